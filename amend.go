@@ -0,0 +1,203 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AmendOpts the options of the image which are changed by Amend. The zero value of the option keeps it unchanged.
+type AmendOpts struct {
+	// ClusterSize the new cluster size of the image in bytes ("cluster_size"), which qemu-img amend does not
+	// support. The image is rewritten with the new cluster size.
+	ClusterSize int
+
+	// Progress is called with the number of bytes of the guest disk which have been rewritten, and the total
+	// number of bytes to be rewritten, same as 'qemu-img amend -p'.
+	Progress func(done, total int64)
+}
+
+// Amend changes the options of the image, same as 'qemu-img amend'.
+//
+// The image whose cluster size is changed is converted to the side file in the same directory, which has the new
+// cluster size and the other options of the image, such as the backing file, the compatibility level and the
+// refcount width. The side file replaces the image file by the rename, so the image file is either the old or the
+// new image even if Amend is interrupted, and the image is reopened from it. Only the top layer of the image is
+// rewritten, and the backing file is shared with the new image. The image which has the internal snapshots, the
+// bitmaps or the encryption can not be re-clustered, nor the image which is not the regular host file.
+//
+// The guest requests wait until Amend is finished.
+//  qemu-img.c: static int img_amend(int argc, char **argv)
+func (q *QCow2) Amend(opts *AmendOpts) error {
+	return q.AmendContext(context.Background(), opts)
+}
+
+// AmendContext is like Amend, but stops rewriting the image when ctx is done, and returns the error of ctx.
+// The image is not changed on the cancellation.
+func (q *QCow2) AmendContext(ctx context.Context, opts *AmendOpts) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		err := errors.Wrapf(ErrUnsupported, "Format driver '%s' does not support option amendment", bs.Drv.formatName)
+		return err
+	}
+	if bs.ReadOnly {
+		err := errors.Wrap(ErrReadOnly, "Cannot amend the read-only image")
+		return err
+	}
+
+	s := bs.Opaque
+	if opts.ClusterSize == 0 || opts.ClusterSize == s.ClusterSize {
+		return nil
+	}
+
+	q.drainReadahead()
+	newBs, err := amendClusterSize(ctx, q, opts)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not change the cluster size of '%s'", bs.Filename)
+		return err
+	}
+
+	// the old image is closed after the guest requests are switched to the new one
+	q.blk.BlockDriverState = newBs
+	q.invalidateReadahead()
+	if err := bdrvUnref(bs); err != nil {
+		bdrvLogf(newBs, LogWarn, "Could not close the old image of '%s': %v", newBs.Filename, err)
+	}
+
+	return nil
+}
+
+// amendClusterSize rewrites the image of q with the cluster size of opts to the side file, replaces the image file
+// with it, and returns the new image opened from it. The caller must hold q.mu for writing.
+func amendClusterSize(ctx context.Context, q *QCow2, opts *AmendOpts) (*BlockDriverState, error) {
+	bs := q.blk.bs()
+	s := bs.Opaque
+
+	clusterBits := ctz32(uint32(opts.ClusterSize))
+	if clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || 1<<uint(clusterBits) != opts.ClusterSize {
+		err := errors.Wrapf(ErrInvalidOption, "Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+		return nil, err
+	}
+	if s.NbSnapshots > 0 {
+		err := errors.Wrap(ErrUnsupported, "Can't change the cluster size of an image which has snapshots")
+		return nil, err
+	}
+	if s.NbBitmaps > 0 {
+		err := errors.Wrap(ErrUnsupported, "Can't change the cluster size of an image which has bitmaps")
+		return nil, err
+	}
+	if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+		err := errors.Wrap(ErrUnsupported, "Can't change the cluster size of an encrypted image")
+		return nil, err
+	}
+
+	fi, err := os.Stat(bs.Filename)
+	if err != nil || strings.Contains(bs.Filename, "://") || !fi.Mode().IsRegular() {
+		err := errors.Wrap(ErrUnsupported, "Can't change the cluster size of an image which is not a regular host file")
+		return nil, err
+	}
+
+	// the side file is in the same directory, so that the rename replaces the image file atomically
+	tmp, err := os.CreateTemp(filepath.Dir(bs.Filename), "."+filepath.Base(bs.Filename)+".amend-")
+	if err != nil {
+		return nil, err
+	}
+	side := tmp.Name()
+	err = tmp.Chmod(fi.Mode().Perm())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(side)
+		return nil, err
+	}
+
+	o := &Opts{
+		Filename:      side,
+		Fmt:           DriverQCow2,
+		BackingFile:   bs.BackingFile,
+		BackingFormat: bs.BackingFormat,
+		ClusterSize:   opts.ClusterSize,
+		RefcountBits:  1 << uint(s.RefcountOrder),
+		LazyRefcounts: s.CompatibleFeatures&uint64(COMPAT_LAZY_REFCOUNTS) != 0,
+		Deterministic: q.blk.deterministic,
+	}
+	if s.Version < Version3 {
+		o.Compat = "0.10"
+	}
+	if err := ConvertContext(ctx, q, o, &ConvertOpts{Progress: opts.Progress}); err != nil {
+		os.Remove(side)
+		return nil, err
+	}
+
+	// the new image must be on the disk before it replaces the image file
+	if err := syncPath(side); err != nil {
+		os.Remove(side)
+		return nil, err
+	}
+	newBs, err := bdrvOpen(side, DriverQCow2, os.O_RDWR, bs.Options)
+	if err != nil {
+		os.Remove(side)
+		return nil, err
+	}
+	if err := os.Rename(side, bs.Filename); err != nil {
+		bdrvUnref(newBs)
+		os.Remove(side)
+		return nil, err
+	}
+	// the rename is durable once the directory is synced, which is not supported on some platforms
+	syncPath(filepath.Dir(bs.Filename))
+
+	newBs.Filename = bs.Filename
+	newBs.ExactFilename = bs.ExactFilename
+	bdrvTransferSettings(bs, newBs)
+
+	return newBs, nil
+}
+
+// bdrvTransferSettings copies the settings of bs which are changed after it is opened to newBs, which replaces bs.
+func bdrvTransferSettings(bs, newBs *BlockDriverState) {
+	if l := bs.logger.Load(); l != nil {
+		newBs.logger.Store(l)
+	}
+	newBs.tracer = bs.tracer
+	newBs.DetectZeroes = bs.DetectZeroes
+
+	bs.acct.mu.Lock()
+	newBs.acct.stats = bs.acct.stats
+	newBs.acct.observer = bs.acct.observer
+	bs.acct.mu.Unlock()
+
+	if s, newS := bs.Opaque, newBs.Opaque; s != nil && newS != nil {
+		newS.DiscardPassthrough = s.DiscardPassthrough
+		newS.WipeFreed = s.WipeFreed
+		newS.SnapshotQuota = s.SnapshotQuota
+		newS.Compression = s.Compression
+	}
+}
+
+// syncPath flushes the file or the directory of path to the disk.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,560 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Backend represents the storage of the image file under the format driver, same as the protocol driver
+// of qemu such as file, nbd and http. The format driver reads and writes the image file only through the
+// Backend, so the image can be stored in the memory, on the network or in the object store.
+//
+// The Backend may implement io.Closer, which is called when the image is closed.
+// The read beyond the end of the image file returns io.EOF, same as *os.File.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Truncate changes the size of the image file to size bytes.
+	Truncate(size int64) error
+	// Sync commits the written data to the stable storage.
+	Sync() error
+	// Size returns the size of the image file in bytes.
+	Size() (int64, error)
+}
+
+// backendDiscarder is implemented by the Backend which can discard the range of the image file.
+// The discard is advisory, and returns ENOTSUP if not supported.
+//  block/block_int.h: int coroutine_fn (*bdrv_co_pdiscard)(BlockDriverState *bs, int64_t offset, int count)
+type backendDiscarder interface {
+	Discard(offset, length int64) error
+}
+
+// backendAllocatedSizer is implemented by the Backend which knows the allocated size of the sparse image file.
+//  block/block_int.h: int64_t (*bdrv_get_allocated_file_size)(BlockDriverState *bs)
+type backendAllocatedSizer interface {
+	AllocatedSize() (int64, error)
+}
+
+// backendCopier is implemented by the Backend which can copy the range of the other Backend into itself without
+// reading the data into the memory, such as by the reflink of the file system.
+// Returns ENOTSUP if the range of src can not be copied.
+//  block/block_int.h: int coroutine_fn (*bdrv_co_copy_range_to)(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+type backendCopier interface {
+	CopyRangeFrom(src Backend, srcOff, dstOff, length int64) error
+}
+
+// FileBackend is the Backend of the host file, or the host device such as the block device and the LVM logical
+// volume, whose size is the size of the device.
+//  block/file-posix.c: BlockDriver bdrv_file
+type FileBackend struct {
+	*os.File
+}
+
+var _ Backend = (*FileBackend)(nil)
+
+// NewFileBackend returns the Backend of the host file f.
+func NewFileBackend(f *os.File) *FileBackend {
+	return &FileBackend{File: f}
+}
+
+// Size implements Backend.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func (f *FileBackend) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if isHostDevice(stat) {
+		return hdevGetlength(f.File)
+	}
+	return stat.Size(), nil
+}
+
+// Truncate implements Backend. The host device can not be resized, so the size which does not exceed the size
+// of the device is accepted without changing it.
+//  block/file-posix.c: static int raw_truncate(BlockDriverState *bs, int64_t offset, PreallocMode prealloc, Error **errp)
+func (f *FileBackend) Truncate(size int64) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !isHostDevice(stat) {
+		return f.File.Truncate(size)
+	}
+
+	length, err := hdevGetlength(f.File)
+	if err != nil {
+		return err
+	}
+	if size > length {
+		err := errors.Wrap(ErrInvalidArgument, "Cannot grow device files")
+		return err
+	}
+
+	return nil
+}
+
+// isHostDevice reports whether the file of fi is the host device, such as the block device.
+//  block/file-posix.c: static int hdev_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func isHostDevice(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0
+}
+
+// removeImageFile removes the image file which is partially written, unless it is the host device.
+func removeImageFile(filename string) {
+	if fi, err := os.Stat(filename); err == nil && isHostDevice(fi) {
+		return
+	}
+	os.Remove(filename)
+}
+
+// createTempFile creates the new file in the directory of filename with perm, whose name is the hidden name of
+// filename with suffix and the random number, so it replaces filename by the rename.
+func createTempFile(filename, suffix string, perm os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, "."+base+"."+suffix+"-"+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// createImageFile creates the new image file of path, which is locked exclusively, and returns it. The new image
+// is created in the temporary file of tmpname, which replaces the existing file of path by the rename, and old is
+// the existing file, which is locked until it is replaced, so the image which is in use is not replaced. The
+// permission, the owner and the group of the existing file are kept. If the existing file can not be replaced
+// without the other changes, such as the file of the hard links, the file of the other owner and the dangling
+// symbolic link, it is returned to be written in place, and tmpname is empty. The filename is the name of the
+// image for the error message.
+func createImageFile(path, filename string) (f *os.File, tmpname string, old *os.File, err error) {
+	fi, serr := os.Stat(path)
+	switch {
+	case serr == nil:
+		old, err = os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if err := bdrvLockImageFile(old, filename, os.O_RDWR); err != nil {
+			old.Close()
+			return nil, "", nil, err
+		}
+		if fileLinks(fi) > 1 {
+			return old, "", nil, nil
+		}
+	case !os.IsNotExist(serr):
+		return nil, "", nil, serr
+	default:
+		if _, lerr := os.Lstat(path); lerr == nil {
+			// the dangling symbolic link, whose target is created
+			f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			if err := bdrvLockImageFile(f, filename, os.O_RDWR); err != nil {
+				f.Close()
+				return nil, "", nil, err
+			}
+			return f, "", nil, nil
+		}
+	}
+
+	perm := os.FileMode(0666)
+	if old != nil {
+		perm = fi.Mode().Perm()
+	}
+	f, err = createTempFile(path, "create", perm)
+	if err != nil {
+		if old != nil {
+			old.Close()
+		}
+		return nil, "", nil, err
+	}
+	if old != nil {
+		// the permission of the old image file is kept regardless of the umask
+		err = f.Chmod(perm)
+		if err == nil && chownLike(f, fi) != nil {
+			// the owner is not changed by the user other than the superuser, so the old image file is
+			// written in place instead
+			f.Close()
+			os.Remove(f.Name())
+			return old, "", nil, nil
+		}
+	}
+	if err == nil {
+		err = bdrvLockImageFile(f, filename, os.O_RDWR)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		if old != nil {
+			old.Close()
+		}
+		return nil, "", nil, err
+	}
+
+	return f, f.Name(), old, nil
+}
+
+// Discard punches the hole of the range of the host file, without changing the file size.
+//  block/file-posix.c: static coroutine_fn BlockAIOCB *raw_aio_pdiscard(BlockDriverState *bs, int64_t offset, int count, BlockCompletionFunc *cb, void *opaque)
+func (f *FileBackend) Discard(offset, length int64) error {
+	return punchHole(f.File, offset, length)
+}
+
+// CopyRangeFrom copies length bytes of src at srcOff to the host file at dstOff in the kernel, by FICLONERANGE
+// or copy_file_range(2). src must be the FileBackend.
+//  block/file-posix.c: static int coroutine_fn raw_co_copy_range_to(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func (f *FileBackend) CopyRangeFrom(src Backend, srcOff, dstOff, length int64) error {
+	sf, ok := src.(*FileBackend)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return copyFileRange(sf.File, srcOff, f.File, dstOff, length)
+}
+
+// AllocatedSize returns the actually allocated size of the host file in bytes.
+//  block/file-posix.c: static int64_t raw_get_allocated_file_size(BlockDriverState *bs)
+func (f *FileBackend) AllocatedSize() (int64, error) {
+	return allocatedFileSize(f.File)
+}
+
+// readerBackend is the read-only Backend of the io.ReaderAt of the fixed size.
+type readerBackend struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// ReadAt implements io.ReaderAt.
+// The read beyond the size returns io.EOF.
+func (b *readerBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > b.size-off {
+		n = int(b.size - off)
+	}
+	k, err := b.r.ReadAt(p[:n], off)
+	if err == nil && k < len(p) {
+		err = io.EOF
+	}
+
+	return k, err
+}
+
+// WriteAt implements io.WriterAt, and always returns EBADF.
+func (b *readerBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EBADF
+}
+
+// Truncate implements Backend, and always returns EBADF.
+func (b *readerBackend) Truncate(size int64) error {
+	return syscall.EBADF
+}
+
+// Sync implements Backend.
+func (b *readerBackend) Sync() error {
+	return nil
+}
+
+// Size implements Backend.
+func (b *readerBackend) Size() (int64, error) {
+	return b.size, nil
+}
+
+// seekerBackend is the Backend of the io.ReadWriteSeeker.
+// The requests are serialized, because each request seeks the io.ReadWriteSeeker.
+// The io.ReadWriteSeeker is not closed, which is owned by the caller.
+type seekerBackend struct {
+	mu sync.Mutex
+	rw io.ReadWriteSeeker
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *seekerBackend) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.rw.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(b.rw, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (b *seekerBackend) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.rw.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return b.rw.Write(p)
+}
+
+// Truncate implements Backend if the io.ReadWriteSeeker has the Truncate method, otherwise returns ENOTSUP.
+func (b *seekerBackend) Truncate(size int64) error {
+	t, ok := b.rw.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return t.Truncate(size)
+}
+
+// Sync implements Backend, and calls the Sync method of the io.ReadWriteSeeker if any.
+func (b *seekerBackend) Sync() error {
+	s, ok := b.rw.(interface {
+		Sync() error
+	})
+	if !ok {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return s.Sync()
+}
+
+// Size implements Backend.
+func (b *seekerBackend) Size() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rw.Seek(0, io.SeekEnd)
+}
+
+// bufferedBackend is the Backend which buffers the writes to the underlying Backend by the cluster in memory.
+// The buffered clusters are written by flush, in the order of the offset, and the contiguous clusters are
+// merged into a write, so the many small writes of the metadata, such as the header fields, the refcount table
+// entries and the refcount blocks, are written by the few cluster-aligned writes.
+// Sync does not write the buffered clusters, so it is only used while the image is created, whose image file
+// is not consistent until it is created.
+type bufferedBackend struct {
+	Backend
+
+	mu          sync.Mutex
+	clusterSize int64
+	// clusters the buffered clusters by the cluster index.
+	clusters map[int64][]byte
+	// size the size of the image file including the buffered writes.
+	size int64
+}
+
+// newBufferedBackend returns the bufferedBackend of b, which buffers the writes by clusterSize bytes.
+// size is the size of the image file, beyond which b reads as zeros, such as the stale data of the host device.
+func newBufferedBackend(b Backend, clusterSize, size int64) *bufferedBackend {
+	return &bufferedBackend{
+		Backend:     b,
+		clusterSize: clusterSize,
+		clusters:    make(map[int64][]byte),
+		size:        size,
+	}
+}
+
+// readBackend reads len(p) bytes of the underlying Backend at off, and fills the range beyond the end of it,
+// or beyond the size of the image file, with zeros.
+func (b *bufferedBackend) readBackend(p []byte, off int64) error {
+	n := 0
+	if off < b.size {
+		n = len(p)
+		if int64(n) > b.size-off {
+			n = int(b.size - off)
+		}
+		k, err := b.Backend.ReadAt(p[:n], off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		n = k
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt. The buffered clusters are read from the memory.
+func (b *bufferedBackend) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > b.size-off {
+		n = int(b.size - off)
+	}
+
+	for pos := 0; pos < n; {
+		idx := (off + int64(pos)) / b.clusterSize
+		inCluster := (off + int64(pos)) % b.clusterSize
+		chunk := MIN(n-pos, int(b.clusterSize-inCluster))
+
+		if c, ok := b.clusters[idx]; ok {
+			copy(p[pos:pos+chunk], c[inCluster:])
+		} else if err := b.readBackend(p[pos:pos+chunk], off+int64(pos)); err != nil {
+			return pos, err
+		}
+		pos += chunk
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. The written clusters are buffered until flush.
+func (b *bufferedBackend) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	for pos := 0; pos < len(p); {
+		idx := (off + int64(pos)) / b.clusterSize
+		inCluster := (off + int64(pos)) % b.clusterSize
+		chunk := MIN(len(p)-pos, int(b.clusterSize-inCluster))
+
+		c, ok := b.clusters[idx]
+		if !ok {
+			c = make([]byte, b.clusterSize)
+			// the cluster which is partially written is read from the underlying Backend
+			if int64(chunk) < b.clusterSize {
+				if err := b.readBackend(c, idx*b.clusterSize); err != nil {
+					return pos, err
+				}
+			}
+			b.clusters[idx] = c
+		}
+		copy(c[inCluster:], p[pos:pos+chunk])
+		pos += chunk
+	}
+
+	if end := off + int64(len(p)); end > b.size {
+		b.size = end
+	}
+
+	return len(p), nil
+}
+
+// Truncate implements Backend. The buffered clusters beyond size are dropped.
+func (b *bufferedBackend) Truncate(size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.Backend.Truncate(size); err != nil {
+		return err
+	}
+
+	for idx, c := range b.clusters {
+		start := idx * b.clusterSize
+		switch {
+		case start >= size:
+			delete(b.clusters, idx)
+		case start+b.clusterSize > size:
+			for i := size - start; i < b.clusterSize; i++ {
+				c[i] = 0
+			}
+		}
+	}
+	b.size = size
+
+	return nil
+}
+
+// Sync implements Backend, and does nothing. The buffered clusters are written by flush.
+func (b *bufferedBackend) Sync() error {
+	return nil
+}
+
+// Size implements Backend.
+func (b *bufferedBackend) Size() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size, nil
+}
+
+// flush writes the buffered clusters to the underlying Backend, and syncs it. The contiguous clusters are
+// written by a write, and the last cluster is written up to the size of the image file.
+func (b *bufferedBackend) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idxs := make([]int64, 0, len(b.clusters))
+	for idx := range b.clusters {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+
+	for i := 0; i < len(idxs); {
+		j := i + 1
+		for j < len(idxs) && idxs[j] == idxs[j-1]+1 && int64(j-i)*b.clusterSize < IO_BUF_SIZE {
+			j++
+		}
+
+		var buf []byte
+		if j-i == 1 {
+			buf = b.clusters[idxs[i]]
+		} else {
+			buf = make([]byte, 0, int64(j-i)*b.clusterSize)
+			for _, idx := range idxs[i:j] {
+				buf = append(buf, b.clusters[idx]...)
+			}
+		}
+
+		start := idxs[i] * b.clusterSize
+		if end := start + int64(len(buf)); end > b.size {
+			buf = buf[:b.size-start]
+		}
+		if _, err := b.Backend.WriteAt(buf, start); err != nil {
+			return err
+		}
+		i = j
+	}
+	b.clusters = make(map[int64][]byte)
+
+	return b.Backend.Sync()
+}
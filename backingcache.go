@@ -0,0 +1,261 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// backendValidator is implemented by the remote Backend which can identify the version of the file, such as the
+// ETag of the HTTP server. The cache of the file is discarded if the validator is changed.
+type backendValidator interface {
+	Validator() string
+}
+
+// CacheBackend is the read-only Backend which reads the remote Backend through the local cache overlay, which is
+// the qcow2 image of the remote file. The clusters which are read from the remote are written to the cache
+// overlay, and are read from it by the following reads, so the remote backing file, such as the cloud image on
+// the HTTP server or the NBD export, is fetched only once by the repeated boots of the VMs on it.
+//
+// The cache overlay records the remote file name as its backing file of the raw format, so the cache overlay is
+// also the valid image of the remote file for qemu. Filling the cache is best effort: the read succeeds even if
+// the fetched data can not be written to the cache overlay, such as on ENOSPC.
+//  block/copy-on-read.c: static int coroutine_fn cor_co_preadv_part(BlockDriverState *bs, int64_t offset, int64_t bytes, QEMUIOVector *qiov, size_t qiov_offset, BdrvRequestFlags flags)
+type CacheBackend struct {
+	remote Backend
+	cache  *QCow2
+	size   int64
+	// clusterSize the size of the cluster of the cache overlay, which is the granularity of the fetch.
+	clusterSize int64
+}
+
+var _ Backend = (*CacheBackend)(nil)
+
+// NewCacheBackend returns the CacheBackend which reads remote through the cache overlay of filename. The cache
+// overlay is created if it does not exist, and is recreated if it is not the cache of the remote file of source,
+// which is the name of the remote file, such as the URL. The cache overlay is locked exclusively until Close, and
+// it fails with ErrLocked if the cache overlay is in use by the other process.
+func NewCacheBackend(remote Backend, source, filename string) (*CacheBackend, error) {
+	size, err := remote.Size()
+	if err != nil {
+		return nil, err
+	}
+	// the virtual size of the image must be the multiple of the sector, and the tail beyond the remote file is
+	// never read
+	virtualSize := (size + int64(BDRV_SECTOR_SIZE) - 1) &^ (int64(BDRV_SECTOR_SIZE) - 1)
+
+	cache, err := openCacheOverlay(filename, source, virtualSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open the cache overlay '%s'", filename)
+	}
+	s := cache.blk.bs().Opaque
+
+	return &CacheBackend{
+		remote:      remote,
+		cache:       cache,
+		size:        size,
+		clusterSize: int64(s.ClusterSize),
+	}, nil
+}
+
+// openCacheOverlay opens the cache overlay of filename without its backing file, or creates it if it does not
+// exist or is not the cache of source of virtualSize.
+func openCacheOverlay(filename, source string, virtualSize int64) (*QCow2, error) {
+	opts := &OpenOpts{
+		NoBacking: true,
+	}
+
+	cache, err := OpenFileOpts(filename, DriverQCow2, os.O_RDWR, opts)
+	if err == nil {
+		info, err := cache.Info()
+		if err == nil && info.VirtualSize == virtualSize && info.BackingFilename == source &&
+			info.BackingFilenameFormat == string(DriverRaw) {
+			return cache, nil
+		}
+		cache.Close()
+	} else if errors.Is(err, ErrLocked) {
+		return nil, err
+	}
+
+	created, err := Create(&Opts{
+		Filename: filename,
+		Fmt:      DriverQCow2,
+		Size:     virtualSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bs := created.blk.bs()
+	err = bdrvChangeBackingFile(bs, source, string(DriverRaw))
+	if cerr := created.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenFileOpts(filename, DriverQCow2, os.O_RDWR, opts)
+}
+
+// ReadAt implements io.ReaderAt. The ranges which are cached are read from the cache overlay, and the others
+// are fetched from the remote by the clusters of the cache overlay, and written to it.
+// The read beyond the size of the remote file returns io.EOF.
+func (c *CacheBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > c.size-off {
+		n = int(c.size - off)
+	}
+
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		status, _, count, err := c.cache.BlockStatus(pos, int64(n-done))
+		if err != nil {
+			return done, err
+		}
+		if count <= 0 {
+			return done, io.ErrUnexpectedEOF
+		}
+
+		buf := p[done : done+int(count)]
+		if status.Flags&StatusHole == 0 {
+			if _, err := c.cache.ReadAt(buf, pos); err != nil && err != io.EOF {
+				return done, err
+			}
+		} else if err := c.fill(buf, pos); err != nil {
+			return done, err
+		}
+		done += int(count)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fill fetches the clusters of the range of p at off from the remote, writes them to the cache overlay, and
+// copies the range to p. The concurrent fills of the same cluster write the same data of the remote.
+func (c *CacheBackend) fill(p []byte, off int64) error {
+	start := off &^ (c.clusterSize - 1)
+	end := (off + int64(len(p)) + c.clusterSize - 1) &^ (c.clusterSize - 1)
+	cacheSize, err := c.cache.VirtualSize()
+	if err != nil {
+		return err
+	}
+	if end > cacheSize {
+		end = cacheSize
+	}
+
+	buf := make([]byte, end-start)
+	remoteEnd := end
+	if remoteEnd > c.size {
+		remoteEnd = c.size
+	}
+	if n, err := c.remote.ReadAt(buf[:remoteEnd-start], start); err != nil && !(err == io.EOF && int64(n) == remoteEnd-start) {
+		return err
+	}
+	copy(p, buf[off-start:])
+
+	// the clusters which are already cached are overwritten with the same data
+	c.cache.WriteAt(buf, start)
+
+	return nil
+}
+
+// WriteAt implements io.WriterAt, and always returns EBADF.
+func (c *CacheBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EBADF
+}
+
+// Truncate implements Backend, and always returns EBADF.
+func (c *CacheBackend) Truncate(size int64) error {
+	return syscall.EBADF
+}
+
+// Sync implements Backend, and flushes the cache overlay.
+func (c *CacheBackend) Sync() error {
+	return c.cache.Flush()
+}
+
+// Size implements Backend, and returns the size of the remote file.
+func (c *CacheBackend) Size() (int64, error) {
+	return c.size, nil
+}
+
+// Close closes the cache overlay, and the remote Backend if it implements io.Closer.
+func (c *CacheBackend) Close() error {
+	err := c.cache.Close()
+	if closer, ok := c.remote.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openBackingCache returns the CacheBackend of the remote backing file of filename in the directory dir, whose
+// name is made of the digests of filename and the validator of remote. The cache overlays of the other versions
+// of the remote file are removed. If the cache overlay is in use by the other process, remote is returned as is.
+func openBackingCache(remote Backend, filename, dir string) (Backend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Could not create the cache directory '%s'", dir)
+	}
+
+	var validator string
+	if v, ok := remote.(backendValidator); ok {
+		validator = v.Validator()
+	}
+	source := sha256.Sum256([]byte(filename))
+	version := sha256.Sum256([]byte(validator))
+	prefix := hex.EncodeToString(source[:])
+	cacheFile := filepath.Join(dir, prefix+"-"+hex.EncodeToString(version[:8])+".qcow2")
+
+	if stale, err := filepath.Glob(filepath.Join(dir, prefix+"-*.qcow2")); err == nil {
+		for _, name := range stale {
+			if name != cacheFile {
+				removeUnlockedImage(name)
+			}
+		}
+	}
+
+	c, err := NewCacheBackend(remote, filename, cacheFile)
+	if errors.Is(err, ErrLocked) {
+		return remote, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// removeUnlockedImage removes the image file of filename unless it is in use.
+func removeUnlockedImage(filename string) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err := lockFile(f, true); err != nil {
+		return
+	}
+	os.Remove(filename)
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// bitmapDirEntrySize the size of the fixed part of the bitmap directory entry.
+	//  sizeof(Qcow2BitmapDirEntry)
+	bitmapDirEntrySize = 24
+
+	// BME_MAX_TABLE_SIZE the maximum number of the entries of the bitmap table.
+	BME_MAX_TABLE_SIZE = 0x8000000
+
+	// BME_TABLE_ENTRY_RESERVED_MASK the reserved bits of the bitmap table entry.
+	BME_TABLE_ENTRY_RESERVED_MASK = uint64(0xff000000000001fe)
+	// BME_TABLE_ENTRY_OFFSET_MASK the host offset of the bitmap table entry.
+	BME_TABLE_ENTRY_OFFSET_MASK = uint64(0x00fffffffffffe00)
+	// BME_TABLE_ENTRY_FLAG_ALL_ONES the cluster of the bitmap table entry reads as all ones.
+	BME_TABLE_ENTRY_FLAG_ALL_ONES = uint64(1)
+)
+
+// bitmapTable represents the bitmap table of the bitmap in the bitmap directory.
+//  block/qcow2-bitmap.c: typedef struct Qcow2BitmapTable
+type bitmapTable struct {
+	offset uint64 // uint64_t
+	size   uint32 // uint32_t: number of 64bit entries
+}
+
+// bitmapListLoad reads the bitmap directory of size bytes at offset, and returns the bitmap tables of the bitmaps.
+//  block/qcow2-bitmap.c: static Qcow2BitmapList *bitmap_list_load(BlockDriverState *bs, uint64_t offset, uint64_t size, Error **errp)
+func bitmapListLoad(bs *BlockDriverState, offset, size uint64) ([]bitmapTable, error) {
+	s := bs.Opaque
+
+	dir := make([]byte, size)
+	if err := bdrvPread(bs.file, int64(offset), dir); err != nil {
+		return nil, err
+	}
+
+	var tables []bitmapTable
+	for pos := uint64(0); pos < size; {
+		if size-pos < bitmapDirEntrySize {
+			return nil, errors.Wrap(ErrInvalidHeader, "Bitmap directory entry is truncated")
+		}
+		e := dir[pos:]
+		table := bitmapTable{
+			offset: BEUint64(e[0:8]),
+			size:   BEUint32(e[8:12]),
+		}
+		nameSize := uint64(BEUint16(e[18:20]))
+		extraDataSize := uint64(BEUint32(e[20:24]))
+
+		entrySize := uint64(alignOffset(int64(bitmapDirEntrySize+extraDataSize+nameSize), 8))
+		if entrySize > size-pos {
+			return nil, errors.Wrap(ErrInvalidHeader, "Bitmap directory entry exceeds the directory")
+		}
+		if offsetIntoCluster(s, int64(table.offset)) != 0 || table.size == 0 || table.size > BME_MAX_TABLE_SIZE {
+			return nil, errors.Wrapf(ErrInvalidHeader, "Invalid bitmap table at offset %#x of %d entries", table.offset, table.size)
+		}
+
+		tables = append(tables, table)
+		pos += entrySize
+	}
+	if len(tables) != int(s.NbBitmaps) {
+		return nil, errors.Wrapf(ErrInvalidHeader, "Bitmap directory has %d bitmaps, expecting %d", len(tables), s.NbBitmaps)
+	}
+
+	return tables, nil
+}
+
+// checkBitmapTableEntry returns the error if the bitmap table entry is invalid.
+//  block/qcow2-bitmap.c: static int check_table_entry(uint64_t entry, int cluster_size)
+func checkBitmapTableEntry(s *BDRVState, entry uint64) error {
+	if entry&BME_TABLE_ENTRY_RESERVED_MASK != 0 {
+		return errors.Wrapf(ErrInvalidHeader, "Bitmap table entry %#x has the reserved bits", entry)
+	}
+
+	offset := entry & BME_TABLE_ENTRY_OFFSET_MASK
+	if offset != 0 {
+		// if offset specified, bit 0 is reserved
+		if entry&BME_TABLE_ENTRY_FLAG_ALL_ONES != 0 {
+			return errors.Wrapf(ErrInvalidHeader, "Bitmap table entry %#x has both the offset and the all-ones flag", entry)
+		}
+		if offsetIntoCluster(s, int64(offset)) != 0 {
+			return errors.Wrapf(ErrInvalidHeader, "Bitmap data cluster %#x is not cluster aligned", offset)
+		}
+	}
+
+	return nil
+}
+
+// checkBitmapsRefcounts increases the refcount of the bitmap directory, the bitmap tables and the bitmap data
+// clusters in refcountTable, which is the refcount table of the check built in memory.
+//  block/qcow2-bitmap.c: int qcow2_check_bitmaps_refcounts(BlockDriverState *bs, BdrvCheckResult *res, void **refcount_table, int64_t *refcount_table_size)
+func checkBitmapsRefcounts(bs *BlockDriverState, res *BdrvCheckResult, refcountTable *[]uint64) error {
+	s := bs.Opaque
+
+	if s.NbBitmaps == 0 {
+		return nil
+	}
+
+	incRefcounts(bs, res, refcountTable, int64(s.BitmapDirectoryOffset), int64(s.BitmapDirectorySize))
+
+	tables, err := bitmapListLoad(bs, s.BitmapDirectoryOffset, s.BitmapDirectorySize)
+	if err != nil {
+		bdrvLogf(bs, LogError, "ERROR bitmap directory at offset %#x is corrupted", s.BitmapDirectoryOffset)
+		res.Corruptions++
+		return err
+	}
+
+	for _, table := range tables {
+		incRefcounts(bs, res, refcountTable, int64(table.offset), int64(table.size)*UINT64_SIZE)
+
+		buf := make([]byte, uint64(table.size)*UINT64_SIZE)
+		if err := bdrvPread(bs.file, int64(table.offset), buf); err != nil {
+			res.Corruptions++
+			break
+		}
+
+		for i := 0; i < int(table.size); i++ {
+			entry := BEUint64(buf[i*UINT64_SIZE:])
+			offset := entry & BME_TABLE_ENTRY_OFFSET_MASK
+
+			if err := checkBitmapTableEntry(s, entry); err != nil {
+				res.Corruptions++
+				continue
+			}
+			if offset == 0 {
+				continue
+			}
+
+			incRefcounts(bs, res, refcountTable, int64(offset), int64(s.ClusterSize))
+		}
+	}
+
+	return nil
+}
@@ -8,7 +8,15 @@ package qcow2
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
 )
 
 // BlockOption represents a block options.
@@ -23,11 +31,873 @@ type BlockBackend struct {
 	allowBeyondEOF   bool
 	BlockDriverState *BlockDriverState
 
+	// enableWriteCache reports whether the writes are completed without flushing them, the writeback cache mode.
+	enableWriteCache bool
+	// deterministic reports whether the image is kept reproducible, see Opts.Deterministic.
+	deterministic bool
+
 	buf bytes.Buffer
 
+	// resizeNotifiers called with the new size after the image is resized. The slice is replaced, never modified
+	// in place, so the copy taken by truncate is not changed by the removal of a notifier.
+	resizeNotifiers []*resizeNotifier
+
 	Error error
 }
 
 func (blk *BlockBackend) bs() *BlockDriverState {
 	return blk.BlockDriverState
 }
+
+// checkByteRequest checks the request of size bytes at offset is in the range of the image.
+//  block/block-backend.c: static int blk_check_byte_request(BlockBackend *blk, int64_t offset, size_t size)
+func (blk *BlockBackend) checkByteRequest(offset, size int64) error {
+	bs := blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	if size < 0 || offset < 0 {
+		return syscall.EIO
+	}
+
+	if !blk.allowBeyondEOF {
+		length, err := getlength(bs)
+		if err != nil {
+			return err
+		}
+
+		if offset > length || length-offset < size {
+			return syscall.EIO
+		}
+	}
+
+	return nil
+}
+
+// pread reads len(buf) bytes of the guest data at offset in ctx.
+//  block/block-backend.c: int blk_pread(BlockBackend *blk, int64_t offset, void *buf, int count)
+func (blk *BlockBackend) pread(ctx context.Context, offset int64, buf []byte) error {
+	if err := blk.checkByteRequest(offset, int64(len(buf))); err != nil {
+		return err
+	}
+
+	err := bdrvAlignedPreadv(ctx, blk.bs(), offset, buf)
+	blockAcctDone(blk.bs(), StatsRead, int64(len(buf)), err)
+
+	return err
+}
+
+// pwrite writes buf to the guest data at offset with flags.
+// In the writethrough cache mode, the write is flushed.
+//  block/block-backend.c: int blk_pwrite(BlockBackend *blk, int64_t offset, const void *buf, int count, BdrvRequestFlags flags)
+func (blk *BlockBackend) pwrite(ctx context.Context, offset int64, buf []byte, flags BdrvRequestFlags) error {
+	if err := blk.checkByteRequest(offset, int64(len(buf))); err != nil {
+		return err
+	}
+
+	if !blk.enableWriteCache {
+		flags |= BDRV_REQ_FUA
+	}
+
+	err := bdrvAlignedPwritev(ctx, blk.bs(), offset, buf, flags)
+	blockAcctDone(blk.bs(), StatsWrite, int64(len(buf)), err)
+
+	return err
+}
+
+// pwriteCompressed writes buf to the guest data at offset as the compressed clusters.
+// In the writethrough cache mode, the write is flushed.
+//  block/block-backend.c: int blk_pwrite_compressed(BlockBackend *blk, int64_t offset, const void *buf, int count)
+func (blk *BlockBackend) pwriteCompressed(ctx context.Context, offset int64, buf []byte) error {
+	if err := blk.checkByteRequest(offset, int64(len(buf))); err != nil {
+		return err
+	}
+
+	flags := BDRV_REQ_WRITE_COMPRESSED
+	if !blk.enableWriteCache {
+		flags |= BDRV_REQ_FUA
+	}
+
+	err := bdrvAlignedPwritev(ctx, blk.bs(), offset, buf, flags)
+	blockAcctDone(blk.bs(), StatsWrite, int64(len(buf)), err)
+
+	return err
+}
+
+// pwriteZeroes writes zeros to the guest data from offset to offset+count.
+// In the writethrough cache mode, the write is flushed.
+//  block/block-backend.c: int blk_pwrite_zeroes(BlockBackend *blk, int64_t offset, int count, BdrvRequestFlags flags)
+func (blk *BlockBackend) pwriteZeroes(ctx context.Context, offset, count int64, flags BdrvRequestFlags) error {
+	if err := blk.checkByteRequest(offset, count); err != nil {
+		return err
+	}
+
+	if !blk.enableWriteCache {
+		flags |= BDRV_REQ_FUA
+	}
+
+	err := bdrvCoPwriteZeroes(ctx, blk.bs(), offset, count, flags)
+	blockAcctDone(blk.bs(), StatsWriteZeroes, count, err)
+
+	return err
+}
+
+// copyRange copies bytes of the guest data at offset to the guest data of dst at dstOff, without reading the
+// data into the memory, such as by the reflink of the host file system. Returns ENOTSUP if the images can not
+// copy the range, then the caller reads and writes the data instead.
+// In the writethrough cache mode of dst, the copy is flushed.
+//  block/block-backend.c: int coroutine_fn blk_co_copy_range(BlockBackend *blk_in, int64_t off_in, BlockBackend *blk_out, int64_t off_out, int64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func (blk *BlockBackend) copyRange(ctx context.Context, offset int64, dst *BlockBackend, dstOff, bytes int64) error {
+	if err := blk.checkByteRequest(offset, bytes); err != nil {
+		return err
+	}
+	if err := dst.checkByteRequest(dstOff, bytes); err != nil {
+		return err
+	}
+
+	err := bdrvCoCopyRange(ctx, blk.bs(), offset, dst.bs(), dstOff, bytes)
+	if err == nil && !dst.enableWriteCache {
+		err = bdrvCoFlush(dst.bs())
+	}
+	if errors.Is(err, syscall.ENOTSUP) {
+		return err
+	}
+	blockAcctDone(blk.bs(), StatsRead, bytes, err)
+	blockAcctDone(dst.bs(), StatsWrite, bytes, err)
+
+	return err
+}
+
+// pdiscard discards the guest data from offset to offset+count.
+//  block/block-backend.c: int blk_pdiscard(BlockBackend *blk, int64_t offset, int count)
+func (blk *BlockBackend) pdiscard(ctx context.Context, offset, count int64) error {
+	if err := blk.checkByteRequest(offset, count); err != nil {
+		return err
+	}
+
+	err := bdrvCoPdiscard(ctx, blk.bs(), offset, count)
+	blockAcctDone(blk.bs(), StatsDiscard, count, err)
+
+	return err
+}
+
+// flush writes the data cached in memory to the image file, and flushes the image file. The flush is traced
+// in ctx.
+//  block/block-backend.c: int blk_flush(BlockBackend *blk)
+func (blk *BlockBackend) flush(ctx context.Context) error {
+	bs := blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	_, span := traceStart(ctx, bs, TraceFlush, 0, 0)
+	err := bdrvCoFlush(bs)
+	span.End(err)
+	blockAcctDone(bs, StatsFlush, 0, err)
+
+	return err
+}
+
+// sync is like flush, but always flushes the image file even if nothing is written after the last flush.
+func (blk *BlockBackend) sync(ctx context.Context) error {
+	bs := blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	_, span := traceStart(ctx, bs, TraceFlush, 0, 0)
+	err := bdrvCoSync(bs)
+	span.End(err)
+	blockAcctDone(bs, StatsFlush, 0, err)
+
+	return err
+}
+
+// bdrvRefreshLimits refreshes the block limits of bs by the image file and the format driver.
+//  block/io.c: void bdrv_refresh_limits(BlockDriverState *bs, Error **errp)
+func bdrvRefreshLimits(bs *BlockDriverState) {
+	bs.BL = BlockLimits{}
+
+	// take over the alignments of the image file, such as the file opened for the direct I/O
+	if l, ok := bs.File.(backendLimiter); ok {
+		bs.BL = l.Limits()
+	}
+
+	if bs.Drv != nil && bs.Drv.bdrvRefreshLimits != nil {
+		bs.Drv.bdrvRefreshLimits(bs)
+	}
+}
+
+// bdrvDrivers list of the registered block drivers.
+var bdrvDrivers = make(map[DriverFmt]*BlockDriver)
+
+// bdrvRegister registers the block driver.
+//  block.c: void bdrv_register(BlockDriver *bdrv)
+func bdrvRegister(drv *BlockDriver) {
+	bdrvDrivers[drv.formatName] = drv
+}
+
+// bdrvFindFormat return the block driver of the format name, or nil if not registered.
+//  block.c: BlockDriver *bdrv_find_format(const char *format_name)
+func bdrvFindFormat(format DriverFmt) *BlockDriver {
+	return bdrvDrivers[format]
+}
+
+// bdrvProbeAll returns the driver whose probe gives the highest score to buf, and the score.
+// It returns nil if no driver matches.
+//  block.c: BlockDriver *bdrv_probe_all(const uint8_t *buf, int buf_size, const char *filename)
+func bdrvProbeAll(buf []byte, filename string) (*BlockDriver, int) {
+	var drv *BlockDriver
+	scoreMax := 0
+	for _, d := range bdrvDrivers {
+		if d.bdrvProbe == nil {
+			continue
+		}
+		if score := d.bdrvProbe(buf, filename); score > scoreMax {
+			scoreMax = score
+			drv = d
+		}
+	}
+
+	return drv, scoreMax
+}
+
+// Probe returns the format of the image whose first bytes are buf, and the score of the probe from 1 to 100.
+// buf should be the first BLOCK_PROBE_BUF_SIZE bytes of the image file; the shorter buf is padded with zeros.
+// The file which matches no format is probed as raw, with the lowest score.
+//  block.c: BlockDriver *bdrv_probe_all(const uint8_t *buf, int buf_size, const char *filename)
+func Probe(buf []byte) (DriverFmt, int) {
+	if len(buf) < BLOCK_PROBE_BUF_SIZE {
+		b := make([]byte, BLOCK_PROBE_BUF_SIZE)
+		copy(b, buf)
+		buf = b
+	}
+
+	drv, score := bdrvProbeAll(buf, "")
+	if drv == nil {
+		return "", 0
+	}
+
+	return drv.formatName, score
+}
+
+// DetectFormat probes the format of the image file of path by its first BLOCK_PROBE_BUF_SIZE bytes.
+//  block.c: static int find_image_format(BlockBackend *file, const char *filename, BlockDriver **pdrv, Error **errp)
+func DetectFormat(path string) (DriverFmt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, BLOCK_PROBE_BUF_SIZE)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "Could not read image for determining its format")
+	}
+
+	format, _ := Probe(buf)
+	return format, nil
+}
+
+// findImageFormat probes the format of the image file.
+// The unknown format is treated as raw, same as qemu.
+//  block.c: static int find_image_format(BlockBackend *file, const char *filename, BlockDriver **pdrv, Error **errp)
+func findImageFormat(bs *BlockDriverState) (*BlockDriver, error) {
+	buf := make([]byte, BLOCK_PROBE_BUF_SIZE)
+	if err := bdrvPread(bs.file, 0, buf); err != nil {
+		return nil, errors.Wrap(err, "Could not read image for determining its format")
+	}
+
+	drv, _ := bdrvProbeAll(buf, bs.Filename)
+	if drv == nil {
+		err := errors.Wrap(ErrUnknownFormat, "Could not determine image format: No compatible driver found")
+		return nil, err
+	}
+
+	return drv, nil
+}
+
+// bdrvOpen opens the image file with the format driver and the options.
+// If format is empty, the format is probed from the image file.
+//  block.c: BlockDriverState *bdrv_open(const char *filename, const char *reference, QDict *options, int flags, Error **errp)
+func bdrvOpen(filename string, format DriverFmt, flag int, opts *OpenOpts) (*BlockDriverState, error) {
+	return bdrvOpenInherit(filename, format, flag, opts, nil)
+}
+
+// bdrvOpenInherit is like bdrvOpen, but opens the image file as the backing file of parent.
+//  block.c: static int bdrv_open_inherit(BlockDriverState **pbs, const char *filename, const char *reference, QDict *options, int flags, BlockDriverState *parent, const BdrvChildRole *child_role, Error **errp)
+func bdrvOpenInherit(filename string, format DriverFmt, flag int, opts *OpenOpts, parent *BlockDriverState) (*BlockDriverState, error) {
+	if opts != nil && opts.ReadOnly {
+		flag = readOnlyFlag(flag)
+	}
+	if opts != nil && opts.Force && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err := errors.Wrap(ErrInvalidOption, "force-share=on can only be used with read-only images")
+		return nil, err
+	}
+
+	var backend Backend
+	if i := strings.Index(filename, "://"); i > 0 {
+		open := bdrvFindProtocol(filename[:i])
+		if open == nil {
+			return nil, errors.Wrapf(ErrUnknownFormat, "Unknown protocol '%s'", filename[:i])
+		}
+		b, err := open(filename, flag)
+		if err != nil {
+			return nil, err
+		}
+		backend = b
+
+		if parent != nil && opts != nil && opts.BackingCacheDir != "" && flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			c, err := openBackingCache(b, filename, opts.BackingCacheDir)
+			if err != nil {
+				if closer, ok := b.(io.Closer); ok {
+					closer.Close()
+				}
+				return nil, err
+			}
+			backend = c
+		}
+	} else {
+		var file *os.File
+		if opts != nil && opts.Direct {
+			b, err := openDirectBackend(filename, flag)
+			if err != nil {
+				return nil, err
+			}
+			backend, file = b, b.File
+		} else {
+			f, err := os.OpenFile(filename, flag, os.FileMode(0))
+			if err != nil {
+				return nil, err
+			}
+			backend, file = NewFileBackend(f), f
+		}
+
+		if opts == nil || !opts.Force {
+			if err := bdrvLockImageFile(file, filename, flag); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if opts != nil && opts.WrapBackend != nil {
+		backend = opts.WrapBackend(backend)
+	}
+
+	bs, err := bdrvOpenBackend(backend, filename, format, flag, opts, parent)
+	if err != nil {
+		if c, ok := backend.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// bdrvLockImageFile takes the lock of the image file f, which is exclusive if the image is opened for writing,
+// and shared otherwise, so the image which is written by the other process is neither written nor read.
+//  block/file-posix.c: static int raw_check_lock_bytes(int fd, uint64_t perm, uint64_t shared_perm, Error **errp)
+func bdrvLockImageFile(f *os.File, filename string, flag int) error {
+	exclusive := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if err := lockFile(f, exclusive); err != nil {
+		if err == syscall.EAGAIN {
+			err = ErrLocked
+		}
+		lock := "shared \"write\""
+		if exclusive {
+			lock = "\"write\""
+		}
+		return errors.Wrapf(err, "Failed to get %s lock: Is another process using the image [%s]?", lock, filename)
+	}
+
+	return nil
+}
+
+// readOnlyFlag returns the open flag without the flags which write to the image file, so the image file
+// is neither created nor truncated.
+//  block.c: int bdrv_apply_auto_read_only(BlockDriverState *bs, const char *errmsg, Error **errp)
+func readOnlyFlag(flag int) int {
+	return flag &^ (os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_EXCL | os.O_TRUNC)
+}
+
+// ProtocolOpenFunc opens the Backend of the filename URL with the open flag.
+//  block/block_int.h: int (*bdrv_file_open)(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+type ProtocolOpenFunc func(filename string, flag int) (Backend, error)
+
+var (
+	protocolsMu sync.RWMutex
+	protocols   = make(map[string]ProtocolOpenFunc)
+)
+
+// RegisterProtocol registers the protocol driver of the URL scheme, such as "nbd" for "nbd://host/export".
+// The filename which has the "scheme://" prefix, including the backing file name in the image header,
+// is opened by the open function of the scheme instead of the host file.
+// RegisterProtocol is usually called from the init function of the package which implements the protocol.
+//  block.c: void bdrv_register(BlockDriver *bdrv)
+func RegisterProtocol(scheme string, open ProtocolOpenFunc) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+
+	if open == nil {
+		panic("qcow2: RegisterProtocol open is nil")
+	}
+	if _, dup := protocols[scheme]; dup {
+		panic("qcow2: RegisterProtocol called twice for protocol " + scheme)
+	}
+	protocols[scheme] = open
+}
+
+// bdrvFindProtocol returns the open function of the registered scheme, or nil.
+//  block.c: BlockDriver *bdrv_find_protocol(const char *filename, bool allow_protocol_prefix, Error **errp)
+func bdrvFindProtocol(scheme string) ProtocolOpenFunc {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	return protocols[scheme]
+}
+
+// bdrvOpenBackend opens the image file of the backend with the format driver and the options.
+// parent is the overlay of the image if it is opened as the backing file, or nil.
+func bdrvOpenBackend(backend Backend, filename string, format DriverFmt, flag int, opts *OpenOpts, parent *BlockDriverState) (*BlockDriverState, error) {
+	bs := &BlockDriverState{
+		Filename:     filename,
+		File:         backend,
+		OpenFlags:    flag,
+		ReadOnly:     flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		Options:      opts,
+		Refcnt:       1,
+		inheritsFrom: parent,
+	}
+	// the overlay is only referred while the backing chain is opened
+	defer func() { bs.inheritsFrom = nil }()
+	if opts != nil && opts.Logger != nil {
+		bs.logger.Store(loggerHolder{opts.Logger})
+	}
+
+	bs.file = &BdrvChild{
+		bs:   bs,
+		Name: filename,
+	}
+	// the format driver allocates the buffers of the metadata by the limits of the image file
+	bdrvRefreshLimits(bs)
+
+	if err := bdrvOpenCommon(bs, format, flag); err != nil {
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// bdrvOpenCommon opens the format driver of bs, and the backing file if the driver supports it.
+//  block.c: static int bdrv_open_common(BlockDriverState *bs, BlockBackend *file, QDict *options, Error **errp)
+func bdrvOpenCommon(bs *BlockDriverState, format DriverFmt, flag int) error {
+	var drv *BlockDriver
+	if format == "" {
+		var err error
+		drv, err = findImageFormat(bs)
+		if err != nil {
+			return err
+		}
+	} else {
+		drv = bdrvFindFormat(format)
+		if drv == nil {
+			return errors.Wrapf(ErrUnknownFormat, "Unknown driver '%s'", format)
+		}
+	}
+
+	bs.Drv = drv
+	if drv.instanceSize > 0 {
+		bs.Opaque = new(BDRVState)
+	}
+
+	if err := drv.bdrvOpen(bs, nil, flag); err != nil {
+		return err
+	}
+
+	bdrvRefreshLimits(bs)
+
+	if err := refreshTotalSectors(bs, bs.TotalSectors); err != nil {
+		if drv.bdrvClose != nil {
+			drv.bdrvClose(bs)
+		}
+		return errors.Wrap(err, "Could not refresh total sector count")
+	}
+
+	// the image is opened without the backing file by the NoBacking option, same as BDRV_O_NO_BACKING
+	if drv.supportsBacking && (bs.Options == nil || !bs.Options.NoBacking) {
+		if err := openBacking(bs); err != nil {
+			if drv.bdrvClose != nil {
+				drv.bdrvClose(bs)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MAX_BACKING_DEPTH the default maximum number of the backing files in the backing chain.
+const MAX_BACKING_DEPTH = 256
+
+// backingKey identifies the opened backing file which is shared by the images.
+type backingKey struct {
+	filename string
+	format   DriverFmt
+	direct   bool
+	cacheDir string
+}
+
+var (
+	// bdrvRefMu guards the Refcnt of the BlockDriverStates and backingStates.
+	bdrvRefMu sync.Mutex
+	// backingStates the opened backing files, which are shared by the images on the same backing file.
+	backingStates = make(map[backingKey]*BlockDriverState)
+)
+
+// openBacking opens the backing file of bs as read-only. The backing file which is already opened as the
+// backing file of the other image is shared, and is closed when the last image which refers to it is closed.
+//  block.c: int bdrv_open_backing_file(BlockDriverState *bs, QDict *parent_options, const char *bdref_key, Error **errp)
+func openBacking(bs *BlockDriverState) error {
+	if bs.BackingFile == "" {
+		return nil
+	}
+
+	filename := pathCombine(bs.Filename, bs.BackingFile)
+	if err := bdrvCheckBackingChain(bs, filename); err != nil {
+		return err
+	}
+
+	// the backing file inherits the direct I/O and the force share of the parent, same as the "cache.direct"
+	// and the "force-share" options of qemu, and the cache of the remote backing files
+	var opts *OpenOpts
+	if bs.Options != nil && (bs.Options.Direct || bs.Options.Force || bs.Options.BackingCacheDir != "") {
+		opts = &OpenOpts{
+			Direct:          bs.Options.Direct,
+			Force:           bs.Options.Force,
+			BackingCacheDir: bs.Options.BackingCacheDir,
+		}
+	}
+
+	key := backingKey{
+		filename: filename,
+		format:   DriverFmt(bs.BackingFormat),
+		direct:   opts != nil && opts.Direct,
+	}
+	if opts != nil {
+		key.cacheDir = opts.BackingCacheDir
+	}
+	if !strings.Contains(filename, "://") {
+		if abs, err := filepath.Abs(filename); err == nil {
+			key.filename = abs
+		}
+	}
+
+	backing := bdrvLookupBacking(key)
+	if backing == nil {
+		b, err := bdrvOpenInherit(filename, key.format, os.O_RDONLY, opts, bs)
+		if err != nil {
+			return errors.Wrapf(err, "Could not open backing file %s", filename)
+		}
+		backing = bdrvRegisterBacking(key, b)
+	}
+
+	bs.Backing = &BdrvChild{
+		bs:   backing,
+		Name: filename,
+	}
+
+	return nil
+}
+
+// bdrvCheckBackingChain checks that the backing file filename of bs is not bs or the overlays of bs, which
+// are being opened, that the backing chain is not deeper than the maximum depth of the top image, and that
+// filename passes the CheckBacking of the top image.
+//  qemu-img.c: static ImageInfoList *collect_image_info_list(bool image_opts, const char *filename, const char *fmt, bool chain, bool force_share)
+func bdrvCheckBackingChain(bs *BlockDriverState, filename string) error {
+	fi, statErr := os.Stat(filename)
+
+	depth := 0
+	top := bs
+	for p := bs; p != nil; p = p.inheritsFrom {
+		depth++
+		top = p
+
+		if sameImageFile(p.Filename, filename, fi, statErr) {
+			err := errors.Wrapf(ErrBackingLoop, "Backing file '%s' creates an infinite loop", filename)
+			return err
+		}
+	}
+
+	maxDepth := MAX_BACKING_DEPTH
+	if top.Options != nil && top.Options.MaxBackingDepth > 0 {
+		maxDepth = top.Options.MaxBackingDepth
+	}
+	if depth > maxDepth {
+		err := errors.Wrapf(ErrBackingTooDeep, "Backing file '%s' exceeds the maximum backing chain depth %d", filename, maxDepth)
+		return err
+	}
+	if top.Options != nil && top.Options.CheckBacking != nil {
+		if err := top.Options.CheckBacking(filename); err != nil {
+			return errors.Wrapf(err, "Could not open backing file %s", filename)
+		}
+	}
+
+	return nil
+}
+
+// sameImageFile reports whether the image file name refers to the file filename, whose FileInfo is fi.
+// The host files are compared by the device and the inode, so the hard links and the symbolic links to the
+// same file are detected.
+func sameImageFile(name, filename string, fi os.FileInfo, statErr error) bool {
+	if name == filename {
+		return true
+	}
+	if statErr != nil || strings.Contains(name, "://") {
+		return false
+	}
+
+	nfi, err := os.Stat(name)
+	return err == nil && os.SameFile(nfi, fi)
+}
+
+// bdrvLookupBacking returns the opened backing file of key with the new reference, or nil if it is not opened.
+// The opened backing file whose file name now refers to the other file, such as the backing file which is
+// replaced by the rename of the new image over it, is not returned, and is unregistered. It is still used by
+// the images which have opened it, and is closed when the last of them is closed.
+func bdrvLookupBacking(key backingKey) *BlockDriverState {
+	bdrvRefMu.Lock()
+	defer bdrvRefMu.Unlock()
+
+	backing := backingStates[key]
+	if backing == nil {
+		return nil
+	}
+	if !backingIsCurrent(backing, key.filename) {
+		delete(backingStates, key)
+		return nil
+	}
+	backing.Refcnt++
+
+	return backing
+}
+
+// bdrvRegisterBacking registers the opened backing file bs of key, and returns it. If the same backing file
+// is registered by the concurrent open, bs is closed and the registered one is returned with the new reference.
+// The registered backing file which is replaced is unregistered, same as bdrvLookupBacking.
+func bdrvRegisterBacking(key backingKey, bs *BlockDriverState) *BlockDriverState {
+	bdrvRefMu.Lock()
+	if registered := backingStates[key]; registered != nil && backingIsCurrent(registered, key.filename) {
+		registered.Refcnt++
+		bdrvRefMu.Unlock()
+
+		bdrvUnref(bs)
+		return registered
+	}
+	backingStates[key] = bs
+	bdrvRefMu.Unlock()
+
+	return bs
+}
+
+// backingIsCurrent reports whether the host file of the opened backing file bs is still the file of filename,
+// which is compared by the device and the inode. The remote backing files and the Backends which are not the
+// host file are always current.
+func backingIsCurrent(bs *BlockDriverState, filename string) bool {
+	if strings.Contains(filename, "://") {
+		return true
+	}
+	f, ok := bs.File.(interface {
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return true
+	}
+
+	ofi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fi, ofi)
+}
+
+// bdrvRef adds the reference to bs.
+//  block.c: void bdrv_ref(BlockDriverState *bs)
+func bdrvRef(bs *BlockDriverState) {
+	bdrvRefMu.Lock()
+	defer bdrvRefMu.Unlock()
+
+	bs.Refcnt++
+}
+
+// bdrvUnref releases the reference to bs, and closes bs when the last reference is released.
+//  block.c: void bdrv_unref(BlockDriverState *bs)
+func bdrvUnref(bs *BlockDriverState) error {
+	bdrvRefMu.Lock()
+	bs.Refcnt--
+	if bs.Refcnt > 0 {
+		bdrvRefMu.Unlock()
+		return nil
+	}
+	for key, backing := range backingStates {
+		if backing == bs {
+			delete(backingStates, key)
+		}
+	}
+	bdrvRefMu.Unlock()
+
+	return bdrvClose(bs)
+}
+
+// bdrvClose flushes bs, leaves the image consistent by the format driver, and closes the format driver and the
+// image file of bs, which releases the lock of the image file. The reference to the backing file is released.
+//  block.c: static void bdrv_close(BlockDriverState *bs)
+func bdrvClose(bs *BlockDriverState) error {
+	bdrvDrainedBegin(bs)
+	defer bdrvDrainedEnd(bs)
+
+	err := bdrvCoFlush(bs)
+
+	if bs.Drv != nil && bs.Drv.bdrvInactivate != nil {
+		if ierr := bs.Drv.bdrvInactivate(bs); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	if bs.Drv != nil && bs.Drv.bdrvClose != nil {
+		bs.Drv.bdrvClose(bs)
+	}
+	bs.Drv = nil
+
+	if bs.Backing != nil {
+		if cerr := bdrvUnref(bs.Backing.bs); cerr != nil && err == nil {
+			err = cerr
+		}
+		bs.Backing = nil
+	}
+
+	if c, ok := bs.File.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		bs.File = nil
+	}
+	bs.file = nil
+
+	return err
+}
+
+// bdrvChangeBackingFile changes the backing file name and the backing format recorded in the image of bs.
+// The opened backing file is not changed.
+//  block.c: int bdrv_change_backing_file(BlockDriverState *bs, const char *backing_file, const char *backing_fmt)
+func bdrvChangeBackingFile(bs *BlockDriverState, backingFile, backingFmt string) error {
+	drv := bs.Drv
+	if drv == nil {
+		return ENOMEDIUM
+	}
+	if drv.bdrvChangeBackingFile == nil {
+		return syscall.ENOTSUP
+	}
+	if bs.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// Backing file format doesn't make sense without a backing file
+	if backingFmt != "" && backingFile == "" {
+		return syscall.EINVAL
+	}
+
+	return drv.bdrvChangeBackingFile(bs, backingFile, backingFmt)
+}
+
+// bdrvHasZeroInit reports whether the newly created image of bs reads as zeros. The image which has the
+// backing file is initialized to the contents of the backing file, which may not be zeros.
+//  block.c: int bdrv_has_zero_init(BlockDriverState *bs)
+func bdrvHasZeroInit(bs *BlockDriverState) bool {
+	if bs.Drv == nil {
+		return false
+	}
+
+	// If BS is a copy on write image, it is initialized to
+	// the contents of the base image, which may not be zeroes.
+	if bs.Backing != nil {
+		return false
+	}
+	if bs.Drv.bdrvHasZeroInit != nil {
+		return bs.Drv.bdrvHasZeroInit(bs)
+	}
+
+	// safe default
+	return false
+}
+
+// bdrvHasZeroInit1 reports that the new image always reads as zeros.
+//  block.c: int bdrv_has_zero_init_1(BlockDriverState *bs)
+func bdrvHasZeroInit1(bs *BlockDriverState) bool {
+	return true
+}
+
+// bdrvTruncate truncates the image of bs to offset bytes.
+//  block.c: int bdrv_truncate(BdrvChild *child, int64_t offset)
+func bdrvTruncate(bs *BlockDriverState, offset int64) error {
+	drv := bs.Drv
+	if drv == nil {
+		return ENOMEDIUM
+	}
+	if drv.bdrvTruncate == nil {
+		return syscall.ENOTSUP
+	}
+	if bs.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := drv.bdrvTruncate(bs, offset); err != nil {
+		return err
+	}
+	bs.mu.Lock()
+	bs.WriteGen++
+	bs.mu.Unlock()
+
+	return refreshTotalSectors(bs, offset>>BDRV_SECTOR_BITS)
+}
+
+// truncate truncates the image to offset bytes, and notifies the new size to the registered resize notifiers.
+// The in-flight requests are completed before the image is resized, and the new requests wait until
+// the resize is finished.
+//  block/block-backend.c: int blk_truncate(BlockBackend *blk, int64_t offset)
+func (blk *BlockBackend) truncate(offset int64) error {
+	bs := blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	bdrvDrainedBegin(bs)
+	err := bdrvTruncate(bs, offset)
+	notifiers := blk.resizeNotifiers
+	bdrvDrainedEnd(bs)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range notifiers {
+		n.fn(offset)
+	}
+
+	return nil
+}
+
+// pathCombine return the path of filename relative to the directory of basePath.
+// If filename is absolute path, returns filename as is.
+//  cutils.c: void path_combine(char *dest, int dest_size, const char *base_path, const char *filename)
+func pathCombine(basePath, filename string) string {
+	if filepath.IsAbs(filename) || strings.Contains(filename, "://") {
+		return filename
+	}
+	return filepath.Join(filepath.Dir(basePath), filename)
+}
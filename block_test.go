@@ -0,0 +1,64 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBackingReplaced replaces the backing file by the rename while the overlay is open, and opens the other
+// overlay of it, which must read the new backing file, not the opened one of the same name.
+func TestBackingReplaced(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.raw")
+	old := bytes.Repeat([]byte("old!"), 1024)
+	if err := os.WriteFile(base, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay := func(name string) *QCow2 {
+		t.Helper()
+		img, err := CreateImage(filepath.Join(dir, name), int64(len(old)), WithBackingFile(base, DriverRaw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	read := func(img *QCow2) []byte {
+		t.Helper()
+		buf := make([]byte, len(old))
+		if _, err := img.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	img1 := overlay("overlay1.qcow2")
+	defer img1.Close()
+
+	renewed := bytes.Repeat([]byte("new!"), 1024)
+	tmp := filepath.Join(dir, "base.tmp")
+	if err := os.WriteFile(tmp, renewed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, base); err != nil {
+		t.Fatal(err)
+	}
+
+	img2 := overlay("overlay2.qcow2")
+	defer img2.Close()
+
+	if !bytes.Equal(read(img2), renewed) {
+		t.Error("the new overlay reads the replaced backing file")
+	}
+	if !bytes.Equal(read(img1), old) {
+		t.Error("the open overlay does not read its opened backing file")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"os"
+	"sync"
+)
+
+// The size classes of the pooled buffers, which are the powers of 2 from the minimum to the maximum
+// cluster size. The buffer larger than the maximum cluster size is not pooled.
+const (
+	bufPoolMinBits = MIN_CLUSTER_BITS
+	bufPoolMaxBits = MAX_CLUSTER_BITS
+)
+
+var (
+	// bufPools the pools of the buffers of each size class, which hold *[]byte of the whole class size.
+	bufPools [bufPoolMaxBits - bufPoolMinBits + 1]sync.Pool
+	// bufPoolAlign the alignment of the pooled buffers, which satisfies the memory alignment of the direct I/O.
+	bufPoolAlign = MAX(MAX_BLOCKSIZE, os.Getpagesize())
+
+	// zeroBlock the zeros written by zeroFill, which is never modified.
+	zeroBlock [32 << 10]byte
+)
+
+// bufPoolClass returns the size class of size bytes.
+func bufPoolClass(size int) int {
+	class := 0
+	for 1<<uint(bufPoolMinBits+class) < size {
+		class++
+	}
+	return class
+}
+
+// bufPoolGet returns the buffer of size bytes whose address is aligned to align, such as the bounce buffer
+// and the cluster buffer of the request, from the pool of the buffers. The contents of the buffer are
+// undefined. The buffer should be returned by bufPoolPut after the request, so the requests reuse the buffers
+// instead of allocating them, which reduces the GC pressure of the high IOPS.
+//  block/io.c: void *qemu_try_blockalign(BlockDriverState *bs, size_t size)
+func bufPoolGet(align, size int) []byte {
+	if size > 1<<bufPoolMaxBits || align > bufPoolAlign {
+		if align <= 0 {
+			align = bufPoolAlign
+		}
+		return qemuMemalign(align, size)
+	}
+
+	class := bufPoolClass(size)
+	if p, ok := bufPools[class].Get().(*[]byte); ok {
+		return (*p)[:size]
+	}
+	return qemuMemalign(bufPoolAlign, 1<<uint(bufPoolMinBits+class))[:size]
+}
+
+// bufPoolPut returns the buffer b returned by bufPoolGet to the pool. b must not be used after that.
+//  util/oslib-posix.c: void qemu_vfree(void *ptr)
+func bufPoolPut(b []byte) {
+	c := cap(b)
+	if c < 1<<bufPoolMinBits || c > 1<<bufPoolMaxBits || c&(c-1) != 0 {
+		return
+	}
+
+	b = b[:c]
+	bufPools[bufPoolClass(c)].Put(&b)
+}
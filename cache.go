@@ -0,0 +1,504 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// CachedTable represents the entry of the Cache.
+//  block/qcow2-cache.c: typedef struct Qcow2CachedTable
+type CachedTable struct {
+	// Offset the offset of the cached table in the image file, or 0 if the entry is not used.
+	Offset int64 // int64_t
+	// LruCounter the value of the Cache.LruCounter when the table was last used.
+	LruCounter uint64 // uint64_t
+	// Ref the number of the users of the table. The table which is in use is not evicted.
+	Ref int // int
+	// Dirty reports whether the table is modified and not written to the image file yet.
+	Dirty bool // bool
+}
+
+// Cache represents the cache of the metadata tables of the image, such as the L2 tables.
+// Each table is the cluster of the image file as is, and the least recently used table
+// is evicted when the new table is loaded. The dirty tables are written back to the image
+// file on the eviction and the flush.
+//  block/qcow2-cache.c: struct Qcow2Cache
+type Cache struct {
+	Entries    []CachedTable // Qcow2CachedTable *
+	Size       int           // int
+	LruCounter uint64        // uint64_t
+	// CacheCleanLruCounter the value of LruCounter at the last cleaning of the unused entries.
+	CacheCleanLruCounter uint64 // uint64_t
+
+	// Depends the cache which must be flushed before the dirty tables of this cache are written.
+	Depends *Cache // struct Qcow2Cache *
+	// DependsOnFlush reports whether the image file must be flushed before the dirty tables of this cache are written.
+	DependsOnFlush bool // bool
+
+	tableSize  int    // the size of a table, which is the cluster size
+	tableArray []byte // void *
+
+	// mu guards the entries, which are shared by the concurrent reads.
+	// The contents of the tables are modified only with the metadata lock of the image held for writing.
+	mu sync.Mutex
+	// released is signaled when the table is no longer in use.
+	released *sync.Cond
+}
+
+// cacheCreate creates the cache of numTables tables of bs.
+//  block/qcow2-cache.c: Qcow2Cache *qcow2_cache_create(BlockDriverState *bs, int num_tables)
+func cacheCreate(bs *BlockDriverState, numTables int) *Cache {
+	s := bs.Opaque
+
+	c := &Cache{
+		Entries:    make([]CachedTable, numTables),
+		Size:       numTables,
+		tableSize:  s.ClusterSize,
+		tableArray: qemuBlockalign(bs, numTables*s.ClusterSize),
+	}
+	c.released = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// cacheGetTableAddr returns the table of the i-th entry.
+//  block/qcow2-cache.c: static inline void *qcow2_cache_get_table_addr(BlockDriverState *bs, Qcow2Cache *c, int table)
+func cacheGetTableAddr(c *Cache, i int) []byte {
+	return c.tableArray[i*c.tableSize : (i+1)*c.tableSize : (i+1)*c.tableSize]
+}
+
+// cacheGetTableIdx returns the index of the entry of table.
+//  block/qcow2-cache.c: static inline int qcow2_cache_get_table_idx(BlockDriverState *bs, Qcow2Cache *c, void *table)
+func cacheGetTableIdx(c *Cache, table []byte) int {
+	tableOffset := uintptr(unsafe.Pointer(&table[0])) - uintptr(unsafe.Pointer(&c.tableArray[0]))
+	return int(tableOffset) / c.tableSize
+}
+
+// cacheEntryFlush writes the i-th entry to the image file if it is dirty.
+// The caller must hold c.mu.
+//  block/qcow2-cache.c: static int qcow2_cache_entry_flush(BlockDriverState *bs, Qcow2Cache *c, int i)
+func cacheEntryFlush(bs *BlockDriverState, c *Cache, i int) error {
+	e := &c.Entries[i]
+	if !e.Dirty || e.Offset == 0 {
+		return nil
+	}
+
+	if c.Depends != nil {
+		if err := cacheFlushDependency(bs, c); err != nil {
+			return err
+		}
+	} else if c.DependsOnFlush {
+		if err := bdrvFlush(bs.file); err != nil {
+			return err
+		}
+		c.DependsOnFlush = false
+	}
+
+	s := bs.Opaque
+	ign := 0
+	if c == s.L2TableCache {
+		ign = QCOW2_OL_ACTIVE_L2
+	} else if c == s.RefcountBlockCache {
+		ign = QCOW2_OL_REFCOUNT_BLOCK
+	}
+	if err := preWriteOverlapCheck(bs, ign, e.Offset, int64(c.tableSize)); err != nil {
+		return err
+	}
+
+	if err := bdrvPwrite(bs.file, e.Offset, cacheGetTableAddr(c, i)); err != nil {
+		return err
+	}
+	e.Dirty = false
+
+	return nil
+}
+
+// cacheWrite writes all dirty entries to the image file.
+// The remaining entries are written even if the write of an entry is failed, and the first error is returned.
+//  block/qcow2-cache.c: int qcow2_cache_write(BlockDriverState *bs, Qcow2Cache *c)
+func cacheWrite(bs *BlockDriverState, c *Cache) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result error
+	for i := range c.Entries {
+		if err := cacheEntryFlush(bs, c, i); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// cacheFlush writes all dirty entries to the image file, and flushes the image file.
+//  block/qcow2-cache.c: int qcow2_cache_flush(BlockDriverState *bs, Qcow2Cache *c)
+func cacheFlush(bs *BlockDriverState, c *Cache) error {
+	if err := cacheWrite(bs, c); err != nil {
+		return err
+	}
+
+	return bdrvFlush(bs.file)
+}
+
+// cacheFlushDependency flushes the cache which c depends on, and clears the dependency.
+// The caller must hold c.mu.
+//  block/qcow2-cache.c: static int qcow2_cache_flush_dependency(BlockDriverState *bs, Qcow2Cache *c)
+func cacheFlushDependency(bs *BlockDriverState, c *Cache) error {
+	if err := cacheFlush(bs, c.Depends); err != nil {
+		return err
+	}
+
+	c.Depends = nil
+	c.DependsOnFlush = false
+
+	return nil
+}
+
+// cacheSetDependency makes the dirty tables of c be written after all dirty tables of dependency are flushed,
+// such as the L2 tables which refer to the clusters whose refcounts are increased.
+//  block/qcow2-cache.c: int qcow2_cache_set_dependency(BlockDriverState *bs, Qcow2Cache *c, Qcow2Cache *dependency)
+func cacheSetDependency(bs *BlockDriverState, c, dependency *Cache) error {
+	// the dependency must not depend on another cache, which can make the circular dependency
+	dependency.mu.Lock()
+	if dependency.Depends != nil {
+		if err := cacheFlushDependency(bs, dependency); err != nil {
+			dependency.mu.Unlock()
+			return err
+		}
+	}
+	dependency.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Depends != nil && c.Depends != dependency {
+		if err := cacheFlushDependency(bs, c); err != nil {
+			return err
+		}
+	}
+	c.Depends = dependency
+
+	return nil
+}
+
+// cacheDependsOnFlush makes the dirty tables of c be written after the image file is flushed.
+//  block/qcow2-cache.c: void qcow2_cache_depends_on_flush(Qcow2Cache *c)
+func cacheDependsOnFlush(c *Cache) {
+	c.mu.Lock()
+	c.DependsOnFlush = true
+	c.mu.Unlock()
+}
+
+// cacheDoGet returns the table at offset, and marks it as in use.
+// If readFromDisk is false, the table is not read from the image file, and the caller must fill it.
+// The read of the table is traced in ctx.
+//  block/qcow2-cache.c: static int qcow2_cache_do_get(BlockDriverState *bs, Qcow2Cache *c, uint64_t offset, void **table, bool read_from_disk)
+func cacheDoGet(ctx context.Context, bs *BlockDriverState, c *Cache, offset int64, readFromDisk bool) ([]byte, error) {
+	if offset == 0 || offset&int64(c.tableSize-1) != 0 {
+		err := signalCorruption(bs, true, offset, "Cannot get entry from cache: Offset %#x is unaligned", offset)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		// Check if the table is already cached
+		minLru := ^uint64(0)
+		minLruIndex := -1
+		for i := range c.Entries {
+			e := &c.Entries[i]
+			if e.Offset == offset {
+				e.Ref++
+				blockAcctCache(bs, c, true)
+				return cacheGetTableAddr(c, i), nil
+			}
+			if e.Ref == 0 && e.LruCounter < minLru {
+				minLru = e.LruCounter
+				minLruIndex = i
+			}
+		}
+
+		if minLruIndex == -1 {
+			// all tables are used by the concurrent requests, wait for the release of them
+			c.released.Wait()
+			continue
+		}
+
+		// Cache miss: write a table back and replace it
+		i := minLruIndex
+		span := traceCacheMiss(ctx, bs, c, offset, readFromDisk)
+		if err := cacheEntryFlush(bs, c, i); err != nil {
+			span.End(err)
+			return nil, err
+		}
+
+		table := cacheGetTableAddr(c, i)
+		c.Entries[i].Offset = 0
+		if readFromDisk {
+			if err := bdrvPread(bs.file, offset, table); err != nil {
+				span.End(err)
+				return nil, err
+			}
+		}
+		span.End(nil)
+
+		c.Entries[i].Offset = offset
+		c.Entries[i].Ref++
+		if readFromDisk {
+			blockAcctCache(bs, c, false)
+		}
+
+		return table, nil
+	}
+}
+
+// cacheGet returns the table at offset read from the image file in ctx, or the cached table.
+// The table must be released by cachePut.
+//  block/qcow2-cache.c: int qcow2_cache_get(BlockDriverState *bs, Qcow2Cache *c, uint64_t offset, void **table)
+func cacheGet(ctx context.Context, bs *BlockDriverState, c *Cache, offset int64) ([]byte, error) {
+	return cacheDoGet(ctx, bs, c, offset, true)
+}
+
+// cacheGetEmpty returns the table of offset without reading it from the image file.
+// The table must be released by cachePut.
+//  block/qcow2-cache.c: int qcow2_cache_get_empty(BlockDriverState *bs, Qcow2Cache *c, uint64_t offset, void **table)
+func cacheGetEmpty(bs *BlockDriverState, c *Cache, offset int64) ([]byte, error) {
+	return cacheDoGet(context.Background(), bs, c, offset, false)
+}
+
+// cachePut releases the table returned by cacheGet.
+//  block/qcow2-cache.c: void qcow2_cache_put(BlockDriverState *bs, Qcow2Cache *c, void **table)
+func cachePut(c *Cache, table []byte) {
+	i := cacheGetTableIdx(c, table)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &c.Entries[i]
+	e.Ref--
+	if e.Ref == 0 {
+		c.LruCounter++
+		e.LruCounter = c.LruCounter
+		c.released.Broadcast()
+	}
+}
+
+// cacheEntryMarkDirty marks the table as dirty, which is written back to the image file later.
+//  block/qcow2-cache.c: void qcow2_cache_entry_mark_dirty(BlockDriverState *bs, Qcow2Cache *c, void *table)
+func cacheEntryMarkDirty(c *Cache, table []byte) {
+	i := cacheGetTableIdx(c, table)
+
+	c.mu.Lock()
+	c.Entries[i].Dirty = true
+	c.mu.Unlock()
+}
+
+// cacheIsTableOffset returns the cached table at offset, or nil if the table is not cached.
+//  block/qcow2-cache.c: void *qcow2_cache_is_table_offset(BlockDriverState *bs, Qcow2Cache *c, uint64_t offset)
+func cacheIsTableOffset(c *Cache, offset int64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.Entries {
+		if c.Entries[i].Offset == offset {
+			return cacheGetTableAddr(c, i)
+		}
+	}
+
+	return nil
+}
+
+// cacheDiscard drops the table from the cache without writing it back, such as the table of the freed cluster.
+//  block/qcow2-cache.c: void qcow2_cache_discard(BlockDriverState *bs, Qcow2Cache *c, void *table)
+func cacheDiscard(c *Cache, table []byte) {
+	i := cacheGetTableIdx(c, table)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Entries[i].Offset = 0
+	c.Entries[i].LruCounter = 0
+	c.Entries[i].Dirty = false
+}
+
+// cacheDiscardOffset drops the table at offset from c if it is cached, which is called when the cluster at offset is freed.
+func cacheDiscardOffset(c *Cache, offset int64) {
+	if c == nil {
+		return
+	}
+	if table := cacheIsTableOffset(c, offset); table != nil {
+		cacheDiscard(c, table)
+	}
+}
+
+// readCacheSizes returns the size of the L2 table cache and the refcount block cache in bytes by the options of bs.
+//  block/qcow2.c: static void read_cache_sizes(BlockDriverState *bs, QemuOpts *opts, uint64_t *l2_cache_size, uint64_t *refcount_cache_size, Error **errp)
+func readCacheSizes(bs *BlockDriverState) (uint64, uint64, error) {
+	s := bs.Opaque
+
+	var opts OpenOpts
+	if bs.Options != nil {
+		opts = *bs.Options
+	}
+	if opts.L2CacheSize < 0 || opts.RefcountCacheSize < 0 {
+		err := errors.Wrap(ErrInvalidOption, "Cache size must not be negative")
+		return 0, 0, err
+	}
+
+	l2CacheSize := uint64(opts.L2CacheSize)
+	refcountCacheSize := uint64(opts.RefcountCacheSize)
+
+	switch {
+	case l2CacheSize == 0 && refcountCacheSize == 0:
+		l2CacheSize = uint64(DEFAULT_L2_CACHE_BYTE_SIZE)
+		if n := uint64(DEFAULT_L2_CACHE_CLUSTERS) * uint64(s.ClusterSize); n > l2CacheSize {
+			l2CacheSize = n
+		}
+		refcountCacheSize = l2CacheSize / DEFAULT_L2_REFCOUNT_SIZE_RATIO
+	case l2CacheSize == 0:
+		l2CacheSize = refcountCacheSize * DEFAULT_L2_REFCOUNT_SIZE_RATIO
+	case refcountCacheSize == 0:
+		refcountCacheSize = l2CacheSize / DEFAULT_L2_REFCOUNT_SIZE_RATIO
+	}
+
+	return l2CacheSize, refcountCacheSize, nil
+}
+
+// initCaches creates the L2 table cache and the refcount block cache of bs.
+//  block/qcow2.c: static int qcow2_update_options_prepare(BlockDriverState *bs, Qcow2ReopenState *r, QDict *options, int flags, Error **errp)
+func initCaches(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	l2CacheSize, refcountCacheSize, err := readCacheSizes(bs)
+	if err != nil {
+		return err
+	}
+
+	l2CacheSize /= uint64(s.ClusterSize)
+	if l2CacheSize < MIN_L2_CACHE_SIZE {
+		l2CacheSize = MIN_L2_CACHE_SIZE
+	}
+	refcountCacheSize /= uint64(s.ClusterSize)
+	if refcountCacheSize < MIN_REFCOUNT_CACHE_SIZE {
+		refcountCacheSize = MIN_REFCOUNT_CACHE_SIZE
+	}
+	if l2CacheSize > INT_MAX || refcountCacheSize > INT_MAX {
+		err := errors.Wrap(ErrInvalidOption, "L2 cache size too big")
+		return err
+	}
+
+	var cacheCleanInterval time.Duration
+	if bs.Options != nil {
+		cacheCleanInterval = bs.Options.CacheCleanInterval
+	}
+	if cacheCleanInterval < 0 || cacheCleanInterval > UINT_MAX*time.Second {
+		err := errors.Wrap(ErrInvalidOption, "Cache clean interval too big")
+		return err
+	}
+
+	s.L2TableCache = cacheCreate(bs, int(l2CacheSize))
+	s.RefcountBlockCache = cacheCreate(bs, int(refcountCacheSize))
+	s.CacheCleanInterval = cacheCleanInterval
+
+	return nil
+}
+
+// canCleanEntry reports whether the i-th entry is unused since the last cleaning, and can be dropped.
+// The caller must hold c.mu.
+//  block/qcow2-cache.c: static inline bool can_clean_entry(Qcow2Cache *c, int i)
+func canCleanEntry(c *Cache, i int) bool {
+	t := &c.Entries[i]
+	return t.Ref == 0 && !t.Dirty && t.Offset != 0 && t.LruCounter <= c.CacheCleanLruCounter
+}
+
+// cacheCleanUnused drops the clean entries which are unused since the last cleaning.
+//  block/qcow2-cache.c: void qcow2_cache_clean_unused(Qcow2Cache *c)
+func cacheCleanUnused(c *Cache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.Entries {
+		if canCleanEntry(c, i) {
+			c.Entries[i].Offset = 0
+			c.Entries[i].LruCounter = 0
+		}
+	}
+
+	c.CacheCleanLruCounter = c.LruCounter
+}
+
+// cacheCleanTimer is the background goroutine which cleans the caches periodically.
+//  block/qcow2.c: QEMUTimer *cache_clean_timer
+type cacheCleanTimer struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// cacheCleanTimerCb drops the unused entries of the L2 table cache and the refcount block cache.
+//  block/qcow2.c: static void cache_clean_timer_cb(void *opaque)
+func cacheCleanTimerCb(bs *BlockDriverState) {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cacheCleanUnused(s.L2TableCache)
+	cacheCleanUnused(s.RefcountBlockCache)
+}
+
+// cacheCleanTimerInit starts the cleaning of the caches every s.CacheCleanInterval, if it is not zero.
+//  block/qcow2.c: static void cache_clean_timer_init(BlockDriverState *bs, AioContext *context)
+func cacheCleanTimerInit(bs *BlockDriverState) {
+	s := bs.Opaque
+
+	if s.CacheCleanInterval == 0 {
+		return
+	}
+
+	t := &cacheCleanTimer{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.cacheCleanTimer = t
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(s.CacheCleanInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				cacheCleanTimerCb(bs)
+			}
+		}
+	}()
+}
+
+// cacheCleanTimerDel stops the cleaning of the caches, and waits for the running cleaning.
+//  block/qcow2.c: static void cache_clean_timer_del(BlockDriverState *bs)
+func cacheCleanTimerDel(bs *BlockDriverState) {
+	s := bs.Opaque
+
+	if s.cacheCleanTimer == nil {
+		return
+	}
+
+	close(s.cacheCleanTimer.stop)
+	<-s.cacheCleanTimer.done
+	s.cacheCleanTimer = nil
+}
@@ -6,54 +6,57 @@
 
 package qcow2
 
-/*
-#include <stdint.h>
-#include <stdlib.h>
-
-static inline int ctz32(uint32_t val)
-{
-    // Binary search for the trailing one bit
-    int cnt;
-
-    cnt = 0;
-    if (!(val & 0x0000FFFFUL)) {
-        cnt += 16;
-        val >>= 16;
-    }
-    if (!(val & 0x000000FFUL)) {
-        cnt += 8;
-        val >>= 8;
-    }
-    if (!(val & 0x0000000FUL)) {
-        cnt += 4;
-        val >>= 4;
-    }
-    if (!(val & 0x00000003UL)) {
-        cnt += 2;
-        val >>= 2;
-    }
-    if (!(val & 0x00000001UL)) {
-        cnt++;
-        val >>= 1;
-    }
-    if (!(val & 0x00000001UL)) {
-        cnt++;
-    }
-
-    return cnt;
-}
-*/
-import "C"
-import "unsafe"
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
+// ctz32 returns the number of the trailing zero bits of val, or 32 if val is zero.
+//  include/qemu/host-utils.h: static inline int ctz32(uint32_t val)
 func ctz32(val uint32) int {
-	i := C.ctz32(C.uint32_t(val))
-	return int(i)
+	return bits.TrailingZeros32(val)
+}
+
+// sizeSuffixes the multipliers of the size suffixes.
+//  util/cutils.c: static int64_t suffix_mul(char suffix, int64_t unit)
+var sizeSuffixes = map[byte]float64{
+	'b': 1,
+	'k': 1 << 10,
+	'm': 1 << 20,
+	'g': 1 << 30,
+	't': 1 << 40,
+	'p': 1 << 50,
+	'e': 1 << 60,
 }
 
-func posixMemalign(alignment uint64, size uint64) []byte {
-	var ptr C.void
-	ptr2 := unsafe.Pointer(&ptr)
-	writesize := C.posix_memalign(&ptr2, C.size_t(uintptr(alignment)), C.size_t(uintptr(size)))
-	return []byte(C.GoBytes(unsafe.Pointer(&ptr), writesize))
+// ParseSize parses the size in bytes, such as "10G", "512M" and "1.5T", which may have the case insensitive
+// b, k, M, G, T, P or E suffix of the power of 1024. The size without the suffix is in bytes, and must be an
+// integer. The size which is not less than 8 EiB fails with ERANGE, and the other invalid size fails with EINVAL.
+//  util/cutils.c: int qemu_strtosz(const char *nptr, const char **end, uint64_t *result)
+func ParseSize(s string) (int64, error) {
+	num := s
+	mul := float64(1)
+	if n := len(s); n > 0 {
+		if m, ok := sizeSuffixes[strings.ToLower(s[n-1:])[0]]; ok {
+			num = s[:n-1]
+			mul = m
+		}
+	}
+
+	val, err := strconv.ParseFloat(num, 64)
+	if err != nil || val < 0 || math.IsNaN(val) || (mul == 1 && val != math.Trunc(val)) {
+		err := errors.Wrap(ErrInvalidArgument, "Invalid image size specified. You may use k, M, G, T, P or E suffixes for kilobytes, megabytes, gigabytes, terabytes, petabytes and exabytes.")
+		return 0, err
+	}
+	size := val * mul
+	if size >= math.MaxInt64 {
+		err := errors.Wrap(ErrTooLarge, "Image size must be less than 8 EiB!")
+		return 0, err
+	}
+
+	return int64(size), nil
 }
@@ -0,0 +1,105 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// ImageCheck represents the result of the consistency check of the image.
+// The json field names are the same as the 'qemu-img check --output=json' output.
+//  qapi/block-core.json: { 'struct': 'ImageCheck' }
+type ImageCheck struct {
+	Filename           string    `json:"filename"`
+	Format             DriverFmt `json:"format"`
+	CheckErrors        int       `json:"check-errors"`
+	ImageEndOffset     int64     `json:"image-end-offset,omitempty"`
+	Corruptions        int       `json:"corruptions,omitempty"`
+	Leaks              int       `json:"leaks,omitempty"`
+	CorruptionsFixed   int       `json:"corruptions-fixed,omitempty"`
+	LeaksFixed         int       `json:"leaks-fixed,omitempty"`
+	TotalClusters      int64     `json:"total-clusters,omitempty"`
+	AllocatedClusters  int64     `json:"allocated-clusters,omitempty"`
+	FragmentedClusters int64     `json:"fragmented-clusters,omitempty"`
+	CompressedClusters int64     `json:"compressed-clusters,omitempty"`
+}
+
+// Check checks the consistency of the metadata of the image, such as the refcounts of the clusters and the
+// OFLAG_COPIED flags, and repairs the inconsistencies by fix. The image must be opened as read-write to
+// repair it, and with OpenOpts.Repair if it is marked as corrupt. If something is repaired, the image is
+// checked again, and the returned result reports the remaining inconsistencies with the repaired ones.
+// The inconsistencies found are reported to the Logger of the image.
+// The returned error is not nil if the check could not be completed.
+//  qemu-img.c: static int collect_image_check(BlockDriverState *bs, ImageCheck *check, const char *filename, const char *fmt, int fix)
+func (q *QCow2) Check(fix CheckMode) (*ImageCheck, error) {
+	return q.CheckContext(context.Background(), fix)
+}
+
+// CheckContext is like Check, but stops checking when ctx is done, and returns the error of ctx.
+// The refcounts are counted before anything is repaired, so the cancellation while counting leaves the image
+// as is. The repair which has been started is completed.
+func (q *QCow2) CheckContext(ctx context.Context, fix CheckMode) (*ImageCheck, error) {
+	defer trace.StartRegion(ctx, "qcow2.Check").End()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return nil, ENOMEDIUM
+	}
+	if bs.Drv.bdrvCheck == nil {
+		err := errors.Wrap(ErrUnsupported, "This image format does not support checks")
+		return nil, err
+	}
+	if fix != 0 && bs.ReadOnly {
+		err := errors.Wrap(ErrReadOnly, "Cannot repair the read-only image")
+		return nil, err
+	}
+	q.drainReadahead()
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	var res BdrvCheckResult
+	if err := bs.Drv.bdrvCheck(ctx, bs, &res, fix); err != nil {
+		err = errors.Wrap(err, "Check failed")
+		return nil, err
+	}
+
+	check := &ImageCheck{
+		Filename:         bs.Filename,
+		Format:           bs.Drv.formatName,
+		CorruptionsFixed: res.CorruptionsFixed,
+		LeaksFixed:       res.LeaksFixed,
+	}
+
+	// check the repaired image again, and report the remaining inconsistencies
+	if fix != 0 && (res.CorruptionsFixed > 0 || res.LeaksFixed > 0) {
+		// the repair may change the guest data of the corrupt clusters
+		q.invalidateReadahead()
+
+		res = BdrvCheckResult{}
+		if err := bs.Drv.bdrvCheck(ctx, bs, &res, 0); err != nil {
+			err = errors.Wrap(err, "Check failed")
+			return nil, err
+		}
+	}
+
+	check.CheckErrors = res.CheckErrors
+	check.Corruptions = res.Corruptions
+	check.Leaks = res.Leaks
+	check.ImageEndOffset = res.ImageEndOffset
+	check.TotalClusters = res.Bfi.TotalClusters
+	check.AllocatedClusters = res.Bfi.AllocatedClusters
+	check.FragmentedClusters = res.Bfi.FragmentedClusters
+	check.CompressedClusters = res.Bfi.CompressedClusters
+
+	return check, nil
+}
@@ -7,13 +7,22 @@
 package qcow2
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
 	"syscall"
+	"unsafe"
 
-	"github.com/zchee/go-qcow2/internal/mem"
+	"github.com/pkg/errors"
 )
 
 const DEBUG_ALLOC2 = false
 
+// growL1Table grows the active L1 table of the image to hold at least minSize entries.
+// If exactSize is false, the table is grown more than minSize to reduce the number of times.
+//  block/qcow2-cluster.c: int qcow2_grow_l1_table(BlockDriverState *bs, uint64_t min_size, bool exact_size)
 func growL1Table(bs *BlockDriverState, minSize uint64, exactSize bool) error {
 	s := bs.Opaque
 	var newL1Size int64
@@ -26,7 +35,7 @@ func growL1Table(bs *BlockDriverState, minSize uint64, exactSize bool) error {
 	// (this prevents overflows during the while loop for the calculation of
 	// new_l1_size)
 	if minSize > INT_MAX/UINT64_SIZE {
-		return syscall.EFBIG
+		return errors.Wrap(ErrTooLarge, "L1 table too large")
 	}
 
 	if exactSize {
@@ -43,70 +52,793 @@ func growL1Table(bs *BlockDriverState, minSize uint64, exactSize bool) error {
 	}
 
 	if newL1Size > MAX_L1_SIZE/UINT64_SIZE {
-		return syscall.EFBIG
+		return errors.Wrap(ErrTooLarge, "L1 table too large")
 	}
 
+	oldL1Table, err := s.L1Table.entries(bs)
+	if err != nil {
+		return err
+	}
 	newL1Size2 := UINT64_SIZE * newL1Size
-	align := bdrvOptMemAlign(bs)
-	newL1Table := posixMemalign(uint64(align), uint64(alignOffset(newL1Size2, 512)))
-	if newL1Table == nil {
-		return syscall.ENOMEM
+	newL1Entries := make([]uint64, newL1Size)
+	copy(newL1Entries, oldL1Table)
+
+	// write new table (align to cluster)
+	newL1TableOffset, err := AllocClusters(bs, uint64(newL1Size2))
+	if err != nil {
+		return err
 	}
-	mem.Set(newL1Table, byte(alignOffset(newL1Size2, 512)))
 
-	mem.Cpy(newL1Table, []byte{byte(s.L1Table)}, uintptr(s.L1Size*UINT64_SIZE))
+	if err := preWriteOverlapCheck(bs, 0, newL1TableOffset, newL1Size2); err != nil {
+		freeClusters(bs, newL1TableOffset, newL1Size2, DISCARD_OTHER)
+		return err
+	}
+
+	buf := make([]byte, newL1Size2)
+	for i, e := range newL1Entries {
+		copy(buf[i*UINT64_SIZE:], BEUvarint64(e))
+	}
+	if err := bdrvPwriteSync(bs.file, newL1TableOffset, buf); err != nil {
+		freeClusters(bs, newL1TableOffset, newL1Size2, DISCARD_OTHER)
+		return err
+	}
+
+	// set new table
+	data := make([]byte, UINT32_SIZE+UINT64_SIZE)
+	copy(data, BEUvarint32(uint32(newL1Size)))
+	copy(data[UINT32_SIZE:], BEUvarint64(uint64(newL1TableOffset)))
+	if err := bdrvPwriteSync(bs.file, int64(unsafe.Offsetof(Header{}.L1Size)), data); err != nil {
+		freeClusters(bs, newL1TableOffset, newL1Size2, DISCARD_OTHER)
+		return err
+	}
+
+	oldL1TableOffset := s.L1TableOffset
+	s.L1TableOffset = uint64(newL1TableOffset)
+	s.L1Table = newL1Table(s.L1TableOffset, int(newL1Size))
+	oldL1Size := s.L1Size
+	s.L1Size = int(newL1Size)
+	freeClusters(bs, int64(oldL1TableOffset), int64(oldL1Size)*UINT64_SIZE, DISCARD_OTHER)
+
+	return nil
+}
+
+// l2Load loads the L2 table at l2Offset through the L2 table cache.
+// The returned table must be released by cachePut.
+//  block/qcow2-cluster.c: static int l2_load(BlockDriverState *bs, uint64_t l2_offset, uint64_t **l2_table)
+func l2Load(ctx context.Context, bs *BlockDriverState, l2Offset uint64) ([]byte, error) {
+	s := bs.Opaque
+
+	return cacheGet(ctx, bs, s.L2TableCache, int64(l2Offset))
+}
+
+// getL2Entry returns the idx-th entry of the L2 table.
+//  block/qcow2.h: static inline uint64_t get_l2_entry(BDRVQcow2State *s, uint64_t *l2_slice, int idx)
+func getL2Entry(l2Table []byte, idx int) uint64 {
+	return BEUint64(l2Table[idx*UINT64_SIZE:])
+}
+
+// setL2Entry sets the idx-th entry of the L2 table to entry.
+//  block/qcow2.h: static inline void set_l2_entry(BDRVQcow2State *s, uint64_t *l2_slice, int idx, uint64_t entry)
+func setL2Entry(l2Table []byte, idx int, entry uint64) {
+	copy(l2Table[idx*UINT64_SIZE:], BEUvarint64(entry))
+}
+
+// countContiguousClusters checks how many clusters are already allocated and don't require a copy on write.
+//  block/qcow2-cluster.c: static int count_contiguous_clusters(int nb_clusters, int cluster_size, uint64_t *l2_table, uint64_t stop_flags)
+func countContiguousClusters(nbClusters int, clusterSize int, l2Table []byte, stopFlags uint64) int {
+	mask := stopFlags | L2E_OFFSET_MASK | OFLAG_COMPRESSED
+	offset := getL2Entry(l2Table, 0) & mask
+
+	if offset == 0 {
+		return 0
+	}
+
+	i := 0
+	for ; i < nbClusters; i++ {
+		l2Entry := getL2Entry(l2Table, i) & mask
+		if offset+uint64(i)*uint64(clusterSize) != l2Entry {
+			break
+		}
+	}
+
+	return i
+}
+
+// countContiguousClustersByType checks how many consecutive clusters are the same cluster type.
+//  block/qcow2-cluster.c: static int count_contiguous_clusters_by_type(int nb_clusters, uint64_t *l2_table, int wanted_type)
+func countContiguousClustersByType(nbClusters int, l2Table []byte, wantedType CLUSTER) int {
+	i := 0
+	for ; i < nbClusters; i++ {
+		if getClusterType(getL2Entry(l2Table, i)) != wantedType {
+			break
+		}
+	}
+
+	return i
+}
+
+// getClusterOffset return the host offset of the cluster which contains offset, the cluster type,
+// and the number of bytes that are contiguous in the image file from offset, up to bytes.
+//
+// The returned cluster offset is 0 if the cluster is unallocated or zero cluster,
+// and the compressed cluster descriptor if the cluster is compressed.
+//  block/qcow2-cluster.c: int qcow2_get_cluster_offset(BlockDriverState *bs, uint64_t offset, unsigned int *bytes, uint64_t *cluster_offset)
+func getClusterOffset(ctx context.Context, bs *BlockDriverState, offset uint64, bytes uint64) (uint64, uint64, CLUSTER, error) {
+	s := bs.Opaque
+
+	offsetInCluster := offsetIntoCluster(s, int64(offset))
+	bytesNeeded := bytes + offsetInCluster
+	l1Bits := uint(s.L2Bits + s.ClusterBits)
+
+	// compute how many bytes there are between the start of the cluster
+	// containing offset and the end of the l1 entry
+	bytesAvailable := (uint64(1) << l1Bits) - (offset & ((uint64(1) << l1Bits) - 1)) + offsetInCluster
+	if bytesNeeded > bytesAvailable {
+		bytesNeeded = bytesAvailable
+	}
+
+	clamp := func(available uint64) uint64 {
+		if available > bytesNeeded {
+			available = bytesNeeded
+		}
+		return available - offsetInCluster
+	}
+
+	l1Index := offset >> l1Bits
+	if l1Index >= uint64(s.L1Size) {
+		return 0, clamp(bytesAvailable), CLUSTER_UNALLOCATED, nil
+	}
+
+	l1Entry, err := s.L1Table.get(bs, int(l1Index))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	l2Offset := l1Entry & L1E_OFFSET_MASK
+	if l2Offset == 0 {
+		return 0, clamp(bytesAvailable), CLUSTER_UNALLOCATED, nil
+	}
+
+	if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+		err := signalCorruption(bs, true, int64(l2Offset), "L2 table offset %#x unaligned (L1 index: %#x)", l2Offset, l1Index)
+		return 0, 0, 0, err
+	}
+
+	l2Table, err := l2Load(ctx, bs, l2Offset)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer cachePut(s.L2TableCache, l2Table)
+
+	l2Index := offsetToL2Index(s, int64(offset))
+	clusterOffset := getL2Entry(l2Table, l2Index)
+
+	nbClusters := int(sizeToClusters(s, bytesNeeded))
+
+	var c int
+	typ := getClusterType(clusterOffset)
+	switch typ {
+	case CLUSTER_COMPRESSED:
+		// Compressed clusters can only be processed one by one
+		c = 1
+		clusterOffset &= L2E_COMPRESSED_OFFSET_SIZE_MASK
+
+	case CLUSTER_ZERO:
+		if s.Version < Version3 {
+			err := signalCorruption(bs, true, -1, "Zero cluster entry found in pre-v3 image (L2 offset: %#x, L2 index: %#x)", l2Offset, l2Index)
+			return 0, 0, 0, err
+		}
+		c = countContiguousClustersByType(nbClusters, l2Table[l2Index*UINT64_SIZE:], CLUSTER_ZERO)
+		clusterOffset = 0
+
+	case CLUSTER_UNALLOCATED:
+		// how many empty clusters ?
+		c = countContiguousClustersByType(nbClusters, l2Table[l2Index*UINT64_SIZE:], CLUSTER_UNALLOCATED)
+		clusterOffset = 0
+
+	case CLUSTER_NORMAL:
+		// how many allocated clusters ?
+		c = countContiguousClusters(nbClusters, s.ClusterSize, l2Table[l2Index*UINT64_SIZE:], OFLAG_ZERO)
+		clusterOffset &= L2E_OFFSET_MASK
+		if offsetIntoCluster(s, int64(clusterOffset)) != 0 {
+			err := signalCorruption(bs, true, int64(clusterOffset), "Data cluster offset %#x unaligned (L2 offset: %#x, L2 index: %#x)", clusterOffset, l2Offset, l2Index)
+			return 0, 0, 0, err
+		}
+	}
+
+	return clusterOffset, clamp(uint64(c) * uint64(s.ClusterSize)), typ, nil
+}
+
+// decompressBuffer decompresses the raw deflate stream of buf to out.
+// Returns the error if the decompressed data is not exactly len(out) bytes.
+//  block/qcow2-cluster.c: static int decompress_buffer(uint8_t *out_buf, int out_buf_size, const uint8_t *buf, int buf_size)
+func decompressBuffer(out, buf []byte) error {
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+
+	if _, err := io.ReadFull(r, out); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decompressCluster decompresses the compressed cluster of clusterOffset descriptor to s.ClusterCache.
+// The last decompressed cluster is cached until the another compressed cluster is read.
+//  block/qcow2-cluster.c: int qcow2_decompress_cluster(BlockDriverState *bs, uint64_t cluster_offset)
+func decompressCluster(bs *BlockDriverState, clusterOffset uint64) error {
+	s := bs.Opaque
+
+	coffset := clusterOffset & s.ClusterOffsetMask
+	if s.ClusterCacheOffset == coffset {
+		return nil
+	}
+
+	nbCsectors := int((clusterOffset>>uint(s.Csize_shift))&uint64(s.Csize_mask)) + 1
+	sectorOffset := int(coffset & 511)
+	csize := nbCsectors*BDRV_SECTOR_SIZE - sectorOffset
+
+	if s.ClusterData == nil {
+		// one more sector for decompressed data alignment
+		s.ClusterData = make([]byte, MAX_CRYPT_CLUSTERS*s.ClusterSize+512)
+		s.ClusterCache = make([]byte, s.ClusterSize)
+	}
+
+	buf := s.ClusterData[:nbCsectors*BDRV_SECTOR_SIZE]
+	if err := bdrvPread(bs.file, int64(coffset)-int64(sectorOffset), buf); err != nil {
+		return err
+	}
+	if err := decompressBuffer(s.ClusterCache, buf[sectorOffset:sectorOffset+csize]); err != nil {
+		// invalidate the partially decompressed cache
+		s.ClusterCacheOffset = ^uint64(0)
+		err = errors.WithStack(&CorruptionError{
+			Offset: int64(coffset),
+			Reason: fmt.Sprintf("Could not decompress the cluster at offset %#x: %v", coffset, err),
+		})
+		return err
+	}
+	s.ClusterCacheOffset = coffset
+
+	return nil
+}
+
+// L1_ENTRIES_PER_SECTOR number of the L1 table entries in a sector.
+const L1_ENTRIES_PER_SECTOR = 512 / 8
+
+// writeL1Entry writes the sector of the L1 table which contains the l1Index entry to the image file.
+//  block/qcow2-cluster.c: int qcow2_write_l1_entry(BlockDriverState *bs, int l1_index)
+func writeL1Entry(bs *BlockDriverState, l1Index int) error {
+	s := bs.Opaque
+
+	l1StartIndex := l1Index &^ (L1_ENTRIES_PER_SECTOR - 1)
+	bufsize := MIN(L1_ENTRIES_PER_SECTOR, s.L1Size-l1StartIndex)
+
+	buf := make([]byte, bufsize*UINT64_SIZE)
+	for i := 0; i < bufsize; i++ {
+		e, err := s.L1Table.get(bs, l1StartIndex+i)
+		if err != nil {
+			return err
+		}
+		copy(buf[i*UINT64_SIZE:], BEUvarint64(e))
+	}
+
+	offset := int64(s.L1TableOffset) + int64(l1StartIndex)*UINT64_SIZE
+	if err := preWriteOverlapCheck(bs, QCOW2_OL_ACTIVE_L1, offset, int64(len(buf))); err != nil {
+		return err
+	}
+
+	return bdrvPwriteSync(bs.file, offset, buf)
+}
+
+// l2Allocate allocates the new L2 table for the l1Index entry, and links it to the L1 table.
+// If the L1 entry already has the L2 table which is shared with the snapshots, its entries are copied to the new table.
+// Returns the new L2 table, which must be released by cachePut.
+//  block/qcow2-cluster.c: static int l2_allocate(BlockDriverState *bs, int l1_index, uint64_t **table)
+func l2Allocate(ctx context.Context, bs *BlockDriverState, l1Index int) ([]byte, error) {
+	s := bs.Opaque
+
+	oldL2Offset, err := s.L1Table.get(bs, l1Index)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate a new l2 entry
+	l2Offset, err := AllocClusters(bs, uint64(s.L2Size*UINT64_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(l2Table []byte, err error) ([]byte, error) {
+		if l2Table != nil {
+			cachePut(s.L2TableCache, l2Table)
+		}
+		s.L1Table.set(bs, l1Index, oldL2Offset)
+		freeClusters(bs, l2Offset, int64(s.L2Size*UINT64_SIZE), DISCARD_OTHER)
+		return nil, err
+	}
+
+	// the refcount of the new table must be written before the L1 entry refers to it
+	if err := cacheFlush(bs, s.RefcountBlockCache); err != nil {
+		return fail(nil, err)
+	}
+
+	// allocate a new entry in the l2 cache
+	l2Table, err := cacheGetEmpty(bs, s.L2TableCache, l2Offset)
+	if err != nil {
+		return fail(nil, err)
+	}
+
+	if oldL2Offset&L1E_OFFSET_MASK == 0 {
+		// if there was no old l2 table, clear the new table
+		for i := range l2Table {
+			l2Table[i] = 0
+		}
+	} else {
+		// if there was an old l2 table, read it from the disk
+		oldTable, err := cacheGet(ctx, bs, s.L2TableCache, int64(oldL2Offset&L1E_OFFSET_MASK))
+		if err != nil {
+			return fail(l2Table, err)
+		}
+		copy(l2Table, oldTable)
+		cachePut(s.L2TableCache, oldTable)
+	}
+
+	// write the l2 table to the file
+	cacheEntryMarkDirty(s.L2TableCache, l2Table)
+	if err := cacheFlush(bs, s.L2TableCache); err != nil {
+		return fail(l2Table, err)
+	}
+
+	// update the L1 entry
+	if err := s.L1Table.set(bs, l1Index, uint64(l2Offset)|OFLAG_COPIED); err != nil {
+		return fail(l2Table, err)
+	}
+	if err := writeL1Entry(bs, l1Index); err != nil {
+		return fail(l2Table, err)
+	}
+
+	return l2Table, nil
+}
+
+// getClusterTable returns the L2 table and the index of the entry for the guest offset.
+// The L1 table is grown, and the L2 table is allocated if needed. The returned table must be released by cachePut.
+//  block/qcow2-cluster.c: static int get_cluster_table(BlockDriverState *bs, uint64_t offset, uint64_t **new_l2_table, int *new_l2_index)
+func getClusterTable(ctx context.Context, bs *BlockDriverState, offset uint64) ([]byte, int, error) {
+	s := bs.Opaque
+
+	l1Index := offset >> uint(s.L2Bits+s.ClusterBits)
+	if l1Index >= uint64(s.L1Size) {
+		if err := growL1Table(bs, l1Index+1, false); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	l1Entry, err := s.L1Table.get(bs, int(l1Index))
+	if err != nil {
+		return nil, 0, err
+	}
+	l2Offset := l1Entry & L1E_OFFSET_MASK
+	if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+		err := signalCorruption(bs, true, int64(l2Offset), "L2 table offset %#x unaligned (L1 index: %#x)", l2Offset, l1Index)
+		return nil, 0, err
+	}
+
+	var l2Table []byte
+	if l1Entry&OFLAG_COPIED != 0 {
+		// load the l2 table in memory
+		l2Table, err = l2Load(ctx, bs, l2Offset)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		// First allocate a new L2 table (and do COW if needed)
+		l2Table, err = l2Allocate(ctx, bs, int(l1Index))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Then decrease the refcount of the old table
+		if l2Offset != 0 {
+			freeClusters(bs, int64(l2Offset), int64(s.L2Size*UINT64_SIZE), DISCARD_OTHER)
+		}
+	}
+
+	return l2Table, offsetToL2Index(s, int64(offset)), nil
+}
+
+// performCow copies the region r of the guest data at startOffset to the newly allocated clusters at clusterOffset.
+//  block/qcow2-cluster.c: static int coroutine_fn do_perform_cow(BlockDriverState *bs, uint64_t src_cluster_offset, uint64_t cluster_offset, int offset_in_cluster, int bytes)
+func performCow(ctx context.Context, bs *BlockDriverState, startOffset, clusterOffset uint64, r COWRegion) (err error) {
+	if r.NbBytes == 0 {
+		return nil
+	}
+
+	ctx, span := traceStart(ctx, bs, TraceCow, int64(startOffset+r.Offset), int64(r.NbBytes))
+	defer func() {
+		span.End(err)
+		blockAcctDone(bs, StatsCow, int64(r.NbBytes), err)
+	}()
+
+	buf := bufPoolGet(int(bdrvOptMemAlign(bs)), r.NbBytes)
+	defer bufPoolPut(buf)
+
+	// Call preadv directly instead of using the public block-layer
+	// interface.  This avoids double I/O throttling and request tracking,
+	// which can lead to deadlock when block layer copy-on-read is enabled.
+	// s.lock is already held by the allocating write.
+	if err := preadvLocked(ctx, bs, int64(startOffset+r.Offset), buf); err != nil {
+		return err
+	}
+
+	if err := preWriteOverlapCheck(bs, 0, int64(clusterOffset+r.Offset), int64(r.NbBytes)); err != nil {
+		return err
+	}
+
+	if err := bdrvPwrite(bs.file, int64(clusterOffset+r.Offset), buf); err != nil {
+		return err
+	}
+
+	// Data is always flushed before L2 table update, so the L2 table doesn't
+	// point to uninitialized (or garbage) data.
+	cacheDependsOnFlush(bs.Opaque.L2TableCache)
+	return nil
+}
+
+// allocClusterLinkL2 copies the COW regions of m, and links the newly allocated clusters to the L2 table.
+// The refcount of the old clusters are decreased.
+//  block/qcow2-cluster.c: int qcow2_alloc_cluster_link_l2(BlockDriverState *bs, QCowL2Meta *m)
+func allocClusterLinkL2(ctx context.Context, bs *BlockDriverState, m *L2Meta) error {
+	s := bs.Opaque
+
+	if m.NbClusters == 0 {
+		return nil
+	}
+
+	// copy content of unmodified sectors
+	if err := performCow(ctx, bs, m.Offset, m.AllocOffset, m.CowStart); err != nil {
+		return err
+	}
+	if err := performCow(ctx, bs, m.Offset, m.AllocOffset, m.CowEnd); err != nil {
+		return err
+	}
+
+	// the refcounts of the new clusters must be written before the L2 entries refer to them
+	if needAccurateRefcounts(s) {
+		if err := cacheSetDependency(bs, s.L2TableCache, s.RefcountBlockCache); err != nil {
+			return err
+		}
+	}
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, m.Offset)
+	if err != nil {
+		return err
+	}
+	cacheEntryMarkDirty(s.L2TableCache, l2Table)
+
+	var oldCluster []uint64
+	for i := 0; i < m.NbClusters; i++ {
+		// if two concurrent writes happen to the same unallocated cluster
+		// each write allocates separate cluster and writes data concurrently.
+		// The first one to complete updates l2 table with pointer to its
+		// cluster the second one has to do RMW (which is done above by
+		// perform_cow()), update l2 table with its cluster pointer and free
+		// old cluster. This is what this loop does
+		if e := getL2Entry(l2Table, l2Index+i); e != 0 {
+			oldCluster = append(oldCluster, e)
+		}
+
+		setL2Entry(l2Table, l2Index+i, (m.AllocOffset+uint64(i<<uint(s.ClusterBits)))|OFLAG_COPIED)
+	}
+
+	cachePut(s.L2TableCache, l2Table)
+
+	// If this was a COW, we need to decrease the refcount of the old cluster.
+	freeL2Entries(bs, oldCluster, DISCARD_NEVER)
+
+	return nil
+}
+
+// allocClusterAbort frees the newly allocated clusters of m, if the guest write is failed.
+//  block/qcow2-cluster.c: void qcow2_alloc_cluster_abort(BlockDriverState *bs, QCowL2Meta *m)
+func allocClusterAbort(bs *BlockDriverState, m *L2Meta) {
+	s := bs.Opaque
+	freeClusters(bs, int64(m.AllocOffset), int64(m.NbClusters)<<uint(s.ClusterBits), DISCARD_NEVER)
+}
+
+// countCowClusters returns the number of clusters from l2Index which need the newly allocated clusters to write.
+//  block/qcow2-cluster.c: static int count_cow_clusters(BDRVQcow2State *s, int nb_clusters, uint64_t *l2_table, int l2_index)
+func countCowClusters(nbClusters int, l2Table []byte, l2Index int) int {
+	var i int
+	for i = 0; i < nbClusters; i++ {
+		l2Entry := getL2Entry(l2Table, l2Index+i)
+		if getClusterType(l2Entry) == CLUSTER_NORMAL && l2Entry&OFLAG_COPIED != 0 {
+			break
+		}
+	}
+
+	return i
+}
+
+// allocClusterOffset returns the host offset of the cluster to write the guest data at offset, and the number of
+// bytes which can be written to the contiguous host clusters, up to bytes.
+//
+// If the clusters are already allocated and not shared with the snapshots, the data is written in place and the
+// returned L2Meta is nil. Otherwise, the new clusters are allocated, and the returned L2Meta must be linked to the
+// L2 table by allocClusterLinkL2 after the guest data is written.
+//  block/qcow2-cluster.c: int qcow2_alloc_cluster_offset(BlockDriverState *bs, uint64_t offset, int *bytes, uint64_t *host_offset, QCowL2Meta **m)
+func allocClusterOffset(ctx context.Context, bs *BlockDriverState, offset, bytes uint64) (uint64, uint64, *L2Meta, error) {
+	s := bs.Opaque
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, offset)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer cachePut(s.L2TableCache, l2Table)
+
+	offsetInCluster := offsetIntoCluster(s, int64(offset))
+	nbClusters := MIN(int(sizeToClusters(s, offsetInCluster+bytes)), s.L2Size-l2Index)
+
+	l2Entry := getL2Entry(l2Table, l2Index)
+	typ := getClusterType(l2Entry)
+
+	// handle_copied: the clusters are already allocated and can be overwritten in place
+	if typ == CLUSTER_NORMAL && l2Entry&OFLAG_COPIED != 0 {
+		clusterOffset := l2Entry & L2E_OFFSET_MASK
+		if offsetIntoCluster(s, int64(clusterOffset)) != 0 {
+			err := signalCorruption(bs, true, int64(clusterOffset), "Preallocated cluster offset %#x unaligned (guest offset: %#x)", clusterOffset, offset)
+			return 0, 0, nil, err
+		}
+
+		c := countContiguousClusters(nbClusters, s.ClusterSize, l2Table[l2Index*UINT64_SIZE:], OFLAG_COPIED|OFLAG_ZERO)
+		n := uint64(c)*uint64(s.ClusterSize) - offsetInCluster
+		if n > bytes {
+			n = bytes
+		}
+		return clusterOffset, n, nil, nil
+	}
+
+	// handle_alloc: allocate the new clusters
+	if typ == CLUSTER_COMPRESSED {
+		nbClusters = 1
+	} else {
+		nbClusters = countCowClusters(nbClusters, l2Table, l2Index)
+	}
+
+	_, span := traceStart(ctx, bs, TraceAllocClusters, int64(offset), int64(nbClusters)<<uint(s.ClusterBits))
+	allocOffset, err := AllocClusters(bs, uint64(nbClusters)<<uint(s.ClusterBits))
+	span.End(err)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if offsetIntoCluster(s, allocOffset) != 0 {
+		err := signalCorruption(bs, true, allocOffset, "Newly allocated cluster offset %#x unaligned (guest offset: %#x)", allocOffset, offset)
+		return 0, 0, nil, err
+	}
+
+	availBytes := uint64(nbClusters) << uint(s.ClusterBits)
+	n := availBytes - offsetInCluster
+	if n > bytes {
+		n = bytes
+	}
+
+	m := &L2Meta{
+		Offset:      uint64(startOfCluster(int64(s.ClusterSize), int64(offset))),
+		AllocOffset: uint64(allocOffset),
+		NbClusters:  nbClusters,
+		CowStart: COWRegion{
+			Offset:  0,
+			NbBytes: int(offsetInCluster),
+		},
+		CowEnd: COWRegion{
+			Offset:  offsetInCluster + n,
+			NbBytes: int(availBytes - offsetInCluster - n),
+		},
+	}
+
+	return uint64(allocOffset), n, m, nil
+}
+
+// allocCompressedClusterOffset allocates compressedSize bytes for the compressed cluster which contains the
+// guest offset, and links the compressed cluster descriptor to the L2 table.
+// The cluster must be unallocated, because the compressed cluster can't overwrite anything.
+// Returns the host offset of the compressed data.
+//  block/qcow2-cluster.c: int qcow2_alloc_compressed_cluster_offset(BlockDriverState *bs, uint64_t offset, int compressed_size, uint64_t *host_offset)
+func allocCompressedClusterOffset(ctx context.Context, bs *BlockDriverState, offset uint64, compressedSize int) (uint64, error) {
+	s := bs.Opaque
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer cachePut(s.L2TableCache, l2Table)
+
+	// Compression can't overwrite anything. Fail if the cluster was already
+	// allocated.
+	if getL2Entry(l2Table, l2Index)&L2E_OFFSET_MASK != 0 {
+		return 0, syscall.EIO
+	}
+
+	clusterOffset, err := allocBytes(bs, compressedSize)
+	if err != nil {
+		return 0, err
+	}
+
+	nbCsectors := (clusterOffset+int64(compressedSize)-1)/int64(BDRV_SECTOR_SIZE) - clusterOffset/int64(BDRV_SECTOR_SIZE)
+
+	// The offset and size must fit in their fields of the L2 table entry
+	if uint64(clusterOffset)&s.ClusterOffsetMask != uint64(clusterOffset) || nbCsectors&int64(s.Csize_mask) != nbCsectors {
+		return 0, errors.Wrap(ErrTooLarge, "Compressed cluster offset too large")
+	}
+
+	l2Entry := uint64(clusterOffset) | OFLAG_COMPRESSED | uint64(nbCsectors)<<uint(s.Csize_shift)
+
+	// compressed clusters never have the copied flag
+	cacheEntryMarkDirty(s.L2TableCache, l2Table)
+	setL2Entry(l2Table, l2Index, l2Entry)
+
+	return uint64(clusterOffset), nil
+}
+
+// zeroSingleL2 marks the nbClusters clusters from offset as the zero clusters, up to the end of the L2 table.
+// The compressed clusters are freed, and the other allocated clusters keep its host offset unless
+// flags has BDRV_REQ_MAY_UNMAP.
+// Returns the number of clusters marked.
+//  block/qcow2-cluster.c: static int zero_single_l2(BlockDriverState *bs, uint64_t offset, uint64_t nb_clusters, int flags)
+func zeroSingleL2(ctx context.Context, bs *BlockDriverState, offset uint64, nbClusters uint64, flags BdrvRequestFlags) (uint64, error) {
+	s := bs.Opaque
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	// Limit nb_clusters to one L2 table
+	if nbClusters > uint64(s.L2Size-l2Index) {
+		nbClusters = uint64(s.L2Size - l2Index)
+	}
+
+	cacheEntryMarkDirty(s.L2TableCache, l2Table)
+
+	var oldEntries []uint64
+	for i := 0; i < int(nbClusters); i++ {
+		oldOffset := getL2Entry(l2Table, l2Index+i)
+
+		// Update L2 entries
+		if oldOffset&OFLAG_COMPRESSED != 0 || flags&BDRV_REQ_MAY_UNMAP != 0 {
+			setL2Entry(l2Table, l2Index+i, OFLAG_ZERO)
+			oldEntries = append(oldEntries, oldOffset)
+		} else {
+			setL2Entry(l2Table, l2Index+i, oldOffset|OFLAG_ZERO)
+		}
+	}
+
+	cachePut(s.L2TableCache, l2Table)
+
+	freeL2Entries(bs, oldEntries, DISCARD_REQUEST)
+
+	return nbClusters, nil
+}
+
+// zeroClusters marks the clusters from offset to offset+bytes as the zero clusters.
+// Returns ENOTSUP for the compat=0.10 image, which has no zero cluster.
+//  block/qcow2-cluster.c: int qcow2_zero_clusters(BlockDriverState *bs, uint64_t offset, int nb_sectors, int flags)
+func zeroClusters(ctx context.Context, bs *BlockDriverState, offset, bytes uint64, flags BdrvRequestFlags) (err error) {
+	s := bs.Opaque
+
+	// The zero flag is only supported by version 3 and newer
+	if s.Version < Version3 {
+		return syscall.ENOTSUP
+	}
+
+	// the compressed cluster cache may be stale after the compressed clusters are freed
+	s.ClusterCacheOffset = ^uint64(0)
+
+	// the host discards of the freed clusters are merged and issued once after all of the L2 tables
+	s.CacheDiscards = true
+	defer func() {
+		s.CacheDiscards = false
+		processDiscards(bs, err)
+	}()
+
+	// Each L2 table is handled by its own loop iteration
+	nbClusters := sizeToClusters(s, bytes)
+	for nbClusters > 0 {
+		n, err := zeroSingleL2(ctx, bs, offset, nbClusters, flags)
+		if err != nil {
+			return err
+		}
+
+		nbClusters -= n
+		offset += n * uint64(s.ClusterSize)
+	}
+
+	return nil
+}
+
+// discardSingleL2 discards the nbClusters clusters from offset, up to the end of the L2 table.
+// Returns the number of clusters discarded.
+//  block/qcow2-cluster.c: static int discard_single_l2(BlockDriverState *bs, uint64_t offset, unsigned int nb_clusters, enum qcow2_discard_type type, bool full_discard)
+func discardSingleL2(ctx context.Context, bs *BlockDriverState, offset, nbClusters uint64, typ DiscardType, fullDiscard bool) (uint64, error) {
+	s := bs.Opaque
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	// Limit nb_clusters to one L2 table
+	if nbClusters > uint64(s.L2Size-l2Index) {
+		nbClusters = uint64(s.L2Size - l2Index)
+	}
+
+	var oldEntries []uint64
+	for i := 0; i < int(nbClusters); i++ {
+		oldL2Entry := getL2Entry(l2Table, l2Index+i)
+
+		// If full_discard is false, make sure that a discarded area reads back
+		// as zeroes for v3 images (we cannot do it for v2 without actually
+		// writing a zero-filled buffer). We can skip the operation if the
+		// cluster is already marked as zero, or if it's unallocated and we
+		// don't have a backing file.
+		//
+		// If full_discard is true, the sector should not read back as zeroes,
+		// but rather fall through to the backing file.
+		switch getClusterType(oldL2Entry) {
+		case CLUSTER_UNALLOCATED:
+			if fullDiscard || bs.Backing == nil {
+				continue
+			}
+		case CLUSTER_ZERO:
+			// Preallocated zero clusters should be discarded in any case
+			if !fullDiscard && oldL2Entry&L2E_OFFSET_MASK == 0 {
+				continue
+			}
+		}
+
+		// First remove L2 entries
+		cacheEntryMarkDirty(s.L2TableCache, l2Table)
+		if !fullDiscard && s.Version >= Version3 {
+			setL2Entry(l2Table, l2Index+i, OFLAG_ZERO)
+		} else {
+			setL2Entry(l2Table, l2Index+i, 0)
+		}
+		oldEntries = append(oldEntries, oldL2Entry)
+	}
+
+	cachePut(s.L2TableCache, l2Table)
+
+	// Then decrease the refcount
+	freeL2Entries(bs, oldEntries, typ)
+
+	return nbClusters, nil
+}
+
+// discardClusters discards the clusters from offset to offset+bytes.
+// The offset and bytes must be aligned to the cluster size, except at the end of the image.
+//  block/qcow2-cluster.c: int qcow2_discard_clusters(BlockDriverState *bs, uint64_t offset, int nb_sectors, enum qcow2_discard_type type, bool full_discard)
+func discardClusters(ctx context.Context, bs *BlockDriverState, offset, bytes uint64, typ DiscardType, fullDiscard bool) (err error) {
+	s := bs.Opaque
+
+	// the compressed cluster cache may be stale after the compressed clusters are freed
+	s.ClusterCacheOffset = ^uint64(0)
+
+	nbClusters := sizeToClusters(s, bytes)
+
+	s.CacheDiscards = true
+	defer func() {
+		s.CacheDiscards = false
+		processDiscards(bs, err)
+	}()
+
+	// Each L2 table is handled by its own loop iteration
+	for nbClusters > 0 {
+		n, err := discardSingleL2(ctx, bs, offset, nbClusters, typ, fullDiscard)
+		if err != nil {
+			return err
+		}
+
+		nbClusters -= n
+		offset += n * uint64(s.ClusterSize)
+	}
 
-	// write new table (align to cluster)
-	// newL1TableOffset, err := AllocClusters(bs, uint64(newL1Size2))
-	// if err != nil {
-	// 	return err
-	// }
-
-	// ret = qcow2_cache_flush(bs, s->refcount_block_cache);
-	// if (ret < 0) {
-	// 	goto fail;
-	// }
-	//
-	// /* the L1 position has not yet been updated, so these clusters must
-	// * indeed be completely free */
-	// ret = qcow2_pre_write_overlap_check(bs, 0, new_l1_table_offset,
-	// new_l1_size2);
-	// if (ret < 0) {
-	// 	goto fail;
-	// }
-	//
-	// BLKDBG_EVENT(bs->file, BLKDBG_L1_GROW_WRITE_TABLE);
-	// for(i = 0; i < s->l1_size; i++)
-	// new_l1_table[i] = cpu_to_be64(new_l1_table[i]);
-	// ret = bdrv_pwrite_sync(bs->file, new_l1_table_offset,
-	// new_l1_table, new_l1_size2);
-	// if (ret < 0)
-	// goto fail;
-	// for(i = 0; i < s->l1_size; i++)
-	// new_l1_table[i] = be64_to_cpu(new_l1_table[i]);
-	//
-	// /* set new table */
-	// BLKDBG_EVENT(bs->file, BLKDBG_L1_GROW_ACTIVATE_TABLE);
-	// stl_be_p(data, new_l1_size);
-	// stq_be_p(data + 4, new_l1_table_offset);
-	// ret = bdrv_pwrite_sync(bs->file, offsetof(QCowHeader, l1_size),
-	// data, sizeof(data));
-	// if (ret < 0) {
-	// 	goto fail;
-	// }
-	// qemu_vfree(s->l1_table);
-	// old_l1_table_offset = s->l1_table_offset;
-	// s->l1_table_offset = new_l1_table_offset;
-	// s->l1_table = new_l1_table;
-	// old_l1_size = s->l1_size;
-	// s->l1_size = new_l1_size;
-	// qcow2_free_clusters(bs, old_l1_table_offset, old_l1_size * sizeof(uint64_t),
-	// QCOW2_DISCARD_OTHER);
-	// return 0;
-	// fail:
-	// qemu_vfree(new_l1_table);
-	// qcow2_free_clusters(bs, new_l1_table_offset, new_l1_size2,
-	// QCOW2_DISCARD_OTHER);
-	// return ret;
 	return nil
 }
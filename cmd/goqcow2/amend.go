@@ -0,0 +1,129 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["amend"] = &command{
+		usage: "[-p] [-q] -o options filename",
+		short: "change the format specific options of the image",
+		run:   runAmend,
+	}
+}
+
+// amendOptions the options of the image which can be changed by amend.
+var amendOptions = [][2]string{
+	{"cluster_size", "qcow2 cluster size"},
+}
+
+// runAmend changes the options of the qcow2 image, same as qemu-img amend.
+//  qemu-img.c: static int img_amend(int argc, char **argv)
+func runAmend(args []string) error {
+	fs := flag.NewFlagSet("amend", flag.ContinueOnError)
+	progress := fs.Bool("p", false, "show the progress of the amendment")
+	quiet := fs.Bool("q", false, "quiet mode")
+	options := fs.String("o", "", "comma separated list of the options to be changed, or \"help\" to list them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 amend %s\n", commands["amend"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *options == "help" || *options == "?" {
+		fmt.Printf("Supported options:\n")
+		for _, opt := range amendOptions {
+			fmt.Printf("  %-22s - %s\n", opt[0], opt[1])
+		}
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *options == "" {
+		return errors.New("Must specify options (-o)")
+	}
+	filename := fs.Arg(0)
+
+	aopts := new(qcow2.AmendOpts)
+	if err := parseAmendOptions(aopts, *options); err != nil {
+		return err
+	}
+	showProgress := *progress && !*quiet
+	if showProgress {
+		aopts.Progress = newProgressPrinter()
+	}
+
+	img, err := qcow2.OpenFileFormat(filename, qcow2.DriverQCow2, os.O_RDWR)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open '%s'", filename)
+		return err
+	}
+	defer img.Close()
+
+	// the interrupted amendment keeps the image unchanged
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = img.AmendContext(ctx, aopts)
+	if showProgress {
+		fmt.Println()
+	}
+	return err
+}
+
+// parseAmendOptions parses the comma separated list of the key=value options to opts.
+func parseAmendOptions(opts *qcow2.AmendOpts, options string) error {
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		key := kv[0]
+		var value string
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+
+		switch key {
+		case "cluster_size":
+			size, err := qcow2.ParseSize(value)
+			if err != nil {
+				return err
+			}
+			opts.ClusterSize = int(size)
+		default:
+			return errors.Errorf("Invalid parameter '%s'", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["check"] = &command{
+		usage: "[-q] [-f fmt] [-output human|json] [-r leaks|all] [-U] filename",
+		short: "check the consistency of the disk image",
+		run:   runCheck,
+	}
+}
+
+// The exit codes of the check subcommand, same as qemu-img check.
+const (
+	// checkExitOK no inconsistencies were found.
+	checkExitOK = 0
+	// checkExitError the check could not be completed.
+	checkExitError = 1
+	// checkExitCorruptions the image has the corruptions.
+	checkExitCorruptions = 2
+	// checkExitLeaks the image has the leaked clusters, but no corruptions.
+	checkExitLeaks = 3
+	// checkExitNotSupported the image format does not support checks.
+	checkExitNotSupported = 63
+)
+
+// runCheck checks the consistency of the image, same as qemu-img check.
+//  qemu-img.c: static int img_check(int argc, char **argv)
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	quiet := fs.Bool("q", false, "quiet mode")
+	format := fs.String("f", "", "image format, probed if omitted")
+	output := fs.String("output", "human", "output format (human or json)")
+	repair := fs.String("r", "", "repair the leaked clusters (leaks) or all of the inconsistencies (all)")
+	force := fs.Bool("U", false, "open the image without the lock; required if the image is opened read-write elsewhere")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 check %s\n", commands["check"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+
+	var fix qcow2.CheckMode
+	switch *repair {
+	case "":
+		// nothing to do
+	case "leaks":
+		fix = qcow2.BDRV_FIX_LEAKS
+	case "all":
+		fix = qcow2.BDRV_FIX_LEAKS | qcow2.BDRV_FIX_ERRORS
+	default:
+		return errors.Errorf("Unknown option value for -r (expecting 'leaks' or 'all'): %s", *repair)
+	}
+
+	flags := os.O_RDONLY
+	if fix != 0 {
+		flags = os.O_RDWR
+		if *force {
+			return errors.New("--force-share/-U is not supported with -r")
+		}
+	}
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), flags, &qcow2.OpenOpts{
+		Force:  *force,
+		Repair: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	check, err := img.Check(fix)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			err = errors.New("This image format does not support checks")
+			return &exitError{code: checkExitNotSupported, err: err}
+		}
+		return &exitError{code: checkExitError, err: err}
+	}
+
+	switch *output {
+	case "json":
+		buf, err := json.MarshalIndent(check, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	case "human":
+		if !*quiet {
+			dumpHumanImageCheck(check)
+		}
+	}
+
+	code := checkExitOK
+	switch {
+	case check.CheckErrors > 0:
+		code = checkExitError
+	case check.Corruptions > 0:
+		code = checkExitCorruptions
+	case check.Leaks > 0:
+		code = checkExitLeaks
+	}
+	if err := img.Close(); err != nil {
+		return err
+	}
+	if code != checkExitOK {
+		return &exitError{code: code}
+	}
+
+	return nil
+}
+
+// dumpHumanImageCheck prints the result of the check in the human readable format.
+//  qemu-img.c: static void dump_human_image_check(ImageCheck *check, bool quiet)
+func dumpHumanImageCheck(check *qcow2.ImageCheck) {
+	if check.CorruptionsFixed > 0 || check.LeaksFixed > 0 {
+		fmt.Printf("The following inconsistencies were found and repaired:\n\n"+
+			"    %d leaked clusters\n"+
+			"    %d corruptions\n\n"+
+			"Double checking the fixed image now...\n",
+			check.LeaksFixed, check.CorruptionsFixed)
+	}
+
+	if check.Corruptions == 0 && check.Leaks == 0 && check.CheckErrors == 0 {
+		fmt.Printf("No errors were found on the image.\n")
+	} else {
+		if check.Corruptions > 0 {
+			fmt.Printf("\n%d errors were found on the image.\n"+
+				"Data may be corrupted, or further writes to the image may corrupt it.\n",
+				check.Corruptions)
+		}
+		if check.Leaks > 0 {
+			fmt.Printf("\n%d leaked clusters were found on the image.\n"+
+				"This means waste of disk space, but no harm to data.\n",
+				check.Leaks)
+		}
+		if check.CheckErrors > 0 {
+			fmt.Printf("\n%d internal errors have occurred during the check.\n", check.CheckErrors)
+		}
+	}
+
+	if check.TotalClusters != 0 && check.AllocatedClusters != 0 {
+		fmt.Printf("%d/%d = %0.2f%% allocated, %0.2f%% fragmented, %0.2f%% compressed clusters\n",
+			check.AllocatedClusters, check.TotalClusters,
+			float64(check.AllocatedClusters)*100/float64(check.TotalClusters),
+			float64(check.FragmentedClusters)*100/float64(check.AllocatedClusters),
+			float64(check.CompressedClusters)*100/float64(check.AllocatedClusters))
+	}
+
+	if check.ImageEndOffset != 0 {
+		fmt.Printf("Image end offset: %d\n", check.ImageEndOffset)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["compact"] = &command{
+		usage: "[-n] [-q] filename",
+		short: "rewrite the data clusters in the guest order and truncate the free space",
+		run:   runCompact,
+	}
+}
+
+// runCompact rewrites the data clusters of the qcow2 image into the order of the guest offset, and prints the
+// fragmentation statistics before and after that.
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	dryRun := fs.Bool("n", false, "print the fragmentation statistics without compacting the image")
+	quiet := fs.Bool("q", false, "quiet mode")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 compact %s\n", commands["compact"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	filename := fs.Arg(0)
+
+	flags := os.O_RDWR
+	if *dryRun {
+		flags = os.O_RDONLY
+	}
+	img, err := qcow2.OpenFileFormat(filename, qcow2.DriverQCow2, flags)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open '%s'", filename)
+		return err
+	}
+	defer img.Close()
+
+	st, err := img.FragmentationStats()
+	if err != nil {
+		return err
+	}
+	if !*quiet {
+		printFragmentationStats(st)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// the interrupted compaction keeps the clusters which have been moved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := img.CompactContext(ctx); err != nil {
+		return err
+	}
+
+	if !*quiet {
+		st, err := img.FragmentationStats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nAfter compaction:\n")
+		printFragmentationStats(st)
+	}
+
+	return nil
+}
+
+// printFragmentationStats prints st in the human readable format.
+func printFragmentationStats(st *qcow2.FragmentationStats) {
+	fmt.Printf("%d allocated clusters in %d ranges, %d extents = %0.2f%% fragmented\n",
+		st.Allocated, st.Ranges, st.Extents, st.Fragmentation())
+	fmt.Printf("%d backward extents, %d clusters of scatter\n", st.Backward, st.Scatter)
+	fmt.Printf("Image file: %d clusters in use, %d free, %d trailing\n",
+		st.FileClusters-st.FreeClusters, st.FreeClusters, st.TrailingClusters)
+}
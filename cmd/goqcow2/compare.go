@@ -0,0 +1,115 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["compare"] = &command{
+		usage: "[-f fmt] [-F fmt] [-q] [-s] [-U] filename1 filename2",
+		short: "check whether the disk images have the same contents",
+		run:   runCompare,
+	}
+}
+
+// The exit codes of the compare subcommand, same as qemu-img compare.
+const (
+	// compareExitIdentical the images are identical.
+	compareExitIdentical = 0
+	// compareExitMismatch the images differ.
+	compareExitMismatch = 1
+	// compareExitError the comparison could not be completed.
+	compareExitError = 2
+)
+
+// runCompare compares the guest visible contents of the images, same as qemu-img compare.
+//  qemu-img.c: static int img_compare(int argc, char **argv)
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	format1 := fs.String("f", "", "image format of the first image, probed if omitted")
+	format2 := fs.String("F", "", "image format of the second image, probed if omitted")
+	quiet := fs.Bool("q", false, "quiet mode")
+	strict := fs.Bool("s", false, "strict mode, which fails on the different image sizes or the allocation status")
+	force := fs.Bool("U", false, "open the images without the lock, even if they are in use")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 compare %s\n", commands["compare"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return &exitError{code: compareExitError, err: err}
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return &exitError{code: compareExitError}
+	}
+	filename1, filename2 := fs.Arg(0), fs.Arg(1)
+
+	img1, err := qcow2.OpenFileOpts(filename1, qcow2.DriverFmt(*format1), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open '%s'", filename1)
+		return &exitError{code: compareExitError, err: err}
+	}
+	defer img1.Close()
+
+	img2, err := qcow2.OpenFileOpts(filename2, qcow2.DriverFmt(*format2), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open '%s'", filename2)
+		return &exitError{code: compareExitError, err: err}
+	}
+	defer img2.Close()
+
+	if !*strict {
+		size1, err := img1.VirtualSize()
+		if err != nil {
+			return &exitError{code: compareExitError, err: err}
+		}
+		size2, err := img2.VirtualSize()
+		if err != nil {
+			return &exitError{code: compareExitError, err: err}
+		}
+		if size1 != size2 && !*quiet {
+			fmt.Printf("Warning: Image size mismatch!\n")
+		}
+	}
+
+	res, err := qcow2.Compare(img1, img2, *strict)
+	if err != nil {
+		return &exitError{code: compareExitError, err: err}
+	}
+
+	if !*quiet {
+		switch res.Mismatch {
+		case qcow2.MismatchNone:
+			fmt.Printf("Images are identical.\n")
+		case qcow2.MismatchContent:
+			fmt.Printf("Content mismatch at offset %d!\n", res.Offset)
+		case qcow2.MismatchBlockStatus:
+			fmt.Printf("Strict mode: Offset %d block status mismatch!\n", res.Offset)
+		case qcow2.MismatchSize:
+			fmt.Printf("Strict mode: Image size mismatch!\n")
+		}
+	}
+	code := compareExitIdentical
+	if !res.Identical {
+		code = compareExitMismatch
+	}
+	if code != compareExitIdentical {
+		return &exitError{code: code}
+	}
+
+	return nil
+}
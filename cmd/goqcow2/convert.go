@@ -0,0 +1,138 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["convert"] = &command{
+		usage: "[-c [-z level] [-j compress_workers]] [-D] [-C] [-m num_workers] [-W] [-p] [-r rate_limit] [-q] [-f fmt] [-O output_fmt] [-B backing_file [-F backing_fmt]] [-o options] [-U] filename output_filename",
+		short: "convert the disk image to the another format",
+		run:   runConvert,
+	}
+}
+
+// runConvert converts the disk image to the new image, same as qemu-img convert.
+//  qemu-img.c: static int img_convert(int argc, char **argv)
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	compress := fs.Bool("c", false, "compress the data clusters of the output image (qcow2 only)")
+	compressLevel := fs.Int("z", 0, "deflate level of the compressed clusters from 1 to 9, the default level if 0 (with -c)")
+	compressWorkers := fs.Int("j", 0, "number of the goroutines which compress the clusters concurrently, GOMAXPROCS if 0 (with -c)")
+	dedup := fs.Bool("D", false, "deduplicate the data clusters of the output image which have the same contents (qcow2 only)")
+	copyOffload := fs.Bool("C", false, "copy the data in the kernel, such as by the reflink of the file system, if supported")
+	workers := fs.Int("m", qcow2.CONVERT_DEFAULT_WORKERS, "number of the chunks which are copied concurrently")
+	outOfOrder := fs.Bool("W", false, "allow the chunks to be written out of order")
+	progress := fs.Bool("p", false, "show the progress of the conversion")
+	rateLimit := fs.String("r", "", "bandwidth limit of the conversion in bytes per second, which may have the k, M or G suffix")
+	quiet := fs.Bool("q", false, "quiet mode")
+	format := fs.String("f", "", "image format of the input image, probed if omitted")
+	outFormat := fs.String("O", string(qcow2.DriverRaw), "image format of the output image (qcow2 or raw)")
+	backingFile := fs.String("B", "", "backing file of the output image")
+	backingFormat := fs.String("F", "", "format of the backing file of the output image")
+	options := fs.String("o", "", "comma separated list of the format specific options, or \"help\" to list them")
+	force := fs.Bool("U", false, "open the input image without the lock, even if it is in use")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 convert %s\n", commands["convert"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *options == "help" || *options == "?" {
+		fmt.Printf("Supported options:\n")
+		for _, opt := range createOptions {
+			fmt.Printf("  %-22s - %s\n", opt[0], opt[1])
+		}
+		return nil
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *backingFormat != "" && *backingFile == "" {
+		return errors.New("-F requires the backing file by -B")
+	}
+
+	opts := &qcow2.Opts{
+		Filename:      fs.Arg(1),
+		Fmt:           qcow2.DriverFmt(*outFormat),
+		BackingFile:   *backingFile,
+		BackingFormat: *backingFormat,
+	}
+	if *options != "" {
+		if *outFormat != string(qcow2.DriverQCow2) {
+			return errors.Errorf("Format driver '%s' does not support the options", *outFormat)
+		}
+		if err := parseCreateOptions(opts, *options); err != nil {
+			return err
+		}
+	}
+
+	src, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not open '%s'", fs.Arg(0))
+	}
+	defer src.Close()
+
+	copts := &qcow2.ConvertOpts{
+		Compress: *compress,
+		Compression: qcow2.Compression{
+			Level:   *compressLevel,
+			Workers: *compressWorkers,
+		},
+		Dedup:       *dedup,
+		CopyOffload: *copyOffload,
+		Workers:     *workers,
+		OutOfOrder:  *outOfOrder,
+	}
+	if *rateLimit != "" {
+		speed, err := qcow2.ParseSize(*rateLimit)
+		if err != nil || speed == 0 {
+			return errors.Errorf("Invalid rate limit specified: %s", *rateLimit)
+		}
+		copts.RateLimit.Speed = speed
+	}
+	showProgress := *progress && !*quiet
+	if showProgress {
+		copts.Progress = newProgressPrinter()
+	}
+
+	err = qcow2.Convert(src, opts, copts)
+	if showProgress {
+		fmt.Println()
+	}
+	return err
+}
+
+// newProgressPrinter returns the function which prints the progress percentage to stdout, whenever it advances
+// by 1 percent, same as the progress of qemu-img.
+//  util/qemu-progress.c: static void progress_simple_print(void)
+func newProgressPrinter() func(done, total int64) {
+	last := -1.0
+	return func(done, total int64) {
+		current := 100.0
+		if total > 0 {
+			current = float64(done) * 100 / float64(total)
+		}
+		if current < last+1 && current < 100 {
+			return
+		}
+		last = current
+		fmt.Printf("    (%3.2f/100%%)\r", current)
+	}
+}
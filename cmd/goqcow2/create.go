@@ -0,0 +1,198 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["create"] = &command{
+		usage: "[-q] [-f fmt] [-b backing_file [-F backing_fmt]] [-o options] filename [size]",
+		short: "create the new disk image",
+		run:   runCreate,
+	}
+}
+
+// createOptions the help of the image creation options of "-o".
+var createOptions = [][2]string{
+	{"backing_file", "File name of a base image"},
+	{"backing_fmt", "Image format of the base image"},
+	{"cluster_size", "qcow2 cluster size"},
+	{"compat", "Compatibility level (0.10 or 1.1)"},
+	{"lazy_refcounts", "Postpone refcount updates"},
+	{"nocow", "Turn off copy-on-write (valid only on btrfs)"},
+	{"preallocation", "Preallocation mode (allowed values: off, metadata, falloc, full)"},
+	{"refcount_bits", "Width of a reference count entry in bits"},
+	{"size", "Virtual disk size"},
+	{"table_size", "Number of clusters of the initial refcount table"},
+}
+
+// runCreate creates the new disk image, same as qemu-img create.
+//  qemu-img.c: static int img_create(int argc, char **argv)
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	quiet := fs.Bool("q", false, "quiet mode")
+	format := fs.String("f", "qcow2", "image format")
+	backingFile := fs.String("b", "", "backing file of the image")
+	backingFormat := fs.String("F", "", "format of the backing file")
+	options := fs.String("o", "", "comma separated list of the format specific options, or \"help\" to list them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 create %s\n", commands["create"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *options == "help" || *options == "?" {
+		fmt.Printf("Supported options:\n")
+		for _, opt := range createOptions {
+			fmt.Printf("  %-22s - %s\n", opt[0], opt[1])
+		}
+		return nil
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	if *format != string(qcow2.DriverQCow2) {
+		return errors.Errorf("Format driver '%s' does not support image creation", *format)
+	}
+
+	opts := &qcow2.Opts{
+		Filename:      fs.Arg(0),
+		Fmt:           qcow2.DriverQCow2,
+		BackingFile:   *backingFile,
+		BackingFormat: *backingFormat,
+	}
+	if *options != "" {
+		if err := parseCreateOptions(opts, *options); err != nil {
+			return err
+		}
+	}
+
+	// Get image size, if specified
+	if fs.NArg() == 2 {
+		opts.Size = 0
+		opts.SizeStr = fs.Arg(1)
+	}
+	if opts.Size == 0 && opts.SizeStr == "" && opts.BackingFile == "" {
+		return errors.New("Image creation needs a size parameter")
+	}
+
+	img, err := qcow2.Create(opts)
+	if err != nil {
+		return errors.Wrapf(err, "%s", opts.Filename)
+	}
+
+	if !*quiet {
+		info, err := img.Info()
+		if err != nil {
+			img.Close()
+			return err
+		}
+		printCreateInfo(info, opts)
+	}
+
+	return img.Close()
+}
+
+// printCreateInfo prints the options of the created image, same as the "Formatting" message of qemu-img create.
+func printCreateInfo(info *qcow2.ImageInfo, opts *qcow2.Opts) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Formatting '%s', fmt=%s cluster_size=%d compression_type=zlib size=%d", opts.Filename, info.Format, info.ClusterSize, info.VirtualSize)
+	if opts.BackingFile != "" {
+		fmt.Fprintf(&b, " backing_file=%s", opts.BackingFile)
+	}
+	if opts.BackingFormat != "" {
+		fmt.Fprintf(&b, " backing_fmt=%s", opts.BackingFormat)
+	}
+	if spec := info.FormatSpecific; spec != nil && spec.Data != nil {
+		lazyRefcounts := "off"
+		if spec.Data.LazyRefcounts != nil && *spec.Data.LazyRefcounts {
+			lazyRefcounts = "on"
+		}
+		fmt.Fprintf(&b, " lazy_refcounts=%s refcount_bits=%d", lazyRefcounts, spec.Data.RefcountBits)
+	}
+	fmt.Println(b.String())
+}
+
+// parseCreateOptions sets the comma separated list of the key=value creation options to opts.
+//  util/qemu-option.c: void qemu_opts_do_parse(QemuOpts *opts, const char *params, const char *firstname, Error **errp)
+func parseCreateOptions(opts *qcow2.Opts, options string) error {
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		key := kv[0]
+		var value string
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+
+		var err error
+		switch key {
+		case "backing_file":
+			opts.BackingFile = value
+		case "backing_fmt":
+			opts.BackingFormat = value
+		case "cluster_size":
+			var size int64
+			size, err = qcow2.ParseSize(value)
+			opts.ClusterSize = int(size)
+		case "compat":
+			opts.Compat = value
+		case "lazy_refcounts":
+			opts.LazyRefcounts, err = parseOnOff(key, value)
+		case "nocow":
+			opts.NoCow, err = parseOnOff(key, value)
+		case "preallocation":
+			opts.Preallocation, err = qcow2.ParsePreallocMode(value)
+		case "refcount_bits":
+			opts.RefcountBits, err = strconv.Atoi(value)
+			if err != nil {
+				err = errors.Errorf("Parameter '%s' expects a number", key)
+			}
+		case "size":
+			opts.Size = 0
+			opts.SizeStr = value
+		case "table_size":
+			opts.TableSize, err = strconv.Atoi(value)
+			if err != nil {
+				err = errors.Errorf("Parameter '%s' expects a number", key)
+			}
+		default:
+			err = errors.Errorf("Invalid parameter '%s'", key)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Invalid options for file format 'qcow2'")
+		}
+	}
+
+	return nil
+}
+
+// parseOnOff parses the boolean value of the option key.
+func parseOnOff(key, value string) (bool, error) {
+	switch value {
+	case "on", "yes", "true", "":
+		return true, nil
+	case "off", "no", "false":
+		return false, nil
+	}
+	return false, errors.Errorf("Parameter '%s' expects 'on' or 'off'", key)
+}
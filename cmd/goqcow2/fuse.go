@@ -0,0 +1,73 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/fuse"
+)
+
+func init() {
+	commands["fuse"] = &command{
+		usage: "[-r] [-u] [-w] [-f format] [-a] filename mountpoint",
+		short: "export the guest disk as the raw file over FUSE",
+		run:   runFUSE,
+	}
+}
+
+// runFUSE mounts the guest disk of the image on the regular file mountpoint until interrupted or unmounted,
+// same as the FUSE export of qemu-storage-daemon.
+func runFUSE(args []string) error {
+	fs := flag.NewFlagSet("fuse", flag.ContinueOnError)
+	readOnly := fs.Bool("r", false, "export the image as read-only")
+	unmap := fs.Bool("u", false, "punch the holes of the discarded clusters in the image file")
+	wipe := fs.Bool("w", false, "overwrite the freed clusters with zeros before they are freed")
+	format := fs.String("f", "", "image format, probed if omitted")
+	allowOther := fs.Bool("a", false, "allow the other users to access the exported file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 fuse %s\n", commands["fuse"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	flags := os.O_RDWR
+	if *readOnly {
+		flags = os.O_RDONLY
+	}
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), flags, &qcow2.OpenOpts{Unmap: *unmap, Wipe: *wipe})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	exp, err := fuse.Mount(fs.Arg(1), img, &fuse.Options{
+		ReadOnly:   *readOnly,
+		AllowOther: *allowOther,
+	})
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		exp.Close()
+	}()
+
+	return exp.Serve()
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["histogram"] = &command{
+		usage: "[-f fmt] [-output human|json] [-U] filename",
+		short: "count the guest clusters of the disk image by cluster type",
+		run:   runHistogram,
+	}
+}
+
+// runHistogram prints the number of the guest clusters of the image by cluster type, and the fragmentation of
+// the allocated clusters.
+func runHistogram(args []string) error {
+	fs := flag.NewFlagSet("histogram", flag.ContinueOnError)
+	format := fs.String("f", "", "image format, probed if omitted")
+	output := fs.String("output", "human", "output format (human or json)")
+	force := fs.Bool("U", false, "open the image without the lock; required if the image is opened read-write elsewhere")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 histogram %s\n", commands["histogram"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	h, err := img.ClusterHistogram()
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "json":
+		buf, err := json.MarshalIndent(h, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	case "human":
+		fmt.Printf("cluster size: %d\n", h.ClusterSize)
+		fmt.Printf("total clusters: %d\n", h.Total)
+		fmt.Printf("unallocated clusters: %d\n", h.Unallocated)
+		fmt.Printf("zero clusters: %d\n", h.Zero)
+		fmt.Printf("compressed clusters: %d\n", h.Compressed)
+		fmt.Printf("normal clusters: %d\n", h.Normal)
+		fmt.Printf("backing clusters: %d\n", h.Backing)
+		fmt.Printf("fragmented clusters: %d (%.2f%%)\n", h.Fragmented, h.Fragmentation())
+		for i, n := range h.Runs {
+			if n != 0 {
+				fmt.Printf("runs of %d-%d clusters: %d\n", int64(1)<<uint(i), int64(1)<<uint(i+1)-1, n)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["info"] = &command{
+		usage: "[-f fmt] [-output human|json] [-backing-chain] [-U] filename",
+		short: "print the information of the disk image",
+		run:   runInfo,
+	}
+}
+
+// runInfo prints the information of the image, same as qemu-img info.
+//  qemu-img.c: static int img_info(int argc, char **argv)
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	format := fs.String("f", "", "image format, probed if omitted")
+	output := fs.String("output", "human", "output format (human or json)")
+	chain := fs.Bool("backing-chain", false, "print the information of the backing file chain")
+	force := fs.Bool("U", false, "open the image without the lock; required if the image is opened read-write elsewhere")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 info %s\n", commands["info"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: !*chain,
+		Force:     *force,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	images := []*qcow2.QCow2{img}
+	if *chain {
+		backings, err := img.BackingChain()
+		if err != nil {
+			return err
+		}
+		for _, backing := range backings {
+			defer backing.Close()
+		}
+		images = append(images, backings...)
+	}
+
+	infos := make([]*qcow2.ImageInfo, len(images))
+	for i, image := range images {
+		info, err := image.Info()
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+	}
+
+	if *output == "json" {
+		var v interface{} = infos[0]
+		if *chain {
+			v = infos
+		}
+		buf, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+		return nil
+	}
+
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		dumpHumanImageInfo(info)
+	}
+
+	return nil
+}
+
+// dumpHumanImageInfo prints the information of the image in the human readable format.
+//  block/qapi.c: void bdrv_image_info_dump(ImageInfo *info)
+func dumpHumanImageInfo(info *qcow2.ImageInfo) {
+	fmt.Printf("image: %s\n", info.Filename)
+	fmt.Printf("file format: %s\n", info.Format)
+	fmt.Printf("virtual size: %s (%d bytes)\n", sizeToStr(info.VirtualSize), info.VirtualSize)
+	fmt.Printf("disk size: %s\n", sizeToStr(info.ActualSize))
+
+	if info.ClusterSize != 0 {
+		fmt.Printf("cluster_size: %d\n", info.ClusterSize)
+	}
+	if info.DirtyFlag {
+		fmt.Printf("cleanly shut down: no\n")
+	}
+	if info.BackingFilename != "" {
+		fmt.Printf("backing file: %s", info.BackingFilename)
+		if info.FullBackingFilename != "" && info.FullBackingFilename != info.BackingFilename {
+			fmt.Printf(" (actual path: %s)", info.FullBackingFilename)
+		}
+		fmt.Println()
+		if info.BackingFilenameFormat != "" {
+			fmt.Printf("backing file format: %s\n", info.BackingFilenameFormat)
+		}
+	}
+
+	if spec := info.FormatSpecific; spec != nil && spec.Data != nil {
+		fmt.Printf("Format specific information:\n")
+		fmt.Printf("    compat: %s\n", spec.Data.Compat)
+		fmt.Printf("    compression type: %s\n", spec.Data.CompressionType)
+		if spec.Data.LazyRefcounts != nil {
+			fmt.Printf("    lazy refcounts: %t\n", *spec.Data.LazyRefcounts)
+		}
+		fmt.Printf("    refcount bits: %d\n", spec.Data.RefcountBits)
+		if spec.Data.Corrupt != nil {
+			fmt.Printf("    corrupt: %t\n", *spec.Data.Corrupt)
+		}
+		fmt.Printf("    extended l2: %t\n", spec.Data.ExtendedL2)
+	}
+}
+
+// sizeToStr returns the human readable size with the binary unit suffix.
+//  util/cutils.c: char *size_to_str(uint64_t val)
+func sizeToStr(val int64) string {
+	suffixes := []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+
+	// The exponent (returned in i) minus one gives us
+	// floor(log2(val * 1024 / 1000).  The correction makes us
+	// switch to the higher power when the integer part is >= 1000.
+	_, i := math.Frexp(float64(val) / (1000.0 / 1024.0))
+	i = (i - 1) / 10
+	if i < 0 {
+		i = 0
+	}
+	div := float64(uint64(1) << uint(i*10))
+
+	return fmt.Sprintf("%0.3g %sB", float64(val)/div, suffixes[i])
+}
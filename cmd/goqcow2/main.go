@@ -0,0 +1,99 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command goqcow2 manages the QEMU qcow2 image format.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+	// register the http:// and https:// image files
+	_ "github.com/zchee/go-qcow2/curl"
+)
+
+// command represents a subcommand of goqcow2.
+type command struct {
+	// usage one line usage of the subcommand arguments.
+	usage string
+	// short one line description of the subcommand.
+	short string
+	// run runs the subcommand with the arguments after the subcommand name.
+	run func(args []string) error
+}
+
+// commands map of the subcommand name to the command.
+var commands = map[string]*command{}
+
+// exitError is the error which exits goqcow2 with the exit code, same as qemu-img.
+// The message is printed if err is not nil.
+type exitError struct {
+	code int
+	err  error
+}
+
+// Error implements error.
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+// stderrLogger writes the messages of the images to stderr without the level prefix, same as qemu-img.
+type stderrLogger struct{}
+
+// Logf implements qcow2.Logger.
+func (stderrLogger) Logf(level qcow2.LogLevel, format string, args ...interface{}) {
+	if level < qcow2.LogInfo {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: goqcow2 <command> [arguments]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].short)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "goqcow2: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	qcow2.SetLogger(stderrLogger{})
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		code := 1
+		var ee *exitError
+		if errors.As(err, &ee) {
+			code = ee.code
+			err = ee.err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "goqcow2 %s: %v\n", os.Args[1], err)
+		}
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["map"] = &command{
+		usage: "[-f fmt] [-output human|json] [-start-offset offset] [-max-length len] [-U] filename",
+		short: "dump the metadata of the disk image and its backing file chain",
+		run:   runMap,
+	}
+}
+
+// runMap prints the allocation map of the image and its backing file chain, same as qemu-img map.
+//  qemu-img.c: static int img_map(int argc, char **argv)
+func runMap(args []string) error {
+	fs := flag.NewFlagSet("map", flag.ContinueOnError)
+	format := fs.String("f", "", "image format, probed if omitted")
+	output := fs.String("output", "human", "output format (human or json)")
+	startOffset := fs.String("start-offset", "0", "guest offset to start the map from")
+	maxLength := fs.String("max-length", "", "maximum length of the guest range to map, up to the end of the image if omitted")
+	force := fs.Bool("U", false, "open the image without the lock, even if it is in use")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 map %s\n", commands["map"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+
+	start, err := qcow2.ParseSize(*startOffset)
+	if err != nil {
+		return errors.New("Invalid start offset specified")
+	}
+	length := int64(-1)
+	if *maxLength != "" {
+		length, err = qcow2.ParseSize(*maxLength)
+		if err != nil {
+			return errors.New("Invalid max length specified")
+		}
+	}
+
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	extents, err := img.MapRange(start, length)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return dumpJSONMap(extents)
+	}
+
+	// the file names of the backing chain layers, indexed by the depth of the extents
+	images := []*qcow2.QCow2{img}
+	backings, err := img.BackingChain()
+	if err != nil {
+		return err
+	}
+	for _, backing := range backings {
+		defer backing.Close()
+	}
+	images = append(images, backings...)
+	filenames := make([]string, len(images))
+	for i, image := range images {
+		info, err := image.Info()
+		if err != nil {
+			return err
+		}
+		filenames[i] = info.Filename
+	}
+
+	return dumpHumanMap(extents, filenames)
+}
+
+// dumpHumanMap prints the data extents in the human readable format. filenames are the file names of the
+// backing chain layers, indexed by the depth.
+//  qemu-img.c: static int dump_map_entry(OutputFormat output_format, MapEntry *e, MapEntry *next)
+func dumpHumanMap(extents []qcow2.Extent, filenames []string) error {
+	fmt.Printf("%-16s%-16s%-16s%s\n", "Offset", "Length", "Mapped to", "File")
+	for _, e := range extents {
+		if e.Data && !e.HasOffset {
+			return errors.New("File contains external, encrypted or compressed clusters.")
+		}
+		if !e.Data || e.Zero {
+			continue
+		}
+
+		var filename string
+		if e.Depth < len(filenames) {
+			filename = filenames[e.Depth]
+		}
+		fmt.Printf("%-16s%-16s%-16s%s\n", hexStr(e.Start), hexStr(e.Length), hexStr(e.Offset), filename)
+	}
+
+	return nil
+}
+
+// dumpJSONMap prints all of the extents as the json array, an extent per line.
+//  qemu-img.c: static int dump_map_entry(OutputFormat output_format, MapEntry *e, MapEntry *next)
+func dumpJSONMap(extents []qcow2.Extent) error {
+	fmt.Printf("[")
+	for i, e := range extents {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Printf(",\n")
+		}
+		fmt.Printf("%s", buf)
+	}
+	fmt.Printf("]\n")
+
+	return nil
+}
+
+// hexStr returns val in hexadecimal with the 0x prefix, except for 0, same as the "%#x" format of C.
+func hexStr(val int64) string {
+	if val == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%#x", val)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["measure"] = &command{
+		usage: "[-output human|json] [-O output_fmt] [-o options] [-size N | [-f fmt] [-U] filename]",
+		short: "calculate the file size required for the new disk image",
+		run:   runMeasure,
+	}
+}
+
+// runMeasure calculates the file size required for the new image, which is converted from the image or is
+// created with the size, same as qemu-img measure.
+//  qemu-img.c: static int img_measure(int argc, char **argv)
+func runMeasure(args []string) error {
+	fs := flag.NewFlagSet("measure", flag.ContinueOnError)
+	output := fs.String("output", "human", "output format (human or json)")
+	outFormat := fs.String("O", string(qcow2.DriverQCow2), "image format of the new image (qcow2 only)")
+	options := fs.String("o", "", "comma separated list of the format specific options, or \"help\" to list them")
+	sizeStr := fs.String("size", "", "virtual disk size of the new empty image, instead of the input image")
+	format := fs.String("f", "", "image format of the input image, probed if omitted")
+	force := fs.Bool("U", false, "open the input image without the lock, even if it is in use")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 measure %s\n", commands["measure"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *options == "help" || *options == "?" {
+		fmt.Printf("Supported options:\n")
+		for _, opt := range createOptions {
+			fmt.Printf("  %-22s - %s\n", opt[0], opt[1])
+		}
+		return nil
+	}
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+	if fs.NArg() == 1 && *sizeStr != "" {
+		return errors.New("--size N cannot be used together with a filename.")
+	}
+	if fs.NArg() == 0 && *sizeStr == "" {
+		return errors.New("Either --size N or one filename must be specified.")
+	}
+	if *outFormat != string(qcow2.DriverQCow2) {
+		return errors.Errorf("Format driver '%s' does not support size measurement", *outFormat)
+	}
+
+	opts := &qcow2.Opts{
+		Fmt: qcow2.DriverQCow2,
+	}
+	if *options != "" {
+		if err := parseCreateOptions(opts, *options); err != nil {
+			return err
+		}
+	}
+
+	var src *qcow2.QCow2
+	if fs.NArg() == 1 {
+		var err error
+		src, err = qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+			Force: *force,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Could not open '%s'", fs.Arg(0))
+		}
+		defer src.Close()
+	} else {
+		size, err := qcow2.ParseSize(*sizeStr)
+		if err != nil {
+			return err
+		}
+		opts.Size = size
+	}
+
+	info, err := qcow2.Measure(src, opts)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "json":
+		buf, err := json.MarshalIndent(info, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	case "human":
+		fmt.Printf("required size: %d\n", info.Required)
+		fmt.Printf("fully allocated size: %d\n", info.FullyAllocated)
+	}
+
+	return nil
+}
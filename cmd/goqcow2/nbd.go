@@ -0,0 +1,98 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/nbd"
+)
+
+func init() {
+	commands["nbd"] = &command{
+		usage: "[-r] [-u] [-w] [-f format] [-R readahead] [-x name] [-D description] [-k socket | -b address -p port] filename",
+		short: "export the image over the NBD protocol",
+		run:   runNBD,
+	}
+}
+
+// runNBD exports the image over the NBD protocol until interrupted, same as qemu-nbd.
+func runNBD(args []string) error {
+	fs := flag.NewFlagSet("nbd", flag.ContinueOnError)
+	readOnly := fs.Bool("r", false, "export the image as read-only")
+	unmap := fs.Bool("u", false, "punch the holes of the discarded clusters in the image file")
+	wipe := fs.Bool("w", false, "overwrite the freed clusters with zeros before they are freed")
+	format := fs.String("f", "", "image format, probed if omitted")
+	readahead := fs.Int64("R", 0, "maximum readahead window of the sequential reads in bytes, disabled if 0")
+	name := fs.String("x", "", "export name")
+	description := fs.String("D", "", "export description")
+	socket := fs.String("k", "", "path of the unix socket to listen on")
+	address := fs.String("b", "0.0.0.0", "address to listen on")
+	port := fs.Int("p", 10809, "TCP port to listen on")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 nbd %s\n", commands["nbd"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	flags := os.O_RDWR
+	if *readOnly {
+		flags = os.O_RDONLY
+	}
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), flags, &qcow2.OpenOpts{Unmap: *unmap, Wipe: *wipe})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if err := img.SetReadahead(*readahead); err != nil {
+		return err
+	}
+
+	srv := nbd.NewServer()
+	if err := srv.AddExport(&nbd.Export{
+		Name:        *name,
+		Description: *description,
+		Image:       img,
+		ReadOnly:    *readOnly,
+	}); err != nil {
+		return err
+	}
+
+	var l net.Listener
+	if *socket != "" {
+		l, err = net.Listen("unix", *socket)
+	} else {
+		l, err = net.Listen("tcp", net.JoinHostPort(*address, strconv.Itoa(*port)))
+	}
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != nbd.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["recover"] = &command{
+		usage: "[-s size] [-l l1_offset] [-b backing_file] [-F backing_fmt] [-w] filename",
+		short: "reconstruct the smashed header of the qcow2 image from its metadata",
+		run:   runRecover,
+	}
+}
+
+// runRecover reconstructs the header of the qcow2 image, and prints it. The header is written to the image
+// only with -w.
+func runRecover(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	size := fs.String("s", "", "virtual disk size of the image, derived from the L1 table if omitted")
+	l1Offset := fs.String("l", "", "offset of the active L1 table, selected from the tables found if omitted")
+	backingFile := fs.String("b", "", "backing file name of the image")
+	backingFmt := fs.String("F", "", "format of the backing file")
+	write := fs.Bool("w", false, "write the recovered header to the image")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 recover %s\n", commands["recover"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *backingFmt != "" && *backingFile == "" {
+		return errors.New("Backing format specified without a backing file")
+	}
+
+	opts := &qcow2.RecoverOpts{
+		BackingFile:   *backingFile,
+		BackingFormat: *backingFmt,
+		Write:         *write,
+	}
+	if *size != "" {
+		n, err := qcow2.ParseSize(*size)
+		if err != nil {
+			return err
+		}
+		opts.Size = n
+	}
+	if *l1Offset != "" {
+		n, err := strconv.ParseUint(*l1Offset, 0, 64)
+		if err != nil {
+			return errors.Errorf("Invalid L1 table offset: '%s'", *l1Offset)
+		}
+		opts.L1TableOffset = n
+	}
+
+	h, err := qcow2.RecoverHeader(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("cluster_size: %d\n", 1<<h.ClusterBits)
+	fmt.Printf("refcount_bits: %d\n", 1<<h.RefcountOrder)
+	fmt.Printf("virtual size: %d\n", h.Size)
+	fmt.Printf("refcount table: offset %#x, %d clusters\n", h.RefcountTableOffset, h.RefcountTableClusters)
+	fmt.Printf("L1 table: offset %#x, %d entries\n", h.L1TableOffset, h.L1Size)
+	if h.NbSnapshots > 0 {
+		fmt.Printf("snapshot table: offset %#x, %d snapshots\n", h.SnapshotsOffset, h.NbSnapshots)
+	}
+	if h.BackingFile != "" {
+		fmt.Printf("backing file: %s\n", h.BackingFile)
+	}
+	for _, offset := range h.OtherL1Tables {
+		fmt.Printf("other L1 table candidate: offset %#x\n", offset)
+	}
+
+	if h.Written {
+		fmt.Printf("The recovered header is written, check the image by 'goqcow2 check -r all %s'\n", fs.Arg(0))
+	} else {
+		fmt.Printf("The image is not changed, write the recovered header by -w\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["schema"] = &command{
+		usage: "[-version] [name]",
+		short: "print the JSON schema of the command outputs",
+		run:   runSchema,
+	}
+}
+
+// runSchema prints the JSON schema of the name output, or the list of the schema names if name is omitted.
+func runSchema(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	version := fs.Bool("version", false, "print the schema version")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 schema %s\n", commands["schema"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case *version:
+		fmt.Println(qcow2.SchemaVersion)
+	case fs.NArg() == 0:
+		for _, name := range qcow2.SchemaNames() {
+			fmt.Println(name)
+		}
+	case fs.NArg() == 1:
+		schema, err := qcow2.Schema(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(schema)
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	return nil
+}
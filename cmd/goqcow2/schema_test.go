@@ -0,0 +1,220 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// captureStdout runs the command, and returns what it prints to the standard output.
+func captureStdout(t *testing.T, run func(args []string) error, args ...string) []byte {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	err = run(args)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// validate validates v against the JSON schema, which is the subset of draft-07 the schemas use. root is the
+// schema document, which the $ref refers to.
+func validate(root, schema map[string]interface{}, v interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		def, ok := root["definitions"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown $ref %q", path, ref)
+		}
+		return validate(root, def, v, path)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		n := 0
+		for _, sub := range oneOf {
+			if validate(root, sub.(map[string]interface{}), v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf", path, n)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not in %v", path, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case nil:
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %T is not object", path, v)
+		}
+		for _, name := range schema["required"].([]interface{}) {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required %q", path, name)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for name, pv := range obj {
+			if sub, ok := props[name].(map[string]interface{}); ok {
+				if err := validate(root, sub, pv, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %T is not array", path, v)
+		}
+		for i, item := range arr {
+			if err := validate(root, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: %T is not string", path, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %T is not boolean", path, v)
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: %T is not integer", path, v)
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fmt.Errorf("%s: %v is not integer", path, n)
+		}
+		if min, ok := schema["minimum"].(json.Number); ok {
+			if m, _ := min.Int64(); i < m {
+				return fmt.Errorf("%s: %d is less than %d", path, i, m)
+			}
+		}
+		if max, ok := schema["maximum"].(json.Number); ok {
+			if m, _ := max.Int64(); i > m {
+				return fmt.Errorf("%s: %d is greater than %d", path, i, m)
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %v", path, schema["type"])
+	}
+
+	return nil
+}
+
+// decodeJSON decodes b with the numbers kept as json.Number.
+func decodeJSON(t *testing.T, b []byte) interface{} {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	return v
+}
+
+// TestSchemas validates the JSON outputs of the commands against their schemas. Every schema must be covered.
+func TestSchemas(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+	overlay := filepath.Join(dir, "overlay.qcow2")
+
+	img, err := qcow2.CreateImage(base, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("base"), 64<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err = qcow2.CreateImage(overlay, 4<<20, qcow2.WithBackingFile(base, qcow2.DriverQCow2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("overlay!"), 8<<10), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.WriteZeroes(2<<20, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		schema string
+		run    func(args []string) error
+		args   []string
+	}{
+		{schema: "info", run: runInfo, args: []string{"-output", "json", overlay}},
+		{schema: "info", run: runInfo, args: []string{"-output", "json", "-backing-chain", overlay}},
+		{schema: "check", run: runCheck, args: []string{"-output", "json", overlay}},
+		{schema: "map", run: runMap, args: []string{"-output", "json", overlay}},
+		{schema: "measure", run: runMeasure, args: []string{"-output", "json", overlay}},
+		{schema: "measure", run: runMeasure, args: []string{"-output", "json", "-size", "1G"}},
+		{schema: "histogram", run: runHistogram, args: []string{"-output", "json", overlay}},
+		{schema: "usage", run: runUsage, args: []string{"-output", "json", overlay}},
+	}
+
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		covered[tt.schema] = true
+		t.Run(strings.Join(append([]string{tt.schema}, tt.args[2:]...), " "), func(t *testing.T) {
+			b, err := qcow2.Schema(tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schema := decodeJSON(t, b).(map[string]interface{})
+
+			out := captureStdout(t, tt.run, tt.args...)
+			if err := validate(schema, schema, decodeJSON(t, out), "$"); err != nil {
+				t.Errorf("output does not match the schema: %v\n%s", err, out)
+			}
+		})
+	}
+	for _, name := range qcow2.SchemaNames() {
+		if !covered[name] {
+			t.Errorf("schema %q is not tested against the output of its command", name)
+		}
+	}
+}
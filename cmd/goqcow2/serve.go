@@ -0,0 +1,136 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"google.golang.org/grpc"
+
+	"github.com/zchee/go-qcow2/qmp"
+	"github.com/zchee/go-qcow2/rest"
+	"github.com/zchee/go-qcow2/rpc"
+)
+
+func init() {
+	commands["serve"] = &command{
+		usage: "[-http | -qmp] [-root dir] [-k socket | -b address -p port]",
+		short: "serve the image management operations over gRPC, the HTTP REST API or QMP",
+		run:   runServe,
+	}
+}
+
+// runServe serves the ImageService over gRPC, the REST API over HTTP, or the QMP sessions on the connections,
+// until interrupted, same as qemu-storage-daemon with the QMP monitor.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	useHTTP := fs.Bool("http", false, "serve the REST API over HTTP instead of gRPC")
+	useQMP := fs.Bool("qmp", false, "serve the QMP monitor instead of gRPC")
+	socket := fs.String("k", "", "path of the unix socket to listen on")
+	address := fs.String("b", "127.0.0.1", "address to listen on")
+	port := fs.Int("p", 50051, "TCP port to listen on")
+	root := fs.String("root", "", "confine the files of the requests to the directory")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 serve %s\n", commands["serve"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *useHTTP && *useQMP {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	var l net.Listener
+	var err error
+	if *socket != "" {
+		l, err = net.Listen("unix", *socket)
+	} else {
+		l, err = net.Listen("tcp", net.JoinHostPort(*address, strconv.Itoa(*port)))
+	}
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	if *useHTTP {
+		hs := &http.Server{Handler: rest.NewHandler(&rest.Options{Root: *root})}
+		go func() {
+			<-sig
+			hs.Shutdown(context.Background())
+		}()
+		if err := hs.Serve(l); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+
+	if *useQMP {
+		return serveQMP(l, sig, *root)
+	}
+
+	srv := rpc.NewServer(&rpc.Options{Root: *root})
+	defer srv.Close()
+	s := grpc.NewServer()
+	srv.Register(s)
+
+	go func() {
+		<-sig
+		s.GracefulStop()
+	}()
+
+	return s.Serve(l)
+}
+
+// serveQMP serves the QMP session on each connection of l until the signal is received. The connections share
+// the nodes of the Monitor, which are closed on return. The filenames are confined to root if it is not empty.
+func serveQMP(l net.Listener, sig <-chan os.Signal, root string) error {
+	m := qmp.NewMonitor(&qmp.Options{Root: root})
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-sig
+		cancel()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			cctx, ccancel := context.WithCancel(ctx)
+			defer ccancel()
+			go func() {
+				<-cctx.Done()
+				conn.Close()
+			}()
+			m.Serve(cctx, conn)
+		}()
+	}
+}
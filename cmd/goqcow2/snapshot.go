@@ -0,0 +1,143 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["snapshot"] = &command{
+		usage: "[-l | -a snapshot | -c snapshot | -d snapshot] [-q] [-w] [-m max_snapshots] [-f fmt] [-U] filename",
+		short: "list, create, apply or delete the internal snapshots of the disk image",
+		run:   runSnapshot,
+	}
+}
+
+// The actions of the snapshot subcommand.
+//  qemu-img.c: static int img_snapshot(int argc, char **argv)
+const (
+	snapshotList = iota + 1
+	snapshotCreate
+	snapshotApply
+	snapshotDelete
+)
+
+// runSnapshot lists, creates, applies or deletes the internal snapshots of the image, same as qemu-img snapshot.
+//  qemu-img.c: static int img_snapshot(int argc, char **argv)
+func runSnapshot(args []string) error {
+	var (
+		action       int
+		snapshotName string
+	)
+	setAction := func(a int) func(string) error {
+		return func(name string) error {
+			if action != 0 {
+				return errors.New("Cannot mix '-l', '-a', '-c', '-d'")
+			}
+			action = a
+			snapshotName = name
+			return nil
+		}
+	}
+
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	fs.BoolFunc("l", "list all snapshots in the image", func(string) error { return setAction(snapshotList)("") })
+	fs.Func("a", "apply the snapshot, which reverts the disk to the saved state", setAction(snapshotApply))
+	fs.Func("c", "create the snapshot", setAction(snapshotCreate))
+	fs.Func("d", "delete the snapshot", setAction(snapshotDelete))
+	quiet := fs.Bool("q", false, "quiet mode")
+	wipe := fs.Bool("w", false, "overwrite the clusters freed by the deletion with zeros")
+	maxSnapshots := fs.Int("m", 0, "fail the creation if the image already has max_snapshots snapshots (-c only)")
+	format := fs.String("f", "", "image format, probed if omitted")
+	force := fs.Bool("U", false, "open the image without the lock, even if it is in use (-l only)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 snapshot %s\n", commands["snapshot"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	filename := fs.Arg(0)
+
+	flags := os.O_RDWR
+	if action == 0 || action == snapshotList {
+		action = snapshotList
+		flags = os.O_RDONLY
+	} else if *force {
+		return errors.New("--force-share/-U is not supported with the modifications of the snapshots")
+	}
+
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverFmt(*format), flags, &qcow2.OpenOpts{
+		NoBacking: true,
+		Force:     *force,
+		Wipe:      *wipe,
+		SnapshotQuota: qcow2.SnapshotQuota{
+			MaxSnapshots: *maxSnapshots,
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not open '%s'", filename)
+	}
+	defer img.Close()
+
+	switch action {
+	case snapshotList:
+		snapshots, err := img.Snapshots()
+		if err != nil {
+			return err
+		}
+		if !*quiet {
+			dumpSnapshots(snapshots)
+		}
+
+	case snapshotCreate:
+		if _, err := img.CreateSnapshot(snapshotName); err != nil {
+			return errors.Wrapf(err, "Could not create snapshot '%s'", snapshotName)
+		}
+
+	case snapshotApply:
+		if err := img.ApplySnapshot(snapshotName); err != nil {
+			return errors.Wrapf(err, "Could not apply snapshot '%s'", snapshotName)
+		}
+
+	case snapshotDelete:
+		if err := img.DeleteSnapshot(snapshotName); err != nil {
+			return errors.Wrapf(err, "Could not delete snapshot '%s'", snapshotName)
+		}
+	}
+
+	return img.Close()
+}
+
+// dumpSnapshots prints the list of the snapshots in the human readable format.
+//  block/qapi.c: void bdrv_snapshot_dump(QEMUSnapshotInfo *sn)
+func dumpSnapshots(snapshots []qcow2.SnapshotInfo) {
+	if len(snapshots) == 0 {
+		return
+	}
+
+	fmt.Printf("Snapshot list:\n")
+	fmt.Printf("%-10s%-17s%8s%20s%13s%11s\n", "ID", "TAG", "VM SIZE", "DATE", "VM CLOCK", "ICOUNT")
+	for _, sn := range snapshots {
+		date := time.Unix(sn.DateSec, sn.DateNsec).Format("2006-01-02 15:04:05")
+
+		secs := sn.VMClockSec
+		clock := fmt.Sprintf("%02d:%02d:%02d.%03d", secs/3600, (secs/60)%60, secs%60, sn.VMClockNsec/1000000)
+
+		fmt.Printf("%-9s %-16s %8s%20s%13s%11s\n", sn.ID, sn.Name, sizeToStr(sn.VMStateSize), date, clock, "")
+	}
+}
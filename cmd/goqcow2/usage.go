@@ -0,0 +1,89 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func init() {
+	commands["usage"] = &command{
+		usage: "[-f fmt] [-output human|json] [-U] filename",
+		short: "print where the space of the image file goes",
+		run:   runUsage,
+	}
+}
+
+// runUsage prints the space of the image file by the structure which uses it.
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	format := fs.String("f", "", "image format, probed if omitted")
+	output := fs.String("output", "human", "output format (human or json)")
+	force := fs.Bool("U", false, "open the image without the lock; required if the image is opened read-write elsewhere")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 usage %s\n", commands["usage"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *output != "human" && *output != "json" {
+		return errors.Errorf("--output must be used with human or json as argument.")
+	}
+
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), os.O_RDONLY, &qcow2.OpenOpts{
+		Force: *force,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	u, err := img.Usage()
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "json":
+		buf, err := json.MarshalIndent(u, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+	case "human":
+		fmt.Printf("cluster size: %d\n", u.ClusterSize)
+		fmt.Printf("virtual size: %d\n", u.VirtualSize)
+		fmt.Printf("file length: %d\n", u.FileLength)
+		fmt.Printf("allocated size: %d\n", u.AllocatedSize)
+		fmt.Printf("allocated clusters: %d\n", u.AllocatedClusters)
+		fmt.Printf("data clusters: %d\n", u.DataClusters)
+		fmt.Printf("compressed clusters: %d\n", u.CompressedClusters)
+		fmt.Printf("free clusters: %d\n", u.FreeClusters)
+		fmt.Printf("leaked clusters: %d\n", u.LeakedClusters)
+		fmt.Printf("metadata: %d bytes\n", u.MetadataBytes())
+		fmt.Printf("  header: %d bytes\n", u.HeaderBytes)
+		fmt.Printf("  L1 table: %d bytes\n", u.L1Bytes)
+		fmt.Printf("  L2 tables: %d bytes\n", u.L2Bytes)
+		fmt.Printf("  refcount: %d bytes\n", u.RefcountBytes)
+		fmt.Printf("  snapshots: %d bytes\n", u.SnapshotBytes)
+		fmt.Printf("  bitmaps: %d bytes\n", u.BitmapBytes)
+		fmt.Printf("compressed guest data: %d bytes\n", u.CompressedGuestBytes)
+		fmt.Printf("compressed data: %d bytes (saved %d bytes)\n", u.CompressedBytes, u.CompressedSavings())
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func TestUsage(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "usage.qcow2")
+	img, err := qcow2.CreateImage(filename, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("usage!!!"), 16<<10), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err = qcow2.OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Usage()
+	img.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got qcow2.Usage
+	out := captureStdout(t, runUsage, "-output", "json", filename)
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", out, err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("usage is %+v, want %+v", got, *want)
+	}
+	if got.DataClusters == 0 {
+		t.Error("the written data clusters are not counted")
+	}
+
+	out = captureStdout(t, runUsage, filename)
+	if !bytes.Contains(out, []byte("cluster size: 65536\n")) {
+		t.Errorf("unexpected human output:\n%s", out)
+	}
+
+	if err := runUsage([]string{"-output", "xml", filename}); err == nil {
+		t.Error("the unknown output format is accepted")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/vhostuser"
+)
+
+func init() {
+	commands["vhost-user-blk"] = &command{
+		usage: "[-r] [-u] [-w] [-f format] [-n queues] [-s serial] [-b logical-block-size] -k socket filename",
+		short: "export the image as the vhost-user-blk device",
+		run:   runVhostUserBlk,
+	}
+}
+
+// runVhostUserBlk exports the image as the vhost-user-blk device until interrupted, same as the vhost-user-blk
+// export of qemu-storage-daemon.
+func runVhostUserBlk(args []string) error {
+	fs := flag.NewFlagSet("vhost-user-blk", flag.ContinueOnError)
+	readOnly := fs.Bool("r", false, "export the image as read-only")
+	unmap := fs.Bool("u", false, "punch the holes of the discarded clusters in the image file")
+	wipe := fs.Bool("w", false, "overwrite the freed clusters with zeros before they are freed")
+	format := fs.String("f", "", "image format, probed if omitted")
+	numQueues := fs.Int("n", 1, "number of the virtqueues")
+	serial := fs.String("s", "", "serial of the device")
+	blockSize := fs.Int("b", 512, "logical block size of the device")
+	socket := fs.String("k", "", "path of the unix socket to listen on")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goqcow2 vhost-user-blk %s\n", commands["vhost-user-blk"].usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *socket == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	flags := os.O_RDWR
+	if *readOnly {
+		flags = os.O_RDONLY
+	}
+	img, err := qcow2.OpenFileOpts(fs.Arg(0), qcow2.DriverFmt(*format), flags, &qcow2.OpenOpts{Unmap: *unmap, Wipe: *wipe})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	srv, err := vhostuser.NewServer(img, &vhostuser.Options{
+		ReadOnly:         *readOnly,
+		NumQueues:        *numQueues,
+		LogicalBlockSize: *blockSize,
+		Serial:           *serial,
+	})
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && err != vhostuser.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"os"
+	"runtime/trace"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CommitOpts represents the options of Commit.
+type CommitOpts struct {
+	// Empty empties the image after the commit, so the committed ranges are read from the backing file,
+	// same as 'qemu-img commit' without '-d'. The image must be opened as read-write.
+	Empty bool
+}
+
+// Commit writes the ranges which are allocated in the image, but not in its backing file, into the backing file,
+// so that the changes of the overlay are merged into the backing file. The backing file is reopened as
+// read-write for the commit, and is grown to the size of the image if it is smaller. The backing file must not
+// be shared with the other open images, and must be the local file. If opts is nil, the image is kept as is.
+//  qemu-img.c: static int img_commit(int argc, char **argv)
+func (q *QCow2) Commit(opts *CommitOpts) error {
+	return q.CommitContext(context.Background(), opts)
+}
+
+// CommitContext is like Commit, but stops writing when ctx is done, and returns the error of ctx.
+// The ranges already written are kept in the backing file, and the image is not emptied, so the guest
+// visible contents of the image are not changed by the cancellation.
+func (q *QCow2) CommitContext(ctx context.Context, opts *CommitOpts) (err error) {
+	defer trace.StartRegion(ctx, "qcow2.Commit").End()
+
+	if opts == nil {
+		opts = &CommitOpts{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.Backing == nil {
+		err := errors.Wrapf(ErrNoBacking, "Image '%s' does not have a backing file", bs.Filename)
+		return err
+	}
+	if opts.Empty && bs.ReadOnly {
+		err := errors.Wrap(ErrReadOnly, "Cannot empty the read-only image")
+		return err
+	}
+	backing := bs.Backing.bs
+	filename := bs.Backing.Name
+	format := backing.Drv.formatName
+	if strings.Contains(filename, "://") {
+		err := errors.Wrapf(ErrUnsupported, "Cannot commit to the remote backing file '%s'", filename)
+		return err
+	}
+
+	q.drainReadahead()
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	extents, err := commitExtents(ctx, bs)
+	if err != nil {
+		return err
+	}
+
+	// the backing file is closed, and is opened as read-write, which takes the exclusive lock of it
+	bdrvRefMu.Lock()
+	shared := backing.Refcnt > 1
+	bdrvRefMu.Unlock()
+	if shared {
+		err := errors.Wrapf(ErrInUse, "Backing file '%s' is in use by the other image", filename)
+		return err
+	}
+	bs.Backing = nil
+	defer func() {
+		// the image falls through to the backing file again, which is opened as read-only
+		if oerr := openBacking(bs); oerr != nil && err == nil {
+			err = oerr
+		}
+		q.invalidateReadahead()
+	}()
+	if err := bdrvUnref(backing); err != nil {
+		return err
+	}
+
+	var bopts *OpenOpts
+	if bs.Options != nil && bs.Options.Direct {
+		bopts = &OpenOpts{Direct: true}
+	}
+	base, err := OpenFileOpts(filename, format, os.O_RDWR, bopts)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open backing file '%s' as read-write", filename)
+		return err
+	}
+	if err := commitWrite(ctx, q, base, extents); err != nil {
+		base.Close()
+		err = errors.Wrapf(err, "Could not commit '%s' to '%s'", bs.Filename, filename)
+		return err
+	}
+	if err := base.Close(); err != nil {
+		return err
+	}
+
+	if opts.Empty {
+		if err := commitEmpty(ctx, bs, extents); err != nil {
+			err = errors.Wrapf(err, "Could not empty '%s'", bs.Filename)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitExtents returns the ranges of bs which are allocated in bs itself. Zero is true if the range reads
+// as zeros.
+//  block/commit.c: static void coroutine_fn commit_run(void *opaque)
+func commitExtents(ctx context.Context, bs *BlockDriverState) ([]Extent, error) {
+	total, err := getlength(bs)
+	if err != nil {
+		err = errors.Wrapf(err, "Can't get size of %s", bs.Filename)
+		return nil, err
+	}
+
+	var extents []Extent
+	var n int64
+	for offset := int64(0); offset < total; offset += n {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var status int
+		status, n, _, err = bdrvBlockStatus(bs, offset, total-offset)
+		if err != nil {
+			err = errors.Wrapf(err, "Block status error in %s at offset %d", bs.Filename, offset)
+			return nil, err
+		}
+		if status&BDRV_BLOCK_ALLOCATED == 0 {
+			continue
+		}
+		zero := status&BDRV_BLOCK_ZERO != 0
+
+		if last := len(extents) - 1; last >= 0 && extents[last].Start+extents[last].Length == offset && extents[last].Zero == zero {
+			extents[last].Length += n
+			continue
+		}
+		extents = append(extents, Extent{Start: offset, Length: n, Allocated: true, Zero: zero, Data: !zero})
+	}
+
+	return extents, nil
+}
+
+// commitWrite writes the extents of q into base. The backing file of q must be detached, so the extents are
+// read from q itself.
+func commitWrite(ctx context.Context, q *QCow2, base *QCow2, extents []Extent) error {
+	total, err := getlength(q.blk.bs())
+	if err != nil {
+		return err
+	}
+	size, err := base.VirtualSize()
+	if err != nil {
+		return err
+	}
+	if size < total {
+		if err := base.Resize(total); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, IO_BUF_SIZE)
+	for _, e := range extents {
+		if e.Zero {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := base.WriteZeroes(e.Start, e.Length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for offset, end := e.Start, e.Start+e.Length; offset < end; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			n := end - offset
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if err := q.blk.pread(ctx, offset, buf[:n]); err != nil {
+				return err
+			}
+			if _, err := base.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += n
+		}
+	}
+
+	return base.Flush()
+}
+
+// commitEmpty discards the committed extents of bs, so that they fall through to the backing file.
+//  block/qcow2.c: static int qcow2_make_empty(BlockDriverState *bs)
+func commitEmpty(ctx context.Context, bs *BlockDriverState, extents []Extent) error {
+	if bs.Drv != bdrvQCow2 {
+		return errors.Wrap(ErrUnsupported, "This image format does not support emptying")
+	}
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := discardClusters(ctx, bs, uint64(e.Start), uint64(e.Length), DISCARD_SNAPSHOT, true); err != nil {
+			return err
+		}
+	}
+
+	return writeCaches(bs)
+}
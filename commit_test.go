@@ -0,0 +1,104 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	for _, empty := range []bool{false, true} {
+		dir := t.TempDir()
+		baseName := filepath.Join(dir, "base.qcow2")
+		base, err := CreateImage(baseName, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := base.WriteAt(bytes.Repeat([]byte("b"), 1<<20), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := base.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		top, err := CreateImage(filepath.Join(dir, "top.qcow2"), 2<<20, WithBackingFile(baseName, DriverQCow2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("t"), 64<<10)
+		if _, err := top.WriteAt(data, 1<<20-32<<10); err != nil {
+			t.Fatal(err)
+		}
+		if err := top.WriteZeroes(0, 64<<10); err != nil {
+			t.Fatal(err)
+		}
+		if err := top.Commit(&CommitOpts{Empty: empty}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the guest view of the image is not changed by the commit
+		buf := make([]byte, len(data))
+		if _, err := top.ReadAt(buf, 1<<20-32<<10); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("empty=%v: the committed data is not read from the image: %v", empty, err)
+		}
+		extents, err := top.Map()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range extents {
+			if empty && e.Allocated && e.Depth == 0 {
+				t.Errorf("empty=%v: %+v is still allocated in the image", empty, e)
+			}
+		}
+		if err := top.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		base, err = OpenFile(baseName, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, _ := base.VirtualSize(); size != 2<<20 {
+			t.Errorf("empty=%v: base size %d, want %d", empty, size, 2<<20)
+		}
+		if _, err := base.ReadAt(buf, 1<<20-32<<10); err != nil || !bytes.Equal(buf, data) {
+			t.Errorf("empty=%v: the data is not committed to the base: %v", empty, err)
+		}
+		if _, err := base.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, make([]byte, len(buf))) {
+			t.Errorf("empty=%v: the zeros are not committed to the base: %v", empty, err)
+		}
+		base.Close()
+	}
+}
+
+func TestCheckContextCanceled(t *testing.T) {
+	img, err := CreateImage(filepath.Join(t.TempDir(), "check.qcow2"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := img.CheckContext(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, err := img.CreateSnapshotContext(ctx, "snap"); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if sns, _ := img.Snapshots(); len(sns) != 0 {
+		t.Fatalf("the snapshot is created with the canceled context")
+	}
+}
@@ -0,0 +1,511 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// COMPACT_BATCH_CLUSTERS the maximum number of the clusters which are moved by Compact before their new
+// mappings are written to the image file.
+const COMPACT_BATCH_CLUSTERS = 1024
+
+// FragmentationStats represents how the guest data of the image is scattered in the image file.
+type FragmentationStats struct {
+	ClusterSize int `json:"cluster-size"`
+
+	// Allocated the number of the normal clusters of the guest disk which are allocated in the image file.
+	Allocated int64 `json:"allocated-clusters"`
+	// Ranges the number of the ranges of the allocated clusters which are contiguous in the guest disk.
+	Ranges int64 `json:"ranges"`
+	// Extents the number of the pieces of the ranges which are also contiguous in the image file.
+	// The guest data is not fragmented if Extents equals Ranges.
+	Extents int64 `json:"extents"`
+	// Backward the number of the extents which are placed before the previous extent of the same range in
+	// the image file, which seek backward on the sequential read of the range.
+	Backward int64 `json:"backward-extents"`
+	// Scatter the total distance in clusters between the consecutive extents of the ranges in the image file.
+	Scatter int64 `json:"scatter-clusters"`
+
+	// FileClusters the number of the clusters of the image file up to the last cluster in use, and
+	// FreeClusters the number of them which are not in use.
+	FileClusters int64 `json:"file-clusters"`
+	FreeClusters int64 `json:"free-clusters"`
+	// TrailingClusters the number of the clusters of the image file after the last cluster in use.
+	TrailingClusters int64 `json:"trailing-clusters"`
+}
+
+// Fragmentation return the ratio of the clusters which start the new extent in the middle of the range to the
+// allocated clusters in percent.
+func (st *FragmentationStats) Fragmentation() float64 {
+	if st.Allocated == 0 {
+		return 0
+	}
+	return float64(st.Extents-st.Ranges) * 100 / float64(st.Allocated)
+}
+
+// FragmentationStats walks the L1 and L2 tables and the refcounts of the image, and returns how the guest
+// contiguous ranges of the allocated clusters are scattered in the image file, and how many clusters of the
+// image file are not in use.
+func (q *QCow2) FragmentationStats() (*FragmentationStats, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return nil, ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		err := errors.Wrap(ErrUnsupported, "This image format does not support the fragmentation statistics")
+		return nil, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	s := bs.Opaque
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return fragmentationStats(bs)
+}
+
+// fragmentationStats returns the fragmentation statistics of bs. The caller must hold s.lock.
+func fragmentationStats(bs *BlockDriverState) (*FragmentationStats, error) {
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+
+	st := &FragmentationStats{ClusterSize: s.ClusterSize}
+	var nextGuest, nextHost int64
+	err := walkDataClusters(context.Background(), bs, func(guest, _, l2Entry uint64) error {
+		host := int64(l2Entry & L2E_OFFSET_MASK)
+
+		switch {
+		case st.Allocated == 0 || int64(guest) != nextGuest:
+			st.Ranges++
+			st.Extents++
+		case host != nextHost:
+			st.Extents++
+			d := host - nextHost
+			if d < 0 {
+				st.Backward++
+				d = -d
+			}
+			st.Scatter += d / clusterSize
+		}
+		st.Allocated++
+		nextGuest, nextHost = int64(guest)+clusterSize, host+clusterSize
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := bs.File.Size()
+	if err != nil {
+		return nil, err
+	}
+	nbClusters := divRoundUp(size, clusterSize)
+	for i := int64(0); i < nbClusters; i++ {
+		refcount, err := getRefcount(bs, uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if refcount == 0 {
+			st.FreeClusters++
+			continue
+		}
+		st.FileClusters = i + 1
+	}
+	st.TrailingClusters = nbClusters - st.FileClusters
+	st.FreeClusters -= st.TrailingClusters
+
+	return st, nil
+}
+
+// walkDataClusters calls fn with the guest offset, the L1 entry and the L2 entry of the normal clusters of the
+// guest disk of bs in the order of the guest offset. The loads of the L2 tables are traced in ctx. The caller must
+// hold s.lock.
+func walkDataClusters(ctx context.Context, bs *BlockDriverState, fn func(guest, l1Entry, l2Entry uint64) error) error {
+	s := bs.Opaque
+
+	l1Table, err := s.L1Table.entries(bs)
+	if err != nil {
+		return err
+	}
+
+	diskSize := uint64(bs.TotalSectors) * uint64(BDRV_SECTOR_SIZE)
+	for i, l1Entry := range l1Table {
+		l2Offset := l1Entry & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+			err := signalCorruption(bs, true, -1, "L2 table offset %#x unaligned (L1 index: %#x)", l2Offset, i)
+			return err
+		}
+
+		l2Table, err := l2Load(ctx, bs, l2Offset)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < s.L2Size; j++ {
+			guest := (uint64(i)<<uint(s.L2Bits) + uint64(j)) << uint(s.ClusterBits)
+			if guest >= diskSize {
+				break
+			}
+
+			l2Entry := getL2Entry(l2Table, j)
+			if getClusterType(l2Entry) != CLUSTER_NORMAL {
+				continue
+			}
+			if offset := l2Entry & L2E_OFFSET_MASK; offsetIntoCluster(s, int64(offset)) != 0 {
+				cachePut(s.L2TableCache, l2Table)
+				err := signalCorruption(bs, true, -1, "Cluster allocation offset %#x unaligned (L2 offset: %#x, L2 index: %#x)", offset, l2Offset, j)
+				return err
+			}
+
+			if err := fn(guest, l1Entry, l2Entry); err != nil {
+				cachePut(s.L2TableCache, l2Table)
+				return err
+			}
+		}
+
+		cachePut(s.L2TableCache, l2Table)
+	}
+
+	return nil
+}
+
+// Compact rewrites the data clusters of the image into the order of the guest offset from the start of the
+// image file, and truncates the free clusters at the end of the image file.
+//
+// Only the data clusters which are referred once by the active L2 tables are moved. The metadata, such as the
+// L1 and L2 tables and the refcount blocks, and the clusters which are shared with the internal snapshots stay
+// in place, and the moved clusters fill the free clusters around them. The clusters which are in the way are
+// moved to the end of the image file first, so some clusters are copied twice.
+//
+// The clusters are moved in batches of COMPACT_BATCH_CLUSTERS clusters at most. The new mappings of the batch
+// are written to the image file after its data is flushed, and the old clusters are freed after that, so the
+// image is consistent even if Compact is interrupted. The guest requests wait until Compact is finished.
+func (q *QCow2) Compact() error {
+	return q.CompactContext(context.Background())
+}
+
+// CompactContext is like Compact, but stops moving the clusters when ctx is done, and returns the error of
+// ctx. The clusters which have been moved are kept, and the image file is not truncated.
+func (q *QCow2) CompactContext(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		err := errors.Wrap(ErrUnsupported, "This image format does not support compaction")
+		return err
+	}
+	if bs.ReadOnly {
+		err := errors.Wrap(ErrReadOnly, "Cannot compact the read-only image")
+		return err
+	}
+	q.drainReadahead()
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	if err := compact(ctx, bs); err != nil {
+		err = errors.Wrapf(err, "Could not compact '%s'", bs.Filename)
+		return err
+	}
+
+	return nil
+}
+
+// compactCluster represents the data cluster which is moved by Compact.
+type compactCluster struct {
+	// guest the guest offset of the cluster.
+	guest uint64
+	// host the current offset of the cluster in the image file.
+	host uint64
+}
+
+// compactMove represents the data cluster which has been copied to the new host cluster, whose L2 entry is not
+// updated yet.
+type compactMove struct {
+	guest    uint64
+	from, to uint64
+}
+
+// compactState represents the state of Compact.
+type compactState struct {
+	ctx context.Context
+	bs  *BlockDriverState
+	// clusters the data clusters which are moved, in the order of the guest offset.
+	clusters []compactCluster
+	// owner map of the host offset of the data cluster which is not placed yet to its index of clusters.
+	owner map[uint64]int
+	// moves the moves of the current batch, and freeing the host offsets of the clusters which are freed when
+	// the batch is committed.
+	moves   []compactMove
+	freeing map[uint64]bool
+	// tail the end of the image file, which the clusters in the way are moved to.
+	tail uint64
+	buf  []byte
+}
+
+// compact moves the data clusters of bs into the order of the guest offset, and truncates the free clusters at
+// the end of the image file.
+func compact(ctx context.Context, bs *BlockDriverState) error {
+	s := bs.Opaque
+	clusterSize := uint64(s.ClusterSize)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	size, err := bs.File.Size()
+	if err != nil {
+		return err
+	}
+
+	st := &compactState{
+		ctx:     ctx,
+		bs:      bs,
+		owner:   make(map[uint64]int),
+		freeing: make(map[uint64]bool),
+		tail:    uint64(roundUp(size, int64(clusterSize))),
+		buf:     bufPoolGet(int(bdrvOptMemAlign(bs)), s.ClusterSize),
+	}
+	defer bufPoolPut(st.buf)
+
+	// the clusters of the shared L2 tables, or which are shared by themselves, must not be moved
+	err = walkDataClusters(ctx, bs, func(guest, l1Entry, l2Entry uint64) error {
+		if l1Entry&OFLAG_COPIED == 0 || l2Entry&OFLAG_COPIED == 0 {
+			return nil
+		}
+		host := l2Entry & L2E_OFFSET_MASK
+		refcount, err := getRefcount(bs, host>>uint(s.ClusterBits))
+		if err != nil || refcount != 1 {
+			return err
+		}
+
+		st.owner[host] = len(st.clusters)
+		st.clusters = append(st.clusters, compactCluster{guest: guest, host: host})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor := uint64(0)
+	for i := range st.clusters {
+		if err := ctx.Err(); err != nil {
+			if cerr := st.commit(); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+
+		c := &st.clusters[i]
+		for {
+			if cursor == c.host {
+				delete(st.owner, cursor)
+				break
+			}
+			// the cluster which is moved by the current batch is reused after it is freed
+			if st.freeing[cursor] {
+				if err := st.commit(); err != nil {
+					return err
+				}
+				continue
+			}
+			// the cluster which is not placed yet is moved out of the way
+			if j, ok := st.owner[cursor]; ok {
+				if err := st.evict(j); err != nil {
+					return err
+				}
+				continue
+			}
+
+			ok, err := allocClusterAt(bs, cursor)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := st.move(i, cursor); err != nil {
+					return err
+				}
+				break
+			}
+			cursor += clusterSize
+		}
+		cursor += clusterSize
+
+		if len(st.moves) >= COMPACT_BATCH_CLUSTERS {
+			if err := st.commit(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := st.commit(); err != nil {
+		return err
+	}
+
+	return compactTruncate(bs)
+}
+
+// move copies the data cluster i to the cluster at to, which has been allocated, and adds the move to the
+// current batch.
+func (st *compactState) move(i int, to uint64) error {
+	bs := st.bs
+	c := &st.clusters[i]
+
+	if err := bdrvPread(bs.file, int64(c.host), st.buf); err != nil {
+		return err
+	}
+	if err := preWriteOverlapCheck(bs, 0, int64(to), int64(len(st.buf))); err != nil {
+		return err
+	}
+	if err := bdrvPwrite(bs.file, int64(to), st.buf); err != nil {
+		return err
+	}
+
+	st.moves = append(st.moves, compactMove{guest: c.guest, from: c.host, to: to})
+	st.freeing[c.host] = true
+	delete(st.owner, c.host)
+	c.host = to
+
+	return nil
+}
+
+// evict moves the data cluster j, which is in the way of the cluster being placed, to the end of the image file.
+// The batch is committed, so the old cluster of j is freed.
+func (st *compactState) evict(j int) error {
+	bs := st.bs
+	s := bs.Opaque
+
+	if s.FreeClusterIndex < st.tail>>uint(s.ClusterBits) {
+		s.FreeClusterIndex = st.tail >> uint(s.ClusterBits)
+	}
+	to, err := AllocClusters(bs, uint64(s.ClusterSize))
+	if err != nil {
+		return err
+	}
+	if end := uint64(to) + uint64(s.ClusterSize); end > st.tail {
+		st.tail = end
+	}
+
+	if err := st.move(j, uint64(to)); err != nil {
+		freeClusters(bs, to, int64(s.ClusterSize), DISCARD_NEVER)
+		return err
+	}
+	st.owner[uint64(to)] = j
+
+	return st.commit()
+}
+
+// commit updates the L2 entries of the moved clusters of the current batch, and frees the old clusters.
+// The data of the moved clusters is flushed before the L2 entries are updated, and the L2 tables are written
+// before the old clusters are freed, so the L2 entries never point to the cluster which is not written yet nor
+// reused.
+func (st *compactState) commit() error {
+	if len(st.moves) == 0 {
+		return nil
+	}
+
+	bs := st.bs
+	s := bs.Opaque
+
+	if err := bdrvFlush(bs.file); err != nil {
+		return err
+	}
+	// the refcounts of the new clusters must be stable before the L2 entries point to them
+	if err := cacheSetDependency(bs, s.L2TableCache, s.RefcountBlockCache); err != nil {
+		return err
+	}
+
+	for _, m := range st.moves {
+		l2Table, l2Index, err := getClusterTable(st.ctx, bs, m.guest)
+		if err != nil {
+			return err
+		}
+		if l2Entry := getL2Entry(l2Table, l2Index); l2Entry&L2E_OFFSET_MASK != m.from {
+			cachePut(s.L2TableCache, l2Table)
+			err := signalCorruption(bs, true, int64(m.from), "L2 entry %#x of the moved cluster at %#x changed (guest offset: %#x)", l2Entry, m.from, m.guest)
+			return err
+		}
+		setL2Entry(l2Table, l2Index, m.to|OFLAG_COPIED)
+		cacheEntryMarkDirty(s.L2TableCache, l2Table)
+		cachePut(s.L2TableCache, l2Table)
+	}
+
+	if err := writeCaches(bs); err != nil {
+		return err
+	}
+	if err := bdrvFlush(bs.file); err != nil {
+		return err
+	}
+
+	var err error
+	for _, m := range st.moves {
+		if ferr := freeClusters(bs, int64(m.from), int64(s.ClusterSize), DISCARD_OTHER); err == nil {
+			err = ferr
+		}
+	}
+	st.moves = st.moves[:0]
+	st.freeing = make(map[uint64]bool)
+
+	return err
+}
+
+// compactTruncate truncates the free clusters at the end of the image file of bs.
+func compactTruncate(bs *BlockDriverState) error {
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+
+	if err := writeCaches(bs); err != nil {
+		return err
+	}
+
+	size, err := bs.File.Size()
+	if err != nil {
+		return err
+	}
+
+	end := divRoundUp(size, clusterSize)
+	for end > 0 {
+		refcount, err := getRefcount(bs, uint64(end-1))
+		if err != nil {
+			return err
+		}
+		if refcount != 0 {
+			break
+		}
+		end--
+	}
+	if end*clusterSize >= size {
+		return bdrvFlush(bs.file)
+	}
+
+	if err := bs.File.Truncate(end * clusterSize); err != nil {
+		err = errors.Wrap(err, "Could not truncate the image file")
+		return err
+	}
+	if s.FreeClusterIndex > uint64(end) {
+		s.FreeClusterIndex = uint64(end)
+	}
+
+	return bdrvFlush(bs.file)
+}
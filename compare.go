@@ -0,0 +1,251 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// CompareMismatch represents a reason of the images are not identical.
+type CompareMismatch string
+
+const (
+	// MismatchNone the images are identical.
+	MismatchNone CompareMismatch = ""
+	// MismatchContent the guest visible contents differ.
+	MismatchContent CompareMismatch = "content"
+	// MismatchBlockStatus the allocation status differs in the strict mode.
+	MismatchBlockStatus CompareMismatch = "block-status"
+	// MismatchSize the virtual disk sizes differ in the strict mode.
+	MismatchSize CompareMismatch = "size"
+)
+
+// CompareResult represents a result of the comparison of two images.
+type CompareResult struct {
+	// Identical is true if the images are identical.
+	Identical bool `json:"identical"`
+	// Mismatch is the reason of the images are not identical.
+	Mismatch CompareMismatch `json:"mismatch,omitempty"`
+	// Offset is the first differing guest offset in bytes. Only valid if Identical is false.
+	Offset int64 `json:"offset"`
+}
+
+// Compare compares the guest visible contents of the images a and b.
+// Only the allocated ranges of the images are read, and the ranges which are zero in both images are skipped.
+//
+// In the non-strict mode, the unallocated and zero ranges are treated equivalently, and the images of
+// different sizes are identical if the range beyond the end of the smaller image is zero.
+// In the strict mode, the images are not identical if the sizes or the allocation status differ.
+//  qemu-img.c: static int img_compare(int argc, char **argv)
+func Compare(a, b *QCow2, strict bool) (*CompareResult, error) {
+	return CompareContext(context.Background(), a, b, strict)
+}
+
+// CompareContext is like Compare, but stops comparing when ctx is done, and returns the error of ctx.
+func CompareContext(ctx context.Context, a, b *QCow2, strict bool) (*CompareResult, error) {
+	defer trace.StartRegion(ctx, "qcow2.Compare").End()
+
+	bs1, bs2 := a.blk.bs(), b.blk.bs()
+	if bs1 == nil || bs2 == nil {
+		return nil, ENOMEDIUM
+	}
+	bdrvIncInFlight(bs1)
+	defer bdrvDecInFlight(bs1)
+	if bs2 != bs1 {
+		bdrvIncInFlight(bs2)
+		defer bdrvDecInFlight(bs2)
+	}
+
+	total1, err := getlength(bs1)
+	if err != nil {
+		err = errors.Wrapf(err, "Can't get size of %s", bs1.Filename)
+		return nil, err
+	}
+	total2, err := getlength(bs2)
+	if err != nil {
+		err = errors.Wrapf(err, "Can't get size of %s", bs2.Filename)
+		return nil, err
+	}
+	totalMin := total1
+	if total2 < totalMin {
+		totalMin = total2
+	}
+
+	if strict && total1 != total2 {
+		return &CompareResult{Mismatch: MismatchSize, Offset: totalMin}, nil
+	}
+
+	buf1 := make([]byte, IO_BUF_SIZE)
+	buf2 := make([]byte, IO_BUF_SIZE)
+
+	var n int64
+	for offset := int64(0); offset < totalMin; offset += n {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		status1, n1, _, _, err := bdrvBlockStatusAbove(bs1, offset, totalMin-offset)
+		if err != nil {
+			err = errors.Wrapf(err, "Block status error in %s at offset %d", bs1.Filename, offset)
+			return nil, err
+		}
+		status2, n2, _, _, err := bdrvBlockStatusAbove(bs2, offset, totalMin-offset)
+		if err != nil {
+			err = errors.Wrapf(err, "Block status error in %s at offset %d", bs2.Filename, offset)
+			return nil, err
+		}
+		if n1 <= 0 || n2 <= 0 {
+			err := errors.Errorf("Block status returned no progress at offset %d", offset)
+			return nil, err
+		}
+		n = n1
+		if n2 < n {
+			n = n2
+		}
+
+		const statusMask = BDRV_BLOCK_DATA | BDRV_BLOCK_ZERO | BDRV_BLOCK_ALLOCATED
+		if strict && status1&statusMask != status2&statusMask {
+			return &CompareResult{Mismatch: MismatchBlockStatus, Offset: offset}, nil
+		}
+
+		// the range which has no data reads as zeros, regardless of it is unallocated or the zero cluster
+		data1 := status1&BDRV_BLOCK_DATA != 0 && status1&BDRV_BLOCK_ZERO == 0
+		data2 := status2&BDRV_BLOCK_DATA != 0 && status2&BDRV_BLOCK_ZERO == 0
+
+		var (
+			diff int64
+			same bool
+		)
+		switch {
+		case !data1 && !data2:
+			continue
+		case data1 && data2:
+			diff, same, err = compareRanges(ctx, bs1, bs2, offset, n, buf1, buf2)
+		case data1:
+			diff, same, err = checkEmptyRange(ctx, bs1, offset, n, buf1)
+		default:
+			diff, same, err = checkEmptyRange(ctx, bs2, offset, n, buf2)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			return &CompareResult{Mismatch: MismatchContent, Offset: diff}, nil
+		}
+	}
+
+	if total1 != total2 {
+		// the range beyond the end of the smaller image must be zero
+		bs := bs1
+		buf := buf1
+		if total2 > total1 {
+			bs = bs2
+			buf = buf2
+		}
+		total := total1 + total2 - totalMin
+
+		for offset := totalMin; offset < total; offset += n {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			var status int
+			status, n, _, _, err = bdrvBlockStatusAbove(bs, offset, total-offset)
+			if err != nil {
+				err = errors.Wrapf(err, "Block status error in %s at offset %d", bs.Filename, offset)
+				return nil, err
+			}
+			if n <= 0 {
+				err := errors.Errorf("Block status returned no progress at offset %d", offset)
+				return nil, err
+			}
+			if status&BDRV_BLOCK_DATA == 0 || status&BDRV_BLOCK_ZERO != 0 {
+				continue
+			}
+
+			diff, same, err := checkEmptyRange(ctx, bs, offset, n, buf)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				return &CompareResult{Mismatch: MismatchContent, Offset: diff}, nil
+			}
+		}
+	}
+
+	return &CompareResult{Identical: true}, nil
+}
+
+// compareRanges reads n bytes of bs1 and bs2 at offset, and returns the first differing offset.
+//  qemu-img.c: static int compare_sectors(const uint8_t *buf1, const uint8_t *buf2, int n, int *pnum)
+func compareRanges(ctx context.Context, bs1, bs2 *BlockDriverState, offset, n int64, buf1, buf2 []byte) (int64, bool, error) {
+	for end := offset + n; offset < end; {
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+
+		chunk := end - offset
+		if chunk > int64(len(buf1)) {
+			chunk = int64(len(buf1))
+		}
+
+		if err := bdrvAlignedPreadv(ctx, bs1, offset, buf1[:chunk]); err != nil {
+			err = errors.Wrapf(err, "Error while reading offset %d of %s", offset, bs1.Filename)
+			return 0, false, err
+		}
+		if err := bdrvAlignedPreadv(ctx, bs2, offset, buf2[:chunk]); err != nil {
+			err = errors.Wrapf(err, "Error while reading offset %d of %s", offset, bs2.Filename)
+			return 0, false, err
+		}
+
+		if !bytes.Equal(buf1[:chunk], buf2[:chunk]) {
+			for i := int64(0); i < chunk; i++ {
+				if buf1[i] != buf2[i] {
+					return offset + i, false, nil
+				}
+			}
+		}
+
+		offset += chunk
+	}
+
+	return 0, true, nil
+}
+
+// checkEmptyRange reads n bytes of bs at offset, and returns the first non-zero offset.
+//  qemu-img.c: static int check_empty_sectors(BlockBackend *blk, int64_t sect_num, int sect_count, const char *filename, uint8_t *buffer, bool quiet)
+func checkEmptyRange(ctx context.Context, bs *BlockDriverState, offset, n int64, buf []byte) (int64, bool, error) {
+	for end := offset + n; offset < end; {
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+
+		chunk := end - offset
+		if chunk > int64(len(buf)) {
+			chunk = int64(len(buf))
+		}
+
+		if err := bdrvAlignedPreadv(ctx, bs, offset, buf[:chunk]); err != nil {
+			err = errors.Wrapf(err, "Error while reading offset %d of %s", offset, bs.Filename)
+			return 0, false, err
+		}
+
+		for i, b := range buf[:chunk] {
+			if b != 0 {
+				return offset + int64(i), false, nil
+			}
+		}
+
+		offset += chunk
+	}
+
+	return 0, true, nil
+}
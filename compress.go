@@ -0,0 +1,78 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"compress/flate"
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Compression represents the options of the compressed writes, such as by WriteAtFlags with
+// BDRV_REQ_WRITE_COMPRESSED and by Convert with ConvertOpts.Compress.
+type Compression struct {
+	// Level the deflate level of the compressed clusters, from flate.BestSpeed (1) to flate.BestCompression (9).
+	// If zero, flate.DefaultCompression is used. The clusters compressed by any level are read by qemu, since
+	// the level only changes the effort of the compressor.
+	Level int
+	// Workers the maximum number of the goroutines which compress the clusters of a compressed write
+	// concurrently. The clusters are compressed independently, and written in the order of the guest offset
+	// regardless of Workers. If zero, GOMAXPROCS is used.
+	Workers int
+}
+
+// validate returns the error if c has the invalid option.
+func (c Compression) validate() error {
+	if c.Level != 0 && (c.Level < flate.BestSpeed || c.Level > flate.BestCompression) {
+		err := errors.Wrapf(ErrInvalidOption, "Compression level must be between %d and %d", flate.BestSpeed, flate.BestCompression)
+		return err
+	}
+	if c.Workers < 0 {
+		err := errors.Wrap(ErrInvalidOption, "Number of compression workers must not be negative")
+		return err
+	}
+	return nil
+}
+
+// level returns the deflate level of c.
+func (c Compression) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+// workers returns the number of the compression workers of c.
+func (c Compression) workers() int {
+	if c.Workers == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return c.Workers
+}
+
+// SetCompression sets the options of the compressed writes of the image, same as OpenOpts.Compression.
+// The compressed writes in progress are completed with the previous options.
+func (q *QCow2) SetCompression(c Compression) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		return syscall.ENOTSUP
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.Opaque.Compression = c
+	bdrvDrainedEnd(bs)
+
+	return nil
+}
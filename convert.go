@@ -0,0 +1,669 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"os"
+	"runtime/trace"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ConvertOpts represents the options of Convert, which are not the image creation options.
+type ConvertOpts struct {
+	// Compress writes the data clusters of the target image compressed, same as 'qemu-img convert -c'.
+	// The format of the target image must be qcow2.
+	Compress bool
+
+	// Compression the deflate level and the number of the workers of the compressed clusters, which is only
+	// used with Compress. The clusters of each chunk are compressed by up to Compression.Workers goroutines.
+	Compression Compression
+
+	// Dedup maps the data clusters of the target image which have the same contents to a single host cluster,
+	// whose refcount is increased for each of them. The clusters are matched by the SHA-256 hash of the
+	// contents, and compared before mapping. The format of the target image must be qcow2.
+	Dedup bool
+
+	// CopyOffload copies the data clusters in the kernel without reading them into the memory, same as
+	// 'qemu-img convert -C'. The extents of the source image file are shared by FICLONERANGE on the file
+	// systems such as btrfs and XFS, or copied by copy_file_range(2), if the images are the host files on
+	// linux. The ranges which can not be offloaded, such as the compressed clusters, are copied through
+	// the memory. The data clusters which are all zeros are copied as is, instead of left unallocated.
+	// It can not be used with Compress and Dedup.
+	CopyOffload bool
+
+	// Workers the number of the chunks of the source image which are copied concurrently, same as
+	// 'qemu-img convert -m'. The chunks are read concurrently, and written in the order of the offset unless
+	// OutOfOrder is true, so the metadata of the target image is laid out same as the chunks are copied one
+	// by one. The clusters of the compressed chunk are compressed concurrently. If zero,
+	// CONVERT_DEFAULT_WORKERS is used, and it must be at most CONVERT_MAX_WORKERS.
+	Workers int
+
+	// OutOfOrder allows the chunks to be written out of order, same as 'qemu-img convert -W', which may
+	// saturate the backends of the high latency, but the clusters of the target image are not allocated in
+	// the order of the offset. It can not be used with Dedup.
+	OutOfOrder bool
+
+	// RateLimit limits the number of bytes of the source image which are copied per second, same as
+	// 'qemu-img convert -r'. The ranges which are not copied are not counted.
+	RateLimit RateLimit
+
+	// Progress is called with the number of bytes of the source image which have been copied, and the total
+	// number of bytes to be copied, same as 'qemu-img convert -p'. The ranges which read as zeros or are read
+	// from the backing file of the target image are not counted.
+	Progress func(done, total int64)
+}
+
+const (
+	// CONVERT_DEFAULT_WORKERS the default number of the chunks which are copied concurrently by Convert.
+	//  qemu-img.c: int num_coroutines = 8
+	CONVERT_DEFAULT_WORKERS = 8
+	// CONVERT_MAX_WORKERS the maximum number of the chunks which are copied concurrently by Convert.
+	//  qemu-img.c: #define MAX_COROUTINES 16
+	CONVERT_MAX_WORKERS = 16
+)
+
+// imgConvertState represents the state of the conversion.
+//  qemu-img.c: typedef struct ImgConvertState
+type imgConvertState struct {
+	src, target      *QCow2
+	totalSize        int64       // int64_t total_sectors
+	allocatedSize    int64       // int64_t allocated_sectors
+	status           writeStatus // ImgConvertBlockStatus
+	nextStatus       int64       // int64_t sector_next_status
+	hasZeroInit      bool        // bool
+	compressed       bool        // bool
+	targetHasBacking bool        // bool
+	dedup            *dedupState
+	limit            *rateLimit
+	clusterSize      int64 // size_t cluster_sectors
+	bufSize          int64 // size_t buf_sectors
+	workers          int   // int num_coroutines
+	wrInOrder        bool  // bool wr_in_order
+
+	// mu guards the fields below, which are shared by the workers.
+	mu          sync.Mutex
+	turn        *sync.Cond
+	wrSeq       int64 // the sequence number of the next chunk to be written in order
+	ret         error // int ret
+	done        int64
+	copyRange   bool // bool copy_range
+	copiedRange bool
+}
+
+// convertChunk represents the range of the source image which is copied by a worker.
+type convertChunk struct {
+	seq    int64
+	offset int64
+	n      int64
+	status writeStatus
+}
+
+// Convert converts the source image to the new image created by opts, same as 'qemu-img convert'.
+// The virtual disk size of the new image is the size of the source image, and opts.Size is ignored.
+// The format of the new image is opts.Fmt, which is qcow2 or raw, and defaults to qcow2.
+//
+// The ranges which read as zeros in the source image are not allocated in the new image. If opts.BackingFile is
+// not empty, the new image is created on the backing file, and only the ranges which are allocated in the top
+// layer of the source image are copied, which assumes that the source image has the same backing file.
+//  qemu-img.c: static int img_convert(int argc, char **argv)
+func Convert(source *QCow2, opts *Opts, copts *ConvertOpts) error {
+	return ConvertContext(context.Background(), source, opts, copts)
+}
+
+// ConvertContext is like Convert, but stops converting when ctx is done, and returns the error of ctx.
+// The image which is partially written on the cancellation is removed.
+func ConvertContext(ctx context.Context, source *QCow2, opts *Opts, copts *ConvertOpts) error {
+	defer trace.StartRegion(ctx, "qcow2.Convert").End()
+
+	if copts == nil {
+		copts = new(ConvertOpts)
+	}
+
+	srcBs := source.blk.bs()
+	if srcBs == nil {
+		return ENOMEDIUM
+	}
+	bdrvIncInFlight(srcBs)
+	defer bdrvDecInFlight(srcBs)
+
+	size, err := getlength(srcBs)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not get size of '%s'", srcBs.Filename)
+		return err
+	}
+
+	o := *opts
+	o.Size = size
+	if o.Fmt == "" {
+		o.Fmt = DriverQCow2
+	}
+
+	switch o.Fmt {
+	case DriverQCow2:
+		// nothing to do
+	case DriverRaw:
+		if copts.Compress {
+			return errors.Wrap(ErrInvalidOption, "Compression not supported for this file format")
+		}
+		if copts.Dedup {
+			return errors.Wrap(ErrInvalidOption, "Deduplication not supported for this file format")
+		}
+		if o.BackingFile != "" {
+			return errors.Wrapf(ErrInvalidOption, "Backing file not supported for file format '%s'", o.Fmt)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidOption, "Unknown file format '%s'", o.Fmt)
+	}
+	if copts.Compress && o.Preallocation != PREALLOC_MODE_OFF {
+		return errors.Wrap(ErrInvalidOption, "Compression and preallocation not supported at the same time")
+	}
+	if copts.Dedup && copts.Compress {
+		return errors.Wrap(ErrInvalidOption, "Compression and deduplication not supported at the same time")
+	}
+	if copts.CopyOffload && (copts.Compress || copts.Dedup) {
+		return errors.Wrap(ErrInvalidOption, "Copy offloading and compression or deduplication not supported at the same time")
+	}
+	if err := copts.Compression.validate(); err != nil {
+		return err
+	}
+	if copts.Workers < 0 || copts.Workers > CONVERT_MAX_WORKERS {
+		return errors.Wrapf(ErrInvalidOption, "Invalid number of workers. Allowed number of workers is between 1 and %d", CONVERT_MAX_WORKERS)
+	}
+	if copts.OutOfOrder && copts.Dedup {
+		return errors.Wrap(ErrInvalidOption, "Out of order write and deduplication not supported at the same time")
+	}
+	if copts.Dedup && o.Preallocation != PREALLOC_MODE_OFF {
+		return errors.Wrap(ErrInvalidOption, "Deduplication and preallocation not supported at the same time")
+	}
+
+	target, err := convertCreate(ctx, &o)
+	if err != nil {
+		return err
+	}
+
+	s := &imgConvertState{
+		src:              source,
+		target:           target,
+		totalSize:        size,
+		compressed:       copts.Compress,
+		targetHasBacking: o.BackingFile != "",
+		copyRange:        copts.CopyOffload,
+		workers:          copts.Workers,
+		wrInOrder:        !copts.OutOfOrder,
+	}
+	if s.workers == 0 {
+		s.workers = CONVERT_DEFAULT_WORKERS
+	}
+	s.turn = sync.NewCond(&s.mu)
+	s.hasZeroInit = !s.targetHasBacking && bdrvHasZeroInit(target.blk.bs())
+	s.limit = newRateLimit(copts.RateLimit)
+	if copts.Dedup {
+		s.dedup = newDedupState(target.blk.bs())
+	}
+	if copts.Compress {
+		target.blk.bs().Opaque.Compression = copts.Compression
+	}
+
+	err = s.doCopy(ctx, copts.Progress)
+	if cerr := target.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil && err == ctx.Err() {
+		removeImageFile(o.Filename)
+	}
+
+	return err
+}
+
+// convertCreate creates the target image of the conversion by opts, and opens it.
+func convertCreate(ctx context.Context, opts *Opts) (*QCow2, error) {
+	if opts.Fmt != DriverRaw {
+		return CreateContext(ctx, opts)
+	}
+
+	if err := rawCreate(opts.Filename, opts.Size); err != nil {
+		err = errors.Wrapf(err, "%s", opts.Filename)
+		return nil, err
+	}
+	target, err := OpenFileFormat(opts.Filename, DriverRaw, os.O_RDWR)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not open '%s'", opts.Filename)
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// iterationBytes updates the status of the source image at offset, and returns the number of bytes from offset
+// which are written with the same status.
+//  qemu-img.c: static int convert_iteration_sectors(ImgConvertState *s, int64_t sector_num)
+func (s *imgConvertState) iterationBytes(offset int64) (int64, error) {
+	srcBs := s.src.blk.bs()
+
+	n := s.totalSize - offset
+	if s.nextStatus <= offset {
+		var (
+			status int
+			sn     int64
+			err    error
+		)
+		if s.targetHasBacking {
+			status, sn, _, err = bdrvBlockStatus(srcBs, offset, n)
+		} else {
+			status, sn, _, _, err = bdrvBlockStatusAbove(srcBs, offset, n)
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "error while reading block status of offset %d", offset)
+			return 0, err
+		}
+		if sn <= 0 {
+			return 0, syscall.EIO
+		}
+		if sn < n {
+			n = sn
+		}
+
+		switch {
+		case status&BDRV_BLOCK_ZERO != 0:
+			s.status = BLK_ZERO
+		case status&BDRV_BLOCK_DATA != 0:
+			s.status = BLK_DATA
+		case !s.targetHasBacking:
+			// Without a target backing file we must copy over the contents of
+			// the backing file as well.
+			s.status = BLK_DATA
+		default:
+			s.status = BLK_BACKING_FILE
+		}
+
+		s.nextStatus = offset + n
+	}
+
+	if n > s.nextStatus-offset {
+		n = s.nextStatus - offset
+	}
+	if s.status == BLK_DATA && n > s.bufSize {
+		n = s.bufSize
+	}
+
+	// We need to write complete clusters for compressed images, so if an
+	// unallocated area is shorter than that, we must consider the whole
+	// cluster allocated
+	if s.compressed {
+		if n < s.clusterSize {
+			n = s.clusterSize
+			if n > s.totalSize-offset {
+				n = s.totalSize - offset
+			}
+			s.status = BLK_DATA
+		} else {
+			n = startOfCluster(s.clusterSize, n)
+		}
+	}
+
+	return n, nil
+}
+
+// doCopy copies the source image to the target image.
+//  qemu-img.c: static int convert_do_copy(ImgConvertState *s)
+func (s *imgConvertState) doCopy(ctx context.Context, progress func(done, total int64)) error {
+	targetBs := s.target.blk.bs()
+	bdrvIncInFlight(targetBs)
+	defer bdrvDecInFlight(targetBs)
+
+	s.clusterSize = bdrvGetClusterSize(targetBs)
+	s.bufSize = IO_BUF_SIZE
+	if s.bufSize < s.clusterSize {
+		s.bufSize = s.clusterSize
+	}
+
+	// Calculate allocated sectors for progress
+	var n int64
+	for offset := int64(0); offset < s.totalSize; offset += n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var err error
+		n, err = s.iterationBytes(offset)
+		if err != nil {
+			return err
+		}
+		if s.status == BLK_DATA {
+			s.allocatedSize += n
+		}
+	}
+	if progress != nil {
+		progress(0, s.allocatedSize)
+	}
+
+	// Do the copy
+	s.nextStatus = 0
+	chunks := make(chan convertChunk)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx, chunks, progress)
+		}()
+	}
+
+	err := s.dispatch(ctx, chunks)
+	close(chunks)
+	wg.Wait()
+	if err == nil {
+		err = s.ret
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.compressed {
+		// align end of file to a sector boundary to ease reading with
+		// sector based I/Os
+		if err := alignFileEnd(targetBs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dispatch sends the chunks of the source image which are written to the target image to the workers, in the
+// order of the offset. It stops when a worker fails.
+func (s *imgConvertState) dispatch(ctx context.Context, chunks chan<- convertChunk) error {
+	var (
+		n   int64
+		seq int64
+	)
+	for offset := int64(0); offset < s.totalSize; offset += n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		failed := s.ret != nil
+		s.mu.Unlock()
+		if failed {
+			return nil
+		}
+
+		var err error
+		n, err = s.iterationBytes(offset)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case s.status == BLK_DATA:
+			if err := s.limit.wait(ctx, n); err != nil {
+				return err
+			}
+		case s.status == BLK_ZERO && !s.hasZeroInit:
+		default:
+			// If we have a backing file, leave clusters unallocated that are
+			// unallocated in the source image, so that the backing file is
+			// visible at the respective offset.
+			continue
+		}
+
+		chunks <- convertChunk{seq: seq, offset: offset, n: n, status: s.status}
+		seq++
+	}
+
+	return nil
+}
+
+// worker copies the chunks received from chunks. The data of the chunk is read concurrently with the other
+// workers, and written in the order of the chunks if s.wrInOrder is true.
+//  qemu-img.c: static void coroutine_fn convert_co_do_copy(void *opaque)
+func (s *imgConvertState) worker(ctx context.Context, chunks <-chan convertChunk, progress func(done, total int64)) {
+	buf := make([]byte, s.bufSize)
+
+	for c := range chunks {
+		s.mu.Lock()
+		err := s.ret
+		copyRange := s.copyRange
+		s.mu.Unlock()
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		read := false
+		if err == nil && c.status == BLK_DATA && !copyRange {
+			if err = s.src.blk.pread(ctx, c.offset, buf[:c.n]); err != nil {
+				err = errors.Wrapf(err, "error while reading offset %d", c.offset)
+			}
+			read = true
+		}
+
+		if s.wrInOrder {
+			s.mu.Lock()
+			for s.wrSeq != c.seq {
+				s.turn.Wait()
+			}
+			s.mu.Unlock()
+		}
+
+		if err == nil {
+			// the zero chunks are not limited to the buffer size, and have no data
+			var data []byte
+			if c.status == BLK_DATA {
+				data = buf[:c.n]
+			}
+			err = s.writeChunk(ctx, c, data, read)
+		}
+
+		s.mu.Lock()
+		if err != nil && s.ret == nil {
+			s.ret = err
+		}
+		if err == nil && c.status == BLK_DATA {
+			s.done += c.n
+			if progress != nil {
+				progress(s.done, s.allocatedSize)
+			}
+		}
+		s.wrSeq++
+		s.turn.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// writeChunk writes the chunk c to the target image. The data of the chunk is buf if read is true, otherwise
+// it is copied by the copy offloading, or read into buf if it can not be offloaded.
+func (s *imgConvertState) writeChunk(ctx context.Context, c convertChunk, buf []byte, read bool) error {
+	if c.status == BLK_ZERO {
+		if err := s.target.blk.pwriteZeroes(ctx, c.offset, c.n, BDRV_REQ_MAY_UNMAP); err != nil {
+			err = errors.Wrapf(err, "error while writing offset %d", c.offset)
+			return err
+		}
+		return nil
+	}
+
+	if !read {
+		copied, err := s.copyRangeData(ctx, c.offset, c.n)
+		if err != nil {
+			err = errors.Wrapf(err, "error while copying offset %d", c.offset)
+			return err
+		}
+		if copied {
+			return nil
+		}
+		if err := s.src.blk.pread(ctx, c.offset, buf); err != nil {
+			err = errors.Wrapf(err, "error while reading offset %d", c.offset)
+			return err
+		}
+	}
+
+	if err := s.write(ctx, c.offset, buf); err != nil {
+		err = errors.Wrapf(err, "error while writing offset %d", c.offset)
+		return err
+	}
+	return nil
+}
+
+// copyRangeData copies n bytes of the source image at offset to the target image by the copy offloading, and
+// reports whether it is copied. The range which can not be offloaded is not copied, and the copy offloading
+// is disabled if the first range fails, which means the images do not support it at all.
+//  qemu-img.c: static int coroutine_fn convert_co_copy_range(ImgConvertState *s, int64_t sector_num, int nb_sectors)
+func (s *imgConvertState) copyRangeData(ctx context.Context, offset, n int64) (bool, error) {
+	s.mu.Lock()
+	copyRange := s.copyRange
+	s.mu.Unlock()
+	if !copyRange {
+		return false, nil
+	}
+
+	err := s.src.blk.copyRange(ctx, offset, s.target.blk, offset, n)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errors.Is(err, syscall.ENOTSUP) {
+		s.copyRange = s.copiedRange
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.copiedRange = true
+	return true, nil
+}
+
+// write writes buf of the source image at offset to the target image.
+//  qemu-img.c: static int convert_write(ImgConvertState *s, int64_t sector_num, int nb_sectors, const uint8_t *buf)
+func (s *imgConvertState) write(ctx context.Context, offset int64, buf []byte) error {
+	if s.dedup != nil {
+		return s.writeDedup(ctx, offset, buf)
+	}
+	if !s.compressed {
+		return convertWrite(ctx, s.target, buf, offset, s.clusterSize, !s.hasZeroInit)
+	}
+
+	for start := int64(0); start < int64(len(buf)); {
+		end := start + s.clusterSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+
+		if s.hasZeroInit && bufferIsZero(buf[start:end]) {
+			start = end
+			continue
+		}
+
+		// the consecutive clusters which are written are compressed concurrently by a request
+		for end < int64(len(buf)) {
+			next := end + s.clusterSize
+			if next > int64(len(buf)) {
+				next = int64(len(buf))
+			}
+			if s.hasZeroInit && bufferIsZero(buf[end:next]) {
+				break
+			}
+			end = next
+		}
+
+		if err := s.target.blk.pwriteCompressed(ctx, offset+start, buf[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// writeDedup writes buf of the source image at offset to the target image, and deduplicates the whole clusters.
+// The partial clusters at the both ends of buf are written as is.
+func (s *imgConvertState) writeDedup(ctx context.Context, offset int64, buf []byte) error {
+	for start := int64(0); start < int64(len(buf)); {
+		end := alignOffset(offset+start+1, int(s.clusterSize)) - offset
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+
+		var err error
+		if end-start == s.clusterSize {
+			err = s.dedup.write(ctx, s.target, offset+start, buf[start:end], !s.hasZeroInit)
+		} else {
+			err = convertWrite(ctx, s.target, buf[start:end], offset+start, s.clusterSize, !s.hasZeroInit)
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// convertWrite writes buf to img at pos, and skips the clusters which are all zeros. If writeZeroes is true,
+// the zero clusters are written as zeros instead, since the unallocated clusters of img do not read as zeros,
+// such as read from the backing file.
+//  qemu-img.c: static int convert_write(ImgConvertState *s, int64_t sector_num, int nb_sectors, const uint8_t *buf)
+func convertWrite(ctx context.Context, img *QCow2, buf []byte, pos, clusterSize int64, writeZeroes bool) error {
+	for start := int64(0); start < int64(len(buf)); {
+		// the first chunk is up to the cluster boundary, if pos is not aligned
+		end := alignOffset(pos+start+1, int(clusterSize)) - pos
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+
+		if bufferIsZero(buf[start:end]) {
+			if writeZeroes {
+				if err := img.WriteZeroes(pos+start, end-start); err != nil {
+					return err
+				}
+			}
+			start = end
+			continue
+		}
+
+		// write the consecutive non-zero clusters by a request
+		for end < int64(len(buf)) {
+			next := end + clusterSize
+			if next > int64(len(buf)) {
+				next = int64(len(buf))
+			}
+			if bufferIsZero(buf[end:next]) {
+				break
+			}
+			end = next
+		}
+
+		if _, err := img.WriteAtContext(ctx, buf[start:end], pos+start); err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// alignFileEnd grows the image file of bs to the sector boundary.
+// The compressed clusters end at the arbitrary byte offset of the image file.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_pwritev_compressed(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov)
+func alignFileEnd(bs *BlockDriverState) error {
+	if bs.file == nil || bs.file.bs == nil || bs.file.bs.File == nil {
+		return ENOMEDIUM
+	}
+	f := bs.file.bs.File
+
+	length, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if aligned := roundUp(length, int64(BDRV_SECTOR_SIZE)); aligned != length {
+		return f.Truncate(aligned)
+	}
+
+	return nil
+}
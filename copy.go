@@ -0,0 +1,157 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// CopyRange copies length bytes of the guest data of src at srcOff to dst at dstOff, same as the skip, seek
+// and count options of 'qemu-img dd' in bytes. If length is negative, copies until the end of src.
+// The copy stops at the end of src, and returns the number of bytes copied.
+//
+// The src and dst can be the raw image opened by OpenFileFormat. The ranges which read as zeros in src are
+// not written to dst if they already read as zeros in dst, so the unallocated clusters of dst are kept sparse.
+//  qemu-img.c: static int img_dd(int argc, char **argv)
+func CopyRange(src *QCow2, srcOff int64, dst *QCow2, dstOff, length int64) (int64, error) {
+	return CopyRangeContext(context.Background(), src, srcOff, dst, dstOff, length)
+}
+
+// CopyRangeContext is like CopyRange, but stops copying when ctx is done, and returns the number of bytes
+// copied and the error of ctx. The range already copied is kept in dst.
+func CopyRangeContext(ctx context.Context, src *QCow2, srcOff int64, dst *QCow2, dstOff, length int64) (int64, error) {
+	defer trace.StartRegion(ctx, "qcow2.CopyRange").End()
+
+	srcBs, dstBs := src.blk.bs(), dst.blk.bs()
+	if srcBs == nil || dstBs == nil {
+		return 0, ENOMEDIUM
+	}
+	if srcOff < 0 || dstOff < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Invalid offset")
+		return 0, err
+	}
+
+	bdrvIncInFlight(srcBs)
+	defer bdrvDecInFlight(srcBs)
+	if dstBs != srcBs {
+		bdrvIncInFlight(dstBs)
+		defer bdrvDecInFlight(dstBs)
+	}
+
+	size, err := getlength(srcBs)
+	if err != nil {
+		err = errors.Wrapf(err, "Failed to get size for '%s'", srcBs.Filename)
+		return 0, err
+	}
+	if srcOff > size {
+		err := errors.Wrapf(ErrInvalidArgument, "%s: cannot skip to specified offset", srcBs.Filename)
+		return 0, err
+	}
+
+	total := size - srcOff
+	if length >= 0 && length < total {
+		total = length
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	if err := dst.blk.checkByteRequest(dstOff, total); err != nil {
+		err = errors.Wrapf(err, "%s: cannot write %d bytes at offset %d", dstBs.Filename, total, dstOff)
+		return 0, err
+	}
+
+	// the overlapped ranges of the same image are copied from the end, same as memmove
+	if srcBs == dstBs && dstOff > srcOff && dstOff < srcOff+total {
+		return copyRangeBackward(ctx, src, srcOff, dst, dstOff, total)
+	}
+
+	buf := make([]byte, IO_BUF_SIZE)
+	var zeroBuf []byte
+
+	var n int64
+	for pos := int64(0); pos < total; pos += n {
+		if err := ctx.Err(); err != nil {
+			return pos, err
+		}
+
+		n = total - pos
+		if n > IO_BUF_SIZE {
+			n = IO_BUF_SIZE
+		}
+
+		status, sn, _, _, err := bdrvBlockStatusAbove(srcBs, srcOff+pos, n)
+		if err != nil {
+			return pos, errors.Wrapf(err, "%s: error while reading", srcBs.Filename)
+		}
+		if sn > 0 && sn < n {
+			n = sn
+		}
+
+		if status&BDRV_BLOCK_DATA == 0 || status&BDRV_BLOCK_ZERO != 0 {
+			// skip the range which already reads as zeros in dst
+			dstStatus, dn, _, _, err := bdrvBlockStatusAbove(dstBs, dstOff+pos, n)
+			if err != nil {
+				return pos, errors.Wrapf(err, "%s: error while writing", dstBs.Filename)
+			}
+			if dn > 0 && dn < n {
+				n = dn
+			}
+			if dstStatus&BDRV_BLOCK_ZERO != 0 {
+				continue
+			}
+
+			if zeroBuf == nil {
+				zeroBuf = make([]byte, IO_BUF_SIZE)
+			}
+			if err := dst.blk.pwrite(ctx, dstOff+pos, zeroBuf[:n], 0); err != nil {
+				return pos, errors.Wrapf(err, "%s: error while writing", dstBs.Filename)
+			}
+			continue
+		}
+
+		if err := src.blk.pread(ctx, srcOff+pos, buf[:n]); err != nil {
+			return pos, errors.Wrapf(err, "%s: error while reading", srcBs.Filename)
+		}
+		if err := dst.blk.pwrite(ctx, dstOff+pos, buf[:n], 0); err != nil {
+			return pos, errors.Wrapf(err, "%s: error while writing", dstBs.Filename)
+		}
+	}
+
+	return total, nil
+}
+
+// copyRangeBackward copies total bytes of src at srcOff to dst at dstOff from the end of the range.
+func copyRangeBackward(ctx context.Context, src *QCow2, srcOff int64, dst *QCow2, dstOff, total int64) (int64, error) {
+	buf := make([]byte, IO_BUF_SIZE)
+
+	for end := total; end > 0; {
+		if err := ctx.Err(); err != nil {
+			return total - end, err
+		}
+
+		n := end
+		if n > IO_BUF_SIZE {
+			n = IO_BUF_SIZE
+		}
+		start := end - n
+
+		if err := src.blk.pread(ctx, srcOff+start, buf[:n]); err != nil {
+			return total - end, errors.Wrapf(err, "%s: error while reading", src.blk.bs().Filename)
+		}
+		if err := dst.blk.pwrite(ctx, dstOff+start, buf[:n], 0); err != nil {
+			return total - end, errors.Wrapf(err, "%s: error while writing", dst.blk.bs().Filename)
+		}
+
+		end = start
+	}
+
+	return total, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crashtest verifies the crash consistency of the qcow2 images.
+//
+// The scenario creates the image and runs the operations on it, with the qcow2.FaultBackend which simulates
+// the crash at every write and sync of the image file. After each crash, the image may leak the clusters, but
+// must have no other corruptions. The image is reopened and repaired by the check, and must be consistent after
+// the repair, same as qemu-iotests with blkdebug.
+package crashtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// Scenario represents the operations on the new image, which are crashed at every failure point.
+type Scenario struct {
+	// Name the name of the scenario, which is also the file name of the image.
+	Name string
+	// Opts the creation options of the image. The Filename and the WrapBackend are set by Run.
+	Opts qcow2.Opts
+	// Run runs the operations on the created image. If nil, only the creation of the image is crashed.
+	Run func(img *qcow2.QCow2) error
+}
+
+// Result represents the result of a crash of the scenario.
+type Result struct {
+	// Kind the kind of the injected failure.
+	Kind qcow2.FaultKind
+	// N the index of the failed write or sync, from 1.
+	N int
+	// Err the error of the scenario returned by the crash, or nil if the failure point was not reached.
+	Err error
+	// Created whether the image was created before the crash.
+	Created bool
+	// Corruptions the number of the corruptions of the crashed image besides the leaks.
+	Corruptions int
+	// Repair the result of the repair of the crashed image, or nil if the image could not be opened.
+	Repair *qcow2.ImageCheck
+}
+
+// String returns the failure point of the result.
+func (r *Result) String() string {
+	return fmt.Sprintf("%s #%d", r.Kind, r.N)
+}
+
+// Run crashes the scenario at every write and sync of the image file in dir, and verifies that each crashed
+// image has no corruptions besides the leaks and is repairable. It returns the results of all crashes, and the
+// error of the first crashed image which is corrupted or is not repairable.
+//
+// The crashed image is repairable if the check repairs all of its inconsistencies, and the following check
+// finds no inconsistencies. The image which is crashed before its creation is completed may not be opened
+// at all, since the creation was never completed.
+func Run(dir string, sc *Scenario) ([]*Result, error) {
+	filename := filepath.Join(dir, sc.Name+".qcow2")
+
+	// count the failure points
+	dry := &Result{Kind: qcow2.FaultNone}
+	fb, err := runOnce(filename, sc, dry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: could not run without failures", sc.Name)
+	}
+	points := map[qcow2.FaultKind]int{
+		qcow2.FaultWrite:      fb.Writes(),
+		qcow2.FaultShortWrite: fb.Writes(),
+		qcow2.FaultAfterSync:  fb.Syncs(),
+		qcow2.FaultLostWrites: fb.Writes(),
+	}
+
+	var results []*Result
+	for _, kind := range []qcow2.FaultKind{qcow2.FaultWrite, qcow2.FaultShortWrite, qcow2.FaultAfterSync, qcow2.FaultLostWrites} {
+		for n := 1; n <= points[kind]; n++ {
+			res := &Result{Kind: kind, N: n}
+			results = append(results, res)
+
+			if _, err := runOnce(filename, sc, res); err != nil {
+				return results, errors.Wrapf(err, "%s: %s", sc.Name, res)
+			}
+		}
+	}
+	os.Remove(filename)
+
+	return results, nil
+}
+
+// runOnce runs the scenario with the failure of res, and verifies the crashed image.
+func runOnce(filename string, sc *Scenario, res *Result) (*qcow2.FaultBackend, error) {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var fb *qcow2.FaultBackend
+	opts := sc.Opts
+	opts.Filename = filename
+	opts.Fmt = qcow2.DriverQCow2
+	opts.WrapBackend = func(b qcow2.Backend) qcow2.Backend {
+		fb = qcow2.NewFaultBackend(b, res.Kind, res.N)
+		return fb
+	}
+
+	img, err := qcow2.Create(&opts)
+	if err == nil {
+		res.Created = true
+		if sc.Run != nil {
+			err = sc.Run(img)
+		}
+		if cerr := img.Close(); err == nil {
+			err = cerr
+		}
+	}
+	res.Err = err
+	if res.Kind == qcow2.FaultNone {
+		if err != nil {
+			return nil, err
+		}
+		return fb, nil
+	}
+
+	return fb, verify(filename, res)
+}
+
+// verify checks that the crashed image has no corruptions besides the leaks, repairs it, and checks that the
+// image is consistent.
+func verify(filename string, res *Result) error {
+	if err := verifyCrashed(filename, res); err != nil {
+		return err
+	}
+
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDWR, &qcow2.OpenOpts{
+		Repair: true,
+	})
+	if err != nil {
+		if !res.Created {
+			return nil
+		}
+		return errors.Wrap(err, "could not open the crashed image")
+	}
+	defer img.Close()
+
+	res.Repair, err = img.Check(qcow2.BDRV_FIX_LEAKS | qcow2.BDRV_FIX_ERRORS)
+	if err != nil {
+		return errors.Wrap(err, "could not repair the crashed image")
+	}
+	if res.Repair.Corruptions > 0 || res.Repair.CheckErrors > 0 {
+		return errors.Errorf("%d corruptions and %d errors are left after the repair", res.Repair.Corruptions, res.Repair.CheckErrors)
+	}
+
+	check, err := img.Check(0)
+	if err != nil {
+		return errors.Wrap(err, "could not check the repaired image")
+	}
+	if check.Corruptions > 0 || check.Leaks > 0 || check.CheckErrors > 0 {
+		return errors.Errorf("the repaired image has %d corruptions, %d leaks and %d errors", check.Corruptions, check.Leaks, check.CheckErrors)
+	}
+
+	return img.Close()
+}
+
+// verifyCrashed repairs only the leaks of the crashed image, and checks that no corruptions are left. The
+// metadata is written in the order of the dependencies, so the crash may leak the clusters, but must not leave
+// the references to the clusters whose refcounts are not written, nor to the tables which are not written.
+//
+// The interrupted operation which increases the refcounts, such as the snapshot creation, also leaves the
+// clusters without OFLAG_COPIED, whose refcounts are 1 once the leaks are repaired. They are not counted as the
+// corruptions, since such clusters are only copied on the next write needlessly.
+func verifyCrashed(filename string, res *Result) error {
+	logger := new(copiedLogger)
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDWR, &qcow2.OpenOpts{
+		Repair: true,
+		Logger: logger,
+	})
+	if err != nil {
+		// the image is verified by the repair
+		return nil
+	}
+	defer img.Close()
+
+	check, err := img.Check(qcow2.BDRV_FIX_LEAKS)
+	if err != nil {
+		return errors.Wrap(err, "could not repair the leaks of the crashed image")
+	}
+	res.Corruptions = check.Corruptions - int(atomic.LoadInt64(&logger.n))
+	if res.Corruptions > 0 {
+		return errors.Errorf("the crashed image has %d corruptions besides the leaks", res.Corruptions)
+	}
+
+	return img.Close()
+}
+
+// copiedLogger counts the errors of the clusters whose refcounts are 1 but have no OFLAG_COPIED.
+type copiedLogger struct {
+	n int64
+}
+
+// Logf implements qcow2.Logger.
+func (l *copiedLogger) Logf(level qcow2.LogLevel, format string, args ...interface{}) {
+	if level != qcow2.LogError || !strings.Contains(format, "OFLAG_COPIED") || len(args) == 0 {
+		return
+	}
+	if refcount, ok := args[len(args)-1].(uint64); ok && refcount == 1 {
+		atomic.AddInt64(&l.n, 1)
+	}
+}
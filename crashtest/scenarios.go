@@ -0,0 +1,94 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package crashtest
+
+import (
+	"bytes"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// scenarioClusterSize the cluster size of the images of the scenarios, which is small so that the writes
+// allocate many clusters and L2 tables.
+const scenarioClusterSize = 4096
+
+// Scenarios returns the scenarios which cover the creation of the image, the guest writes, and the internal
+// snapshots.
+func Scenarios() []*Scenario {
+	opts := qcow2.Opts{
+		Size:        64 << 20,
+		ClusterSize: scenarioClusterSize,
+	}
+
+	return []*Scenario{
+		{
+			Name: "create",
+			Opts: opts,
+		},
+		{
+			Name: "write",
+			Opts: opts,
+			Run:  runWrite,
+		},
+		{
+			Name: "snapshot",
+			Opts: opts,
+			Run:  runSnapshot,
+		},
+	}
+}
+
+// runWrite allocates the data clusters and the L2 tables, overwrites the clusters partially, and zeroes and
+// discards the clusters.
+func runWrite(img *qcow2.QCow2) error {
+	data := bytes.Repeat([]byte{0xa5}, 3*scenarioClusterSize)
+
+	// the clusters in the different L2 tables
+	for _, off := range []int64{0, 8 << 20, 32 << 20} {
+		if _, err := img.WriteAt(data, off+512); err != nil {
+			return err
+		}
+	}
+	if err := img.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := img.WriteAt(data[:1024], 2048); err != nil {
+		return err
+	}
+	if err := img.WriteZeroes(8<<20, 2*scenarioClusterSize); err != nil {
+		return err
+	}
+	if err := img.Discard(32<<20, 2*scenarioClusterSize); err != nil {
+		return err
+	}
+
+	return img.Flush()
+}
+
+// runSnapshot creates the snapshot, overwrites the clusters shared with the snapshot, which are copied on
+// write, reverts the image to the snapshot, and deletes it.
+func runSnapshot(img *qcow2.QCow2) error {
+	data := bytes.Repeat([]byte{0x5a}, 2*scenarioClusterSize)
+
+	if _, err := img.WriteAt(data, 0); err != nil {
+		return err
+	}
+	sn, err := img.CreateSnapshot("crash")
+	if err != nil {
+		return err
+	}
+	if _, err := img.WriteAt(data[:512], 1024); err != nil {
+		return err
+	}
+	if err := img.Flush(); err != nil {
+		return err
+	}
+	if err := img.ApplySnapshot(sn.ID); err != nil {
+		return err
+	}
+
+	return img.DeleteSnapshot(sn.ID)
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// createURLOverlay creates the overlay on the raw backing file of url.
+func createURLOverlay(t *testing.T, url string, size int64) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "overlay.qcow2")
+	img, err := qcow2.Create(&qcow2.Opts{
+		Filename:      filename,
+		Fmt:           qcow2.DriverQCow2,
+		Size:          size,
+		BackingFile:   url,
+		BackingFormat: string(qcow2.DriverRaw),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// readOverlay opens the overlay of filename with the backing cache of dir, and reads n bytes at off.
+func readOverlay(filename, dir string, off int64, n int) ([]byte, error) {
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDONLY, &qcow2.OpenOpts{BackingCacheDir: dir})
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	buf := make([]byte, n)
+	if _, err := img.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func TestBackingCache(t *testing.T) {
+	const size = 1<<20 + 100
+	data := testData(size)
+	srv := newTestServer(t, data)
+	overlay := createURLOverlay(t, srv.URL+"/base.raw", 2<<20)
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		etag string
+		off  int64
+		len  int
+		// fetch whether the read is fetched from the server
+		fetch bool
+	}{
+		{name: "first", off: 100 << 10, len: 8 << 10, fetch: true},
+		{name: "cached", off: 100 << 10, len: 8 << 10},
+		{name: "not cached", off: 512 << 10, len: 4 << 10, fetch: true},
+		{name: "tail", off: size - 4096, len: 4096, fetch: true},
+		{name: "tail cached", off: size - 4096, len: 4096},
+		{name: "changed", etag: `"v2"`, off: 100 << 10, len: 8 << 10, fetch: true},
+		{name: "changed cached", off: 100 << 10, len: 8 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.etag != "" {
+				srv.mu.Lock()
+				srv.etag = tt.etag
+				srv.mu.Unlock()
+			}
+
+			gets := srv.getCount()
+			got, err := readOverlay(overlay, dir, tt.off, tt.len)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[tt.off:tt.off+int64(tt.len)]) {
+				t.Error("the data read through the cache differs from the backing file")
+			}
+			if fetched := srv.getCount() > gets; fetched != tt.fetch {
+				t.Errorf("the read is fetched from the server: %v, want %v", fetched, tt.fetch)
+			}
+		})
+	}
+
+	// the cache overlay of the old version is removed
+	caches, err := filepath.Glob(filepath.Join(dir, "*.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caches) != 1 {
+		t.Errorf("cache overlays = %v, want only the current version", caches)
+	}
+
+	// the tail beyond the backing file reads as zeros
+	got, err := readOverlay(overlay, dir, size, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, make([]byte, 4096)) {
+		t.Error("the tail beyond the backing file is not zero")
+	}
+}
+
+// TestBackingCacheErrors checks the failed fetches are returned to the reader, and are not cached.
+func TestBackingCacheErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		short  bool
+	}{
+		{name: "short response", short: true},
+		{name: "server error", status: http.StatusInternalServerError},
+		{name: "not found", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(1 << 20)
+			srv := newTestServer(t, data)
+			overlay := createURLOverlay(t, srv.URL+"/base.raw", 1<<20)
+			dir := t.TempDir()
+
+			srv.mu.Lock()
+			srv.status, srv.short = tt.status, tt.short
+			srv.mu.Unlock()
+			if _, err := readOverlay(overlay, dir, 0, 4096); err == nil {
+				t.Fatal("the failed fetch is read without the error")
+			}
+
+			srv.mu.Lock()
+			srv.status, srv.short = 0, false
+			srv.mu.Unlock()
+			got, err := readOverlay(overlay, dir, 0, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[:4096]) {
+				t.Error("the failed fetch is cached")
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// cacheBlockSize the granularity of the on-disk cache.
+	cacheBlockSize = 64 * 1024
+	// cacheMapMagic the magic of the map file of the on-disk cache.
+	cacheMapMagic = "QCURLMAP"
+)
+
+// diskCache is the on-disk cache of the file on the server. The fetched blocks are stored in the sparse
+// data file at the same offset, and the map file records which blocks are stored.
+// The map is reused by the next open only if the size and the validator of the file on the server are
+// not changed.
+type diskCache struct {
+	data      *os.File
+	mapPath   string
+	validator string
+	size      int64
+	// present the bitmap of the stored blocks.
+	present []byte
+	dirty   bool
+}
+
+// openDiskCache opens the cache of the url in the dir, and discards the stored blocks if the file on
+// the server is changed.
+func openDiskCache(dir, url, validator string, size int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Could not create cache directory %s", dir)
+	}
+
+	sum := sha256.Sum256([]byte(url))
+	name := filepath.Join(dir, hex.EncodeToString(sum[:]))
+
+	data, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open cache file %s", name)
+	}
+
+	c := &diskCache{
+		data:      data,
+		mapPath:   name + ".map",
+		validator: validator,
+		size:      size,
+		present:   make([]byte, (size/cacheBlockSize+8)/8),
+	}
+
+	// without the validator, the stored blocks can not be proved to be the current file
+	if validator == "" || !c.loadMap() {
+		if err := data.Truncate(0); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	if err := data.Truncate(size); err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadMap reads the map file, and returns false if it does not match the file on the server.
+func (c *diskCache) loadMap() bool {
+	buf, err := ioutil.ReadFile(c.mapPath)
+	if err != nil {
+		return false
+	}
+
+	hdrLen := len(cacheMapMagic) + 8 + 4
+	if len(buf) < hdrLen || string(buf[:len(cacheMapMagic)]) != cacheMapMagic {
+		return false
+	}
+	buf = buf[len(cacheMapMagic):]
+	if int64(binary.BigEndian.Uint64(buf)) != c.size {
+		return false
+	}
+	n := int(binary.BigEndian.Uint32(buf[8:]))
+	buf = buf[12:]
+	if len(buf) != n+len(c.present) || string(buf[:n]) != c.validator {
+		return false
+	}
+	copy(c.present, buf[n:])
+
+	return true
+}
+
+// saveMap writes the map file atomically.
+func (c *diskCache) saveMap() error {
+	var buf bytes.Buffer
+	buf.WriteString(cacheMapMagic)
+	binary.Write(&buf, binary.BigEndian, uint64(c.size))
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.validator)))
+	buf.WriteString(c.validator)
+	buf.Write(c.present)
+
+	tmp := c.mapPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.mapPath)
+}
+
+func (c *diskCache) has(block int64) bool {
+	return c.present[block/8]&(1<<uint(block%8)) != 0
+}
+
+func (c *diskCache) set(block int64) {
+	c.present[block/8] |= 1 << uint(block%8)
+}
+
+// readAt reads p from the cache, and fetches the missing blocks from the server.
+// The contiguous missing blocks are fetched by a request, which is extended to the readahead size
+// while the following blocks are missing.
+func (c *diskCache) readAt(f *File, p []byte, off int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	first := off / cacheBlockSize
+	last := (off + int64(len(p)) - 1) / cacheBlockSize
+	nbBlocks := (c.size + cacheBlockSize - 1) / cacheBlockSize
+
+	for block := first; block <= last; {
+		if c.has(block) {
+			block++
+			continue
+		}
+
+		end := block + 1
+		for end < nbBlocks && !c.has(end) && (end <= last || (end-block)*cacheBlockSize < f.readahead) {
+			end++
+		}
+
+		start := block * cacheBlockSize
+		length := end*cacheBlockSize - start
+		if length > c.size-start {
+			length = c.size - start
+		}
+		buf := make([]byte, length)
+		if err := f.fetch(buf, start); err != nil {
+			return err
+		}
+		if _, err := c.data.WriteAt(buf, start); err != nil {
+			return errors.Wrap(err, "Could not write cache file")
+		}
+		for ; block < end; block++ {
+			c.set(block)
+		}
+		c.dirty = true
+	}
+
+	_, err := c.data.ReadAt(p, off)
+	return err
+}
+
+// close writes the map, and closes the data file.
+func (c *diskCache) close() error {
+	var err error
+	if c.dirty && c.validator != "" {
+		err = c.saveMap()
+	}
+	if cerr := c.data.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package curl reads the image file over HTTP(S) by the range requests, same as the curl block driver of qemu.
+//
+// Importing the package registers the http:// and https:// URLs as the protocol of the image file and the
+// backing file, so the overlay can be created straight on top of the cloud image URL without downloading it
+// first. Only the clusters which are read by the guest are fetched, and they are optionally cached on the disk.
+package curl
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// CURL_BLOCK_OPT_READAHEAD_DEFAULT the default readahead size.
+//  block/curl.c: #define CURL_BLOCK_OPT_READAHEAD_DEFAULT (256 * 1024)
+const CURL_BLOCK_OPT_READAHEAD_DEFAULT = 256 * 1024
+
+func init() {
+	for _, scheme := range []string{"http", "https"} {
+		qcow2.RegisterProtocol(scheme, openURL)
+	}
+}
+
+// The errors of Open, which are returned if the server can not serve the file as the image file.
+var (
+	// errNoSize the server does not report the size of the file.
+	errNoSize = errors.New("CURL: Server does not report the file size")
+	// errNoRange the server does not support the range requests.
+	errNoRange = errors.New("Server does not support 'range' (byte ranges)")
+)
+
+// Options represents the options of the HTTP(S) file.
+type Options struct {
+	// Client the HTTP client of the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Header the additional header of the requests, such as the cookie and the authorization.
+	Header http.Header
+	// Readahead the size of the data fetched by a request. The read smaller than Readahead fetches
+	// the following data together, which is used by the next sequential reads.
+	// If zero, CURL_BLOCK_OPT_READAHEAD_DEFAULT is used.
+	Readahead int64
+	// CacheDir the directory of the on-disk cache. If not empty, the fetched data are stored in the cache
+	// file of the URL, and read from it instead of the server until the file on the server is changed.
+	CacheDir string
+}
+
+// DefaultOptions the options of the http:// and https:// file names opened as the image file or the
+// backing file. It should be set before opening the image.
+var DefaultOptions = &Options{}
+
+// openURL opens the URL as the protocol of the image file.
+//  block/curl.c: static int curl_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func openURL(filename string, flag int) (qcow2.Backend, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err := errors.Wrap(qcow2.ErrReadOnly, "curl block device does not support writes")
+		return nil, err
+	}
+
+	return Open(filename, DefaultOptions)
+}
+
+// File is the read-only image file on the HTTP(S) server, which implements qcow2.Backend.
+// The server must support the byte range requests.
+//  block/curl.c: typedef struct BDRVCURLState
+type File struct {
+	url       string
+	client    *http.Client
+	header    http.Header
+	readahead int64
+	size      int64
+	// validator the ETag or the modification time of the file, which identifies the version of the file
+	validator string
+
+	mu sync.Mutex
+	// buf the data of the last request from bufOffset, which serves the following sequential reads.
+	buf       []byte
+	bufOffset int64
+	cache     *diskCache
+}
+
+var _ qcow2.Backend = (*File)(nil)
+
+// Open opens the file of the URL. If opts is nil, the default options are used.
+//  block/curl.c: static int curl_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func Open(url string, opts *Options) (*File, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	f := &File{
+		url:       url,
+		client:    opts.Client,
+		header:    opts.Header,
+		readahead: opts.Readahead,
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	if f.readahead <= 0 {
+		f.readahead = CURL_BLOCK_OPT_READAHEAD_DEFAULT
+	}
+
+	req, err := f.newRequest("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "CURL: Error opening file")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("CURL: Error opening file: %s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, errNoSize
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil, errNoRange
+	}
+	f.size = resp.ContentLength
+
+	// the ETag or the modification time identifies the version of the file on the server
+	f.validator = resp.Header.Get("ETag")
+	if f.validator == "" {
+		f.validator = resp.Header.Get("Last-Modified")
+	}
+
+	if opts.CacheDir != "" {
+		f.cache, err = openDiskCache(opts.CacheDir, url, f.validator, f.size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f *File) newRequest(method string) (*http.Request, error) {
+	req, err := http.NewRequest(method, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range f.header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// fetch reads the range of the file from the server into p.
+//  block/curl.c: static void curl_setup_preadv(BlockDriverState *bs, CURLAIOCB *acb)
+func (f *File) fetch(p []byte, off int64) error {
+	req, err := f.newRequest("GET")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "CURL: Error reading offset %d", off)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.Errorf("CURL: Error reading offset %d: %s", off, resp.Status)
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return errors.Wrapf(err, "CURL: Error reading offset %d", off)
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+// The read beyond the size of the file returns io.EOF.
+//  block/curl.c: static void curl_readv_bh_cb(void *p)
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > f.size-off {
+		n = int(f.size - off)
+	}
+
+	var err error
+	if f.cache != nil {
+		err = f.cache.readAt(f, p[:n], off)
+	} else {
+		err = f.readAhead(p[:n], off)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// readAhead reads p from the last fetched data, or fetches the data from off with the readahead.
+//  block/curl.c: static int curl_find_buf(BDRVCURLState *s, size_t start, size_t len, CURLAIOCB *acb)
+func (f *File) readAhead(p []byte, off int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= f.bufOffset && off+int64(len(p)) <= f.bufOffset+int64(len(f.buf)) {
+		copy(p, f.buf[off-f.bufOffset:])
+		return nil
+	}
+
+	length := int64(len(p))
+	if length < f.readahead {
+		length = f.readahead
+	}
+	if length > f.size-off {
+		length = f.size - off
+	}
+
+	buf := make([]byte, length)
+	if err := f.fetch(buf, off); err != nil {
+		return err
+	}
+	copy(p, buf)
+	f.buf = buf
+	f.bufOffset = off
+
+	return nil
+}
+
+// WriteAt implements io.WriterAt, and always returns EBADF.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EBADF
+}
+
+// Truncate implements qcow2.Backend, and always returns EBADF.
+func (f *File) Truncate(size int64) error {
+	return syscall.EBADF
+}
+
+// Sync implements qcow2.Backend.
+func (f *File) Sync() error {
+	return nil
+}
+
+// Size implements qcow2.Backend, and returns the size of the file on the server.
+//  block/curl.c: static int64_t curl_getlength(BlockDriverState *bs)
+func (f *File) Size() (int64, error) {
+	return f.size, nil
+}
+
+// Validator returns the ETag or the modification time of the file on the server, which identifies the version of
+// the file for the cache overlay of OpenOpts.BackingCacheDir.
+func (f *File) Validator() string {
+	return f.validator
+}
+
+// Close closes the on-disk cache if any.
+//  block/curl.c: static void curl_close(BlockDriverState *bs)
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.buf = nil
+	if f.cache == nil {
+		return nil
+	}
+	err := f.cache.close()
+	f.cache = nil
+
+	return err
+}
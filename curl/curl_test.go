@@ -0,0 +1,295 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// testServer the HTTP server of the file, which serves the range requests and counts them.
+type testServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	data []byte
+	etag string
+	// gets the number of the GET requests.
+	gets int
+	// status the status of the GET requests instead of 206 if not zero.
+	status int
+	// short sends the half of the requested range.
+	short bool
+	// noRange and noSize omit the Accept-Ranges and the Content-Length of the HEAD response.
+	noRange, noSize bool
+}
+
+func newTestServer(t *testing.T, data []byte) *testServer {
+	t.Helper()
+
+	s := &testServer{
+		data: data,
+		etag: `"v1"`,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("ETag", s.etag)
+	if !s.noRange {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	switch r.Method {
+	case "HEAD":
+		if !s.noSize {
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "GET":
+		s.gets++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.status != 0 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(s.data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	body := s.data[start : end+1]
+	if s.short {
+		body = body[:len(body)/2]
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(body)
+}
+
+// getCount returns the number of the GET requests.
+func (s *testServer) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.gets
+}
+
+// testData returns the data of size, whose every 4 bytes differ.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := 0; i+4 <= size; i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = byte(i>>24), byte(i>>16), byte(i>>8), byte(i)
+	}
+	return data
+}
+
+func TestReadAt(t *testing.T) {
+	const size = 1<<20 + 100
+	data := testData(size)
+	srv := newTestServer(t, data)
+
+	f, err := Open(srv.URL+"/disk.raw", &Options{Readahead: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got, _ := f.Size(); got != size {
+		t.Errorf("Size() = %d, want %d", got, size)
+	}
+	if f.Validator() != `"v1"` {
+		t.Errorf("Validator() = %q, want the ETag", f.Validator())
+	}
+
+	tests := []struct {
+		name string
+		off  int64
+		len  int
+		// want the number of the bytes read, which is less than len with io.EOF
+		want int
+		// gets the number of the GET requests after the read
+		gets int
+	}{
+		{name: "first", off: 0, len: 4096, want: 4096, gets: 1},
+		{name: "readahead", off: 4096, len: 4096, want: 4096, gets: 1},
+		{name: "end of readahead", off: 60 << 10, len: 8 << 10, want: 8 << 10, gets: 2},
+		{name: "larger than readahead", off: 256 << 10, len: 128 << 10, want: 128 << 10, gets: 3},
+		{name: "backward", off: 0, len: 512, want: 512, gets: 4},
+		{name: "tail", off: size - 100, len: 4096, want: 100, gets: 5},
+		{name: "beyond end", off: size, len: 512, want: 0, gets: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.len)
+			n, err := f.ReadAt(buf, tt.off)
+			if n != tt.want {
+				t.Errorf("ReadAt() = %d, want %d", n, tt.want)
+			}
+			if tt.want < tt.len && err != io.EOF {
+				t.Errorf("ReadAt() = %v, want io.EOF", err)
+			}
+			if tt.want == tt.len && err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(buf[:n], data[tt.off:tt.off+int64(n)]) {
+				t.Error("the data read differs from the file")
+			}
+			if got := srv.getCount(); got != tt.gets {
+				t.Errorf("%d GET requests, want %d", got, tt.gets)
+			}
+		})
+	}
+
+	if _, err := f.WriteAt([]byte{0}, 0); err == nil {
+		t.Error("the write to the file succeeded")
+	}
+}
+
+func TestReadAtErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		short  bool
+		// cache reads through the on-disk cache, which must not store the failed blocks
+		cache bool
+	}{
+		{name: "short response", short: true},
+		{name: "server error", status: http.StatusInternalServerError},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "range ignored", status: http.StatusOK},
+		{name: "short response with cache", short: true, cache: true},
+		{name: "server error with cache", status: http.StatusInternalServerError, cache: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, testData(1<<20))
+			opts := &Options{}
+			if tt.cache {
+				opts.CacheDir = t.TempDir()
+			}
+			f, err := Open(srv.URL+"/disk.raw", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			srv.mu.Lock()
+			srv.status, srv.short = tt.status, tt.short
+			srv.mu.Unlock()
+
+			if n, err := f.ReadAt(make([]byte, 4096), 0); err == nil {
+				t.Errorf("ReadAt() = %d, want the error", n)
+			}
+
+			// the failed request does not leave the partial data for the following reads
+			srv.mu.Lock()
+			srv.status, srv.short = 0, false
+			srv.mu.Unlock()
+
+			buf := make([]byte, 4096)
+			if _, err := f.ReadAt(buf, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, testData(4096)) {
+				t.Error("the data read after the error differs from the file")
+			}
+		})
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	if _, err := Open(missing.URL+"/disk.raw", nil); err == nil {
+		t.Error("Open() of the missing file succeeded")
+	}
+
+	srv := newTestServer(t, testData(4096))
+	srv.mu.Lock()
+	srv.noRange = true
+	srv.mu.Unlock()
+	if _, err := Open(srv.URL+"/disk.raw", nil); errors.Cause(err) != errNoRange {
+		t.Errorf("Open() = %v, want %v", err, errNoRange)
+	}
+
+	srv.mu.Lock()
+	srv.noRange, srv.noSize = false, true
+	srv.mu.Unlock()
+	if _, err := Open(srv.URL+"/disk.raw", nil); errors.Cause(err) != errNoSize {
+		t.Errorf("Open() = %v, want %v", err, errNoSize)
+	}
+
+	if _, err := openURL(srv.URL+"/disk.raw", os.O_RDWR); errors.Cause(err) != qcow2.ErrReadOnly {
+		t.Errorf("openURL() as read-write = %v, want %v", err, qcow2.ErrReadOnly)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	data := testData(1 << 20)
+	srv := newTestServer(t, data)
+	opts := &Options{CacheDir: t.TempDir()}
+
+	read := func(t *testing.T, off int64, n int) {
+		t.Helper()
+
+		f, err := Open(srv.URL+"/disk.raw", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[off:off+int64(n)]) {
+			t.Error("the data read differs from the file")
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read(t, 100<<10, 8<<10)
+	if srv.getCount() != 1 {
+		t.Fatalf("%d GET requests, want 1", srv.getCount())
+	}
+
+	// the cached blocks are read from the cache by the next open
+	read(t, 100<<10, 8<<10)
+	if srv.getCount() != 1 {
+		t.Errorf("%d GET requests for the cached blocks, want 1", srv.getCount())
+	}
+
+	// the cache is discarded if the file on the server is changed
+	srv.mu.Lock()
+	srv.etag = `"v2"`
+	srv.mu.Unlock()
+	read(t, 100<<10, 8<<10)
+	if srv.getCount() != 2 {
+		t.Errorf("%d GET requests after the file is changed, want 2", srv.getCount())
+	}
+}
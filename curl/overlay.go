@@ -0,0 +1,195 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// CreateOverlayFromURL creates the new qcow2 image at destPath on top of the base image of rawurl, which is
+// usually the cloud image, and returns the opened overlay.
+//
+// If rawurl is the http:// or https:// URL and the server supports the range requests, the overlay refers the
+// URL itself as the backing file, and only the clusters read by the guest are fetched. Otherwise, or if the
+// server does not report the file size, the base image is downloaded to the directory of destPath by the last element of the URL path, and the overlay refers the
+// downloaded file. Any other rawurl is referred as the local file by the absolute path.
+//
+// The format of the base image is probed, and recorded in the overlay as the backing format, so the raw base
+// image is never probed as the other format. The virtual disk size of the overlay is size, or the size of the
+// base image if size is zero. size must not be smaller than the base image.
+// The options of the requests are DefaultOptions.
+func CreateOverlayFromURL(rawurl, destPath string, size int64) (*qcow2.QCow2, error) {
+	return CreateOverlayFromURLContext(context.Background(), rawurl, destPath, size)
+}
+
+// CreateOverlayFromURLContext is like CreateOverlayFromURL, but stops downloading the base image when ctx is
+// done, and returns the error of ctx.
+func CreateOverlayFromURLContext(ctx context.Context, rawurl, destPath string, size int64) (*qcow2.QCow2, error) {
+	if size < 0 {
+		return nil, errors.New("Image size must be positive")
+	}
+
+	backing, err := resolveBacking(ctx, rawurl, destPath)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := probeFormat(backing)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not determine the format of '%s'", backing)
+	}
+
+	base, err := qcow2.OpenFileOpts(backing, format, os.O_RDONLY, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open backing file '%s'", backing)
+	}
+	baseSize, err := base.VirtualSize()
+	base.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get size of '%s'", backing)
+	}
+
+	if size == 0 {
+		size = baseSize
+	}
+	if size < baseSize {
+		return nil, errors.Errorf("Overlay size %d is smaller than the backing file size %d", size, baseSize)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return qcow2.CreateContext(ctx, &qcow2.Opts{
+		Filename:      destPath,
+		Fmt:           qcow2.DriverQCow2,
+		Size:          size,
+		BackingFile:   backing,
+		BackingFormat: string(format),
+	})
+}
+
+// resolveBacking returns the backing file name of the overlay at destPath for rawurl, and downloads the base
+// image if the server does not support the range requests.
+func resolveBacking(ctx context.Context, rawurl, destPath string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		// the local file
+		if err == nil && u.Scheme == "file" {
+			rawurl = u.Path
+		}
+		return filepath.Abs(rawurl)
+	}
+
+	f, err := Open(rawurl, DefaultOptions)
+	if err == nil {
+		f.Close()
+		return rawurl, nil
+	}
+	if cause := errors.Cause(err); cause != errNoRange && cause != errNoSize {
+		return "", err
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", errors.Errorf("Could not determine the file name of '%s'", rawurl)
+	}
+	dest, err := filepath.Abs(filepath.Join(filepath.Dir(destPath), name))
+	if err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(destPath); err == nil && abs == dest {
+		return "", errors.Errorf("The downloaded base image '%s' conflicts with the overlay", dest)
+	}
+	if err := download(ctx, rawurl, dest); err != nil {
+		return "", errors.Wrapf(err, "Could not download '%s'", rawurl)
+	}
+
+	return dest, nil
+}
+
+// download fetches the whole file of rawurl to dest. The existing dest is never overwritten, since it may be
+// the backing file of the other overlays.
+func download(ctx context.Context, rawurl, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return errors.Wrapf(os.ErrExist, "%s", dest)
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range DefaultOptions.Header {
+		req.Header[k] = v
+	}
+	client := DefaultOptions.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	// download to the temporary file, so that the partial file is never referred
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".part")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// probeFormat probes the format of the local file or the URL.
+func probeFormat(filename string) (qcow2.DriverFmt, error) {
+	u, err := url.Parse(filename)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return qcow2.DetectFormat(filename)
+	}
+
+	f, err := Open(filename, DefaultOptions)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, qcow2.BLOCK_PROBE_BUF_SIZE)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "Could not read image for determining its format")
+	}
+
+	format, _ := qcow2.Probe(buf)
+	return format, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+)
+
+// dedupCluster represents the host cluster of the target image which is referred by the deduplicated clusters.
+type dedupCluster struct {
+	// hostOffset the offset of the host cluster.
+	hostOffset uint64
+	// guestOffset the guest offset of the cluster which is written to the host cluster first.
+	guestOffset uint64
+	// shared whether the host cluster is referred by more than one guest cluster, and the OFLAG_COPIED flag of
+	// the first guest cluster is cleared.
+	shared bool
+}
+
+// dedupState maps the contents of the clusters written by the conversion to the host clusters of the target
+// image, so the clusters which have the same contents refer the same host cluster.
+type dedupState struct {
+	bs       *BlockDriverState
+	clusters map[[sha256.Size]byte]*dedupCluster
+	buf      []byte
+}
+
+// newDedupState returns the dedupState of the target image bs.
+func newDedupState(bs *BlockDriverState) *dedupState {
+	return &dedupState{
+		bs:       bs,
+		clusters: make(map[[sha256.Size]byte]*dedupCluster),
+		buf:      make([]byte, bs.Opaque.ClusterSize),
+	}
+}
+
+// write writes the whole cluster buf to the target image img at the cluster aligned guest offset, or links the
+// guest cluster to the host cluster which has the same contents.
+func (d *dedupState) write(ctx context.Context, img *QCow2, offset int64, buf []byte, writeZeroes bool) error {
+	if bufferIsZero(buf) {
+		return convertWrite(ctx, img, buf, offset, int64(len(buf)), writeZeroes)
+	}
+
+	sum := sha256.Sum256(buf)
+	if c, ok := d.clusters[sum]; ok {
+		linked, err := d.link(ctx, offset, c, buf)
+		if err != nil {
+			return err
+		}
+		if linked {
+			return nil
+		}
+	}
+
+	if err := convertWrite(ctx, img, buf, offset, int64(len(buf)), writeZeroes); err != nil {
+		return err
+	}
+
+	hostOffset, err := d.hostOffset(ctx, offset)
+	if err != nil {
+		return err
+	}
+	if hostOffset != 0 {
+		// the cluster which can not be linked to the previous host cluster, such as by the refcount overflow,
+		// is referred by the following clusters instead
+		d.clusters[sum] = &dedupCluster{
+			hostOffset:  hostOffset,
+			guestOffset: uint64(offset),
+		}
+	}
+
+	return nil
+}
+
+// hostOffset returns the host offset of the normal cluster at the guest offset, or 0 if the cluster is not
+// the normal cluster.
+func (d *dedupState) hostOffset(ctx context.Context, offset int64) (uint64, error) {
+	bs := d.bs
+	s := bs.Opaque
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	clusterOffset, _, typ, err := getClusterOffset(ctx, bs, uint64(offset), uint64(s.ClusterSize))
+	if err != nil {
+		return 0, err
+	}
+	if typ != CLUSTER_NORMAL {
+		return 0, nil
+	}
+
+	return clusterOffset, nil
+}
+
+// link links the unallocated guest cluster at offset to the host cluster of c, whose contents must be buf, and
+// increases the refcount of the host cluster. It returns false without linking if the contents of the host
+// cluster differ from buf by the hash collision, the refcount reaches the maximum, or the guest cluster is
+// already allocated.
+func (d *dedupState) link(ctx context.Context, offset int64, c *dedupCluster, buf []byte) (bool, error) {
+	bs := d.bs
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := bdrvPread(bs.file, int64(c.hostOffset), d.buf); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(d.buf, buf) {
+		return false, nil
+	}
+
+	clusterIndex := c.hostOffset >> uint(s.ClusterBits)
+	refcount, err := getRefcount(bs, clusterIndex)
+	if err != nil {
+		return false, err
+	}
+	if refcount >= s.RefcountMax {
+		return false, nil
+	}
+
+	l2Table, l2Index, err := getClusterTable(ctx, bs, uint64(offset))
+	if err != nil {
+		return false, err
+	}
+	defer cachePut(s.L2TableCache, l2Table)
+
+	if getL2Entry(l2Table, l2Index) != 0 {
+		return false, nil
+	}
+
+	if err := updateClusterRefcount(bs, int64(clusterIndex), 1, false, DISCARD_NEVER); err != nil {
+		return false, err
+	}
+
+	// the host cluster is no longer owned only by the first guest cluster, which must be copied on write
+	if !c.shared {
+		firstTable, firstIndex, err := getClusterTable(ctx, bs, c.guestOffset)
+		if err != nil {
+			return false, err
+		}
+		cacheEntryMarkDirty(s.L2TableCache, firstTable)
+		setL2Entry(firstTable, firstIndex, getL2Entry(firstTable, firstIndex)&^OFLAG_COPIED)
+		cachePut(s.L2TableCache, firstTable)
+		c.shared = true
+	}
+
+	// the increased refcount must be written before the L2 entry refers to the host cluster
+	if needAccurateRefcounts(s) {
+		if err := cacheSetDependency(bs, s.L2TableCache, s.RefcountBlockCache); err != nil {
+			return false, err
+		}
+	}
+	cacheEntryMarkDirty(s.L2TableCache, l2Table)
+	setL2Entry(l2Table, l2Index, c.hostOffset)
+
+	return true, nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// Diff returns the guest ranges of b whose contents differ from a, such as the changes of the overlay since it
+// was created on top of a, so that the replication tools only copy the changed ranges of b.
+//
+// The ranges which resolve to the same host data of the same layer in both images, such as the clusters of
+// the overlay which are read from the base image, are the same without reading them. The other ranges which
+// have the data in either image are compared by the cluster, the larger cluster size of a and b, and the
+// differing clusters are returned. The ranges which read as zeros in both images are skipped. The range beyond
+// the end of the smaller image reads as zeros.
+//
+// The returned extents describe the contents of b: Zero is true if the range reads as zeros in b, and Depth is
+// the layer of the backing chain of b which the range resolves to. The host offsets are not reported.
+func Diff(a, b *QCow2) ([]Extent, error) {
+	return DiffContext(context.Background(), a, b)
+}
+
+// DiffContext is like Diff, but stops comparing when ctx is done, and returns the error of ctx.
+func DiffContext(ctx context.Context, a, b *QCow2) ([]Extent, error) {
+	defer trace.StartRegion(ctx, "qcow2.Diff").End()
+
+	bs1, bs2 := a.blk.bs(), b.blk.bs()
+	if bs1 == nil || bs2 == nil {
+		return nil, ENOMEDIUM
+	}
+	bdrvIncInFlight(bs1)
+	defer bdrvDecInFlight(bs1)
+	if bs2 != bs1 {
+		bdrvIncInFlight(bs2)
+		defer bdrvDecInFlight(bs2)
+	}
+
+	total1, err := getlength(bs1)
+	if err != nil {
+		err = errors.Wrapf(err, "Can't get size of %s", bs1.Filename)
+		return nil, err
+	}
+	total2, err := getlength(bs2)
+	if err != nil {
+		err = errors.Wrapf(err, "Can't get size of %s", bs2.Filename)
+		return nil, err
+	}
+	total := total1
+	if total2 > total {
+		total = total2
+	}
+
+	granularity := bdrvGetClusterSize(bs1)
+	if c := bdrvGetClusterSize(bs2); c > granularity {
+		granularity = c
+	}
+	d := &diffState{
+		bs1:         bs1,
+		bs2:         bs2,
+		granularity: granularity,
+		buf1:        make([]byte, granularity),
+		buf2:        make([]byte, granularity),
+	}
+
+	var n int64
+	for offset := int64(0); offset < total; offset += n {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		e1, err := diffEntry(bs1, total1, offset, total-offset)
+		if err != nil {
+			return nil, err
+		}
+		e2, err := diffEntry(bs2, total2, offset, total-offset)
+		if err != nil {
+			return nil, err
+		}
+		n = e1.Length
+		if e2.Length < n {
+			n = e2.Length
+		}
+
+		// the range which has no data reads as zeros, regardless of it is unallocated or the zero cluster
+		data1 := e1.Data && !e1.Zero
+		data2 := e2.Data && !e2.Zero
+		switch {
+		case !data1 && !data2:
+			continue
+		case data1 && data2 && e1.HasOffset && e2.HasOffset && e1.Offset == e2.Offset:
+			same, err := d.sameLayer(bs1, e1.Depth, bs2, e2.Depth)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				continue
+			}
+		}
+
+		e2.Length = n
+		if err := d.compare(ctx, &e2, data1, data2); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.extents, nil
+}
+
+// diffState represents the state of Diff.
+type diffState struct {
+	bs1, bs2    *BlockDriverState
+	granularity int64
+	buf1, buf2  []byte
+	extents     []Extent
+}
+
+// diffEntry returns the extent of bs which starts at offset. The range beyond size, the end of bs, has no data.
+func diffEntry(bs *BlockDriverState, size, offset, bytes int64) (Extent, error) {
+	if offset >= size {
+		return Extent{Start: offset, Length: bytes, Zero: true}, nil
+	}
+	if bytes > size-offset {
+		bytes = size - offset
+	}
+
+	e, err := mapEntry(bs, offset, bytes)
+	if err != nil {
+		err = errors.Wrapf(err, "Block status error in %s at offset %d", bs.Filename, offset)
+		return Extent{}, err
+	}
+	if e.Length <= 0 {
+		err := errors.Errorf("Block status returned no progress at offset %d", offset)
+		return Extent{}, err
+	}
+
+	return e, nil
+}
+
+// compare compares the range of e by the granularity, and appends the differing ranges of e to the extents.
+// data1 and data2 report whether the range has the data in bs1 and bs2, otherwise it reads as zeros.
+func (d *diffState) compare(ctx context.Context, e *Extent, data1, data2 bool) error {
+	end := e.Start + e.Length
+	for offset := e.Start; offset < end; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := startOfCluster(d.granularity, offset) + d.granularity - offset
+		if n > end-offset {
+			n = end - offset
+		}
+
+		if data1 {
+			if err := bdrvAlignedPreadv(ctx, d.bs1, offset, d.buf1[:n]); err != nil {
+				err = errors.Wrapf(err, "Error while reading offset %d of %s", offset, d.bs1.Filename)
+				return err
+			}
+		}
+		if data2 {
+			if err := bdrvAlignedPreadv(ctx, d.bs2, offset, d.buf2[:n]); err != nil {
+				err = errors.Wrapf(err, "Error while reading offset %d of %s", offset, d.bs2.Filename)
+				return err
+			}
+		}
+		var same bool
+		switch {
+		case data1 && data2:
+			same = bytes.Equal(d.buf1[:n], d.buf2[:n])
+		case data1:
+			same = bufferIsZero(d.buf1[:n])
+		default:
+			same = bufferIsZero(d.buf2[:n])
+		}
+
+		if !same {
+			next := *e
+			next.Start = offset
+			next.Length = n
+			next.Offset = 0
+			next.HasOffset = false
+			if k := len(d.extents); k > 0 && d.extents[k-1].Start+d.extents[k-1].Length == offset && d.extents[k-1].mergeable(&next) {
+				d.extents[k-1].Length += n
+			} else {
+				d.extents = append(d.extents, next)
+			}
+		}
+		offset += n
+	}
+
+	return nil
+}
+
+// sameLayer reports whether the layer of depth1 in the backing chain of bs1 and the layer of depth2 in the
+// backing chain of bs2 are the same image file.
+func (d *diffState) sameLayer(bs1 *BlockDriverState, depth1 int, bs2 *BlockDriverState, depth2 int) (bool, error) {
+	layer1 := backingLayer(bs1, depth1)
+	layer2 := backingLayer(bs2, depth2)
+	if layer1 == nil || layer2 == nil {
+		return false, nil
+	}
+	if layer1 == layer2 {
+		return true, nil
+	}
+
+	type stater interface {
+		Stat() (os.FileInfo, error)
+	}
+	f1, ok1 := layer1.File.(stater)
+	f2, ok2 := layer2.File.(stater)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	fi1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(fi1, fi2), nil
+}
+
+// backingLayer returns the layer of depth in the backing chain of bs, or nil if the chain is shorter.
+func backingLayer(bs *BlockDriverState, depth int) *BlockDriverState {
+	for ; depth > 0 && bs != nil; depth-- {
+		if bs.Backing == nil {
+			return nil
+		}
+		bs = bs.Backing.bs
+	}
+	return bs
+}
@@ -0,0 +1,264 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// MAX_BLOCKSIZE the maximum alignment which is probed for the direct I/O.
+//  block/file-posix.c: #define MAX_BLOCKSIZE 4096
+const MAX_BLOCKSIZE = 4096
+
+// backendLimiter is implemented by the Backend which has the alignment requirements of the requests.
+//  block/block_int.h: void (*bdrv_refresh_limits)(BlockDriverState *bs, Error **errp)
+type backendLimiter interface {
+	Limits() BlockLimits
+}
+
+// qemuMemalign returns the buffer of size bytes whose address is aligned to align.
+//  util/oslib-posix.c: void *qemu_memalign(size_t alignment, size_t size)
+func qemuMemalign(align, size int) []byte {
+	buf := make([]byte, size+align)
+
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1)); r != 0 {
+		off = align - r
+	}
+
+	return buf[off : off+size : off+size]
+}
+
+// qemuBlockalign returns the buffer of size bytes which is aligned for the requests to the image file of bs,
+// so the requests with it need no bounce buffer.
+//  block/io.c: void *qemu_blockalign(BlockDriverState *bs, size_t size)
+func qemuBlockalign(bs *BlockDriverState, size int) []byte {
+	align := int(bdrvOptMemAlign(bs))
+	if align == 0 {
+		align = os.Getpagesize()
+	}
+
+	return qemuMemalign(align, size)
+}
+
+// directBackend is the Backend of the host file opened for the direct I/O, which bypasses the page cache
+// of the host. The direct I/O requires the offset, the length and the buffer address of the requests to be
+// aligned, so the unaligned reads are done through the aligned bounce buffer, and the unaligned writes are
+// the read-modify-write of the aligned blocks.
+//  block/file-posix.c: typedef struct BDRVRawState
+type directBackend struct {
+	*FileBackend
+
+	// requestAlignment the alignment of the offset and the length of the requests.
+	requestAlignment int
+	// bufAlign the alignment of the buffer address of the requests.
+	bufAlign int
+
+	// rmw is held for writing by the read-modify-write, and for reading by the aligned writes,
+	// so the aligned write to the block is not lost by the concurrent read-modify-write of the same block.
+	rmw sync.RWMutex
+}
+
+var _ Backend = (*directBackend)(nil)
+
+// openDirectBackend opens the host file for the direct I/O, and probes its alignment.
+//  block/file-posix.c: static int raw_open_common(BlockDriverState *bs, QDict *options, int bdrv_flags, int open_flags, Error **errp)
+func openDirectBackend(filename string, flag int) (*directBackend, error) {
+	file, err := openDirect(filename, flag, os.FileMode(0))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open '%s' for the direct I/O", filename)
+	}
+
+	b := &directBackend{
+		FileBackend: NewFileBackend(file),
+	}
+	if err := b.probeAlignment(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// rawIsIoAligned reports whether the read of buf at offset 0 is accepted by the direct I/O.
+//  block/file-posix.c: static bool raw_is_io_aligned(int fd, void *buf, size_t len)
+func rawIsIoAligned(f *os.File, buf []byte) bool {
+	_, err := f.ReadAt(buf, 0)
+	return err == nil || !errors.Is(err, syscall.EINVAL)
+}
+
+// probeAlignment probes the alignment of the buffer address and the requests by the reads of the file.
+//  block/file-posix.c: static void raw_probe_alignment(BlockDriverState *bs, int fd, Error **errp)
+func (b *directBackend) probeAlignment() error {
+	maxAlign := MAX_BLOCKSIZE
+	if pageSize := os.Getpagesize(); pageSize > maxAlign {
+		maxAlign = pageSize
+	}
+
+	buf := qemuMemalign(maxAlign, 2*maxAlign)
+	for align := 512; align <= maxAlign; align <<= 1 {
+		if rawIsIoAligned(b.File, buf[align:align+maxAlign]) {
+			b.bufAlign = align
+			break
+		}
+	}
+	if b.bufAlign == 0 {
+		err := errors.Wrap(ErrInvalidOption, "Could not find working O_DIRECT alignment")
+		return err
+	}
+
+	buf = qemuMemalign(b.bufAlign, maxAlign)
+	for align := 512; align <= maxAlign; align <<= 1 {
+		if rawIsIoAligned(b.File, buf[:align]) {
+			b.requestAlignment = align
+			break
+		}
+	}
+	if b.requestAlignment == 0 {
+		err := errors.Wrap(ErrInvalidOption, "Could not find working O_DIRECT alignment")
+		return err
+	}
+
+	return nil
+}
+
+// Limits returns the alignment of the requests and the buffers of the direct I/O.
+//  block/file-posix.c: static void raw_refresh_limits(BlockDriverState *bs, Error **errp)
+func (b *directBackend) Limits() BlockLimits {
+	optMemAlignment := b.bufAlign
+	if pageSize := os.Getpagesize(); pageSize > optMemAlignment {
+		optMemAlignment = pageSize
+	}
+
+	return BlockLimits{
+		RequestAlignment: uint32(b.requestAlignment),
+		MinMemAlignment:  uint32(b.bufAlign),
+		OptMemAlignment:  uint32(optMemAlignment),
+	}
+}
+
+// isAligned reports whether the request of p at off can be done by the direct I/O as is.
+//  block/io.c: bool bdrv_qiov_is_aligned(BlockDriverState *bs, QEMUIOVector *qiov)
+func (b *directBackend) isAligned(p []byte, off int64) bool {
+	align := int64(b.requestAlignment)
+	if off%align != 0 || int64(len(p))%align != 0 {
+		return false
+	}
+
+	return len(p) == 0 || uintptr(unsafe.Pointer(&p[0]))&uintptr(b.bufAlign-1) == 0
+}
+
+// alignedRange returns the range of the aligned blocks which covers length bytes at off.
+func (b *directBackend) alignedRange(off int64, length int) (int64, int64) {
+	align := int64(b.requestAlignment)
+	start := off &^ (align - 1)
+	end := (off + int64(length) + align - 1) &^ (align - 1)
+
+	return start, end
+}
+
+// ReadAt implements io.ReaderAt. The unaligned read is done through the aligned bounce buffer.
+// The read beyond the end of the file returns io.EOF.
+//  block/file-posix.c: static int coroutine_fn raw_co_prw(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int type)
+func (b *directBackend) ReadAt(p []byte, off int64) (int, error) {
+	if b.isAligned(p, off) {
+		return b.File.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	start, end := b.alignedRange(off, len(p))
+	buf := bufPoolGet(b.bufAlign, int(end-start))
+	defer bufPoolPut(buf)
+
+	n, err := b.File.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// the bytes read beyond off
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p[:n], buf[off-start:])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock reads the aligned block at off into dst through the aligned buffer.
+// The range beyond the end of the file is filled with zeros.
+func (b *directBackend) readBlock(dst []byte, off int64) error {
+	buf := bufPoolGet(b.bufAlign, len(dst))
+	defer bufPoolPut(buf)
+	n, err := b.File.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	copy(dst, buf)
+
+	return nil
+}
+
+// WriteAt implements io.WriterAt. The unaligned write reads the head and the tail blocks, which are partially
+// overwritten, and writes the aligned blocks through the bounce buffer.
+// The file may grow to the aligned end of the write.
+//  block/io.c: static int coroutine_fn bdrv_co_do_zero_pwritev(BdrvChild *child, int64_t offset, unsigned int bytes, BdrvRequestFlags flags, BdrvTrackedRequest *req)
+func (b *directBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.isAligned(p, off) {
+		b.rmw.RLock()
+		defer b.rmw.RUnlock()
+
+		return b.File.WriteAt(p, off)
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	b.rmw.Lock()
+	defer b.rmw.Unlock()
+
+	align := int64(b.requestAlignment)
+	start, end := b.alignedRange(off, len(p))
+	buf := bufPoolGet(b.bufAlign, int(end-start))
+	defer bufPoolPut(buf)
+
+	// read the head and the tail blocks, the range beyond the end of the file is zeros
+	if off != start {
+		if err := b.readBlock(buf[:align], start); err != nil {
+			return 0, err
+		}
+	}
+	if off+int64(len(p)) != end && (end-align != start || off == start) {
+		if err := b.readBlock(buf[end-align-start:], end-align); err != nil {
+			return 0, err
+		}
+	}
+
+	copy(buf[off-start:], p)
+	if _, err := b.File.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Discard discards the guest data from off to off+length, and decreases the refcount of the clusters.
+// The discarded range reads as zeros for the compat=1.1 image. The partial clusters are ignored,
+// because the discard is advisory.
+//
+// The freed clusters are discarded in the image file if the passthrough of DISCARD_REQUEST is enabled
+// by SetDiscardPassthrough, which punches the holes in the host file.
+//  block/block-backend.c: int blk_pdiscard(BlockBackend *blk, int64_t offset, int count)
+func (q *QCow2) Discard(off, length int64) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	if err := q.blk.pdiscard(context.Background(), off, length); err != nil {
+		err = errors.Wrapf(err, "Could not discard at offset %d", off)
+		return err
+	}
+
+	return nil
+}
+
+// SetDiscardPassthrough sets whether the clusters freed by the typ operation are discarded in the image file.
+// The DISCARD_REQUEST is the guest discard request, DISCARD_SNAPSHOT is the snapshot deletion, and
+// DISCARD_OTHER is the other operations such as the metadata update.
+// By default, only DISCARD_SNAPSHOT is passed through, same as qemu.
+//  block/qcow2.c: pass-discard-request, pass-discard-snapshot and pass-discard-other options
+func (q *QCow2) SetDiscardPassthrough(typ DiscardType, passthrough bool) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		return syscall.ENOTSUP
+	}
+	if typ != DISCARD_REQUEST && typ != DISCARD_SNAPSHOT && typ != DISCARD_OTHER {
+		err := errors.Wrapf(ErrInvalidArgument, "Invalid discard type %d", typ)
+		return err
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.Opaque.DiscardPassthrough[typ] = passthrough
+	bdrvDrainedEnd(bs)
+
+	return nil
+}
+
+// SetWipeFreed sets whether the host clusters are overwritten with zeros before they are freed, same as
+// OpenOpts.Wipe. All of the freed clusters are wiped, including the old clusters which are replaced by the
+// copy-on-write or moved by Compact, and the clusters which are freed to roll back the failed allocation.
+// The L2 table cache is written before the clusters are wiped, so the image file does not refer to them.
+func (q *QCow2) SetWipeFreed(wipe bool) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		return syscall.ENOTSUP
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.Opaque.WipeFreed = wipe
+	bdrvDrainedEnd(bs)
+
+	return nil
+}
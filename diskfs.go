@@ -0,0 +1,84 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskFile the method set which go-diskfs requires of the image file: the fs.File which is readable, writable
+// and seekable at any offset.
+type diskFile interface {
+	fs.File
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+}
+
+var _ diskFile = (*QCow2)(nil)
+
+// Stat returns the fs.FileInfo of the guest disk, and implements fs.File. The size is the virtual size of the
+// image, the mode is the regular file which is writable unless the image is read-only, and the modification
+// time is of the image file on the host, or zero if the image file is not the host file.
+//
+// So the QCow2 has the method set of the image file of go-diskfs, and the partition tables and the filesystems
+// can be created in the image from pure Go. The QCow2 itself is not the backend.Storage of go-diskfs, which is
+// not the dependency of this package, so only that method set is asserted here. The backend.Storage is the
+// QCow2 wrapped by the backend/file package of go-diskfs, which is closed with the image by the Close of the
+// disk:
+//
+//  img, err := qcow2.CreateImage("disk.qcow2", 1*qcow2.GiB)
+//  ...
+//  disk, err := diskfs.OpenBackend(file.New(img, img.ReadOnly()))
+//  ...
+//  err = disk.Partition(&gpt.Table{...})
+func (q *QCow2) Stat() (fs.FileInfo, error) {
+	bs := q.blk.bs()
+	if bs == nil {
+		return nil, ENOMEDIUM
+	}
+
+	size, err := q.VirtualSize()
+	if err != nil {
+		return nil, err
+	}
+
+	fi := &diskInfo{
+		name: filepath.Base(bs.Filename),
+		size: size,
+		mode: 0644,
+	}
+	if bs.ReadOnly {
+		fi.mode = 0444
+	}
+	if st, err := os.Stat(bs.Filename); err == nil {
+		fi.modTime = st.ModTime()
+	}
+
+	return fi, nil
+}
+
+// diskInfo the fs.FileInfo of the guest disk.
+type diskInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+var _ fs.FileInfo = (*diskInfo)(nil)
+
+func (fi *diskInfo) Name() string       { return fi.name }
+func (fi *diskInfo) Size() int64        { return fi.size }
+func (fi *diskInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *diskInfo) ModTime() time.Time { return fi.modTime }
+func (fi *diskInfo) IsDir() bool        { return false }
+func (fi *diskInfo) Sys() interface{}   { return nil }
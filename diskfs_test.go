@@ -0,0 +1,69 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDiskFile uses the image through diskFile, the same way as go-diskfs uses its image file.
+func TestDiskFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := CreateImage(filename, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f diskFile = img
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "disk.qcow2" || fi.Size() != 4<<20 || fi.Mode() != 0644 || fi.IsDir() {
+		t.Errorf("stat: name %q, size %d, mode %v", fi.Name(), fi.Size(), fi.Mode())
+	}
+	if end, err := f.Seek(0, io.SeekEnd); err != nil || end != 4<<20 {
+		t.Errorf("seek to the end: %d, %v", end, err)
+	}
+
+	// the protective MBR of the GPT, which go-diskfs writes at the first sector
+	mbr := make([]byte, 512)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(mbr))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, mbr) {
+		t.Error("the written sector is not read back")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	fi, err = img.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0444 {
+		t.Errorf("read-only image has mode %v, want %v", fi.Mode(), os.FileMode(0444))
+	}
+}
@@ -6,8 +6,193 @@
 
 package qcow2
 
-import "syscall"
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
 
 const (
 	ENOMEDIUM = syscall.ENODEV
 )
+
+// The errors returned by the image operations. The returned errors wrap them with the message, so use
+// errors.Is to test them. Each error also wraps the errno of the failure, same as the negative errno
+// returned by qemu, so errors.Is(err, syscall.ENOTSUP) reports true for ErrUnsupportedVersion.
+var (
+	// ErrNotQcow2 the image file is not the qcow2 image.
+	ErrNotQcow2 error = &Error{Errno: syscall.EINVAL, msg: "not a qcow2 image"}
+	// ErrUnsupportedVersion the version of the qcow2 image is not supported.
+	ErrUnsupportedVersion error = &Error{Errno: syscall.ENOTSUP, msg: "unsupported qcow2 version"}
+	// ErrUnsupportedFeature the image has the unknown incompatible feature bits.
+	ErrUnsupportedFeature error = &Error{Errno: syscall.ENOTSUP, msg: "unsupported qcow2 feature"}
+	// ErrInvalidHeader the header or the header extension of the image has the invalid value.
+	ErrInvalidHeader error = &Error{Errno: syscall.EINVAL, msg: "invalid qcow2 header"}
+	// ErrEncrypted the image is encrypted, which is not supported.
+	ErrEncrypted error = &Error{Errno: syscall.ENOTSUP, msg: "encrypted image is not supported"}
+	// ErrTooLarge the image size or the size of the metadata table exceeds the limit of the qcow2 format, or of
+	// this implementation.
+	ErrTooLarge error = &Error{Errno: syscall.EFBIG, msg: "image or metadata table is too large"}
+	// ErrReadOnly the image is opened as read-only.
+	ErrReadOnly error = &Error{Errno: syscall.EPERM, msg: "image is read-only"}
+	// ErrCorrupt the image is marked as corrupt, so it can not be opened or written as read-write.
+	ErrCorrupt error = &Error{Errno: syscall.EACCES, msg: "image is corrupt"}
+	// ErrDirty the image is marked as dirty, and its refcounts could not be repaired on the read-write open,
+	// or it is opened as read-only without OpenOpts.Repair.
+	ErrDirty error = &Error{Errno: syscall.EIO, msg: "image is dirty"}
+	// ErrLocked the image file is locked by the other process, or by the other open of the same process.
+	ErrLocked error = &Error{Errno: syscall.EAGAIN, msg: "image is locked"}
+	// ErrSnapshotNotFound no internal snapshot of the image has the id or the name.
+	ErrSnapshotNotFound error = &Error{Errno: syscall.ENOENT, msg: "snapshot not found"}
+	// ErrSnapshotAmbiguous no internal snapshot of the image has the id, and several snapshots have the name.
+	ErrSnapshotAmbiguous error = &Error{Errno: syscall.EINVAL, msg: "snapshot name is ambiguous"}
+	// ErrInvalidArgument the argument of the operation is invalid, such as the negative offset.
+	ErrInvalidArgument error = &Error{Errno: syscall.EINVAL, msg: "invalid argument"}
+	// ErrInvalidOption the option of the image creation or the open is invalid.
+	ErrInvalidOption error = &Error{Errno: syscall.EINVAL, msg: "invalid image option"}
+	// ErrUnsupported the operation is not supported by the format of the image, or for its current state.
+	ErrUnsupported error = &Error{Errno: syscall.ENOTSUP, msg: "operation is not supported"}
+	// ErrUnknownFormat the format of the image file could not be determined.
+	ErrUnknownFormat error = &Error{Errno: syscall.ENOENT, msg: "unknown image format"}
+	// ErrBackingLoop the backing file chain of the image refers to the image itself.
+	ErrBackingLoop error = &Error{Errno: syscall.ELOOP, msg: "backing file chain has a loop"}
+	// ErrBackingTooDeep the backing file chain of the image exceeds the maximum depth.
+	ErrBackingTooDeep error = &Error{Errno: syscall.EMLINK, msg: "backing file chain is too deep"}
+	// ErrNoBacking the image has no backing file.
+	ErrNoBacking error = &Error{Errno: syscall.EINVAL, msg: "image has no backing file"}
+	// ErrInUse the image is in use by the other image, so it can not be reopened.
+	ErrInUse error = &Error{Errno: syscall.EBUSY, msg: "image is in use"}
+	// ErrPublished the image or the name is already published to expvar.
+	ErrPublished error = &Error{Errno: syscall.EEXIST, msg: "already published"}
+	// ErrInvalidPartitionTable the partition table of the guest disk is invalid.
+	ErrInvalidPartitionTable error = &Error{Errno: syscall.EINVAL, msg: "invalid partition table"}
+)
+
+// Error is the type of the sentinel errors, which wraps the errno of the failure.
+type Error struct {
+	// Errno the errno of the failure.
+	Errno syscall.Errno
+	msg   string
+}
+
+// NewError returns the sentinel error of msg which wraps errno, such as the errors of the servers of the images.
+func NewError(errno syscall.Errno, msg string) *Error {
+	return &Error{Errno: errno, msg: msg}
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the errno of the error.
+func (e *Error) Unwrap() error {
+	return e.Errno
+}
+
+// CorruptionError represents the corruption of the image metadata, such as the unaligned table offset
+// and the reference to the image header. It wraps EIO, same as qemu.
+//  block/qcow2.c: void qcow2_signal_corruption(BlockDriverState *bs, bool fatal, int64_t offset, int64_t size, const char *message_format, ...)
+type CorruptionError struct {
+	// Offset the host offset which the corrupted metadata refers to, or -1 if it is unknown.
+	Offset int64
+	// Reason describes the corruption.
+	Reason string
+}
+
+// Error implements error.
+func (e *CorruptionError) Error() string {
+	return "qcow2: Image is corrupt: " + e.Reason
+}
+
+// Unwrap returns EIO.
+func (e *CorruptionError) Unwrap() error {
+	return syscall.EIO
+}
+
+// SnapshotQuotaError represents the snapshot which is not created, since the image would exceed its snapshot
+// quota. It wraps EDQUOT.
+type SnapshotQuotaError struct {
+	// Quota the snapshot quota of the image.
+	Quota SnapshotQuota
+	// Snapshots the number of the snapshots of the image.
+	Snapshots int
+	// TableSize the size of the snapshot table in bytes, with the new snapshot.
+	TableSize int64
+}
+
+// Error implements error.
+func (e *SnapshotQuotaError) Error() string {
+	if e.Quota.MaxSnapshots > 0 && e.Snapshots >= e.Quota.MaxSnapshots {
+		return fmt.Sprintf("qcow2: Snapshot quota exceeded: the image has %d snapshots, and at most %d snapshots are allowed",
+			e.Snapshots, e.Quota.MaxSnapshots)
+	}
+	return fmt.Sprintf("qcow2: Snapshot quota exceeded: the snapshot table would be %d bytes, and at most %d bytes are allowed",
+		e.TableSize, e.Quota.MaxTableSize)
+}
+
+// Unwrap returns EDQUOT.
+func (e *SnapshotQuotaError) Unwrap() error {
+	return syscall.EDQUOT
+}
+
+// OptsError represents the invalid options of the image creation, which is returned by Opts.Validate.
+// It wraps all of the problems of the options, so errors.Is reports true for each of them.
+type OptsError struct {
+	// Errs the problems of the options.
+	Errs []error
+}
+
+// Error implements error.
+func (e *OptsError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "Invalid image options: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the problems of the options.
+func (e *OptsError) Unwrap() []error {
+	return e.Errs
+}
+
+// signalCorruption returns the CorruptionError of the metadata at offset, with the stack trace.
+// If fatal is true and the image is writable, the image is marked as corrupt, and the following writes
+// to the image fail with ErrCorrupt. The first corruption of the image is reported to the Logger of the image.
+// The caller must hold s.lock for reading at least.
+//  block/qcow2.c: void qcow2_signal_corruption(BlockDriverState *bs, bool fatal, int64_t offset, int64_t size, const char *message_format, ...)
+func signalCorruption(bs *BlockDriverState, fatal bool, offset int64, format string, args ...interface{}) error {
+	s := bs.Opaque
+
+	reason := fmt.Sprintf(format, args...)
+	if bs.ReadOnly {
+		fatal = false
+	}
+
+	s.corruptLock.Lock()
+	// the messages after the first one are suppressed, same as qemu
+	if !s.SignaledCorruption || (fatal && !s.fenced) {
+		if fatal {
+			bdrvLogf(bs, LogError, "qcow2: Marking image as corrupt: %s; further corruption events will be suppressed", reason)
+		} else {
+			bdrvLogf(bs, LogWarn, "qcow2: Image is corrupt: %s; further non-fatal corruption events will be suppressed", reason)
+		}
+	}
+	if fatal && !s.fenced {
+		// the writes are fenced even if the header is not written
+		if err := markCorrupt(bs); err != nil {
+			bdrvLogf(bs, LogWarn, "qcow2: Could not mark image as corrupt: %v", err)
+		}
+		s.fenced = true
+	}
+	s.SignaledCorruption = true
+	s.corruptLock.Unlock()
+
+	return errors.WithStack(&CorruptionError{
+		Offset: offset,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ExpvarName the name of the expvar.Map of the published images, which is served as the "qcow2" object
+// of /debug/vars.
+const ExpvarName = "qcow2"
+
+var (
+	expvarOnce   sync.Once
+	expvarImages *expvar.Map
+	// expvarMu serializes the insertions and the deletions of expvarImages, since expvar.Map has no atomic
+	// insertion, and guards QCow2.expvarName.
+	expvarMu sync.Mutex
+)
+
+// CacheUsage represents the occupancy of the metadata table cache.
+type CacheUsage struct {
+	// Tables the number of the tables which the cache can hold.
+	Tables int `json:"tables"`
+	// Used the number of the cached tables.
+	Used int `json:"used"`
+	// Dirty the number of the cached tables which are not written to the image file yet.
+	Dirty int `json:"dirty"`
+	// InUse the number of the cached tables which are referred by the running requests.
+	InUse int `json:"in-use"`
+}
+
+// usage returns the occupancy of c.
+func (c *Cache) usage() CacheUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u := CacheUsage{Tables: c.Size}
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if e.Offset == 0 {
+			continue
+		}
+		u.Used++
+		if e.Dirty {
+			u.Dirty++
+		}
+		if e.Ref > 0 {
+			u.InUse++
+		}
+	}
+	return u
+}
+
+// ImageVars represents the runtime statistics of the image published by PublishExpvar.
+type ImageVars struct {
+	Filename string  `json:"filename"`
+	Stats    IOStats `json:"stats"`
+	// L2Cache and RefcountCache the occupancy of the metadata table caches, which are nil if the image has no
+	// such cache, such as the raw image.
+	L2Cache       *CacheUsage `json:"l2-cache,omitempty"`
+	RefcountCache *CacheUsage `json:"refcount-cache,omitempty"`
+}
+
+// Vars returns the runtime statistics of the image. The closed image returns the zero statistics.
+func (q *QCow2) Vars() ImageVars {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ImageVars{}
+	}
+
+	vars := ImageVars{Filename: bs.Filename}
+	bs.acct.mu.Lock()
+	vars.Stats = bs.acct.stats
+	bs.acct.mu.Unlock()
+
+	if s := bs.Opaque; s != nil {
+		if s.L2TableCache != nil {
+			u := s.L2TableCache.usage()
+			vars.L2Cache = &u
+		}
+		if s.RefcountBlockCache != nil {
+			u := s.RefcountBlockCache.usage()
+			vars.RefcountCache = &u
+		}
+	}
+
+	return vars
+}
+
+// PublishExpvar publishes the runtime statistics of the image as name of the "qcow2" object of expvar, so
+// that they are served at /debug/vars by the http.DefaultServeMux. The statistics are computed on each
+// request, and the image is removed from expvar when it is closed.
+// Publishing is opt-in: the "qcow2" object is not published until the first image is published.
+// PublishExpvar returns EEXIST if name is already used by another image.
+func (q *QCow2) PublishExpvar(name string) error {
+	expvarOnce.Do(func() {
+		expvarImages = expvar.NewMap(ExpvarName)
+	})
+
+	q.mu.RLock()
+	bs := q.blk.bs()
+	q.mu.RUnlock()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	// q.mu is not held while the image is inserted, since expvar holds the lock of the map while it calls
+	// Vars of the published images
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if q.expvarName != "" {
+		return errors.Wrapf(ErrPublished, "Image is already published as '%s'", q.expvarName)
+	}
+	if expvarImages.Get(name) != nil {
+		return errors.Wrapf(ErrPublished, "Name '%s' is already published", name)
+	}
+	expvarImages.Set(name, expvar.Func(func() interface{} {
+		return q.Vars()
+	}))
+	q.expvarName = name
+
+	return nil
+}
+
+// unpublishExpvar removes the image from expvar, if it is published. The caller must not hold q.mu.
+func (q *QCow2) unpublishExpvar() {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if q.expvarName == "" {
+		return
+	}
+	expvarImages.Delete(q.expvarName)
+	q.expvarName = ""
+}
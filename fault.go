@@ -0,0 +1,219 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"sync"
+	"syscall"
+)
+
+// FaultKind represents the failure which is injected by FaultBackend.
+type FaultKind int
+
+const (
+	// FaultNone no failure is injected, and the writes and the syncs are only counted.
+	FaultNone FaultKind = iota
+	// FaultWrite the Nth write fails with EIO without writing anything.
+	FaultWrite
+	// FaultShortWrite the Nth write writes only the sectors in the first half of the data, and fails with EIO.
+	// The write within a sector writes nothing, since the write of a sector is atomic on the disk.
+	FaultShortWrite
+	// FaultAfterSync the Nth sync succeeds, and the following writes fail with EIO.
+	FaultAfterSync
+	// FaultLostWrites the Nth write is written, but the previous writes since the last sync are lost, and fails
+	// with EIO. It simulates the host crash with the disk which writes back its volatile cache out of order, so
+	// the write which depends on the unsynced writes is found without them.
+	FaultLostWrites
+)
+
+// String returns the name of the fault kind.
+func (k FaultKind) String() string {
+	switch k {
+	case FaultNone:
+		return "none"
+	case FaultWrite:
+		return "write"
+	case FaultShortWrite:
+		return "short-write"
+	case FaultAfterSync:
+		return "after-sync"
+	case FaultLostWrites:
+		return "lost-writes"
+	}
+	return "unknown"
+}
+
+// FaultBackend is the Backend which injects the failure into the underlying Backend, to simulate the crash
+// of the process or the host at the failure point, same as the blkdebug driver of qemu.
+//
+// Once the failure is injected, the backend is crashed: all of the following writes, truncates and syncs fail
+// with EIO, so the underlying image file is left as it was at the failure point. The reads still succeed.
+// The backend is usually injected by Opts.WrapBackend or OpenOpts.WrapBackend.
+//  block/blkdebug.c: typedef struct BDRVBlkdebugState
+type FaultBackend struct {
+	Backend
+
+	kind FaultKind
+	n    int
+
+	mu      sync.Mutex
+	writes  int
+	syncs   int
+	crashed bool
+	// unsynced the previous contents of the ranges which are written since the last sync, which are restored by
+	// FaultLostWrites.
+	unsynced []faultUndo
+}
+
+// faultUndo the previous content of the written range.
+type faultUndo struct {
+	off  int64
+	data []byte
+}
+
+var _ Backend = (*FaultBackend)(nil)
+
+// NewFaultBackend returns the FaultBackend of b, which injects the failure of kind at the nth write, or the
+// nth sync for FaultAfterSync. n starts from 1.
+func NewFaultBackend(b Backend, kind FaultKind, n int) *FaultBackend {
+	return &FaultBackend{
+		Backend: b,
+		kind:    kind,
+		n:       n,
+	}
+}
+
+// WriteAt implements io.WriterAt.
+//  block/blkdebug.c: static int coroutine_fn blkdebug_co_pwritev(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func (f *FaultBackend) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return 0, syscall.EIO
+	}
+	f.writes++
+	if f.writes != f.n {
+		if f.kind == FaultLostWrites {
+			f.saveUnsynced(len(p), off)
+		}
+		return f.Backend.WriteAt(p, off)
+	}
+
+	switch f.kind {
+	case FaultWrite:
+		f.crashed = true
+		return 0, syscall.EIO
+	case FaultShortWrite:
+		f.crashed = true
+		// the write of a sector is atomic on the disk, so the write is torn at the sector boundary
+		n := int(startOfCluster(int64(BDRV_SECTOR_SIZE), off+int64(len(p)/2)) - off)
+		if n <= 0 {
+			return 0, syscall.EIO
+		}
+		n, err := f.Backend.WriteAt(p[:n], off)
+		if err == nil {
+			err = syscall.EIO
+		}
+		return n, err
+	case FaultLostWrites:
+		f.crashed = true
+		for i := len(f.unsynced) - 1; i >= 0; i-- {
+			u := f.unsynced[i]
+			if _, err := f.Backend.WriteAt(u.data, u.off); err != nil {
+				return 0, err
+			}
+		}
+		f.unsynced = nil
+		n, err := f.Backend.WriteAt(p, off)
+		if err == nil {
+			err = syscall.EIO
+		}
+		return n, err
+	}
+
+	return f.Backend.WriteAt(p, off)
+}
+
+// Truncate implements Backend, and fails with EIO after the failure is injected.
+func (f *FaultBackend) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return syscall.EIO
+	}
+	return f.Backend.Truncate(size)
+}
+
+// Sync implements Backend.
+//  block/blkdebug.c: static int blkdebug_co_flush(BlockDriverState *bs)
+func (f *FaultBackend) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return syscall.EIO
+	}
+	f.syncs++
+	if err := f.Backend.Sync(); err != nil {
+		return err
+	}
+	f.unsynced = nil
+	if f.kind == FaultAfterSync && f.syncs == f.n {
+		f.crashed = true
+	}
+
+	return nil
+}
+
+// saveUnsynced saves the previous content of the range of n bytes at off, which is about to be written.
+// The range beyond the end of the backend is saved as zeros. The caller must hold f.mu.
+func (f *FaultBackend) saveUnsynced(n int, off int64) {
+	data := make([]byte, n)
+	k, err := f.Backend.ReadAt(data, off)
+	if err != nil && err != io.EOF {
+		return
+	}
+	for i := k; i < n; i++ {
+		data[i] = 0
+	}
+	f.unsynced = append(f.unsynced, faultUndo{off: off, data: data})
+}
+
+// Close closes the underlying Backend if it implements io.Closer.
+func (f *FaultBackend) Close() error {
+	if c, ok := f.Backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Writes returns the number of the writes to the backend, including the failed write.
+func (f *FaultBackend) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writes
+}
+
+// Syncs returns the number of the syncs of the backend.
+func (f *FaultBackend) Syncs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.syncs
+}
+
+// Crashed reports whether the failure has been injected.
+func (f *FaultBackend) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.crashed
+}
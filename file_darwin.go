@@ -0,0 +1,107 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// F_PUNCHHOLE deallocates a range of the file.
+//  sys/fcntl.h: #define F_PUNCHHOLE 99
+const F_PUNCHHOLE = 99
+
+const (
+	// DKIOCGETBLOCKSIZE returns the logical block size of the disk device.
+	//  sys/disk.h: #define DKIOCGETBLOCKSIZE _IOR('d', 24, uint32_t)
+	DKIOCGETBLOCKSIZE = 0x40046418
+	// DKIOCGETBLOCKCOUNT returns the number of the logical blocks of the disk device.
+	//  sys/disk.h: #define DKIOCGETBLOCKCOUNT _IOR('d', 25, uint64_t)
+	DKIOCGETBLOCKCOUNT = 0x40086419
+	// DKIOCGETPHYSICALBLOCKSIZE returns the physical block size of the disk device.
+	//  sys/disk.h: #define DKIOCGETPHYSICALBLOCKSIZE _IOR('d', 77, uint32_t)
+	DKIOCGETPHYSICALBLOCKSIZE = 0x4004644d
+)
+
+// fpunchhole represents the argument of F_PUNCHHOLE.
+//  sys/fcntl.h: typedef struct fpunchhole
+type fpunchhole struct {
+	flags    uint32 // unsigned int fp_flags
+	reserved uint32 // unsigned int reserved
+	offset   int64  // off_t fp_offset
+	length   int64  // off_t fp_length
+}
+
+// punchHole deallocates the range of the file, without changing the file size.
+//  block/file-posix.c: static ssize_t handle_aiocb_discard(RawPosixAIOData *aiocb)
+func punchHole(f *os.File, offset, length int64) error {
+	arg := fpunchhole{
+		offset: offset,
+		length: length,
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), F_PUNCHHOLE, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyFileRange is not supported on this platform.
+func copyFileRange(src *os.File, srcOff int64, dst *os.File, dstOff, length int64) error {
+	return syscall.ENOTSUP
+}
+
+// setNoCow does nothing on this platform.
+func setNoCow(f *os.File) {}
+
+// openDirect opens the file for the direct I/O, which bypasses the page cache of the host.
+// macOS has no O_DIRECT, so the caching of the file is turned off by F_NOCACHE instead.
+//  block/file-posix.c: static int raw_open_common(BlockDriverState *bs, QDict *options, int bdrv_flags, int open_flags, Error **errp)
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+
+	return f, nil
+}
+
+// hdevGetlength returns the size of the host disk device in bytes.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func hdevGetlength(f *os.File) (int64, error) {
+	var (
+		sectors    uint64
+		sectorSize uint32
+	)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETBLOCKCOUNT, uintptr(unsafe.Pointer(&sectors))); errno != 0 {
+		return 0, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETBLOCKSIZE, uintptr(unsafe.Pointer(&sectorSize))); errno != 0 {
+		return 0, errno
+	}
+
+	return int64(sectors) * int64(sectorSize), nil
+}
+
+// hdevPhysicalBlockSize returns the physical block size of the host disk device, or BDRV_SECTOR_SIZE if
+// it is not known.
+//  block/file-posix.c: static int probe_physical_blocksize(int fd, unsigned int *blk_size)
+func hdevPhysicalBlockSize(f *os.File) int64 {
+	var size uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETPHYSICALBLOCKSIZE, uintptr(unsafe.Pointer(&size))); errno != 0 || size == 0 {
+		return int64(BDRV_SECTOR_SIZE)
+	}
+
+	return int64(size)
+}
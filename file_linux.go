@@ -0,0 +1,124 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// FALLOC_FL_KEEP_SIZE default is extend size.
+	FALLOC_FL_KEEP_SIZE = 0x01
+	// FALLOC_FL_PUNCH_HOLE de-allocates range.
+	FALLOC_FL_PUNCH_HOLE = 0x02
+
+	// BLKGETSIZE64 returns the size of the block device in bytes.
+	//  linux/fs.h: #define BLKGETSIZE64 _IOR(0x12,114,size_t)
+	BLKGETSIZE64 = 0x80001272 | unsafe.Sizeof(uintptr(0))<<16
+	// BLKPBSZGET returns the physical block size of the block device.
+	//  linux/fs.h: #define BLKPBSZGET _IO(0x12,123)
+	BLKPBSZGET = 0x127b
+	// FS_NOCOW_FL the file attribute which turns off the copy-on-write of the file on btrfs.
+	//  linux/fs.h: #define FS_NOCOW_FL 0x00800000
+	FS_NOCOW_FL = 0x00800000
+)
+
+// punchHole deallocates the range of the file, without changing the file size.
+//  block/file-posix.c: static ssize_t handle_aiocb_discard(RawPosixAIOData *aiocb)
+func punchHole(f *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return syscall.ENOTSUP
+	}
+	return err
+}
+
+// copyFileRange copies length bytes of src at srcOff to dst at dstOff in the kernel, without moving the data
+// through the user space. The range is cloned by FICLONERANGE first, which shares the extents of src on the
+// file systems such as btrfs and XFS but requires the range aligned to their block size, and is copied by
+// copy_file_range(2) otherwise. Returns ENOTSUP if neither is supported, such as the files are on the
+// different file systems, or the range is beyond the end of src.
+//  block/file-posix.c: static ssize_t handle_aiocb_copy_range(RawPosixAIOData *aiocb)
+func copyFileRange(src *os.File, srcOff int64, dst *os.File, dstOff, length int64) error {
+	if err := unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_offset:  uint64(srcOff),
+		Src_length:  uint64(length),
+		Dest_offset: uint64(dstOff),
+	}); err == nil {
+		return nil
+	}
+
+	for length > 0 {
+		n := length
+		if n > 1<<30 {
+			n = 1 << 30
+		}
+
+		m, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, int(n), 0)
+		switch err {
+		case nil:
+		case unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP, unix.EINVAL, unix.EBADF:
+			return syscall.ENOTSUP
+		default:
+			return err
+		}
+		if m == 0 {
+			return syscall.ENOTSUP
+		}
+		length -= int64(m)
+	}
+
+	return nil
+}
+
+// setNoCow sets the NOCOW file attribute of the empty file f, which turns off the copy-on-write of the file on btrfs.
+// The failure is ignored, since it is only the optimization, and the other file systems do not support it.
+//  block/file-posix.c: static int coroutine_fn raw_co_create(BlockdevCreateOptions *options, Error **errp)
+func setNoCow(f *os.File) {
+	var attr int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), unix.FS_IOC_GETFLAGS, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return
+	}
+	attr |= FS_NOCOW_FL
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), unix.FS_IOC_SETFLAGS, uintptr(unsafe.Pointer(&attr)))
+}
+
+// openDirect opens the file for the direct I/O, which bypasses the page cache of the host.
+//  block/file-posix.c: static void raw_parse_flags(int bdrv_flags, int *open_flags)
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+}
+
+// hdevGetlength returns the size of the host block device in bytes. The size is seeked to the end of the
+// device if BLKGETSIZE64 is not supported.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func hdevGetlength(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno == 0 {
+		return int64(size), nil
+	}
+
+	return f.Seek(0, io.SeekEnd)
+}
+
+// hdevPhysicalBlockSize returns the physical block size of the host block device, or BDRV_SECTOR_SIZE if
+// it is not known.
+//  block/file-posix.c: static int probe_physical_blocksize(int fd, unsigned int *blk_size)
+func hdevPhysicalBlockSize(f *os.File) int64 {
+	var size uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKPBSZGET, uintptr(unsafe.Pointer(&size))); errno != 0 || size == 0 {
+		return int64(BDRV_SECTOR_SIZE)
+	}
+
+	return int64(size)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package qcow2
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// punchHole is not supported on this platform.
+func punchHole(f *os.File, offset, length int64) error {
+	return syscall.ENOTSUP
+}
+
+// copyFileRange is not supported on this platform.
+func copyFileRange(src *os.File, srcOff int64, dst *os.File, dstOff, length int64) error {
+	return syscall.ENOTSUP
+}
+
+// setNoCow does nothing on this platform.
+func setNoCow(f *os.File) {}
+
+// fileLinks returns 1, since the hard links are not counted on this platform.
+func fileLinks(fi os.FileInfo) uint64 {
+	return 1
+}
+
+// chownLike does nothing, since the owner of the file is not changed on this platform.
+func chownLike(f *os.File, fi os.FileInfo) error {
+	return nil
+}
+
+// openDirect is not supported on this platform.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// allocatedFileSize returns the file size, since the allocated size is not known on this platform.
+func allocatedFileSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// setSparse does nothing on this platform.
+func setSparse(f *os.File) error {
+	return nil
+}
+
+// hdevGetlength returns the size of the host device in bytes, which is seeked to the end of the device.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func hdevGetlength(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
+
+// hdevPhysicalBlockSize returns BDRV_SECTOR_SIZE, since the physical block size is not known on this platform.
+func hdevPhysicalBlockSize(f *os.File) int64 {
+	return int64(BDRV_SECTOR_SIZE)
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// sparseFile creates the sparse file of size bytes, which has the data of n bytes at off.
+func sparseFile(t *testing.T, size, off int64, n int) *os.File {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := setSparse(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xa5}, n), off); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestPunchHole(t *testing.T) {
+	const off, n = 1 << 20, 64 << 10
+	f := sparseFile(t, 8<<20, off, n)
+
+	err := punchHole(f, off, n)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]byte, n)) {
+		t.Error("the punched range is not read as zeros")
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 8<<20 {
+		t.Errorf("the file size is changed by the punch: %v", err)
+	}
+}
+
+func TestAllocatedFileSize(t *testing.T) {
+	const size = 8 << 20
+	f := sparseFile(t, size, 1<<20, 64<<10)
+
+	n, err := allocatedFileSize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 0 || n > size {
+		t.Errorf("allocated size of the sparse file is %d, want at most %d", n, size)
+	}
+}
+
+// TestCreateDiscard creates the image, and discards its written data, which is read as zeros on every platform
+// whether the image file can punch the holes or not.
+func TestCreateDiscard(t *testing.T) {
+	img, err := CreateImage(filepath.Join(t.TempDir(), "discard.qcow2"), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	data := bytes.Repeat([]byte("discard!"), 128<<10/8)
+	if _, err := img.WriteAt(data, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Discard(1<<20, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("the discarded data is not read as zeros")
+	}
+}
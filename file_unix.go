@@ -0,0 +1,49 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedFileSize returns the actually allocated size of the file in bytes.
+//  block/file-posix.c: static int64_t raw_get_allocated_file_size(BlockDriverState *bs)
+func allocatedFileSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512, nil
+	}
+	return fi.Size(), nil
+}
+
+// fileLinks returns the number of the hard links of the file of fi.
+func fileLinks(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// chownLike changes the owner and the group of f to those of the file of fi.
+func chownLike(f *os.File, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return f.Chown(int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+// setSparse does nothing, since the files are sparse by default on this platform.
+func setSparse(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetCompressedFileSizeW = modkernel32.NewProc("GetCompressedFileSizeW")
+
+const (
+	// FSCTL_SET_SPARSE marks the file as the sparse file.
+	//  winioctl.h: #define FSCTL_SET_SPARSE CTL_CODE(FILE_DEVICE_FILE_SYSTEM, 49, METHOD_BUFFERED, FILE_SPECIAL_ACCESS)
+	FSCTL_SET_SPARSE = 0x000900c4
+	// FSCTL_SET_ZERO_DATA fills the range of the file with zeros, and deallocates it if the file is sparse.
+	//  winioctl.h: #define FSCTL_SET_ZERO_DATA CTL_CODE(FILE_DEVICE_FILE_SYSTEM, 50, METHOD_BUFFERED, FILE_WRITE_DATA)
+	FSCTL_SET_ZERO_DATA = 0x000980c8
+
+	// INVALID_FILE_SIZE the return value of GetCompressedFileSizeW on the failure.
+	INVALID_FILE_SIZE = 0xffffffff
+)
+
+// fileZeroDataInformation represents the argument of FSCTL_SET_ZERO_DATA.
+//  winioctl.h: typedef struct _FILE_ZERO_DATA_INFORMATION
+type fileZeroDataInformation struct {
+	fileOffset      int64 // LARGE_INTEGER FileOffset
+	beyondFinalZero int64 // LARGE_INTEGER BeyondFinalZero
+}
+
+// punchHole deallocates the range of the sparse file, without changing the file size.
+// The range of the non-sparse file is filled with zeros instead.
+//  block/file-win32.c: static BlockAIOCB *raw_aio_pdiscard(BlockDriverState *bs, int64_t offset, int count, BlockCompletionFunc *cb, void *opaque)
+func punchHole(f *os.File, offset, length int64) error {
+	arg := fileZeroDataInformation{
+		fileOffset:      offset,
+		beyondFinalZero: offset + length,
+	}
+
+	var n uint32
+	return syscall.DeviceIoControl(syscall.Handle(f.Fd()), FSCTL_SET_ZERO_DATA, (*byte)(unsafe.Pointer(&arg)), uint32(unsafe.Sizeof(arg)), nil, 0, &n, nil)
+}
+
+// copyFileRange is not supported on this platform.
+func copyFileRange(src *os.File, srcOff int64, dst *os.File, dstOff, length int64) error {
+	return syscall.ENOTSUP
+}
+
+// setNoCow does nothing on this platform.
+func setNoCow(f *os.File) {}
+
+// fileLinks returns 1, since the hard links are not counted on this platform.
+func fileLinks(fi os.FileInfo) uint64 {
+	return 1
+}
+
+// chownLike does nothing, since the owner of the file is not changed on this platform.
+func chownLike(f *os.File, fi os.FileInfo) error {
+	return nil
+}
+
+// openDirect is not supported on this platform.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// allocatedFileSize returns the actually allocated size of the file in bytes, which is smaller than the file
+// size if the file is sparse or compressed.
+//  block/file-win32.c: static int64_t raw_get_allocated_file_size(BlockDriverState *bs)
+func allocatedFileSize(f *os.File) (int64, error) {
+	name, err := syscall.UTF16PtrFromString(f.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	var high uint32
+	low, _, err := procGetCompressedFileSizeW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&high)))
+	if low == INVALID_FILE_SIZE {
+		// INVALID_FILE_SIZE is also the valid low-order size, which is told by the last error
+		if errno, ok := err.(syscall.Errno); ok && errno != 0 {
+			return 0, err
+		}
+	}
+
+	return int64(high)<<32 | int64(low), nil
+}
+
+// setSparse marks the file as the sparse file, so the clusters which are not written are not allocated, and
+// the discarded clusters are deallocated.
+func setSparse(f *os.File) error {
+	var n uint32
+	return syscall.DeviceIoControl(syscall.Handle(f.Fd()), FSCTL_SET_SPARSE, nil, 0, nil, 0, &n, nil)
+}
+
+// hdevGetlength returns the size of the host device in bytes, which is seeked to the end of the device.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func hdevGetlength(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
+
+// hdevPhysicalBlockSize returns BDRV_SECTOR_SIZE, since the physical block size is not known on this platform.
+func hdevPhysicalBlockSize(f *os.File) int64 {
+	return int64(BDRV_SECTOR_SIZE)
+}
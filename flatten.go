@@ -0,0 +1,70 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Flatten writes the guest visible contents of the image to the new qcow2 image dest, which has no backing file,
+// so the backing files of the image can be retired. Every cluster is resolved through the backing chain, and the
+// ranges which read as zeros are not allocated in dest. The image and its backing chain are not modified.
+//
+// The new image has the same cluster size, compatibility level, refcount width and lazy refcounts as the image
+// if it is qcow2. The internal snapshots of the image are not copied.
+//  qemu-img.c: static int img_convert(int argc, char **argv)
+func (q *QCow2) Flatten(dest string) error {
+	return q.FlattenContext(context.Background(), dest)
+}
+
+// FlattenContext is like Flatten, but stops writing when ctx is done, and returns the error of ctx.
+// The image which is partially written on the cancellation is removed.
+func (q *QCow2) FlattenContext(ctx context.Context, dest string) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	// dest must not be any image of the chain, which is truncated by the creation
+	if fi, err := os.Stat(dest); err == nil {
+		for layer := bs; layer != nil; layer = backingLayer(layer, 1) {
+			if f, ok := layer.File.(interface {
+				Stat() (os.FileInfo, error)
+			}); ok {
+				lfi, err := f.Stat()
+				if err == nil && os.SameFile(fi, lfi) {
+					err := errors.Wrapf(ErrInvalidArgument, "Destination '%s' is the image file of '%s' in the backing chain", dest, layer.Filename)
+					return err
+				}
+			}
+		}
+	}
+
+	opts := &Opts{
+		Filename: dest,
+		Fmt:      DriverQCow2,
+	}
+	if bs.Drv == bdrvQCow2 {
+		s := bs.Opaque
+		opts.ClusterSize = s.ClusterSize
+		opts.RefcountBits = 1 << uint(s.RefcountOrder)
+		opts.LazyRefcounts = s.CompatibleFeatures&uint64(COMPAT_LAZY_REFCOUNTS) != 0
+		if s.Version < Version3 {
+			opts.Compat = "0.10"
+		}
+	}
+
+	if err := ConvertContext(ctx, q, opts, nil); err != nil {
+		err = errors.Wrapf(err, "Could not flatten '%s' to '%s'", bs.Filename, dest)
+		return err
+	}
+
+	return nil
+}
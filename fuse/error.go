@@ -0,0 +1,20 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// The errors returned by Mount. The returned errors wrap them with the message, so use errors.Is to test them.
+// Each error also wraps the errno of the failure.
+var (
+	// ErrMountPermission the process can neither mount the filesystem by itself nor run fusermount.
+	ErrMountPermission error = qcow2.NewError(syscall.EPERM, "mounting is not permitted")
+	// ErrFusermount fusermount did not send back the FUSE device.
+	ErrFusermount error = qcow2.NewError(syscall.EIO, "invalid reply from fusermount")
+)
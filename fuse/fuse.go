@@ -0,0 +1,637 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fuse exports the guest disk of the qcow2 image as a single raw file over FUSE (Filesystem in
+// Userspace), same as the FUSE export of qemu-storage-daemon.
+//
+// The image is mounted on the regular file, which reads and writes the guest data of the image, so the
+// standard tools, such as partprobe, mount -o loop and the forensic scanners, can operate on the contents
+// of the image without converting it. The export talks the FUSE kernel protocol directly, and is only
+// supported on Linux. Mounting requires the CAP_SYS_ADMIN capability, otherwise the fusermount helper of
+// libfuse is used.
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// numWorkers the number of the goroutines which serve the requests concurrently.
+const numWorkers = 4
+
+// attrValid the time which the kernel caches the attributes of the exported file.
+const attrValid = time.Second
+
+// byteOrder the byte order of the FUSE kernel protocol, which is the native byte order of the host.
+var byteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Options options of the FUSE export. The zero value is the writable export, which is only accessible by
+// the user who mounts it.
+type Options struct {
+	// ReadOnly exports the image as read-only. The read-only image is always exported as read-only.
+	ReadOnly bool
+	// AllowOther allows the other users to access the exported file, which is limited to the user who
+	// mounts it by default. The permission bits of the file are still checked.
+	AllowOther bool
+}
+
+// Export represents the image exported over FUSE.
+//  block/export/fuse.c: typedef struct FuseExport
+type Export struct {
+	img        *qcow2.QCow2
+	mountpoint string
+	readOnly   bool
+	dev        *os.File
+	fusermount bool
+	maxWrite   int
+	minor      uint32
+	blksize    uint32
+	ctime      time.Time
+
+	// mu guards the attributes of the exported file which are changed by SETATTR.
+	mu   sync.Mutex
+	mode uint32
+	uid  uint32
+	gid  uint32
+
+	// removeNotifier unregisters the resize notifier of the export from the image.
+	removeNotifier func()
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Mount mounts the image on mountpoint, which must be the existing regular file, and returns the Export
+// which serves the requests of the mounted file by Serve.
+//  block/export/fuse.c: static int fuse_export_create(BlockExport *blk_exp, BlockExportOptions *blk_exp_args, Error **errp)
+func Mount(mountpoint string, img *qcow2.QCow2, opts *Options) (*Export, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	fi, err := os.Stat(mountpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fuse: Failed to stat '%s'", mountpoint)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.Errorf("fuse: '%s' is not a regular file", mountpoint)
+	}
+
+	e := &Export{
+		img:        img,
+		mountpoint: mountpoint,
+		readOnly:   opts.ReadOnly || img.ReadOnly(),
+		blksize:    512,
+		ctime:      time.Now(),
+		mode:       syscall.S_IFREG | 0400,
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+	}
+	if !e.readOnly {
+		e.mode |= 0200
+	}
+	if opts.AllowOther {
+		e.mode |= 0044
+	}
+	if info, err := img.Info(); err == nil && info.ClusterSize > 0 {
+		e.blksize = uint32(info.ClusterSize)
+	}
+
+	e.dev, e.fusermount, err = mount(mountpoint, e.readOnly, opts.AllowOther)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.init(); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	// the kernel drops the cached size of the file when the image is resized, such as by the NBD client
+	e.removeNotifier = img.AddResizeNotifier(func(int64) {
+		go e.notifyInvalInode()
+	})
+
+	return e, nil
+}
+
+// Serve serves the requests of the mounted file until it is unmounted by Close or umount(8).
+// It returns nil after the file is unmounted.
+func (e *Export) Serve() error {
+	errc := make(chan error, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			errc <- e.serve()
+		}()
+	}
+
+	var err error
+	for i := 0; i < numWorkers; i++ {
+		if werr := <-errc; werr != nil && err == nil {
+			err = werr
+		}
+	}
+	e.dev.Close()
+
+	return err
+}
+
+// Close unmounts the file, and Serve returns.
+//  block/export/fuse.c: static void fuse_export_shutdown(BlockExport *blk_exp)
+func (e *Export) Close() error {
+	e.closeOnce.Do(func() {
+		if e.removeNotifier != nil {
+			e.removeNotifier()
+		}
+		e.closeErr = unmount(e.mountpoint, e.fusermount)
+	})
+	return e.closeErr
+}
+
+// init handles the FUSE_INIT request, which is the first request of the mount.
+//  block/export/fuse.c: static void fuse_init(void *userdata, struct fuse_conn_info *conn)
+func (e *Export) init() error {
+	buf := make([]byte, FUSE_MIN_READ_BUFFER)
+	n, err := e.dev.Read(buf)
+	if err != nil {
+		return errors.Wrap(err, "fuse: Failed to read the INIT request")
+	}
+
+	var hdr inHeader
+	var in initIn
+	r := bytes.NewReader(buf[:n])
+	if err := binary.Read(r, byteOrder, &hdr); err != nil {
+		return errors.Wrap(err, "fuse: Invalid INIT request")
+	}
+	if hdr.Opcode != FUSE_INIT {
+		return errors.Errorf("fuse: Unexpected opcode %d instead of INIT", hdr.Opcode)
+	}
+	if err := binary.Read(r, byteOrder, &in); err != nil {
+		return errors.Wrap(err, "fuse: Invalid INIT request")
+	}
+	if in.Major != FUSE_KERNEL_VERSION {
+		e.reply(&hdr, syscall.EPROTO)
+		return errors.Errorf("fuse: Unsupported kernel protocol version %d.%d", in.Major, in.Minor)
+	}
+
+	e.minor = in.Minor
+	if e.minor > FUSE_KERNEL_MINOR_VERSION {
+		e.minor = FUSE_KERNEL_MINOR_VERSION
+	}
+
+	out := initOut{
+		Major:        FUSE_KERNEL_VERSION,
+		Minor:        FUSE_KERNEL_MINOR_VERSION,
+		MaxReadahead: in.MaxReadahead,
+		Flags:        in.Flags & (FUSE_ASYNC_READ | FUSE_BIG_WRITES),
+		MaxWrite:     128 << 10,
+	}
+	if in.Minor >= 28 && in.Flags&FUSE_MAX_PAGES != 0 {
+		out.Flags |= FUSE_MAX_PAGES
+		out.MaxWrite = 1 << 20
+		out.MaxPages = uint16(out.MaxWrite / uint32(os.Getpagesize()))
+	}
+	e.maxWrite = int(out.MaxWrite)
+
+	return e.reply(&hdr, 0, &out)
+}
+
+// serve reads the requests, and handles them until the file is unmounted.
+func (e *Export) serve() error {
+	// the buffer must hold the largest write request and its headers
+	buf := make([]byte, e.maxWrite+os.Getpagesize())
+	for {
+		n, err := e.dev.Read(buf)
+		if err != nil {
+			switch {
+			case errors.Is(err, syscall.ENODEV), errors.Is(err, os.ErrClosed):
+				// unmounted
+				return nil
+			case errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.ENOENT):
+				// the request is interrupted before it is read
+				continue
+			}
+			return errors.Wrap(err, "fuse: Failed to read the request")
+		}
+
+		if err := e.handle(buf[:n]); err != nil {
+			if errors.Is(err, syscall.ENODEV) || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			// the request which is interrupted or aborted by the kernel can not be replied
+			if !errors.Is(err, syscall.ENOENT) {
+				return err
+			}
+		}
+	}
+}
+
+// handle handles the request, and writes the reply.
+//  block/export/fuse.c: static const struct fuse_lowlevel_ops fuse_ops
+func (e *Export) handle(req []byte) error {
+	var hdr inHeader
+	r := bytes.NewReader(req)
+	if err := binary.Read(r, byteOrder, &hdr); err != nil {
+		return errors.Wrap(err, "fuse: Invalid request header")
+	}
+	body := req[binary.Size(hdr):]
+
+	switch hdr.Opcode {
+	case FUSE_FORGET, FUSE_BATCH_FORGET, FUSE_INTERRUPT:
+		// no reply
+		return nil
+
+	case FUSE_LOOKUP:
+		// the root is the exported file, which has no entry
+		return e.reply(&hdr, syscall.ENOENT)
+
+	case FUSE_GETATTR:
+		return e.replyAttr(&hdr)
+
+	case FUSE_SETATTR:
+		var in setattrIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		if errno := e.setattr(&in); errno != 0 {
+			return e.reply(&hdr, errno)
+		}
+		return e.replyAttr(&hdr)
+
+	case FUSE_OPEN:
+		var in openIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		if e.readOnly && in.Flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+			return e.reply(&hdr, syscall.EROFS)
+		}
+		return e.reply(&hdr, 0, &openOut{})
+
+	case FUSE_READ:
+		var in readIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		data, errno := e.read(int64(in.Offset), int(in.Size))
+		if errno != 0 {
+			return e.reply(&hdr, errno)
+		}
+		return e.replyData(&hdr, data)
+
+	case FUSE_WRITE:
+		var in writeIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		data := body[binary.Size(in):]
+		if uint32(len(data)) < in.Size {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		n, errno := e.write(int64(in.Offset), data[:in.Size])
+		if errno != 0 {
+			return e.reply(&hdr, errno)
+		}
+		return e.reply(&hdr, 0, &writeOut{Size: uint32(n)})
+
+	case FUSE_FALLOCATE:
+		var in fallocateIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		return e.reply(&hdr, e.fallocate(int64(in.Offset), int64(in.Length), in.Mode))
+
+	case FUSE_LSEEK:
+		var in lseekIn
+		if err := binary.Read(r, byteOrder, &in); err != nil {
+			return e.reply(&hdr, syscall.EINVAL)
+		}
+		offset, errno := e.lseek(int64(in.Offset), in.Whence)
+		if errno != 0 {
+			return e.reply(&hdr, errno)
+		}
+		return e.reply(&hdr, 0, &lseekOut{Offset: uint64(offset)})
+
+	case FUSE_FSYNC, FUSE_FLUSH:
+		if err := e.img.Flush(); err != nil {
+			return e.reply(&hdr, errno(err))
+		}
+		return e.reply(&hdr, 0)
+
+	case FUSE_STATFS:
+		return e.reply(&hdr, 0, &statfsOut{
+			Bsize:   e.blksize,
+			Frsize:  e.blksize,
+			Namelen: 255,
+		})
+
+	case FUSE_RELEASE, FUSE_DESTROY:
+		return e.reply(&hdr, 0)
+
+	default:
+		return e.reply(&hdr, syscall.ENOSYS)
+	}
+}
+
+// attr returns the attributes of the exported file.
+//  block/export/fuse.c: static void fuse_getattr(fuse_req_t req, fuse_ino_t inode, struct fuse_file_info *fi)
+func (e *Export) attr() (*attrOut, syscall.Errno) {
+	size, err := e.img.VirtualSize()
+	if err != nil {
+		return nil, errno(err)
+	}
+	var blocks uint64
+	if info, err := e.img.Info(); err == nil && info.ActualSize > 0 {
+		blocks = uint64(info.ActualSize+511) / 512
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sec, nsec := uint64(e.ctime.Unix()), uint32(e.ctime.Nanosecond())
+	return &attrOut{
+		AttrValid:     uint64(attrValid / time.Second),
+		AttrValidNsec: uint32(attrValid % time.Second),
+		Attr: attr{
+			Ino:       FUSE_ROOT_ID,
+			Size:      uint64(size),
+			Blocks:    blocks,
+			Atime:     sec,
+			Mtime:     sec,
+			Ctime:     sec,
+			Atimensec: nsec,
+			Mtimensec: nsec,
+			Ctimensec: nsec,
+			Mode:      e.mode,
+			Nlink:     1,
+			UID:       e.uid,
+			GID:       e.gid,
+			Blksize:   e.blksize,
+		},
+	}, 0
+}
+
+// replyAttr writes the reply of the attributes of the exported file.
+func (e *Export) replyAttr(hdr *inHeader) error {
+	out, errno := e.attr()
+	if errno != 0 {
+		return e.reply(hdr, errno)
+	}
+	return e.reply(hdr, 0, out)
+}
+
+// setattr changes the attributes of the exported file. The size is changed by resizing the image, which
+// can not be shrunk.
+//  block/export/fuse.c: static void fuse_setattr(fuse_req_t req, fuse_ino_t inode, struct stat *statbuf, int to_set, struct fuse_file_info *fi)
+func (e *Export) setattr(in *setattrIn) syscall.Errno {
+	valid := in.Valid &^ (FATTR_FH | FATTR_LOCKOWNER)
+	if valid&^(FATTR_MODE|FATTR_UID|FATTR_GID|FATTR_SIZE) != 0 {
+		return syscall.ENOTSUP
+	}
+
+	if valid&FATTR_MODE != 0 && e.readOnly && in.Mode&0222 != 0 {
+		return syscall.EROFS
+	}
+	if valid&FATTR_SIZE != 0 {
+		if e.readOnly {
+			return syscall.EROFS
+		}
+		size, err := e.img.VirtualSize()
+		if err != nil {
+			return errno(err)
+		}
+		if int64(in.Size) != size {
+			if err := e.img.Resize(int64(in.Size)); err != nil {
+				return errno(err)
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if valid&FATTR_MODE != 0 {
+		e.mode = e.mode&syscall.S_IFMT | in.Mode&^syscall.S_IFMT
+	}
+	if valid&FATTR_UID != 0 {
+		e.uid = in.UID
+	}
+	if valid&FATTR_GID != 0 {
+		e.gid = in.GID
+	}
+
+	return 0
+}
+
+// read reads size bytes of the guest data at offset. The read beyond the end of the image is short.
+//  block/export/fuse.c: static void fuse_read(fuse_req_t req, fuse_ino_t inode, size_t size, off_t offset, struct fuse_file_info *fi)
+func (e *Export) read(offset int64, size int) ([]byte, syscall.Errno) {
+	length, err := e.img.VirtualSize()
+	if err != nil {
+		return nil, errno(err)
+	}
+	if offset >= length {
+		return nil, 0
+	}
+	if int64(size) > length-offset {
+		size = int(length - offset)
+	}
+
+	buf := make([]byte, size)
+	n, err := e.img.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, errno(err)
+	}
+
+	return buf[:n], 0
+}
+
+// write writes data to the guest data at offset, and returns the number of bytes written. The image does
+// not grow by the write, so the write beyond the end of the image is short.
+//  block/export/fuse.c: static void fuse_write(fuse_req_t req, fuse_ino_t inode, const char *buf, size_t size, off_t offset, struct fuse_file_info *fi)
+func (e *Export) write(offset int64, data []byte) (int, syscall.Errno) {
+	if e.readOnly {
+		return 0, syscall.EROFS
+	}
+
+	length, err := e.img.VirtualSize()
+	if err != nil {
+		return 0, errno(err)
+	}
+	if len(data) > 0 && offset >= length {
+		return 0, syscall.ENOSPC
+	}
+	if int64(len(data)) > length-offset {
+		data = data[:length-offset]
+	}
+
+	n, err := e.img.WriteAt(data, offset)
+	if err != nil {
+		return n, errno(err)
+	}
+
+	return n, 0
+}
+
+// fallocate punches the hole of, or writes zeros to the range of the guest data. The range beyond the end
+// of the image is ignored, since the image does not grow. The allocation of the range is not supported.
+//  block/export/fuse.c: static void fuse_fallocate(fuse_req_t req, fuse_ino_t inode, int mode, off_t offset, off_t length, struct fuse_file_info *fi)
+func (e *Export) fallocate(offset, length int64, mode uint32) syscall.Errno {
+	if e.readOnly {
+		return syscall.EROFS
+	}
+
+	var flags qcow2.BdrvRequestFlags
+	switch mode &^ FALLOC_FL_KEEP_SIZE {
+	case FALLOC_FL_PUNCH_HOLE:
+		if mode&FALLOC_FL_KEEP_SIZE == 0 {
+			return syscall.EINVAL
+		}
+		// the punched hole must read as zeros, which the advisory discard does not guarantee
+		flags = qcow2.BDRV_REQ_MAY_UNMAP
+	case FALLOC_FL_ZERO_RANGE:
+		// nothing to do
+	default:
+		return syscall.ENOTSUP
+	}
+
+	size, err := e.img.VirtualSize()
+	if err != nil {
+		return errno(err)
+	}
+	if offset >= size {
+		return 0
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+
+	if err := e.img.WriteZeroesFlags(offset, length, flags); err != nil {
+		return errno(err)
+	}
+
+	return 0
+}
+
+// lseek returns the offset of the next data or hole at or after offset, for SEEK_DATA and SEEK_HOLE.
+// The range which reads as zeros is the hole, and the end of the image is the implicit hole.
+//  block/export/fuse.c: static void fuse_lseek(fuse_req_t req, fuse_ino_t inode, off_t offset, int whence, struct fuse_file_info *fi)
+func (e *Export) lseek(offset int64, whence uint32) (int64, syscall.Errno) {
+	if whence != SEEK_DATA && whence != SEEK_HOLE {
+		return 0, syscall.EINVAL
+	}
+	if offset < 0 {
+		return 0, syscall.ENXIO
+	}
+
+	size, err := e.img.VirtualSize()
+	if err != nil {
+		return 0, errno(err)
+	}
+	if offset >= size {
+		return 0, syscall.ENXIO
+	}
+
+	extents, err := e.img.MapRange(offset, size-offset)
+	if err != nil {
+		return 0, errno(err)
+	}
+	for _, ext := range extents {
+		data := ext.Data && !ext.Zero
+		if data == (whence == SEEK_DATA) {
+			if ext.Start < offset {
+				return offset, 0
+			}
+			return ext.Start, 0
+		}
+	}
+
+	if whence == SEEK_DATA {
+		return 0, syscall.ENXIO
+	}
+	return size, 0
+}
+
+// notifyInvalInode notifies the kernel to drop the cached attributes and data of the exported file.
+// The notification is not supported before the protocol 7.12.
+func (e *Export) notifyInvalInode() {
+	if e.minor < 12 {
+		return
+	}
+
+	out := notifyInvalInodeOut{Ino: FUSE_ROOT_ID}
+	var buf bytes.Buffer
+	binary.Write(&buf, byteOrder, &outHeader{
+		Len:   uint32(binary.Size(outHeader{}) + binary.Size(out)),
+		Error: FUSE_NOTIFY_INVAL_INODE,
+	})
+	binary.Write(&buf, byteOrder, &out)
+
+	// the notification fails after the file is unmounted
+	e.dev.Write(buf.Bytes())
+}
+
+// reply writes the reply of the request, which is the error if errno is not zero, otherwise the result out.
+func (e *Export) reply(hdr *inHeader, errno syscall.Errno, out ...interface{}) error {
+	var body bytes.Buffer
+	if errno == 0 {
+		for _, v := range out {
+			binary.Write(&body, byteOrder, v)
+		}
+	}
+
+	return e.send(hdr, errno, body.Bytes())
+}
+
+// replyData writes the reply of the request whose result is data.
+func (e *Export) replyData(hdr *inHeader, data []byte) error {
+	return e.send(hdr, 0, data)
+}
+
+// send writes the reply header and body of the request to the FUSE device.
+func (e *Export) send(hdr *inHeader, errno syscall.Errno, body []byte) error {
+	out := outHeader{
+		Len:    uint32(binary.Size(outHeader{}) + len(body)),
+		Error:  -int32(errno),
+		Unique: hdr.Unique,
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, int(out.Len)))
+	binary.Write(buf, byteOrder, &out)
+	buf.Write(body)
+
+	if _, err := e.dev.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "fuse: Failed to write the reply")
+	}
+	return nil
+}
+
+// errno returns the errno of err, or EIO if err has no errno.
+func errno(err error) syscall.Errno {
+	var en syscall.Errno
+	switch {
+	case errors.Is(err, qcow2.ErrReadOnly):
+		return syscall.EROFS
+	case errors.Is(err, io.ErrShortWrite):
+		return syscall.ENOSPC
+	case errors.As(err, &en):
+		return en
+	default:
+		return syscall.EIO
+	}
+}
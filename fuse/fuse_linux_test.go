@@ -0,0 +1,348 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zchee/go-qcow2"
+)
+
+const testSize = 1 << 20
+
+// testExport the export whose FUSE device is the socket pair, which keeps the boundaries of the requests and
+// the replies same as /dev/fuse. The requests are fed to the export, and the replies are read from the kernel end.
+type testExport struct {
+	*Export
+	kernel *os.File
+	unique uint64
+}
+
+func newTestExport(t *testing.T, readOnly bool) *testExport {
+	t.Helper()
+
+	img, err := qcow2.CreateImage(filepath.Join(t.TempDir(), "fuse.qcow2"), testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, kernel := os.NewFile(uintptr(fds[0]), "dev"), os.NewFile(uintptr(fds[1]), "kernel")
+	t.Cleanup(func() {
+		dev.Close()
+		kernel.Close()
+	})
+
+	e := &Export{
+		img:      img,
+		readOnly: readOnly,
+		dev:      dev,
+		maxWrite: 128 << 10,
+		blksize:  512,
+		ctime:    time.Now(),
+		mode:     syscall.S_IFREG | 0600,
+	}
+	return &testExport{Export: e, kernel: kernel}
+}
+
+// request returns the request of op with the arguments, which are encoded after the header.
+func (te *testExport) request(op uint32, args ...interface{}) []byte {
+	var body bytes.Buffer
+	for _, v := range args {
+		if b, ok := v.([]byte); ok {
+			body.Write(b)
+			continue
+		}
+		binary.Write(&body, byteOrder, v)
+	}
+
+	te.unique++
+	var buf bytes.Buffer
+	binary.Write(&buf, byteOrder, &inHeader{
+		Len:    uint32(binary.Size(inHeader{}) + body.Len()),
+		Opcode: op,
+		Unique: te.unique,
+		Nodeid: FUSE_ROOT_ID,
+	})
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// handle feeds the request of op to the export, and returns the errno and the body of its reply.
+func (te *testExport) handle(t *testing.T, op uint32, args ...interface{}) (syscall.Errno, []byte) {
+	t.Helper()
+
+	if err := te.Export.handle(te.request(op, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return te.reply(t)
+}
+
+// reply reads the reply of the last request.
+func (te *testExport) reply(t *testing.T) (syscall.Errno, []byte) {
+	t.Helper()
+
+	te.kernel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2<<20)
+	n, err := te.kernel.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out outHeader
+	if err := binary.Read(bytes.NewReader(buf[:n]), byteOrder, &out); err != nil {
+		t.Fatal(err)
+	}
+	if int(out.Len) != n {
+		t.Fatalf("reply length is %d, want %d", out.Len, n)
+	}
+	if out.Unique != te.unique {
+		t.Fatalf("reply of the request %d, want %d", out.Unique, te.unique)
+	}
+	return syscall.Errno(-out.Error), buf[binary.Size(out):n]
+}
+
+// noReply checks the export did not reply.
+func (te *testExport) noReply(t *testing.T) {
+	t.Helper()
+
+	te.kernel.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := te.kernel.Read(make([]byte, 4096)); err == nil {
+		t.Fatalf("unexpected reply of %d bytes", n)
+	}
+}
+
+func decode(t *testing.T, body []byte, v interface{}) {
+	t.Helper()
+
+	if err := binary.Read(bytes.NewReader(body), byteOrder, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        initIn
+		wantErr   bool
+		wantErrno syscall.Errno
+		minor     uint32
+		maxWrite  int
+		flags     uint32
+	}{
+		{
+			name:     "7.31 max pages",
+			in:       initIn{Major: 7, Minor: 31, MaxReadahead: 128 << 10, Flags: FUSE_ASYNC_READ | FUSE_BIG_WRITES | FUSE_MAX_PAGES},
+			minor:    31,
+			maxWrite: 1 << 20,
+			flags:    FUSE_ASYNC_READ | FUSE_BIG_WRITES | FUSE_MAX_PAGES,
+		},
+		{
+			name:     "newer minor",
+			in:       initIn{Major: 7, Minor: FUSE_KERNEL_MINOR_VERSION + 5, Flags: FUSE_BIG_WRITES},
+			minor:    FUSE_KERNEL_MINOR_VERSION,
+			maxWrite: 128 << 10,
+			flags:    FUSE_BIG_WRITES,
+		},
+		{
+			name:     "max pages before 7.28",
+			in:       initIn{Major: 7, Minor: 26, Flags: FUSE_MAX_PAGES},
+			minor:    26,
+			maxWrite: 128 << 10,
+		},
+		{
+			name:      "unsupported major",
+			in:        initIn{Major: 8, Minor: 0},
+			wantErr:   true,
+			wantErrno: syscall.EPROTO,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			te := newTestExport(t, false)
+			if _, err := te.kernel.Write(te.request(FUSE_INIT, &tt.in)); err != nil {
+				t.Fatal(err)
+			}
+
+			err := te.init()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			errno, body := te.reply(t)
+			if errno != tt.wantErrno {
+				t.Fatalf("errno = %v, want %v", errno, tt.wantErrno)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var out initOut
+			decode(t, body, &out)
+			if out.Major != FUSE_KERNEL_VERSION || out.Minor != FUSE_KERNEL_MINOR_VERSION {
+				t.Errorf("version = %d.%d, want %d.%d", out.Major, out.Minor, FUSE_KERNEL_VERSION, FUSE_KERNEL_MINOR_VERSION)
+			}
+			if out.Flags != tt.flags {
+				t.Errorf("flags = %#x, want %#x", out.Flags, tt.flags)
+			}
+			if int(out.MaxWrite) != tt.maxWrite || te.maxWrite != tt.maxWrite {
+				t.Errorf("max write = %d, export %d, want %d", out.MaxWrite, te.maxWrite, tt.maxWrite)
+			}
+			if te.minor != tt.minor {
+				t.Errorf("negotiated minor = %d, want %d", te.minor, tt.minor)
+			}
+		})
+	}
+}
+
+// TestInitMalformed feeds the malformed INIT requests, which fail the mount without the reply.
+func TestInitMalformed(t *testing.T) {
+	te := newTestExport(t, false)
+	tests := []struct {
+		name string
+		req  []byte
+	}{
+		{name: "short header", req: te.request(FUSE_INIT)[:10]},
+		{name: "not INIT", req: te.request(FUSE_GETATTR, &initIn{Major: 7, Minor: 31})},
+		{name: "short INIT", req: te.request(FUSE_INIT, []byte{7, 0, 0, 0})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := te.kernel.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			if err := te.init(); err == nil {
+				t.Fatal("init() succeeded")
+			}
+			te.noReply(t)
+		})
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	te := newTestExport(t, false)
+
+	if err := te.Export.handle(te.request(FUSE_GETATTR)[:20]); err == nil {
+		t.Error("the short header is handled")
+	}
+	te.noReply(t)
+
+	tests := []struct {
+		name string
+		op   uint32
+		args []interface{}
+		want syscall.Errno
+	}{
+		{name: "short READ", op: FUSE_READ, args: []interface{}{make([]byte, 8)}, want: syscall.EINVAL},
+		{name: "short WRITE", op: FUSE_WRITE, args: []interface{}{make([]byte, 8)}, want: syscall.EINVAL},
+		{name: "WRITE data shorter than size", op: FUSE_WRITE, args: []interface{}{&writeIn{Size: 512}, make([]byte, 100)}, want: syscall.EINVAL},
+		{name: "short SETATTR", op: FUSE_SETATTR, args: []interface{}{make([]byte, 8)}, want: syscall.EINVAL},
+		{name: "unknown opcode", op: 9999, want: syscall.ENOSYS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errno, _ := te.handle(t, tt.op, tt.args...); errno != tt.want {
+				t.Errorf("errno = %v, want %v", errno, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadWriteEOF(t *testing.T) {
+	te := newTestExport(t, false)
+
+	data := bytes.Repeat([]byte("fuse"), 4)
+	errno, body := te.handle(t, FUSE_WRITE, &writeIn{Offset: testSize - 8, Size: uint32(len(data))}, data)
+	if errno != 0 {
+		t.Fatalf("write across the end: %v", errno)
+	}
+	var out writeOut
+	decode(t, body, &out)
+	if out.Size != 8 {
+		t.Errorf("written %d bytes across the end, want 8", out.Size)
+	}
+
+	if errno, _ := te.handle(t, FUSE_WRITE, &writeIn{Offset: testSize, Size: uint32(len(data))}, data); errno != syscall.ENOSPC {
+		t.Errorf("write at the end: errno = %v, want ENOSPC", errno)
+	}
+
+	errno, body = te.handle(t, FUSE_READ, &readIn{Offset: testSize - 8, Size: 4096})
+	if errno != 0 {
+		t.Fatalf("read across the end: %v", errno)
+	}
+	if !bytes.Equal(body, data[:8]) {
+		t.Errorf("read across the end %q, want %q", body, data[:8])
+	}
+
+	errno, body = te.handle(t, FUSE_READ, &readIn{Offset: testSize + 4096, Size: 4096})
+	if errno != 0 || len(body) != 0 {
+		t.Errorf("read beyond the end: errno = %v, %d bytes, want empty", errno, len(body))
+	}
+}
+
+func TestSetattrSize(t *testing.T) {
+	te := newTestExport(t, false)
+
+	errno, body := te.handle(t, FUSE_SETATTR, &setattrIn{Valid: FATTR_SIZE, Size: 2 * testSize})
+	if errno != 0 {
+		t.Fatalf("grow: %v", errno)
+	}
+	var out attrOut
+	decode(t, body, &out)
+	if out.Attr.Size != 2*testSize {
+		t.Errorf("size attribute = %d, want %d", out.Attr.Size, 2*testSize)
+	}
+	if size, err := te.img.VirtualSize(); err != nil || size != 2*testSize {
+		t.Errorf("image size = %d, %v, want %d", size, err, 2*testSize)
+	}
+
+	if errno, _ := te.handle(t, FUSE_SETATTR, &setattrIn{Valid: FATTR_SIZE, Size: testSize}); errno == 0 {
+		t.Error("the image is shrunk")
+	}
+	// FATTR_ATIME
+	if errno, _ := te.handle(t, FUSE_SETATTR, &setattrIn{Valid: 1 << 4}); errno != syscall.ENOTSUP {
+		t.Errorf("setattr of atime: errno = %v, want ENOTSUP", errno)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	te := newTestExport(t, true)
+
+	tests := []struct {
+		name string
+		op   uint32
+		args []interface{}
+	}{
+		{name: "OPEN", op: FUSE_OPEN, args: []interface{}{&openIn{Flags: syscall.O_RDWR}}},
+		{name: "WRITE", op: FUSE_WRITE, args: []interface{}{&writeIn{Size: 4}, []byte("fuse")}},
+		{name: "SETATTR size", op: FUSE_SETATTR, args: []interface{}{&setattrIn{Valid: FATTR_SIZE, Size: 2 * testSize}}},
+		{name: "SETATTR mode", op: FUSE_SETATTR, args: []interface{}{&setattrIn{Valid: FATTR_MODE, Mode: 0644}}},
+		{name: "FALLOCATE", op: FUSE_FALLOCATE, args: []interface{}{&fallocateIn{Length: 4096, Mode: FALLOC_FL_ZERO_RANGE}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errno, _ := te.handle(t, tt.op, tt.args...); errno != syscall.EROFS {
+				t.Errorf("errno = %v, want EROFS", errno)
+			}
+		})
+	}
+
+	if errno, _ := te.handle(t, FUSE_OPEN, &openIn{Flags: syscall.O_RDONLY}); errno != 0 {
+		t.Errorf("read-only open: %v", errno)
+	}
+	buf := make([]byte, 4)
+	if _, err := te.img.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, make([]byte, 4)) {
+		t.Errorf("the read-only export is written: %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mount mounts the FUSE filesystem on mountpoint, and returns the FUSE device which serves it. It mounts by
+// mount(2) if the process has the CAP_SYS_ADMIN capability, otherwise by the fusermount helper, and reports
+// which is used, since the mount by fusermount must also be unmounted by it.
+//  block/export/fuse.c: static int setup_fuse_export(FuseExport *exp, const char *mountpoint, bool allow_other, Error **errp)
+func mount(mountpoint string, readOnly, allowOther bool) (*os.File, bool, error) {
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "fuse: Failed to open /dev/fuse")
+	}
+
+	opts := fmt.Sprintf("fd=%d,rootmode=%o,user_id=%d,group_id=%d,default_permissions", dev.Fd(), syscall.S_IFREG, os.Getuid(), os.Getgid())
+	if allowOther {
+		opts += ",allow_other"
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+
+	err = syscall.Mount("goqcow2", mountpoint, "fuse", flags, opts)
+	if err == nil {
+		return dev, false, nil
+	}
+	dev.Close()
+	if err != syscall.EPERM {
+		return nil, false, errors.Wrapf(err, "fuse: Failed to mount '%s'", mountpoint)
+	}
+
+	dev, err = fusermount(mountpoint, readOnly, allowOther)
+	if err != nil {
+		return nil, false, err
+	}
+	return dev, true, nil
+}
+
+// fusermount mounts the FUSE filesystem on mountpoint by the fusermount helper, which sends the opened FUSE
+// device back over the socket.
+func fusermount(mountpoint string, readOnly, allowOther bool) (*os.File, error) {
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if bin, err = exec.LookPath("fusermount"); err != nil {
+			return nil, errors.Wrap(ErrMountPermission, "fuse: Mounting requires CAP_SYS_ADMIN or fusermount")
+		}
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "fuse: Failed to create the socket pair")
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	defer remote.Close()
+
+	opts := "nosuid,nodev,default_permissions,fsname=goqcow2"
+	if readOnly {
+		opts += ",ro"
+	}
+	if allowOther {
+		opts += ",allow_other"
+	}
+
+	cmd := exec.Command(bin, "-o", opts, "--", mountpoint)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "fuse: Failed to mount '%s' by %s", mountpoint, bin)
+	}
+
+	buf := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(local.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "fuse: Failed to receive the FUSE device from fusermount")
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.Wrap(ErrFusermount, "fuse: Invalid control message from fusermount")
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) != 1 {
+		return nil, errors.Wrap(ErrFusermount, "fuse: Invalid control message from fusermount")
+	}
+	syscall.CloseOnExec(rights[0])
+
+	return os.NewFile(uintptr(rights[0]), "/dev/fuse"), nil
+}
+
+// unmount unmounts the FUSE filesystem on mountpoint.
+//  block/export/fuse.c: static void fuse_export_shutdown(BlockExport *blk_exp)
+func unmount(mountpoint string, fusermount bool) error {
+	if !fusermount {
+		if err := syscall.Unmount(mountpoint, 0); err != nil {
+			return errors.Wrapf(err, "fuse: Failed to unmount '%s'", mountpoint)
+		}
+		return nil
+	}
+
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		bin = "fusermount"
+	}
+	if out, err := exec.Command(bin, "-u", "--", mountpoint).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "fuse: Failed to unmount '%s': %s", mountpoint, out)
+	}
+	return nil
+}
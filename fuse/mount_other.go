@@ -0,0 +1,25 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// mount returns qcow2.ErrUnsupported, since the FUSE export is only supported on Linux.
+func mount(mountpoint string, readOnly, allowOther bool) (*os.File, bool, error) {
+	return nil, false, errors.Wrap(qcow2.ErrUnsupported, "fuse: FUSE export is only supported on Linux")
+}
+
+// unmount returns qcow2.ErrUnsupported, since the FUSE export is only supported on Linux.
+func unmount(mountpoint string, fusermount bool) error {
+	return errors.Wrap(qcow2.ErrUnsupported, "fuse: FUSE export is only supported on Linux")
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+// The version of the FUSE kernel protocol.
+//  include/uapi/linux/fuse.h of the Linux kernel
+const (
+	FUSE_KERNEL_VERSION       = 7
+	FUSE_KERNEL_MINOR_VERSION = 31
+
+	// FUSE_ROOT_ID the node ID of the root, which is the exported file.
+	FUSE_ROOT_ID = 1
+
+	// FUSE_MIN_READ_BUFFER the minimum size of the buffer which reads the requests.
+	FUSE_MIN_READ_BUFFER = 8192
+)
+
+// The opcodes of the requests.
+const (
+	FUSE_LOOKUP       = 1
+	FUSE_FORGET       = 2
+	FUSE_GETATTR      = 3
+	FUSE_SETATTR      = 4
+	FUSE_OPEN         = 14
+	FUSE_READ         = 15
+	FUSE_WRITE        = 16
+	FUSE_STATFS       = 17
+	FUSE_RELEASE      = 18
+	FUSE_FSYNC        = 20
+	FUSE_FLUSH        = 25
+	FUSE_INIT         = 26
+	FUSE_INTERRUPT    = 36
+	FUSE_DESTROY      = 38
+	FUSE_BATCH_FORGET = 42
+	FUSE_FALLOCATE    = 43
+	FUSE_LSEEK        = 46
+)
+
+// The flags of the INIT request and reply.
+const (
+	FUSE_ASYNC_READ = 1 << 0
+	FUSE_BIG_WRITES = 1 << 5
+	FUSE_MAX_PAGES  = 1 << 22
+)
+
+// The valid attributes of the SETATTR request.
+const (
+	FATTR_MODE      = 1 << 0
+	FATTR_UID       = 1 << 1
+	FATTR_GID       = 1 << 2
+	FATTR_SIZE      = 1 << 3
+	FATTR_FH        = 1 << 6
+	FATTR_LOCKOWNER = 1 << 9
+)
+
+// The modes of the FALLOCATE request.
+//  include/uapi/linux/falloc.h
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+	FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// The whences of the LSEEK request.
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+// FUSE_NOTIFY_INVAL_INODE the notification which invalidates the cached attributes and data of the inode.
+const FUSE_NOTIFY_INVAL_INODE = 2
+
+// inHeader represents the header of the request.
+//  include/uapi/linux/fuse.h: struct fuse_in_header
+type inHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	Nodeid  uint64
+	UID     uint32
+	GID     uint32
+	PID     uint32
+	Padding uint32
+}
+
+// outHeader represents the header of the reply.
+//  include/uapi/linux/fuse.h: struct fuse_out_header
+type outHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+// initIn represents the argument of FUSE_INIT.
+//  include/uapi/linux/fuse.h: struct fuse_init_in
+type initIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+// initOut represents the reply of FUSE_INIT.
+//  include/uapi/linux/fuse.h: struct fuse_init_out
+type initOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Flags2              uint32
+	Unused              [7]uint32
+}
+
+// attr represents the attributes of the inode.
+//  include/uapi/linux/fuse.h: struct fuse_attr
+type attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Flags     uint32
+}
+
+// attrOut represents the reply of FUSE_GETATTR and FUSE_SETATTR.
+//  include/uapi/linux/fuse.h: struct fuse_attr_out
+type attrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          attr
+}
+
+// setattrIn represents the argument of FUSE_SETATTR.
+//  include/uapi/linux/fuse.h: struct fuse_setattr_in
+type setattrIn struct {
+	Valid     uint32
+	Padding   uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Unused4   uint32
+	UID       uint32
+	GID       uint32
+	Unused5   uint32
+}
+
+// openIn represents the argument of FUSE_OPEN.
+//  include/uapi/linux/fuse.h: struct fuse_open_in
+type openIn struct {
+	Flags     uint32
+	OpenFlags uint32
+}
+
+// openOut represents the reply of FUSE_OPEN.
+//  include/uapi/linux/fuse.h: struct fuse_open_out
+type openOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+// readIn represents the argument of FUSE_READ.
+//  include/uapi/linux/fuse.h: struct fuse_read_in
+type readIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+// writeIn represents the argument of FUSE_WRITE, which is followed by the data.
+//  include/uapi/linux/fuse.h: struct fuse_write_in
+type writeIn struct {
+	Fh         uint64
+	Offset     uint64
+	Size       uint32
+	WriteFlags uint32
+	LockOwner  uint64
+	Flags      uint32
+	Padding    uint32
+}
+
+// writeOut represents the reply of FUSE_WRITE.
+//  include/uapi/linux/fuse.h: struct fuse_write_out
+type writeOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+// fallocateIn represents the argument of FUSE_FALLOCATE.
+//  include/uapi/linux/fuse.h: struct fuse_fallocate_in
+type fallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	Padding uint32
+}
+
+// lseekIn represents the argument of FUSE_LSEEK.
+//  include/uapi/linux/fuse.h: struct fuse_lseek_in
+type lseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+// lseekOut represents the reply of FUSE_LSEEK.
+//  include/uapi/linux/fuse.h: struct fuse_lseek_out
+type lseekOut struct {
+	Offset uint64
+}
+
+// statfsOut represents the reply of FUSE_STATFS.
+//  include/uapi/linux/fuse.h: struct fuse_statfs_out
+type statfsOut struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+// notifyInvalInodeOut represents the FUSE_NOTIFY_INVAL_INODE notification.
+//  include/uapi/linux/fuse.h: struct fuse_notify_inval_inode_out
+type notifyInvalInodeOut struct {
+	Ino uint64
+	Off int64
+	Len int64
+}
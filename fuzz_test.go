@@ -0,0 +1,145 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets are run with the seed corpus by go test, and are fuzzed such as:
+//
+//  go test -run '^$' -fuzz FuzzOpen -fuzzminimizetime 1s github.com/zchee/go-qcow2
+//
+// The inputs of FuzzOpen are the whole image files, whose minimization takes long by default.
+//
+// The images are opened from the memory without the backing files, since the hostile image may name any file
+// of the host as its backing file.
+
+// fuzzClusterSize the cluster size of the template image, which is small so that the inputs are small.
+const fuzzClusterSize = 512
+
+// fuzzReadLimit the size of the head of the guest disk which is read from the fuzzed image.
+const fuzzReadLimit = 1 << 20
+
+// fuzzTemplateImage returns the image file of the template, which has the data clusters in the two L2 tables,
+// and a snapshot which shares some of them.
+func fuzzTemplateImage(f *testing.F) []byte {
+	f.Helper()
+
+	filename := filepath.Join(f.TempDir(), "template.qcow2")
+	img, err := CreateImage(filename, 4<<20, WithClusterSize(fuzzClusterSize))
+	if err != nil {
+		f.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0xa5}, 4*fuzzClusterSize)
+	if _, err := img.WriteAt(data, 0); err == nil {
+		_, err = img.WriteAt(data, 2<<20)
+	}
+	if err == nil {
+		_, err = img.CreateSnapshot("fuzz")
+	}
+	if err == nil {
+		_, err = img.WriteAt(data[:fuzzClusterSize], fuzzClusterSize)
+	}
+	if cerr := img.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	template, err := os.ReadFile(filename)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return template
+}
+
+// fuzzOpen opens the image file of data from the memory, and walks its metadata and reads its guest data.
+// The errors are expected, and only the panics and the hangs fail the fuzzing.
+func fuzzOpen(data []byte) {
+	backend := &readerBackend{r: bytes.NewReader(data), size: int64(len(data))}
+	bs, err := bdrvOpenBackend(backend, "fuzz.qcow2", DriverQCow2, os.O_RDONLY, &OpenOpts{NoBacking: true}, nil)
+	if err != nil {
+		return
+	}
+	img := newImage(bs)
+	defer img.Close()
+
+	img.Info()
+	img.Snapshots()
+	img.Check(0)
+	img.Usage()
+
+	size, err := img.VirtualSize()
+	if err != nil {
+		return
+	}
+	if size > fuzzReadLimit {
+		size = fuzzReadLimit
+	}
+	buf := make([]byte, 64<<10)
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		img.ReadAt(buf, off)
+	}
+	img.MapRange(0, size)
+}
+
+// FuzzOpen opens data as the qcow2 image file.
+func FuzzOpen(f *testing.F) {
+	f.Add(fuzzTemplateImage(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzOpen(data)
+	})
+}
+
+// FuzzHeader opens the template image whose head is overwritten by data, which covers the header, the header
+// extensions and the backing file name in the first cluster.
+func FuzzHeader(f *testing.F) {
+	template := fuzzTemplateImage(f)
+	f.Add(template[:fuzzClusterSize])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > fuzzClusterSize {
+			t.Skip()
+		}
+		img := append([]byte(nil), template...)
+		copy(img, data)
+
+		fuzzOpen(img)
+	})
+}
+
+// FuzzSnapshotTable opens the template image whose snapshot table is overwritten by data. The first 4 bytes
+// of data are the number of the snapshots in the header, and the rest is the snapshot table.
+func FuzzSnapshotTable(f *testing.F) {
+	template := fuzzTemplateImage(f)
+	// the nb_snapshots and the snapshots_offset fields of the header, and the cluster of the snapshot table of
+	// the template
+	offset := int(BEUint64(template[64:72]))
+	end := MIN(offset+fuzzClusterSize, len(template))
+	f.Add(append(append([]byte(nil), template[60:64]...), template[offset:end]...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 4 {
+			t.Skip()
+		}
+		img := append([]byte(nil), template...)
+
+		copy(img[60:64], data[:4])
+		if end := offset + len(data) - 4; end > len(img) {
+			img = append(img, make([]byte, end-len(img))...)
+		}
+		copy(img[offset:], data[4:])
+
+		fuzzOpen(img)
+	})
+}
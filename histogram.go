@@ -0,0 +1,172 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import "context"
+
+// ClusterHistogram represents the number of guest clusters of the image by cluster type,
+// and the fragmentation of the allocated clusters.
+type ClusterHistogram struct {
+	ClusterSize int   `json:"cluster-size"`
+	Total       int64 `json:"total-clusters"`
+
+	// Unallocated is the number of clusters which are not allocated in the image and the backing chain.
+	Unallocated int64 `json:"unallocated-clusters"`
+	// Zero is the number of clusters which have the zero flag.
+	Zero int64 `json:"zero-clusters"`
+	// Compressed is the number of compressed clusters.
+	Compressed int64 `json:"compressed-clusters"`
+	// Normal is the number of allocated, uncompressed clusters.
+	Normal int64 `json:"normal-clusters"`
+	// Backing is the number of clusters which are not allocated in the image, but provided by the backing chain.
+	Backing int64 `json:"backing-clusters"`
+
+	// Fragmented is the number of allocated clusters which do not follow the previous allocated cluster
+	// in the image file. Compressed clusters are fragmented by nature, same as qemu-img check.
+	Fragmented int64 `json:"fragmented-clusters"`
+	// Runs is the distribution of the runs of normal clusters which are contiguous in the image file.
+	// Runs[i] is the number of runs of 2^i to 2^(i+1)-1 clusters.
+	Runs []int64 `json:"runs"`
+}
+
+// addRun adds the run of n contiguous clusters to the runs distribution.
+func (h *ClusterHistogram) addRun(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	var i int
+	for n > 1 {
+		n >>= 1
+		i++
+	}
+	for len(h.Runs) <= i {
+		h.Runs = append(h.Runs, 0)
+	}
+	h.Runs[i]++
+}
+
+// Fragmentation return the ratio of the fragmented clusters to the allocated clusters in percent.
+//  qemu-img.c: static void dump_human_image_check(ImageCheck *check, bool quiet)
+func (h *ClusterHistogram) Fragmentation() float64 {
+	allocated := h.Normal + h.Compressed
+	if allocated == 0 {
+		return 0
+	}
+	return float64(h.Fragmented) * 100 / float64(allocated)
+}
+
+// ClusterHistogram walks the L1 and L2 tables of the image, and counts the guest clusters by cluster type.
+// The unallocated clusters are looked up in the backing chain.
+func (q *QCow2) ClusterHistogram() (*ClusterHistogram, error) {
+	bs := q.blk.bs()
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+
+	size, err := getlength(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ClusterHistogram{
+		ClusterSize: s.ClusterSize,
+		Total:       divRoundUp(size, clusterSize),
+		Runs:        []int64{},
+	}
+
+	var (
+		nextContiguousOffset uint64
+		run                  int64
+	)
+	for offset := int64(0); offset < size; {
+		clusterOffset, n, typ, err := getClusterOffset(context.Background(), bs, uint64(offset), uint64(size-offset))
+		if err != nil {
+			return nil, err
+		}
+		nbClusters := divRoundUp(int64(n), clusterSize)
+
+		switch typ {
+		case CLUSTER_NORMAL:
+			h.Normal += nbClusters
+			if clusterOffset != nextContiguousOffset {
+				if nextContiguousOffset != 0 {
+					h.Fragmented++
+				}
+				h.addRun(run)
+				run = 0
+			}
+			run += nbClusters
+			nextContiguousOffset = clusterOffset + uint64(nbClusters*clusterSize)
+
+		case CLUSTER_COMPRESSED:
+			// Compressed clusters are fragmented by nature.  Since they take
+			// up sub-sector space but we only have sector granularity I/O we
+			// need to re-read the same sectors even for adjacent compressed
+			// clusters.
+			h.Compressed += nbClusters
+			h.Fragmented += nbClusters
+
+		case CLUSTER_ZERO:
+			h.Zero += nbClusters
+
+		case CLUSTER_UNALLOCATED:
+			backing, err := backingClusters(bs, offset, int64(n))
+			if err != nil {
+				return nil, err
+			}
+			h.Backing += backing
+			h.Unallocated += nbClusters - backing
+		}
+
+		offset += int64(n)
+	}
+	h.addRun(run)
+
+	return h, nil
+}
+
+// backingClusters return the number of clusters of bs between offset and offset+bytes
+// which are allocated in the backing chain of bs.
+func backingClusters(bs *BlockDriverState, offset, bytes int64) (int64, error) {
+	if bs.Backing == nil {
+		return 0, nil
+	}
+
+	clusterSize := int64(bs.Opaque.ClusterSize)
+	var (
+		count       int64
+		lastCounted = int64(-1)
+	)
+	for end := offset + bytes; offset < end; {
+		status, n, _, _, err := bdrvBlockStatusAbove(bs.Backing.bs, offset, end-offset)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 {
+			break
+		}
+
+		if status&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO) != 0 {
+			first := offset / clusterSize
+			if first <= lastCounted {
+				first = lastCounted + 1
+			}
+			last := (offset + n - 1) / clusterSize
+			if last >= first {
+				count += last - first + 1
+				lastCounted = last
+			}
+		}
+
+		offset += n
+	}
+
+	return count, nil
+}
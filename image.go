@@ -0,0 +1,361 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	_ io.ReaderAt        = (*QCow2)(nil)
+	_ io.WriterAt        = (*QCow2)(nil)
+	_ io.ReadWriteSeeker = (*QCow2)(nil)
+	_ io.Closer          = (*QCow2)(nil)
+)
+
+// ReadAt reads len(p) bytes of the guest data at off, and implements io.ReaderAt.
+// The read beyond the end of the image returns io.EOF with the number of bytes read.
+// ReadAt is safe for concurrent use by multiple goroutines. The reads wait only for the running writes
+// to the same cluster.
+func (q *QCow2) ReadAt(p []byte, off int64) (int, error) {
+	return q.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is like ReadAt, but reads in ctx: the read is not started if ctx is done, and the spans of the
+// tracer set by SetTracer are started in ctx.
+func (q *QCow2) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.readAt(ctx, p, off)
+}
+
+func (q *QCow2) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	bs := q.blk.bs()
+	if bs == nil {
+		return 0, ENOMEDIUM
+	}
+	if off < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative offset")
+		return 0, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	size, err := getlength(bs)
+	if err != nil {
+		return 0, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+	if err := q.pread(ctx, off, p[:n]); err != nil {
+		err = errors.Wrapf(err, "Could not read at offset %d", off)
+		return 0, err
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the guest data at off, and implements io.WriterAt.
+// The qcow2 image does not grow by the write, the write beyond the end of the image returns
+// io.ErrShortWrite with the number of bytes written. Use Resize to grow the image.
+// WriteAt is safe for concurrent use by multiple goroutines. The writes to the same cluster are serialized,
+// and the writes to the disjoint clusters run in parallel.
+// p and off need not be aligned: if the image file requires the aligned requests, such as opened with
+// OpenOpts.Direct, the unaligned head and tail are read from the image and written with p as the whole blocks.
+func (q *QCow2) WriteAt(p []byte, off int64) (int, error) {
+	return q.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is like WriteAt, but writes in ctx: the write is not started if ctx is done, and the spans of
+// the tracer set by SetTracer are started in ctx.
+func (q *QCow2) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.writeAt(ctx, p, off, 0)
+}
+
+// WriteAtFlags is like WriteAt, but writes p with flags. The only supported flag is BDRV_REQ_FUA, which writes p
+// through to the disk: the data and the metadata which refers it are on the disk when WriteAtFlags returns,
+// even in the writeback cache mode. The format driver which supports FUA natively, whose SupportedWriteFlags has
+// BDRV_REQ_FUA, writes p through by itself, otherwise FUA is emulated by the flush of the image.
+//  block/block-backend.c: int blk_pwrite(BlockBackend *blk, int64_t offset, const void *buf, int count, BdrvRequestFlags flags)
+func (q *QCow2) WriteAtFlags(p []byte, off int64, flags BdrvRequestFlags) (int, error) {
+	if flags&^BDRV_REQ_FUA != 0 {
+		err := errors.Wrapf(ErrInvalidArgument, "Unsupported write flags %#x", flags&^BDRV_REQ_FUA)
+		return 0, err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.writeAt(context.Background(), p, off, flags)
+}
+
+func (q *QCow2) writeAt(ctx context.Context, p []byte, off int64, flags BdrvRequestFlags) (int, error) {
+	bs := q.blk.bs()
+	if bs == nil {
+		return 0, ENOMEDIUM
+	}
+	if off < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative offset")
+		return 0, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	n := len(p)
+	if !q.blk.allowBeyondEOF {
+		size, err := getlength(bs)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case off >= size:
+			n = 0
+		case int64(n) > size-off:
+			n = int(size - off)
+		}
+	}
+
+	if n > 0 {
+		if err := q.blk.pwrite(ctx, off, p[:n], flags); err != nil {
+			err = errors.Wrapf(err, "Could not write at offset %d", off)
+			return 0, err
+		}
+	}
+
+	if n < len(p) {
+		err := errors.Wrapf(io.ErrShortWrite, "Could not write beyond the end of the image at offset %d", off+int64(n))
+		return n, err
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes of the guest data at the current offset, and implements io.Reader.
+func (q *QCow2) Read(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, err := q.readAt(context.Background(), p, q.offset)
+	q.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Write writes p to the guest data at the current offset, and implements io.Writer.
+func (q *QCow2) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, err := q.writeAt(context.Background(), p, q.offset, 0)
+	q.offset += int64(n)
+
+	return n, err
+}
+
+// Seek sets the offset of the next Read or Write to offset, interpreted according to whence,
+// and implements io.Seeker. The io.SeekEnd is relative to the virtual size of the image.
+func (q *QCow2) Seek(offset int64, whence int) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += q.offset
+	case io.SeekEnd:
+		bs := q.blk.bs()
+		if bs == nil {
+			return 0, ENOMEDIUM
+		}
+		size, err := getlength(bs)
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		err := errors.Wrapf(ErrInvalidArgument, "Invalid whence %d", whence)
+		return 0, err
+	}
+
+	if offset < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative offset")
+		return 0, err
+	}
+	q.offset = offset
+
+	return offset, nil
+}
+
+// VirtualSize returns the virtual disk size of the image in bytes.
+func (q *QCow2) VirtualSize() (int64, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return 0, ENOMEDIUM
+	}
+
+	return getlength(bs)
+}
+
+// ReadOnly reports whether the image is opened as read-only.
+func (q *QCow2) ReadOnly() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	return bs == nil || bs.ReadOnly
+}
+
+// SetLogger sets the Logger of the diagnostic messages of the image. If l is nil, the Logger set by the package
+// SetLogger is used.
+func (q *QCow2) SetLogger(l Logger) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return
+	}
+
+	bs.logger.Store(loggerHolder{l})
+}
+
+// Flush writes the dirty metadata caches to the image file, and flushes the image file to the disk.
+// The refcount blocks are written before the L2 tables which refer to the newly allocated clusters.
+// Flush is safe for concurrent use with the reads and the writes, and the writes completed before Flush are
+// on the disk when it returns.
+//  block/block-backend.c: int blk_flush(BlockBackend *blk)
+func (q *QCow2) Flush() error {
+	return q.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but flushes in ctx: the flush is not started if ctx is done, and the span of the
+// flush is started in ctx.
+func (q *QCow2) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	if err := q.blk.flush(ctx); err != nil {
+		err = errors.Wrap(err, "Could not flush the image")
+		return err
+	}
+
+	return nil
+}
+
+// Sync is like Flush, but always flushes the image file to the disk, even if nothing is written after the last
+// flush. The dirty metadata caches are written in the dependency order, the refcount blocks before the L2
+// tables, so the image on the disk is consistent when Sync returns, including the metadata updated without the
+// guest writes, such as by the snapshots and the repair.
+//  block/block-backend.c: int blk_flush(BlockBackend *blk)
+func (q *QCow2) Sync() error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	if err := q.blk.sync(context.Background()); err != nil {
+		err = errors.Wrap(err, "Could not sync the image")
+		return err
+	}
+
+	return nil
+}
+
+// Close closes the image and its backing file chain, and implements io.Closer.
+// The writable image is flushed, the metadata caches are written to the image file and the dirty bit is cleared,
+// so that the image is consistent when it is opened again. The lock of the image file is released.
+// The backing file which is shared with the other images is closed when the last of them is closed.
+// The methods of the closed image return ENOMEDIUM.
+//  block/block-backend.c: void blk_remove_bs(BlockBackend *blk)
+func (q *QCow2) Close() error {
+	q.unpublishExpvar()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	q.drainReadahead()
+	q.blk.BlockDriverState = nil
+
+	if err := bdrvUnref(bs); err != nil {
+		err = errors.Wrapf(err, "Could not close '%s'", bs.Filename)
+		return err
+	}
+
+	return nil
+}
+
+// BackingChain returns the read-only images of the backing file chain, from the backing file of the image
+// to the base image. Each image is opened with the format recorded in its overlay, or the probed format if
+// it is not recorded. The backing files are shared with the image, so they are not opened again, and each
+// returned image must be closed by the caller.
+//  block.c: BlockDriverState *bdrv_backing_chain_next(BlockDriverState *bs)
+func (q *QCow2) BackingChain() ([]*QCow2, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return nil, ENOMEDIUM
+	}
+
+	var chain []*QCow2
+	for backing := bs.Backing; backing != nil; backing = backing.bs.Backing {
+		bdrvRef(backing.bs)
+		chain = append(chain, newImage(backing.bs))
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestCloseConcurrent calls the accessors of the image while it is closed, which is run with -race. They must
+// see the image either open or closed.
+func TestCloseConcurrent(t *testing.T) {
+	img, err := CreateImage(filepath.Join(t.TempDir(), "close.qcow2"), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 100; j++ {
+				size, err := img.VirtualSize()
+				if err != nil && !errors.Is(err, ENOMEDIUM) {
+					t.Error(err)
+					return
+				}
+				if err == nil && size != 4<<20 {
+					t.Errorf("virtual size is %d, want %d", size, 4<<20)
+					return
+				}
+				img.ReadOnly()
+				img.SetLogger(nil)
+			}
+		}()
+	}
+
+	close(start)
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if _, err := img.VirtualSize(); !errors.Is(err, ENOMEDIUM) {
+		t.Errorf("VirtualSize of the closed image returns %v, want %v", err, ENOMEDIUM)
+	}
+	if !img.ReadOnly() {
+		t.Error("the closed image is not read-only")
+	}
+}
+
+// TestConcurrentIOMetadata runs the partial writes of the same clusters and the reads concurrently with the
+// metadata operations through the public API, which is run with -race. The operations which take the image
+// lock, the driver lock and the tracked requests in the different orders must not deadlock, and every write
+// must be read back.
+func TestConcurrentIOMetadata(t *testing.T) {
+	const (
+		clusterSize = 64 << 10
+		clusters    = 8
+		writers     = 4
+		slot        = 4 << 10
+		rounds      = 20
+	)
+
+	img, err := CreateImage(filepath.Join(t.TempDir(), "concurrent.qcow2"), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < rounds; k++ {
+				data := bytes.Repeat([]byte{byte(i<<4 | k&0xf)}, slot)
+				for c := int64(0); c < clusters; c++ {
+					if _, err := img.WriteAt(data, c*clusterSize+int64(i)*slot); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				buf := make([]byte, clusterSize)
+				if _, err := img.ReadAt(buf, int64(k%clusters)*clusterSize); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	meta := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Flush", img.Flush},
+		{"Sync", img.Sync},
+		{"WriteZeroes", func() error { return img.WriteZeroes(2<<20, clusterSize) }},
+		{"Discard", func() error { return img.Discard(2<<20, clusterSize) }},
+		{"Map", func() error { _, err := img.Map(); return err }},
+		{"BlockStatus", func() error { _, _, _, err := img.BlockStatus(0, clusters*clusterSize); return err }},
+		{"Usage", func() error { _, err := img.Usage(); return err }},
+		{"Info", func() error { _, err := img.Info(); return err }},
+		{"Check", func() error { _, err := img.Check(0); return err }},
+		{"CreateSnapshot", func() error { _, err := img.CreateSnapshot("concurrent"); return err }},
+		{"DeleteSnapshot", func() error { return img.DeleteSnapshot("concurrent") }},
+	}
+	metaDone := make(chan struct{})
+	go func() {
+		defer close(metaDone)
+		for {
+			for _, m := range meta {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := m.fn(); err != nil {
+					t.Errorf("%s: %v", m.name, err)
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-metaDone
+	if t.Failed() {
+		return
+	}
+
+	buf := make([]byte, slot)
+	for i := 0; i < writers; i++ {
+		want := bytes.Repeat([]byte{byte(i<<4 | (rounds-1)&0xf)}, slot)
+		for c := int64(0); c < clusters; c++ {
+			if _, err := img.ReadAt(buf, c*clusterSize+int64(i)*slot); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, want) {
+				t.Errorf("the last write of the writer %d is lost in the cluster %d", i, c)
+			}
+		}
+	}
+
+	res, err := img.Check(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Corruptions != 0 || res.Leaks != 0 {
+		t.Errorf("the image is inconsistent: %d corruptions, %d leaks", res.Corruptions, res.Leaks)
+	}
+}
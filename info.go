@@ -0,0 +1,122 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+// ImageInfo represents a information about a disk image.
+// The json field names are the same as the 'qemu-img info --output=json' output.
+//  qapi/block-core.json: { 'struct': 'ImageInfo' }
+type ImageInfo struct {
+	Filename              string             `json:"filename"`
+	Format                DriverFmt          `json:"format"`
+	DirtyFlag             bool               `json:"dirty-flag"`
+	ActualSize            int64              `json:"actual-size"`
+	VirtualSize           int64              `json:"virtual-size"`
+	ClusterSize           int                `json:"cluster-size,omitempty"`
+	Encrypted             bool               `json:"encrypted,omitempty"`
+	BackingFilename       string             `json:"backing-filename,omitempty"`
+	FullBackingFilename   string             `json:"full-backing-filename,omitempty"`
+	BackingFilenameFormat string             `json:"backing-filename-format,omitempty"`
+	FormatSpecific        *ImageInfoSpecific `json:"format-specific,omitempty"`
+}
+
+// ImageInfoSpecific represents a format specific information of the image.
+//  qapi/block-core.json: { 'union': 'ImageInfoSpecific' }
+type ImageInfoSpecific struct {
+	Type DriverFmt               `json:"type"`
+	Data *ImageInfoSpecificQCow2 `json:"data"`
+}
+
+// ImageInfoSpecificQCow2 represents a qcow2 specific information of the image.
+// The LazyRefcounts and Corrupt fields are only set for the compat=1.1 images, same as qemu.
+//  qapi/block-core.json: { 'struct': 'ImageInfoSpecificQCow2' }
+type ImageInfoSpecificQCow2 struct {
+	Compat          string `json:"compat"`
+	CompressionType string `json:"compression-type"`
+	LazyRefcounts   *bool  `json:"lazy-refcounts,omitempty"`
+	RefcountBits    int    `json:"refcount-bits"`
+	Corrupt         *bool  `json:"corrupt,omitempty"`
+	ExtendedL2      bool   `json:"extended-l2"`
+}
+
+// compat return the compatibility level string of the qcow2 image version.
+func (v Version) compat() string {
+	if v == Version2 {
+		return "0.10"
+	}
+	return "1.1"
+}
+
+// Info returns the information of the image.
+//  qemu-img.c: static ImageInfoList *collect_image_info_list(...)
+func (q *QCow2) Info() (*ImageInfo, error) {
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil || bs.File == nil {
+		return nil, ENOMEDIUM
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	actualSize, err := allocatedSize(bs.File)
+	if err != nil {
+		return nil, err
+	}
+	virtualSize, err := getlength(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ImageInfo{
+		Filename:    bs.Filename,
+		Format:      bs.Drv.formatName,
+		ActualSize:  actualSize,
+		VirtualSize: virtualSize,
+	}
+
+	if bs.BackingFile != "" {
+		info.BackingFilename = bs.BackingFile
+		info.FullBackingFilename = pathCombine(bs.Filename, bs.BackingFile)
+		info.BackingFilenameFormat = bs.BackingFormat
+	}
+
+	// the layer of the backing file chain may be the other format
+	if bs.Drv != bdrvQCow2 {
+		return info, nil
+	}
+
+	s := bs.Opaque
+	info.DirtyFlag = s.IncompatibleFeatures&INCOMPAT_DIRTY != 0
+	info.ClusterSize = s.ClusterSize
+	info.Encrypted = s.CryptMethodHeader != uint32(CRYPT_NONE)
+
+	spec := &ImageInfoSpecificQCow2{
+		Compat:          s.Version.compat(),
+		CompressionType: "zlib",
+		RefcountBits:    s.RefcountBits,
+	}
+	if s.Version >= Version3 {
+		lazyRefcounts := s.CompatibleFeatures&COMPAT_LAZY_REFCOUNTS != 0
+		corrupt := s.IncompatibleFeatures&INCOMPAT_CORRUPT != 0
+		spec.LazyRefcounts = &lazyRefcounts
+		spec.Corrupt = &corrupt
+	}
+	info.FormatSpecific = &ImageInfoSpecific{
+		Type: DriverQCow2,
+		Data: spec,
+	}
+
+	return info, nil
+}
+
+// allocatedSize returns the allocated size of the image file of the backend, or the file size if the backend
+// does not know the allocated size.
+//  block.c: int64_t bdrv_get_allocated_file_size(BlockDriverState *bs)
+func allocatedSize(backend Backend) (int64, error) {
+	if a, ok := backend.(backendAllocatedSizer); ok {
+		return a.AllocatedSize()
+	}
+	return backend.Size()
+}
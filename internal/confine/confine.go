@@ -0,0 +1,132 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package confine confines the filenames of the requests of the servers to the root directory, so the clients
+// of the server can not read or write the files of the host outside of it.
+//
+// The symbolic links are resolved before the check, and the resolved path is used to open the file. The check
+// is not atomic against the concurrent renames in the root directory, so the root directory must not be
+// writable by the untrusted users of the host.
+package confine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// ErrOutsideRoot the path is outside of the root directory, or can not be resolved in it.
+var ErrOutsideRoot error = qcow2.NewError(syscall.EACCES, "path is outside of the root directory")
+
+// Path returns the resolved path of name in root. The relative name is relative to root, and the absolute name
+// must be in root. The name of the new file is resolved by its directory, which must exist. If root is empty,
+// name is returned as is.
+func Path(root, name string) (string, error) {
+	if root == "" || name == "" {
+		return name, nil
+	}
+	if strings.Contains(name, "://") {
+		return "", errors.Wrapf(ErrOutsideRoot, "Remote file '%s' is not allowed", name)
+	}
+
+	path := filepath.FromSlash(name)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	return resolve(root, name, path)
+}
+
+// Backing checks that backing, which is the backing file name of the image of the resolved path image, is in
+// root. The relative backing file name is relative to the directory of the image, same as qemu.
+func Backing(root, image, backing string) error {
+	if root == "" || backing == "" {
+		return nil
+	}
+	if strings.Contains(backing, "://") {
+		return errors.Wrapf(ErrOutsideRoot, "Remote backing file '%s' is not allowed", backing)
+	}
+
+	path := filepath.FromSlash(backing)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(image), path)
+	}
+	_, err := resolve(root, backing, path)
+	return err
+}
+
+// Chain checks that the backing files of img, which are opened with it, are in root, since the backing file
+// name in the image file may refer to any file of the host.
+func Chain(root string, img *qcow2.QCow2) error {
+	if root == "" {
+		return nil
+	}
+
+	chain, err := img.BackingChain()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, backing := range chain {
+			backing.Close()
+		}
+	}()
+
+	for _, backing := range chain {
+		info, err := backing.Info()
+		if err != nil {
+			return err
+		}
+		if _, err := Path(root, info.Filename); err != nil {
+			return errors.Wrap(err, "Backing file is not allowed")
+		}
+	}
+	return nil
+}
+
+// BackingCheck returns the qcow2.OpenOpts.CheckBacking which rejects the backing files outside of root, so they
+// are not opened. It returns nil if root is empty.
+func BackingCheck(root string) func(filename string) error {
+	if root == "" {
+		return nil
+	}
+	return func(filename string) error {
+		if _, err := Path(root, filename); err != nil {
+			return errors.Wrap(err, "Backing file is not allowed")
+		}
+		return nil
+	}
+}
+
+// resolve resolves the symbolic links of path, and returns it if it is in root. The name is the name of path
+// in the request for the error message.
+func resolve(root, name, path string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not resolve the root directory")
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		// the dangling symbolic link would create the file of its target
+		if _, lerr := os.Lstat(path); lerr == nil {
+			return "", errors.Wrapf(ErrOutsideRoot, "Path '%s' is the dangling symbolic link", name)
+		}
+		var dir string
+		dir, err = filepath.EvalSymlinks(filepath.Dir(path))
+		resolved = filepath.Join(dir, filepath.Base(path))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(realRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Wrapf(ErrOutsideRoot, "Path '%s' is outside of the root directory", name)
+	}
+	return resolved, nil
+}
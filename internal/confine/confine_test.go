@@ -0,0 +1,79 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package confine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "new"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir", filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "a.qcow2", want: filepath.Join(realRoot, "a.qcow2")},
+		{name: "dir/../a.qcow2", want: filepath.Join(realRoot, "a.qcow2")},
+		{name: filepath.Join(root, "dir", "a.qcow2"), want: filepath.Join(realRoot, "dir", "a.qcow2")},
+		{name: "inside/a.qcow2", want: filepath.Join(realRoot, "dir", "a.qcow2")},
+		{name: "../a.qcow2"},
+		{name: filepath.Join(outside, "a.qcow2")},
+		{name: "escape/a.qcow2"},
+		{name: "dangling"},
+		{name: "http://example.com/a.qcow2"},
+	}
+	for _, tt := range tests {
+		got, err := Path(root, tt.name)
+		if tt.want == "" {
+			if !errors.Is(err, ErrOutsideRoot) {
+				t.Errorf("Path(%q): got %q, %v, want ErrOutsideRoot", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Path(%q): got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	if got, err := Path("", "../a.qcow2"); err != nil || got != "../a.qcow2" {
+		t.Errorf("Path without root: got %q, %v", got, err)
+	}
+}
+
+func TestBacking(t *testing.T) {
+	root := t.TempDir()
+	image := filepath.Join(root, "dir", "a.qcow2")
+	if err := os.Mkdir(filepath.Dir(image), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Backing(root, image, "../base.qcow2"); err != nil {
+		t.Errorf("backing file in the root directory: %v", err)
+	}
+	if err := Backing(root, image, "../../base.qcow2"); !errors.Is(err, ErrOutsideRoot) {
+		t.Errorf("backing file outside of the root directory: got %v, want ErrOutsideRoot", err)
+	}
+}
@@ -6,28 +6,827 @@
 
 package qcow2
 
-import "os"
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"syscall"
 
-// bdrvPread reads the child qcow2 image file.
+	"github.com/pkg/errors"
+)
+
+// bdrvPread reads len(buf) bytes from the child image file at offset.
 // Return nil on success, err on error.
-//
-// NOTE: This function does not use the pread syscall.
-// The function name only of compatible for QEMU intelnal source.
-func bdrvPread(child *BdrvChild, offset int64, res interface{}, byt uintptr) error {
-	f, err := os.Open(child.Name)
+// The range beyond the end of file is filled with zeros, same as the qemu block layer.
+//  block/io.c: int bdrv_pread(BdrvChild *child, int64_t offset, void *buf, int bytes)
+func bdrvPread(child *BdrvChild, offset int64, buf []byte) error {
+	if child == nil || child.bs == nil || child.bs.File == nil {
+		return ENOMEDIUM
+	}
+	if offset < 0 {
+		return syscall.EIO
+	}
+
+	n, err := child.bs.File.ReadAt(buf, offset)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		return nil
+	}
+
+	return err
+}
+
+// bdrvAlignedPreadv reads len(buf) bytes of the guest data of bs at offset through the format driver.
+// The range beyond the end of the image is filled with zeros.
+//  block/io.c: static int coroutine_fn bdrv_aligned_preadv(BlockDriverState *bs, BdrvTrackedRequest *req, int64_t offset, unsigned int bytes, int64_t align, QEMUIOVector *qiov, int flags)
+func bdrvAlignedPreadv(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if offset < 0 {
+		return syscall.EIO
+	}
+
+	totalBytes, err := getlength(bs)
+	if err != nil {
+		return err
+	}
+
+	maxBytes := totalBytes - offset
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	if int64(len(buf)) > maxBytes {
+		tail := buf[maxBytes:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		buf = buf[:maxBytes]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	req := trackedRequestBegin(bs, offset, int64(len(buf)), false)
+	defer trackedRequestEnd(req)
+	waitSerialisingRequests(req)
+
+	if bs.Drv.bdrvCoPreadv == nil {
+		return bdrvPread(bs.file, offset, buf)
+	}
+	return bs.Drv.bdrvCoPreadv(ctx, bs, offset, buf)
+}
+
+// bufferIsZero reports whether buf is all zeros.
+//  util/bufferiszero.c: bool buffer_is_zero(const void *buf, size_t len)
+func bufferIsZero(buf []byte) bool {
+	for len(buf) >= 8 {
+		if binary.LittleEndian.Uint64(buf) != 0 {
+			return false
+		}
+		buf = buf[8:]
+	}
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bdrvDriverPwritev writes buf to the guest data of bs at offset by the format driver.
+// If flags has BDRV_REQ_WRITE_COMPRESSED, buf is written as the compressed clusters.
+//  block/io.c: static int coroutine_fn bdrv_driver_pwritev(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func bdrvDriverPwritev(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, flags BdrvRequestFlags) error {
+	if flags&BDRV_REQ_WRITE_COMPRESSED != 0 {
+		if bs.Drv.bdrvCoPwritevCompressed == nil {
+			return syscall.ENOTSUP
+		}
+		return bs.Drv.bdrvCoPwritevCompressed(ctx, bs, offset, buf)
+	}
+
+	if bs.Drv.bdrvCoPwritev == nil {
+		return syscall.ENOTSUP
+	}
+
+	return bs.Drv.bdrvCoPwritev(ctx, bs, offset, buf, flags&BdrvRequestFlags(bs.SupportedWriteFlags))
+}
+
+// bdrvAlignedPwritev writes buf to the guest data of bs at offset through the format driver.
+//  block/io.c: static int coroutine_fn bdrv_aligned_pwritev(BlockDriverState *bs, BdrvTrackedRequest *req, int64_t offset, unsigned int bytes, int64_t align, QEMUIOVector *qiov, int flags)
+func bdrvAlignedPwritev(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, flags BdrvRequestFlags) error {
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.ReadOnly {
+		return ErrReadOnly
+	}
+	if offset < 0 {
+		return syscall.EIO
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	// the unaligned request is padded by the head and the tail, which are read from bs, so it must not be
+	// interleaved with the other writes to the same aligned blocks
+	align := int64(bs.BL.RequestAlignment)
+	if flags&BDRV_REQ_WRITE_COMPRESSED != 0 {
+		align = 1
+	}
+	serialiseAlign := bdrvGetClusterSize(bs)
+	if align > serialiseAlign {
+		serialiseAlign = align
+	}
+
+	req := trackedRequestBegin(bs, offset, int64(len(buf)), true)
+	defer trackedRequestEnd(req)
+	markRequestSerialising(req, serialiseAlign)
+	waitSerialisingRequests(req)
+
+	offset, padded, err := bdrvPadWrite(ctx, bs, offset, buf, align)
 	if err != nil {
 		return err
 	}
+	if &padded[0] != &buf[0] {
+		defer bufPoolPut(padded)
+	}
+	buf = padded
+
+	emulateFUA := flags&BDRV_REQ_FUA != 0
+	if bs.DetectZeroes != DETECT_ZEROES_OFF && bufferIsZero(buf) {
+		if bs.DetectZeroes == DETECT_ZEROES_UNMAP {
+			flags |= BDRV_REQ_MAY_UNMAP
+		}
+		err = bdrvCoDoPwriteZeroes(ctx, bs, offset, int64(len(buf)), flags)
+	} else {
+		err = bdrvDriverPwritev(ctx, bs, offset, buf, flags)
+		if bs.SupportedWriteFlags&uint(BDRV_REQ_FUA) != 0 {
+			emulateFUA = false
+		}
+	}
+	bdrvCoWriteReqFinish(bs, offset, int64(len(buf)), err)
+
+	// emulate FUA by the flush if the format driver does not support it. It must follow the update of
+	// the write generation, otherwise the flush of the image file is skipped.
+	if err == nil && emulateFUA {
+		err = bdrvCoFlush(bs)
+	}
+
+	return err
+}
 
-	if offset != 0 {
-		f.Seek(offset, 0)
+// bdrvPadWrite extends the write request of buf at offset to the align boundaries, and returns the padded
+// request. The head and the tail of the padded request are read from bs, so the unaligned write is done as
+// the read-modify-write of the aligned blocks. The tail is not padded beyond the end of bs, so the padding
+// does not grow bs. The request is returned as is if it is aligned, or align is not greater than 1, otherwise
+// the padded buffer is from the pool, and should be returned by bufPoolPut.
+//  block/io.c: int coroutine_fn bdrv_co_pwritev(BdrvChild *child, int64_t offset, unsigned int bytes, QEMUIOVector *qiov, BdrvRequestFlags flags)
+func bdrvPadWrite(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, align int64) (int64, []byte, error) {
+	if align <= 1 {
+		return offset, buf, nil
 	}
 
+	end := offset + int64(len(buf))
+	padStart := offset &^ (align - 1)
+	padEnd := roundUp(end, align)
+	if padStart == offset && padEnd == end {
+		return offset, buf, nil
+	}
+
+	totalBytes, err := getlength(bs)
+	if err != nil {
+		return 0, nil, err
+	}
+	if padEnd > totalBytes {
+		padEnd = totalBytes
+		if padEnd < end {
+			padEnd = end
+		}
+	}
+
+	padded := bufPoolGet(int(bdrvOptMemAlign(bs)), int(padEnd-padStart))
+
+	// read the head block, which is partially overwritten
+	if padStart != offset {
+		headEnd := padStart + align
+		if headEnd > padEnd {
+			headEnd = padEnd
+		}
+		if err := bdrvPadRead(ctx, bs, padStart, padded[:headEnd-padStart], totalBytes); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// read the tail block, unless it is the head block which has been read
+	if padEnd != end {
+		tailStart := (end - 1) &^ (align - 1)
+		if padStart != offset && tailStart == padStart {
+			tailStart = padStart + align
+		}
+		if tailStart < padEnd {
+			if err := bdrvPadRead(ctx, bs, tailStart, padded[tailStart-padStart:], totalBytes); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	copy(padded[offset-padStart:], buf)
+
+	return padStart, padded, nil
+}
+
+// bdrvPadRead reads buf of the padding from bs at offset through the format driver. The range beyond
+// totalBytes, the end of bs, reads as zeros.
+//  block/io.c: static int coroutine_fn bdrv_aligned_preadv(BlockDriverState *bs, BdrvTrackedRequest *req, int64_t offset, unsigned int bytes, int64_t align, QEMUIOVector *qiov, int flags)
+func bdrvPadRead(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, totalBytes int64) error {
+	maxBytes := totalBytes - offset
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	if int64(len(buf)) > maxBytes {
+		tail := buf[maxBytes:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		buf = buf[:maxBytes]
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if bs.Drv.bdrvCoPreadv == nil {
+		return bdrvPread(bs.file, offset, buf)
+	}
+	return bs.Drv.bdrvCoPreadv(ctx, bs, offset, buf)
+}
+
+// bdrvCoWriteReqFinish updates the write generation of bs after the write request, and grows the size
+// of bs to the end of the request if it succeeded.
+//  block/io.c: static inline void coroutine_fn bdrv_co_write_req_finish(BdrvChild *child, int64_t offset, uint64_t bytes, BdrvTrackedRequest *req, int ret)
+func bdrvCoWriteReqFinish(bs *BlockDriverState, offset, bytes int64, err error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.WriteGen++
+
+	if err == nil {
+		endSector := divRoundUp(offset+bytes, int64(BDRV_SECTOR_SIZE))
+		if bs.TotalSectors < endSector {
+			bs.TotalSectors = endSector
+		}
+	}
+}
+
+// MAX_WRITE_ZEROES_BOUNCE_BUFFER maximum number of sectors of the zero buffer written
+// if the format driver can not write zeros efficiently.
+//  block/io.c: #define MAX_WRITE_ZEROES_BOUNCE_BUFFER 32768
+const MAX_WRITE_ZEROES_BOUNCE_BUFFER = 32768
+
+// bdrvCoPwriteZeroes writes zeros to the guest data of bs from offset to offset+count.
+//  block/io.c: int coroutine_fn bdrv_co_pwrite_zeroes(BdrvChild *child, int64_t offset, int count, BdrvRequestFlags flags)
+func bdrvCoPwriteZeroes(ctx context.Context, bs *BlockDriverState, offset, count int64, flags BdrvRequestFlags) error {
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.ReadOnly {
+		return ErrReadOnly
+	}
+	if offset < 0 || count < 0 {
+		return syscall.EIO
+	}
+
+	req := trackedRequestBegin(bs, offset, count, true)
+	defer trackedRequestEnd(req)
+	markRequestSerialising(req, bdrvGetClusterSize(bs))
+	waitSerialisingRequests(req)
+
+	err := bdrvCoDoPwriteZeroes(ctx, bs, offset, count, flags)
+	bdrvCoWriteReqFinish(bs, offset, count, err)
+
+	if err == nil && flags&BDRV_REQ_FUA != 0 {
+		err = bdrvCoFlush(bs)
+	}
+
+	return err
+}
+
+// bdrvCoDoPwriteZeroes writes zeros to the guest data of bs from offset to offset+count.
+// The request is split to the head, the aligned body and the tail by the write zeroes alignment of bs.
+// If the format driver can not write zeros efficiently, the zero buffer is written instead.
+//  block/io.c: static int coroutine_fn bdrv_co_do_pwrite_zeroes(BlockDriverState *bs, int64_t offset, int count, BdrvRequestFlags flags)
+func bdrvCoDoPwriteZeroes(ctx context.Context, bs *BlockDriverState, offset, count int64, flags BdrvRequestFlags) error {
+	alignment := int64(bs.BL.PwriteZeroesAlignment)
+	if alignment == 0 {
+		alignment = int64(BDRV_SECTOR_SIZE)
+	}
+	head := offset % alignment
+	tail := (offset + count) % alignment
+
 	var buf []byte
-	if _, err := f.ReadAt(buf, int64(byt)); err != nil {
+	for count > 0 {
+		num := count
+
+		// Align request.  Block drivers can expect the "bulk" of the request
+		// to be aligned, and that unaligned requests do not cross cluster
+		// boundaries.
+		if head != 0 {
+			// Make a small request up to the first aligned sector.
+			if num > alignment-head {
+				num = alignment - head
+			}
+			head = (head + num) % alignment
+		} else if tail != 0 && num > alignment {
+			// Shorten the request to the last aligned sector.
+			num -= tail
+		}
+
+		err := error(syscall.ENOTSUP)
+		if bs.Drv.bdrvCoPwriteZeroes != nil {
+			err = bs.Drv.bdrvCoPwriteZeroes(ctx, bs, offset, num, flags&^BDRV_REQ_FUA)
+		}
+
+		if errors.Is(err, syscall.ENOTSUP) {
+			// Fall back to bounce buffer if write zeroes is unsupported
+			if buf == nil {
+				bufSize := count
+				if bufSize > MAX_WRITE_ZEROES_BOUNCE_BUFFER*int64(BDRV_SECTOR_SIZE) {
+					bufSize = MAX_WRITE_ZEROES_BOUNCE_BUFFER * int64(BDRV_SECTOR_SIZE)
+				}
+				buf = bufPoolGet(int(bdrvOptMemAlign(bs)), int(bufSize))
+				defer bufPoolPut(buf)
+				for i := range buf {
+					buf[i] = 0
+				}
+			}
+
+			err = nil
+			for done := int64(0); done < num && err == nil; {
+				n := num - done
+				if n > int64(len(buf)) {
+					n = int64(len(buf))
+				}
+				err = bdrvDriverPwritev(ctx, bs, offset+done, buf[:n], 0)
+				done += n
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		offset += num
+		count -= num
+	}
+
+	return nil
+}
+
+// bdrvCoPdiscard discards the guest data of bs from offset to offset+count.
+// The discard is advisory, so the unaligned head and tail which the format driver can not discard are ignored.
+//  block/io.c: int coroutine_fn bdrv_co_pdiscard(BlockDriverState *bs, int64_t offset, int count)
+func bdrvCoPdiscard(ctx context.Context, bs *BlockDriverState, offset, count int64) error {
+	if bs == nil || bs.Drv == nil {
+		return ENOMEDIUM
+	}
+	if bs.ReadOnly {
+		return ErrReadOnly
+	}
+	if offset < 0 || count < 0 {
+		return syscall.EIO
+	}
+
+	if bs.Drv.bdrvCoPdiscard == nil {
+		return nil
+	}
+
+	req := trackedRequestBegin(bs, offset, count, true)
+	defer trackedRequestEnd(req)
+	waitSerialisingRequests(req)
+
+	align := int64(bs.BL.PdiscardAlignment)
+	if align < int64(BDRV_SECTOR_SIZE) {
+		align = int64(BDRV_SECTOR_SIZE)
+	}
+	head := offset % align
+	tail := (offset + count) % align
+
+	for count > 0 {
+		num := count
+
+		if head != 0 {
+			// Make small requests to get to alignment boundaries.
+			if num > align-head {
+				num = align - head
+			}
+			head = (head + num) % align
+		} else if tail != 0 && num > align {
+			num -= tail
+		}
+
+		if err := bs.Drv.bdrvCoPdiscard(ctx, bs, offset, num); err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			return err
+		}
+
+		offset += num
+		count -= num
+	}
+
+	bs.mu.Lock()
+	bs.WriteGen++
+	bs.mu.Unlock()
+
+	return nil
+}
+
+// bdrvPdiscard discards the range of the child image file, such as by punching a hole in the host file.
+// The discard is advisory, returns ENOTSUP if the backend does not support it.
+//  block/io.c: int coroutine_fn bdrv_co_pdiscard(BlockDriverState *bs, int64_t offset, int count)
+func bdrvPdiscard(child *BdrvChild, offset, count int64) error {
+	if child == nil || child.bs == nil || child.bs.File == nil {
+		return ENOMEDIUM
+	}
+	if count <= 0 {
+		return nil
+	}
+
+	d, ok := child.bs.File.(backendDiscarder)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return d.Discard(offset, count)
+}
+
+// bdrvCoCopyRange copies bytes of the guest data of src at srcOff to the guest data of dst at dstOff through
+// the format drivers, without reading the data into the memory. Returns ENOTSUP if the format drivers or the
+// image files can not copy the range, then the caller reads and writes the data instead. The range copied
+// before ENOTSUP is returned is written again by the caller, so the copy may be retried as a whole.
+//  block/io.c: int coroutine_fn bdrv_co_copy_range(BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func bdrvCoCopyRange(ctx context.Context, src *BlockDriverState, srcOff int64, dst *BlockDriverState, dstOff, bytes int64) error {
+	if src == nil || src.Drv == nil || dst == nil || dst.Drv == nil {
+		return ENOMEDIUM
+	}
+	if dst.ReadOnly {
+		return ErrReadOnly
+	}
+	if srcOff < 0 || dstOff < 0 || bytes < 0 {
+		return syscall.EIO
+	}
+	if bytes == 0 {
+		return nil
+	}
+
+	// the requests of the same image would wait for each other, and the zero detection needs the data
+	if src == dst || dst.DetectZeroes != DETECT_ZEROES_OFF ||
+		src.Drv.bdrvCoCopyRangeFrom == nil || dst.Drv.bdrvCoCopyRangeTo == nil {
+		return syscall.ENOTSUP
+	}
+	// the unaligned request needs the padding of the head and the tail, which is read into the memory
+	for _, align := range []int64{int64(src.BL.RequestAlignment), int64(dst.BL.RequestAlignment)} {
+		if align > 1 && (srcOff|dstOff|bytes)&(align-1) != 0 {
+			return syscall.ENOTSUP
+		}
+	}
+
+	rreq := trackedRequestBegin(src, srcOff, bytes, false)
+	defer trackedRequestEnd(rreq)
+	waitSerialisingRequests(rreq)
+
+	wreq := trackedRequestBegin(dst, dstOff, bytes, true)
+	defer trackedRequestEnd(wreq)
+	markRequestSerialising(wreq, bdrvGetClusterSize(dst))
+	waitSerialisingRequests(wreq)
+
+	err := src.Drv.bdrvCoCopyRangeFrom(ctx, src, srcOff, dst, dstOff, bytes)
+	bdrvCoWriteReqFinish(dst, dstOff, bytes, err)
+
+	return err
+}
+
+// bdrvCoCopyRangeTo copies bytes of the src image file at srcOff to the guest data of bs at offset, which is
+// called by bdrvCoCopyRangeFrom of the source driver.
+//  block/io.c: int coroutine_fn bdrv_co_copy_range_to(BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func bdrvCoCopyRangeTo(ctx context.Context, src *BdrvChild, srcOff int64, bs *BlockDriverState, offset, bytes int64) error {
+	if bs.Drv.bdrvCoCopyRangeTo == nil {
+		return syscall.ENOTSUP
+	}
+	return bs.Drv.bdrvCoCopyRangeTo(ctx, src, srcOff, bs, offset, bytes)
+}
+
+// bdrvCopyRange copies bytes of the src image file at srcOff to the dst image file at dstOff, such as by the
+// reflink of the host file system. Returns ENOTSUP if the backend does not support it.
+//  block/file-posix.c: static int coroutine_fn raw_co_copy_range_to(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func bdrvCopyRange(src *BdrvChild, srcOff int64, dst *BdrvChild, dstOff, bytes int64) error {
+	if src == nil || src.bs == nil || src.bs.File == nil || dst == nil || dst.bs == nil || dst.bs.File == nil {
+		return ENOMEDIUM
+	}
+	if bytes <= 0 {
+		return nil
+	}
+
+	c, ok := dst.bs.File.(backendCopier)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return c.CopyRangeFrom(src.bs.File, srcOff, dstOff, bytes)
+}
+
+// bdrvPwrite writes buf to the child image file at offset.
+// Return nil on success, err on error.
+//  block/io.c: int bdrv_pwrite(BdrvChild *child, int64_t offset, const void *buf, int bytes)
+func bdrvPwrite(child *BdrvChild, offset int64, buf []byte) error {
+	if child == nil || child.bs == nil || child.bs.File == nil {
+		return ENOMEDIUM
+	}
+	if offset < 0 {
+		return syscall.EIO
+	}
+
+	_, err := child.bs.File.WriteAt(buf, offset)
+	return err
+}
+
+// bdrvPwriteSync writes buf to the child image file at offset, and flushes the image file.
+//  block/io.c: int bdrv_pwrite_sync(BdrvChild *child, int64_t offset, const void *buf, int count)
+func bdrvPwriteSync(child *BdrvChild, offset int64, buf []byte) error {
+	if err := bdrvPwrite(child, offset, buf); err != nil {
 		return err
 	}
 
-	res = &buf
+	return bdrvFlush(child)
+}
+
+// bdrvCoFlush writes the data cached by the format driver of bs to the image file, and flushes the image file
+// if bs is written after the last flush.
+//  block/io.c: int coroutine_fn bdrv_co_flush(BlockDriverState *bs)
+func bdrvCoFlush(bs *BlockDriverState) error {
+	return bdrvCoDoFlush(bs, false)
+}
+
+// bdrvCoSync is like bdrvCoFlush, but always flushes the image file even if bs is not written after the last
+// flush, so the metadata which is updated without the guest writes, such as by the snapshots, is on the disk.
+func bdrvCoSync(bs *BlockDriverState) error {
+	return bdrvCoDoFlush(bs, true)
+}
+
+// bdrvCoDoFlush writes the data cached by the format driver of bs to the image file, and flushes the image
+// file if force is true or bs is written after the last flush.
+func bdrvCoDoFlush(bs *BlockDriverState, force bool) error {
+	if bs == nil || bs.Drv == nil || bs.ReadOnly {
+		return nil
+	}
+
+	bs.mu.Lock()
+	currentGen := bs.WriteGen
+	flushedGen := bs.FlushedGen
+	bs.mu.Unlock()
+
+	// Write back cached data to the OS
+	if bs.Drv.bdrvCoFlushToOS != nil {
+		if err := bs.Drv.bdrvCoFlushToOS(bs); err != nil {
+			return err
+		}
+	}
+
+	// Check if we really need to flush anything
+	if force || flushedGen != currentGen {
+		if err := bdrvFlush(bs.file); err != nil {
+			return err
+		}
+	}
+
+	bs.mu.Lock()
+	bs.FlushedGen = currentGen
+	bs.mu.Unlock()
+
 	return nil
 }
+
+// bdrvFlush flushes the child image file to the disk.
+//  block/io.c: int bdrv_flush(BlockDriverState *bs)
+func bdrvFlush(child *BdrvChild) error {
+	if child == nil || child.bs == nil || child.bs.File == nil {
+		return ENOMEDIUM
+	}
+
+	return child.bs.File.Sync()
+}
+
+// bdrvDrainedBegin begins a quiesced section of bs.
+// Waits for the in-flight requests to complete, and the new requests are not processed
+// until the matching bdrvDrainedEnd is called.
+//  block/io.c: void bdrv_drained_begin(BlockDriverState *bs)
+func bdrvDrainedBegin(bs *BlockDriverState) {
+	bs.quiesce.Lock()
+	bs.QuiesceCounter++
+}
+
+// bdrvDrainedEnd ends a quiesced section of bs.
+//  block/io.c: void bdrv_drained_end(BlockDriverState *bs)
+func bdrvDrainedEnd(bs *BlockDriverState) {
+	bs.QuiesceCounter--
+	bs.quiesce.Unlock()
+}
+
+// bdrvIncInFlight marks the start of a request of bs.
+// Blocks while bs is in the quiesced section.
+//  block/io.c: void bdrv_inc_in_flight(BlockDriverState *bs)
+func bdrvIncInFlight(bs *BlockDriverState) {
+	bs.quiesce.RLock()
+}
+
+// bdrvDecInFlight marks the end of a request of bs.
+//  block/io.c: void bdrv_dec_in_flight(BlockDriverState *bs)
+func bdrvDecInFlight(bs *BlockDriverState) {
+	bs.quiesce.RUnlock()
+}
+
+// trackedRequestBegin adds the request of bytes at offset to the in-flight requests of bs.
+// The caller must end the request by trackedRequestEnd.
+//  block/io.c: static void tracked_request_begin(BdrvTrackedRequest *req, BlockDriverState *bs, int64_t offset, unsigned int bytes, enum BdrvTrackedRequestType type)
+func trackedRequestBegin(bs *BlockDriverState, offset, bytes int64, isWrite bool) *BdrvTrackedRequest {
+	req := &BdrvTrackedRequest{
+		bs:            bs,
+		Offset:        offset,
+		Bytes:         bytes,
+		IsWrite:       isWrite,
+		OverlapOffset: offset,
+		OverlapBytes:  bytes,
+		waitQueue:     make(chan struct{}),
+	}
+
+	bs.mu.Lock()
+	bs.TrackedRequests = append(bs.TrackedRequests, req)
+	bs.mu.Unlock()
+
+	return req
+}
+
+// markRequestSerialising marks req as serialising, and extends the overlap range of req to the align boundaries.
+//  block/io.c: static void mark_request_serialising(BdrvTrackedRequest *req, uint64_t align)
+func markRequestSerialising(req *BdrvTrackedRequest, align int64) {
+	overlapOffset := req.Offset &^ (align - 1)
+	overlapBytes := roundUp(req.Offset+req.Bytes, align) - overlapOffset
+
+	bs := req.bs
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if !req.Serialising {
+		bs.SerialisingInFlight++
+		req.Serialising = true
+	}
+
+	if req.OverlapOffset > overlapOffset {
+		req.OverlapOffset = overlapOffset
+	}
+	if req.OverlapBytes < overlapBytes {
+		req.OverlapBytes = overlapBytes
+	}
+}
+
+// trackedRequestEnd removes req from the in-flight requests, and wakes up the requests waiting for it.
+//  block/io.c: static void tracked_request_end(BdrvTrackedRequest *req)
+func trackedRequestEnd(req *BdrvTrackedRequest) {
+	bs := req.bs
+	bs.mu.Lock()
+	if req.Serialising {
+		bs.SerialisingInFlight--
+	}
+	for i, r := range bs.TrackedRequests {
+		if r == req {
+			bs.TrackedRequests = append(bs.TrackedRequests[:i], bs.TrackedRequests[i+1:]...)
+			break
+		}
+	}
+	bs.mu.Unlock()
+
+	close(req.waitQueue)
+}
+
+// trackedRequestOverlaps reports whether req overlaps the range of bytes at offset.
+//  block/io.c: static bool tracked_request_overlaps(BdrvTrackedRequest *req, int64_t offset, unsigned int bytes)
+func trackedRequestOverlaps(req *BdrvTrackedRequest, offset, bytes int64) bool {
+	//        aaaa   bbbb
+	if offset >= req.OverlapOffset+req.OverlapBytes {
+		return false
+	}
+	// bbbb   aaaa
+	if req.OverlapOffset >= offset+bytes {
+		return false
+	}
+	return true
+}
+
+// waitSerialisingRequests waits until the overlapping requests which are started before self are completed,
+// if self or them are serialising. Reports whether self waited.
+//  block/io.c: static bool coroutine_fn wait_serialising_requests(BdrvTrackedRequest *self)
+func waitSerialisingRequests(self *BdrvTrackedRequest) bool {
+	bs := self.bs
+	waited := false
+
+	for {
+		var wait *BdrvTrackedRequest
+
+		bs.mu.Lock()
+		if bs.SerialisingInFlight == 0 {
+			bs.mu.Unlock()
+			return waited
+		}
+		for _, req := range bs.TrackedRequests {
+			// the requests started after self wait for self instead
+			if req == self {
+				break
+			}
+			if !req.Serialising && !self.Serialising {
+				continue
+			}
+			if trackedRequestOverlaps(req, self.OverlapOffset, self.OverlapBytes) {
+				wait = req
+				break
+			}
+		}
+		bs.mu.Unlock()
+
+		if wait == nil {
+			return waited
+		}
+		<-wait.waitQueue
+		waited = true
+	}
+}
+
+// bdrvGetClusterSize returns the cluster size of bs, or the request alignment if bs has no cluster.
+//  block/io.c: static int bdrv_get_cluster_size(BlockDriverState *bs)
+func bdrvGetClusterSize(bs *BlockDriverState) int64 {
+	if bs.Drv.bdrvGetInfo != nil {
+		if bdi := bs.Drv.bdrvGetInfo(bs); bdi.clusterSize > 0 {
+			return int64(bdi.clusterSize)
+		}
+	}
+	if bs.BL.RequestAlignment > 0 {
+		return int64(bs.BL.RequestAlignment)
+	}
+
+	return int64(BDRV_SECTOR_SIZE)
+}
+
+// bdrvBlockStatus returns the allocation status of the bs at offset, n bytes that
+// have the same status, and the host offset if BDRV_BLOCK_OFFSET_VALID is set.
+//  block/io.c: static int64_t coroutine_fn bdrv_co_get_block_status(BlockDriverState *bs, int64_t sector_num, int nb_sectors, int *pnum, BlockDriverState **file)
+func bdrvBlockStatus(bs *BlockDriverState, offset, bytes int64) (int, int64, int64, error) {
+	totalSize, err := getlength(bs)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if offset >= totalSize {
+		return BDRV_BLOCK_EOF, 0, 0, nil
+	}
+	if bytes > totalSize-offset {
+		bytes = totalSize - offset
+	}
+
+	if bs.Drv.bdrvCoGetBlockStatus == nil {
+		return BDRV_BLOCK_DATA | BDRV_BLOCK_ALLOCATED | BDRV_BLOCK_OFFSET_VALID, bytes, offset, nil
+	}
+
+	status, n, mapOffset, err := bs.Drv.bdrvCoGetBlockStatus(bs, offset, bytes)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if status&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO) != 0 {
+		status |= BDRV_BLOCK_ALLOCATED
+	} else if bs.Backing == nil {
+		// unallocated area of the image which has no backing file reads as zeros
+		status |= BDRV_BLOCK_ZERO
+	}
+
+	return status, n, mapOffset, nil
+}
+
+// bdrvBlockStatusAbove walks the backing chain of bs until the layer which allocated offset is found.
+// Returns the status, n bytes that have the same status, the host offset and the depth of layer.
+//  block/io.c: static int64_t coroutine_fn bdrv_co_get_block_status_above(BlockDriverState *bs, BlockDriverState *base, int64_t sector_num, int nb_sectors, int *pnum, BlockDriverState **file)
+func bdrvBlockStatusAbove(bs *BlockDriverState, offset, bytes int64) (int, int64, int64, int, error) {
+	var depth int
+	for {
+		status, n, mapOffset, err := bdrvBlockStatus(bs, offset, bytes)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if status&BDRV_BLOCK_EOF != 0 {
+			// the backing file is shorter than the top image
+			return 0, bytes, 0, depth, nil
+		}
+		if status&(BDRV_BLOCK_DATA|BDRV_BLOCK_ZERO) != 0 || bs.Backing == nil {
+			return status, n, mapOffset, depth, nil
+		}
+
+		bs = bs.Backing.bs
+		bytes = n
+		depth++
+	}
+}
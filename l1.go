@@ -0,0 +1,135 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// L1_SEGMENT_SIZE the number of the entries of the segment of the active L1 table, which is loaded from the
+// image file at once. The segment of 4 KiB maps 256 GiB of the guest disk of the image with the 64 KiB clusters.
+const L1_SEGMENT_SIZE = 512
+
+// l1Table is the active L1 table of the image. The segments of L1_SEGMENT_SIZE entries are loaded from the
+// image file on the first access, so opening the large image does not read the whole L1 table, and only the
+// segments of the guest disk which is accessed are held in the memory, same as its L2 tables which are held
+// by the L2 table cache. The whole table is loaded only by the operations which walk all of the L2 tables,
+// such as the snapshots and the check.
+//
+// The entries are read with s.lock held for reading and written with it held for writing, and mu serializes
+// the loading of the segments by the concurrent readers.
+type l1Table struct {
+	// offset the offset of the table in the image file, which the segments are loaded from.
+	offset uint64
+	// size the number of the entries.
+	size int
+
+	mu sync.Mutex
+	// segs the segments of the table, which are nil until loaded.
+	segs [][]uint64
+}
+
+// newL1Table returns the L1 table of size entries at offset of the image file, which is not loaded yet.
+func newL1Table(offset uint64, size int) *l1Table {
+	return &l1Table{
+		offset: offset,
+		size:   size,
+		segs:   make([][]uint64, (size+L1_SEGMENT_SIZE-1)/L1_SEGMENT_SIZE),
+	}
+}
+
+// newL1TableFrom returns the L1 table of entries at offset of the image file, which is already loaded.
+func newL1TableFrom(offset uint64, entries []uint64) *l1Table {
+	t := newL1Table(offset, len(entries))
+	for i := range t.segs {
+		end := MIN((i+1)*L1_SEGMENT_SIZE, len(entries))
+		t.segs[i] = append([]uint64(nil), entries[i*L1_SEGMENT_SIZE:end]...)
+	}
+	return t
+}
+
+// segment returns the segment seg of t, which is loaded from the image file of bs if needed.
+// The caller must hold t.mu.
+func (t *l1Table) segment(bs *BlockDriverState, seg int) ([]uint64, error) {
+	if t.segs[seg] != nil {
+		return t.segs[seg], nil
+	}
+
+	start := seg * L1_SEGMENT_SIZE
+	n := MIN(L1_SEGMENT_SIZE, t.size-start)
+	buf := make([]byte, n*UINT64_SIZE)
+	if err := bdrvPread(bs.file, int64(t.offset)+int64(start)*UINT64_SIZE, buf); err != nil {
+		err = errors.Wrap(err, "Could not read L1 table")
+		return nil, err
+	}
+
+	entries := make([]uint64, n)
+	for i := range entries {
+		entries[i] = BEUint64(buf[i*UINT64_SIZE:])
+	}
+	t.segs[seg] = entries
+
+	return entries, nil
+}
+
+// get returns the entry i of t.
+func (t *l1Table) get(bs *BlockDriverState, i int) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seg, err := t.segment(bs, i/L1_SEGMENT_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	return seg[i%L1_SEGMENT_SIZE], nil
+}
+
+// set sets the entry i of t to e in the memory. The entry is written to the image file by writeL1Entry.
+func (t *l1Table) set(bs *BlockDriverState, i int, e uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seg, err := t.segment(bs, i/L1_SEGMENT_SIZE)
+	if err != nil {
+		return err
+	}
+	seg[i%L1_SEGMENT_SIZE] = e
+	return nil
+}
+
+// entries returns the copy of the whole table, which loads all of the segments of t.
+func (t *l1Table) entries(bs *BlockDriverState) ([]uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]uint64, 0, t.size)
+	for i := range t.segs {
+		seg, err := t.segment(bs, i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, seg...)
+	}
+	return entries, nil
+}
+
+// loadedEntries calls fn with the index and the value of the entries of the loaded segments of t, until fn
+// returns false.
+func (t *l1Table) loadedEntries(fn func(i int, e uint64) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, seg := range t.segs {
+		for j, e := range seg {
+			if !fn(i*L1_SEGMENT_SIZE+j, e) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layers
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// The errors returned by the Store. The returned errors wrap them with the message, so use errors.Is to test
+// them. Each error also wraps the errno of the failure.
+var (
+	// ErrInvalidDigest the digest is not the valid content address of the layer.
+	ErrInvalidDigest error = qcow2.NewError(syscall.EINVAL, "invalid digest")
+	// ErrInvalidName the name of the tag or the overlay is not the single path element.
+	ErrInvalidName error = qcow2.NewError(syscall.EINVAL, "invalid name")
+	// ErrInvalidLayer the image is not the valid layer, such as the image whose backing file is not in the store.
+	ErrInvalidLayer error = qcow2.NewError(syscall.EINVAL, "invalid layer")
+	// ErrOverlayExists the overlay of the name already exists.
+	ErrOverlayExists error = qcow2.NewError(syscall.EEXIST, "overlay already exists")
+)
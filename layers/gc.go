@@ -0,0 +1,92 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layers
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// GC removes the layers which are not reachable from the tags and the overlays through the backing chains, and
+// returns their digests. The overlays which are in use are also the roots. It fails without removing any layer
+// if the tag or the overlay can not be read, so the layer of the broken reference is not removed.
+func (s *Store) GC(ctx context.Context) ([]Digest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// mark
+	var roots []Digest
+	tags, err := listNames(s.path(refsDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tags {
+		d, err := s.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, d)
+	}
+	overlays, err := listNames(s.path(overlaysDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range overlays {
+		info, err := s.inspect(s.path(overlaysDir, name), true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not inspect the overlay '%s'", name)
+		}
+		d, err := s.parent(info)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not inspect the overlay '%s'", name)
+		}
+		if d != "" {
+			roots = append(roots, d)
+		}
+	}
+
+	reachable := make(map[Digest]bool)
+	for _, d := range roots {
+		for d != "" && !reachable[d] {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			reachable[d] = true
+			info, err := s.inspect(s.layerPath(d), false)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not inspect the layer '%s'", d)
+			}
+			if d, err = s.parent(info); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// sweep
+	digests, err := s.layerDigests()
+	if err != nil {
+		return nil, err
+	}
+	var removed []Digest
+	for _, d := range digests {
+		if reachable[d] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if err := os.Remove(s.layerPath(d)); err != nil {
+			return removed, errors.Wrapf(err, "Could not remove the layer '%s'", d)
+		}
+		removed = append(removed, d)
+	}
+	if len(removed) > 0 {
+		syncDir(s.path(layersDir))
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// Overlay the information of the overlay.
+type Overlay struct {
+	// Name the name of the overlay.
+	Name string
+	// Parent the digest of the backing layer, which is empty if the overlay has no backing layer.
+	Parent Digest
+	// Size the size of the image file in bytes.
+	Size int64
+	// VirtualSize the virtual disk size of the image in bytes.
+	VirtualSize int64
+}
+
+// CreateOverlay creates the overlay of name on top of the layer of parent, and opens it as read-write.
+// The virtual disk size of the overlay is size, or the size of the parent if size is zero. If parent is empty,
+// the overlay has no backing layer, and size must not be zero. The options are passed to qcow2.CreateImage,
+// which must not include WithBackingFile.
+func (s *Store) CreateOverlay(name string, parent Digest, size int64, options ...qcow2.Option) (*qcow2.QCow2, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if parent != "" {
+		if err := parent.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := s.path(overlaysDir, name)
+	if _, err := os.Lstat(filename); err == nil {
+		return nil, errors.Wrapf(ErrOverlayExists, "The overlay '%s' already exists", name)
+	}
+
+	if parent != "" {
+		if _, err := os.Stat(s.layerPath(parent)); err != nil {
+			return nil, errors.Wrapf(err, "Could not find the layer '%s'", parent)
+		}
+		options = append([]qcow2.Option{qcow2.WithBackingFile(layerBacking(parent), qcow2.DriverQCow2)}, options...)
+	}
+
+	img, err := qcow2.CreateImage(filename, size, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not create the overlay '%s'", name)
+	}
+	return img, nil
+}
+
+// OpenOverlay opens the overlay of name with the open flag, such as os.O_RDWR.
+func (s *Store) OpenOverlay(name string, flag int) (*qcow2.QCow2, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return qcow2.OpenFileFormat(s.path(overlaysDir, name), qcow2.DriverQCow2, flag)
+}
+
+// Overlays returns the overlays of the store in the order of their names. The overlays which are in use are
+// also inspected.
+func (s *Store) Overlays() ([]Overlay, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := listNames(s.path(overlaysDir))
+	if err != nil {
+		return nil, err
+	}
+	overlays := make([]Overlay, 0, len(names))
+	for _, name := range names {
+		filename := s.path(overlaysDir, name)
+		info, err := s.inspect(filename, true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not inspect the overlay '%s'", name)
+		}
+		parent, err := s.parent(info)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not inspect the overlay '%s'", name)
+		}
+		overlay := Overlay{
+			Name:        name,
+			Parent:      parent,
+			Size:        info.ActualSize,
+			VirtualSize: info.VirtualSize,
+		}
+		if fi, err := os.Stat(filename); err == nil {
+			overlay.Size = fi.Size()
+		}
+		overlays = append(overlays, overlay)
+	}
+	return overlays, nil
+}
+
+// RemoveOverlay removes the overlay of name. It fails with qcow2.ErrLocked if the overlay is in use.
+func (s *Store) RemoveOverlay(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := s.path(overlaysDir, name)
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDWR, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not remove the overlay '%s'", name)
+	}
+	img.Close()
+
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	syncDir(s.path(overlaysDir))
+	return nil
+}
+
+// Commit turns the overlay of name into the layer, and returns its digest. The overlay is removed, and the new
+// overlay can be created on top of the layer to continue the changes. The overlay must not be in use, and must
+// be closed cleanly. The layer is the overlay image file as is, which has the changes since its parent layer,
+// so the parent is kept by GC while the layer is reachable.
+func (s *Store) Commit(ctx context.Context, name string) (Digest, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := s.path(overlaysDir, name)
+
+	// the shared lock of the image keeps the overlay from being opened for writing while it is hashed
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not commit the overlay '%s'", name)
+	}
+	d, err := s.hashOverlay(ctx, img, filename)
+	img.Close()
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not commit the overlay '%s'", name)
+	}
+
+	if err := s.storeLayer(filename, d); err != nil {
+		return "", err
+	}
+	syncDir(s.path(overlaysDir))
+
+	return d, nil
+}
+
+// hashOverlay validates the overlay image img of filename as the layer, and returns the digest of the image file.
+// The caller must hold s.mu.
+func (s *Store) hashOverlay(ctx context.Context, img *qcow2.QCow2, filename string) (Digest, error) {
+	info, err := img.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.DirtyFlag {
+		return "", errors.Wrap(qcow2.ErrDirty, "The image is not closed cleanly")
+	}
+	if _, err := s.parent(info); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := copyContext(ctx, h, f); err != nil {
+		return "", err
+	}
+	return Digest(digestAlgorithm + hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// Verify recomputes the digest of the layer of d, and returns the error if the image file is modified.
+func (s *Store) Verify(ctx context.Context, d Digest) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.layerPath(d))
+	if err != nil {
+		return errors.Wrapf(err, "Could not find the layer '%s'", d)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := copyContext(ctx, h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != d.Hex() {
+		return errors.Wrapf(qcow2.ErrCorrupt, "The layer '%s' has the digest %s%s", d, digestAlgorithm, actual)
+	}
+	return nil
+}
+
+// Export writes the image file of the layer of d to w. The layer refers its parent as the backing file, so the
+// parents must be exported and imported first.
+func (s *Store) Export(ctx context.Context, d Digest, w io.Writer) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	f, err := os.Open(s.layerPath(d))
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "Could not find the layer '%s'", d)
+	}
+	defer f.Close()
+
+	_, err = copyContext(ctx, w, f)
+	return err
+}
@@ -0,0 +1,518 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package layers manages the content-addressed store of the qcow2 layers, and the writable qcow2 overlays on top
+// of them, which are the plumbing of the container-style snapshotter of the VM disks.
+//
+// The Store is the directory which has the following layout:
+//
+//  layers/<hex>    the immutable layer, whose name is the hex of the SHA-256 digest of the image file
+//  overlays/<name> the writable overlay, which is created by CreateOverlay
+//  refs/<name>     the tag, which has the digest of the layer
+//  tmp/            the temporary files of Import and the other operations
+//
+// The layers and the overlays are chained by the backing files of the qcow2 images, whose names are the relative
+// paths "../layers/<hex>", so the store can be moved or copied as a whole, and the images can be opened by qemu
+// directly. The base layer has no backing file. The overlay becomes the layer by Commit, and the layers which are
+// not reachable from the tags and the overlays are removed by GC:
+//
+//  s, err := layers.Open("/var/lib/vm-disks")
+//  base, err := s.ImportFile(ctx, "ubuntu.qcow2")
+//  err = s.Tag("ubuntu", base)
+//  img, err := s.CreateOverlay("vm0", base, 0)
+//  ... boot the VM on img, and close it
+//  layer, err := s.Commit(ctx, "vm0")
+//  removed, err := s.GC(ctx)
+//
+// The operations of the Store are serialized within the process, and the images are locked by the image
+// locking of qcow2 against the other processes, but GC must not run concurrently with the other processes
+// which create the overlays in the same store.
+package layers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// The directories of the store.
+const (
+	layersDir   = "layers"
+	overlaysDir = "overlays"
+	refsDir     = "refs"
+	tmpDir      = "tmp"
+)
+
+// digestAlgorithm the prefix of the digest.
+const digestAlgorithm = "sha256:"
+
+// Digest the content address of the layer, which is "sha256:" and the lower hex of the SHA-256 digest of the
+// image file.
+type Digest string
+
+// Validate returns the error if d is not the valid digest.
+func (d Digest) Validate() error {
+	h := strings.TrimPrefix(string(d), digestAlgorithm)
+	if len(h) != len(d)-len(digestAlgorithm) || len(h) != hex.EncodedLen(sha256.Size) {
+		return errors.Wrapf(ErrInvalidDigest, "Invalid digest '%s'", string(d))
+	}
+	for _, c := range h {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return errors.Wrapf(ErrInvalidDigest, "Invalid digest '%s'", string(d))
+		}
+	}
+	return nil
+}
+
+// Hex returns the hex of the digest without the algorithm.
+func (d Digest) Hex() string {
+	return strings.TrimPrefix(string(d), digestAlgorithm)
+}
+
+// Layer the information of the layer.
+type Layer struct {
+	// Digest the digest of the layer.
+	Digest Digest
+	// Parent the digest of the backing layer, which is empty for the base layer.
+	Parent Digest
+	// Size the size of the image file in bytes.
+	Size int64
+	// VirtualSize the virtual disk size of the image in bytes.
+	VirtualSize int64
+}
+
+// Store the content-addressed store of the layers and the overlays.
+type Store struct {
+	root string
+
+	// mu serializes the operations of the store.
+	mu sync.Mutex
+}
+
+// Open opens the store of the root directory, which is created if it does not exist. The temporary files which
+// are left by the interrupted operations are removed.
+func Open(root string) (*Store, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{layersDir, overlaysDir, refsDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, errors.Wrapf(err, "Could not create the store directory '%s'", root)
+		}
+	}
+
+	s := &Store{root: root}
+	tmps, err := ioutil.ReadDir(s.path(tmpDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range tmps {
+		os.RemoveAll(filepath.Join(s.path(tmpDir), fi.Name()))
+	}
+
+	return s, nil
+}
+
+// Root returns the absolute path of the root directory of the store.
+func (s *Store) Root() string {
+	return s.root
+}
+
+// path returns the path of elem in the store.
+func (s *Store) path(elem ...string) string {
+	return filepath.Join(append([]string{s.root}, elem...)...)
+}
+
+// layerPath returns the path of the layer of d.
+func (s *Store) layerPath(d Digest) string {
+	return s.path(layersDir, d.Hex())
+}
+
+// layerBacking returns the backing file name of the layer of d, which is relative to the directories of the
+// layers and the overlays.
+func layerBacking(d Digest) string {
+	return "../" + layersDir + "/" + d.Hex()
+}
+
+// Import reads the qcow2 image from r, and stores it as the layer. The image must be clean, and must not have the
+// backing file other than the layer in the store, so the base image, and the layer which is exported from the
+// other store with its parents, can be imported. It returns the digest of the layer, which is the existing layer
+// if the store already has the same image.
+func (s *Store) Import(ctx context.Context, r io.Reader) (Digest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := ioutil.TempFile(s.path(tmpDir), "import-")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	_, err = copyContext(ctx, io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Could not import the layer")
+	}
+	d := Digest(digestAlgorithm + hex.EncodeToString(h.Sum(nil)))
+
+	if _, err := s.inspectLayer(tmp); err != nil {
+		return "", errors.Wrap(err, "Could not import the layer")
+	}
+	if err := s.storeLayer(tmp, d); err != nil {
+		return "", err
+	}
+
+	return d, nil
+}
+
+// ImportFile imports the qcow2 image of filename as the layer, same as Import.
+func (s *Store) ImportFile(ctx context.Context, filename string) (Digest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s.Import(ctx, f)
+}
+
+// storeLayer moves the image file of filename into the store as the layer of d, or removes it if the store
+// already has the layer. The layer file is read-only. The caller must hold s.mu.
+func (s *Store) storeLayer(filename string, d Digest) error {
+	dest := s.layerPath(d)
+	if _, err := os.Stat(dest); err == nil {
+		return os.Remove(filename)
+	}
+
+	if err := os.Chmod(filename, 0444); err != nil {
+		return err
+	}
+	if err := os.Rename(filename, dest); err != nil {
+		return errors.Wrapf(err, "Could not store the layer '%s'", d)
+	}
+	syncDir(s.path(layersDir))
+	return nil
+}
+
+// Layer returns the information of the layer of d.
+func (s *Store) Layer(d Digest) (*Layer, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.layer(d)
+}
+
+// layer returns the information of the layer of d. The caller must hold s.mu.
+func (s *Store) layer(d Digest) (*Layer, error) {
+	filename := s.layerPath(d)
+	if _, err := os.Stat(filename); err != nil {
+		return nil, errors.Wrapf(err, "Could not find the layer '%s'", d)
+	}
+	layer, err := s.inspectLayer(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not inspect the layer '%s'", d)
+	}
+	layer.Digest = d
+	return layer, nil
+}
+
+// Layers returns the layers of the store in the order of their digests.
+func (s *Store) Layers() ([]Layer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	digests, err := s.layerDigests()
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]Layer, 0, len(digests))
+	for _, d := range digests {
+		layer, err := s.layer(d)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, *layer)
+	}
+	return layers, nil
+}
+
+// layerDigests returns the digests of the layers in the store. The caller must hold s.mu.
+func (s *Store) layerDigests() ([]Digest, error) {
+	fis, err := ioutil.ReadDir(s.path(layersDir))
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]Digest, 0, len(fis))
+	for _, fi := range fis {
+		d := Digest(digestAlgorithm + fi.Name())
+		if fi.Mode().IsRegular() && d.Validate() == nil {
+			digests = append(digests, d)
+		}
+	}
+	return digests, nil
+}
+
+// OpenLayer opens the image of the layer of d as read-only.
+func (s *Store) OpenLayer(d Digest) (*qcow2.QCow2, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return qcow2.OpenFileFormat(s.layerPath(d), qcow2.DriverQCow2, os.O_RDONLY)
+}
+
+// inspectLayer validates the qcow2 image of filename as the layer, and returns its information without the
+// digest. The caller must hold s.mu.
+func (s *Store) inspectLayer(filename string) (*Layer, error) {
+	format, err := qcow2.DetectFormat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if format != qcow2.DriverQCow2 {
+		return nil, errors.Wrapf(ErrInvalidLayer, "The layer must be the qcow2 image, not %s", format)
+	}
+
+	info, err := s.inspect(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	if info.DirtyFlag {
+		return nil, errors.Wrap(qcow2.ErrDirty, "The image is not closed cleanly")
+	}
+
+	layer := &Layer{
+		Size:        info.ActualSize,
+		VirtualSize: info.VirtualSize,
+	}
+	if fi, err := os.Stat(filename); err == nil {
+		layer.Size = fi.Size()
+	}
+	layer.Parent, err = s.parent(info)
+	if err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// inspect returns the information of the qcow2 image of filename, which is opened without the backing file.
+// The image which is in use by the other process is read if force is true. The caller must hold s.mu.
+func (s *Store) inspect(filename string, force bool) (*qcow2.ImageInfo, error) {
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: true,
+		Force:     force,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	return img.Info()
+}
+
+// parent returns the digest of the backing layer of the image of info, which must be in the store.
+// The caller must hold s.mu.
+func (s *Store) parent(info *qcow2.ImageInfo) (Digest, error) {
+	if info.BackingFilename == "" {
+		return "", nil
+	}
+
+	prefix := layerBacking("")
+	d := Digest(digestAlgorithm + strings.TrimPrefix(info.BackingFilename, prefix))
+	if !strings.HasPrefix(info.BackingFilename, prefix) || d.Validate() != nil {
+		return "", errors.Wrapf(ErrInvalidLayer, "The backing file '%s' is not the layer in the store", info.BackingFilename)
+	}
+	if info.BackingFilenameFormat != "" && info.BackingFilenameFormat != string(qcow2.DriverQCow2) {
+		return "", errors.Wrapf(ErrInvalidLayer, "The backing format of the layer must be qcow2, not %s", info.BackingFilenameFormat)
+	}
+	if _, err := os.Stat(s.layerPath(d)); err != nil {
+		return "", errors.Wrapf(err, "Could not find the parent layer '%s'", d)
+	}
+	return d, nil
+}
+
+// Tag tags the layer of d by name, which replaces the existing tag. The tagged layer and its parents are not
+// removed by GC.
+func (s *Store) Tag(name string, d Digest) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.layerPath(d)); err != nil {
+		return errors.Wrapf(err, "Could not find the layer '%s'", d)
+	}
+
+	f, err := ioutil.TempFile(s.path(tmpDir), "ref-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = f.WriteString(string(d) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path(refsDir, name)); err != nil {
+		return err
+	}
+	syncDir(s.path(refsDir))
+	return nil
+}
+
+// Untag removes the tag of name.
+func (s *Store) Untag(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(refsDir, name)); err != nil {
+		return errors.Wrapf(err, "Could not remove the tag '%s'", name)
+	}
+	return nil
+}
+
+// Resolve returns the digest of the layer which is tagged by name.
+func (s *Store) Resolve(name string) (Digest, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.resolve(name)
+}
+
+// resolve returns the digest of the tag of name. The caller must hold s.mu.
+func (s *Store) resolve(name string) (Digest, error) {
+	buf, err := ioutil.ReadFile(s.path(refsDir, name))
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not find the tag '%s'", name)
+	}
+	d := Digest(strings.TrimSpace(string(buf)))
+	if err := d.Validate(); err != nil {
+		return "", errors.Wrapf(err, "Invalid tag '%s'", name)
+	}
+	return d, nil
+}
+
+// Tags returns the tags of the store, and their digests.
+func (s *Store) Tags() (map[string]Digest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := listNames(s.path(refsDir))
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]Digest, len(names))
+	for _, name := range names {
+		d, err := s.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		tags[name] = d
+	}
+	return tags, nil
+}
+
+// validateName returns the error if name is not the valid name of the tag or the overlay, which is the single
+// path element without the leading dot.
+func validateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return errors.Wrapf(ErrInvalidName, "Invalid name '%s'", name)
+	}
+	return nil
+}
+
+// listNames returns the names of the regular files in dir in the sorted order.
+func listNames(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && validateName(fi.Name()) == nil {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// copyContext copies r to w until EOF, and returns the error of ctx if ctx is done before that.
+func copyContext(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, 1<<20)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// syncDir flushes the directory entries of dir to the disk. It is best effort, since the directory can not be
+// synced on some platforms.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
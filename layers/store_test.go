@@ -0,0 +1,318 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layers
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+const testSize = 4 << 20
+
+// importBase imports the new base image, which has data at off, and returns its digest.
+func importBase(t *testing.T, s *Store, data []byte, off int64) Digest {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "base.qcow2")
+	img, err := qcow2.CreateImage(filename, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := s.ImportFile(context.Background(), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// commitOverlay creates the overlay of name on parent, writes data at off, and commits it.
+func commitOverlay(t *testing.T, s *Store, name string, parent Digest, data []byte, off int64) Digest {
+	t.Helper()
+
+	img, err := s.CreateOverlay(name, parent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := s.Commit(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// readAt reads n bytes of img at off.
+func readAt(t *testing.T, img *qcow2.QCow2, off int64, n int) []byte {
+	t.Helper()
+
+	buf := make([]byte, n)
+	if _, err := img.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// TestStack stacks the layers by committing the overlays, and reads the changes of every layer through the top
+// overlay.
+func TestStack(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseData := bytes.Repeat([]byte("base"), 16<<10)
+	base := importBase(t, s, baseData, 0)
+	if again := importBase(t, s, baseData, 0); again != base {
+		t.Errorf("the same image is imported as %s, want %s", again, base)
+	}
+
+	midData := bytes.Repeat([]byte("mid!"), 16<<10)
+	mid := commitOverlay(t, s, "mid", base, midData, 1<<20)
+	topData := bytes.Repeat([]byte("top!"), 1<<10)
+	top := commitOverlay(t, s, "top", mid, topData, 32<<10)
+
+	for _, tt := range []struct {
+		d, parent Digest
+	}{
+		{base, ""},
+		{mid, base},
+		{top, mid},
+	} {
+		layer, err := s.Layer(tt.d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if layer.Parent != tt.parent || layer.VirtualSize != testSize {
+			t.Errorf("layer %s has the parent %q and size %d, want %q and %d", tt.d, layer.Parent, layer.VirtualSize, tt.parent, testSize)
+		}
+		if err := s.Verify(context.Background(), tt.d); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(s.path(overlaysDir, "mid")); !os.IsNotExist(err) {
+		t.Errorf("the committed overlay is not removed: %v", err)
+	}
+
+	img, err := s.CreateOverlay("vm0", top, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	want := append([]byte(nil), baseData...)
+	copy(want[32<<10:], topData)
+	if got := readAt(t, img, 0, len(baseData)); !bytes.Equal(got, want) {
+		t.Error("the base layer under the top layer is not read through the overlay")
+	}
+	if got := readAt(t, img, 1<<20, len(midData)); !bytes.Equal(got, midData) {
+		t.Error("the middle layer is not read through the overlay")
+	}
+
+	// the layers are not changed by the writes to the overlay
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0xff}, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := s.OpenLayer(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	if got := readAt(t, layer, 0, 4096); !bytes.Equal(got, baseData[:4096]) {
+		t.Error("the base layer is changed by the write to the overlay")
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	raw := filepath.Join(dir, "disk.raw")
+	if err := os.WriteFile(raw, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ImportFile(context.Background(), raw); !errors.Is(err, ErrInvalidLayer) {
+		t.Errorf("import of the raw image = %v, want %v", err, ErrInvalidLayer)
+	}
+
+	// the backing file outside of the store
+	base := filepath.Join(dir, "base.qcow2")
+	img, err := qcow2.CreateImage(base, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	img, err = qcow2.CreateImage(overlay, testSize, qcow2.WithBackingFile(base, qcow2.DriverQCow2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	if _, err := s.ImportFile(context.Background(), overlay); !errors.Is(err, ErrInvalidLayer) {
+		t.Errorf("import of the image with the external backing file = %v, want %v", err, ErrInvalidLayer)
+	}
+
+	layers, err := s.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 0 {
+		t.Errorf("the invalid images are stored as %v", layers)
+	}
+}
+
+func TestOverlayErrors(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := importBase(t, s, []byte("base"), 0)
+
+	for _, name := range []string{"", ".hidden", "a/b", `a\b`} {
+		if _, err := s.CreateOverlay(name, base, 0); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("CreateOverlay(%q) = %v, want %v", name, err, ErrInvalidName)
+		}
+	}
+	if _, err := s.CreateOverlay("vm0", "sha256:1234", 0); !errors.Is(err, ErrInvalidDigest) {
+		t.Errorf("CreateOverlay of the invalid digest = %v, want %v", err, ErrInvalidDigest)
+	}
+	missing := Digest(digestAlgorithm + string(bytes.Repeat([]byte("0"), 64)))
+	if _, err := s.CreateOverlay("vm0", missing, 0); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("CreateOverlay of the missing layer = %v, want not exist", err)
+	}
+
+	img, err := s.CreateOverlay("vm0", base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateOverlay("vm0", base, 0); !errors.Is(err, ErrOverlayExists) {
+		t.Errorf("CreateOverlay of the existing overlay = %v, want %v", err, ErrOverlayExists)
+	}
+	if err := s.RemoveOverlay("vm0"); !errors.Is(err, qcow2.ErrLocked) {
+		t.Errorf("RemoveOverlay of the open overlay = %v, want %v", err, qcow2.ErrLocked)
+	}
+	if _, err := s.Commit(context.Background(), "vm0"); !errors.Is(err, qcow2.ErrLocked) {
+		t.Errorf("Commit of the open overlay = %v, want %v", err, qcow2.ErrLocked)
+	}
+
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveOverlay("vm0"); err != nil {
+		t.Fatal(err)
+	}
+	overlays, err := s.Overlays()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overlays) != 0 {
+		t.Errorf("overlays = %v after the removal", overlays)
+	}
+}
+
+// TestGC removes the layers which are not reachable from the tags and the overlays, and keeps the parents of the
+// reachable layers.
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := importBase(t, s, []byte("base"), 0)
+	tagged := commitOverlay(t, s, "tagged", base, []byte("tagged"), 0)
+	used := commitOverlay(t, s, "used", base, []byte("used"), 0)
+	orphan := commitOverlay(t, s, "orphan", base, []byte("orphan"), 0)
+	other := importBase(t, s, []byte("other"), 0)
+
+	if err := s.Tag("release", tagged); err != nil {
+		t.Fatal(err)
+	}
+	img, err := s.CreateOverlay("vm0", used, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	removed, err := s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Digest]bool{orphan: true, other: true}
+	if len(removed) != len(want) {
+		t.Errorf("GC removed %v, want %v", removed, want)
+	}
+	for _, d := range removed {
+		if !want[d] {
+			t.Errorf("GC removed the reachable layer %s", d)
+		}
+	}
+	for _, d := range []Digest{base, tagged, used} {
+		if _, err := s.Layer(d); err != nil {
+			t.Errorf("the reachable layer is removed: %v", err)
+		}
+	}
+
+	// the layers are collected after the references are removed
+	if err := s.Untag("release"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveOverlay("vm0"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err = s.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Errorf("GC removed %v, want all of the 3 layers", removed)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := importBase(t, s, []byte("base"), 0)
+
+	filename := s.layerPath(d)
+	if err := os.Chmod(filename, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tampered"))
+	f.Close()
+
+	if err := s.Verify(context.Background(), d); !errors.Is(err, qcow2.ErrCorrupt) {
+		t.Errorf("Verify of the modified layer = %v, want %v", err, qcow2.ErrCorrupt)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package qcow2
+
+import (
+	"os"
+)
+
+// closeBeforeRename keeps the old image file open until the new image replaces it.
+const closeBeforeRename = false
+
+// lockFile is not supported on this platform, so the image file is not locked.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
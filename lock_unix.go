@@ -0,0 +1,35 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+)
+
+// closeBeforeRename keeps the old image file open, and locked, until the new image replaces it.
+const closeBeforeRename = false
+
+// lockFile takes the advisory lock of the whole file without blocking, which is exclusive if exclusive is true,
+// and shared otherwise. It returns EAGAIN if the conflicting lock is held by the other open file description.
+// The lock is released when the file is closed.
+//  block/file-posix.c: static int raw_apply_lock_bytes(BDRVRawState *s, int fd, uint64_t perm_lock_bits, uint64_t shared_perm_lock_bits, bool unlock, Error **errp)
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return syscall.EAGAIN
+	}
+	return err
+}
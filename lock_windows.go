@@ -0,0 +1,61 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32    = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = modkernel32.NewProc("LockFileEx")
+)
+
+const (
+	// LOCKFILE_FAIL_IMMEDIATELY returns immediately if the lock can not be acquired.
+	LOCKFILE_FAIL_IMMEDIATELY = 0x00000001
+	// LOCKFILE_EXCLUSIVE_LOCK requests the exclusive lock.
+	LOCKFILE_EXCLUSIVE_LOCK = 0x00000002
+
+	// ERROR_LOCK_VIOLATION the process cannot access the file because another process has locked a portion of the file.
+	ERROR_LOCK_VIOLATION syscall.Errno = 33
+)
+
+// closeBeforeRename closes the old image file before the new image replaces it, since the file which is open can
+// not be replaced on windows. The old image file is unlocked until the rename.
+const closeBeforeRename = true
+
+// lockOffset the offset of the byte which is locked. The locks of windows are mandatory, so the byte far beyond the
+// end of any image file is locked, and the reads and the writes of the image file by the other processes are not denied.
+const lockOffset = 0x7fffffffffffff00
+
+// lockFile takes the lock of the file without blocking, which is exclusive if exclusive is true, and shared
+// otherwise. It returns EAGAIN if the conflicting lock is held by the other handle. The lock is released
+// when the file is closed.
+//  block/file-posix.c: static int raw_apply_lock_bytes(BDRVRawState *s, int fd, uint64_t perm_lock_bits, uint64_t shared_perm_lock_bits, bool unlock, Error **errp)
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uint32(LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	ol := &syscall.Overlapped{
+		Offset:     uint32(lockOffset & 0xffffffff),
+		OffsetHigh: uint32(lockOffset >> 32),
+	}
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		if err == ERROR_LOCK_VIOLATION {
+			return syscall.EAGAIN
+		}
+		return err
+	}
+
+	return nil
+}
@@ -8,9 +8,105 @@ package qcow2
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	"sync/atomic"
 )
 
+// LogLevel represents the severity of the diagnostic message of the image.
+type LogLevel int
+
+const (
+	// LogDebug the message for debugging the image handling.
+	LogDebug LogLevel = iota
+	// LogInfo the message of the normal but significant event, such as the header update on open.
+	LogInfo
+	// LogWarn the message of the unexpected event, which does not fail the request.
+	LogWarn
+	// LogError the message of the error, such as the corruption of the image.
+	LogError
+)
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warning"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives the diagnostic messages of the images. The messages are formatted by fmt.Sprintf.
+// Logf may be called concurrently by multiple goroutines.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// loggerHolder holds the Logger in atomic.Value, which can not store nil.
+type loggerHolder struct {
+	Logger
+}
+
+// defaultLogger the Logger of the images which have no Logger.
+var defaultLogger atomic.Value // loggerHolder
+
+// SetLogger sets the Logger of the package, which is used by the images opened without OpenOpts.Logger and
+// whose SetLogger is not called. If l is nil, the messages are discarded, which is the default.
+func SetLogger(l Logger) {
+	defaultLogger.Store(loggerHolder{l})
+}
+
+// stdLogger is the Logger which writes the messages at or above the level to the log.Logger.
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+// NewLogger returns the Logger which writes the messages at or above level to l, with the level prefix.
+// If l is nil, the standard logger of the log package is used.
+func NewLogger(l *log.Logger, level LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, level: level}
+}
+
+// Logf implements Logger.
+func (s *stdLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level < s.level {
+		return
+	}
+	s.l.Output(2, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+// bdrvLogger returns the Logger of bs, or the Logger of the package if bs has no Logger.
+// It returns nil if neither is set.
+func bdrvLogger(bs *BlockDriverState) Logger {
+	if bs != nil {
+		if h, ok := bs.logger.Load().(loggerHolder); ok && h.Logger != nil {
+			return h.Logger
+		}
+	}
+	if h, ok := defaultLogger.Load().(loggerHolder); ok {
+		return h.Logger
+	}
+	return nil
+}
+
+// bdrvLogf writes the message of bs at level to the Logger of bs.
+//  util/qemu-error.c: void error_report(const char *fmt, ...)
+func bdrvLogf(bs *BlockDriverState, level LogLevel, format string, args ...interface{}) {
+	if l := bdrvLogger(bs); l != nil {
+		l.Logf(level, format, args...)
+	}
+}
+
 func PrintByte(buf []byte) {
 	log.Printf("    [0:3] Magic:                       %+v \t %v [81 70 73 251]", buf[:4], bytes.Equal(buf[:4], []byte{81, 70, 73, 251}))
 	log.Printf("    [4:7] Version:                     %+v \t\t %v [0 0 0 3]", buf[4:8], bytes.Equal(buf[4:8], []byte{0, 0, 0, 3}))
@@ -35,12 +131,12 @@ func PrintByte(buf []byte) {
 	log.Printf("[110:114] HeaderExtensionLength(bit):  %+v \t\t %v [0 0 0 144]", buf[108:112], bytes.Equal(buf[108:112], []byte{0, 0, 0, 144}))
 	log.Printf("[115:162] HeaderExtensionData(name):   \n%+v\n[0 0 100 105 114 116 121 32 98 105 116 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0]", buf[112:158])
 
-	log.Printf("[163:166] HeaderExtensionType(type):   %+v \t\t %v [0 0 0 1]", buf[158:162])
-	log.Printf("[167:171] HeaderExtensionLength(bit):  %+v \t %v [99 111 114 114]", buf[162:166])
+	log.Printf("[163:166] HeaderExtensionType(type):   %+v \t\t %v [0 0 0 1]", buf[158:162], bytes.Equal(buf[158:162], []byte{0, 0, 0, 1}))
+	log.Printf("[167:171] HeaderExtensionLength(bit):  %+v \t %v [99 111 114 114]", buf[162:166], bytes.Equal(buf[162:166], []byte{99, 111, 114, 114}))
 	log.Printf("[172:219] HeaderExtensionData(name):   \n%+v\n[117 112 116 32 98 105 116 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 1 0 108 97]", buf[166:212])
 
-	log.Printf("[220:223] HeaderExtensionType(type):   %+v \t %v [122 121 32 114]", buf[212:216])
-	log.Printf("[224:228] HeaderExtensionLength(bit):  %+v \t %v [101 102 99 111]", buf[216:220])
+	log.Printf("[220:223] HeaderExtensionType(type):   %+v \t %v [122 121 32 114]", buf[212:216], bytes.Equal(buf[212:216], []byte{122, 121, 32, 114}))
+	log.Printf("[224:228] HeaderExtensionLength(bit):  %+v \t %v [101 102 99 111]", buf[216:220], bytes.Equal(buf[216:220], []byte{101, 102, 99, 111}))
 	log.Printf("[229:276] HeaderExtensionData(name):   \n%+v\n[117 110 116 115 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0]", buf[220:266])
 
 	if len(buf) > 266 {
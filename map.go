@@ -0,0 +1,252 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Extent represents a contiguous guest address range which has the same allocation status.
+// The json field names are the same as the 'qemu-img map --output=json' output.
+//  qemu-img.c: typedef struct MapEntry
+type Extent struct {
+	// Start guest offset of the extent in bytes.
+	Start int64 `json:"start"`
+	// Length length of the extent in bytes.
+	Length int64 `json:"length"`
+	// Depth depth of the backing chain layer which the extent resolves to. 0 is the top image.
+	Depth int `json:"depth"`
+	// Allocated whether the extent is allocated in any layer of the backing chain.
+	Allocated bool `json:"present"`
+	// Zero whether the extent reads as zeros.
+	Zero bool `json:"zero"`
+	// Data whether the extent has the data.
+	Data bool `json:"data"`
+	// Compressed whether the extent is stored in compressed clusters.
+	Compressed bool `json:"compressed"`
+	// Offset host offset of the data in the image file of the Depth layer. Only valid if HasOffset is true.
+	Offset int64 `json:"offset"`
+	// HasOffset whether the Offset is valid.
+	HasOffset bool `json:"-"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+// The offset field is omitted if the extent has no valid host offset, same as qemu.
+func (e Extent) MarshalJSON() ([]byte, error) {
+	type extent Extent
+	v := struct {
+		extent
+		Offset *int64 `json:"offset,omitempty"`
+	}{
+		extent: extent(e),
+	}
+	if e.HasOffset {
+		v.Offset = &e.Offset
+	}
+	return json.Marshal(v)
+}
+
+// mergeable reports whether the next extent can be merged to e.
+//  qemu-img.c: static bool entry_mergeable(const MapEntry *curr, const MapEntry *next)
+func (e *Extent) mergeable(next *Extent) bool {
+	if e.Length == 0 {
+		return false
+	}
+	if e.Depth != next.Depth || e.Allocated != next.Allocated || e.Zero != next.Zero || e.Data != next.Data || e.Compressed != next.Compressed {
+		return false
+	}
+	if e.HasOffset != next.HasOffset {
+		return false
+	}
+	if e.HasOffset && e.Offset+e.Length != next.Offset {
+		return false
+	}
+	return true
+}
+
+// Map returns the allocation map of the whole guest address range of the image,
+// including the backing chain.
+//  qemu-img.c: static int img_map(int argc, char **argv)
+func (q *QCow2) Map() ([]Extent, error) {
+	return q.MapRange(0, -1)
+}
+
+// MapRange returns the allocation map of the guest address range from offset to offset+length,
+// including the backing chain. If length is negative, the range is up to the end of the image.
+// The range beyond the end of the image is ignored.
+//  qemu-img.c: static int img_map(int argc, char **argv)
+func (q *QCow2) MapRange(offset, length int64) ([]Extent, error) {
+	bs := q.blk.bs()
+	if bs == nil {
+		return nil, ENOMEDIUM
+	}
+	if offset < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative offset")
+		return nil, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	size, err := getlength(bs)
+	if err != nil {
+		return nil, err
+	}
+	end := size
+	if length >= 0 && length < size-offset {
+		end = offset + length
+	}
+
+	var extents []Extent
+	for offset < end {
+		next, err := mapEntry(bs, offset, end-offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if n := len(extents); n > 0 && extents[n-1].mergeable(&next) {
+			extents[n-1].Length += next.Length
+		} else {
+			extents = append(extents, next)
+		}
+		offset += next.Length
+	}
+
+	return extents, nil
+}
+
+// mapEntry return the extent which starts at offset.
+//  qemu-img.c: static int get_block_status(BlockDriverState *bs, int64_t sector_num, int nb_sectors, MapEntry *e)
+func mapEntry(bs *BlockDriverState, offset, bytes int64) (Extent, error) {
+	status, n, mapOffset, depth, err := bdrvBlockStatusAbove(bs, offset, bytes)
+	if err != nil {
+		return Extent{}, err
+	}
+
+	e := Extent{
+		Start:      offset,
+		Length:     n,
+		Depth:      depth,
+		Allocated:  status&BDRV_BLOCK_ALLOCATED != 0,
+		Zero:       status&BDRV_BLOCK_ZERO != 0,
+		Data:       status&BDRV_BLOCK_DATA != 0,
+		Compressed: status&BDRV_BLOCK_COMPRESSED != 0,
+		HasOffset:  status&BDRV_BLOCK_OFFSET_VALID != 0,
+	}
+	if e.HasOffset {
+		e.Offset = mapOffset
+	}
+
+	return e, nil
+}
+
+// StatusFlag represents the allocation status of the guest address range, which is a set of the flags.
+type StatusFlag int
+
+const (
+	// StatusData the range has the data, which is read from the image file of the layer.
+	StatusData StatusFlag = 1 << iota
+	// StatusZero the range reads as zeros.
+	StatusZero
+	// StatusHole the range is not allocated in any layer of the backing chain, and reads as zeros.
+	StatusHole
+	// StatusCompressed the range is stored in the compressed clusters.
+	StatusCompressed
+)
+
+// String returns the names of the flags joined by "|".
+func (f StatusFlag) String() string {
+	var names []string
+	for _, flag := range []struct {
+		flag StatusFlag
+		name string
+	}{
+		{StatusData, "data"},
+		{StatusZero, "zero"},
+		{StatusHole, "hole"},
+		{StatusCompressed, "compressed"},
+	} {
+		if f&flag.flag != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// Status represents the allocation status of the guest address range, and the layer of the backing chain
+// which provides the data of the range.
+type Status struct {
+	// Flags the allocation status flags of the range.
+	Flags StatusFlag
+	// Depth the depth of the backing chain layer which the range resolves to. 0 is the top image.
+	Depth int
+}
+
+// BlockStatus returns the allocation status of the guest address range which starts at off, and the number
+// of bytes n up to length which have the same status. If the data of the range is stored in the image file
+// of the layer as is, mappedOffset is the host offset of off in that image file, and -1 otherwise.
+// It returns io.EOF if off is at or beyond the end of the image.
+//  block/io.c: int bdrv_block_status_above(BlockDriverState *bs, BlockDriverState *base, int64_t offset, int64_t bytes, int64_t *pnum, int64_t *map, BlockDriverState **file)
+func (q *QCow2) BlockStatus(off, length int64) (status Status, mappedOffset int64, n int64, err error) {
+	bs := q.blk.bs()
+	if bs == nil {
+		return Status{}, -1, 0, ENOMEDIUM
+	}
+	if off < 0 || length < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative offset or length")
+		return Status{}, -1, 0, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	size, err := getlength(bs)
+	if err != nil {
+		return Status{}, -1, 0, err
+	}
+	if off >= size {
+		return Status{}, -1, 0, io.EOF
+	}
+	if length > size-off {
+		length = size - off
+	}
+	if length == 0 {
+		return Status{}, -1, 0, nil
+	}
+
+	ret, n, mapOffset, depth, err := bdrvBlockStatusAbove(bs, off, length)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not get the block status at offset %d", off)
+		return Status{}, -1, 0, err
+	}
+
+	status.Depth = depth
+	if ret&BDRV_BLOCK_DATA != 0 {
+		status.Flags |= StatusData
+	}
+	if ret&BDRV_BLOCK_ZERO != 0 {
+		status.Flags |= StatusZero
+	}
+	if ret&BDRV_BLOCK_ALLOCATED == 0 {
+		status.Flags |= StatusHole | StatusZero
+	}
+	if ret&BDRV_BLOCK_COMPRESSED != 0 {
+		status.Flags |= StatusCompressed
+	}
+
+	mappedOffset = -1
+	if ret&BDRV_BLOCK_OFFSET_VALID != 0 {
+		mappedOffset = mapOffset
+	}
+
+	return status, mappedOffset, n, nil
+}
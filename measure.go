@@ -0,0 +1,162 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// MeasureInfo represents the size of the image file which is required for the new image.
+// The json field names are the same as the 'qemu-img measure --output=json' output.
+//  qapi/block-core.json: { 'struct': 'BlockMeasureInfo' }
+type MeasureInfo struct {
+	// Required is the size required for the new image, including the metadata.
+	Required int64 `json:"required"`
+	// FullyAllocated is the size of the new image when all of the clusters are allocated.
+	FullyAllocated int64 `json:"fully-allocated"`
+}
+
+// Measure calculates the size of the image file which is required to convert the source image
+// to the new qcow2 image created with opts.
+// If source is nil, measures the new empty image of the virtual size of opts.Size or opts.SizeStr.
+//  block/qcow2.c: static BlockMeasureInfo *qcow2_measure(QemuOpts *opts, BlockDriverState *in_bs, Error **errp)
+func Measure(source *QCow2, opts *Opts) (*MeasureInfo, error) {
+	return MeasureContext(context.Background(), source, opts)
+}
+
+// MeasureContext is like Measure, but stops walking the source image when ctx is done, and returns the error of ctx.
+func MeasureContext(ctx context.Context, source *QCow2, opts *Opts) (*MeasureInfo, error) {
+	defer trace.StartRegion(ctx, "qcow2.Measure").End()
+
+	if opts == nil {
+		opts = new(Opts)
+	}
+	if size, err := opts.virtualSize(); err != nil {
+		return nil, err
+	} else if size != opts.Size {
+		o := *opts
+		o.Size = size
+		opts = &o
+	}
+
+	// Parse image creation options
+	clusterSize := int64(opts.ClusterSize)
+	if clusterSize == 0 {
+		size := opts.Size
+		if source != nil {
+			ssize, err := source.VirtualSize()
+			if err != nil {
+				err = errors.Wrap(err, "Unable to get image virtual_size")
+				return nil, err
+			}
+			size = ssize
+		}
+		clusterSize = autoClusterSize(size)
+	}
+	clusterBits := ctz32(uint32(clusterSize))
+	if clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || int64(1)<<uint(clusterBits) != clusterSize {
+		err := errors.Wrapf(ErrInvalidOption, "Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+		return nil, err
+	}
+
+	refcountBits := opts.RefcountBits
+	if refcountBits == 0 {
+		refcountBits = 16 // defaults
+	}
+	if refcountBits > 64 || refcountBits&(refcountBits-1) != 0 {
+		err := errors.Wrap(ErrInvalidOption, "Refcount width must be a power of two and may not exceed 64 bits")
+		return nil, err
+	}
+	refcountOrder := ctz32(uint32(refcountBits))
+
+	switch opts.Compat {
+	case "", "0.10", "1.1":
+		// nothing to do
+	default:
+		err := errors.Wrapf(ErrInvalidOption, "Invalid compatibility level: '%s'", opts.Compat)
+		return nil, err
+	}
+
+	prealloc := opts.Preallocation
+	if opts.BackingFile != "" && prealloc != PREALLOC_MODE_OFF {
+		err := errors.Wrap(ErrInvalidOption, "Backing file and preallocation cannot be used at the same time")
+		return nil, err
+	}
+
+	var virtualSize, required int64
+
+	// Account for input image
+	if source != nil {
+		bs := source.blk.bs()
+		bdrvIncInFlight(bs)
+		defer bdrvDecInFlight(bs)
+
+		ssize, err := getlength(bs)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to get image virtual_size")
+			return nil, err
+		}
+		virtualSize = alignOffset(ssize, int(clusterSize))
+
+		if opts.BackingFile != "" {
+			// We don't how much of the backing chain is shared by the input
+			// image and the new image file.  In the worst case the new image's
+			// backing file has nothing in common with the input image.  Be
+			// conservative and assume all clusters need to be written.
+			required = virtualSize
+		} else {
+			var n int64
+			for offset := int64(0); offset < ssize; offset += n {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+
+				var status int
+				status, n, _, _, err = bdrvBlockStatusAbove(bs, offset, ssize-offset)
+				if err != nil {
+					err = errors.Wrap(err, "Unable to get block status")
+					return nil, err
+				}
+				if n <= 0 {
+					break
+				}
+
+				if status&BDRV_BLOCK_ZERO != 0 {
+					// Skip zero regions (safe with no backing file)
+				} else if status&(BDRV_BLOCK_DATA|BDRV_BLOCK_ALLOCATED) == BDRV_BLOCK_DATA|BDRV_BLOCK_ALLOCATED {
+					// Extend n to end of cluster for next iteration
+					n = alignOffset(offset+n, int(clusterSize)) - offset
+
+					// Count clusters we've seen
+					required += offset%clusterSize + n
+				}
+			}
+		}
+	} else {
+		virtualSize = alignOffset(opts.Size, int(clusterSize))
+	}
+
+	// Take into account preallocation.  Nothing special is needed for
+	// PREALLOC_MODE_METADATA since metadata is always counted.
+	if prealloc == PREALLOC_MODE_FULL || prealloc == PREALLOC_MODE_FALLOC {
+		required = virtualSize
+	}
+
+	info := &MeasureInfo{
+		FullyAllocated: calcPreallocSize(virtualSize, clusterSize, refcountOrder),
+	}
+
+	// Remove data clusters that are not required.  This overestimates the
+	// required size because metadata needed for the fully allocated file is
+	// still counted.
+	info.Required = info.FullyAllocated - virtualSize + required
+
+	return info, nil
+}
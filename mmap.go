@@ -0,0 +1,219 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MmapBackend is the Backend of the memory-mapped host file. The reads of the image file are the copies from
+// the mapping without the system calls, which speeds up the metadata heavy operations such as Check and Map
+// of the large image. If the backend is writable, the writes are copied to the mapping, and the writes
+// beyond the end of the mapping, which grow the image file, are written to the file and mapped by the next read.
+//
+// The file must not be truncated by the other processes while it is mapped, otherwise the read raises SIGBUS.
+// The mapping is supported on Linux and macOS, and NewMmapBackend returns ENOTSUP on the other platforms.
+type MmapBackend struct {
+	f        *os.File
+	writable bool
+
+	// mu guards the mapping. It is held for reading by the copies from and to the mapping, and for writing
+	// by the remapping of the grown or truncated file.
+	mu   sync.RWMutex
+	data []byte
+}
+
+var _ Backend = (*MmapBackend)(nil)
+
+// NewMmapBackend maps the host file f, and returns the Backend of it. If writable is true, the mapping is
+// writable and shared with the file, so f must be opened for reading and writing.
+// f is closed by Close of the backend.
+//  util/mmap-alloc.c: void *qemu_ram_mmap(int fd, size_t size, size_t align, bool shared)
+func NewMmapBackend(f *os.File, writable bool) (*MmapBackend, error) {
+	b := &MmapBackend{
+		f:        f,
+		writable: writable,
+	}
+	if err := b.remap(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// remap maps the file again if its size is changed. The caller must hold b.mu for writing.
+func (b *MmapBackend) remap() error {
+	size, err := b.Size()
+	if err != nil {
+		return err
+	}
+	if size == int64(len(b.data)) {
+		return nil
+	}
+	if int64(int(size)) != size {
+		err := errors.Wrapf(ErrTooLarge, "Could not map the file of %d bytes", size)
+		return err
+	}
+
+	if b.data != nil {
+		if err := munmapFile(b.data); err != nil {
+			return errors.Wrap(err, "Could not unmap the file")
+		}
+		b.data = nil
+	}
+	if size == 0 {
+		return nil
+	}
+
+	data, err := mmapFile(b.f, int(size), b.writable)
+	if err != nil {
+		return errors.Wrap(err, "Could not map the file")
+	}
+	b.data = data
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+// The read beyond the end of the mapping maps the file again, and the read beyond the end of the file returns io.EOF.
+func (b *MmapBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	b.mu.RLock()
+	if off+int64(len(p)) <= int64(len(b.data)) {
+		n := copy(p, b.data[off:])
+		b.mu.RUnlock()
+		return n, nil
+	}
+	b.mu.RUnlock()
+
+	// the file may be grown by the writes beyond the end of the mapping
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.remap(); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. It returns EBADF if the backend is not writable.
+func (b *MmapBackend) WriteAt(p []byte, off int64) (int, error) {
+	if !b.writable {
+		return 0, syscall.EBADF
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if off+int64(len(p)) <= int64(len(b.data)) {
+		return copy(b.data[off:], p), nil
+	}
+
+	// the write beyond the end of the mapping grows the file, which is mapped by the next read
+	return b.f.WriteAt(p, off)
+}
+
+// Truncate implements Backend, and maps the file of the new size.
+func (b *MmapBackend) Truncate(size int64) error {
+	if !b.writable {
+		return syscall.EBADF
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// unmap first, the mapping beyond the end of the shrunk file must not be accessed
+	if b.data != nil {
+		if err := munmapFile(b.data); err != nil {
+			return errors.Wrap(err, "Could not unmap the file")
+		}
+		b.data = nil
+	}
+	if err := b.f.Truncate(size); err != nil {
+		return err
+	}
+
+	return b.remap()
+}
+
+// Sync implements Backend. The mapping is written back to the file before the file is synced.
+func (b *MmapBackend) Sync() error {
+	if b.writable {
+		b.mu.RLock()
+		var err error
+		if b.data != nil {
+			err = msyncFile(b.data)
+		}
+		b.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.f.Sync()
+}
+
+// Size implements Backend, and returns the size of the file, which may be larger than the mapping.
+//  block/file-posix.c: static int64_t raw_getlength(BlockDriverState *bs)
+func (b *MmapBackend) Size() (int64, error) {
+	stat, err := b.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Discard punches the hole of the range of the file, without changing the file size.
+//  block/file-posix.c: static coroutine_fn BlockAIOCB *raw_aio_pdiscard(BlockDriverState *bs, int64_t offset, int count, BlockCompletionFunc *cb, void *opaque)
+func (b *MmapBackend) Discard(offset, length int64) error {
+	if !b.writable {
+		return syscall.EBADF
+	}
+	return punchHole(b.f, offset, length)
+}
+
+// AllocatedSize returns the actually allocated size of the file in bytes.
+//  block/file-posix.c: static int64_t raw_get_allocated_file_size(BlockDriverState *bs)
+func (b *MmapBackend) AllocatedSize() (int64, error) {
+	return allocatedFileSize(b.f)
+}
+
+// Close unmaps and closes the file.
+func (b *MmapBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	if b.data != nil {
+		err = munmapFile(b.data)
+		b.data = nil
+	}
+	if cerr := b.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,30 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package qcow2
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile is not supported on this platform.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// munmapFile is not supported on this platform.
+func munmapFile(data []byte) error {
+	return syscall.ENOTSUP
+}
+
+// msyncFile is not supported on this platform.
+func msyncFile(data []byte) error {
+	return syscall.ENOTSUP
+}
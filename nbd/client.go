@@ -0,0 +1,529 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// NBD_DEFAULT_PORT the default TCP port of the NBD server.
+const NBD_DEFAULT_PORT = 10809
+
+// nbdOldstyleMagic the second magic of the oldstyle negotiation, which is not supported.
+const nbdOldstyleMagic = 0x00420281861253
+
+func init() {
+	for _, scheme := range []string{"nbd", "nbd+tcp", "nbd+unix"} {
+		qcow2.RegisterProtocol(scheme, openURL)
+	}
+}
+
+// openURL opens the export of the nbd URL as the protocol of the image file.
+//  block/nbd.c: static int nbd_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func openURL(filename string, flag int) (qcow2.Backend, error) {
+	c, err := DialURL(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && c.ReadOnly() {
+		c.Close()
+		err := errors.Wrapf(qcow2.ErrReadOnly, "export of '%s' is read-only", filename)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Client is the connection to an export of the NBD server, same as the nbd block driver of qemu.
+// Client implements qcow2.Backend, so the image can be opened on the export by qcow2.OpenBackend.
+// Importing the package also registers the "nbd", "nbd+tcp" and "nbd+unix" URL schemes as the protocol,
+// and the image file names and the backing file names of these schemes are opened by DialURL.
+//
+// The requests are serialized on the connection, and the replies are the simple replies.
+//  block/nbd-client.h: typedef struct NBDClientSession
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	size   int64
+	flags  uint16
+	handle uint64
+	closed bool
+}
+
+var _ qcow2.Backend = (*Client)(nil)
+
+// Dial connects to the NBD server on the network address, and selects the export of name.
+// The network is "tcp" or "unix". The empty name selects the default export.
+func Dial(network, address, name string) (*Client, error) {
+	if len(name) > NBD_MAX_NAME_SIZE {
+		err := errors.Wrapf(qcow2.ErrInvalidArgument, "export name is too long (%d bytes)", len(name))
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	if err := c.negotiate(name); err != nil {
+		conn.Close()
+		err = errors.Wrapf(err, "could not negotiate with the NBD server %s", address)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DialURL connects to the export of the URL, which is one of the forms:
+//
+//  nbd://host[:port]/export
+//  nbd+tcp://host[:port]/export
+//  nbd+unix:///export?socket=path
+//
+// The export is the path of the URL without the leading slash, and empty for the default export.
+//  block/nbd.c: static int nbd_parse_uri(const char *filename, QDict *options)
+func DialURL(rawurl string) (*Client, error) {
+	network, address, name, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	return Dial(network, address, name)
+}
+
+// parseURL parses the nbd URL, and returns the network, the address and the export name.
+//  block/nbd.c: static int nbd_parse_uri(const char *filename, QDict *options)
+func parseURL(rawurl string) (network, address, name string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	switch u.Scheme {
+	case "nbd", "nbd+tcp":
+		network = "tcp"
+	case "nbd+unix":
+		network = "unix"
+	default:
+		return "", "", "", errors.Errorf("invalid NBD URL scheme '%s'", u.Scheme)
+	}
+
+	name = strings.TrimPrefix(u.Path, "/")
+	query := u.Query()
+
+	if network == "unix" {
+		// nbd+unix:///export?socket=path
+		if u.Host != "" || len(query) != 1 || len(query["socket"]) != 1 {
+			return "", "", "", errors.Errorf("invalid NBD URL '%s': expecting only the socket parameter", rawurl)
+		}
+		return network, query.Get("socket"), name, nil
+	}
+
+	// nbd[+tcp]://host[:port]/export
+	if u.Hostname() == "" || len(query) != 0 {
+		return "", "", "", errors.Errorf("invalid NBD URL '%s': expecting the host and no parameters", rawurl)
+	}
+	port := u.Port()
+	if port == "" {
+		port = strconv.Itoa(NBD_DEFAULT_PORT)
+	}
+
+	return network, net.JoinHostPort(u.Hostname(), port), name, nil
+}
+
+func (c *Client) read(v interface{}) error {
+	return binary.Read(c.r, binary.BigEndian, v)
+}
+
+func (c *Client) write(v interface{}) error {
+	return binary.Write(c.w, binary.BigEndian, v)
+}
+
+// negotiate performs the newstyle negotiation, and selects the export of name.
+// NBD_OPT_GO is used if the server supports the fixed newstyle, and falls back to NBD_OPT_EXPORT_NAME.
+//  nbd/client.c: int nbd_receive_negotiate(QIOChannel *ioc, const char *name, uint16_t *flags, QCryptoTLSCreds *tlscreds, const char *hostname, QIOChannel **outioc, off_t *size, Error **errp)
+func (c *Client) negotiate(name string) error {
+	var magic, magic2 uint64
+	if err := c.read(&magic); err != nil {
+		return err
+	}
+	if magic != NBDMAGIC {
+		return errors.Errorf("bad magic received %#x", magic)
+	}
+	if err := c.read(&magic2); err != nil {
+		return err
+	}
+	if magic2 == nbdOldstyleMagic {
+		return errors.Wrap(qcow2.ErrUnsupported, "oldstyle negotiation is not supported")
+	}
+	if magic2 != IHAVEOPT {
+		return errors.Errorf("bad magic received %#x", magic2)
+	}
+
+	var globalFlags uint16
+	if err := c.read(&globalFlags); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if globalFlags&NBD_FLAG_FIXED_NEWSTYLE != 0 {
+		clientFlags |= NBD_FLAG_C_FIXED_NEWSTYLE
+	}
+	if globalFlags&NBD_FLAG_NO_ZEROES != 0 {
+		clientFlags |= NBD_FLAG_C_NO_ZEROES
+	}
+	c.write(clientFlags)
+
+	if clientFlags&NBD_FLAG_C_FIXED_NEWSTYLE != 0 {
+		ok, err := c.optGo(name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return c.optExportName(name, clientFlags&NBD_FLAG_C_NO_ZEROES != 0)
+}
+
+// sendOption writes the option request.
+//  nbd/client.c: static int nbd_send_option_request(QIOChannel *ioc, uint32_t opt, uint32_t len, const char *data, Error **errp)
+func (c *Client) sendOption(opt uint32, data []byte) error {
+	c.write(uint64(IHAVEOPT))
+	c.write(opt)
+	c.write(uint32(len(data)))
+	c.w.Write(data)
+	return c.w.Flush()
+}
+
+// optGo selects the export by NBD_OPT_GO, and returns false if the server does not support it.
+//  nbd/client.c: static int nbd_opt_go(QIOChannel *ioc, const char *wantname, NBDExportInfo *info, Error **errp)
+func (c *Client) optGo(name string) (bool, error) {
+	data := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	// no information requests, NBD_INFO_EXPORT is always sent
+	if err := c.sendOption(NBD_OPT_GO, data); err != nil {
+		return false, err
+	}
+
+	haveExport := false
+	for {
+		var rep struct {
+			Magic  uint64
+			Opt    uint32
+			Type   uint32
+			Length uint32
+		}
+		if err := c.read(&rep); err != nil {
+			return false, err
+		}
+		if rep.Magic != NBD_REP_MAGIC {
+			return false, errors.Errorf("unexpected option reply magic %#x", rep.Magic)
+		}
+		if rep.Opt != NBD_OPT_GO {
+			return false, errors.Errorf("unexpected option reply %d, expecting %d", rep.Opt, NBD_OPT_GO)
+		}
+		if rep.Length > nbdMaxOptionSize {
+			return false, errors.Errorf("option reply is too large (%d bytes)", rep.Length)
+		}
+		payload := make([]byte, rep.Length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return false, err
+		}
+
+		switch rep.Type {
+		case NBD_REP_ACK:
+			if !haveExport {
+				return false, errors.New("server did not send the export information")
+			}
+			return true, nil
+
+		case NBD_REP_INFO:
+			if len(payload) < 2 {
+				return false, errors.Errorf("information reply is too short (%d bytes)", len(payload))
+			}
+			if binary.BigEndian.Uint16(payload) != NBD_INFO_EXPORT {
+				// skip the unrequested information
+				continue
+			}
+			if len(payload) != 12 {
+				return false, errors.Errorf("invalid length of the export information (%d bytes)", len(payload))
+			}
+			c.size = int64(binary.BigEndian.Uint64(payload[2:]))
+			c.flags = binary.BigEndian.Uint16(payload[10:])
+			haveExport = true
+
+		case NBD_REP_ERR_UNSUP:
+			return false, nil
+
+		case NBD_REP_ERR_UNKNOWN:
+			return false, errors.Errorf("requested export '%s' not present: %s", name, payload)
+
+		default:
+			if rep.Type&nbdRepErr == 0 {
+				return false, errors.Errorf("unexpected option reply type %d", rep.Type)
+			}
+			return false, errors.Errorf("option NBD_OPT_GO failed with the error %#x: %s", rep.Type, payload)
+		}
+	}
+}
+
+// optExportName selects the export by NBD_OPT_EXPORT_NAME.
+//  nbd/client.c: int nbd_receive_negotiate(QIOChannel *ioc, const char *name, uint16_t *flags, QCryptoTLSCreds *tlscreds, const char *hostname, QIOChannel **outioc, off_t *size, Error **errp)
+func (c *Client) optExportName(name string, noZeroes bool) error {
+	if err := c.sendOption(NBD_OPT_EXPORT_NAME, []byte(name)); err != nil {
+		return err
+	}
+
+	var size uint64
+	if err := c.read(&size); err != nil {
+		return errors.Wrapf(err, "requested export '%s' not present", name)
+	}
+	if err := c.read(&c.flags); err != nil {
+		return err
+	}
+	c.size = int64(size)
+
+	if !noZeroes {
+		if _, err := io.CopyN(ioutil.Discard, c.r, 124); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// do sends the request, and reads the simple reply with the read data into buf.
+//  block/nbd-client.c: static int nbd_co_request(BlockDriverState *bs, NBDRequest *request, QEMUIOVector *qiov)
+func (c *Client) do(typ uint16, offset int64, length uint32, data, buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return syscall.ESHUTDOWN
+	}
+
+	c.handle++
+	req := request{
+		Magic:  NBD_REQUEST_MAGIC,
+		Type:   typ,
+		Handle: c.handle,
+		Offset: uint64(offset),
+		Length: length,
+	}
+	c.write(req)
+	c.w.Write(data)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	var rep struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	if err := c.read(&rep); err != nil {
+		return err
+	}
+	if rep.Magic != NBD_SIMPLE_REPLY_MAGIC {
+		return errors.Errorf("invalid reply magic %#x", rep.Magic)
+	}
+	if rep.Handle != req.Handle {
+		return errors.Errorf("unexpected reply handle %d, expecting %d", rep.Handle, req.Handle)
+	}
+	if rep.Error != NBD_SUCCESS {
+		return systemErrno(rep.Error)
+	}
+
+	if buf != nil {
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+// The read beyond the size of the export returns io.EOF.
+//  block/nbd-client.c: int nbd_client_co_preadv(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if int64(n) > c.size-off {
+		n = int(c.size - off)
+	}
+	for done := 0; done < n; {
+		length := n - done
+		if length > NBD_MAX_BUFFER_SIZE {
+			length = NBD_MAX_BUFFER_SIZE
+		}
+		if err := c.do(NBD_CMD_READ, off+int64(done), uint32(length), nil, p[done:done+length]); err != nil {
+			return done, err
+		}
+		done += length
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+//  block/nbd-client.c: int nbd_client_co_pwritev(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	if c.ReadOnly() {
+		return 0, syscall.EBADF
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	for done := 0; done < len(p); {
+		length := len(p) - done
+		if length > NBD_MAX_BUFFER_SIZE {
+			length = NBD_MAX_BUFFER_SIZE
+		}
+		if err := c.do(NBD_CMD_WRITE, off+int64(done), uint32(length), p[done:done+length], nil); err != nil {
+			return done, err
+		}
+		done += length
+	}
+
+	return len(p), nil
+}
+
+// Truncate implements qcow2.Backend, and grows the export by NBD_CMD_RESIZE if the server supports the resize
+// extension. Returns ENOTSUP if the server does not support it or size is smaller than the current size.
+func (c *Client) Truncate(size int64) error {
+	if size == c.size {
+		return nil
+	}
+	if c.flags&NBD_FLAG_SEND_RESIZE == 0 || c.ReadOnly() || size < c.size {
+		return syscall.ENOTSUP
+	}
+	if err := c.do(NBD_CMD_RESIZE, size, 0, nil, nil); err != nil {
+		return err
+	}
+	c.size = size
+
+	return nil
+}
+
+// Sync implements qcow2.Backend, and flushes the export if the server supports NBD_CMD_FLUSH.
+//  block/nbd-client.c: int nbd_client_co_flush(BlockDriverState *bs)
+func (c *Client) Sync() error {
+	if c.flags&NBD_FLAG_SEND_FLUSH == 0 {
+		return nil
+	}
+	return c.do(NBD_CMD_FLUSH, 0, 0, nil, nil)
+}
+
+// Size implements qcow2.Backend, and returns the size of the export.
+func (c *Client) Size() (int64, error) {
+	return c.size, nil
+}
+
+// Discard trims the range of the export, and returns ENOTSUP if the server does not support NBD_CMD_TRIM.
+//  block/nbd-client.c: int nbd_client_co_pdiscard(BlockDriverState *bs, int64_t offset, int count)
+func (c *Client) Discard(offset, length int64) error {
+	if c.flags&NBD_FLAG_SEND_TRIM == 0 || c.ReadOnly() {
+		return syscall.ENOTSUP
+	}
+
+	for length > 0 {
+		n := length
+		if n > NBD_MAX_BUFFER_SIZE {
+			n = NBD_MAX_BUFFER_SIZE
+		}
+		if err := c.do(NBD_CMD_TRIM, offset, uint32(n), nil, nil); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
+
+// ReadOnly reports whether the export is read-only.
+func (c *Client) ReadOnly() bool {
+	return c.flags&NBD_FLAG_READ_ONLY != 0
+}
+
+// Close sends NBD_CMD_DISC, and closes the connection.
+//  block/nbd-client.c: void nbd_client_close(BlockDriverState *bs)
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	c.handle++
+	c.write(request{
+		Magic:  NBD_REQUEST_MAGIC,
+		Type:   NBD_CMD_DISC,
+		Handle: c.handle,
+	})
+	c.w.Flush()
+
+	return c.conn.Close()
+}
+
+// systemErrno returns the system errno of the NBD error.
+//  nbd/client.c: static int nbd_errno_to_system_errno(int err)
+func systemErrno(nbdErr uint32) error {
+	switch nbdErr {
+	case NBD_EPERM:
+		return syscall.EPERM
+	case NBD_ENOMEM:
+		return syscall.ENOMEM
+	case NBD_EINVAL:
+		return syscall.EINVAL
+	case NBD_ENOSPC:
+		return syscall.ENOSPC
+	case NBD_EOVERFLOW:
+		return syscall.EOVERFLOW
+	case NBD_ENOTSUP:
+		return syscall.ENOTSUP
+	case NBD_ESHUTDOWN:
+		return syscall.ESHUTDOWN
+	default:
+		return syscall.EIO
+	}
+}
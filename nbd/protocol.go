@@ -0,0 +1,160 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+// The constants of the NBD protocol.
+//  include/block/nbd.h, and doc/proto.md of the NBD project
+const (
+	// NBDMAGIC the first magic of the handshake.
+	NBDMAGIC = 0x4e42444d41474943 // "NBDMAGIC"
+	// IHAVEOPT the magic of the newstyle negotiation, and of the option request.
+	IHAVEOPT = 0x49484156454f5054 // "IHAVEOPT"
+	// NBD_REP_MAGIC the magic of the option reply.
+	NBD_REP_MAGIC = 0x0003e889045565a9
+
+	// NBD_REQUEST_MAGIC the magic of the transmission request.
+	NBD_REQUEST_MAGIC = 0x25609513
+	// NBD_SIMPLE_REPLY_MAGIC the magic of the simple reply.
+	NBD_SIMPLE_REPLY_MAGIC = 0x67446698
+	// NBD_STRUCTURED_REPLY_MAGIC the magic of the structured reply chunk.
+	NBD_STRUCTURED_REPLY_MAGIC = 0x668e33ef
+)
+
+// Handshake flags sent by the server.
+const (
+	NBD_FLAG_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_NO_ZEROES      = 1 << 1
+)
+
+// Client flags sent by the client.
+const (
+	NBD_FLAG_C_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_C_NO_ZEROES      = 1 << 1
+)
+
+// Transmission flags of the export.
+const (
+	NBD_FLAG_HAS_FLAGS         = 1 << 0
+	NBD_FLAG_READ_ONLY         = 1 << 1
+	NBD_FLAG_SEND_FLUSH        = 1 << 2
+	NBD_FLAG_SEND_FUA          = 1 << 3
+	NBD_FLAG_ROTATIONAL        = 1 << 4
+	NBD_FLAG_SEND_TRIM         = 1 << 5
+	NBD_FLAG_SEND_WRITE_ZEROES = 1 << 6
+	NBD_FLAG_SEND_DF           = 1 << 7
+	NBD_FLAG_CAN_MULTI_CONN    = 1 << 8
+	// NBD_FLAG_SEND_RESIZE the export accepts NBD_CMD_RESIZE, defined by the experimental resize extension.
+	NBD_FLAG_SEND_RESIZE = 1 << 9
+)
+
+// Options of the option haggling.
+const (
+	NBD_OPT_EXPORT_NAME       = 1
+	NBD_OPT_ABORT             = 2
+	NBD_OPT_LIST              = 3
+	NBD_OPT_STARTTLS          = 5
+	NBD_OPT_INFO              = 6
+	NBD_OPT_GO                = 7
+	NBD_OPT_STRUCTURED_REPLY  = 8
+	NBD_OPT_LIST_META_CONTEXT = 9
+	NBD_OPT_SET_META_CONTEXT  = 10
+)
+
+// Option reply types.
+const (
+	NBD_REP_ACK          = 1
+	NBD_REP_SERVER       = 2
+	NBD_REP_INFO         = 3
+	NBD_REP_META_CONTEXT = 4
+
+	nbdRepErr = 1 << 31
+
+	NBD_REP_ERR_UNSUP    = nbdRepErr + 1
+	NBD_REP_ERR_POLICY   = nbdRepErr + 2
+	NBD_REP_ERR_INVALID  = nbdRepErr + 3
+	NBD_REP_ERR_PLATFORM = nbdRepErr + 4
+	NBD_REP_ERR_TLS_REQD = nbdRepErr + 5
+	NBD_REP_ERR_UNKNOWN  = nbdRepErr + 6
+	NBD_REP_ERR_SHUTDOWN = nbdRepErr + 7
+)
+
+// Information types of NBD_REP_INFO.
+const (
+	NBD_INFO_EXPORT      = 0
+	NBD_INFO_NAME        = 1
+	NBD_INFO_DESCRIPTION = 2
+	NBD_INFO_BLOCK_SIZE  = 3
+)
+
+// Command types of the transmission request.
+const (
+	NBD_CMD_READ         = 0
+	NBD_CMD_WRITE        = 1
+	NBD_CMD_DISC         = 2
+	NBD_CMD_FLUSH        = 3
+	NBD_CMD_TRIM         = 4
+	NBD_CMD_CACHE        = 5
+	NBD_CMD_WRITE_ZEROES = 6
+	NBD_CMD_BLOCK_STATUS = 7
+	// NBD_CMD_RESIZE resizes the export to the size in the offset field, defined by the experimental resize
+	// extension. The length field must be zero.
+	NBD_CMD_RESIZE = 8
+)
+
+// Command flags of the transmission request.
+const (
+	NBD_CMD_FLAG_FUA     = 1 << 0
+	NBD_CMD_FLAG_NO_HOLE = 1 << 1
+	NBD_CMD_FLAG_DF      = 1 << 2
+	NBD_CMD_FLAG_REQ_ONE = 1 << 3
+)
+
+// Structured reply flags and types.
+const (
+	NBD_REPLY_FLAG_DONE = 1 << 0
+
+	NBD_REPLY_TYPE_NONE         = 0
+	NBD_REPLY_TYPE_OFFSET_DATA  = 1
+	NBD_REPLY_TYPE_OFFSET_HOLE  = 2
+	NBD_REPLY_TYPE_BLOCK_STATUS = 5
+	NBD_REPLY_TYPE_ERROR        = 1<<15 + 1
+	NBD_REPLY_TYPE_ERROR_OFFSET = 1<<15 + 2
+)
+
+// The flags of the "base:allocation" metadata context.
+const (
+	NBD_STATE_HOLE = 1 << 0
+	NBD_STATE_ZERO = 1 << 1
+)
+
+// The errors of the transmission reply.
+const (
+	NBD_SUCCESS   = 0
+	NBD_EPERM     = 1
+	NBD_EIO       = 5
+	NBD_ENOMEM    = 12
+	NBD_EINVAL    = 22
+	NBD_ENOSPC    = 28
+	NBD_EOVERFLOW = 75
+	NBD_ENOTSUP   = 95
+	NBD_ESHUTDOWN = 108
+)
+
+const (
+	// NBD_MAX_BUFFER_SIZE maximum length of the read and write requests.
+	NBD_MAX_BUFFER_SIZE = 32 << 20
+	// NBD_MAX_NAME_SIZE maximum length of the export name.
+	NBD_MAX_NAME_SIZE = 4096
+	// nbdMaxOptionSize maximum length of the option data.
+	nbdMaxOptionSize = 64 << 10
+
+	// NBD_META_BASE_ALLOCATION the name of the block status metadata context.
+	NBD_META_BASE_ALLOCATION = "base:allocation"
+	// nbdMetaBaseAllocationID the context id of NBD_META_BASE_ALLOCATION.
+	nbdMetaBaseAllocationID = 1
+
+	// nbdPreferredBlockSize preferred block size of NBD_INFO_BLOCK_SIZE.
+	nbdPreferredBlockSize = 4096
+)
@@ -0,0 +1,835 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd serves the qcow2 images over the NBD (Network Block Device) protocol, same as qemu-nbd.
+//
+// The server supports the fixed newstyle negotiation, the structured replies, the block status
+// of the "base:allocation" metadata context and the experimental resize extension. The images are exported over the unix socket or TCP,
+// and can be attached by the Linux nbd-client, or qemu as the nbd:// block device.
+//
+// The Client connects to the export of the NBD server as the qcow2.Backend. Importing the package registers
+// the nbd:// and nbd+unix:// URLs as the protocol of the image file and the backing file, so the overlay
+// can be created on top of the image exported from another host.
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("nbd: Server closed")
+
+// errAbort is returned by the negotiation when the client aborts it.
+var errAbort = errors.New("nbd: negotiation aborted by the client")
+
+// Export represents an image exported by the Server.
+type Export struct {
+	// Name the name of the export. The client connects to the export by the name.
+	// The empty name is the default export, and the first added export is also used as the default.
+	Name string
+	// Description the human readable description of the export.
+	Description string
+	// Image the exported image.
+	Image *qcow2.QCow2
+	// ReadOnly exports the image as read-only. The read-only image is always exported as read-only.
+	ReadOnly bool
+
+	// mu serializes the requests of the connections to the image.
+	mu sync.Mutex
+
+	// size the virtual disk size of the image, which is updated by the resize notifier of the image, so the
+	// resize by NBD_CMD_RESIZE or by the other users of the image is seen by the requests and the new clients.
+	// The clients which are connected before the resize keep the size sent by the negotiation, which is still
+	// valid since the image only grows.
+	size int64
+	// removeNotifier unregisters the resize notifier from the image.
+	removeNotifier func()
+}
+
+// readOnly reports whether the export is read-only.
+func (e *Export) readOnly() bool {
+	return e.ReadOnly || e.Image.ReadOnly()
+}
+
+// flusher returns the Flush of the image, or nil if the image has no Flush method.
+func (e *Export) flusher() interface {
+	Flush() error
+} {
+	f, _ := interface{}(e.Image).(interface {
+		Flush() error
+	})
+	return f
+}
+
+// transmissionFlags returns the transmission flags of the export.
+//  nbd/server.c: static int nbd_negotiate_send_info(NBDClient *client, uint16_t info, uint32_t length, void *buf, Error **errp)
+func (e *Export) transmissionFlags(structured bool) uint16 {
+	flags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_WRITE_ZEROES)
+	if e.readOnly() {
+		flags |= NBD_FLAG_READ_ONLY
+	} else {
+		flags |= NBD_FLAG_SEND_TRIM | NBD_FLAG_SEND_RESIZE
+	}
+	if e.flusher() != nil {
+		flags |= NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA
+	}
+	if structured {
+		flags |= NBD_FLAG_SEND_DF
+	}
+	return flags
+}
+
+// Server serves the exports over the NBD protocol.
+type Server struct {
+	// ErrorLog logs the errors of the connections. If nil, the standard logger of the log package is used.
+	ErrorLog *log.Logger
+
+	mu        sync.Mutex
+	exports   []*Export
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns the new Server which has no export.
+func NewServer() *Server {
+	return &Server{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// AddExport adds the export to the server. The name of the export must be unique.
+// The export follows the resizes of the image until the server is closed.
+func (s *Server) AddExport(e *Export) error {
+	if e.Image == nil {
+		return errors.Errorf("nbd: export '%s' has no image", e.Name)
+	}
+	if len(e.Name) > NBD_MAX_NAME_SIZE {
+		return errors.Errorf("nbd: export name is too long")
+	}
+	size, err := e.Image.VirtualSize()
+	if err != nil {
+		return errors.Wrapf(err, "nbd: Failed to get the size of export '%s'", e.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, x := range s.exports {
+		if x.Name == e.Name {
+			return errors.Errorf("nbd: export '%s' already exists", e.Name)
+		}
+	}
+	atomic.StoreInt64(&e.size, size)
+	e.removeNotifier = e.Image.AddResizeNotifier(func(size int64) {
+		atomic.StoreInt64(&e.size, size)
+	})
+	s.exports = append(s.exports, e)
+
+	return nil
+}
+
+// lookup returns the export of the name, or nil if not found.
+func (s *Server) lookup(name string) *Export {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.exports {
+		if e.Name == name {
+			return e
+		}
+	}
+	if name == "" && len(s.exports) > 0 {
+		return s.exports[0]
+	}
+	return nil
+}
+
+// ListenAndServe listens on the network address, and serves the connections.
+// The network is "unix" for the unix socket, or "tcp" for TCP.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts the connections on l, and serves each connection in the new goroutine.
+// Serve always returns the non-nil error, and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(c)
+	}
+}
+
+// Close closes the listeners and the connections, and waits for the in-flight requests to complete.
+// The exported images are not closed, but the exports stop following their resizes.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	for _, e := range s.exports {
+		if e.removeNotifier != nil {
+			e.removeNotifier()
+			e.removeNotifier = nil
+		}
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// serveConn serves the connection c.
+//  nbd/server.c: void nbd_client_new(NBDExport *exp, QIOChannelSocket *sioc, QCryptoTLSCreds *tlscreds, const char *tlsaclname, void (*close_fn)(NBDClient *, bool))
+func (s *Server) serveConn(c net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+		s.wg.Done()
+	}()
+
+	cl := &client{
+		srv: s,
+		r:   bufio.NewReader(c),
+		w:   bufio.NewWriter(c),
+	}
+
+	if err := cl.negotiate(); err != nil {
+		if err != errAbort && errors.Cause(err) != io.EOF {
+			s.logf("nbd: %s: negotiation failed: %v", c.RemoteAddr(), err)
+		}
+		return
+	}
+
+	if err := cl.transmission(); err != nil && errors.Cause(err) != io.EOF {
+		s.logf("nbd: %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+// client represents the state of a connection.
+//  nbd/server.c: struct NBDClient
+type client struct {
+	srv *Server
+	r   *bufio.Reader
+	w   *bufio.Writer
+
+	exp        *Export
+	noZeroes   bool
+	structured bool
+	// metaBaseAllocation whether the "base:allocation" metadata context is selected.
+	metaBaseAllocation bool
+}
+
+func (cl *client) read(v interface{}) error {
+	return binary.Read(cl.r, binary.BigEndian, v)
+}
+
+func (cl *client) write(v interface{}) error {
+	return binary.Write(cl.w, binary.BigEndian, v)
+}
+
+// negotiate performs the fixed newstyle negotiation, and selects the export.
+//  nbd/server.c: static coroutine_fn int nbd_negotiate(NBDClient *client, Error **errp)
+func (cl *client) negotiate() error {
+	cl.write(uint64(NBDMAGIC))
+	cl.write(uint64(IHAVEOPT))
+	cl.write(uint16(NBD_FLAG_FIXED_NEWSTYLE | NBD_FLAG_NO_ZEROES))
+	if err := cl.w.Flush(); err != nil {
+		return err
+	}
+
+	var clientFlags uint32
+	if err := cl.read(&clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&^(NBD_FLAG_C_FIXED_NEWSTYLE|NBD_FLAG_C_NO_ZEROES) != 0 {
+		return errors.Errorf("unknown client flags %#x", clientFlags)
+	}
+	cl.noZeroes = clientFlags&NBD_FLAG_C_NO_ZEROES != 0
+
+	for {
+		done, err := cl.negotiateOption(clientFlags&NBD_FLAG_C_FIXED_NEWSTYLE != 0)
+		if err != nil {
+			return err
+		}
+		if err := cl.w.Flush(); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// negotiateOption handles an option request, and returns true if the export is selected.
+//  nbd/server.c: static int nbd_negotiate_options(NBDClient *client, uint16_t myflags, Error **errp)
+func (cl *client) negotiateOption(fixed bool) (bool, error) {
+	var hdr struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}
+	if err := cl.read(&hdr); err != nil {
+		return false, err
+	}
+	if hdr.Magic != IHAVEOPT {
+		return false, errors.Errorf("invalid option magic %#x", hdr.Magic)
+	}
+	if hdr.Length > nbdMaxOptionSize {
+		return false, errors.Errorf("option %d is too long (%d bytes)", hdr.Option, hdr.Length)
+	}
+	data := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(cl.r, data); err != nil {
+		return false, err
+	}
+
+	if !fixed && hdr.Option != NBD_OPT_EXPORT_NAME {
+		// the unfixed newstyle client can not handle the option replies
+		return false, errors.Errorf("unsupported option %d of the unfixed newstyle client", hdr.Option)
+	}
+
+	switch hdr.Option {
+	case NBD_OPT_EXPORT_NAME:
+		exp := cl.srv.lookup(string(data))
+		if exp == nil {
+			return false, errors.Errorf("unknown export '%s'", data)
+		}
+		cl.exp = exp
+		cl.write(uint64(atomic.LoadInt64(&exp.size)))
+		cl.write(exp.transmissionFlags(cl.structured))
+		if !cl.noZeroes {
+			cl.w.Write(make([]byte, 124))
+		}
+		return true, nil
+
+	case NBD_OPT_ABORT:
+		cl.reply(hdr.Option, NBD_REP_ACK, nil)
+		cl.w.Flush()
+		return false, errAbort
+
+	case NBD_OPT_LIST:
+		if len(data) != 0 {
+			return false, cl.replyErr(hdr.Option, NBD_REP_ERR_INVALID, "no payload expected")
+		}
+		cl.srv.mu.Lock()
+		exports := append([]*Export(nil), cl.srv.exports...)
+		cl.srv.mu.Unlock()
+		for _, e := range exports {
+			buf := make([]byte, 4, 4+len(e.Name)+len(e.Description))
+			binary.BigEndian.PutUint32(buf, uint32(len(e.Name)))
+			buf = append(buf, e.Name...)
+			buf = append(buf, e.Description...)
+			if err := cl.reply(hdr.Option, NBD_REP_SERVER, buf); err != nil {
+				return false, err
+			}
+		}
+		return false, cl.reply(hdr.Option, NBD_REP_ACK, nil)
+
+	case NBD_OPT_STARTTLS:
+		return false, cl.replyErr(hdr.Option, NBD_REP_ERR_POLICY, "TLS is not supported")
+
+	case NBD_OPT_INFO, NBD_OPT_GO:
+		return cl.negotiateInfo(hdr.Option, data)
+
+	case NBD_OPT_STRUCTURED_REPLY:
+		if len(data) != 0 {
+			return false, cl.replyErr(hdr.Option, NBD_REP_ERR_INVALID, "no payload expected")
+		}
+		if cl.structured {
+			return false, cl.replyErr(hdr.Option, NBD_REP_ERR_INVALID, "structured reply already negotiated")
+		}
+		cl.structured = true
+		return false, cl.reply(hdr.Option, NBD_REP_ACK, nil)
+
+	case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+		return false, cl.negotiateMetaContext(hdr.Option, data)
+
+	default:
+		return false, cl.replyErr(hdr.Option, NBD_REP_ERR_UNSUP, "unsupported option")
+	}
+}
+
+// negotiateInfo handles NBD_OPT_INFO and NBD_OPT_GO, and returns true if the export is selected by NBD_OPT_GO.
+//  nbd/server.c: static int nbd_negotiate_handle_info(NBDClient *client, uint32_t length, uint32_t opt, uint16_t myflags, Error **errp)
+func (cl *client) negotiateInfo(opt uint32, data []byte) (bool, error) {
+	name, rest, ok := parseName(data)
+	if !ok || len(rest) < 2 {
+		return false, cl.replyErr(opt, NBD_REP_ERR_INVALID, "invalid payload")
+	}
+	nrRequests := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) != nrRequests*2 {
+		return false, cl.replyErr(opt, NBD_REP_ERR_INVALID, "invalid payload")
+	}
+
+	exp := cl.srv.lookup(name)
+	if exp == nil {
+		return false, cl.replyErr(opt, NBD_REP_ERR_UNKNOWN, "export '"+name+"' not present")
+	}
+	size := atomic.LoadInt64(&exp.size)
+
+	for ; len(rest) > 0; rest = rest[2:] {
+		var buf []byte
+		switch binary.BigEndian.Uint16(rest) {
+		case NBD_INFO_NAME:
+			buf = append([]byte{0, NBD_INFO_NAME}, exp.Name...)
+		case NBD_INFO_DESCRIPTION:
+			buf = append([]byte{0, NBD_INFO_DESCRIPTION}, exp.Description...)
+		case NBD_INFO_BLOCK_SIZE:
+			buf = make([]byte, 14)
+			binary.BigEndian.PutUint16(buf, NBD_INFO_BLOCK_SIZE)
+			binary.BigEndian.PutUint32(buf[2:], 1)
+			binary.BigEndian.PutUint32(buf[6:], nbdPreferredBlockSize)
+			binary.BigEndian.PutUint32(buf[10:], NBD_MAX_BUFFER_SIZE)
+		default:
+			continue
+		}
+		if err := cl.reply(opt, NBD_REP_INFO, buf); err != nil {
+			return false, err
+		}
+	}
+
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf, NBD_INFO_EXPORT)
+	binary.BigEndian.PutUint64(buf[2:], uint64(size))
+	binary.BigEndian.PutUint16(buf[10:], exp.transmissionFlags(cl.structured))
+	if err := cl.reply(opt, NBD_REP_INFO, buf); err != nil {
+		return false, err
+	}
+	if err := cl.reply(opt, NBD_REP_ACK, nil); err != nil {
+		return false, err
+	}
+
+	if opt == NBD_OPT_GO {
+		cl.exp = exp
+		return true, nil
+	}
+	return false, nil
+}
+
+// negotiateMetaContext handles NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT.
+// The only supported metadata context is "base:allocation".
+//  nbd/server.c: static int nbd_negotiate_meta_queries(NBDClient *client, NBDExportMetaContexts *meta, Error **errp)
+func (cl *client) negotiateMetaContext(opt uint32, data []byte) error {
+	if opt == NBD_OPT_SET_META_CONTEXT && !cl.structured {
+		return cl.replyErr(opt, NBD_REP_ERR_INVALID, "structured reply is not negotiated")
+	}
+
+	name, rest, ok := parseName(data)
+	if !ok || len(rest) < 4 {
+		return cl.replyErr(opt, NBD_REP_ERR_INVALID, "invalid payload")
+	}
+	nrQueries := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	var queries []string
+	for i := uint32(0); i < nrQueries; i++ {
+		var query string
+		query, rest, ok = parseName(rest)
+		if !ok {
+			return cl.replyErr(opt, NBD_REP_ERR_INVALID, "invalid payload")
+		}
+		queries = append(queries, query)
+	}
+	if len(rest) != 0 {
+		return cl.replyErr(opt, NBD_REP_ERR_INVALID, "invalid payload")
+	}
+
+	if cl.srv.lookup(name) == nil {
+		return cl.replyErr(opt, NBD_REP_ERR_UNKNOWN, "export '"+name+"' not present")
+	}
+
+	match := false
+	if opt == NBD_OPT_LIST_META_CONTEXT && len(queries) == 0 {
+		match = true
+	}
+	for _, q := range queries {
+		switch {
+		case q == NBD_META_BASE_ALLOCATION:
+			match = true
+		case opt == NBD_OPT_LIST_META_CONTEXT && q == "base:":
+			match = true
+		}
+	}
+
+	if opt == NBD_OPT_SET_META_CONTEXT {
+		cl.metaBaseAllocation = match
+	}
+	if match {
+		buf := make([]byte, 4, 4+len(NBD_META_BASE_ALLOCATION))
+		binary.BigEndian.PutUint32(buf, nbdMetaBaseAllocationID)
+		buf = append(buf, NBD_META_BASE_ALLOCATION...)
+		if err := cl.reply(opt, NBD_REP_META_CONTEXT, buf); err != nil {
+			return err
+		}
+	}
+
+	return cl.reply(opt, NBD_REP_ACK, nil)
+}
+
+// parseName parses the 32-bit length prefixed string of data, and returns the rest of data.
+func parseName(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if n > NBD_MAX_NAME_SIZE || uint32(len(data)) < n {
+		return "", nil, false
+	}
+
+	return string(data[:n]), data[n:], true
+}
+
+// reply writes the option reply.
+//  nbd/server.c: static int nbd_negotiate_send_rep_len(NBDClient *client, uint32_t type, uint32_t len, Error **errp)
+func (cl *client) reply(opt, typ uint32, data []byte) error {
+	cl.write(uint64(NBD_REP_MAGIC))
+	cl.write(opt)
+	cl.write(typ)
+	cl.write(uint32(len(data)))
+	_, err := cl.w.Write(data)
+	return err
+}
+
+// replyErr writes the error option reply with the message.
+//  nbd/server.c: static int nbd_negotiate_send_rep_err(NBDClient *client, uint32_t type, Error **errp, const char *fmt, ...)
+func (cl *client) replyErr(opt, typ uint32, msg string) error {
+	return cl.reply(opt, typ, []byte(msg))
+}
+
+// request represents the transmission request.
+//  include/block/nbd.h: struct NBDRequest
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+// transmission serves the requests to the selected export until the client disconnects.
+//  nbd/server.c: static coroutine_fn void nbd_trip(void *opaque)
+func (cl *client) transmission() error {
+	for {
+		var req request
+		if err := cl.read(&req); err != nil {
+			return err
+		}
+		if req.Magic != NBD_REQUEST_MAGIC {
+			return errors.Errorf("invalid request magic %#x", req.Magic)
+		}
+
+		var data []byte
+		if req.Type == NBD_CMD_WRITE {
+			if req.Length > NBD_MAX_BUFFER_SIZE {
+				return errors.Errorf("write request is too large (%d bytes)", req.Length)
+			}
+			data = make([]byte, req.Length)
+			if _, err := io.ReadFull(cl.r, data); err != nil {
+				return err
+			}
+		}
+
+		if req.Type == NBD_CMD_DISC {
+			return nil
+		}
+
+		if err := cl.handle(&req, data); err != nil {
+			return err
+		}
+		if err := cl.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles the request, and writes the reply.
+//  nbd/server.c: static coroutine_fn int nbd_handle_request(NBDClient *client, NBDRequest *request, uint8_t *data, Error **errp)
+func (cl *client) handle(req *request, data []byte) error {
+	exp := cl.exp
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+
+	var err error
+	size := atomic.LoadInt64(&exp.size)
+	inRange := req.Offset <= uint64(size) && uint64(req.Length) <= uint64(size)-req.Offset
+
+	switch req.Type {
+	case NBD_CMD_READ:
+		if req.Length > NBD_MAX_BUFFER_SIZE {
+			return cl.replyError(req, NBD_EINVAL, "read request is too large")
+		}
+		if !inRange {
+			return cl.replyError(req, NBD_EINVAL, "read beyond the end of the export")
+		}
+		buf := make([]byte, req.Length)
+		if _, err := exp.Image.ReadAt(buf, int64(req.Offset)); err != nil {
+			return cl.replyError(req, errno(err), err.Error())
+		}
+		return cl.replyRead(req, buf)
+
+	case NBD_CMD_WRITE, NBD_CMD_WRITE_ZEROES, NBD_CMD_TRIM:
+		if exp.readOnly() {
+			return cl.replyError(req, NBD_EPERM, "export is read-only")
+		}
+		if !inRange {
+			return cl.replyError(req, NBD_ENOSPC, "write beyond the end of the export")
+		}
+
+		// the FUA writes are written through by the image, and the FUA trim is followed by the sync of the image
+		var flags qcow2.BdrvRequestFlags
+		if req.Flags&NBD_CMD_FLAG_FUA != 0 {
+			flags |= qcow2.BDRV_REQ_FUA
+		}
+		switch req.Type {
+		case NBD_CMD_WRITE:
+			_, err = exp.Image.WriteAtFlags(data, int64(req.Offset), flags)
+		case NBD_CMD_WRITE_ZEROES:
+			if req.Flags&NBD_CMD_FLAG_NO_HOLE == 0 {
+				flags |= qcow2.BDRV_REQ_MAY_UNMAP
+			}
+			err = exp.Image.WriteZeroesFlags(int64(req.Offset), int64(req.Length), flags)
+		case NBD_CMD_TRIM:
+			err = exp.Image.Discard(int64(req.Offset), int64(req.Length))
+			if err == nil && flags&qcow2.BDRV_REQ_FUA != 0 {
+				err = exp.Image.Sync()
+			}
+		}
+		if err != nil {
+			return cl.replyError(req, errno(err), err.Error())
+		}
+		return cl.replyDone(req)
+
+	case NBD_CMD_FLUSH:
+		if f := exp.flusher(); f != nil {
+			if err := f.Flush(); err != nil {
+				return cl.replyError(req, errno(err), err.Error())
+			}
+		}
+		return cl.replyDone(req)
+
+	case NBD_CMD_BLOCK_STATUS:
+		if !cl.structured || !cl.metaBaseAllocation {
+			return cl.replyError(req, NBD_EINVAL, "no metadata context is selected")
+		}
+		if req.Length == 0 || !inRange {
+			return cl.replyError(req, NBD_EINVAL, "invalid block status request")
+		}
+		extents, err := exp.Image.MapRange(int64(req.Offset), int64(req.Length))
+		if err != nil {
+			return cl.replyError(req, errno(err), err.Error())
+		}
+		return cl.replyBlockStatus(req, extents)
+
+	case NBD_CMD_RESIZE:
+		if exp.readOnly() {
+			return cl.replyError(req, NBD_EPERM, "export is read-only")
+		}
+		if req.Length != 0 || req.Offset > math.MaxInt64 {
+			return cl.replyError(req, NBD_EINVAL, "invalid resize request")
+		}
+		// the image can not shrink, so the clients which are connected keep the valid size
+		if req.Offset < uint64(size) {
+			return cl.replyError(req, NBD_EINVAL, "shrinking the export is not supported")
+		}
+		if err := exp.Image.Resize(int64(req.Offset)); err != nil {
+			return cl.replyError(req, errno(err), err.Error())
+		}
+		return cl.replyDone(req)
+
+	default:
+		return cl.replyError(req, NBD_EINVAL, "unsupported command")
+	}
+}
+
+// replyHeader writes the simple reply header, or the structured reply chunk header of the length payload.
+func (cl *client) replyHeader(req *request, flags, typ uint16, length int) {
+	cl.write(uint32(NBD_STRUCTURED_REPLY_MAGIC))
+	cl.write(flags)
+	cl.write(typ)
+	cl.write(req.Handle)
+	cl.write(uint32(length))
+}
+
+// replySimple writes the simple reply.
+//  nbd/server.c: static int nbd_co_send_simple_reply(NBDClient *client, uint64_t handle, uint32_t error, void *data, size_t len, Error **errp)
+func (cl *client) replySimple(req *request, nbdErr uint32, data []byte) error {
+	cl.write(uint32(NBD_SIMPLE_REPLY_MAGIC))
+	cl.write(nbdErr)
+	cl.write(req.Handle)
+	_, err := cl.w.Write(data)
+	return err
+}
+
+// replyDone writes the successful reply without payload.
+func (cl *client) replyDone(req *request) error {
+	if !cl.structured {
+		return cl.replySimple(req, NBD_SUCCESS, nil)
+	}
+
+	cl.replyHeader(req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, 0)
+	return nil
+}
+
+// replyRead writes the reply of the read request.
+// The data is sent by a NBD_REPLY_TYPE_OFFSET_DATA chunk for the structured reply, which also satisfies
+// the NBD_CMD_FLAG_DF flag.
+//  nbd/server.c: static int nbd_co_send_structured_read(NBDClient *client, uint64_t handle, uint64_t offset, void *data, size_t size, bool final, Error **errp)
+func (cl *client) replyRead(req *request, data []byte) error {
+	if !cl.structured {
+		return cl.replySimple(req, NBD_SUCCESS, data)
+	}
+
+	cl.replyHeader(req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_OFFSET_DATA, 8+len(data))
+	cl.write(req.Offset)
+	_, err := cl.w.Write(data)
+	return err
+}
+
+// replyError writes the error reply with the message.
+//  nbd/server.c: static int nbd_co_send_structured_error(NBDClient *client, uint64_t handle, uint32_t error, const char *msg, Error **errp)
+func (cl *client) replyError(req *request, nbdErr uint32, msg string) error {
+	if !cl.structured {
+		return cl.replySimple(req, nbdErr, nil)
+	}
+
+	cl.replyHeader(req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, 6+len(msg))
+	cl.write(nbdErr)
+	cl.write(uint16(len(msg)))
+	_, err := cl.w.WriteString(msg)
+	return err
+}
+
+// replyBlockStatus writes the block status of the "base:allocation" metadata context.
+//  nbd/server.c: static int nbd_co_send_block_status(NBDClient *client, uint64_t handle, BlockDriverState *bs, uint64_t offset, uint32_t length, bool dont_fragment, uint32_t context_id, Error **errp)
+func (cl *client) replyBlockStatus(req *request, extents []qcow2.Extent) error {
+	type descriptor struct {
+		Length uint32
+		Flags  uint32
+	}
+
+	var descs []descriptor
+	for _, e := range extents {
+		var flags uint32
+		if !e.Data {
+			flags |= NBD_STATE_HOLE
+		}
+		if e.Zero {
+			flags |= NBD_STATE_ZERO
+		}
+
+		if n := len(descs); n > 0 && descs[n-1].Flags == flags {
+			descs[n-1].Length += uint32(e.Length)
+			continue
+		}
+		if req.Flags&NBD_CMD_FLAG_REQ_ONE != 0 && len(descs) == 1 {
+			break
+		}
+		descs = append(descs, descriptor{Length: uint32(e.Length), Flags: flags})
+	}
+
+	cl.replyHeader(req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS, 4+8*len(descs))
+	cl.write(uint32(nbdMetaBaseAllocationID))
+	return cl.write(descs)
+}
+
+// errno returns the NBD error of err.
+//  nbd/server.c: static int system_errno_to_nbd_errno(int err)
+func errno(err error) uint32 {
+	switch {
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EROFS), errors.Is(err, syscall.EBADF):
+		return NBD_EPERM
+	case errors.Is(err, syscall.ENOMEM):
+		return NBD_ENOMEM
+	case errors.Is(err, syscall.EINVAL):
+		return NBD_EINVAL
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EFBIG), errors.Is(err, io.ErrShortWrite):
+		return NBD_ENOSPC
+	case errors.Is(err, syscall.EOVERFLOW):
+		return NBD_EOVERFLOW
+	case errors.Is(err, syscall.ENOTSUP):
+		return NBD_ENOTSUP
+	case errors.Is(err, syscall.ESHUTDOWN):
+		return NBD_ESHUTDOWN
+	default:
+		return NBD_EIO
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package nbd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+)
+
+func TestServerResize(t *testing.T) {
+	img, err := qcow2.CreateImage(filepath.Join(t.TempDir(), "export.qcow2"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	srv := NewServer()
+	exp := &Export{Name: "disk", Image: img}
+	if err := srv.AddExport(exp); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := Dial("tcp", l.Addr().String(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.flags&NBD_FLAG_SEND_RESIZE == 0 {
+		t.Fatal("the writable export does not advertise NBD_FLAG_SEND_RESIZE")
+	}
+	if err := c.Truncate(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := img.VirtualSize(); err != nil || size != 2<<20 {
+		t.Fatalf("image size %d, %v, want %d", size, err, 2<<20)
+	}
+	if _, err := c.WriteAt([]byte("grown"), 2<<20-5); err != nil {
+		t.Fatalf("write to the grown range: %v", err)
+	}
+	if err := c.Truncate(1 << 20); err == nil {
+		t.Fatal("shrinking the export succeeded")
+	}
+
+	// the resize by the other user of the image is seen by the new clients
+	if err := img.Resize(3 << 20); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Dial("tcp", l.Addr().String(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if size, _ := c2.Size(); size != 3<<20 {
+		t.Fatalf("new client got size %d, want %d", size, 3<<20)
+	}
+
+	srv.Close()
+	if exp.removeNotifier != nil {
+		t.Fatal("the resize notifier is left registered after Close")
+	}
+}
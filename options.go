@@ -0,0 +1,175 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// The units of the sizes in bytes, such as WithClusterSize(64 * KiB).
+const (
+	KiB = 1 << 10
+	MiB = 1 << 20
+	GiB = 1 << 30
+	TiB = 1 << 40
+)
+
+// Option sets the option of the image which is created by CreateImage. The value of the option is validated when it
+// is set, and the combination of the options is validated by NewOpts before the image file is created.
+type Option func(opts *Opts) error
+
+// WithBackingFile creates the image on the backing file of path, whose image format is format, or probed if
+// format is empty. The size of the image defaults to the size of the backing file.
+func WithBackingFile(path string, format DriverFmt) Option {
+	return func(opts *Opts) error {
+		if path == "" {
+			return errors.Wrap(ErrInvalidOption, "Expecting backing file name")
+		}
+		if opts.BackingFile != "" {
+			return errors.Wrap(ErrInvalidOption, "Backing file specified twice")
+		}
+		opts.BackingFile = path
+		opts.BackingFormat = string(format)
+		return nil
+	}
+}
+
+// WithClusterSize sets the cluster size of the image in bytes, which must be a power of two between 512 and 2 MiB.
+// The cluster size is selected by the virtual size of the image by default.
+func WithClusterSize(size int) Option {
+	return func(opts *Opts) error {
+		clusterBits := ctz32(uint32(size))
+		if size <= 0 || clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || 1<<uint(clusterBits) != size {
+			err := errors.Wrapf(ErrInvalidOption, "Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+			return err
+		}
+		opts.ClusterSize = size
+		return nil
+	}
+}
+
+// WithPrealloc sets the preallocation mode of the image, which can not be used with WithBackingFile.
+func WithPrealloc(mode PreallocMode) Option {
+	return func(opts *Opts) error {
+		if mode < 0 || mode >= PREALLOC_MODE__MAX {
+			return errors.Wrapf(ErrInvalidOption, "Invalid preallocation mode %d", int(mode))
+		}
+		opts.Preallocation = mode
+		return nil
+	}
+}
+
+// WithCompat sets the compatibility level of the image, which is "0.10" or "1.1". The default is "1.1".
+func WithCompat(compat string) Option {
+	return func(opts *Opts) error {
+		if compat != "0.10" && compat != "1.1" {
+			return errors.Wrapf(ErrInvalidOption, "Invalid compatibility level: '%s'", compat)
+		}
+		opts.Compat = compat
+		return nil
+	}
+}
+
+// WithLazyRefcounts postpones the refcount updates of the image, which requires the compatibility level 1.1.
+func WithLazyRefcounts() Option {
+	return func(opts *Opts) error {
+		opts.LazyRefcounts = true
+		return nil
+	}
+}
+
+// WithRefcountBits sets the width of the refcount entry of the image in bits, which must be a power of two and
+// may not exceed 64. The widths other than 16 require the compatibility level 1.1.
+func WithRefcountBits(bits int) Option {
+	return func(opts *Opts) error {
+		if bits <= 0 || bits > 64 || bits&(bits-1) != 0 {
+			return errors.Wrap(ErrInvalidOption, "Refcount width must be a power of two and may not exceed 64 bits")
+		}
+		opts.RefcountBits = bits
+		return nil
+	}
+}
+
+// WithNoCow turns off the copy-on-write of the image file on btrfs, same as Opts.NoCow.
+func WithNoCow() Option {
+	return func(opts *Opts) error {
+		opts.NoCow = true
+		return nil
+	}
+}
+
+// WithDeterministic creates the reproducible image, same as Opts.Deterministic.
+func WithDeterministic() Option {
+	return func(opts *Opts) error {
+		opts.Deterministic = true
+		return nil
+	}
+}
+
+// WithWrapBackend wraps the Backend of the image file, same as Opts.WrapBackend.
+func WithWrapBackend(wrap func(Backend) Backend) Option {
+	return func(opts *Opts) error {
+		if wrap == nil {
+			return errors.Wrap(ErrInvalidOption, "Expecting the function which wraps the Backend")
+		}
+		opts.WrapBackend = wrap
+		return nil
+	}
+}
+
+// NewOpts returns the Opts of the qcow2 image of filename, whose virtual size is size bytes, with options.
+// The size can be zero only with WithBackingFile. It fails if the option has the invalid value, or the
+// combination of the options is not supported, such as WithBackingFile and WithPrealloc.
+func NewOpts(filename string, size int64, options ...Option) (*Opts, error) {
+	if filename == "" {
+		err := errors.Wrap(ErrInvalidOption, "Expecting image file name")
+		return nil, err
+	}
+	if size < 0 {
+		err := errors.Wrap(ErrInvalidOption, "Invalid image size specified")
+		return nil, err
+	}
+
+	opts := &Opts{
+		Filename: filename,
+		Fmt:      DriverQCow2,
+		Size:     size,
+	}
+	for _, o := range options {
+		if err := o(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Size == 0 && opts.BackingFile == "" {
+		err := errors.Wrap(ErrInvalidOption, "Image creation needs a size parameter")
+		return nil, err
+	}
+	if err := validateCreateOpts(opts); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// CreateImage creates the qcow2 image of filename, whose virtual size is size bytes, with options, and opens it.
+// The options are validated by NewOpts before the image file is created.
+func CreateImage(filename string, size int64, options ...Option) (*QCow2, error) {
+	return CreateImageContext(context.Background(), filename, size, options...)
+}
+
+// CreateImageContext is like CreateImage, but returns the error of ctx if ctx is done before the image is created.
+func CreateImageContext(ctx context.Context, filename string, size int64, options ...Option) (*QCow2, error) {
+	opts, err := NewOpts(filename, size, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateContext(ctx, opts)
+}
@@ -0,0 +1,386 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"syscall"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// The partition table schemes.
+const (
+	PartitionTableMBR = "mbr"
+	PartitionTableGPT = "gpt"
+)
+
+const (
+	// mbrSectorSize the size of the sector which the MBR partition table addresses.
+	mbrSectorSize = 512
+	// mbrMaxLogical the maximum number of the logical partitions, which guards the loop of the EBR chain.
+	mbrMaxLogical = 256
+
+	// gptMaxEntries the maximum number of the GPT partition entries.
+	gptMaxEntries = 1024
+)
+
+// The MBR partition types of the extended partition.
+var mbrExtendedTypes = map[byte]bool{
+	0x05: true, // Extended (CHS)
+	0x0f: true, // W95 Extended (LBA)
+	0x85: true, // Linux extended
+}
+
+// mbrProtectiveType the MBR partition type of the protective MBR of the GPT disk.
+const mbrProtectiveType = 0xee
+
+// gptSignature the signature of the GPT header.
+var gptSignature = []byte("EFI PART")
+
+// Partition represents a partition of the guest disk.
+type Partition struct {
+	// Table the scheme of the partition table, PartitionTableMBR or PartitionTableGPT.
+	Table string
+	// Index the number of the partition, same as Linux. The primary MBR partitions are 1 to 4, and the
+	// logical partitions start at 5. The GPT partitions are numbered by their entries.
+	Index int
+	// Start guest offset of the partition in bytes.
+	Start int64
+	// Length length of the partition in bytes.
+	Length int64
+	// Type the partition type, which is the system ID such as "0x83" for MBR, or the partition type GUID for GPT.
+	Type string
+	// Bootable whether the MBR partition is marked as active. Always false for GPT.
+	Bootable bool
+	// GUID the unique partition GUID of the GPT partition.
+	GUID string
+	// Name the name of the GPT partition.
+	Name string
+
+	// Reader reads the contents of the partition from the guest disk.
+	Reader *io.SectionReader
+}
+
+// Partitions parses the partition table of the guest disk, and returns the partitions, whose Reader reads the
+// partition over ReadAt of the image, so each partition can be fed to the filesystem libraries.
+// The GPT is used if the disk has the protective MBR, otherwise the MBR partition table with its logical
+// partitions. It returns no partitions if the disk has no partition table.
+//  qemu-nbd.c: static int find_partition(BlockBackend *blk, int partition, uint64_t *offset, uint64_t *size)
+func (q *QCow2) Partitions() ([]Partition, error) {
+	size, err := q.VirtualSize()
+	if err != nil {
+		return nil, err
+	}
+	return ReadPartitions(q, size)
+}
+
+// ReadPartitions parses the partition table of the disk r of size bytes, same as Partitions.
+func ReadPartitions(r io.ReaderAt, size int64) ([]Partition, error) {
+	mbr := make([]byte, mbrSectorSize)
+	if err := readFull(r, mbr, 0); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the disk is smaller than the sector
+			return nil, nil
+		}
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, nil
+	}
+
+	var records [4]partitionRecord
+	for i := range records {
+		records[i] = readPartition(mbr[446+16*i:])
+		if records[i].system == mbrProtectiveType {
+			return readGPT(r, size)
+		}
+	}
+
+	return readMBR(r, size, records)
+}
+
+// partitionRecord represents the entry of the MBR partition table.
+//  qemu-nbd.c: struct partition_record
+type partitionRecord struct {
+	bootIndicator  uint8  // uint8_t boot_indicator
+	startHead      uint8  // uint8_t start_head
+	startCylinder  uint16 // uint16_t start_cylinder
+	startSector    uint8  // uint8_t start_sector
+	system         uint8  // uint8_t system
+	endHead        uint8  // uint8_t end_head
+	endSector      uint8  // uint8_t end_sector
+	endCylinder    uint16 // uint16_t end_cylinder
+	startSectorAbs uint32 // uint32_t start_sector_abs
+	nbSectorsAbs   uint32 // uint32_t nb_sectors_abs
+}
+
+// readPartition parses the entry of the MBR partition table p.
+//  qemu-nbd.c: static void read_partition(uint8_t *p, struct partition_record *r)
+func readPartition(p []byte) partitionRecord {
+	return partitionRecord{
+		bootIndicator:  p[0],
+		startHead:      p[1],
+		startCylinder:  uint16(p[3]) | uint16(p[2]>>6)<<8,
+		startSector:    p[2] & 0x3f,
+		system:         p[4],
+		endHead:        p[5],
+		endCylinder:    uint16(p[7]) | uint16(p[6]>>6)<<8,
+		endSector:      p[6] & 0x3f,
+		startSectorAbs: binary.LittleEndian.Uint32(p[8:]),
+		nbSectorsAbs:   binary.LittleEndian.Uint32(p[12:]),
+	}
+}
+
+// readMBR returns the primary partitions of records, and the logical partitions which are chained by the EBRs
+// from the extended partition.
+//  qemu-nbd.c: static int find_partition(BlockBackend *blk, int partition, uint64_t *offset, uint64_t *size)
+func readMBR(r io.ReaderAt, size int64, records [4]partitionRecord) ([]Partition, error) {
+	var parts []Partition
+	var extended *partitionRecord
+
+	for i := range records {
+		rec := &records[i]
+		if rec.system == 0 || rec.nbSectorsAbs == 0 {
+			continue
+		}
+		if mbrExtendedTypes[rec.system] {
+			if extended == nil {
+				extended = rec
+			}
+			continue
+		}
+		if p, ok := newMBRPartition(r, size, i+1, 0, rec); ok {
+			parts = append(parts, p)
+		}
+	}
+	if extended == nil {
+		return parts, nil
+	}
+
+	// each EBR has the logical partition relative to the EBR, and the link to the next EBR relative to the
+	// extended partition
+	base := int64(extended.startSectorAbs)
+	ebr := make([]byte, mbrSectorSize)
+	next := base
+	visited := make(map[int64]bool)
+	for index := 5; index < 5+mbrMaxLogical; index++ {
+		if visited[next] {
+			return nil, errors.Wrapf(ErrInvalidPartitionTable, "Loop in the extended partition at sector %d", next)
+		}
+		visited[next] = true
+
+		if err := readFull(r, ebr, next*mbrSectorSize); err != nil {
+			return nil, errors.Wrapf(err, "Could not read the extended partition at sector %d", next)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			break
+		}
+
+		logical := readPartition(ebr[446:])
+		if logical.system != 0 && logical.nbSectorsAbs != 0 {
+			if p, ok := newMBRPartition(r, size, index, next, &logical); ok {
+				parts = append(parts, p)
+			}
+		}
+
+		link := readPartition(ebr[446+16:])
+		if link.nbSectorsAbs == 0 || !mbrExtendedTypes[link.system] {
+			break
+		}
+		next = base + int64(link.startSectorAbs)
+	}
+
+	return parts, nil
+}
+
+// newMBRPartition returns the partition of the MBR entry rec, whose start sector is relative to the sector
+// base. The partition is truncated to the disk size, and ok is false if it starts beyond the disk.
+func newMBRPartition(r io.ReaderAt, size int64, index int, base int64, rec *partitionRecord) (Partition, bool) {
+	start := (base + int64(rec.startSectorAbs)) * mbrSectorSize
+	length := int64(rec.nbSectorsAbs) * mbrSectorSize
+	if start >= size {
+		return Partition{}, false
+	}
+	if length > size-start {
+		length = size - start
+	}
+
+	return Partition{
+		Table:    PartitionTableMBR,
+		Index:    index,
+		Start:    start,
+		Length:   length,
+		Type:     fmt.Sprintf("0x%02x", rec.system),
+		Bootable: rec.bootIndicator == 0x80,
+		Reader:   io.NewSectionReader(r, start, length),
+	}, true
+}
+
+// gptHeader represents the GPT header.
+type gptHeader struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCRC32              uint32
+	Reserved                 uint32
+	MyLBA                    uint64
+	AlternateLBA             uint64
+	FirstUsableLBA           uint64
+	LastUsableLBA            uint64
+	DiskGUID                 [16]byte
+	PartitionEntryLBA        uint64
+	NumberOfPartitionEntries uint32
+	SizeOfPartitionEntry     uint32
+	PartitionEntryArrayCRC32 uint32
+}
+
+// gptEntry represents the GPT partition entry.
+type gptEntry struct {
+	PartitionTypeGUID   [16]byte
+	UniquePartitionGUID [16]byte
+	StartingLBA         uint64
+	EndingLBA           uint64
+	Attributes          uint64
+	PartitionName       [36]uint16
+}
+
+// readGPT returns the partitions of the GPT. The logical block size of the disk is probed from 512 and 4096
+// bytes, and the backup GPT at the end of the disk is used if the primary GPT is corrupt.
+func readGPT(r io.ReaderAt, size int64) ([]Partition, error) {
+	var lastErr error
+	for _, blockSize := range []int64{512, 4096} {
+		if size < 2*blockSize {
+			break
+		}
+		for _, lba := range []int64{1, size/blockSize - 1} {
+			hdr, entries, err := readGPTHeader(r, blockSize, lba)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return newGPTPartitions(r, size, blockSize, hdr, entries), nil
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = syscall.EINVAL
+	}
+	return nil, errors.Wrap(lastErr, "Invalid GPT")
+}
+
+// readGPTHeader reads the GPT header at lba and its partition entries, and validates their CRC32.
+func readGPTHeader(r io.ReaderAt, blockSize, lba int64) (*gptHeader, []byte, error) {
+	buf := make([]byte, blockSize)
+	if err := readFull(r, buf, lba*blockSize); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(buf[:len(gptSignature)], gptSignature) {
+		return nil, nil, errors.Wrapf(ErrInvalidPartitionTable, "No GPT header at LBA %d", lba)
+	}
+
+	hdr := new(gptHeader)
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.HeaderSize < uint32(binary.Size(hdr)) || int64(hdr.HeaderSize) > blockSize {
+		return nil, nil, errors.Wrapf(ErrInvalidPartitionTable, "Invalid GPT header size %d", hdr.HeaderSize)
+	}
+	sum := make([]byte, hdr.HeaderSize)
+	copy(sum, buf)
+	binary.LittleEndian.PutUint32(sum[16:], 0)
+	if crc32.ChecksumIEEE(sum) != hdr.HeaderCRC32 {
+		return nil, nil, errors.Wrapf(ErrInvalidPartitionTable, "GPT header CRC mismatch at LBA %d", lba)
+	}
+	if hdr.SizeOfPartitionEntry < uint32(binary.Size(gptEntry{})) || hdr.SizeOfPartitionEntry%8 != 0 ||
+		hdr.NumberOfPartitionEntries > gptMaxEntries {
+		return nil, nil, errors.Wrapf(ErrInvalidPartitionTable, "Invalid GPT partition entries %d of %d bytes",
+			hdr.NumberOfPartitionEntries, hdr.SizeOfPartitionEntry)
+	}
+
+	entries := make([]byte, int64(hdr.NumberOfPartitionEntries)*int64(hdr.SizeOfPartitionEntry))
+	if err := readFull(r, entries, int64(hdr.PartitionEntryLBA)*blockSize); err != nil {
+		return nil, nil, errors.Wrap(err, "Could not read the GPT partition entries")
+	}
+	if crc32.ChecksumIEEE(entries) != hdr.PartitionEntryArrayCRC32 {
+		return nil, nil, errors.Wrapf(ErrInvalidPartitionTable, "GPT partition entries CRC mismatch at LBA %d", hdr.PartitionEntryLBA)
+	}
+
+	return hdr, entries, nil
+}
+
+// newGPTPartitions returns the partitions of the used GPT partition entries. The partition is truncated to
+// the disk size, and is ignored if it starts beyond the disk.
+func newGPTPartitions(r io.ReaderAt, size, blockSize int64, hdr *gptHeader, entries []byte) []Partition {
+	var parts []Partition
+	var zero [16]byte
+
+	for i := 0; i < int(hdr.NumberOfPartitionEntries); i++ {
+		var e gptEntry
+		p := entries[i*int(hdr.SizeOfPartitionEntry):]
+		if err := binary.Read(bytes.NewReader(p), binary.LittleEndian, &e); err != nil {
+			break
+		}
+		if e.PartitionTypeGUID == zero || e.EndingLBA < e.StartingLBA {
+			continue
+		}
+
+		start := int64(e.StartingLBA) * blockSize
+		length := int64(e.EndingLBA-e.StartingLBA+1) * blockSize
+		if start < 0 || start >= size {
+			continue
+		}
+		if length <= 0 || length > size-start {
+			length = size - start
+		}
+
+		name := e.PartitionName[:]
+		for j, c := range name {
+			if c == 0 {
+				name = name[:j]
+				break
+			}
+		}
+
+		parts = append(parts, Partition{
+			Table:  PartitionTableGPT,
+			Index:  i + 1,
+			Start:  start,
+			Length: length,
+			Type:   formatGUID(e.PartitionTypeGUID),
+			GUID:   formatGUID(e.UniquePartitionGUID),
+			Name:   string(utf16.Decode(name)),
+			Reader: io.NewSectionReader(r, start, length),
+		})
+	}
+
+	return parts
+}
+
+// formatGUID formats the mixed-endian GUID of GPT, whose first three fields are little-endian.
+func formatGUID(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]), binary.LittleEndian.Uint16(g[6:]),
+		g[8:10], g[10:])
+}
+
+// readFull reads len(buf) bytes at off of r. It returns io.ErrUnexpectedEOF if r is shorter.
+func readFull(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,414 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// qcowHeaderSize is the size of the qcow (version 1) image header.
+//  block/qcow.c: sizeof(QCowHeader)
+const qcowHeaderSize = 48
+
+// QCOW_OFLAG_COMPRESSED the L2 table entry of the qcow image refers to the compressed cluster.
+//  block/qcow.c: #define QCOW_OFLAG_COMPRESSED (1ULL << 63)
+const QCOW_OFLAG_COMPRESSED = 1 << 63
+
+// QCOW_L2_CACHE_SIZE the number of the L2 tables cached by the qcow driver.
+//  block/qcow.c: #define L2_CACHE_SIZE 16
+const QCOW_L2_CACHE_SIZE = 16
+
+// QCowHeader represents the header of the qcow (version 1) image.
+//  block/qcow.c: typedef struct QCowHeader
+type QCowHeader struct {
+	Magic             uint32 //  [0:3] magic: QCOW magic string ("QFI\xfb")
+	Version           uint32 //  [4:7] Version number (only valid value is 1)
+	BackingFileOffset uint64 // [8:15] Offset into the image file at which the backing file name is stored
+	BackingFileSize   uint32 // [16:19] Length of the backing file name in bytes
+	Mtime             uint32 // [20:23] Modification time of the image
+	Size              uint64 // [24:31] Virtual disk size in bytes
+	ClusterBits       uint8  //    [32] Number of bits of the offset within a cluster
+	L2Bits            uint8  //    [33] Number of bits of the index within a L2 table
+	Padding           uint16 // [34:35]
+	CryptMethod       uint32 // [36:39] 0 for no encryption, 1 for AES encryption
+	L1TableOffset     uint64 // [40:47] Offset into the image file at which the L1 table starts
+}
+
+// qcowState represents the state of the qcow (version 1) image.
+//  block/qcow.c: typedef struct BDRVQcowState
+type qcowState struct {
+	// lock guards the L2 table cache and the cluster cache.
+	lock sync.Mutex
+
+	clusterBits       int
+	clusterSize       int
+	l2Bits            int
+	l2Size            int
+	l1Size            int
+	clusterOffsetMask uint64
+	l1TableOffset     uint64
+	l1Table           []uint64
+
+	l2Cache       [QCOW_L2_CACHE_SIZE][]uint64
+	l2CacheOffset [QCOW_L2_CACHE_SIZE]uint64
+	l2CacheCounts [QCOW_L2_CACHE_SIZE]uint32
+
+	clusterCache       []byte
+	clusterData        []byte
+	clusterCacheOffset uint64
+
+	cryptMethodHeader uint32
+}
+
+// bdrvQCow is the qcow (version 1) format block driver. The image can only be read, such as the source of
+// the conversion to the qcow2 image.
+//  block/qcow.c: BlockDriver bdrv_qcow
+var bdrvQCow = &BlockDriver{
+	formatName:           DriverQCow,
+	supportsBacking:      true,
+	bdrvProbe:            qcowProbe,
+	bdrvOpen:             qcowOpen,
+	bdrvClose:            qcowClose,
+	bdrvCoPreadv:         qcowPreadv,
+	bdrvCoGetBlockStatus: qcowGetBlockStatus,
+}
+
+func init() {
+	bdrvRegister(bdrvQCow)
+}
+
+// qcowProbe returns the score of buf as the qcow image, which has the magic and the version 1.
+//  block/qcow.c: static int qcow_probe(const uint8_t *buf, int buf_size, const char *filename)
+func qcowProbe(buf []byte, filename string) int {
+	if len(buf) >= qcowHeaderSize && bytes.Equal(buf[:len(MAGIC)], MAGIC) && BEUint32(buf[4:8]) == 1 {
+		return 100
+	}
+
+	return 0
+}
+
+// qcowOpen opens the qcow image as read-only.
+//  block/qcow.c: static int qcow_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func qcowOpen(bs *BlockDriverState, options *QDict, flags int) error {
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err := errors.Wrap(ErrUnsupported, "qcow images can only be opened read-only")
+		return err
+	}
+
+	var header QCowHeader
+	buf := make([]byte, qcowHeaderSize)
+	if err := bdrvPread(bs.file, 0, buf); err != nil {
+		err = errors.Wrap(err, "Could not read qcow header")
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &header); err != nil {
+		err = errors.Wrap(err, "Could not read qcow header")
+		return err
+	}
+
+	if !bytes.Equal(BEUvarint32(header.Magic), MAGIC) {
+		err := errors.Wrap(ErrNotQcow2, "Image not in qcow format")
+		return err
+	}
+	if header.Version != 1 {
+		err := errors.Wrapf(ErrUnsupportedVersion, "Unsupported qcow version %d", header.Version)
+		return err
+	}
+
+	if header.Size <= 1 {
+		err := errors.Wrap(ErrInvalidHeader, "Image size is too small (must be at least 2 bytes)")
+		return err
+	}
+	if header.ClusterBits < 9 || header.ClusterBits > 16 {
+		err := errors.Wrap(ErrInvalidHeader, "Cluster size must be between 512 and 64k")
+		return err
+	}
+
+	// l2_bits specifies number of entries; storing a uint64_t in each entry, so bytes = num_entries << 3
+	if header.L2Bits < 9-3 || header.L2Bits > 16-3 {
+		err := errors.Wrap(ErrInvalidHeader, "L2 table size must be between 512 and 64k")
+		return err
+	}
+
+	if header.CryptMethod > uint32(CRYPT_AES) {
+		err := errors.Wrap(ErrInvalidHeader, "invalid encryption method in qcow header")
+		return err
+	}
+	if header.CryptMethod != uint32(CRYPT_NONE) {
+		err := errors.Wrap(ErrEncrypted, "Use of AES-CBC encrypted qcow images is not supported")
+		return err
+	}
+
+	s := &qcowState{
+		clusterBits:        int(header.ClusterBits),
+		clusterSize:        1 << header.ClusterBits,
+		l2Bits:             int(header.L2Bits),
+		l2Size:             1 << header.L2Bits,
+		clusterOffsetMask:  (uint64(1) << uint(63-header.ClusterBits)) - 1,
+		l1TableOffset:      header.L1TableOffset,
+		clusterCacheOffset: ^uint64(0),
+		cryptMethodHeader:  header.CryptMethod,
+	}
+	bs.TotalSectors = int64(header.Size / 512)
+
+	// read the level 1 table
+	shift := uint(s.clusterBits + s.l2Bits)
+	if header.Size > UINT64_MAX-(uint64(1)<<shift) {
+		err := errors.Wrap(ErrTooLarge, "Image too large")
+		return err
+	}
+	l1Size := (header.Size + (uint64(1) << shift) - 1) >> shift
+	if l1Size > INT_MAX/8 {
+		err := errors.Wrap(ErrTooLarge, "Image too large")
+		return err
+	}
+	s.l1Size = int(l1Size)
+
+	fileSize, err := bs.file.bs.File.Size()
+	if err != nil {
+		err = errors.Wrap(err, "Could not get the image file size")
+		return err
+	}
+	if s.l1TableOffset > uint64(fileSize) || uint64(s.l1Size)*UINT64_SIZE > uint64(fileSize)-s.l1TableOffset {
+		err := errors.Wrap(ErrInvalidHeader, "L1 table exceeds the end of the image file")
+		return err
+	}
+
+	l1 := make([]byte, s.l1Size*UINT64_SIZE)
+	if err := bdrvPread(bs.file, int64(s.l1TableOffset), l1); err != nil {
+		err = errors.Wrap(err, "Could not read L1 table")
+		return err
+	}
+	s.l1Table = make([]uint64, s.l1Size)
+	for i := range s.l1Table {
+		s.l1Table[i] = BEUint64(l1[i*UINT64_SIZE:])
+	}
+
+	// read the backing file name
+	if header.BackingFileOffset != 0 {
+		length := header.BackingFileSize
+		if length > 1023 {
+			err := errors.Wrap(ErrInvalidHeader, "Backing file name too long")
+			return err
+		}
+		backingFile := make([]byte, length)
+		if err := bdrvPread(bs.file, int64(header.BackingFileOffset), backingFile); err != nil {
+			err = errors.Wrap(err, "Could not read backing file name")
+			return err
+		}
+		bs.BackingFile = string(backingFile)
+	}
+
+	bs.qcowOpaque = s
+
+	return nil
+}
+
+// qcowClose closes the qcow image.
+//  block/qcow.c: static void qcow_close(BlockDriverState *bs)
+func qcowClose(bs *BlockDriverState) {
+	bs.qcowOpaque = nil
+}
+
+// qcowL2Table returns the L2 table at l2Offset from the L2 table cache, and reads it if it is not cached.
+// The caller must hold s.lock.
+//  block/qcow.c: static int get_cluster_offset(BlockDriverState *bs, uint64_t offset, int allocate, int compressed_size, int n_start, int n_end, uint64_t *result)
+func qcowL2Table(bs *BlockDriverState, l2Offset uint64) ([]uint64, error) {
+	s := bs.qcowOpaque
+
+	// seek the l2 offset in the l2 cache
+	for i := 0; i < QCOW_L2_CACHE_SIZE; i++ {
+		if l2Offset == s.l2CacheOffset[i] {
+			// increment the hit count
+			s.l2CacheCounts[i]++
+			if s.l2CacheCounts[i] == 0xffffffff {
+				for j := range s.l2CacheCounts {
+					s.l2CacheCounts[j] >>= 1
+				}
+			}
+			return s.l2Cache[i], nil
+		}
+	}
+
+	// not found: load a new entry in the least used one
+	minIndex := 0
+	minCount := uint32(0xffffffff)
+	for i := 0; i < QCOW_L2_CACHE_SIZE; i++ {
+		if s.l2CacheCounts[i] < minCount {
+			minCount = s.l2CacheCounts[i]
+			minIndex = i
+		}
+	}
+
+	buf := make([]byte, s.l2Size*UINT64_SIZE)
+	if err := bdrvPread(bs.file, int64(l2Offset), buf); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, s.l2Size)
+	for i := range table {
+		table[i] = BEUint64(buf[i*UINT64_SIZE:])
+	}
+
+	s.l2Cache[minIndex] = table
+	s.l2CacheOffset[minIndex] = l2Offset
+	s.l2CacheCounts[minIndex] = 1
+
+	return table, nil
+}
+
+// qcowGetClusterOffset returns the L2 table entry of the cluster at the guest offset, which is the host offset
+// of the cluster, or the compressed cluster descriptor with QCOW_OFLAG_COMPRESSED. It returns 0 if the cluster
+// is not allocated. The caller must hold s.lock.
+//  block/qcow.c: static int get_cluster_offset(BlockDriverState *bs, uint64_t offset, int allocate, int compressed_size, int n_start, int n_end, uint64_t *result)
+func qcowGetClusterOffset(bs *BlockDriverState, offset uint64) (uint64, error) {
+	s := bs.qcowOpaque
+
+	l1Index := int(offset >> uint(s.l2Bits+s.clusterBits))
+	if l1Index >= s.l1Size {
+		return 0, nil
+	}
+	l2Offset := s.l1Table[l1Index]
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	l2Table, err := qcowL2Table(bs, l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	l2Index := (offset >> uint(s.clusterBits)) & uint64(s.l2Size-1)
+
+	return l2Table[l2Index], nil
+}
+
+// qcowDecompressCluster decompresses the compressed cluster of clusterOffset descriptor to s.clusterCache.
+// The caller must hold s.lock.
+//  block/qcow.c: static int decompress_cluster(BlockDriverState *bs, uint64_t cluster_offset)
+func qcowDecompressCluster(bs *BlockDriverState, clusterOffset uint64) error {
+	s := bs.qcowOpaque
+
+	coffset := clusterOffset & s.clusterOffsetMask
+	if s.clusterCacheOffset == coffset {
+		return nil
+	}
+
+	csize := int(clusterOffset>>uint(63-s.clusterBits)) & (s.clusterSize - 1)
+	if s.clusterData == nil {
+		s.clusterData = make([]byte, s.clusterSize)
+		s.clusterCache = make([]byte, s.clusterSize)
+	}
+
+	buf := s.clusterData[:csize]
+	if err := bdrvPread(bs.file, int64(coffset), buf); err != nil {
+		return err
+	}
+	if err := decompressBuffer(s.clusterCache, buf); err != nil {
+		s.clusterCacheOffset = ^uint64(0)
+		err = errors.WithStack(&CorruptionError{
+			Offset: int64(coffset),
+			Reason: fmt.Sprintf("Could not decompress the cluster at offset %#x: %v", coffset, err),
+		})
+		return err
+	}
+	s.clusterCacheOffset = coffset
+
+	return nil
+}
+
+// qcowPreadv reads the guest data of the qcow image at offset to buf.
+//  block/qcow.c: static coroutine_fn int qcow_co_preadv(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func qcowPreadv(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	s := bs.qcowOpaque
+
+	for len(buf) > 0 {
+		indexInCluster := int(offset & int64(s.clusterSize-1))
+		n := MIN(s.clusterSize-indexInCluster, len(buf))
+		curBuf := buf[:n]
+
+		s.lock.Lock()
+		clusterOffset, err := qcowGetClusterOffset(bs, uint64(offset))
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		switch {
+		case clusterOffset == 0:
+			s.lock.Unlock()
+			if bs.Backing != nil {
+				// read from the base image
+				if err := bdrvAlignedPreadv(ctx, bs.Backing.bs, offset, curBuf); err != nil {
+					return err
+				}
+			} else {
+				for i := range curBuf {
+					curBuf[i] = 0
+				}
+			}
+
+		case clusterOffset&QCOW_OFLAG_COMPRESSED != 0:
+			// add AIO support for compressed blocks ?
+			if err := qcowDecompressCluster(bs, clusterOffset); err != nil {
+				s.lock.Unlock()
+				return err
+			}
+			copy(curBuf, s.clusterCache[indexInCluster:])
+			s.lock.Unlock()
+
+		default:
+			s.lock.Unlock()
+			if clusterOffset&511 != 0 {
+				return syscall.EIO
+			}
+			if err := bdrvPread(bs.file, int64(clusterOffset)+int64(indexInCluster), curBuf); err != nil {
+				return err
+			}
+		}
+
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// qcowGetBlockStatus returns the status of the cluster of the qcow image at offset, and the number of bytes
+// up to the end of the cluster.
+//  block/qcow.c: static int coroutine_fn qcow_co_block_status(BlockDriverState *bs, bool want_zero, int64_t offset, int64_t bytes, int64_t *pnum, int64_t *map, BlockDriverState **file)
+func qcowGetBlockStatus(bs *BlockDriverState, offset, bytes int64) (int, int64, int64, error) {
+	s := bs.qcowOpaque
+
+	s.lock.Lock()
+	clusterOffset, err := qcowGetClusterOffset(bs, uint64(offset))
+	s.lock.Unlock()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	indexInCluster := offset & int64(s.clusterSize-1)
+	n := int64(s.clusterSize) - indexInCluster
+	if n > bytes {
+		n = bytes
+	}
+
+	if clusterOffset == 0 {
+		return 0, n, 0, nil
+	}
+	if clusterOffset&QCOW_OFLAG_COMPRESSED != 0 {
+		return BDRV_BLOCK_DATA | BDRV_BLOCK_COMPRESSED, n, 0, nil
+	}
+
+	return BDRV_BLOCK_DATA | BDRV_BLOCK_OFFSET_VALID, n, int64(clusterOffset) + indexInCluster, nil
+}
@@ -8,10 +8,19 @@ package qcow2
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -19,6 +28,53 @@ import (
 
 const IO_BUF_SIZE = (2 * 1024 * 1024)
 
+// bdrvQCow2 is the qcow2 format block driver.
+//  block/qcow2.c: BlockDriver bdrv_qcow2
+var bdrvQCow2 = &BlockDriver{
+	formatName:              DriverQCow2,
+	instanceSize:            int(unsafe.Sizeof(BDRVState{})),
+	bdrvProbe:               probe,
+	supportsBacking:         true,
+	bdrvOpen:                Open,
+	bdrvClose:               qcow2Close,
+	bdrvInactivate:          inactivate,
+	bdrvCoFlushToOS:         flushToOS,
+	bdrvTruncate:            truncate,
+	bdrvCoPreadv:            preadv,
+	bdrvCoPwritev:           pwritev,
+	bdrvCoPwritevCompressed: pwriteCompressed,
+	bdrvCoPwriteZeroes:      pwriteZeroes,
+	bdrvCoPdiscard:          pdiscard,
+	bdrvCoCopyRangeFrom:     copyRangeFrom,
+	bdrvCoCopyRangeTo:       copyRangeTo,
+	bdrvRefreshLimits:       refreshLimits,
+	bdrvHasZeroInit:         bdrvHasZeroInit1,
+	bdrvCoGetBlockStatus:    getBlockStatus,
+	bdrvGetInfo:             getInfo,
+	bdrvCheck:               check,
+
+	bdrvSnapshotCreate: snapshotCreate,
+	bdrvSnapshotGoto:   snapshotGoto,
+	bdrvSnapshotDelete: snapshotDelete,
+	bdrvSnapshotList:   snapshotList,
+
+	bdrvChangeBackingFile: changeBackingFile,
+}
+
+func init() {
+	bdrvRegister(bdrvQCow2)
+}
+
+// probe returns the score of buf as the qcow2 image, which has the magic and the version 2 or later.
+//  block/qcow2.c: static int qcow2_probe(const uint8_t *buf, int buf_size, const char *filename)
+func probe(buf []byte, filename string) int {
+	if len(buf) >= int(unsafe.Sizeof(Header{})) && bytes.Equal(buf[:len(MAGIC)], MAGIC) && Version(BEUint32(buf[4:8])) >= Version2 {
+		return 100
+	}
+
+	return 0
+}
+
 // New return the new Qcow.
 func New(config *Opts) *QCow2 {
 	return &QCow2{}
@@ -38,6 +94,9 @@ type Opts struct {
 	// BLOCK_OPT
 	// Size size of create image virtual size.
 	Size int64
+	// SizeStr the virtual size in the human readable form, such as "10G", "512M" and "1.5T", which is parsed by
+	// ParseSize. It is used if Size is zero.
+	SizeStr string
 
 	//  Encryption option is if this option is set to "on", the image is encrypted with 128-bit AES-CBC.
 	Encryption bool
@@ -50,8 +109,13 @@ type Opts struct {
 
 	//  ClusterSize option is changes the qcow2 cluster size (must be between 512 and 2M).
 	//  Smaller cluster sizes can improve the image file size whereas larger cluster sizes generally provide better performance.
+	//  If zero, the cluster size is selected by the virtual disk size, see autoClusterSize.
 	ClusterSize int
 
+	// TableSize the number of the clusters of the initial refcount table. The refcount table of the image which
+	// is filled soon after the creation can be sized in advance, so that it is not grown and copied while the
+	// image is written. It is limited by MAX_REFTABLE_SIZE, and by the refcount block which covers the header and
+	// the refcount table. If zero, the refcount table has one cluster.
 	TableSize int
 
 	//  Preallocation mode of pre-allocation metadata (allowed values: "off", "metadata", "falloc", "full").
@@ -89,49 +153,447 @@ type Opts struct {
 	ObjectSize int
 
 	RefcountBits int
+
+	// WrapBackend wraps the Backend of the new image file, such as by FaultBackend to inject the failures.
+	// The returned Backend is used for all of the writes of the image, including the creation.
+	WrapBackend func(Backend) Backend
+
+	// Exclusive creates the image file only if it does not exist, same as O_EXCL, and the creation fails with
+	// the error of os.ErrExist otherwise. The existing file and the symbolic link are never replaced, even if
+	// they are created concurrently.
+	Exclusive bool
+
+	// Deterministic creates the reproducible image, which is byte-identical to the image created from the same
+	// options and written by the same requests in the same order, so the built image can be cached by its
+	// content. The snapshots created on the image record the time of the SOURCE_DATE_EPOCH environment
+	// variable, or the zero time if it is not set, instead of the current time.
+	// The concurrent writes allocate the clusters in the order they are processed, so the writes must be
+	// issued sequentially for the reproducible image.
+	Deterministic bool
+}
+
+// preallocModeLookup the names of PreallocMode.
+//  qapi-types.c: const char *const PreallocMode_lookup[]
+var preallocModeLookup = [PREALLOC_MODE__MAX]string{
+	PREALLOC_MODE_OFF:      "off",
+	PREALLOC_MODE_METADATA: "metadata",
+	PREALLOC_MODE_FALLOC:   "falloc",
+	PREALLOC_MODE_FULL:     "full",
+}
+
+// String implements fmt.Stringer.
+func (m PreallocMode) String() string {
+	if m < 0 || m >= PREALLOC_MODE__MAX {
+		return fmt.Sprintf("PreallocMode(%d)", int(m))
+	}
+	return preallocModeLookup[m]
+}
+
+// ParsePreallocMode parses the preallocation option value "off", "metadata", "falloc" or "full".
+func ParsePreallocMode(s string) (PreallocMode, error) {
+	for i, name := range preallocModeLookup {
+		if s == name {
+			return PreallocMode(i), nil
+		}
+	}
+
+	return PREALLOC_MODE_OFF, errors.Wrapf(ErrInvalidOption, "Invalid preallocation mode: '%s'", s)
+}
+
+// MarshalText implements encoding.TextMarshaler, so the mode is encoded by its name in JSON.
+func (m PreallocMode) MarshalText() ([]byte, error) {
+	if m < 0 || m >= PREALLOC_MODE__MAX {
+		return nil, errors.Wrapf(ErrInvalidOption, "Invalid preallocation mode %d", int(m))
+	}
+	return []byte(preallocModeLookup[m]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *PreallocMode) UnmarshalText(text []byte) error {
+	mode, err := ParsePreallocMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
 }
 
+// OpenOpts options of opening the image, same as the runtime options of the qcow2 driver of qemu.
+// The zero value is the default options.
+type OpenOpts struct {
+	// L2CacheSize the maximum size of the L2 table cache in bytes ("l2-cache-size"). If zero, the size is
+	// 4 times of RefcountCacheSize if it is given, otherwise the larger of 1 MiB and 8 clusters.
+	L2CacheSize int64
+	// RefcountCacheSize the maximum size of the refcount block cache in bytes ("refcount-cache-size").
+	// If zero, the size is a fourth of the L2 cache size.
+	RefcountCacheSize int64
+	// CacheCleanInterval the interval of dropping the cache entries which are unused since the last
+	// interval ("cache-clean-interval"). If zero, the entries are never dropped.
+	CacheCleanInterval time.Duration
+	// Cache the cache mode of the writes ("cache"). The default is CacheWriteback.
+	Cache CacheMode
+	// Direct opens the image file with O_DIRECT, which bypasses the page cache of the host ("cache.direct").
+	// The requests are aligned to BlockLimits.RequestAlignment through the aligned bounce buffer.
+	// It is only supported for the host files on linux and darwin.
+	Direct bool
+	// Force opens the image file without the lock ("force-share"). By default, the image file is locked
+	// exclusively if it is opened for writing, and shared otherwise, and opening the image which is locked
+	// by the other process fails with ErrLocked. Force is only allowed for the read-only image, and the image
+	// which is written by the other process may be read inconsistently.
+	Force bool
+	// Logger the Logger of the diagnostic messages of the image. If nil, the Logger set by SetLogger is used.
+	// It is not applied to the backing files, which may be shared with the other images.
+	Logger Logger
+	// NoBacking opens the image without its backing file, same as BDRV_O_NO_BACKING of qemu. The backing file
+	// name is still reported by Info, but the clusters which are not allocated in the image read as zeros,
+	// so the image whose backing file is missing or unreachable can be inspected by Info, Check and Map.
+	NoBacking bool
+	// BackingCacheDir the directory of the cache overlays of the remote backing files, such as the http:// and
+	// the nbd:// URLs. If not empty, the remote backing files in the backing chain are read through the cache
+	// overlays by CacheBackend, so the repeated boots of the images on the same remote backing file fetch each
+	// cluster only once. The cache overlay is discarded if the remote file is changed, and the remote backing file
+	// is read without the cache if its cache overlay is in use by the other process.
+	BackingCacheDir string
+	// MaxBackingDepth the maximum number of the backing files in the backing chain of the image.
+	// If zero, MAX_BACKING_DEPTH is used.
+	MaxBackingDepth int
+	// CheckBacking checks the file name of each backing file in the backing chain of the image before it is
+	// opened, which is combined with the directory of its overlay, such as to confine the backing files of the
+	// untrusted image. The open fails with the returned error, and the backing file is not opened.
+	CheckBacking func(filename string) error
+	// ReadOnly opens the image file as read-only regardless of the open flag ("read-only"). The header is
+	// never updated, such as the dirty bit and the autoclear feature bits, and the writes fail with ErrReadOnly.
+	// The image file is still locked shared, so the open of the image which is already opened as read-write,
+	// by the other process or by the other open of the same process, fails with ErrLocked unless Force is set.
+	ReadOnly bool
+	// Repair allows the image which is marked as corrupt to be opened as read-write to repair it. The writes to
+	// the corrupt image fail with ErrCorrupt until Check repairs it and clears the corrupt bit. The image which
+	// is marked as dirty is not repaired automatically on the open, since the caller repairs it by Check.
+	// It also allows the image which is marked as dirty to be opened as read-only to check it, which fails
+	// with ErrDirty otherwise. The corrupt image is not opened as read-write if ReadOnly is true.
+	Repair bool
+	// OverlapCheck the level of the check which prevents the writes to the image file from overwriting the
+	// metadata of the image ("overlap-check"). The default is OverlapCheckCached.
+	OverlapCheck OverlapCheckMode
+	// WrapBackend wraps the Backend of the image file, such as by FaultBackend to inject the failures.
+	// It is not applied to the backing files.
+	WrapBackend func(Backend) Backend
+	// Deterministic keeps the image reproducible, same as Opts.Deterministic.
+	Deterministic bool
+	// Readahead the maximum size of the readahead window in bytes. After the sequential guest reads, the
+	// following guest data and its L2 tables are prefetched in the background, such as for the boot or the
+	// streaming read over NBD. If zero, the readahead is disabled.
+	Readahead int64
+	// Unmap passes the guest discard requests through to the image file ("discard=unmap"), so that the clusters
+	// freed by Discard and WriteZeroesFlags with BDRV_REQ_MAY_UNMAP are punched out of the host file and the
+	// space is returned to the host filesystem. The clusters freed by the snapshot deletion are always punched.
+	// Punching the holes is best effort, and does nothing if the host file or the platform does not support it.
+	// Same as SetDiscardPassthrough of DISCARD_REQUEST.
+	Unmap bool
+	// Wipe overwrites the host clusters with zeros before they are freed, so that the guest data of the clusters
+	// freed by Discard, the snapshot deletion and the other operations does not remain in the image file, such as
+	// for the data sanitization of the image on the shared storage. The zeros are written even if the freed
+	// clusters are punched by Unmap, since the storage may keep the data of the punched ranges. The host cluster
+	// of the compressed clusters is wiped when all of the compressed clusters in it are freed.
+	// Same as SetWipeFreed.
+	Wipe bool
+	// SnapshotQuota limits the internal snapshots which are created in the image, in addition to MAX_SNAPSHOTS
+	// and MAX_SNAPSHOTS_SIZE. Same as SetSnapshotQuota.
+	SnapshotQuota SnapshotQuota
+	// Compression the deflate level and the number of the workers of the compressed writes, which trade the
+	// compression ratio for the throughput on the fast storage. Same as SetCompression.
+	Compression Compression
+}
+
+// CacheMode represents the cache mode of the writes, same as the "cache" option of qemu.
+type CacheMode int
+
+const (
+	// CacheWriteback the write is completed when the data is written to the image file, and the metadata
+	// updates are batched in the metadata caches. The data and the metadata are written to the disk by
+	// Flush or Close.
+	CacheWriteback CacheMode = iota
+	// CacheWritethrough the write is completed after the data and the metadata caches are flushed to the disk.
+	CacheWritethrough
+)
+
+// OverlapCheckMode represents the level of the metadata overlap check, same as the "overlap-check" option of qemu.
+// The write which overlaps the checked metadata fails with EIO, and the image is marked as corrupt.
+type OverlapCheckMode string
+
+const (
+	// OverlapCheckNone no metadata is checked.
+	OverlapCheckNone OverlapCheckMode = "none"
+	// OverlapCheckConstant the metadata which is checked in constant time, such as the header, the active L1 table,
+	// the refcount table and the snapshot table.
+	OverlapCheckConstant OverlapCheckMode = "constant"
+	// OverlapCheckCached the metadata which is checked without the I/O, which is the L1 tables of the snapshots,
+	// and the active L2 tables and the refcount blocks which are referred by the loaded segments of the active
+	// L1 table and the refcount table, in addition to OverlapCheckConstant. The metadata of the segments which
+	// are not accessed since the open is not checked.
+	OverlapCheckCached OverlapCheckMode = "cached"
+	// OverlapCheckAll all of the metadata, including the L2 tables of the snapshots, which are read from
+	// the image file by every check, and the whole active L1 table and refcount table, which are loaded by
+	// the first check.
+	OverlapCheckAll OverlapCheckMode = "all"
+)
+
 func (q *QCow2) Len() (int64, error) {
-	stat, err := q.blk.bs().File.Stat()
+	return q.blk.bs().File.Size()
+}
+
+// OpenFile opens the QCow2 image file, and the backing file chain if any.
+// The flag is the same as os.OpenFile, such as os.O_RDONLY or os.O_RDWR.
+func OpenFile(filename string, flag int) (*QCow2, error) {
+	return OpenFileFormat(filename, DriverQCow2, flag)
+}
+
+// OpenFileFormat opens the image file with the format driver, and the backing file chain if any.
+// If format is empty, the format is probed from the image file, and the unknown format is opened as raw.
+// The raw image grows when the data is written beyond the end of the file.
+func OpenFileFormat(filename string, format DriverFmt, flag int) (*QCow2, error) {
+	return OpenFileOpts(filename, format, flag, nil)
+}
+
+// OpenFileOpts is like OpenFileFormat, but opens the image with opts. If opts is nil, the default options are used.
+// The options except Direct and Force are not applied to the backing files.
+func OpenFileOpts(filename string, format DriverFmt, flag int, opts *OpenOpts) (*QCow2, error) {
+	bs, err := bdrvOpen(filename, format, flag, opts)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	return newImage(bs), nil
+}
+
+// OpenReader opens the read-only qcow2 image from r of size bytes, such as the image in the archive or
+// the memory buffer. The backing file is opened from the file system by its name.
+func OpenReader(r io.ReaderAt, size int64) (*QCow2, error) {
+	if size < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative size")
+		return nil, err
+	}
+
+	return OpenBackend(&readerBackend{r: r, size: size}, "", DriverQCow2, os.O_RDONLY)
+}
+
+// OpenReadWriter opens the writable qcow2 image from rw. The size of the image file is the offset of
+// the end of rw, and the image file grows by writing beyond the end.
+// The backing file is opened from the file system by its name.
+func OpenReadWriter(rw io.ReadWriteSeeker) (*QCow2, error) {
+	return OpenBackend(&seekerBackend{rw: rw}, "", DriverQCow2, os.O_RDWR)
+}
+
+// OpenBackend opens the image file of the backend with the format driver, and the backing file chain if any.
+// The filename is used to resolve the relative backing file name, and in the messages. If format is empty,
+// the format is probed from the image file. The image is read-only unless flag has os.O_RDWR or os.O_WRONLY.
+// The backend is closed by Close of the image if it implements io.Closer.
+func OpenBackend(backend Backend, filename string, format DriverFmt, flag int) (*QCow2, error) {
+	bs, err := bdrvOpenBackend(backend, filename, format, flag, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImage(bs), nil
+}
+
+// newImage returns the image of the opened bs.
+func newImage(bs *BlockDriverState) *QCow2 {
+	q := &QCow2{
+		blk: &BlockBackend{
+			BlockDriverState: bs,
+			allowBeyondEOF:   bs.Drv.hasVariableLength,
+			enableWriteCache: bs.Options == nil || bs.Options.Cache == CacheWriteback,
+			deterministic:    bs.Options != nil && bs.Options.Deterministic,
+		},
+	}
+	if bs.Options != nil && bs.Options.Readahead > 0 {
+		q.ra = newReadahead(bs.Options.Readahead)
+	}
+
+	return q
+}
+
+// validateCreateOpts validates the options of opts which are used by the creation of the image, and the
+// combinations of them, and returns the first problem.
+//  block/qcow2.c: static int qcow2_create(const char *filename, QemuOpts *opts, Error **errp)
+func validateCreateOpts(opts *Opts) error {
+	if errs := createOptsErrors(opts); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// createOptsErrors returns all of the problems of the options of opts which are validated by validateCreateOpts.
+func createOptsErrors(opts *Opts) []error {
+	var errs []error
+
+	version := Version3
+	switch opts.Compat {
+	case "", "1.1":
+		// nothing to do
+	case "0.10":
+		version = Version2
+	default:
+		errs = append(errs, errors.Wrapf(ErrInvalidOption, "Invalid compatibility level: '%s'", opts.Compat))
+	}
+
+	if opts.TableSize < 0 {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Refcount table size must not be negative"))
+	}
+
+	if opts.Preallocation < 0 || opts.Preallocation >= PREALLOC_MODE__MAX {
+		errs = append(errs, errors.Wrapf(ErrInvalidOption, "Invalid preallocation mode %d", int(opts.Preallocation)))
+	}
+	if opts.BackingFile != "" && opts.Preallocation != PREALLOC_MODE_OFF {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Backing file and preallocation cannot be used at the same time"))
+	}
+
+	if version < Version3 && opts.LazyRefcounts {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Lazy refcounts only supported with compatibility level 1.1 and above (use compat=1.1 or greater)"))
+	}
+
+	refcountBits := opts.RefcountBits
+	if refcountBits == 0 {
+		refcountBits = 16 // defaults
+	}
+	if refcountBits < 0 || refcountBits > 64 || refcountBits&(refcountBits-1) != 0 {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Refcount width must be a power of two and may not exceed 64 bits"))
+	} else if version < Version3 && refcountBits != 16 {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Different refcount widths than 16 bits require compatibility level 1.1 or above (use compat=1.1 or greater)"))
+	}
+
+	if clusterSize := opts.ClusterSize; clusterSize != 0 {
+		clusterBits := ctz32(uint32(clusterSize))
+		if clusterSize < 0 || clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || 1<<uint(clusterBits) != clusterSize {
+			errs = append(errs, errors.Wrapf(ErrInvalidOption, "Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10)))
+		}
+	}
+
+	return errs
+}
+
+// Validate checks all of the options of opts without creating the image, and returns OptsError which lists every
+// problem of them, instead of the first one which Create fails with. In addition to the options which Create
+// validates, the size must be a multiple of the sector size, which Create rounds up, and the backing file must
+// be opened with the backing format.
+func (opts *Opts) Validate() error {
+	var errs []error
+
+	if opts.Filename == "" {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Expecting image file name"))
+	}
+
+	size, err := opts.virtualSize()
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+	case size == 0 && opts.BackingFile == "":
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Image creation needs a size parameter"))
+	case size%int64(BDRV_SECTOR_SIZE) != 0:
+		errs = append(errs, errors.Wrapf(ErrInvalidOption, "Image size %d must be a multiple of %d bytes", size, BDRV_SECTOR_SIZE))
+	}
+
+	if opts.BackingFormat != "" && opts.BackingFile == "" {
+		errs = append(errs, errors.Wrap(ErrInvalidOption, "Backing format specified without the backing file"))
+	}
+
+	errs = append(errs, createOptsErrors(opts)...)
+
+	if opts.BackingFile != "" {
+		backingFile := pathCombine(opts.Filename, opts.BackingFile)
+		bs, err := bdrvOpen(backingFile, DriverFmt(opts.BackingFormat), os.O_RDONLY, nil)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "Could not open backing file '%s'", backingFile))
+		} else {
+			bdrvUnref(bs)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.WithStack(&OptsError{Errs: errs})
 	}
+	return nil
+}
 
-	return stat.Size(), nil
+// virtualSize returns the virtual size of opts, which is Size, or SizeStr if Size is zero.
+func (opts *Opts) virtualSize() (int64, error) {
+	if opts.Size < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Invalid image size specified")
+		return 0, err
+	}
+	if opts.Size == 0 && opts.SizeStr != "" {
+		return ParseSize(opts.SizeStr)
+	}
+	return opts.Size, nil
 }
 
 // Create creates the new QCow2 virtual disk image by the qemu style.
+// The existing image file is replaced only after the new image is completely written, so the interrupted creation
+// never leaves the partially written image.
 func Create(opts *Opts) (*QCow2, error) {
+	return CreateContext(context.Background(), opts)
+}
+
+// CreateContext is like Create, but returns the error of ctx if ctx is done before the image is created.
+// The image file is not replaced on the cancellation.
+func CreateContext(ctx context.Context, opts *Opts) (*QCow2, error) {
+	defer trace.StartRegion(ctx, "qcow2.Create").End()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if opts.Filename == "" {
-		err := errors.New("Expecting image file name")
+		err := errors.Wrap(ErrInvalidOption, "Expecting image file name")
 		return nil, err
 	}
 
-	// TODO(zchee): implements file size eror handling
-	// sval = qemu_strtosz_suffix(argv[optind++], &end,
-	// QEMU_STRTOSZ_DEFSUFFIX_B);
-	// if (sval < 0 || *end) {
-	// 	if (sval == -ERANGE) {
-	// 		error_report("Image size must be less than 8 EiB!");
-	// 	} else {
-	// 		error_report("Invalid image size specified! You may use k, M, "
-	// 		"G, T, P or E suffixes for ");
-	// 		error_report("kilobytes, megabytes, gigabytes, terabytes, "
-	// 		"petabytes and exabytes.");
-	// 	}
-	// 	goto fail;
-	// }
+	if size, err := opts.virtualSize(); err != nil {
+		return nil, err
+	} else if size != opts.Size {
+		o := *opts
+		o.Size = size
+		opts = &o
+	}
+
+	// The size of the image defaults to the size of the backing file
+	//  block.c: void bdrv_img_create(const char *filename, const char *fmt, ...)
+	if opts.Size == 0 && opts.BackingFile != "" {
+		backingFile := pathCombine(opts.Filename, opts.BackingFile)
+		bs, err := bdrvOpen(backingFile, DriverFmt(opts.BackingFormat), os.O_RDONLY, nil)
+		if err != nil {
+			err = errors.Wrapf(err, "Could not open backing file '%s'", backingFile)
+			return nil, err
+		}
+		size := bs.TotalSectors * int64(BDRV_SECTOR_SIZE)
+		bdrvUnref(bs)
+
+		o := *opts
+		o.Size = size
+		opts = &o
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
 
 	img := new(QCow2)
-	blk, err := create(opts.Filename, opts)
+	blk, err := create(ctx, opts.Filename, opts)
 	if err != nil {
 		return nil, err
 	}
 	img.blk = blk
+
 	return img, nil
 }
 
-func create(filename string, opts *Opts) (*BlockBackend, error) {
+// create creates the qcow2 image of filename by opts, and returns the opened image.
+//
+// The image is written to the temporary file in the same directory, which replaces the image file by the rename
+// after the image is complete, so the image file is either the old file or the complete new image even if the
+// creation is interrupted, and it is never replaced if ctx is done. The image file which is in use by the other
+// process is not replaced. The host device is written in place.
+func create(ctx context.Context, filename string, opts *Opts) (_ *BlockBackend, err error) {
 
 	// ------------------------------------------------------------------------
 	// static int qcow2_create(const char *filename, QemuOpts *opts,
@@ -143,9 +605,9 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 		version = Version3
 	)
 
-	size := roundUp(int(opts.Size), BDRV_SECTOR_SIZE)
+	size := roundUp(opts.Size, int64(BDRV_SECTOR_SIZE))
 	backingFile := opts.BackingFile
-	// backingFormat := opts.BackingFormat
+	backingFormat := opts.BackingFormat
 
 	if opts.Encryption {
 		flags |= BLOCK_FLAG_ENCRYPT
@@ -153,48 +615,27 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 
 	clusterSize := int64(opts.ClusterSize)
 	if clusterSize == 0 {
-		clusterSize = DEFAULT_CLUSTER_SIZE
+		clusterSize = autoClusterSize(size)
 	}
 
 	// TODO(zchee): error handle
 	prealloc := opts.Preallocation
 
-	compat := opts.Compat
-	switch compat {
-	case "":
-		compat = "1.1" // automatically set to latest compatible version
-	case "0.10":
-		version = Version2
-	case "1.1":
-		// nothing to do
-	default:
-		err := errors.Errorf("Invalid compatibility level: '%s'", compat)
+	if err := validateCreateOpts(opts); err != nil {
 		return nil, err
 	}
+	if opts.Compat == "0.10" {
+		version = Version2
+	}
 
 	if opts.LazyRefcounts {
 		flags |= BLOCK_FLAG_LAZY_REFCOUNTS
 	}
 
-	if backingFile != "" && prealloc != PREALLOC_MODE_OFF {
-		err := errors.New("Backing file and preallocation cannot be used at the same time")
-		return nil, err
-	}
-
-	if version < 3 && (flags&BLOCK_FLAG_LAZY_REFCOUNTS) == 0 {
-		err := errors.New("Lazy refcounts only supported with compatibility level 1.1 and above (use compat=1.1 or greater)")
-		return nil, err
-	}
-
 	refcountBits := opts.RefcountBits
 	if refcountBits == 0 {
 		refcountBits = 16 // defaults
 	}
-	if refcountBits > 64 {
-		err := errors.New("Refcount width must be a power of two and may not exceed 64 bits")
-		return nil, err
-	}
-
 	refcountOrder := ctz32(uint32(refcountBits))
 
 	// ------------------------------------------------------------------------
@@ -209,8 +650,22 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 
 	// Calculate cluster_bits
 	clusterBits := ctz32(uint32(clusterSize))
-	if clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || (1<<uint(clusterBits)) != opts.ClusterSize {
-		err := errors.Errorf("Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+	if clusterBits < MIN_CLUSTER_BITS || clusterBits > MAX_CLUSTER_BITS || int64(1)<<uint(clusterBits) != clusterSize {
+		err := errors.Wrapf(ErrInvalidOption, "Cluster size must be a power of two between %d and %dk", 1<<MIN_CLUSTER_BITS, 1<<(MAX_CLUSTER_BITS-10))
+		return nil, err
+	}
+
+	// the first refcount block covers the header, the refcount table and itself
+	tableClusters := int64(1)
+	if opts.TableSize > 0 {
+		tableClusters = int64(opts.TableSize)
+	}
+	maxTableClusters := int64(MAX_REFTABLE_SIZE) / clusterSize
+	if n := clusterSize*8/int64(refcountBits) - 2; n < maxTableClusters {
+		maxTableClusters = n
+	}
+	if tableClusters > maxTableClusters {
+		err := errors.Wrapf(ErrInvalidOption, "Refcount table size must be at most %d clusters", maxTableClusters)
 		return nil, err
 	}
 
@@ -225,79 +680,120 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 	// 2 GB for 64k clusters, and we don't want to have a 2 GB initial file
 	// size for any qcow2 image.
 
+	var fileSize int64
 	if prealloc == PREALLOC_MODE_FULL || prealloc == PREALLOC_MODE_FALLOC {
-		// Note: The following calculation does not need to be exact; if it is a
-		// bit off, either some bytes will be "leaked" (which is fine) or we
-		// will need to increase the file size by some bytes (which is fine,
-		// too, as long as the bulk is allocated here). Therefore, using
-		// floating point arithmetic is fine.
-		var metaSize int64
-		alignedTotalZize := alignOffset(size, int(clusterSize))
-		rces := int64(1<<uint(refcountOrder)) / 8.
-
-		refblockBits := clusterBits - (refcountOrder - 3)
-		refblockSize := 1 << uint(refblockBits)
-
-		metaSize += int64(clusterSize)
-
-		nl2e := alignedTotalZize / clusterSize
-		nl2e = alignOffset(nl2e, int(clusterSize/int64(UINT64_SIZE)))
-		metaSize += nl2e * UINT64_SIZE
-
-		nl1e := nl2e * UINT64_SIZE / clusterSize
-		nl1e = alignOffset(nl1e, int(clusterSize/int64(UINT64_SIZE)))
-		metaSize += nl1e * UINT64_SIZE
-
-		// total size of refcount blocks
-		//
-		// note: every host cluster is reference-counted, including metadata
-		// (even refcount blocks are recursively included).
-		// Let:
-		//   a = total_size (this is the guest disk size)
-		//   m = meta size not including refcount blocks and refcount tables
-		//   c = cluster size
-		//   y1 = number of refcount blocks entries
-		//   y2 = meta size including everything
-		//   rces = refcount entry size in bytes
-		// then,
-		//   y1 = (y2 + a)/c
-		//   y2 = y1 * rces + y1 * rces * sizeof(u64) / c + m
-		// we can get y1:
-		//   y1 = (a + m) / (c - rces - rces * sizeof(u64) / c)
-		nrefblocke := (alignedTotalZize + metaSize + int64(clusterSize)) / (int64(clusterSize) - rces - rces*UINT64_SIZE) / int64(clusterSize)
-		metaSize += divRoundUp(int(nrefblocke), refblockSize) * int64(clusterSize)
-
-		// total size of refcount tables
-		nreftablee := nrefblocke / int64(refblockSize)
-		nreftablee = alignOffset(nreftablee, int(clusterSize/int64(UINT64_SIZE)))
-		metaSize += nreftablee * UINT64_SIZE
-
-		size = alignedTotalZize + metaSize
-	}
-
-	blkOption := new(BlockOption)
-	diskImage, err := CreateFile(filename, blkOption)
-	if err != nil {
-		return nil, err
+		fileSize = calcPreallocSize(size, clusterSize, refcountOrder)
 	}
-	defer diskImage.Close()
 
 	blk := new(BlockBackend)
 	blk.BlockDriverState = &BlockDriverState{
-		file: &BdrvChild{
-			Name: diskImage.Name(),
-		},
+		Filename: filename,
+		Refcnt:   1,
+	}
+	blk.BlockDriverState.file = &BdrvChild{
+		bs:   blk.BlockDriverState,
+		Name: filename,
+	}
+
+	var (
+		path    = filename
+		tmpname string
+		tmpFile *os.File
+		oldFile *os.File
+	)
+	if opts.Exclusive {
+		// the new file is created by the open, so the file which is created concurrently is never replaced
+		f, cerr := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if cerr != nil {
+			return nil, cerr
+		}
+		defer func() {
+			if err != nil {
+				os.Remove(filename)
+			}
+		}()
+		if err := bdrvLockImageFile(f, filename, os.O_RDWR); err != nil {
+			f.Close()
+			return nil, err
+		}
+		blk.BlockDriverState.File = NewFileBackend(f)
+	} else if fi, serr := os.Stat(filename); serr == nil && isHostDevice(fi) {
+		// TODO(zchee): should use func Open(bs BlockDriverState, options *QDict, flag int) error
+		// if err := Open(blk.bs(), nil, flags); err != nil {
+		if err := blk.Open(filename, "", nil, os.O_RDWR); err != nil {
+			return nil, err
+		}
+	} else {
+		// the file which the symbolic link refers to is replaced, so the link is kept
+		if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+			path = resolved
+		}
+		f, tmp, old, cerr := createImageFile(path, filename)
+		if cerr != nil {
+			return nil, cerr
+		}
+		tmpname, tmpFile, oldFile = tmp, f, old
+		if oldFile != nil {
+			defer oldFile.Close()
+		}
+		if tmpname != "" {
+			defer func() {
+				if err != nil {
+					os.Remove(tmpname)
+				}
+			}()
+		}
+		blk.BlockDriverState.File = NewFileBackend(f)
+	}
+	file := blk.BlockDriverState.File
+	defer func() {
+		if err != nil {
+			if c, ok := file.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}()
+
+	// the metadata on the host device is aligned to the physical block size of the device by the cluster size
+	if f, ok := file.(*FileBackend); ok {
+		if fi, err := f.Stat(); err == nil && isHostDevice(fi) {
+			if blockSize := hdevPhysicalBlockSize(f.File); clusterSize < blockSize {
+				err := errors.Wrapf(ErrInvalidOption, "Cluster size %d is smaller than the physical block size %d of '%s'", clusterSize, blockSize, filename)
+				return nil, err
+			}
+		} else if err := setSparse(f.File); err != nil {
+			return nil, err
+		}
 	}
 
-	// TODO(zchee): should use func Open(bs BlockDriverState, options *QDict, flag int) error
-	// if err := Open(blk.bs(), nil, flags); err != nil {
-	if err := blk.Open(diskImage.Name(), "", nil, os.O_RDWR|os.O_CREATE); err != nil {
+	// the image file is truncated after it is locked, so the image which is in use is not clobbered.
+	// The host device is not truncated, and its stale data is not referred by the new image
+	if err := file.Truncate(0); err != nil {
 		return nil, err
 	}
+	// the attribute is only changed while the file is empty
+	if f, ok := file.(*FileBackend); ok && opts.NoCow {
+		setNoCow(f.File)
+	}
+	if opts.WrapBackend != nil {
+		file = opts.WrapBackend(file)
+	}
+	// TODO(zchee): allocates the blocks of the image file for "falloc" and "full"
+	if fileSize > 0 {
+		if err := file.Truncate(fileSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// the metadata written while the image is created is buffered, and is written by the few cluster-aligned
+	// writes before the image is returned
+	buffered := newBufferedBackend(file, clusterSize, fileSize)
+	blk.BlockDriverState.File = buffered
 
 	blk.BlockDriverState.Opaque = new(BDRVState)
 
 	blk.allowBeyondEOF = true
+	blk.deterministic = opts.Deterministic
 
 	blk.Header = Header{
 		Magic:                 BEUint32(MAGIC), // uint32
@@ -305,18 +801,18 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 		BackingFileOffset:     uint64(0),
 		BackingFileSize:       uint32(0),
 		ClusterBits:           uint32(clusterBits),
-		Size:                  uint64(size),   // TODO(zchee): Sets to when initializing of the header? qemu is after initialization.
-		CryptMethod:           CRYPT_NONE,     // uint32
-		L1Size:                uint32(128),    // TODO(zchee): hardcoded
-		L1TableOffset:         uint64(458752), // TODO(zchee): hardcoded
+		Size:                  uint64(0),
+		CryptMethod:           CRYPT_NONE, // uint32
+		L1Size:                uint32(0),
+		L1TableOffset:         uint64(0),
 		RefcountTableOffset:   uint64(clusterSize),
-		RefcountTableClusters: uint32(1),
+		RefcountTableClusters: uint32(tableClusters),
 		NbSnapshots:           uint32(0),
 		SnapshotsOffset:       uint64(0),
 		IncompatibleFeatures:  uint64(0),
 		CompatibleFeatures:    uint64(0),
 		AutoclearFeatures:     uint64(0),
-		RefcountOrder:         uint32(refcountOrder), // NOTE: qemu now supported only refcount_order = 4
+		RefcountOrder:         uint32(refcountOrder),
 		HeaderLength:          uint32(unsafe.Sizeof(Header{})),
 	}
 
@@ -363,58 +859,76 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 	}
 
 	// Write a header data to image file
-	writeFile(blk.bs(), 0, blk.buf.Bytes(), blk.buf.Len())
+	if err := writeFile(blk.bs(), 0, blk.buf.Bytes(), blk.buf.Len()); err != nil {
+		err = errors.Wrap(err, "Could not write qcow2 header")
+		return nil, err
+	}
 
 	// Write a refcount table with one refcount block
-	refcountTable := make([][]byte, 2*clusterSize)
-	refcountTable[0] = BEUvarint64(uint64(2 * clusterSize))
-
-	// TODO(zchee): int(2*clusterSize))?
-	writeFile(blk.bs(), clusterSize, bytes.Join(refcountTable, []byte{}), int(clusterSize))
+	refcountTable := make([]byte, (tableClusters+1)*clusterSize)
+	copy(refcountTable, BEUvarint64(uint64((tableClusters+1)*clusterSize)))
 
-	blk.BlockDriverState.Drv = new(BlockDriver)
-	blk.BlockDriverState.Drv.bdrvGetlength = getlength
-	// bs.Drv.bdrvTruncate = bdrvTruncate
-
-	blk.BlockDriverState.Opaque = &BDRVState{
-		ClusterSize:   int(clusterSize),
-		ClusterBits:   clusterBits,
-		RefcountOrder: refcountOrder,
+	if err := writeFile(blk.bs(), clusterSize, refcountTable, len(refcountTable)); err != nil {
+		err = errors.Wrap(err, "Could not write refcount table")
+		return nil, err
 	}
 
-	if _, err := AllocClusters(blk.bs(), uint64(3*clusterSize)); err != nil {
-		if err != syscall.Errno(0) {
-			err = errors.Wrap(err, "Huh, first cluster in empty image is already in use?")
-			return nil, err
-		}
+	// And now open the image and make it consistent first (i.e. increase the
+	// refcount of the cluster that is occupied by the header and the refcount
+	// table)
+	blk.BlockDriverState.Drv = bdrvQCow2
+	blk.BlockDriverState.Opaque = new(BDRVState)
+	if err := Open(blk.bs(), nil, os.O_RDWR); err != nil {
+		err = errors.Wrap(err, "Could not open new image")
+		return nil, err
+	}
+	bdrvRefreshLimits(blk.bs())
 
+	offset, err := AllocClusters(blk.bs(), uint64((tableClusters+2)*clusterSize))
+	if err != nil {
 		err = errors.Wrap(err, "Could not allocate clusters for qcow2 header and refcount table")
 		return nil, err
 	}
+	if offset != 0 {
+		err := errors.New("Huh, first cluster in empty image is already in use?")
+		return nil, err
+	}
 
 	// Create a full header (including things like feature table)
-	// ret = qcow2_update_header(blk_bs(blk));
-	// if (ret < 0) {
-	// 	error_setg_errno(errp, -ret, "Could not update qcow2 header");
-	// 	goto out;
-	// }
-
-	// TODO(zchee): carried from bdrv_open_common, should move to the Open function
-	blk.bs().Opaque.L2Bits = blk.bs().Opaque.ClusterBits - 3
-	blk.bs().Opaque.L2Size = 1 << uint(blk.bs().Opaque.L2Bits)
-	blk.bs().Opaque.RefcountTableOffset = blk.Header.RefcountTableOffset
-	// blk.bs().Opaque.RefcountTableSize = blk.Header.RefcountTableClusters << uint(blk.bs().Opaque.ClusterBits-3)
-	blk.bs().TotalSectors = int64(blk.Header.Size / 512)
+	if err := updateHeader(blk.bs()); err != nil {
+		err = errors.Wrap(err, "Could not update qcow2 header")
+		return nil, err
+	}
 
 	// Okay, now that we have a valid image, let's give it the right size
-	if err := truncate(blk.bs(), size); err != nil {
+	if err := bdrvTruncate(blk.bs(), size); err != nil {
 		err = errors.Wrap(err, "Could not resize image")
 		return nil, err
 	}
 
 	// Want a backing file? There you go
 	if backingFile != "" {
-		// TODO(zchee): implements bdrv_change_backing_file
+		if err := bdrvChangeBackingFile(blk.bs(), backingFile, backingFormat); err != nil {
+			err = errors.Wrapf(err, "Could not assign backing file '%s' with format '%s'", backingFile, backingFormat)
+			return nil, err
+		}
+	}
+
+	// write the metadata caches and the buffered metadata to the image file
+	if err := flushToOS(blk.bs()); err != nil {
+		err = errors.Wrap(err, "Could not write the metadata of new image")
+		return nil, err
+	}
+	if err := buffered.flush(); err != nil {
+		err = errors.Wrap(err, "Could not write the metadata of new image")
+		return nil, err
+	}
+	blk.BlockDriverState.File = file
+
+	if backingFile != "" {
+		if err := openBacking(blk.bs()); err != nil {
+			return nil, err
+		}
 	}
 
 	// And if we're supposed to preallocate metadata, do that now
@@ -422,9 +936,75 @@ func create(filename string, opts *Opts) (*BlockBackend, error) {
 		// TODO(zchee): implements preallocate()
 	}
 
+	if tmpname != "" {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// the new image must be on the disk before it replaces the image file
+		if err := tmpFile.Sync(); err != nil {
+			return nil, err
+		}
+		// the old image file is unlocked after the rename, so the other process can not open it in between
+		if oldFile != nil && closeBeforeRename {
+			oldFile.Close()
+		}
+		if err := os.Rename(tmpname, path); err != nil {
+			return nil, err
+		}
+		// the rename is durable once the directory is synced, which is not supported on some platforms
+		syncPath(filepath.Dir(path))
+	}
+
+	// the guest requests of the created image are checked against the virtual disk size
+	blk.allowBeyondEOF = false
+	blk.enableWriteCache = true
+
 	return blk, nil
 }
 
+// autoClusterSize returns the cluster size of the image of size bytes virtual disk, which is used if the
+// cluster size is not given. It is DEFAULT_CLUSTER_SIZE, and is doubled up to 2 MiB while the L1 table of
+// the image does not fit in a single cluster, so the huge image does not have the huge L1 table.
+func autoClusterSize(size int64) int64 {
+	clusterBits := ctz32(DEFAULT_CLUSTER_SIZE)
+	for clusterBits < MAX_CLUSTER_BITS {
+		l2Bits := clusterBits - 3
+		l1Size := divRoundUp(size, int64(1)<<uint(clusterBits+l2Bits))
+		if l1Size*UINT64_SIZE <= int64(1)<<uint(clusterBits) {
+			break
+		}
+		clusterBits++
+	}
+	return int64(1) << uint(clusterBits)
+}
+
+// calcPreallocSize return the size of the image file which is fully allocated the totalSize bytes
+// of virtual disk, including all of the metadata.
+//  block/qcow2.c: static int64_t qcow2_calc_prealloc_size(int64_t total_size, size_t cluster_size, int refcount_order)
+func calcPreallocSize(totalSize, clusterSize int64, refcountOrder int) int64 {
+	var metaSize int64
+	alignedTotalSize := alignOffset(totalSize, int(clusterSize))
+
+	// header: 1 cluster
+	metaSize += clusterSize
+
+	// total size of L2 tables
+	nl2e := alignedTotalSize / clusterSize
+	nl2e = alignOffset(nl2e, int(clusterSize/UINT64_SIZE))
+	metaSize += nl2e * UINT64_SIZE
+
+	// total size of L1 tables
+	nl1e := nl2e * UINT64_SIZE / clusterSize
+	nl1e = alignOffset(nl1e, int(clusterSize/UINT64_SIZE))
+	metaSize += nl1e * UINT64_SIZE
+
+	// total size of refcount table and blocks
+	refcountSize, _ := refcountMetadataSize((metaSize+alignedTotalSize)/clusterSize, clusterSize, refcountOrder, false)
+	metaSize += refcountSize
+
+	return metaSize + alignedTotalSize
+}
+
 // refreshTotalSectors sets the current 'total_sectors' value
 func refreshTotalSectors(bs *BlockDriverState, hint int64) error {
 	drv := bs.Drv
@@ -443,30 +1023,42 @@ func refreshTotalSectors(bs *BlockDriverState, hint int64) error {
 		if length < 0 {
 			return nil
 		}
-		hint = divRoundUp(int(length), BDRV_SECTOR_SIZE)
+		hint = divRoundUp(length, int64(BDRV_SECTOR_SIZE))
 	}
 
+	bs.mu.Lock()
 	bs.TotalSectors = hint
+	bs.mu.Unlock()
+
 	return nil
 }
 
+// truncate grows the virtual disk size of the image to offset bytes.
+//  block/qcow2.c: static int qcow2_truncate(BlockDriverState *bs, int64_t offset)
 func truncate(bs *BlockDriverState, offset int64) error {
 	s := bs.Opaque
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
 	if offset&511 != 0 {
-		err := errors.Wrap(syscall.EINVAL, "The new size must be a multiple of 512")
+		err := errors.Wrap(ErrInvalidArgument, "The new size must be a multiple of 512")
 		return err
 	}
 
 	// cannot proceed if image has snapshots
 	if s.NbSnapshots != 0 {
-		err := errors.Wrap(syscall.ENOTSUP, "Can't resize an image which has snapshots")
+		err := errors.Wrap(ErrUnsupported, "Can't resize an image which has snapshots")
 		return err
 	}
 
 	// shrinking is currently not supported
 	if offset < bs.TotalSectors*512 {
-		err := errors.Wrap(syscall.ENOTSUP, "qcow2 doesn't support shrinking images yet")
+		err := errors.Wrap(ErrUnsupported, "qcow2 doesn't support shrinking images yet")
 		return err
 	}
 
@@ -476,10 +1068,9 @@ func truncate(bs *BlockDriverState, offset int64) error {
 	}
 
 	// write updated header.size
-	// off := BEUvarint64(uint64(offset))
-	// if err := bdrvPwriteSync(bs.File, unsafe.Offsetof(Header.Size), &offset, UINT64_SIZE); err != nil {
-	// 	return err
-	// }
+	if err := bdrvPwriteSync(bs.file, int64(unsafe.Offsetof(Header{}.Size)), BEUvarint64(uint64(offset))); err != nil {
+		return err
+	}
 
 	s.L1VmStateIndex = int(newL1Size)
 	return nil
@@ -499,14 +1090,13 @@ func writeFile(bs *BlockDriverState, offset int64, data []byte, length int) erro
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, data)
 
-	bs.File.Seek(offset, 0)
-	off, err := bs.File.Write(buf.Bytes())
+	off, err := bs.File.WriteAt(buf.Bytes(), offset)
 	if err != nil {
 		return errors.Wrap(err, "Could not write a data")
 	}
 
 	if length > off {
-		if err := zeroFill(bs.File, int64(length-off)); err != nil {
+		if err := zeroFill(io.NewOffsetWriter(bs.File, offset+int64(off)), int64(length-off)); err != nil {
 			return err
 		}
 	}
@@ -514,18 +1104,22 @@ func writeFile(bs *BlockDriverState, offset int64, data []byte, length int) erro
 	return nil
 }
 
-func roundUp(n, d int) int64 {
-	return int64((n + d - 1) & -d)
+// roundUp return n rounded up to the multiple of d, which must be a power of 2.
+//  #define ROUND_UP(n, d) (((n) + (d) - 1) & -(0 ? (n) : (d)))
+func roundUp(n, d int64) int64 {
+	return (n + d - 1) & -d
 }
 
-func divRoundUp(n, d int) int64 {
-	return int64((n + d - 1) / d)
+// divRoundUp return n divided by d, rounded up.
+//  #define DIV_ROUND_UP(n, d) (((n) + (d) - 1) / (d))
+func divRoundUp(n, d int64) int64 {
+	return (n + d - 1) / d
 }
 
 // zeroFill writes n zero bytes into w.
 func zeroFill(w io.Writer, n int64) error {
-	const blocksize = 32 << 10
-	zeros := make([]byte, blocksize)
+	const blocksize = int64(len(zeroBlock))
+	zeros := zeroBlock[:]
 	var k int
 	var err error
 	for n > 0 {
@@ -560,14 +1154,18 @@ func CreateFile(filename string, opts *BlockOption) (*os.File, error) {
 	return image, nil
 }
 
-// Open open the QCow2 block-backend image file.
+// Open open the QCow2 block-backend image file, and locks it.
 func (blk *BlockBackend) Open(filename, reference string, options *BlockOption, flag int) error {
-	file, err := os.OpenFile(filename, flag, os.FileMode(0))
+	file, err := os.OpenFile(filename, flag, os.FileMode(0666))
 	if err != nil {
 		return err
 	}
+	if err := bdrvLockImageFile(file, filename, flag); err != nil {
+		file.Close()
+		return err
+	}
 
-	blk.BlockDriverState.File = file
+	blk.BlockDriverState.File = NewFileBackend(file)
 
 	return nil
 }
@@ -579,26 +1177,36 @@ func Open(bs *BlockDriverState, options *QDict, flag int) error {
 	s := bs.Opaque
 	var header Header
 
-	err := bdrvPread(bs.file, 0, &header, unsafe.Sizeof(header))
-	if err != nil {
+	buf := make([]byte, unsafe.Sizeof(header))
+	if err := bdrvPread(bs.file, 0, buf); err != nil {
+		err = errors.Wrap(err, "Could not read qcow2 header")
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &header); err != nil {
 		err = errors.Wrap(err, "Could not read qcow2 header")
 		return err
 	}
 
 	if !bytes.Equal(BEUvarint32(header.Magic), MAGIC) {
-		err := errors.Wrap(syscall.EINVAL, "Image is not in qcow2 format")
+		err := errors.Wrap(ErrNotQcow2, "Image is not in qcow2 format")
 		return err
 	}
-	if header.Version < Version2 || header.Version > Version3 {
-		err := errors.Wrapf(syscall.ENOTSUP, "Unsupported qcow2 version %d", header.Version)
-		return err
+
+	fileSize, err := bs.file.bs.File.Size()
+	if err != nil {
+		err = errors.Wrap(err, "Could not get the image file size")
+		return err
+	}
+	if header.Version < Version2 || header.Version > Version3 {
+		err := errors.Wrapf(ErrUnsupportedVersion, "Unsupported qcow2 version %d", header.Version)
+		return err
 	}
 
 	s.Version = header.Version
 
 	// Initialise cluster size
 	if header.ClusterBits < MIN_CLUSTER_BITS || header.ClusterBits > MAX_CLUSTER_BITS {
-		err := errors.Wrapf(syscall.EINVAL, "Unsupported cluster size: 2^%d", header.ClusterBits)
+		err := errors.Wrapf(ErrInvalidHeader, "Unsupported cluster size: 2^%d", header.ClusterBits)
 		return err
 	}
 
@@ -615,13 +1223,13 @@ func Open(bs *BlockDriverState, options *QDict, flag int) error {
 		header.HeaderLength = 72
 	} else {
 		if header.HeaderLength < 104 {
-			err := errors.Wrap(syscall.EINVAL, "qcow2 header too short")
+			err := errors.Wrap(ErrInvalidHeader, "qcow2 header too short")
 			return err
 		}
 	}
 
 	if header.HeaderLength > uint32(s.ClusterSize) {
-		err := errors.Wrap(syscall.EINVAL, "qcow2 header exceeds cluster size")
+		err := errors.Wrap(ErrInvalidHeader, "qcow2 header exceeds cluster size")
 		return err
 	}
 
@@ -629,53 +1237,52 @@ func Open(bs *BlockDriverState, options *QDict, flag int) error {
 	if header.HeaderLength > hdrSizeof {
 		s.UnknownheaderFieldsSize = int(header.HeaderLength - hdrSizeof)
 		s.UnknownHeaderFields = make([]byte, s.UnknownheaderFieldsSize)
-		err := bdrvPread(bs.file, int64(hdrSizeof), &s.UnknownHeaderFields, uintptr(s.UnknownheaderFieldsSize))
-		if err != nil {
+		if err := bdrvPread(bs.file, int64(hdrSizeof), s.UnknownHeaderFields); err != nil {
 			err = errors.Wrap(err, "Could not read unknown qcow2 header fields")
 			return err
 		}
 	}
 
 	if header.BackingFileOffset > uint64(s.ClusterSize) {
-		err := errors.Wrap(syscall.EINVAL, "Invalid backing file offset")
+		err := errors.Wrap(ErrInvalidHeader, "Invalid backing file offset")
 		return err
 	}
 
-	// var extEnd uint64
-	// if header.BackingFileOffset != 0 {
-	// 	extEnd = header.BackingFileOffset
-	// } else {
-	// 	extEnd = 1 << header.ClusterBits
-	// }
+	var extEnd uint64
+	if header.BackingFileOffset != 0 {
+		extEnd = header.BackingFileOffset
+	} else {
+		extEnd = 1 << header.ClusterBits
+	}
 
 	// Handle feature bits
 	s.IncompatibleFeatures = header.IncompatibleFeatures
 	s.CompatibleFeatures = header.CompatibleFeatures
 	s.AutoclearFeatures = header.AutoclearFeatures
 
-	if int(s.IncompatibleFeatures) & ^INCOMPAT_MASK != 0 {
-		// TODO(zchee): implements read extensions
-		// featureTable := nil
-		// qcow2_read_extensions(bs, header.header_length, ext_end, &feature_table, NULL);
-		// report_unsupported_feature(errp, feature_table, s->incompatible_features & ~QCOW2_INCOMPAT_MASK);
-		// ret = -ENOTSUP;
-		// g_free(feature_table);
-		// goto fail;
+	if s.IncompatibleFeatures&^INCOMPAT_MASK != 0 {
+		var featureTable []Feature
+		readExtensions(bs, uint64(header.HeaderLength), extEnd, &featureTable, nil)
+		return reportUnsupportedFeature(featureTable, s.IncompatibleFeatures&^INCOMPAT_MASK)
 	}
 
 	if s.IncompatibleFeatures&INCOMPAT_CORRUPT != 0 {
-		// TODO(zchee): implements
 		// Corrupt images may not be written to unless they are being repaired
-		// if ((flags & BDRV_O_RDWR) && !(flags & BDRV_O_CHECK)) {
-		// 	error_setg(errp, "qcow2: Image is corrupt; cannot be opened read/write");
-		// 	ret = -EACCES;
-		// 	goto fail;
-		// }
+		switch {
+		case flag&(os.O_WRONLY|os.O_RDWR) == 0:
+			bdrvLogf(bs, LogWarn, "qcow2: Image '%s' is corrupt; it is opened read-only for the data recovery", bs.Filename)
+		case bs.Options == nil || !bs.Options.Repair:
+			err := errors.Wrap(ErrCorrupt, "qcow2: Image is corrupt; cannot be opened read/write")
+			return err
+		default:
+			// the writes other than the repair are fenced until the check clears the corrupt bit
+			s.fenced = true
+		}
 	}
 
 	// Check support for various header values
 	if header.RefcountOrder > 6 {
-		err := errors.Wrap(syscall.EINVAL, "Reference count entry width too large; may not exceed 64 bits")
+		err := errors.Wrap(ErrInvalidHeader, "Reference count entry width too large; may not exceed 64 bits")
 		return err
 	}
 	s.RefcountOrder = int(header.RefcountOrder)
@@ -684,7 +1291,7 @@ func Open(bs *BlockDriverState, options *QDict, flag int) error {
 	s.RefcountMax += s.RefcountMax - 1
 
 	if header.CryptMethod > CRYPT_AES {
-		err := errors.Wrapf(syscall.EINVAL, "Unsupported encryption method: %d", header.CryptMethod)
+		err := errors.Wrapf(ErrInvalidHeader, "Unsupported encryption method: %d", header.CryptMethod)
 		return err
 	}
 	// TODO(zchee): implements
@@ -708,202 +1315,1387 @@ func Open(bs *BlockDriverState, options *QDict, flag int) error {
 	// 2^(s->refcount_order - 3) is the refcount width in bytes
 	s.RefcountBlockBits = s.ClusterBits - (s.RefcountOrder - 3)
 	s.RefcountBlockSize = 1 << uint(s.RefcountBlockBits)
+	if header.Size > INT64_MAX {
+		err := errors.Wrapf(ErrTooLarge, "Image size %d is too big", header.Size)
+		return err
+	}
 	bs.TotalSectors = int64(header.Size / 512)
 	s.Csize_shift = (62 - (s.ClusterBits - 8))
-	s.Csize_mask = (1 - (s.ClusterBits - 8)) - 1
+	s.Csize_mask = (1 << uint(s.ClusterBits-8)) - 1
 	s.ClusterOffsetMask = (1 << uint(s.Csize_shift)) - 1
 
+	// check the table size before the shift, which is evaluated in uint32
+	if uint64(header.RefcountTableClusters) > maxRefcountClusters(s) {
+		err := errors.Wrap(ErrInvalidHeader, "Reference count table too large")
+		return err
+	}
+
+	if header.RefcountTableClusters == 0 {
+		err := errors.Wrap(ErrInvalidHeader, "Image does not contain a reference count table")
+		return err
+	}
+
 	s.RefcountTableOffset = header.RefcountTableOffset
 	s.RefcountTableSize = header.RefcountTableClusters << uint(s.ClusterBits-3)
 
-	if uint64(header.RefcountTableClusters) > maxRefcountClusters(s) {
-		err := errors.Wrap(syscall.EINVAL, "Reference count table too large")
+	if err := validateTableOffset(s, s.RefcountTableOffset, uint64(s.RefcountTableSize), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "Invalid reference count table offset")
+		return err
+	}
+	if err := validateTableInFile(fileSize, s.RefcountTableOffset, uint64(s.RefcountTableSize), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "Reference count table exceeds the end of the image file")
+		return err
+	}
+
+	// Snapshot table offset/length
+	if header.NbSnapshots > MAX_SNAPSHOTS {
+		err := errors.Wrap(ErrInvalidHeader, "Too many snapshots")
+		return err
+	}
+
+	if err := validateTableOffset(s, header.SnapshotsOffset, uint64(header.NbSnapshots), snapshotHeaderSize); err != nil {
+		err = errors.Wrap(err, "Invalid snapshot table offset")
+		return err
+	}
+	if err := validateTableInFile(fileSize, header.SnapshotsOffset, uint64(header.NbSnapshots), snapshotHeaderSize); err != nil {
+		err = errors.Wrap(err, "Snapshot table exceeds the end of the image file")
+		return err
+	}
+
+	s.SnapshotsOffset = header.SnapshotsOffset
+	s.NbSnapshots = uintptr(header.NbSnapshots)
+
+	// read the level 1 table
+	if header.L1Size > MAX_L1_SIZE/UINT64_SIZE {
+		err := errors.Wrap(ErrTooLarge, "Active L1 table too large")
+		return err
+	}
+
+	if err := validateTableOffset(s, header.L1TableOffset, uint64(header.L1Size), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "Invalid L1 table offset")
+		return err
+	}
+	if err := validateTableInFile(fileSize, header.L1TableOffset, uint64(header.L1Size), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "L1 table exceeds the end of the image file")
+		return err
+	}
+	s.L1Size = int(header.L1Size)
+
+	l1VmStateIndex := sizeToL1(s, int64(header.Size))
+	if l1VmStateIndex > INT_MAX {
+		err := errors.Wrap(ErrTooLarge, "Image is too big")
+		return err
+	}
+	s.L1VmStateIndex = int(l1VmStateIndex)
+
+	// the L1 table must contain at least enough entries to put header.size bytes
+	if s.L1Size < s.L1VmStateIndex {
+		err := errors.Wrap(ErrInvalidHeader, "L1 table is too small")
+		return err
+	}
+	s.L1TableOffset = header.L1TableOffset
+
+	// the L1 table is loaded on demand
+	s.L1Table = newL1Table(s.L1TableOffset, s.L1Size)
+
+	if err := initCaches(bs); err != nil {
+		return err
+	}
+
+	overlapCheck, err := overlapCheckTemplate(bs)
+	if err != nil {
+		return err
+	}
+	s.OverlapCheck = overlapCheck
+
+	if err := refcountInit(bs); err != nil {
+		err = errors.Wrap(err, "Could not initialize refcount handling")
+		return err
+	}
+
+	s.DiscardPassthrough[DISCARD_NEVER] = false
+	s.DiscardPassthrough[DISCARD_ALWAYS] = true
+	s.DiscardPassthrough[DISCARD_REQUEST] = bs.Options != nil && bs.Options.Unmap
+	s.DiscardPassthrough[DISCARD_SNAPSHOT] = true
+	s.DiscardPassthrough[DISCARD_OTHER] = false
+	s.WipeFreed = bs.Options != nil && bs.Options.Wipe
+	if bs.Options != nil {
+		quota := bs.Options.SnapshotQuota
+		if quota.MaxSnapshots < 0 || quota.MaxTableSize < 0 {
+			err := errors.Wrap(ErrInvalidArgument, "Snapshot quota must not be negative")
+			return err
+		}
+		s.SnapshotQuota = quota
+
+		if err := bs.Options.Compression.validate(); err != nil {
+			return err
+		}
+		s.Compression = bs.Options.Compression
+	}
+
+	// the compressed cluster cache is allocated on the first read of the compressed cluster
+	s.ClusterCacheOffset = ^uint64(0)
+
+	// read qcow2 extensions
+	var needUpdateHeader bool
+	if err := readExtensions(bs, uint64(header.HeaderLength), extEnd, nil, &needUpdateHeader); err != nil {
+		return err
+	}
+
+	// read the backing file name
+	if header.BackingFileOffset != 0 {
+		length := header.BackingFileSize
+		if uint64(length) > uint64(MIN(1023, s.ClusterSize-int(header.BackingFileOffset))) {
+			err := errors.Wrap(ErrInvalidHeader, "Backing file name too long")
+			return err
+		}
+		backingFile := make([]byte, length)
+		if err := bdrvPread(bs.file, int64(header.BackingFileOffset), backingFile); err != nil {
+			err = errors.Wrap(err, "Could not read backing file name")
+			return err
+		}
+		bs.BackingFile = string(backingFile)
+		s.ImageBackingFile = bs.BackingFile
+	}
+
+	if err := readSnapshots(bs); err != nil {
+		err = errors.Wrap(err, "Could not read snapshots")
 		return err
 	}
 
-	// ret = validate_table_offset(bs, header.l1_table_offset, header.l1_size, sizeof(uint64_t));
+	// Clear unknown autoclear feature bits
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// the dirty bitmaps are not maintained by the writes, so the bitmaps extension is dropped
+		// same as a program lacking bitmap support
+		if s.AutoclearFeatures&AUTOCLEAR_BITMAPS != 0 || s.NbBitmaps > 0 {
+			needUpdateHeader = true
+		}
+		if s.AutoclearFeatures&^AUTOCLEAR_MASK != 0 {
+			needUpdateHeader = true
+		}
+
+		s.AutoclearFeatures &= AUTOCLEAR_MASK &^ AUTOCLEAR_BITMAPS
+		s.NbBitmaps = 0
+		s.BitmapDirectoryOffset = 0
+		s.BitmapDirectorySize = 0
+
+		if needUpdateHeader {
+			bdrvLogf(bs, LogDebug, "qcow2: Clearing the autoclear feature bits %#x of '%s'", header.AutoclearFeatures, bs.Filename)
+			if err := updateHeader(bs); err != nil {
+				err = errors.Wrap(err, "Could not update qcow2 header")
+				return err
+			}
+		}
+	}
+
+	// Repair image if dirty
+	if s.IncompatibleFeatures&INCOMPAT_DIRTY != 0 {
+		if err := repairDirty(bs, flag); err != nil {
+			return err
+		}
+	}
+
+	cacheCleanTimerInit(bs)
 
 	return nil
 }
 
-// getInfo gets the BlockDriverInfo informations.
-//  static int qcow2_get_info(BlockDriverState *bs, BlockDriverInfo *bdi)
-func getInfo(bs *BlockDriverState) *BlockDriverInfo {
-	bdi := new(BlockDriverInfo)
+// repairDirty rebuilds the refcounts of the dirty image, whose refcounts may be inaccurate since the lazy
+// refcounts were enabled when it was closed uncleanly, same as the automatic "qemu-img check -r all".
+// The image which is opened with OpenOpts.Repair is repaired by its caller instead. The read-only image can
+// not be repaired, so its open fails with ErrDirty unless OpenOpts.Repair is set, since its metadata may be
+// inconsistent, such as while the image is in use by the other process with the lazy refcounts.
+func repairDirty(bs *BlockDriverState, flag int) error {
+	repair := bs.Options != nil && bs.Options.Repair
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !repair {
+			err := errors.Wrapf(ErrDirty, "qcow2: Image '%s' is dirty; it cannot be opened read-only without the repair option", bs.Filename)
+			return err
+		}
+		bdrvLogf(bs, LogWarn, "qcow2: Image '%s' is dirty; its refcounts are not repaired while it is opened read-only", bs.Filename)
+		return nil
+	}
+	if repair {
+		return nil
+	}
+
+	bdrvLogf(bs, LogInfo, "qcow2: Repairing the dirty image '%s'", bs.Filename)
+	var res BdrvCheckResult
+	err := check(context.Background(), bs, &res, BDRV_FIX_ERRORS|BDRV_FIX_LEAKS)
+	if err == nil && res.CheckErrors > 0 {
+		err = errors.Errorf("%d errors were found during the check", res.CheckErrors)
+	}
+	if err != nil {
+		err = errors.Wrapf(ErrDirty, "Could not repair dirty image: %v", err)
+		return err
+	}
+	bdrvLogf(bs, LogInfo, "qcow2: Repaired the dirty image '%s': %d leaks and %d corruptions were fixed",
+		bs.Filename, res.LeaksFixed, res.CorruptionsFixed)
+
+	return nil
+}
+
+// readExtensions reads the optional header extensions from start to end offset.
+// If featureTable is not nil, stores the feature name table to featureTable.
+// If needUpdateHeader is not nil, it is set to true if the header should be rewritten to drop the
+// inconsistent extension.
+//  block/qcow2.c: static int qcow2_read_extensions(BlockDriverState *bs, uint64_t start_offset, uint64_t end_offset, void **p_feature_table, int flags, bool *need_update_header, Error **errp)
+func readExtensions(bs *BlockDriverState, startOffset, endOffset uint64, featureTable *[]Feature, needUpdateHeader *bool) error {
 	s := bs.Opaque
+	offset := startOffset
 
-	bdi.unallocatedBlocksAreZero = true
-	bdi.canWriteZeroesWithUnmap = (s.Version >= 3)
-	bdi.clusterSize = s.ClusterSize
-	bdi.vmStateOffset = vmStateOffset(s)
+	for offset < endOffset {
+		if offset > uint64(s.ClusterSize) {
+			err := errors.Wrapf(ErrInvalidHeader, "qcow2_read_extension: suspicious offset %d", offset)
+			return err
+		}
 
-	return bdi
+		var ext Extension
+		buf := make([]byte, unsafe.Sizeof(ext))
+		if err := bdrvPread(bs.file, int64(offset), buf); err != nil {
+			err = errors.Wrapf(err, "qcow2_read_extension: ERROR: pread fail from offset %d", offset)
+			return err
+		}
+		ext.Magic = HeaderExtensionType(BEUint32(buf[0:4]))
+		ext.Len = BEUint32(buf[4:8])
+		offset += uint64(len(buf))
+
+		if offset > endOffset || uint64(ext.Len) > endOffset-offset {
+			err := errors.Wrap(ErrInvalidHeader, "Header extension too large")
+			return err
+		}
+
+		data := make([]byte, ext.Len)
+		if err := bdrvPread(bs.file, int64(offset), data); err != nil {
+			err = errors.Wrapf(err, "ERROR: ext 0x%x: Could not read data", uint32(ext.Magic))
+			return err
+		}
+
+		switch ext.Magic {
+		case HeaderExtensionEndOfArea:
+			return nil
+
+		case HeaderExtensionBackingFileFormat:
+			if ext.Len >= 16 {
+				err := errors.Wrapf(ErrInvalidHeader, "ERROR: ext_backing_format: len=%d too large (>=16)", ext.Len)
+				return err
+			}
+			bs.BackingFormat = string(data)
+			s.ImageBackingFormat = data
+
+		case HeaderExtensionFeatureNameTable:
+			if featureTable != nil {
+				for i := 0; i+featureSize <= len(data); i += featureSize {
+					*featureTable = append(*featureTable, Feature{
+						Type: data[i],
+						Bit:  data[i+1],
+						Name: string(bytes.TrimRight(data[i+2:i+featureSize], "\x00")),
+					})
+				}
+			}
+
+		case HeaderExtensionBitmapsExtension:
+			if ext.Len != uint32(unsafe.Sizeof(BitmapExtension{})) {
+				err := errors.Wrap(ErrInvalidHeader, "bitmaps_ext: Invalid extension length")
+				return err
+			}
+
+			if s.AutoclearFeatures&AUTOCLEAR_BITMAPS == 0 {
+				// a program lacking bitmap support modified this file, so all bitmaps are now considered
+				// inconsistent, and the extension is dropped
+				if needUpdateHeader != nil {
+					*needUpdateHeader = true
+				}
+				break
+			}
+
+			var bitmapsExt BitmapExtension
+			if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &bitmapsExt); err != nil {
+				return err
+			}
+
+			if bitmapsExt.Reserved != 0 {
+				err := errors.Wrap(ErrInvalidHeader, "bitmaps_ext: Reserved field is not zero")
+				return err
+			}
+			if bitmapsExt.NbBitmaps > MAX_BITMAPS {
+				err := errors.Wrapf(ErrInvalidHeader, "bitmaps_ext: Image has %d bitmaps, exceeding the QEMU supported maximum of %d", bitmapsExt.NbBitmaps, MAX_BITMAPS)
+				return err
+			}
+			if bitmapsExt.NbBitmaps == 0 {
+				err := errors.Wrap(ErrInvalidHeader, "found bitmaps extension with zero bitmaps")
+				return err
+			}
+			if offsetIntoCluster(s, int64(bitmapsExt.BitmapDirectoryOffset)) != 0 {
+				err := errors.Wrap(ErrInvalidHeader, "bitmaps_ext: invalid bitmap directory offset")
+				return err
+			}
+			if bitmapsExt.BitmapDirectorySize > MAX_BITMAP_DIRECTORY_SIZE {
+				err := errors.Wrapf(ErrInvalidHeader, "bitmaps_ext: bitmap directory size (%d) exceeds the maximum supported size (%d)", bitmapsExt.BitmapDirectorySize, MAX_BITMAP_DIRECTORY_SIZE)
+				return err
+			}
+
+			s.NbBitmaps = bitmapsExt.NbBitmaps
+			s.BitmapDirectoryOffset = bitmapsExt.BitmapDirectoryOffset
+			s.BitmapDirectorySize = bitmapsExt.BitmapDirectorySize
+
+		default:
+			// unknown magic - save it in case we need to rewrite the header
+			s.UnknownHeaderExt = append(s.UnknownHeaderExt, &UnknownHeaderExtension{
+				Magic: uint32(ext.Magic),
+				Len:   ext.Len,
+				Data:  data,
+			})
+		}
+
+		offset += (uint64(ext.Len) + 7) &^ 7
+	}
+
+	return nil
 }
 
-// selectPart
-//  static void convert_select_part(ImgConvertState *s, int64_t sector_num)
-func (q *QCow2) selectPart(sectorNum int64) {
-	for (sectorNum - q.srcCurOffset) >= int64(BEUvarint64(uint64(q.srcSectors))[q.srcCur]) {
-		q.srcCurOffset += int64(BEUvarint64(uint64(q.srcSectors))[q.srcCur])
-		q.srcCur++
+// headerExtAdd adds the header extension of magic and data to buf.
+// Returns the length of the header extension including the padding.
+//  block/qcow2.c: static size_t header_ext_add(char *buf, uint32_t magic, const void *s, size_t len, size_t buflen)
+func headerExtAdd(buf []byte, magic HeaderExtensionType, data []byte) (int, error) {
+	extLen := int(unsafe.Sizeof(Extension{})) + (len(data)+7)&^7
+	if len(buf) < extLen {
+		return 0, syscall.ENOSPC
 	}
+
+	copy(buf, BEUvarint32(uint32(magic)))
+	copy(buf[4:], BEUvarint32(uint32(len(data))))
+	copy(buf[unsafe.Sizeof(Extension{}):], data)
+
+	return extLen, nil
 }
 
-func (q *QCow2) iterationSectors(sectorNum int64) (int, error) {
-	// q.selectPart(sectorNum)
+// updateHeader writes the header, the header extensions and the backing file name of the image
+// based on the current state.
+//  block/qcow2.c: int qcow2_update_header(BlockDriverState *bs)
+func updateHeader(bs *BlockDriverState) error {
+	s := bs.Opaque
 
-	n := MIN(int(q.totalSectors-sectorNum), BDRV_SECTOR_BITS)
+	buf := qemuBlockalign(bs, s.ClusterSize)
+
+	header := Header{
+		// Version 2 fields
+		Magic:                 BEUint32(MAGIC),
+		Version:               s.Version,
+		BackingFileOffset:     0, // updated later
+		BackingFileSize:       0,
+		ClusterBits:           uint32(s.ClusterBits),
+		Size:                  uint64(bs.TotalSectors * int64(BDRV_SECTOR_SIZE)),
+		CryptMethod:           CryptMethod(s.CryptMethodHeader),
+		L1Size:                uint32(s.L1Size),
+		L1TableOffset:         s.L1TableOffset,
+		RefcountTableOffset:   s.RefcountTableOffset,
+		RefcountTableClusters: s.RefcountTableSize >> uint(s.ClusterBits-3),
+		NbSnapshots:           uint32(s.NbSnapshots),
+		SnapshotsOffset:       s.SnapshotsOffset,
+
+		// Version 3 fields
+		IncompatibleFeatures: s.IncompatibleFeatures,
+		CompatibleFeatures:   s.CompatibleFeatures,
+		AutoclearFeatures:    s.AutoclearFeatures,
+		RefcountOrder:        uint32(s.RefcountOrder),
+		HeaderLength:         uint32(unsafe.Sizeof(Header{})) + uint32(s.UnknownheaderFieldsSize),
+	}
 
-	if q.sectorNextStatus <= sectorNum {
-		// TODO(zchee): hardcoded BDRV_BLOCK_DATA
-		s := BDRV_BLOCK_DATA
-		// BlockDriverState *file;
-		// ret = bdrv_get_block_status(blk_bs(s->src[s->src_cur]),
-		// 							sector_num - s->src_cur_offset,
-		// 							n, &n, &file);
+	// For older versions, write a shorter header
+	var offset int
+	switch s.Version {
+	case Version2:
+		offset = int(unsafe.Offsetof(header.IncompatibleFeatures))
+	case Version3:
+		offset = int(unsafe.Sizeof(header))
+	default:
+		return syscall.EINVAL
+	}
 
-		switch {
-		case s == BDRV_BLOCK_ZERO:
-			q.status = BLK_ZERO
-		case s == BDRV_BLOCK_DATA:
-			q.status = BLK_DATA
-		case !q.targetHasBacking:
-			// TODO(zchee): omit
-		default:
-			q.status = BLK_BACKING_FILE
+	// Preserve any unknown field in the header
+	if s.UnknownheaderFieldsSize > 0 {
+		if len(buf)-offset < s.UnknownheaderFieldsSize {
+			return syscall.ENOSPC
+		}
+		offset += copy(buf[offset:], s.UnknownHeaderFields)
+	}
+
+	// Backing file format header extension
+	if len(s.ImageBackingFormat) > 0 {
+		n, err := headerExtAdd(buf[offset:], HeaderExtensionBackingFileFormat, s.ImageBackingFormat)
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	// Feature table
+	if s.Version >= Version3 {
+		features := []Feature{
+			{
+				Type: uint8(FEAT_TYPE_INCOMPATIBLE),
+				Bit:  uint8(INCOMPAT_DIRTY_BITNR),
+				Name: "dirty bit",
+			},
+			{
+				Type: uint8(FEAT_TYPE_INCOMPATIBLE),
+				Bit:  uint8(INCOMPAT_CORRUPT_BITNR),
+				Name: "corrupt bit",
+			},
+			{
+				Type: uint8(FEAT_TYPE_COMPATIBLE),
+				Bit:  uint8(COMPAT_LAZY_REFCOUNTS_BITNR),
+				Name: "lazy refcounts",
+			},
+		}
+
+		table := make([]byte, featureSize*len(features))
+		for i, f := range features {
+			table[i*featureSize] = f.Type
+			table[i*featureSize+1] = f.Bit
+			copy(table[i*featureSize+2:(i+1)*featureSize], f.Name)
 		}
 
-		q.sectorNextStatus = sectorNum + int64(n)
+		n, err := headerExtAdd(buf[offset:], HeaderExtensionFeatureNameTable, table)
+		if err != nil {
+			return err
+		}
+		offset += n
 	}
 
-	n = MIN(n, int(q.sectorNextStatus-sectorNum))
-	if q.status == BLK_DATA {
-		n = MIN(n, q.bufSectors)
+	// Bitmap extension
+	if s.NbBitmaps > 0 {
+		ext := make([]byte, unsafe.Sizeof(BitmapExtension{}))
+		copy(ext[0:4], BEUvarint32(s.NbBitmaps))
+		copy(ext[8:16], BEUvarint64(s.BitmapDirectorySize))
+		copy(ext[16:24], BEUvarint64(s.BitmapDirectoryOffset))
+
+		n, err := headerExtAdd(buf[offset:], HeaderExtensionBitmapsExtension, ext)
+		if err != nil {
+			return err
+		}
+		offset += n
 	}
 
-	// TODO(zchee): support zlib compressed write
-	// We need to write complete clusters for compressed images, so if an
-	// unallocated area is shorter than that, we must consider the whole
-	// cluster allocated
-	// if (s->compressed) {
-	// 	 if (n < s->cluster_sectors) {
-	// 		 n = MIN(s->cluster_sectors, s->total_sectors - sector_num);
-	// 		 s->status = BLK_DATA;
-	// 	 } else {
-	// 		 n = QEMU_ALIGN_DOWN(n, s->cluster_sectors);
-	// 	 }
-	//  }
+	// Keep unknown header extensions
+	for _, uext := range s.UnknownHeaderExt {
+		n, err := headerExtAdd(buf[offset:], HeaderExtensionType(uext.Magic), uext.Data)
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
 
-	return n, nil
-}
+	// End of header extensions
+	n, err := headerExtAdd(buf[offset:], HeaderExtensionEndOfArea, nil)
+	if err != nil {
+		return err
+	}
+	offset += n
 
-func (q *QCow2) readData(sectorNum, n int, buf *[]byte) error {
-	return nil
+	// Add backing file name
+	if s.ImageBackingFile != "" {
+		if len(buf)-offset < len(s.ImageBackingFile) {
+			return syscall.ENOSPC
+		}
+		copy(buf[offset:], s.ImageBackingFile)
+		header.BackingFileOffset = uint64(offset)
+		header.BackingFileSize = uint32(len(s.ImageBackingFile))
+	}
+
+	var hdr bytes.Buffer
+	if err := binary.Write(&hdr, binary.BigEndian, header); err != nil {
+		return err
+	}
+	if s.Version == Version2 {
+		copy(buf, hdr.Bytes()[:unsafe.Offsetof(header.IncompatibleFeatures)])
+	} else {
+		copy(buf, hdr.Bytes())
+	}
+
+	// Write the new header
+	return bdrvPwrite(bs.file, 0, buf)
 }
 
-func (q *QCow2) writeData(sectorNum, n int, buf *[]byte) error {
-	return nil
+// changeBackingFile changes the backing file name and the backing format of the image header.
+//  block/qcow2.c: static int qcow2_change_backing_file(BlockDriverState *bs, const char *backing_file, const char *backing_fmt)
+func changeBackingFile(bs *BlockDriverState, backingFile, backingFmt string) error {
+	s := bs.Opaque
+
+	if len(backingFile) > 1023 {
+		return syscall.EINVAL
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	bs.BackingFile = backingFile
+	bs.BackingFormat = backingFmt
+
+	s.ImageBackingFile = backingFile
+	s.ImageBackingFormat = nil
+	if backingFmt != "" {
+		s.ImageBackingFormat = []byte(backingFmt)
+	}
+
+	return updateHeader(bs)
 }
 
-func (q *QCow2) Write(data []byte) error {
-	bufsectors := IO_BUF_SIZE / BDRV_SECTOR_SIZE
-	totalSectors := q.blk.bs().TotalSectors
+// reportUnsupportedFeature return the error which describes the unsupported incompatible feature bits.
+//  block/qcow2.c: static void report_unsupported_feature(Error **errp, Qcow2Feature *table, uint64_t mask)
+func reportUnsupportedFeature(table []Feature, mask uint64) error {
+	var features []string
 
-	// increase bufsectors from the default 4096 (2M) if opt_transfer
-	// or discard_alignment of the out_bs is greater. Limit to 32768 (16MB)
-	// as maximum.
-	bufsectors = MIN(32768,
-		MAX(bufsectors,
-			MAX(int(q.blk.bs().BL.OptTransfer>>BDRV_SECTOR_BITS), int(q.blk.bs().BL.PdiscardAlignment>>BDRV_SECTOR_BITS))))
+	for _, f := range table {
+		if FeatureType(f.Type) == FEAT_TYPE_INCOMPATIBLE && mask&(1<<f.Bit) != 0 {
+			features = append(features, f.Name)
+			mask &^= 1 << f.Bit
+		}
+	}
 
-	bdi := getInfo(q.blk.bs())
+	for i := uint(0); i < 64; i++ {
+		if mask&(1<<i) != 0 {
+			features = append(features, fmt.Sprintf("Unknown incompatible feature: %x", uint64(1)<<i))
+		}
+	}
 
-	q.src = q.blk
-	// q.srcSectors = bsSectors
-	// q.srcNum = bs_n
-	q.totalSectors = totalSectors
-	q.target = q.blk
-	// TODO(zchee): hardcoded false
-	q.compressed = false
-	// q.targetHasBacking = out_baseimg
-	q.minSparse = 8 // Need at least 4k of zeros for sparse detection
-	q.clusterSectors = bdi.clusterSize / BDRV_SECTOR_SIZE
-	q.bufSectors = bufsectors
+	return errors.Wrapf(ErrUnsupportedFeature, "Unsupported qcow2 feature(s): %s", strings.Join(features, ", "))
+}
 
-	// ------------------------------------------------------------------------
-	// static int convert_do_copy(ImgConvertState *s)
-
-	// buf := posixMemalign(4096, uint64(bufsectors*BDRV_SECTOR_SIZE))
-
-	// Calculate allocated sectors for progress
-	q.allocatedSectors = 0
-	// var sectorNum int64
-	// for int64(sectorNum) < q.totalSectors {
-	// 	n, err := q.iterationSectors(sectorNum)
-	// 	if err != nil && n < 0 {
-	// 		return err
-	// 	}
-	// 	if q.status == BLK_DATA || q.minSparse != 0 && q.status == BLK_ZERO {
-	// 		q.allocatedSectors += int64(n)
-	// 	}
-	// 	sectorNum += int64(n)
-	// 	log.Printf("sectorNum: %+v\n", sectorNum)
-	// }
+// validateTableOffset checks the table at offset of entries * entryLen bytes is representable in int64,
+// and is aligned to the cluster.
+//  block/qcow2.c: static int validate_table_offset(BlockDriverState *bs, uint64_t offset, uint64_t entries, size_t entry_len)
+func validateTableOffset(s *BDRVState, offset, entries, entryLen uint64) error {
+	// Use signed INT64_MAX as the maximum even for uint64_t header fields,
+	// because values will be passed to functions taking int64.
+	if entries > INT64_MAX/entryLen {
+		return ErrInvalidHeader
+	}
 
-	// Do the write
-	q.srcCur = 0
-	q.srcCurOffset = 0
-	q.sectorNextStatus = 0
-
-	// sectorNum = 0
-	// allocated_done = 0
-
-	// for int64(sectorNum) < q.totalSectors {
-	// 	n, err := q.iterationSectors(sectorNum)
-	// 	if err != nil && n < 0 {
-	// 		return err
-	// 	}
-	// 	if q.status == BLK_DATA || q.minSparse != 0 && q.status == BLK_ZERO {
-	// 		allocated_done += int64(n)
-	// 	}
-	//
-	// 	if q.status == BLK_DATA {
-	// 		if err := q.readData(int(sectorNum), n, &buf); err != nil {
-	// 			err = errors.Wrapf(err, "error while reading sector %d", sectorNum)
-	// 			return err
-	// 		}
-	// 	} else if q.minSparse != 0 && q.status == BLK_ZERO {
-	// 		n = MIN(n, q.bufSectors)
-	// 		mem.Set(buf, 0)
-	// 	}
-	//
-	// 	if err := q.writeData(int(sectorNum), n, &buf); err != nil {
-	// 		err = errors.Wrapf(err, "error while writing sector %d", sectorNum)
-	// 		return err
-	// 	}
-	//
-	// 	sectorNum += int64(n)
-	// }
+	size := entries * entryLen
+	if INT64_MAX-size < offset {
+		return ErrInvalidHeader
+	}
 
-	// TODO(zchee): support zlib compressed write
-	// if (s->compressed) {
-	// 	/* signal EOF to align */
-	// 	ret = blk_write_compressed(s->target, 0, NULL, 0);
-	// 	if (ret < 0) {
-	// 		goto fail;
-	// 	}
-	// }
+	// Tables must be cluster aligned
+	if offset&uint64(s.ClusterSize-1) != 0 {
+		return ErrInvalidHeader
+	}
+
+	return nil
+}
+
+// validateTableInFile checks the table at offset of entries * entryLen bytes lies within the image file of
+// fileSize bytes, so the truncated image is not read as the zeros beyond the end of the file.
+// The table must be validated by validateTableOffset before.
+func validateTableInFile(fileSize int64, offset, entries, entryLen uint64) error {
+	if entries == 0 {
+		return nil
+	}
 
-	// TODO(zchee): tired... hardcoded
-	writeFile(q.blk.bs(), 131080, []byte{0, 1, 0, 1, 0, 1, 0, 1}, 8)
-	writeFile(q.blk.bs(), 196608, []byte{128, 0, 0, 0, 0, 4}, 6)
-	writeFile(q.blk.bs(), 262144, []byte{128, 0, 0, 0, 0, 5}, 6)
-	writeFile(q.blk.bs(), 262264, []byte{128, 0, 0, 0, 0, 6}, 6)
-	writeFile(q.blk.bs(), 327680, data, len(data))
+	if offset+entries*entryLen > uint64(fileSize) {
+		return ErrInvalidHeader
+	}
 
 	return nil
 }
 
+// getInfo gets the BlockDriverInfo informations.
+//  block/qcow2.c: static int qcow2_get_info(BlockDriverState *bs, BlockDriverInfo *bdi)
+func getInfo(bs *BlockDriverState) *BlockDriverInfo {
+	bdi := new(BlockDriverInfo)
+	s := bs.Opaque
+
+	bdi.unallocatedBlocksAreZero = true
+	bdi.canWriteZeroesWithUnmap = (s.Version >= 3)
+	bdi.clusterSize = s.ClusterSize
+	bdi.vmStateOffset = vmStateOffset(s)
+
+	return bdi
+}
+
+// getBlockStatus return the block status of the qcow2 image at offset, and n bytes that have the same status.
+//  block/qcow2.c: static int64_t coroutine_fn qcow2_co_get_block_status(BlockDriverState *bs, int64_t sector_num, int nb_sectors, int *pnum, BlockDriverState **file)
+func getBlockStatus(bs *BlockDriverState, offset, bytes int64) (int, int64, int64, error) {
+	s := bs.Opaque
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	clusterOffset, n, typ, err := getClusterOffset(context.Background(), bs, uint64(offset), uint64(bytes))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var (
+		status    int
+		mapOffset int64
+	)
+	if clusterOffset != 0 && typ != CLUSTER_COMPRESSED && s.CryptMethodHeader == 0 {
+		mapOffset = int64(clusterOffset + offsetIntoCluster(s, offset))
+		status |= BDRV_BLOCK_OFFSET_VALID
+	}
+
+	switch typ {
+	case CLUSTER_ZERO:
+		status |= BDRV_BLOCK_ZERO
+	case CLUSTER_COMPRESSED:
+		status |= BDRV_BLOCK_DATA | BDRV_BLOCK_COMPRESSED
+	case CLUSTER_NORMAL:
+		status |= BDRV_BLOCK_DATA
+	}
+
+	return status, int64(n), mapOffset, nil
+}
+
+// preadv reads len(buf) bytes of the guest data at offset.
+// The unallocated clusters are read from the backing file, or filled with zeros if the image has no backing file.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_preadv(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func preadv(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	s := bs.Opaque
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return preadvLocked(ctx, bs, offset, buf)
+}
+
+// preadvLocked is like preadv, but the caller must hold s.lock for reading or writing.
+func preadvLocked(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	s := bs.Opaque
+
+	for len(buf) > 0 {
+		clusterOffset, n, typ, err := getClusterOffset(ctx, bs, uint64(offset), uint64(len(buf)))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return syscall.EIO
+		}
+
+		offsetInCluster := offsetIntoCluster(s, offset)
+		curBuf := buf[:n]
+
+		switch typ {
+		case CLUSTER_UNALLOCATED:
+			if bs.Backing != nil {
+				// read from the base image
+				if err := bdrvAlignedPreadv(ctx, bs.Backing.bs, offset, curBuf); err != nil {
+					return err
+				}
+			} else {
+				for i := range curBuf {
+					curBuf[i] = 0
+				}
+			}
+
+		case CLUSTER_ZERO:
+			for i := range curBuf {
+				curBuf[i] = 0
+			}
+
+		case CLUSTER_COMPRESSED:
+			s.clusterCacheLock.Lock()
+			if err := decompressCluster(bs, clusterOffset); err != nil {
+				s.clusterCacheLock.Unlock()
+				return err
+			}
+			copy(curBuf, s.ClusterCache[offsetInCluster:])
+			s.clusterCacheLock.Unlock()
+
+		case CLUSTER_NORMAL:
+			if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+				err := errors.Wrap(ErrEncrypted, "Reading the encrypted image is not supported")
+				return err
+			}
+			if err := bdrvPread(bs.file, int64(clusterOffset+offsetInCluster), curBuf); err != nil {
+				return err
+			}
+
+		default:
+			return syscall.EIO
+		}
+
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// pwritev writes buf to the guest data at offset.
+// The clusters are allocated if they are not allocated yet or shared with the snapshots,
+// and the rest of the newly allocated clusters are copied from the old data.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_pwritev(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func pwritev(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, flags BdrvRequestFlags) error {
+	s := bs.Opaque
+
+	if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+		err := errors.Wrap(ErrEncrypted, "Writing the encrypted image is not supported")
+		return err
+	}
+
+	for len(buf) > 0 {
+		s.lock.Lock()
+		s.ClusterCacheOffset = ^uint64(0) // disable compressed cache
+
+		if err := checkFenced(bs); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		clusterOffset, n, m, err := allocClusterOffset(ctx, bs, uint64(offset), uint64(len(buf)))
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		offsetInCluster := offsetIntoCluster(s, offset)
+		if err := preWriteOverlapCheck(bs, 0, int64(clusterOffset+offsetInCluster), int64(n)); err != nil {
+			if m != nil {
+				allocClusterAbort(bs, m)
+			}
+			s.lock.Unlock()
+			return err
+		}
+		s.lock.Unlock()
+
+		// the guest data is written without s.lock, the overlapping requests are serialized by
+		// the tracked requests of the block layer until the new clusters are linked
+		if err := bdrvPwrite(bs.file, int64(clusterOffset+offsetInCluster), buf[:n]); err != nil {
+			if m != nil {
+				s.lock.Lock()
+				allocClusterAbort(bs, m)
+				s.lock.Unlock()
+			}
+			return err
+		}
+
+		if m != nil {
+			s.lock.Lock()
+			err := allocClusterLinkL2(ctx, bs, m)
+			if err != nil {
+				allocClusterAbort(bs, m)
+			}
+			s.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// copyRangeFrom copies the guest data of bs at offset to the guest data of dst at dstOff. The normal clusters are
+// copied from the image file, the zero clusters are written as zeros, and the unallocated clusters are copied
+// from the backing file. Returns ENOTSUP for the compressed and the encrypted clusters.
+//  block/qcow2.c: static int coroutine_fn qcow2_co_copy_range_from(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func copyRangeFrom(ctx context.Context, bs *BlockDriverState, offset int64, dst *BlockDriverState, dstOff, bytes int64) error {
+	s := bs.Opaque
+
+	for bytes > 0 {
+		// the mapping is not changed while the tracked read request is in flight, and s.lock is not held
+		// while dst is written, which may be the backing file of bs
+		s.lock.RLock()
+		clusterOffset, n, typ, err := getClusterOffset(ctx, bs, uint64(offset), uint64(bytes))
+		s.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return syscall.EIO
+		}
+
+		switch typ {
+		case CLUSTER_UNALLOCATED:
+			if bs.Backing == nil {
+				err = bdrvCoDoPwriteZeroes(ctx, dst, dstOff, int64(n), 0)
+				break
+			}
+			backing := bs.Backing.bs
+			length, lerr := getlength(backing)
+			if lerr != nil {
+				return lerr
+			}
+			if offset+int64(n) > length || backing.Drv.bdrvCoCopyRangeFrom == nil {
+				// the backing file which is shorter than bs reads as zeros beyond its end
+				return syscall.ENOTSUP
+			}
+			err = backing.Drv.bdrvCoCopyRangeFrom(ctx, backing, offset, dst, dstOff, int64(n))
+
+		case CLUSTER_ZERO:
+			err = bdrvCoDoPwriteZeroes(ctx, dst, dstOff, int64(n), 0)
+
+		case CLUSTER_NORMAL:
+			if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+				return syscall.ENOTSUP
+			}
+			err = bdrvCoCopyRangeTo(ctx, bs.file, int64(clusterOffset+offsetIntoCluster(s, offset)), dst, dstOff, int64(n))
+
+		default:
+			return syscall.ENOTSUP
+		}
+		if err != nil {
+			return err
+		}
+
+		bytes -= int64(n)
+		offset += int64(n)
+		dstOff += int64(n)
+	}
+
+	return nil
+}
+
+// copyRangeTo copies the range of the src image file at srcOff to the guest data of bs at offset. The clusters
+// are allocated same as pwritev, and the data is copied to them instead of written.
+//  block/qcow2.c: static int coroutine_fn qcow2_co_copy_range_to(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func copyRangeTo(ctx context.Context, src *BdrvChild, srcOff int64, bs *BlockDriverState, offset, bytes int64) error {
+	s := bs.Opaque
+
+	if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+		return syscall.ENOTSUP
+	}
+
+	for bytes > 0 {
+		s.lock.Lock()
+		s.ClusterCacheOffset = ^uint64(0) // disable compressed cache
+
+		if err := checkFenced(bs); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		clusterOffset, n, m, err := allocClusterOffset(ctx, bs, uint64(offset), uint64(bytes))
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		offsetInCluster := offsetIntoCluster(s, offset)
+		if err := preWriteOverlapCheck(bs, 0, int64(clusterOffset+offsetInCluster), int64(n)); err != nil {
+			if m != nil {
+				allocClusterAbort(bs, m)
+			}
+			s.lock.Unlock()
+			return err
+		}
+		s.lock.Unlock()
+
+		if err := bdrvCopyRange(src, srcOff, bs.file, int64(clusterOffset+offsetInCluster), int64(n)); err != nil {
+			if m != nil {
+				s.lock.Lock()
+				allocClusterAbort(bs, m)
+				s.lock.Unlock()
+			}
+			return err
+		}
+
+		if m != nil {
+			s.lock.Lock()
+			err := allocClusterLinkL2(ctx, bs, m)
+			if err != nil {
+				allocClusterAbort(bs, m)
+			}
+			s.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		bytes -= int64(n)
+		offset += int64(n)
+		srcOff += int64(n)
+	}
+
+	return nil
+}
+
+// compressWindowSize the size of the window of the deflate stream of the compressed cluster.
+// qemu inflates the compressed clusters with the 4k window (windowBits -12), so the back references of the
+// deflate stream must not go further.
+const compressWindowSize = 1 << 12
+
+// compressBuffer compresses src to dest by the raw deflate stream of level, and returns the compressed size.
+// Returns ENOMEM if the compressed data does not fit in dest.
+//  block/qcow2.c: static ssize_t qcow2_compress(void *dest, size_t dest_size, const void *src, size_t src_size)
+func compressBuffer(dest, src []byte, level int) (int, error) {
+	var out bytes.Buffer
+	zw, err := flate.NewWriter(&out, level)
+	if err != nil {
+		return 0, err
+	}
+
+	// Go's deflate has the 32k window, so each chunk of the window size is compressed by the reset writer
+	// into the non-final blocks, which never refer back to the previous chunks
+	for off := 0; off < len(src); off += compressWindowSize {
+		end := off + compressWindowSize
+		if end > len(src) {
+			end = len(src)
+		}
+
+		zw.Reset(&out)
+		if _, err := zw.Write(src[off:end]); err != nil {
+			return 0, err
+		}
+		if end < len(src) {
+			err = zw.Flush()
+		} else {
+			err = zw.Close()
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if out.Len() > len(dest) {
+			return 0, syscall.ENOMEM
+		}
+	}
+
+	return copy(dest, out.Bytes()), nil
+}
+
+// pwriteCompressed writes buf to the guest data at offset as the compressed clusters.
+// offset must be aligned to the cluster, and buf must be the whole clusters, except the last cluster of the image
+// which is padded with zeros. The clusters must not be allocated yet. The cluster which is not compressible is
+// written as the normal cluster.
+//
+// The clusters of buf are compressed concurrently by up to Compression.Workers goroutines, and then allocated and
+// written in the order of the guest offset, so the compressed clusters are packed in the image file same as they
+// are compressed one by one.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_pwritev_compressed(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov)
+func pwriteCompressed(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	s := bs.Opaque
+
+	if s.CryptMethodHeader != uint32(CRYPT_NONE) {
+		err := errors.Wrap(ErrEncrypted, "Writing the encrypted image is not supported")
+		return err
+	}
+	if offsetIntoCluster(s, offset) != 0 {
+		return syscall.EINVAL
+	}
+
+	size, err := getlength(bs)
+	if err != nil {
+		return err
+	}
+
+	clusterSize := int64(s.ClusterSize)
+	nbClusters := int((int64(len(buf)) + clusterSize - 1) / clusterSize)
+	if tail := int64(len(buf)) % clusterSize; tail != 0 && offset+int64(len(buf)) != size {
+		return syscall.EINVAL
+	}
+
+	// outs holds the compressed clusters, which is nil if the cluster is not compressible
+	outs := make([][]byte, nbClusters)
+	defer func() {
+		for _, out := range outs {
+			if out != nil {
+				bufPoolPut(out)
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		next     int64
+		errMu    sync.Mutex
+		compErr  error
+		nbWorker = s.Compression.workers()
+		level    = s.Compression.level()
+	)
+	if nbWorker > nbClusters {
+		nbWorker = nbClusters
+	}
+	for w := 0; w < nbWorker; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			clusterBuf := bufPoolGet(0, int(clusterSize))
+			defer bufPoolPut(clusterBuf)
+
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= nbClusters {
+					return
+				}
+
+				// Zero-pad last write if image size is not cluster aligned
+				src := buf[int64(i)*clusterSize:]
+				if int64(len(src)) > clusterSize {
+					src = src[:clusterSize]
+				}
+				if int64(len(src)) < clusterSize {
+					n := copy(clusterBuf, src)
+					for j := n; j < len(clusterBuf); j++ {
+						clusterBuf[j] = 0
+					}
+					src = clusterBuf
+				}
+
+				outBuf := bufPoolGet(0, int(clusterSize-1))
+				outLen, err := compressBuffer(outBuf, src, level)
+				if err != nil {
+					bufPoolPut(outBuf)
+					if !errors.Is(err, syscall.ENOMEM) {
+						errMu.Lock()
+						compErr = syscall.EINVAL
+						errMu.Unlock()
+					}
+					continue
+				}
+				outs[i] = outBuf[:outLen]
+			}
+		}()
+	}
+	wg.Wait()
+	if compErr != nil {
+		return compErr
+	}
+
+	for i, out := range outs {
+		n := clusterSize
+		if int64(len(buf)) < n {
+			n = int64(len(buf))
+		}
+
+		if out == nil {
+			// could not compress: write normal cluster
+			if err := pwritev(ctx, bs, offset, buf[:n], 0); err != nil {
+				return err
+			}
+			buf = buf[n:]
+			offset += n
+			continue
+		}
+
+		s.lock.Lock()
+		s.ClusterCacheOffset = ^uint64(0) // disable compressed cache
+
+		if err := checkFenced(bs); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		clusterOffset, err := allocCompressedClusterOffset(ctx, bs, uint64(offset), len(out))
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+
+		err = preWriteOverlapCheck(bs, 0, int64(clusterOffset), int64(len(out)))
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if err := bdrvPwrite(bs.file, int64(clusterOffset), out); err != nil {
+			return err
+		}
+
+		bufPoolPut(out)
+		outs[i] = nil
+		buf = buf[n:]
+		offset += n
+	}
+
+	return nil
+}
+
+// isZero reports whether the bytes of the guest data at offset reads as zeros.
+// The range beyond the end of the image reads as zeros.
+//  block/qcow2.c: static bool is_zero_sectors(BlockDriverState *bs, int64_t start, uint32_t count)
+func isZero(bs *BlockDriverState, offset, bytes int64) (bool, error) {
+	size, err := getlength(bs)
+	if err != nil {
+		return false, err
+	}
+	if offset+bytes > size {
+		bytes = size - offset
+	}
+	if bytes <= 0 {
+		return true, nil
+	}
+
+	status, n, _, _, err := bdrvBlockStatusAbove(bs, offset, bytes)
+	if err != nil {
+		return false, err
+	}
+
+	return status&BDRV_BLOCK_ZERO != 0 && n == bytes, nil
+}
+
+// pwriteZeroes marks the clusters from offset to offset+count as the zero clusters.
+// The partial cluster is marked only if the rest of the cluster already reads as zeros.
+// Returns ENOTSUP if the range can not be the zero clusters, then the block layer writes zeros instead.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_pwrite_zeroes(BlockDriverState *bs, int64_t offset, int count, BdrvRequestFlags flags)
+func pwriteZeroes(ctx context.Context, bs *BlockDriverState, offset, count int64, flags BdrvRequestFlags) error {
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+
+	head := offset % clusterSize
+	tail := (offset + count) % clusterSize
+
+	if head != 0 || tail != 0 {
+		clStart := offset - head
+
+		// check whether remainder of cluster already reads as zero
+		headZero, err := isZero(bs, clStart, head)
+		if err != nil {
+			return err
+		}
+		tailZero, err := isZero(bs, offset+count, -tail&(clusterSize-1))
+		if err != nil {
+			return err
+		}
+		if !headZero || !tailZero {
+			return syscall.ENOTSUP
+		}
+
+		offset = clStart
+		count = clusterSize
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	if head != 0 || tail != 0 {
+		// the cluster may be allocated after the check of isZero
+		_, _, typ, err := getClusterOffset(ctx, bs, uint64(offset), uint64(count))
+		if err != nil {
+			return err
+		}
+		if typ != CLUSTER_UNALLOCATED && typ != CLUSTER_ZERO {
+			return syscall.ENOTSUP
+		}
+	}
+
+	// Whatever is left can use real zero clusters
+	return zeroClusters(ctx, bs, uint64(offset), uint64(count), flags)
+}
+
+// pdiscard discards the clusters from offset to offset+count.
+// The discarded clusters read as zeros for the compat=1.1 image, and fall through to the backing file for
+// the compat=0.10 image. Returns ENOTSUP for the partial clusters, except the last partial cluster of the image.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_pdiscard(BlockDriverState *bs, int64_t offset, int count)
+func pdiscard(ctx context.Context, bs *BlockDriverState, offset, count int64) error {
+	s := bs.Opaque
+
+	if (offset|count)&(int64(s.ClusterSize)-1) != 0 {
+		// Ignore partial clusters, except for the special case of the
+		// complete partial cluster at the end of an unaligned file
+		if offsetIntoCluster(s, offset) != 0 || offset+count != bs.TotalSectors*int64(BDRV_SECTOR_SIZE) {
+			return syscall.ENOTSUP
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	return discardClusters(ctx, bs, uint64(offset), uint64(count), DISCARD_REQUEST, false)
+}
+
+// flushToOS writes the dirty metadata cached in memory to the image file.
+//  block/qcow2.c: static coroutine_fn int qcow2_co_flush_to_os(BlockDriverState *bs)
+func flushToOS(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the cached tables of the corrupt image are dropped, same as qemu which makes the image unusable
+	if s.fenced {
+		return nil
+	}
+
+	return writeCaches(bs)
+}
+
+// markCorrupt marks the image as corrupt, and writes the header to the disk.
+//  block/qcow2.c: int qcow2_mark_corrupt(BlockDriverState *bs)
+func markCorrupt(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	s.IncompatibleFeatures |= INCOMPAT_CORRUPT
+	if err := updateHeader(bs); err != nil {
+		return err
+	}
+
+	return bdrvFlush(bs.file)
+}
+
+// markClean clears the dirty bit of the image, and writes the header to the disk.
+//  block/qcow2.c: static int qcow2_mark_clean(BlockDriverState *bs)
+func markClean(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	if s.IncompatibleFeatures&INCOMPAT_DIRTY == 0 {
+		return nil
+	}
+
+	if err := bdrvFlush(bs.file); err != nil {
+		return err
+	}
+
+	s.IncompatibleFeatures &^= INCOMPAT_DIRTY
+	return updateHeader(bs)
+}
+
+// markConsistent clears the corrupt bit of the image, and writes the header to the disk.
+// The writes to the image are not fenced any more.
+//  block/qcow2.c: int qcow2_mark_consistent(BlockDriverState *bs)
+func markConsistent(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	if s.IncompatibleFeatures&INCOMPAT_CORRUPT != 0 {
+		if err := bdrvFlush(bs.file); err != nil {
+			return err
+		}
+
+		s.IncompatibleFeatures &^= INCOMPAT_CORRUPT
+		if err := updateHeader(bs); err != nil {
+			return err
+		}
+	}
+
+	s.corruptLock.Lock()
+	s.fenced = false
+	s.SignaledCorruption = false
+	s.corruptLock.Unlock()
+
+	return nil
+}
+
+// check checks the consistency of the metadata of the image, and repairs the inconsistencies by the fix mode.
+// If the image is consistent after the repair, the dirty bit and the corrupt bit are cleared.
+//  block/qcow2.c: static int qcow2_check(BlockDriverState *bs, BdrvCheckResult *result, BdrvCheckMode fix)
+func check(ctx context.Context, bs *BlockDriverState, res *BdrvCheckResult, fix CheckMode) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the tables are read from the image file
+	if !s.fenced {
+		if err := writeCaches(bs); err != nil {
+			res.CheckErrors++
+			return err
+		}
+	}
+
+	if err := checkRefcounts(ctx, bs, res, fix); err != nil {
+		return err
+	}
+
+	if fix != 0 {
+		if err := writeCaches(bs); err != nil {
+			res.CheckErrors++
+			return err
+		}
+
+		if res.CheckErrors == 0 && res.Corruptions == 0 {
+			if err := markClean(bs); err != nil {
+				return err
+			}
+			return markConsistent(bs)
+		}
+	}
+
+	return nil
+}
+
+// checkFenced returns ErrCorrupt if the writes to the image are fenced by the fatal corruption.
+// The caller must hold s.lock.
+func checkFenced(bs *BlockDriverState) error {
+	if bs.Opaque.fenced {
+		err := errors.Wrap(ErrCorrupt, "qcow2: Image is corrupt; cannot be written")
+		return err
+	}
+
+	return nil
+}
+
+// writeCaches writes the dirty tables of the L2 table cache and the refcount block cache to the image file.
+// The refcount blocks are always written, because the lazy refcounts are not supported yet.
+//  block/qcow2.c: int qcow2_write_caches(BlockDriverState *bs)
+func writeCaches(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	if s.L2TableCache == nil {
+		return nil
+	}
+
+	if err := cacheWrite(bs, s.L2TableCache); err != nil {
+		return err
+	}
+
+	return cacheWrite(bs, s.RefcountBlockCache)
+}
+
+// inactivate writes the dirty tables in the caches to the image file, and clears the dirty bit if they are written,
+// so that the image is consistent without the repair when it is opened again.
+//  block/qcow2.c: static int qcow2_inactivate(BlockDriverState *bs)
+func inactivate(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if bs.ReadOnly || s.fenced {
+		return nil
+	}
+
+	if err := writeCaches(bs); err != nil {
+		err = errors.Wrap(err, "Failed to flush the metadata caches")
+		return err
+	}
+
+	return markClean(bs)
+}
+
+// qcow2Close releases the tables and the caches of the qcow2 image.
+//  block/qcow2.c: static void qcow2_close(BlockDriverState *bs)
+func qcow2Close(bs *BlockDriverState) {
+	s := bs.Opaque
+
+	cacheCleanTimerDel(bs)
+
+	s.L1Table = nil
+	s.L2TableCache = nil
+	s.RefcountBlockCache = nil
+	s.RefcountTable = nil
+	s.ClusterCache = nil
+	s.ClusterData = nil
+	s.ClusterCacheOffset = ^uint64(0)
+}
+
+// refreshLimits sets the request alignments of the qcow2 image to the cluster size.
+//  block/qcow2.c: static void qcow2_refresh_limits(BlockDriverState *bs, Error **errp)
+func refreshLimits(bs *BlockDriverState) {
+	s := bs.Opaque
+
+	bs.BL.PwriteZeroesAlignment = uint32(s.ClusterSize)
+	bs.BL.PdiscardAlignment = uint32(s.ClusterSize)
+}
+
 // ---------------------------------------------------------------------------
 // block/qcow2.h static inline functions
 
@@ -928,8 +2720,9 @@ func sizeToClusters(s *BDRVState, size uint64) uint64 {
 // sizeToL1 return the L1 size.
 //  static inline int64_t size_to_l1(BDRVQcow2State *s, int64_t size)
 func sizeToL1(s *BDRVState, size int64) int64 {
-	shift := s.ClusterBits + s.L2Bits
-	return (size + (1 << uint(shift)) - 1) >> uint(shift)
+	shift := uint(s.ClusterBits + s.L2Bits)
+	// evaluate in uint64 to not overflow with the size near INT64_MAX
+	return int64((uint64(size) + (1 << shift) - 1) >> shift)
 }
 
 // offsetToL2Index return the L2 index offset.
@@ -941,14 +2734,14 @@ func offsetToL2Index(s *BDRVState, offset int64) int {
 // alignOffset return the aligned offset size.
 //  static inline int64_t align_offset(int64_t offset, int n)
 func alignOffset(offset int64, n int) int64 {
-	offset = offset + int64(n) - 1 & ^(int64(n)-1)
+	offset = (offset + int64(n) - 1) &^ (int64(n) - 1)
 	return offset
 }
 
 // vmStateOffset return the offset of vm state.
 //  static inline int64_t qcow2_vm_state_offset(BDRVQcow2State *s)
 func vmStateOffset(s *BDRVState) int64 {
-	return int64(s.L1VmStateIndex << uint(s.ClusterBits+s.L2Bits))
+	return int64(s.L1VmStateIndex) << uint(s.ClusterBits+s.L2Bits)
 }
 
 // maxRefcountClusters return the maximum size of refcount clusters.
@@ -959,16 +2752,16 @@ func maxRefcountClusters(s *BDRVState) uint64 {
 
 // getClusterType return the type of cluster.
 //  static inline int qcow2_get_cluster_type(uint64_t l2_entry)
-func getClusterType(l2Entry uint64) int {
-	switch l2Entry {
-	case OFLAG_COMPRESSED:
-		return int(CLUSTER_COMPRESSED)
-	case OFLAG_ZERO:
-		return int(CLUSTER_ZERO)
-	case L2E_OFFSET_MASK:
-		return int(CLUSTER_UNALLOCATED)
+func getClusterType(l2Entry uint64) CLUSTER {
+	switch {
+	case l2Entry&OFLAG_COMPRESSED != 0:
+		return CLUSTER_COMPRESSED
+	case l2Entry&OFLAG_ZERO != 0:
+		return CLUSTER_ZERO
+	case l2Entry&L2E_OFFSET_MASK == 0:
+		return CLUSTER_UNALLOCATED
 	default:
-		return int(CLUSTER_NORMAL)
+		return CLUSTER_NORMAL
 	}
 }
 
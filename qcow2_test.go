@@ -0,0 +1,335 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fourGiB the offset above which the metadata offsets do not fit in uint32.
+const fourGiB = 4 << 30
+
+// TestMetadataAbove4GiB makes the allocator skip the first 4 GiB of the image file, so the clusters allocated after
+// that, such as the L2 tables, the refcount blocks, the snapshot table and the copied-on-write clusters, lie above
+// 4 GiB. The skipped clusters are a hole of the sparse image file, so the test takes little space on the disk.
+func TestMetadataAbove4GiB(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "large.qcow2")
+	img, err := CreateImage(filename, 5<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	s := img.blk.bs().Opaque
+	s.FreeClusterIndex = fourGiB >> uint(s.ClusterBits)
+
+	data := bytes.Repeat([]byte("before"), 1024)
+	off := int64(4<<30 + 12345)
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	after := bytes.Repeat([]byte("after!"), 1024)
+	if _, err := img.WriteAt(after, off); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.SnapshotsOffset < fourGiB {
+		t.Fatalf("snapshot table at %#x, want above 4 GiB", s.SnapshotsOffset)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFile(filename, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	buf := make([]byte, len(after))
+	if _, err := reopened.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, after) {
+		t.Fatal("the data written above 4 GiB is not read back")
+	}
+
+	check, err := reopened.Check(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Corruptions != 0 || check.Leaks != 0 || check.CheckErrors != 0 {
+		t.Fatalf("check: %+v", check)
+	}
+	if check.ImageEndOffset < fourGiB {
+		t.Fatalf("image end offset %#x, want above 4 GiB", check.ImageEndOffset)
+	}
+
+	if err := reopened.ApplySnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("the snapshot data above 4 GiB is not read back")
+	}
+}
+
+// patchHeader creates the image, and overwrites the header at off with v, which is a uint32 or a uint64.
+func patchHeader(t *testing.T, off int64, v interface{}) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "patched.qcow2")
+	img, err := CreateImage(filename, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(buf.Bytes(), off); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestOpenTooLarge(t *testing.T) {
+	tests := []struct {
+		name string
+		off  int64
+		v    interface{}
+	}{
+		{name: "size", off: 24, v: uint64(1 << 63)},
+		{name: "l1 size", off: 36, v: uint32(MAX_L1_SIZE/UINT64_SIZE + 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := patchHeader(t, tt.off, tt.v)
+			img, err := OpenFile(filename, os.O_RDONLY)
+			if err == nil {
+				img.Close()
+				t.Fatal("open succeeded")
+			}
+			if !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("got %v, want ErrTooLarge", err)
+			}
+			if !errors.Is(err, syscall.EFBIG) {
+				t.Fatalf("got %v, want EFBIG", err)
+			}
+		})
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "junk.qcow2")
+	if err := os.WriteFile(garbage, bytes.Repeat([]byte{0xff}, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(garbage, os.O_RDONLY); !errors.Is(err, ErrNotQcow2) || !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("open of the non-qcow2 file: got %v, want ErrNotQcow2", err)
+	}
+
+	loop := filepath.Join(dir, "loop.qcow2")
+	img, err := CreateImage(loop, 1<<20, WithBackingFile(garbage, DriverRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	patchBacking(t, loop, loop)
+	if _, err := OpenFile(loop, os.O_RDONLY); !errors.Is(err, ErrBackingLoop) || !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("open of the image backed by itself: got %v, want ErrBackingLoop", err)
+	}
+
+	if _, err := OpenFileOpts(garbage, DriverRaw, os.O_RDWR, &OpenOpts{Force: true}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("force-share of the read-write open: got %v, want ErrInvalidOption", err)
+	}
+	if _, err := OpenFileFormat(garbage, DriverFmt("nosuchformat"), os.O_RDONLY); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("open with the unknown driver: got %v, want ErrUnknownFormat", err)
+	}
+}
+
+// patchBacking overwrites the backing file name of the qcow2 image filename with backing, which must be as long
+// as the current name.
+func patchBacking(t *testing.T, filename, backing string) {
+	t.Helper()
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var hdr struct {
+		Magic, Version uint32
+		Offset         uint64
+		Size           uint32
+	}
+	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if int(hdr.Size) != len(backing) {
+		t.Fatalf("backing file name is %d bytes, want %d", hdr.Size, len(backing))
+	}
+	if _, err := f.WriteAt([]byte(backing), int64(hdr.Offset)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenDirtyReadOnly(t *testing.T) {
+	filename := patchHeader(t, 72, uint64(INCOMPAT_DIRTY))
+
+	if _, err := OpenFile(filename, os.O_RDONLY); !errors.Is(err, ErrDirty) {
+		t.Fatalf("read-only open of the dirty image: got %v, want ErrDirty", err)
+	}
+
+	img, err := OpenFileOpts(filename, DriverQCow2, os.O_RDONLY, &OpenOpts{Repair: true})
+	if err != nil {
+		t.Fatalf("read-only open of the dirty image with Repair: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = OpenFile(filename, os.O_RDWR)
+	if err != nil {
+		t.Fatalf("read-write open of the dirty image: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err = OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("read-only open of the repaired image: %v", err)
+	}
+	img.Close()
+}
+
+// TestCreateReplace creates the image over the existing image file through the symbolic link and the hard link,
+// which must be kept.
+func TestCreateReplace(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.qcow2")
+	link := filepath.Join(dir, "link.qcow2")
+	hard := filepath.Join(dir, "hard.qcow2")
+
+	create := func(filename string, size int64) {
+		t.Helper()
+		img, err := CreateImage(filename, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := img.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func(filename string) int64 {
+		t.Helper()
+		img, err := OpenFile(filename, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		n, err := img.VirtualSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	create(target, 1<<20)
+	if err := os.Symlink("target.qcow2", link); err != nil {
+		t.Skip(err)
+	}
+	create(link, 2<<20)
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("symbolic link is replaced: %v", err)
+	}
+	if n := size(target); n != 2<<20 {
+		t.Errorf("the target of the symbolic link has size %d, want %d", n, 2<<20)
+	}
+
+	if err := os.Link(target, hard); err != nil {
+		t.Skip(err)
+	}
+	create(hard, 3<<20)
+	if n := size(target); n != 3<<20 {
+		t.Errorf("the other hard link has size %d, want %d", n, 3<<20)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, ".*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temporary files are left: %v", matches)
+	}
+}
+
+// TestCreateExclusive creates the image only if the file does not exist, and the existing file and the dangling
+// symbolic link are kept.
+func TestCreateExclusive(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "excl.qcow2")
+	link := filepath.Join(dir, "link.qcow2")
+
+	create := func(filename string, size int64) error {
+		img, err := Create(&Opts{Filename: filename, Fmt: DriverQCow2, Size: size, Exclusive: true})
+		if err != nil {
+			return err
+		}
+		return img.Close()
+	}
+
+	if err := create(filename, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(filename, 2<<20); !errors.Is(err, os.ErrExist) {
+		t.Errorf("create over the existing file: got %v, want os.ErrExist", err)
+	}
+	img, err := OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := img.VirtualSize()
+	img.Close()
+	if err != nil || n != 1<<20 {
+		t.Errorf("the existing image has size %d, %v, want %d", n, err, 1<<20)
+	}
+
+	if err := os.Symlink("target.qcow2", link); err != nil {
+		t.Skip(err)
+	}
+	if err := create(link, 1<<20); !errors.Is(err, os.ErrExist) {
+		t.Errorf("create over the dangling symbolic link: got %v, want os.ErrExist", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "target.qcow2")); !os.IsNotExist(err) {
+		t.Errorf("the target of the symbolic link is created: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qemuimg cross-verifies the images which go-qcow2 produces with qemu-img.
+//
+// The scenarios create, convert and snapshot the images with go-qcow2, and each produced image is checked by
+// 'qemu-img check' and inspected by 'qemu-img info'. Any error, corruption or leak which qemu-img reports, and
+// any difference between the information of qemu-img and go-qcow2 fails the verification, so the images which
+// go-qcow2 thinks are consistent but qemu would not accept, such as the refcount blocks beyond the end of the
+// image file, are caught.
+//
+// The verification is opt-in: qemu-img is looked up in the $QEMU_IMG environment variable or in the $PATH, and
+// ErrNotFound is returned if it is not installed, so the callers can skip the verification.
+package qemuimg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// ErrNotFound is returned if qemu-img is not installed.
+var ErrNotFound = errors.New("qemu-img is not found")
+
+// the exit codes of 'qemu-img check'.
+//  qemu-img.c: static int img_check(int argc, char **argv)
+const (
+	exitCheckCorrupted = 2
+	exitCheckLeaked    = 3
+)
+
+// Path returns the path of qemu-img, which is $QEMU_IMG if it is set, or qemu-img in the $PATH.
+func Path() (string, error) {
+	name := os.Getenv("QEMU_IMG")
+	if name == "" {
+		name = "qemu-img"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+// Available reports whether qemu-img is installed.
+func Available() bool {
+	_, err := Path()
+	return err == nil
+}
+
+// run runs qemu-img with args, and returns its standard output. The error of the exit code which is in ok is
+// ignored, since 'qemu-img check' reports the inconsistencies by the exit code with the output.
+func run(ctx context.Context, ok []int, args ...string) ([]byte, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		for _, code := range ok {
+			if exitErr.ExitCode() == code {
+				return stdout.Bytes(), nil
+			}
+		}
+		return nil, errors.Errorf("qemu-img %s: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Check checks the qcow2 image of filename by 'qemu-img check', and returns its result. The image must not be
+// opened by go-qcow2, since qemu-img locks the image.
+func Check(ctx context.Context, filename string) (*qcow2.ImageCheck, error) {
+	out, err := run(ctx, []int{exitCheckCorrupted, exitCheckLeaked}, "check", "--output=json", "-f", string(qcow2.DriverQCow2), filename)
+	if err != nil {
+		return nil, err
+	}
+
+	check := new(qcow2.ImageCheck)
+	if err := json.Unmarshal(out, check); err != nil {
+		return nil, errors.Wrap(err, "Could not parse the output of qemu-img check")
+	}
+	return check, nil
+}
+
+// Info inspects the qcow2 image of filename by 'qemu-img info', and returns its information. The backing chain
+// is not inspected.
+func Info(ctx context.Context, filename string) (*qcow2.ImageInfo, error) {
+	out, err := run(ctx, nil, "info", "--output=json", "-f", string(qcow2.DriverQCow2), filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(qcow2.ImageInfo)
+	if err := json.Unmarshal(out, info); err != nil {
+		return nil, errors.Wrap(err, "Could not parse the output of qemu-img info")
+	}
+	return info, nil
+}
+
+// Verify checks and inspects the qcow2 image of filename by qemu-img and by go-qcow2, and returns the error if
+// qemu-img reports any error, corruption or leak, or if the information of the image differs.
+func Verify(ctx context.Context, filename string) error {
+	check, err := Check(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if check.CheckErrors > 0 || check.Corruptions > 0 || check.Leaks > 0 {
+		return errors.Errorf("%s: qemu-img check reports %d errors, %d corruptions and %d leaks",
+			filename, check.CheckErrors, check.Corruptions, check.Leaks)
+	}
+
+	want, err := Info(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	img, err := qcow2.OpenFileOpts(filename, qcow2.DriverQCow2, os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not open '%s'", filename)
+	}
+	defer img.Close()
+
+	got, err := img.Info()
+	if err != nil {
+		return err
+	}
+	if err := compareInfo(got, want); err != nil {
+		return errors.Wrap(err, filename)
+	}
+
+	return nil
+}
+
+// compareInfo returns the error if the information got of go-qcow2 differs from want of qemu-img.
+func compareInfo(got, want *qcow2.ImageInfo) error {
+	switch {
+	case want.DirtyFlag:
+		return errors.New("qemu-img info reports the dirty flag")
+	case got.VirtualSize != want.VirtualSize:
+		return errors.Errorf("virtual size %d, qemu-img reports %d", got.VirtualSize, want.VirtualSize)
+	case got.ClusterSize != want.ClusterSize:
+		return errors.Errorf("cluster size %d, qemu-img reports %d", got.ClusterSize, want.ClusterSize)
+	case got.BackingFilename != want.BackingFilename:
+		return errors.Errorf("backing file '%s', qemu-img reports '%s'", got.BackingFilename, want.BackingFilename)
+	case got.BackingFilenameFormat != want.BackingFilenameFormat:
+		return errors.Errorf("backing format '%s', qemu-img reports '%s'", got.BackingFilenameFormat, want.BackingFilenameFormat)
+	}
+
+	gotSpec, wantSpec := got.FormatSpecific, want.FormatSpecific
+	if gotSpec == nil || gotSpec.Data == nil || wantSpec == nil || wantSpec.Data == nil {
+		return nil
+	}
+	switch g, w := gotSpec.Data, wantSpec.Data; {
+	case w.Corrupt != nil && *w.Corrupt:
+		return errors.New("qemu-img info reports the corrupt flag")
+	case g.Compat != w.Compat:
+		return errors.Errorf("compat %s, qemu-img reports %s", g.Compat, w.Compat)
+	case g.RefcountBits != w.RefcountBits:
+		return errors.Errorf("refcount bits %d, qemu-img reports %d", g.RefcountBits, w.RefcountBits)
+	case g.ExtendedL2 != w.ExtendedL2:
+		return errors.Errorf("extended L2 %t, qemu-img reports %t", g.ExtendedL2, w.ExtendedL2)
+	}
+
+	return nil
+}
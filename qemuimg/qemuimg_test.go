@@ -0,0 +1,31 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build qemuimg
+// +build qemuimg
+
+package qemuimg
+
+import (
+	"context"
+	"testing"
+)
+
+// TestScenarios verifies the images of every scenario with qemu-img, which is run by:
+//
+//  go test -tags qemuimg github.com/zchee/go-qcow2/qemuimg
+func TestScenarios(t *testing.T) {
+	if !Available() {
+		t.Skip(ErrNotFound)
+	}
+
+	for _, sc := range Scenarios() {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			if err := Run(context.Background(), t.TempDir(), sc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemuimg
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// Scenario represents the operations which produce the images to be verified by qemu-img.
+type Scenario struct {
+	// Name the name of the scenario, which is also the prefix of the file names of the images.
+	Name string
+	// Run produces the images in dir, and returns their file names. The images must be closed.
+	Run func(dir string) ([]string, error)
+}
+
+// Run runs the scenario in dir, and verifies each produced image by Verify. The images are removed if all of
+// them are verified, and are kept for the investigation otherwise. It returns ErrNotFound without running the
+// scenario if qemu-img is not installed.
+func Run(ctx context.Context, dir string, sc *Scenario) error {
+	if !Available() {
+		return ErrNotFound
+	}
+
+	filenames, err := sc.Run(dir)
+	if err != nil {
+		return errors.Wrapf(err, "%s: could not produce the images", sc.Name)
+	}
+	for _, filename := range filenames {
+		if err := Verify(ctx, filename); err != nil {
+			return errors.Wrap(err, sc.Name)
+		}
+	}
+	for _, filename := range filenames {
+		os.Remove(filename)
+	}
+
+	return nil
+}
+
+// Scenarios returns the scenarios which cover the creation of the images of the various options, the guest
+// writes, the growth of the refcount table, the internal snapshots, the conversion and the backing files.
+func Scenarios() []*Scenario {
+	return []*Scenario{
+		{Name: "create", Run: runCreate},
+		{Name: "write", Run: runWrite},
+		{Name: "refcount-growth", Run: runRefcountGrowth},
+		{Name: "snapshot", Run: runSnapshot},
+		{Name: "resize", Run: runResize},
+		{Name: "convert", Run: runConvert},
+		{Name: "backing", Run: runBacking},
+	}
+}
+
+// scenarioSize the virtual size of the images of the scenarios.
+const scenarioSize = 64 << 20
+
+// withImage creates the image of name in dir, runs fn on it, and closes it. It returns the file name of the image.
+func withImage(dir, name string, size int64, fn func(img *qcow2.QCow2) error, options ...qcow2.Option) (string, error) {
+	filename := filepath.Join(dir, name+".qcow2")
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	img, err := qcow2.CreateImage(filename, size, options...)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not create '%s'", filename)
+	}
+	if fn != nil {
+		err = fn(img)
+	}
+	if cerr := img.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// writePattern writes the clusters of the different L2 tables, and overwrites them partially.
+func writePattern(img *qcow2.QCow2, clusterSize int) error {
+	data := bytes.Repeat([]byte{0xa5}, 3*clusterSize)
+	for _, off := range []int64{0, 8 << 20, 32 << 20} {
+		if _, err := img.WriteAt(data, off+512); err != nil {
+			return err
+		}
+		if _, err := img.WriteAt(data[:512], off+int64(clusterSize)); err != nil {
+			return err
+		}
+	}
+	return img.Flush()
+}
+
+// runCreate creates the empty and the written images of the cluster sizes, the refcount widths, the versions
+// and the preallocation modes.
+func runCreate(dir string) ([]string, error) {
+	variants := []struct {
+		name    string
+		options []qcow2.Option
+	}{
+		{"create-default", nil},
+		{"create-cluster-512", []qcow2.Option{qcow2.WithClusterSize(512)}},
+		{"create-cluster-2m", []qcow2.Option{qcow2.WithClusterSize(2 << 20)}},
+		{"create-compat-0.10", []qcow2.Option{qcow2.WithCompat("0.10")}},
+		{"create-lazy-refcounts", []qcow2.Option{qcow2.WithLazyRefcounts()}},
+		{"create-refcount-1", []qcow2.Option{qcow2.WithRefcountBits(1)}},
+		{"create-refcount-64", []qcow2.Option{qcow2.WithRefcountBits(64)}},
+		{"create-prealloc-metadata", []qcow2.Option{qcow2.WithPrealloc(qcow2.PREALLOC_MODE_METADATA)}},
+	}
+
+	var filenames []string
+	for _, v := range variants {
+		filename, err := withImage(dir, v.name, scenarioSize, nil, v.options...)
+		if err != nil {
+			return filenames, err
+		}
+		filenames = append(filenames, filename)
+
+		filename, err = withImage(dir, v.name+"-written", scenarioSize, func(img *qcow2.QCow2) error {
+			info, err := img.Info()
+			if err != nil {
+				return err
+			}
+			return writePattern(img, info.ClusterSize)
+		}, v.options...)
+		if err != nil {
+			return filenames, err
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, nil
+}
+
+// runWrite writes the clusters, and zeroes and discards them.
+func runWrite(dir string) ([]string, error) {
+	const clusterSize = 4096
+
+	filename, err := withImage(dir, "write", scenarioSize, func(img *qcow2.QCow2) error {
+		if err := writePattern(img, clusterSize); err != nil {
+			return err
+		}
+		if err := img.WriteZeroes(8<<20, 2*clusterSize); err != nil {
+			return err
+		}
+		if err := img.Discard(32<<20, 2*clusterSize); err != nil {
+			return err
+		}
+		return img.Flush()
+	}, qcow2.WithClusterSize(clusterSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{filename}, nil
+}
+
+// runRefcountGrowth fills the image of the small clusters, so that the refcount blocks and the refcount table
+// are allocated beyond the end of the image file, and the refcount table is grown more than once.
+func runRefcountGrowth(dir string) ([]string, error) {
+	const clusterSize = 512
+
+	filename, err := withImage(dir, "refcount-growth", scenarioSize, func(img *qcow2.QCow2) error {
+		data := bytes.Repeat([]byte{0x3c}, 1<<20)
+		for off := int64(0); off < scenarioSize; off += int64(len(data)) {
+			if _, err := img.WriteAt(data, off); err != nil {
+				return err
+			}
+		}
+		return img.Flush()
+	}, qcow2.WithClusterSize(clusterSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{filename}, nil
+}
+
+// runSnapshot creates the snapshots, overwrites the clusters shared with them, reverts the image to one of them,
+// and deletes the other, so that the image keeps one snapshot.
+func runSnapshot(dir string) ([]string, error) {
+	const clusterSize = 4096
+
+	filename, err := withImage(dir, "snapshot", scenarioSize, func(img *qcow2.QCow2) error {
+		if err := writePattern(img, clusterSize); err != nil {
+			return err
+		}
+		first, err := img.CreateSnapshot("first")
+		if err != nil {
+			return err
+		}
+		data := bytes.Repeat([]byte{0x5a}, 2*clusterSize)
+		if _, err := img.WriteAt(data, 1024); err != nil {
+			return err
+		}
+		second, err := img.CreateSnapshot("second")
+		if err != nil {
+			return err
+		}
+		if _, err := img.WriteAt(data, 8<<20); err != nil {
+			return err
+		}
+		if err := img.ApplySnapshot(first.ID); err != nil {
+			return err
+		}
+		return img.DeleteSnapshot(second.ID)
+	}, qcow2.WithClusterSize(clusterSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{filename}, nil
+}
+
+// runResize grows the written image, and writes to the grown range.
+func runResize(dir string) ([]string, error) {
+	const clusterSize = 4096
+
+	filename, err := withImage(dir, "resize", scenarioSize, func(img *qcow2.QCow2) error {
+		if err := writePattern(img, clusterSize); err != nil {
+			return err
+		}
+		if err := img.Resize(4 * scenarioSize); err != nil {
+			return err
+		}
+		data := bytes.Repeat([]byte{0x96}, 2*clusterSize)
+		if _, err := img.WriteAt(data, 3*scenarioSize); err != nil {
+			return err
+		}
+		return img.Flush()
+	}, qcow2.WithClusterSize(clusterSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{filename}, nil
+}
+
+// runConvert converts the written image to the uncompressed and the compressed images.
+func runConvert(dir string) ([]string, error) {
+	source, err := withImage(dir, "convert-source", scenarioSize, func(img *qcow2.QCow2) error {
+		return writePattern(img, 65536)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := qcow2.OpenFileFormat(source, qcow2.DriverQCow2, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	filenames := []string{source}
+	for _, compress := range []bool{false, true} {
+		filename := filepath.Join(dir, "convert.qcow2")
+		if compress {
+			filename = filepath.Join(dir, "convert-compressed.qcow2")
+		}
+		os.Remove(filename)
+
+		opts := &qcow2.Opts{
+			Filename: filename,
+			Fmt:      qcow2.DriverQCow2,
+			Size:     scenarioSize,
+		}
+		if err := qcow2.Convert(img, opts, &qcow2.ConvertOpts{Compress: compress}); err != nil {
+			return filenames, errors.Wrapf(err, "Could not convert to '%s'", filename)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, nil
+}
+
+// runBacking creates the overlay on top of the written image, and writes to the overlay.
+func runBacking(dir string) ([]string, error) {
+	base, err := withImage(dir, "backing-base", scenarioSize, func(img *qcow2.QCow2) error {
+		return writePattern(img, 65536)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	overlay, err := withImage(dir, "backing-overlay", scenarioSize, func(img *qcow2.QCow2) error {
+		data := bytes.Repeat([]byte{0x69}, 4096)
+		if _, err := img.WriteAt(data, 8<<20+512); err != nil {
+			return err
+		}
+		return img.Flush()
+	}, qcow2.WithBackingFile(filepath.Base(base), qcow2.DriverQCow2))
+	if err != nil {
+		return []string{base}, err
+	}
+
+	return []string{base, overlay}, nil
+}
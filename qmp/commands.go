@@ -0,0 +1,332 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/internal/confine"
+)
+
+// commandFunc executes the command with the JSON object of its arguments, and returns the result, which is nil
+// if the command has no result. The caller must hold m.mu.
+type commandFunc func(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error)
+
+// commands the supported commands by their names.
+var commands map[string]commandFunc
+
+func init() {
+	commands = map[string]commandFunc{
+		"qmp_capabilities":                       nil,
+		"query-commands":                         queryCommands,
+		"query-block":                            queryBlock,
+		"blockdev-add":                           blockdevAdd,
+		"blockdev-del":                           blockdevDel,
+		"block_resize":                           blockResize,
+		"blockdev-snapshot-internal-sync":        blockdevSnapshotInternalSync,
+		"blockdev-snapshot-delete-internal-sync": blockdevSnapshotDeleteInternalSync,
+	}
+}
+
+// CommandInfo the information of the command of query-commands.
+//  qapi/control.json: { 'struct': 'CommandInfo' }
+type CommandInfo struct {
+	Name string `json:"name"`
+}
+
+// queryCommands returns the supported commands.
+//  monitor/qmp-cmds-control.c: CommandInfoList *qmp_query_commands(Error **errp)
+func queryCommands(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	if err := decodeArguments(args, &struct{}{}); err != nil {
+		return nil, err
+	}
+
+	infos := make([]CommandInfo, 0, len(commands))
+	for name := range commands {
+		infos = append(infos, CommandInfo{Name: name})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// BlockInfo the information of the node of query-block.
+//  qapi/block-core.json: { 'struct': 'BlockInfo' }
+type BlockInfo struct {
+	Device    string           `json:"device"`
+	Locked    bool             `json:"locked"`
+	Removable bool             `json:"removable"`
+	Inserted  *BlockDeviceInfo `json:"inserted,omitempty"`
+}
+
+// BlockDeviceInfo the information of the image of the node.
+//  qapi/block-core.json: { 'struct': 'BlockDeviceInfo' }
+type BlockDeviceInfo struct {
+	File        string           `json:"file"`
+	NodeName    string           `json:"node-name"`
+	RO          bool             `json:"ro"`
+	Drv         qcow2.DriverFmt  `json:"drv"`
+	BackingFile string           `json:"backing_file,omitempty"`
+	Encrypted   bool             `json:"encrypted"`
+	Image       *qcow2.ImageInfo `json:"image"`
+}
+
+// queryBlock returns the information of the nodes in the order of their names.
+//  block/qapi.c: BlockInfoList *qmp_query_block(Error **errp)
+func queryBlock(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	if err := decodeArguments(args, &struct{}{}); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(m.nodes))
+	for name := range m.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]BlockInfo, 0, len(names))
+	for _, name := range names {
+		img := m.nodes[name].img
+		info, err := img.Info()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not query the node '%s'", name)
+		}
+		infos = append(infos, BlockInfo{
+			Device: name,
+			Inserted: &BlockDeviceInfo{
+				File:        info.Filename,
+				NodeName:    name,
+				RO:          img.ReadOnly(),
+				Drv:         info.Format,
+				BackingFile: info.BackingFilename,
+				Encrypted:   info.Encrypted,
+				Image:       info,
+			},
+		})
+	}
+	return infos, nil
+}
+
+// BlockdevOptions the arguments of blockdev-add.
+//  qapi/block-core.json: { 'union': 'BlockdevOptions' }
+type BlockdevOptions struct {
+	// Driver the format of the image, which must be "qcow2".
+	Driver string `json:"driver"`
+	// NodeName the name of the new node.
+	NodeName string `json:"node-name"`
+	// File the protocol layer of the image, whose driver must be "file".
+	File *BlockdevOptionsFile `json:"file"`
+	// ReadOnly opens the image read-only.
+	ReadOnly bool `json:"read-only,omitempty"`
+}
+
+// BlockdevOptionsFile the options of the file protocol.
+//  qapi/block-core.json: { 'struct': 'BlockdevOptionsFile' }
+type BlockdevOptionsFile struct {
+	Driver   string `json:"driver"`
+	Filename string `json:"filename"`
+}
+
+// blockdevAdd opens the image, and adds it as the new node.
+//  blockdev.c: void qmp_blockdev_add(BlockdevOptions *options, Error **errp)
+func blockdevAdd(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	var opts BlockdevOptions
+	if err := decodeArguments(args, &opts); err != nil {
+		return nil, err
+	}
+	switch {
+	case opts.Driver == "":
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'driver' is missing")
+	case opts.Driver != string(qcow2.DriverQCow2):
+		return nil, errors.Wrapf(ErrInvalidParameter, "Parameter 'driver' does not accept value '%s'", opts.Driver)
+	case opts.NodeName == "":
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'node-name' is missing")
+	case opts.File == nil:
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'file' is missing")
+	case opts.File.Driver != "file":
+		return nil, errors.Wrapf(ErrInvalidParameter, "Parameter 'file.driver' does not accept value '%s'", opts.File.Driver)
+	case opts.File.Filename == "":
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'file.filename' is missing")
+	}
+	if _, ok := m.nodes[opts.NodeName]; ok {
+		return nil, errors.Wrapf(ErrNodeExists, "node-name=%s is conflicting with a device id", opts.NodeName)
+	}
+
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	filename, err := confine.Path(m.root, opts.File.Filename)
+	if err != nil {
+		return nil, err
+	}
+	img, err := qcow2.OpenFileFormat(filename, qcow2.DriverQCow2, flag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open '%s'", opts.File.Filename)
+	}
+	if err := confine.Chain(m.root, img); err != nil {
+		img.Close()
+		return nil, err
+	}
+	if err := m.addNode(opts.NodeName, img, true); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return nil, nil
+}
+
+// blockdevDel closes the image of the node which is added by blockdev-add, and removes the node.
+//  blockdev.c: void qmp_blockdev_del(const char *node_name, Error **errp)
+func blockdevDel(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	var req struct {
+		NodeName string `json:"node-name"`
+	}
+	if err := decodeArguments(args, &req); err != nil {
+		return nil, err
+	}
+	if req.NodeName == "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'node-name' is missing")
+	}
+	n, ok := m.nodes[req.NodeName]
+	if !ok {
+		return nil, errors.Wrapf(ErrNodeNotFound, "Failed to find node with node-name='%s'", req.NodeName)
+	}
+	if !n.owned {
+		return nil, errors.Wrapf(ErrNodeNotOwned, "Node %s is not owned by the monitor", req.NodeName)
+	}
+
+	delete(m.nodes, req.NodeName)
+	if err := n.img.Close(); err != nil {
+		return nil, errors.Wrapf(err, "Could not close the node '%s'", req.NodeName)
+	}
+	return nil, nil
+}
+
+// blockResize resizes the image of the node.
+//  blockdev.c: void qmp_block_resize(bool has_device, const char *device, bool has_node_name, const char *node_name, int64_t size, Error **errp)
+func blockResize(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Device   string `json:"device,omitempty"`
+		NodeName string `json:"node-name,omitempty"`
+		Size     *int64 `json:"size"`
+	}
+	if err := decodeArguments(args, &req); err != nil {
+		return nil, err
+	}
+	if req.Device != "" && req.NodeName != "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Cannot specify both 'device' and 'node-name'")
+	}
+	if req.Size == nil {
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'size' is missing")
+	}
+	if *req.Size < 0 {
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'size' expects a >0 size")
+	}
+
+	device := req.Device
+	if device == "" {
+		device = req.NodeName
+	}
+	img, err := m.lookup(device)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.Resize(*req.Size); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// blockdevSnapshotInternalSync creates the internal snapshot of the image of the node.
+//  blockdev.c: void qmp_blockdev_snapshot_internal_sync(const char *device, const char *name, Error **errp)
+func blockdevSnapshotInternalSync(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Device string `json:"device"`
+		Name   string `json:"name"`
+	}
+	if err := decodeArguments(args, &req); err != nil {
+		return nil, err
+	}
+	img, err := m.lookup(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Name is empty")
+	}
+
+	// the internal snapshots share the name space of the ids and names, same as the transaction action of qemu
+	if _, err := img.FindSnapshot(req.Name); err == nil || errors.Is(err, qcow2.ErrSnapshotAmbiguous) {
+		return nil, errors.Wrapf(ErrSnapshotExists, "Snapshot with name '%s' already exists on device '%s'", req.Name, req.Device)
+	} else if !errors.Is(err, qcow2.ErrSnapshotNotFound) {
+		return nil, err
+	}
+
+	if _, err := img.CreateSnapshot(req.Name); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create snapshot '%s' on device '%s'", req.Name, req.Device)
+	}
+	return nil, nil
+}
+
+// blockdevSnapshotDeleteInternalSync deletes the internal snapshot of the image of the node, which matches both
+// of the id and name which are given, and returns it.
+//  blockdev.c: SnapshotInfo *qmp_blockdev_snapshot_delete_internal_sync(const char *device, bool has_id, const char *id, bool has_name, const char *name, Error **errp)
+func blockdevSnapshotDeleteInternalSync(ctx context.Context, m *Monitor, args json.RawMessage) (interface{}, error) {
+	var req struct {
+		Device string `json:"device"`
+		ID     string `json:"id,omitempty"`
+		Name   string `json:"name,omitempty"`
+	}
+	if err := decodeArguments(args, &req); err != nil {
+		return nil, err
+	}
+	img, err := m.lookup(req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if req.ID == "" && req.Name == "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Name or id must be provided")
+	}
+
+	snapshots, err := img.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	var sn *qcow2.SnapshotInfo
+	for i := range snapshots {
+		if (req.ID == "" || snapshots[i].ID == req.ID) && (req.Name == "" || snapshots[i].Name == req.Name) {
+			sn = &snapshots[i]
+			break
+		}
+	}
+	if sn == nil {
+		err := errors.Wrapf(qcow2.ErrSnapshotNotFound, "Snapshot with id '%s' and name '%s' does not exist on device '%s'", req.ID, req.Name, req.Device)
+		return nil, err
+	}
+
+	if err := img.DeleteSnapshot(sn.ID); err != nil {
+		return nil, errors.Wrapf(err, "Failed to delete snapshot '%s' on device '%s'", sn.ID, req.Device)
+	}
+	return sn, nil
+}
+
+// decodeArguments decodes the JSON object of the arguments of the command to v. The unknown members are
+// rejected, same as QMP.
+func decodeArguments(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.Wrapf(ErrInvalidParameter, "Invalid arguments: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qmp
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/internal/confine"
+)
+
+// The errors returned by the Monitor and its commands. The returned errors wrap them with the message, which is
+// the description of the QMP error response, so use errors.Is to test them. Each error also wraps the errno of
+// the failure.
+var (
+	// ErrInvalidInput the QMP input is not the valid command object.
+	ErrInvalidInput error = qcow2.NewError(syscall.EINVAL, "invalid QMP input")
+	// ErrInvalidParameter the argument of the command is missing or invalid.
+	ErrInvalidParameter error = qcow2.NewError(syscall.EINVAL, "invalid parameter")
+	// ErrNodeNotFound no node has the node name.
+	ErrNodeNotFound error = qcow2.NewError(syscall.ENOENT, "node not found")
+	// ErrNodeExists the node name is already in use.
+	ErrNodeExists error = qcow2.NewError(syscall.EEXIST, "node name is in use")
+	// ErrNodeOwned the node is opened by blockdev-add, so it is removed by blockdev-del.
+	ErrNodeOwned error = qcow2.NewError(syscall.EINVAL, "node is opened by blockdev-add")
+	// ErrNodeNotOwned the node is added by Monitor.AddNode, so it can not be removed by blockdev-del.
+	ErrNodeNotOwned error = qcow2.NewError(syscall.EBUSY, "node is not owned by the monitor")
+	// ErrSnapshotExists the image already has the internal snapshot of the name.
+	ErrSnapshotExists error = qcow2.NewError(syscall.EEXIST, "snapshot already exists")
+	// ErrOutsideRoot the filename of blockdev-add is outside of Options.Root.
+	ErrOutsideRoot error = confine.ErrOutsideRoot
+)
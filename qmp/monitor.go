@@ -0,0 +1,352 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qmp accepts the block commands of the QMP (QEMU Machine Protocol) in JSON, and maps them onto the
+// image operations, so the tooling which scripts the monitor of qemu can drive the images without qemu.
+//
+// The Monitor holds the images by their node names, which are added by AddNode, or opened by the blockdev-add
+// command. The commands are executed by Execute, or read from the QMP session served by Serve:
+//
+//  -> {"execute": "qmp_capabilities"}
+//  <- {"return": {}}
+//  -> {"execute": "blockdev-add", "arguments": {"driver": "qcow2", "node-name": "disk0", "file": {"driver": "file", "filename": "disk.qcow2"}}}
+//  <- {"return": {}}
+//  -> {"execute": "blockdev-snapshot-internal-sync", "arguments": {"device": "disk0", "name": "snap0"}}
+//  <- {"return": {}}
+//  -> {"execute": "query-block"}
+//  <- {"return": [{"device": "disk0", ...}]}
+//
+// The supported commands are listed by query-commands. The errors are the QMP error responses, whose class is
+// "GenericError" unless the command or the device is not found, same as qemu. The commands are executed one at
+// a time, same as the big lock of qemu.
+//
+// The dirty bitmaps are not supported, so block-dirty-bitmap-add and the other bitmap commands are not provided,
+// and fail with "CommandNotFound" same as the other unknown commands. The incremental backups of qemu, which
+// depend on them, can not be driven by the Monitor.
+//
+// The filenames of blockdev-add are the paths on the host of the Monitor, which are confined to Options.Root
+// if it is set, and the Monitor has no authentication of its own, so serve it on the unix socket.
+package qmp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// The error classes of the QMP error response.
+//  qapi/error.json: { 'enum': 'QapiErrorClass' }
+const (
+	ClassGenericError    = "GenericError"
+	ClassCommandNotFound = "CommandNotFound"
+	ClassDeviceNotFound  = "DeviceNotFound"
+)
+
+// Command the QMP command.
+type Command struct {
+	// Execute the name of the command.
+	Execute string `json:"execute"`
+	// Arguments the JSON object of the arguments of the command.
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	// ID the arbitrary JSON value which is copied to the response.
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+// Response the response of the QMP command, which has either Return or Error.
+type Response struct {
+	// Return the result of the successful command, which is the empty object if the command has no result.
+	Return interface{} `json:"return,omitempty"`
+	// Error the error of the failed command.
+	Error *Error `json:"error,omitempty"`
+	// ID the ID of the command.
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+// Error the error of the QMP error response.
+//  qapi/qmp-dispatch.c: QDict *qmp_error_response(Error *err)
+type Error struct {
+	// Class the error class, such as ClassGenericError.
+	Class string `json:"class"`
+	// Desc the human readable description of the error.
+	Desc string `json:"desc"`
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Desc
+}
+
+// Options represents the options of the Monitor.
+type Options struct {
+	// Root confines the filenames of blockdev-add, and the backing files of the images, to the directory.
+	// The relative filenames are relative to Root, and the symbolic links are resolved before the check.
+	// The commands of the filenames outside of Root fail. If empty, any file of the host is allowed.
+	Root string
+}
+
+// Monitor executes the QMP commands on the images.
+type Monitor struct {
+	root string
+
+	// mu serializes the commands, and guards nodes.
+	mu    sync.Mutex
+	nodes map[string]*node
+}
+
+// node the image of the node name.
+type node struct {
+	img *qcow2.QCow2
+	// owned the image is opened by blockdev-add, and is closed by blockdev-del.
+	owned bool
+}
+
+// NewMonitor returns the new Monitor which has no images. If opts is nil, the default options are used.
+func NewMonitor(opts *Options) *Monitor {
+	m := &Monitor{
+		nodes: make(map[string]*node),
+	}
+	if opts != nil {
+		m.root = opts.Root
+	}
+	return m
+}
+
+// AddNode adds img as the node of name, which is the device name of the commands. The image is not closed
+// by the Monitor, and can not be removed by blockdev-del.
+func (m *Monitor) AddNode(name string, img *qcow2.QCow2) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addNode(name, img, false)
+}
+
+// RemoveNode removes the node of name which is added by AddNode.
+func (m *Monitor) RemoveNode(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.nodes[name]
+	if !ok {
+		return errors.Wrapf(ErrNodeNotFound, "Failed to find node with node-name='%s'", name)
+	}
+	if n.owned {
+		return errors.Wrapf(ErrNodeOwned, "Node '%s' is opened by blockdev-add", name)
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+// Close closes the images which are opened by blockdev-add, and removes all of the nodes.
+func (m *Monitor) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for name, n := range m.nodes {
+		if n.owned {
+			if cerr := n.img.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		delete(m.nodes, name)
+	}
+	return err
+}
+
+// addNode adds img as the node of name. The caller must hold m.mu.
+func (m *Monitor) addNode(name string, img *qcow2.QCow2, owned bool) error {
+	if name == "" {
+		return errors.Wrap(ErrInvalidParameter, "Parameter 'node-name' is missing")
+	}
+	if _, ok := m.nodes[name]; ok {
+		return errors.Wrapf(ErrNodeExists, "node-name=%s is conflicting with a device id", name)
+	}
+	m.nodes[name] = &node{img: img, owned: owned}
+	return nil
+}
+
+// lookup returns the image of the device name. The caller must hold m.mu.
+func (m *Monitor) lookup(device string) (*qcow2.QCow2, error) {
+	if device == "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'device' is missing")
+	}
+	n, ok := m.nodes[device]
+	if !ok {
+		return nil, &Error{Class: ClassDeviceNotFound, Desc: "Device '" + device + "' not found"}
+	}
+	return n.img, nil
+}
+
+// Execute executes cmd, and returns its response. The capabilities negotiation is not needed.
+//  qapi/qmp-dispatch.c: QDict *qmp_dispatch(const QmpCommandList *cmds, QObject *request, bool allow_oob, Monitor *cur_mon)
+func (m *Monitor) Execute(ctx context.Context, cmd *Command) *Response {
+	resp := &Response{ID: cmd.ID}
+
+	c, ok := commands[cmd.Execute]
+	if !ok {
+		resp.Error = &Error{Class: ClassCommandNotFound, Desc: "The command " + cmd.Execute + " has not been found"}
+		return resp
+	}
+	if cmd.Execute == "qmp_capabilities" {
+		resp.Error = &Error{Class: ClassCommandNotFound, Desc: "Capabilities negotiation is already complete, command ignored"}
+		return resp
+	}
+
+	m.mu.Lock()
+	ret, err := c(ctx, m, cmd.Arguments)
+	m.mu.Unlock()
+	if err != nil {
+		resp.Error = errorResponse(err)
+		return resp
+	}
+	if ret == nil {
+		ret = struct{}{}
+	}
+	resp.Return = ret
+	return resp
+}
+
+// Serve serves the QMP session on rw until the input ends or ctx is done. The greeting is sent first, and the
+// commands other than qmp_capabilities are rejected until the capabilities are negotiated by it. The
+// malformed JSON input ends the session after its error response.
+//  monitor/qmp.c: static void monitor_qmp_dispatch(MonitorQMP *mon, QObject *req)
+func (m *Monitor) Serve(ctx context.Context, rw io.ReadWriter) error {
+	w := bufio.NewWriter(rw)
+	send := func(v interface{}) error {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.Write(buf)
+		w.WriteString("\r\n")
+		return w.Flush()
+	}
+
+	if err := send(greeting()); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(rw)
+	negotiated := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			send(&Response{Error: &Error{Class: ClassGenericError, Desc: "JSON parse error, " + err.Error()}})
+			return err
+		}
+
+		cmd, err := parseCommand(raw)
+		if err != nil {
+			if err := send(&Response{Error: errorResponse(err), ID: cmd.ID}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var resp *Response
+		switch {
+		case !negotiated && cmd.Execute == "qmp_capabilities":
+			if err := decodeArguments(cmd.Arguments, &struct {
+				Enable []string `json:"enable,omitempty"`
+			}{}); err != nil {
+				resp = &Response{Error: errorResponse(err), ID: cmd.ID}
+				break
+			}
+			negotiated = true
+			resp = &Response{Return: struct{}{}, ID: cmd.ID}
+		case !negotiated:
+			resp = &Response{
+				Error: &Error{Class: ClassCommandNotFound, Desc: "Expecting capabilities negotiation with 'qmp_capabilities'"},
+				ID:    cmd.ID,
+			}
+		default:
+			resp = m.Execute(ctx, cmd)
+		}
+		if err := send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// greeting returns the greeting message of the QMP session.
+//  monitor/qmp.c: static QDict *qmp_greeting(MonitorQMP *mon)
+func greeting() interface{} {
+	type version struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	}
+	return map[string]interface{}{
+		"QMP": map[string]interface{}{
+			"version": map[string]interface{}{
+				"qemu":    version{},
+				"package": "go-qcow2",
+			},
+			"capabilities": []string{},
+		},
+	}
+}
+
+// parseCommand parses the QMP input raw. The returned command has the ID of the input even if it is invalid.
+//  qapi/qmp-dispatch.c: static QDict *qmp_dispatch_check_obj(QDict *dict, bool allow_oob, Error **errp)
+func parseCommand(raw json.RawMessage) (*Command, error) {
+	cmd := new(Command)
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil || members == nil {
+		return cmd, errors.Wrap(ErrInvalidInput, "QMP input must be a JSON object")
+	}
+	cmd.ID = members["id"]
+
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := members[key]
+		switch key {
+		case "execute":
+			if err := json.Unmarshal(value, &cmd.Execute); err != nil {
+				return cmd, errors.Wrap(ErrInvalidInput, "QMP input member 'execute' must be a string")
+			}
+		case "arguments":
+			if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+				return cmd, errors.Wrap(ErrInvalidInput, "QMP input member 'arguments' must be an object")
+			}
+			cmd.Arguments = value
+		case "id":
+		default:
+			return cmd, errors.Wrapf(ErrInvalidInput, "QMP input member '%s' is unexpected", key)
+		}
+	}
+	if cmd.Execute == "" {
+		return cmd, errors.Wrap(ErrInvalidInput, "QMP input lacks member 'execute'")
+	}
+
+	return cmd, nil
+}
+
+// errorResponse returns the QMP error of err.
+func errorResponse(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Class: ClassGenericError, Desc: err.Error()}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// session the QMP session of the client, whose Monitor serves the other end of the pipe. The pipe is
+// synchronous, so the replies are read continuously, otherwise the Monitor blocks writing the line ending.
+type session struct {
+	conn    net.Conn
+	replies chan *reply
+	// errc receives the error of Serve when the session ends.
+	errc chan error
+}
+
+// reply the response of the command, or the greeting.
+type reply struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+func newSession(t *testing.T, m *Monitor) *session {
+	t.Helper()
+
+	client, server := net.Pipe()
+	s := &session{
+		conn:    client,
+		replies: make(chan *reply, 1),
+		errc:    make(chan error, 1),
+	}
+	go func() {
+		s.errc <- m.Serve(context.Background(), server)
+		server.Close()
+	}()
+	go func() {
+		defer close(s.replies)
+		dec := json.NewDecoder(client)
+		for {
+			r := new(reply)
+			if err := dec.Decode(r); err != nil {
+				return
+			}
+			s.replies <- r
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	greeting := s.recv(t)
+	if !strings.Contains(string(greeting.QMP), `"capabilities":[]`) {
+		t.Fatalf("greeting %s has no capabilities", greeting.QMP)
+	}
+	return s
+}
+
+func (s *session) recv(t *testing.T) *reply {
+	t.Helper()
+
+	select {
+	case r, ok := <-s.replies:
+		if !ok {
+			t.Fatal("the session is closed")
+		}
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+	return nil
+}
+
+// execute sends the raw input, and returns its response.
+func (s *session) execute(t *testing.T, input string) *reply {
+	t.Helper()
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write([]byte(input + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	return s.recv(t)
+}
+
+// negotiate completes the capabilities negotiation.
+func (s *session) negotiate(t *testing.T) {
+	t.Helper()
+
+	if r := s.execute(t, `{"execute": "qmp_capabilities"}`); r.Error != nil {
+		t.Fatal(r.Error)
+	}
+}
+
+// wantError checks r is the error response of class.
+func wantError(t *testing.T, r *reply, class string) {
+	t.Helper()
+
+	if r.Error == nil {
+		t.Fatalf("returned %s, want %s", r.Return, class)
+	}
+	if r.Error.Class != class {
+		t.Fatalf("error %s: %s, want %s", r.Error.Class, r.Error.Desc, class)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	s := newSession(t, NewMonitor(nil))
+
+	r := s.execute(t, `{"execute": "query-commands", "id": 1}`)
+	wantError(t, r, ClassCommandNotFound)
+	if string(r.ID) != "1" {
+		t.Errorf("id of the rejected command = %s, want 1", r.ID)
+	}
+
+	wantError(t, s.execute(t, `{"execute": "qmp_capabilities", "arguments": {"bogus": true}}`), ClassGenericError)
+
+	r = s.execute(t, `{"execute": "qmp_capabilities", "arguments": {"enable": []}, "id": "neg"}`)
+	if r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	if string(r.Return) != "{}" || string(r.ID) != `"neg"` {
+		t.Errorf("negotiation returned %s with id %s, want {} with \"neg\"", r.Return, r.ID)
+	}
+
+	wantError(t, s.execute(t, `{"execute": "qmp_capabilities"}`), ClassCommandNotFound)
+
+	r = s.execute(t, `{"execute": "query-commands"}`)
+	if r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	var infos []CommandInfo
+	if err := json.Unmarshal(r.Return, &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(commands) {
+		t.Errorf("query-commands returned %d commands, want %d", len(infos), len(commands))
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	root := t.TempDir()
+	img, err := qcow2.CreateImage(filepath.Join(root, "disk.qcow2"), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMonitor(&Options{Root: root})
+	defer m.Close()
+	s := newSession(t, m)
+	s.negotiate(t)
+
+	tests := []struct {
+		name  string
+		input string
+		class string
+	}{
+		{name: "unknown command", input: `{"execute": "block-dirty-bitmap-add"}`, class: ClassCommandNotFound},
+		{name: "outside root", input: `{"execute": "blockdev-add", "arguments": {"driver": "qcow2", "node-name": "etc", "file": {"driver": "file", "filename": "/etc/passwd"}}}`, class: ClassGenericError},
+		{name: "add", input: `{"execute": "blockdev-add", "arguments": {"driver": "qcow2", "node-name": "disk0", "file": {"driver": "file", "filename": "disk.qcow2"}}}`},
+		{name: "add again", input: `{"execute": "blockdev-add", "arguments": {"driver": "qcow2", "node-name": "disk0", "file": {"driver": "file", "filename": "disk.qcow2"}}}`, class: ClassGenericError},
+		{name: "unknown argument", input: `{"execute": "block_resize", "arguments": {"device": "disk0", "size": 8388608, "bogus": 1}}`, class: ClassGenericError},
+		{name: "resize", input: `{"execute": "block_resize", "arguments": {"device": "disk0", "size": 8388608}}`},
+		{name: "unknown device", input: `{"execute": "block_resize", "arguments": {"device": "disk1", "size": 8388608}}`, class: ClassDeviceNotFound},
+		{name: "snapshot", input: `{"execute": "blockdev-snapshot-internal-sync", "arguments": {"device": "disk0", "name": "snap0"}}`},
+		{name: "snapshot again", input: `{"execute": "blockdev-snapshot-internal-sync", "arguments": {"device": "disk0", "name": "snap0"}}`, class: ClassGenericError},
+		{name: "delete snapshot", input: `{"execute": "blockdev-snapshot-delete-internal-sync", "arguments": {"device": "disk0", "name": "snap0"}}`},
+		{name: "delete missing snapshot", input: `{"execute": "blockdev-snapshot-delete-internal-sync", "arguments": {"device": "disk0", "name": "snap0"}}`, class: ClassGenericError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := s.execute(t, tt.input)
+			if tt.class != "" {
+				wantError(t, r, tt.class)
+				return
+			}
+			if r.Error != nil {
+				t.Fatalf("%s: %s", r.Error.Class, r.Error.Desc)
+			}
+		})
+	}
+
+	r := s.execute(t, `{"execute": "query-block"}`)
+	if r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	var infos []BlockInfo
+	if err := json.Unmarshal(r.Return, &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Device != "disk0" || infos[0].Inserted.Image.VirtualSize != 8<<20 {
+		t.Errorf("query-block returned %s, want disk0 of 8 MiB", r.Return)
+	}
+
+	if r := s.execute(t, `{"execute": "blockdev-del", "arguments": {"node-name": "disk0"}}`); r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	wantError(t, s.execute(t, `{"execute": "blockdev-del", "arguments": {"node-name": "disk0"}}`), ClassGenericError)
+}
+
+func TestBadJSON(t *testing.T) {
+	s := newSession(t, NewMonitor(nil))
+	s.negotiate(t)
+
+	// the invalid commands are rejected, and the session continues
+	for _, input := range []string{
+		`[1, 2]`,
+		`"query-commands"`,
+		`{"execute": 1}`,
+		`{"arguments": {}}`,
+		`{"execute": "query-commands", "arguments": []}`,
+		`{"execute": "query-commands", "bogus": true, "id": 7}`,
+	} {
+		r := s.execute(t, input)
+		wantError(t, r, ClassGenericError)
+		if strings.Contains(input, `"id": 7`) && string(r.ID) != "7" {
+			t.Errorf("id of %s = %s, want 7", input, r.ID)
+		}
+	}
+	if r := s.execute(t, `{"execute": "query-commands"}`); r.Error != nil {
+		t.Fatalf("the session does not continue after the invalid commands: %v", r.Error)
+	}
+
+	// the malformed JSON ends the session after its error response
+	r := s.execute(t, `{"execute": ]`)
+	wantError(t, r, ClassGenericError)
+	if !strings.HasPrefix(r.Error.Desc, "JSON parse error") {
+		t.Errorf("error of the malformed JSON = %q", r.Error.Desc)
+	}
+	select {
+	case err := <-s.errc:
+		if err == nil {
+			t.Error("Serve returned nil for the malformed JSON")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session does not end by the malformed JSON")
+	}
+}
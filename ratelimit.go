@@ -0,0 +1,116 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"time"
+)
+
+// SLICE_TIME the default time slice of the rate limit, which is the burst of Speed/10 bytes.
+//  blockjob.c: #define SLICE_TIME 100000000ULL /* ns */
+const SLICE_TIME = 100 * time.Millisecond
+
+// RateLimit represents the bandwidth limit of the copy operations, such as Convert, so that the background
+// maintenance of the image does not starve the other I/O of the shared storage.
+type RateLimit struct {
+	// Speed the number of bytes per second. Zero means unlimited.
+	Speed int64
+	// Burst the number of bytes which may be copied without the delay, after the copy has been idle.
+	// Zero means the bytes copied in SLICE_TIME at Speed.
+	Burst int64
+}
+
+// rateLimit represents the state of the rate limit.
+//  include/qemu/ratelimit.h: typedef struct RateLimit
+type rateLimit struct {
+	sliceStartTime time.Time     // int64_t slice_start_time
+	sliceEndTime   time.Time     // int64_t slice_end_time
+	sliceQuota     uint64        // uint64_t slice_quota
+	sliceNs        time.Duration // uint64_t slice_ns
+	dispatched     uint64        // uint64_t dispatched
+}
+
+// newRateLimit returns the state of the rate limit r, or nil if r is unlimited.
+func newRateLimit(r RateLimit) *rateLimit {
+	if r.Speed <= 0 {
+		return nil
+	}
+
+	sliceNs := SLICE_TIME
+	if r.Burst > 0 {
+		sliceNs = time.Duration(float64(r.Burst) / float64(r.Speed) * float64(time.Second))
+		if sliceNs <= 0 {
+			sliceNs = 1
+		}
+	}
+
+	limit := new(rateLimit)
+	limit.setSpeed(uint64(r.Speed), sliceNs)
+	return limit
+}
+
+// setSpeed sets the speed in bytes per second, and the time slice of the rate limit.
+//  include/qemu/ratelimit.h: static inline void ratelimit_set_speed(RateLimit *limit, uint64_t speed, uint64_t slice_ns)
+func (limit *rateLimit) setSpeed(speed uint64, sliceNs time.Duration) {
+	limit.sliceNs = sliceNs
+	limit.sliceQuota = uint64(float64(speed) * sliceNs.Seconds())
+	if limit.sliceQuota < 1 {
+		limit.sliceQuota = 1
+	}
+}
+
+// calculateDelay accounts the n bytes which have been dispatched, and returns the delay before the next
+// bytes are dispatched.
+//  include/qemu/ratelimit.h: static inline int64_t ratelimit_calculate_delay(RateLimit *limit, uint64_t n)
+func (limit *rateLimit) calculateDelay(n uint64) time.Duration {
+	now := time.Now()
+
+	if limit.sliceEndTime.Before(now) {
+		// Previous, possibly extended, time slice finished; reset the
+		// accounting.
+		limit.sliceStartTime = now
+		limit.sliceEndTime = now.Add(limit.sliceNs)
+		limit.dispatched = 0
+	}
+
+	limit.dispatched += n
+	if limit.dispatched < limit.sliceQuota {
+		// We may send further data within the current time slice, no
+		// need to delay the next request.
+		return 0
+	}
+
+	// Quota exceeded. Wait based on the excess amount and then start a new
+	// slice.
+	delaySlices := float64(limit.dispatched) / float64(limit.sliceQuota)
+	limit.sliceEndTime = limit.sliceStartTime.Add(time.Duration(delaySlices * float64(limit.sliceNs)))
+	return limit.sliceEndTime.Sub(now)
+}
+
+// wait accounts the n bytes which have been copied, and sleeps until the next bytes may be copied, or ctx is
+// done. It returns the error of ctx if ctx is done. The nil limit does not wait.
+//  blockjob.c: void block_job_sleep_ns(BlockJob *job, int64_t ns)
+func (limit *rateLimit) wait(ctx context.Context, n int64) error {
+	if limit == nil {
+		return nil
+	}
+
+	delay := limit.calculateDelay(uint64(n))
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// bdrvRaw is the raw format block driver.
+//  block/raw-format.c: BlockDriver bdrv_raw
+var bdrvRaw = &BlockDriver{
+	formatName:           DriverRaw,
+	bdrvProbe:            rawProbe,
+	bdrvOpen:             rawOpen,
+	bdrvGetlength:        rawGetlength,
+	bdrvTruncate:         rawTruncate,
+	hasVariableLength:    true,
+	bdrvCoPreadv:         rawPreadv,
+	bdrvCoPwritev:        rawPwritev,
+	bdrvCoPdiscard:       rawPdiscard,
+	bdrvCoGetBlockStatus: rawGetBlockStatus,
+	bdrvCoCopyRangeFrom:  rawCopyRangeFrom,
+	bdrvCoCopyRangeTo:    rawCopyRangeTo,
+	bdrvHasZeroInit:      rawHasZeroInit,
+}
+
+func init() {
+	bdrvRegister(bdrvRaw)
+}
+
+// rawProbe returns the lowest score, so any file is probed as raw if no other format matches.
+//  block/raw-format.c: static int raw_probe(const uint8_t *buf, int buf_size, const char *filename)
+func rawProbe(buf []byte, filename string) int {
+	return 1
+}
+
+// rawOpen opens the raw format image.
+//  block/raw-format.c: static int raw_open(BlockDriverState *bs, QDict *options, int flags, Error **errp)
+func rawOpen(bs *BlockDriverState, options *QDict, flags int) error {
+	bs.SG = false
+	bs.SupportedWriteFlags = uint(BDRV_REQ_FUA)
+	return nil
+}
+
+// rawGetlength return the length of raw image file in bytes.
+//  block/raw-format.c: static int64_t raw_getlength(BlockDriverState *bs)
+func rawGetlength(bs *BlockDriverState) (int64, error) {
+	return bs.File.Size()
+}
+
+// rawTruncate changes the size of the raw image to offset bytes.
+//  block/raw-format.c: static int raw_truncate(BlockDriverState *bs, int64_t offset)
+func rawTruncate(bs *BlockDriverState, offset int64) error {
+	return bs.File.Truncate(offset)
+}
+
+// rawPreadv reads len(buf) bytes of the raw image at offset.
+//  block/raw-format.c: static int coroutine_fn raw_co_preadv(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func rawPreadv(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error {
+	return bdrvPread(bs.file, offset, buf)
+}
+
+// rawPwritev writes buf to the raw image at offset.
+// The guest data is the image file itself, so the FUA write only flushes the image file.
+//  block/raw-format.c: static int coroutine_fn raw_co_pwritev(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags)
+func rawPwritev(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, flags BdrvRequestFlags) error {
+	if flags&BDRV_REQ_FUA != 0 {
+		return bdrvPwriteSync(bs.file, offset, buf)
+	}
+
+	return bdrvPwrite(bs.file, offset, buf)
+}
+
+// rawCopyRangeFrom copies the range of the raw image file at offset to the guest data of dst at dstOff.
+//  block/raw-format.c: static int coroutine_fn raw_co_copy_range_from(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func rawCopyRangeFrom(ctx context.Context, bs *BlockDriverState, offset int64, dst *BlockDriverState, dstOff, bytes int64) error {
+	return bdrvCoCopyRangeTo(ctx, bs.file, offset, dst, dstOff, bytes)
+}
+
+// rawCopyRangeTo copies the range of the src image file at srcOff to the raw image file at offset.
+//  block/raw-format.c: static int coroutine_fn raw_co_copy_range_to(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags)
+func rawCopyRangeTo(ctx context.Context, src *BdrvChild, srcOff int64, bs *BlockDriverState, offset, bytes int64) error {
+	return bdrvCopyRange(src, srcOff, bs.file, offset, bytes)
+}
+
+// rawPdiscard discards the range of the raw image file.
+//  block/raw-format.c: static int coroutine_fn raw_co_pdiscard(BlockDriverState *bs, int64_t offset, int count)
+func rawPdiscard(ctx context.Context, bs *BlockDriverState, offset, count int64) error {
+	return bdrvPdiscard(bs.file, offset, count)
+}
+
+// rawGetBlockStatus return the block status of the raw image.
+// The all of raw image data is allocated, and maps to the same offset in the file.
+//  block/raw-format.c: static int64_t coroutine_fn raw_co_get_block_status(BlockDriverState *bs, int64_t sector_num, int nb_sectors, int *pnum, BlockDriverState **file)
+func rawGetBlockStatus(bs *BlockDriverState, offset, bytes int64) (int, int64, int64, error) {
+	return BDRV_BLOCK_RAW | BDRV_BLOCK_DATA | BDRV_BLOCK_OFFSET_VALID, bytes, offset, nil
+}
+
+// rawHasZeroInit reports whether the new raw image reads as zeros, which is false for the host device.
+//  block/file-posix.c: static int hdev_has_zero_init(BlockDriverState *bs)
+func rawHasZeroInit(bs *BlockDriverState) bool {
+	f, ok := bs.File.(interface {
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return true
+	}
+	fi, err := f.Stat()
+	return err == nil && !isHostDevice(fi)
+}
+
+// rawCreate creates the raw image file of size bytes. The image file is sparse, so it reads as zeros.
+// The host device, such as the block device, is not resized, and must have size bytes at least.
+//  block/file-posix.c: static int raw_create(const char *filename, QemuOpts *opts, Error **errp)
+func rawCreate(filename string, size int64) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		err = errors.Wrap(err, "Could not create file")
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if isHostDevice(fi) {
+		if err := NewFileBackend(f).Truncate(size); err != nil {
+			f.Close()
+			err = errors.Wrap(err, "Could not resize file")
+			return err
+		}
+		return f.Close()
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		err = errors.Wrap(err, "Could not resize file")
+		return err
+	}
+	if err := setSparse(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		err = errors.Wrap(err, "Could not resize file")
+		return err
+	}
+
+	return f.Close()
+}
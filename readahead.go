@@ -0,0 +1,255 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// READAHEAD_SEQUENTIAL_READS the number of the consecutive sequential reads which start the readahead.
+const READAHEAD_SEQUENTIAL_READS = 2
+
+// readahead detects the sequential guest reads of the image, and prefetches the guest data following them in
+// the background. The prefetch reads through the format driver, so the L2 tables of the prefetched clusters
+// are loaded into the L2 table cache with the data.
+//
+// The window of the readahead starts from the cluster size, and doubles on each readahead up to max. The next
+// readahead starts when the prefetched data which is not read yet is less than the half of the window, so the
+// sequential reads are served from the memory without waiting for the image file.
+//
+// The prefetched data is dropped when the guest data is modified, which is detected by the write generation of
+// the image, or when the disk state is changed by the other operations, such as ApplySnapshot.
+type readahead struct {
+	// max the maximum size of the window.
+	max int64
+
+	mu sync.Mutex
+	// next the end of the last read, where the next sequential read starts.
+	next int64
+	// seq the number of the consecutive sequential reads.
+	seq int
+	// window the size of the next readahead.
+	window int64
+
+	// off, buf and gen the prefetched data at off, and the write generation of the image when it is read.
+	off int64
+	buf []byte
+	gen uint
+	// epoch is increased by invalidate, which drops the prefetch in flight.
+	epoch uint
+	// pending the prefetch in flight, or nil.
+	pending *readaheadReq
+	// inflight counts the prefetch in flight, which is waited by the operations which hold the image lock for
+	// writing, since the prefetch runs without the image lock.
+	inflight sync.WaitGroup
+}
+
+// readaheadReq represents the prefetch of length bytes at off.
+type readaheadReq struct {
+	off    int64
+	length int64
+	gen    uint
+	epoch  uint
+	// done is closed when the prefetch completes.
+	done chan struct{}
+}
+
+// newReadahead returns the readahead whose window is at most max bytes.
+func newReadahead(max int64) *readahead {
+	return &readahead{max: max}
+}
+
+// writeGen returns the write generation of bs.
+func writeGen(bs *BlockDriverState) uint {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.WriteGen
+}
+
+// read copies the prefetched data at off to p, and reports whether p is read. The read which is being
+// prefetched waits for the prefetch. It records the read to detect the sequential reads, and returns the
+// readahead to be started after the read, or nil.
+func (ra *readahead) read(bs *BlockDriverState, off int64, p []byte) (*readaheadReq, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	end := off + int64(len(p))
+	for req := ra.pending; req != nil && req.off <= off && end <= req.off+req.length; req = ra.pending {
+		ra.mu.Unlock()
+		<-req.done
+		ra.mu.Lock()
+	}
+
+	if off == ra.next {
+		ra.seq++
+	} else {
+		ra.seq = 0
+		ra.window = 0
+	}
+	ra.next = end
+
+	gen := writeGen(bs)
+	valid := ra.buf != nil && ra.gen == gen
+	if !valid {
+		ra.buf = nil
+	}
+	hit := valid && off >= ra.off && ra.next <= ra.off+int64(len(ra.buf))
+	if hit {
+		copy(p, ra.buf[off-ra.off:])
+	}
+
+	if ra.seq < READAHEAD_SEQUENTIAL_READS || ra.pending != nil {
+		return nil, hit
+	}
+
+	// the readahead continues from the end of the prefetched data which follows the read
+	from := ra.next
+	if valid && ra.off <= ra.next && ra.next <= ra.off+int64(len(ra.buf)) {
+		from = ra.off + int64(len(ra.buf))
+	}
+	if ra.window == 0 {
+		ra.window = bdrvGetClusterSize(bs)
+		if w := 2 * int64(len(p)); ra.window < w {
+			ra.window = w
+		}
+	}
+	if ra.window > ra.max {
+		ra.window = ra.max
+	}
+	if from-ra.next > ra.window/2 {
+		return nil, hit
+	}
+
+	length, err := getlength(bs)
+	if err != nil || from >= length {
+		return nil, hit
+	}
+	n := ra.window
+	if n > length-from {
+		n = length - from
+	}
+	if ra.window < ra.max {
+		ra.window *= 2
+	}
+
+	ra.pending = &readaheadReq{off: from, length: n, gen: gen, epoch: ra.epoch, done: make(chan struct{})}
+	ra.inflight.Add(1)
+	return ra.pending, hit
+}
+
+// complete stores the data buf prefetched by req, which failed if err is not nil. The data is dropped if the
+// guest data is modified while it is prefetched.
+func (ra *readahead) complete(bs *BlockDriverState, req *readaheadReq, buf []byte, err error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	defer ra.inflight.Done()
+	defer close(req.done)
+
+	ra.pending = nil
+	if err != nil || req.epoch != ra.epoch || writeGen(bs) != req.gen {
+		return
+	}
+
+	// the prefetched data which is not read yet is kept with the new data
+	off := req.off
+	if ra.buf != nil && ra.gen == req.gen && ra.off <= ra.next && ra.next <= req.off && ra.off+int64(len(ra.buf)) == req.off {
+		keep := ra.buf[ra.next-ra.off:]
+		b := make([]byte, 0, len(keep)+len(buf))
+		buf = append(append(b, keep...), buf...)
+		off = ra.next
+	}
+
+	ra.off, ra.buf, ra.gen = off, buf, req.gen
+}
+
+// invalidate drops the prefetched data and the prefetch in flight.
+func (ra *readahead) invalidate() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.buf = nil
+	ra.seq = 0
+	ra.window = 0
+	ra.epoch++
+}
+
+// pread reads len(p) bytes of the guest data at off in ctx through the readahead of the image, if it is
+// enabled. The caller must hold q.mu for reading.
+func (q *QCow2) pread(ctx context.Context, off int64, p []byte) error {
+	ra := q.ra
+	if ra == nil {
+		return q.blk.pread(ctx, off, p)
+	}
+
+	bs := q.blk.bs()
+	req, hit := ra.read(bs, off, p)
+	if req != nil {
+		go prefetch(bs, ra, req)
+	}
+	if !hit {
+		return q.blk.pread(ctx, off, p)
+	}
+
+	blockAcctDone(bs, StatsReadaheadHit, int64(len(p)), nil)
+	blockAcctDone(bs, StatsRead, int64(len(p)), nil)
+	return nil
+}
+
+// prefetch reads the guest data of req from bs in the background, and stores it to ra.
+// It runs without the image lock, so the operations which hold it for writing wait for the prefetch by
+// drainReadahead, and it is traced without the context of the read which started it, since it outlives it.
+func prefetch(bs *BlockDriverState, ra *readahead, req *readaheadReq) {
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	buf := make([]byte, req.length)
+	err := bdrvAlignedPreadv(context.Background(), bs, req.off, buf)
+	blockAcctDone(bs, StatsReadahead, req.length, err)
+	ra.complete(bs, req, buf, err)
+}
+
+// SetReadahead sets the maximum size of the readahead window of the image in bytes, same as
+// OpenOpts.Readahead. The zero size disables the readahead.
+func (q *QCow2) SetReadahead(size int64) error {
+	if size < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Negative readahead size")
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.blk.bs() == nil {
+		return ENOMEDIUM
+	}
+	q.drainReadahead()
+	q.ra = nil
+	if size > 0 {
+		q.ra = newReadahead(size)
+	}
+
+	return nil
+}
+
+// drainReadahead waits for the prefetch in flight. The caller must hold q.mu for writing.
+func (q *QCow2) drainReadahead() {
+	if q.ra != nil {
+		q.ra.inflight.Wait()
+	}
+}
+
+// invalidateReadahead drops the prefetched data of the image, after the disk state is changed other than by
+// the writes. The caller must hold q.mu for writing.
+func (q *QCow2) invalidateReadahead() {
+	if q.ra != nil {
+		q.ra.invalidate()
+	}
+}
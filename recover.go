@@ -0,0 +1,808 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// l1eReservedMask the bits of the L1 table entry which must be zero.
+	l1eReservedMask = ^(L1E_OFFSET_MASK | OFLAG_COPIED)
+	// l2eReservedMask the bits of the standard L2 table entry which must be zero.
+	l2eReservedMask = ^(L2E_OFFSET_MASK | OFLAG_COPIED | OFLAG_ZERO)
+)
+
+// preferredRefcountOrders the refcount orders which are tried in the order, from the default order.
+var preferredRefcountOrders = [...]int{4, 0, 1, 2, 3, 5, 6}
+
+// RecoverOpts the options of RecoverHeader.
+type RecoverOpts struct {
+	// Size the virtual disk size of the image. If zero, the size is the guest range covered by the recovered
+	// L1 table, which is rounded up to the range of the L2 table, and may be smaller than the original size.
+	// The size must be given if no L1 table entry is found.
+	Size int64
+	// L1TableOffset the offset of the active L1 table, which is one of RecoveredHeader.OtherL1Tables.
+	// If zero, the most plausible table found is used.
+	L1TableOffset uint64
+	// BackingFile the backing file name written to the recovered header, which can not be recovered.
+	BackingFile string
+	// BackingFormat the format of the backing file written to the recovered header.
+	BackingFormat string
+	// Write writes the recovered header to the image file. Otherwise the image file is not changed.
+	Write bool
+}
+
+// RecoveredHeader the header of the image which is reconstructed by RecoverHeader.
+type RecoveredHeader struct {
+	Header
+
+	// BackingFile the backing file name of the recovered header, which is RecoverOpts.BackingFile.
+	BackingFile string
+	// BackingFormat the format of the backing file of the recovered header.
+	BackingFormat string
+	// OtherL1Tables the offsets of the other tables which may be the active L1 table, which are not used by
+	// the recovered header.
+	OtherL1Tables []uint64
+	// Written reports whether the recovered header is written to the image file.
+	Written bool
+}
+
+// RecoverHeader reconstructs the header of the qcow2 image of filename whose header is smashed, from the
+// metadata found in the image file.
+//
+// The image file is scanned for the refcount table, which gives the cluster size and the refcount width, and
+// the clusters which are in use. Then the clusters in use are scanned for the snapshot table and the L1 tables.
+// The active L1 table is the table which is referenced by neither the snapshot table nor the other tables.
+// The recovered header has the version 3, and has no feature bits and no encryption.
+//
+// The header is written to the image file only with RecoverOpts.Write, after the whole image file is scanned.
+// The recovered header is plausible but not verified, so the image should be checked by Check before it is
+// written. The clusters which are in use but are not found, such as the unused part of the refcount table, are
+// leaked in the recovered image, which are repaired by Check.
+func RecoverHeader(filename string, opts *RecoverOpts) (*RecoveredHeader, error) {
+	if opts == nil {
+		opts = new(RecoverOpts)
+	}
+	if opts.Size < 0 || opts.Size%int64(BDRV_SECTOR_SIZE) != 0 {
+		err := errors.Wrap(ErrInvalidArgument, "The image size must be a multiple of 512")
+		return nil, err
+	}
+
+	flag := os.O_RDONLY
+	if opts.Write {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(filename, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := bdrvLockImageFile(f, filename, flag); err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := fi.Size()
+	if isHostDevice(fi) {
+		if fileSize, err = f.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	sc := &headerScanner{file: f, fileSize: fileSize}
+	h, err := sc.recover(opts)
+	if err != nil {
+		err = errors.Wrapf(err, "Could not recover the header of '%s'", filename)
+		return nil, err
+	}
+
+	if opts.Write {
+		if err := writeRecoveredHeader(f, filename, h); err != nil {
+			err = errors.Wrapf(err, "Could not write the recovered header of '%s'", filename)
+			return nil, err
+		}
+		h.Written = true
+	}
+
+	return h, nil
+}
+
+// writeRecoveredHeader writes h to the header cluster of the image file f.
+func writeRecoveredHeader(f *os.File, filename string, h *RecoveredHeader) error {
+	bs := &BlockDriverState{
+		Filename:     filename,
+		Refcnt:       1,
+		File:         NewFileBackend(f),
+		TotalSectors: int64(h.Size) / int64(BDRV_SECTOR_SIZE),
+	}
+	bs.file = &BdrvChild{
+		bs:   bs,
+		Name: filename,
+	}
+	bs.Opaque = &BDRVState{
+		Version:             h.Version,
+		ClusterBits:         int(h.ClusterBits),
+		ClusterSize:         1 << h.ClusterBits,
+		L1Size:              int(h.L1Size),
+		L1TableOffset:       h.L1TableOffset,
+		RefcountTableOffset: h.RefcountTableOffset,
+		RefcountTableSize:   h.RefcountTableClusters << (h.ClusterBits - 3),
+		NbSnapshots:         uintptr(h.NbSnapshots),
+		SnapshotsOffset:     h.SnapshotsOffset,
+		RefcountOrder:       int(h.RefcountOrder),
+		ImageBackingFile:    h.BackingFile,
+		ImageBackingFormat:  []byte(h.BackingFormat),
+	}
+
+	if err := updateHeader(bs); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// clusterSet the set of the clusters of the image file, indexed by the cluster index.
+type clusterSet []uint64
+
+func (cs clusterSet) add(i int64) {
+	if i >= 0 && i>>6 < int64(len(cs)) {
+		cs[i>>6] |= 1 << uint(i&63)
+	}
+}
+
+func (cs clusterSet) has(i int64) bool {
+	return i >= 0 && i>>6 < int64(len(cs)) && cs[i>>6]&(1<<uint(i&63)) != 0
+}
+
+// recoveredSnapshotTable the snapshot table found in the image file.
+type recoveredSnapshotTable struct {
+	offset int64
+	size   int64
+	// l1Tables the offset and the number of entries of the L1 tables of the snapshots.
+	l1Tables [][2]uint64
+}
+
+// l1Candidate the cluster which looks like the L1 table.
+type l1Candidate struct {
+	offset int64
+	// copied the number of the entries which have OFLAG_COPIED.
+	copied int
+}
+
+// headerScanner finds the metadata of the image file whose header is unknown.
+type headerScanner struct {
+	file     io.ReaderAt
+	fileSize int64
+
+	clusterBits   uint
+	clusterSize   int64
+	nbClusters    int64
+	refcountOrder int
+
+	reftableOffset   int64
+	reftableClusters int64
+	reftable         []uint64
+	refblocks        map[int64][]byte
+
+	// allocated the clusters whose refcount is not zero.
+	allocated clusterSet
+	// metadata the header, the refcount table and the refcount blocks.
+	metadata clusterSet
+	// referenced the clusters which are referenced by the L1 table candidates.
+	referenced clusterSet
+}
+
+// recover scans the image file, and returns the recovered header by opts.
+func (sc *headerScanner) recover(opts *RecoverOpts) (*RecoveredHeader, error) {
+	if err := sc.findRefcountTable(); err != nil {
+		return nil, err
+	}
+	if err := sc.loadRefcounts(); err != nil {
+		return nil, err
+	}
+
+	var (
+		candidates []l1Candidate
+		zeros      []int64
+		snapshots  *recoveredSnapshotTable
+	)
+	buf := make([]byte, sc.clusterSize)
+	for i := int64(1); i < sc.nbClusters; i++ {
+		if !sc.allocated.has(i) || sc.metadata.has(i) {
+			continue
+		}
+		offset := i << sc.clusterBits
+		if err := sc.readCluster(offset, buf); err != nil {
+			return nil, err
+		}
+
+		if bufferIsZero(buf) {
+			zeros = append(zeros, offset)
+			continue
+		}
+		if t, err := sc.parseSnapshotTable(offset); err != nil {
+			return nil, err
+		} else if t != nil {
+			if snapshots == nil || len(t.l1Tables) > len(snapshots.l1Tables) {
+				snapshots = t
+			}
+			continue
+		}
+		if copied, ok := sc.parseL1Table(buf); ok {
+			candidates = append(candidates, l1Candidate{offset: offset, copied: copied})
+			for j := 0; j < len(buf); j += UINT64_SIZE {
+				if l2Offset := BEUint64(buf[j:]) & L1E_OFFSET_MASK; l2Offset != 0 {
+					sc.referenced.add(int64(l2Offset) >> sc.clusterBits)
+				}
+			}
+		}
+	}
+
+	// the snapshot table and the L1 tables of the snapshots are not the active L1 table
+	inactive := make(clusterSet, len(sc.allocated))
+	if snapshots != nil {
+		for i := snapshots.offset >> sc.clusterBits; i<<sc.clusterBits < snapshots.offset+snapshots.size; i++ {
+			inactive.add(i)
+		}
+		for _, l1 := range snapshots.l1Tables {
+			for i := int64(l1[0]) >> sc.clusterBits; i<<sc.clusterBits < int64(l1[0]+l1[1]*UINT64_SIZE); i++ {
+				inactive.add(i)
+			}
+		}
+	}
+
+	h := &RecoveredHeader{
+		Header: Header{
+			Magic:                 BEUint32(MAGIC),
+			Version:               Version3,
+			ClusterBits:           uint32(sc.clusterBits),
+			RefcountTableOffset:   uint64(sc.reftableOffset),
+			RefcountTableClusters: uint32(sc.reftableClusters),
+			RefcountOrder:         uint32(sc.refcountOrder),
+			HeaderLength:          uint32(unsafe.Sizeof(Header{})),
+		},
+		BackingFile:   opts.BackingFile,
+		BackingFormat: opts.BackingFormat,
+	}
+	if snapshots != nil {
+		h.NbSnapshots = uint32(len(snapshots.l1Tables))
+		h.SnapshotsOffset = uint64(snapshots.offset)
+	}
+
+	// the active L1 table is the start of the run of the candidates which is referenced by nothing
+	var (
+		l1Offset  int64 = -1
+		l1Entries int64
+		l1Max     int64
+		best      l1Candidate
+	)
+	isCandidate := make(clusterSet, len(sc.allocated))
+	for _, c := range candidates {
+		i := c.offset >> sc.clusterBits
+		if !sc.referenced.has(i) && !inactive.has(i) {
+			isCandidate.add(i)
+		}
+	}
+	for _, c := range candidates {
+		i := c.offset >> sc.clusterBits
+		if !isCandidate.has(i) || isCandidate.has(i-1) {
+			continue
+		}
+		if opts.L1TableOffset != 0 && uint64(c.offset) != opts.L1TableOffset {
+			h.OtherL1Tables = append(h.OtherL1Tables, uint64(c.offset))
+			continue
+		}
+
+		entries, capacity, copied, err := sc.scanL1Run(c.offset, isCandidate, inactive)
+		if err != nil {
+			return nil, err
+		}
+		if entries == 0 {
+			continue
+		}
+		c.copied = copied
+		if l1Offset >= 0 && (c.copied < best.copied || c.copied == best.copied && entries < l1Entries) {
+			h.OtherL1Tables = append(h.OtherL1Tables, uint64(c.offset))
+			continue
+		}
+		if l1Offset >= 0 {
+			h.OtherL1Tables = append(h.OtherL1Tables, uint64(l1Offset))
+		}
+		l1Offset, l1Entries, l1Max, best = c.offset, entries, capacity, c
+	}
+
+	if l1Offset < 0 && opts.L1TableOffset != 0 {
+		offset := int64(opts.L1TableOffset)
+		i := offset >> sc.clusterBits
+		if offset&(sc.clusterSize-1) != 0 || !sc.allocated.has(i) || sc.metadata.has(i) {
+			err := errors.Wrapf(ErrInvalidArgument, "No L1 table at offset %#x", offset)
+			return nil, err
+		}
+		isCandidate.add(i)
+		entries, capacity, _, err := sc.scanL1Run(offset, isCandidate, inactive)
+		if err != nil {
+			return nil, err
+		}
+		if capacity == 0 {
+			err := errors.Wrapf(ErrInvalidArgument, "No L1 table at offset %#x", offset)
+			return nil, err
+		}
+		l1Offset, l1Entries, l1Max = offset, entries, capacity
+	}
+
+	// the L1 table of the image which has no data is empty
+	if l1Offset < 0 {
+		for _, offset := range zeros {
+			if i := offset >> sc.clusterBits; !sc.referenced.has(i) && !inactive.has(i) {
+				l1Offset, l1Max = offset, sc.clusterSize/UINT64_SIZE
+				break
+			}
+		}
+	}
+	if l1Offset < 0 {
+		err := errors.Wrap(ErrInvalidHeader, "Could not find the L1 table")
+		return nil, err
+	}
+
+	l2Bits := sc.clusterBits - 3
+	size := opts.Size
+	if size == 0 {
+		if l1Entries == 0 {
+			err := errors.Wrap(ErrInvalidArgument, "Could not determine the image size from the empty L1 table, the size must be given")
+			return nil, err
+		}
+		size = l1Entries << (sc.clusterBits + l2Bits)
+	}
+	l1Size := int64((uint64(size) + 1<<(sc.clusterBits+l2Bits) - 1) >> (sc.clusterBits + l2Bits))
+	if l1Size < l1Entries {
+		err := errors.Wrapf(ErrInvalidArgument, "The image size must be at least %d for the L1 table of %d entries", l1Entries<<(sc.clusterBits+l2Bits), l1Entries)
+		return nil, err
+	}
+	if l1Size > l1Max {
+		err := errors.Wrapf(ErrInvalidArgument, "The image size must be at most %d for the L1 table at offset %#x", l1Max<<(sc.clusterBits+l2Bits), l1Offset)
+		return nil, err
+	}
+
+	h.Size = uint64(size)
+	h.L1Size = uint32(l1Size)
+	h.L1TableOffset = uint64(l1Offset)
+
+	return h, nil
+}
+
+// findRefcountTable finds the refcount table of the image file. The refcount table is usually in the second
+// cluster of the image file, otherwise the whole image file is scanned. The old refcount table which is left
+// after the table is grown does not cover the end of the image file, and the data which looks like the refcount
+// table has the refcounts beyond the end of the image file, so they are used only if no other table is found.
+func (sc *headerScanner) findRefcountTable() error {
+	var (
+		found bool
+		best  headerScanner
+		score [3]int64
+	)
+	try := func(bits uint, offset int64) (bool, error) {
+		ok, err := sc.tryRefcountTable(bits, offset)
+		if err != nil || !ok {
+			return false, err
+		}
+		var s [3]int64
+		clean, err := sc.cleanBeyondEOF()
+		if err != nil {
+			return false, err
+		}
+		if clean {
+			s[0] = 1
+		}
+		blockBits := bits + 3 - uint(sc.refcountOrder)
+		if s[2] = int64(len(sc.reftable)) << (blockBits + bits); s[2] >= sc.fileSize {
+			s[1] = 1
+		}
+		if s[0] == 1 && s[1] == 1 {
+			return true, nil
+		}
+		if !found || s[0] > score[0] || s[0] == score[0] && (s[1] > score[1] || s[1] == score[1] && s[2] > score[2]) {
+			found, best, score = true, *sc, s
+		}
+		return false, nil
+	}
+
+	for _, bits := range []uint{16, 9, 10, 11, 12, 13, 14, 15, 17, 18, 19, 20, 21} {
+		if ok, err := try(bits, int64(1)<<bits); err != nil || ok {
+			return err
+		}
+	}
+
+	buf := make([]byte, IO_BUF_SIZE)
+	for offset := int64(0); offset < sc.fileSize; offset += int64(len(buf)) {
+		n, err := sc.file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for j := 0; j+BDRV_SECTOR_SIZE <= n; j += BDRV_SECTOR_SIZE {
+			off := offset + int64(j)
+			entry := BEUint64(buf[j:])
+			if off == 0 || entry == 0 || entry&REFT_RESERVED_MASK != 0 || entry >= uint64(sc.fileSize) {
+				continue
+			}
+			for bits := uint(MIN_CLUSTER_BITS); bits <= MAX_CLUSTER_BITS; bits++ {
+				mask := int64(1)<<bits - 1
+				if off&mask != 0 || int64(entry)&mask != 0 {
+					break
+				}
+				if ok, err := try(bits, off); err != nil || ok {
+					return err
+				}
+			}
+		}
+	}
+
+	if !found {
+		return errors.Wrap(ErrInvalidHeader, "Could not find the refcount table")
+	}
+	*sc = best
+	return nil
+}
+
+// tryRefcountTable reports whether the clusters of the size of 1<<bits at offset are the refcount table,
+// and sets it to sc if so.
+func (sc *headerScanner) tryRefcountTable(bits uint, offset int64) (bool, error) {
+	clusterSize := int64(1) << bits
+	if offset <= 0 || offset+clusterSize > sc.fileSize {
+		return false, nil
+	}
+
+	// the refcount table continues while its last entry is used
+	var table []uint64
+	buf := make([]byte, clusterSize)
+	for off := offset; off+clusterSize <= sc.fileSize && int64(len(table))*UINT64_SIZE < MAX_REFTABLE_SIZE; off += clusterSize {
+		if _, err := sc.file.ReadAt(buf, off); err != nil {
+			return false, err
+		}
+		for j := 0; j < len(buf); j += UINT64_SIZE {
+			entry := BEUint64(buf[j:])
+			if entry&REFT_RESERVED_MASK != 0 || entry&uint64(clusterSize-1) != 0 || entry >= uint64(sc.fileSize) {
+				return false, nil
+			}
+			table = append(table, entry)
+		}
+		if table[len(table)-1] == 0 {
+			break
+		}
+	}
+	if len(table) == 0 || table[0] == 0 {
+		return false, nil
+	}
+	last := len(table) - 1
+	for table[last] == 0 {
+		last--
+	}
+	// the refcount blocks are distinct
+	seen := make(map[uint64]bool)
+	for _, entry := range table[:last+1] {
+		if entry != 0 && seen[entry] {
+			return false, nil
+		}
+		seen[entry] = true
+	}
+	clusters := (int64(last+1)*UINT64_SIZE + clusterSize - 1) / clusterSize
+
+	for _, order := range preferredRefcountOrders {
+		sc.clusterBits = bits
+		sc.clusterSize = clusterSize
+		sc.refcountOrder = order
+		sc.reftable = table[:last+1]
+		sc.refblocks = make(map[int64][]byte)
+
+		// the header, the refcount table and all of the refcount blocks are in use, which is unlikely for
+		// the data which looks like the refcount table, such as the L2 table
+		ok, err := sc.refcountIs(0, func(r uint64) bool { return r == 1 })
+		for i := int64(0); ok && err == nil && i < clusters; i++ {
+			ok, err = sc.refcountIs((offset>>bits)+i, func(r uint64) bool { return r > 0 })
+		}
+		for i := 0; ok && err == nil && i <= last; i++ {
+			if table[i] != 0 {
+				ok, err = sc.refcountIs(int64(table[i])>>bits, func(r uint64) bool { return r > 0 })
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			sc.reftableOffset = offset
+			sc.reftableClusters = clusters
+			sc.nbClusters = (sc.fileSize + clusterSize - 1) >> bits
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// cleanBeyondEOF reports whether the refcounts of the clusters beyond the end of the image file are zero.
+func (sc *headerScanner) cleanBeyondEOF() (bool, error) {
+	blockBits := sc.clusterBits + 3 - uint(sc.refcountOrder)
+	i := (sc.nbClusters - 1) >> blockBits
+	if i >= int64(len(sc.reftable)) {
+		return true, nil
+	}
+	if int64(len(sc.reftable)) > i+1 {
+		return false, nil
+	}
+	if sc.reftable[i] == 0 {
+		return true, nil
+	}
+
+	block, err := sc.refcountBlock(int64(sc.reftable[i]))
+	if err != nil {
+		return false, err
+	}
+	get := getRefcountFuncs[sc.refcountOrder]
+	for j := sc.nbClusters - i<<blockBits; j < 1<<blockBits; j++ {
+		if get(block, uint64(j)) != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// refcountIs reports whether the refcount of the cluster of index satisfies f.
+func (sc *headerScanner) refcountIs(index int64, f func(refcount uint64) bool) (bool, error) {
+	blockBits := sc.clusterBits + 3 - uint(sc.refcountOrder)
+	i := index >> blockBits
+	if i >= int64(len(sc.reftable)) || sc.reftable[i] == 0 {
+		return f(0), nil
+	}
+
+	block, err := sc.refcountBlock(int64(sc.reftable[i]))
+	if err != nil {
+		return false, err
+	}
+	return f(getRefcountFuncs[sc.refcountOrder](block, uint64(index&(1<<blockBits-1)))), nil
+}
+
+// refcountBlock reads the refcount block at offset.
+func (sc *headerScanner) refcountBlock(offset int64) ([]byte, error) {
+	if block, ok := sc.refblocks[offset]; ok {
+		return block, nil
+	}
+
+	block := make([]byte, sc.clusterSize)
+	if err := sc.readCluster(offset, block); err != nil {
+		return nil, err
+	}
+	sc.refblocks[offset] = block
+	return block, nil
+}
+
+// loadRefcounts sets the clusters whose refcount is not zero to sc.allocated.
+func (sc *headerScanner) loadRefcounts() error {
+	n := (sc.nbClusters + 63) >> 6
+	sc.allocated = make(clusterSet, n)
+	sc.metadata = make(clusterSet, n)
+	sc.referenced = make(clusterSet, n)
+
+	sc.metadata.add(0)
+	for i := int64(0); i < sc.reftableClusters; i++ {
+		sc.metadata.add(sc.reftableOffset>>sc.clusterBits + i)
+	}
+
+	blockBits := sc.clusterBits + 3 - uint(sc.refcountOrder)
+	get := getRefcountFuncs[sc.refcountOrder]
+	for i, offset := range sc.reftable {
+		if offset == 0 {
+			continue
+		}
+		sc.metadata.add(int64(offset) >> sc.clusterBits)
+
+		block, err := sc.refcountBlock(int64(offset))
+		if err != nil {
+			return err
+		}
+		for j := int64(0); j < 1<<blockBits; j++ {
+			if get(block, uint64(j)) != 0 {
+				sc.allocated.add(int64(i)<<blockBits + j)
+			}
+		}
+	}
+	sc.refblocks = nil
+
+	return nil
+}
+
+// readCluster reads the cluster at offset to buf. The cluster beyond the end of the image file reads as zeros.
+func (sc *headerScanner) readCluster(offset int64, buf []byte) error {
+	n, err := sc.file.ReadAt(buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return err
+}
+
+// validOffset reports whether the cluster at offset is in use.
+func (sc *headerScanner) validOffset(offset uint64) bool {
+	return offset&uint64(sc.clusterSize-1) == 0 && offset < uint64(sc.fileSize) && sc.allocated.has(int64(offset)>>sc.clusterBits)
+}
+
+// parseL1Table reports whether buf looks like the L1 table, and returns the number of the entries which have
+// OFLAG_COPIED. The table must have at least one entry in use.
+func (sc *headerScanner) parseL1Table(buf []byte) (int, bool) {
+	var used, copied int
+	for j := 0; j < len(buf); j += UINT64_SIZE {
+		entry := BEUint64(buf[j:])
+		if entry == 0 {
+			continue
+		}
+		if entry&l1eReservedMask != 0 || !sc.validOffset(entry&L1E_OFFSET_MASK) {
+			return 0, false
+		}
+		used++
+		if entry&OFLAG_COPIED != 0 {
+			copied++
+		}
+	}
+
+	return copied, used > 0
+}
+
+// validL2Table reports whether buf looks like the L2 table.
+func (sc *headerScanner) validL2Table(buf []byte) bool {
+	csizeShift := 62 - (sc.clusterBits - 8)
+	for j := 0; j < len(buf); j += UINT64_SIZE {
+		entry := BEUint64(buf[j:])
+		switch {
+		case entry == 0:
+		case entry&OFLAG_COMPRESSED != 0:
+			if entry&OFLAG_COPIED != 0 || int64(entry&(1<<csizeShift-1)) >= sc.fileSize {
+				return false
+			}
+		case entry&l2eReservedMask != 0:
+			return false
+		case entry&L2E_OFFSET_MASK == 0:
+			if entry&OFLAG_ZERO == 0 {
+				return false
+			}
+		default:
+			if !sc.validOffset(entry & L2E_OFFSET_MASK) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// scanL1Run returns the number of the entries in use of the L1 table at offset, the number of the entries which
+// the table can have, and the number of the entries which have OFLAG_COPIED. The table continues to the following
+// clusters which are the L1 table candidates or empty, and are referenced by nothing. The table whose entry does
+// not refer to the L2 table ends before the cluster of the entry, so the table is empty if its first cluster has
+// such an entry.
+func (sc *headerScanner) scanL1Run(offset int64, isCandidate, inactive clusterSet) (entries, capacity int64, copied int, err error) {
+	buf := make([]byte, sc.clusterSize)
+	l2 := make([]byte, sc.clusterSize)
+	entriesPerCluster := sc.clusterSize / UINT64_SIZE
+
+next:
+	for off := offset; capacity*UINT64_SIZE < MAX_L1_SIZE; off += sc.clusterSize {
+		i := off >> sc.clusterBits
+		if off != offset && (!sc.allocated.has(i) || sc.metadata.has(i) || sc.referenced.has(i) || inactive.has(i)) {
+			break
+		}
+		if err := sc.readCluster(off, buf); err != nil {
+			return 0, 0, 0, err
+		}
+		if !isCandidate.has(i) && !bufferIsZero(buf) {
+			break
+		}
+
+		var (
+			last int64 = -1
+			n    int
+		)
+		for j := int64(0); j < entriesPerCluster; j++ {
+			entry := BEUint64(buf[j*UINT64_SIZE:])
+			if entry == 0 {
+				continue
+			}
+			if err := sc.readCluster(int64(entry&L1E_OFFSET_MASK), l2); err != nil {
+				return 0, 0, 0, err
+			}
+			if !sc.validL2Table(l2) {
+				break next
+			}
+			last = j
+			if entry&OFLAG_COPIED != 0 {
+				n++
+			}
+		}
+		if last >= 0 {
+			entries = capacity + last + 1
+		}
+		capacity += entriesPerCluster
+		copied += n
+	}
+
+	return entries, capacity, copied, nil
+}
+
+// parseSnapshotTable returns the snapshot table at offset, or nil if the entries at offset do not look like
+// the snapshot table.
+func (sc *headerScanner) parseSnapshotTable(offset int64) (*recoveredSnapshotTable, error) {
+	t := &recoveredSnapshotTable{offset: offset}
+	ids := make(map[string]bool)
+
+	off := offset
+	buf := make([]byte, snapshotHeaderSize)
+	for len(t.l1Tables) < MAX_SNAPSHOTS {
+		off = alignOffset(off, 8)
+		if off+snapshotHeaderSize > sc.fileSize || off-offset > MAX_SNAPSHOTS_SIZE {
+			break
+		}
+		if _, err := sc.file.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+		var h SnapshotHeader
+		if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &h); err != nil {
+			return nil, err
+		}
+
+		if !sc.validOffset(h.L1TableOffset) || h.L1TableOffset == 0 || h.L1Size > MAX_L1_SIZE/UINT64_SIZE ||
+			h.L1TableOffset+uint64(h.L1Size)*UINT64_SIZE > uint64(sc.fileSize) || h.DateNsec >= 1e9 ||
+			h.ExtraDataSize > MAX_SNAPSHOT_EXTRA_DATA || h.IDStrSize == 0 {
+			break
+		}
+		end := off + snapshotHeaderSize + int64(h.ExtraDataSize) + int64(h.IDStrSize) + int64(h.NameSize)
+		if end > sc.fileSize {
+			break
+		}
+		strs := make([]byte, int(h.IDStrSize)+int(h.NameSize))
+		if _, err := sc.file.ReadAt(strs, end-int64(len(strs))); err != nil {
+			return nil, err
+		}
+		id, name := string(strs[:h.IDStrSize]), string(strs[h.IDStrSize:])
+		if !printable(id) || !printable(name) || ids[id] {
+			break
+		}
+
+		ids[id] = true
+		t.l1Tables = append(t.l1Tables, [2]uint64{h.L1TableOffset, uint64(h.L1Size)})
+		off = end
+	}
+	if len(t.l1Tables) == 0 {
+		return nil, nil
+	}
+	t.size = off - offset
+
+	return t, nil
+}
+
+// printable reports whether s is the valid UTF-8 string which has no control characters.
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
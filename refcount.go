@@ -7,57 +7,567 @@
 package qcow2
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
-func getRefcountRO4(refcountArray *[8][]byte, index uint8) uint64 {
-	// TODO(zchee): always uint64(1)
-	return uint64(1)
+// getRefcountRO0 return the 1 bit refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro0(const void *refcount_array, uint64_t index)
+func getRefcountRO0(refcountArray []byte, index uint64) uint64 {
+	return uint64(refcountArray[index/8]>>(index%8)) & 0x1
+}
+
+// setRefcountRO0 sets the 1 bit refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro0(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO0(refcountArray []byte, index uint64, value uint64) {
+	refcountArray[index/8] &^= 0x1 << (index % 8)
+	refcountArray[index/8] |= byte(value&0x1) << (index % 8)
+}
+
+// getRefcountRO1 return the 2 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro1(const void *refcount_array, uint64_t index)
+func getRefcountRO1(refcountArray []byte, index uint64) uint64 {
+	return uint64(refcountArray[index/4]>>(2*(index%4))) & 0x3
+}
+
+// setRefcountRO1 sets the 2 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro1(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO1(refcountArray []byte, index uint64, value uint64) {
+	refcountArray[index/4] &^= 0x3 << (2 * (index % 4))
+	refcountArray[index/4] |= byte(value&0x3) << (2 * (index % 4))
+}
+
+// getRefcountRO2 return the 4 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro2(const void *refcount_array, uint64_t index)
+func getRefcountRO2(refcountArray []byte, index uint64) uint64 {
+	return uint64(refcountArray[index/2]>>(4*(index%2))) & 0xf
+}
+
+// setRefcountRO2 sets the 4 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro2(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO2(refcountArray []byte, index uint64, value uint64) {
+	refcountArray[index/2] &^= 0xf << (4 * (index % 2))
+	refcountArray[index/2] |= byte(value&0xf) << (4 * (index % 2))
+}
+
+// getRefcountRO3 return the 8 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro3(const void *refcount_array, uint64_t index)
+func getRefcountRO3(refcountArray []byte, index uint64) uint64 {
+	return uint64(refcountArray[index])
+}
+
+// setRefcountRO3 sets the 8 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro3(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO3(refcountArray []byte, index uint64, value uint64) {
+	refcountArray[index] = byte(value)
+}
+
+// getRefcountRO4 return the 16 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro4(const void *refcount_array, uint64_t index)
+func getRefcountRO4(refcountArray []byte, index uint64) uint64 {
+	return uint64(BEUint16(refcountArray[index*UINT16_SIZE:]))
+}
+
+// setRefcountRO4 sets the 16 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro4(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO4(refcountArray []byte, index uint64, value uint64) {
+	copy(refcountArray[index*UINT16_SIZE:], BEUvarint16(uint16(value)))
+}
+
+// getRefcountRO5 return the 32 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro5(const void *refcount_array, uint64_t index)
+func getRefcountRO5(refcountArray []byte, index uint64) uint64 {
+	return uint64(BEUint32(refcountArray[index*UINT32_SIZE:]))
+}
+
+// setRefcountRO5 sets the 32 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro5(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO5(refcountArray []byte, index uint64, value uint64) {
+	copy(refcountArray[index*UINT32_SIZE:], BEUvarint32(uint32(value)))
+}
+
+// getRefcountRO6 return the 64 bits refcount entry at index of refcountArray.
+//  block/qcow2-refcount.c: static uint64_t get_refcount_ro6(const void *refcount_array, uint64_t index)
+func getRefcountRO6(refcountArray []byte, index uint64) uint64 {
+	return BEUint64(refcountArray[index*UINT64_SIZE:])
+}
+
+// setRefcountRO6 sets the 64 bits refcount entry at index of refcountArray to value.
+//  block/qcow2-refcount.c: static void set_refcount_ro6(void *refcount_array, uint64_t index, uint64_t value)
+func setRefcountRO6(refcountArray []byte, index uint64, value uint64) {
+	copy(refcountArray[index*UINT64_SIZE:], BEUvarint64(value))
+}
+
+// getRefcountFuncs is the getter of the refcount entry, which is indexed by the refcount order.
+//  block/qcow2-refcount.c: static Qcow2GetRefcountFunc *const get_refcount_funcs[]
+var getRefcountFuncs = [...]GetRefcountFunc{
+	getRefcountRO0,
+	getRefcountRO1,
+	getRefcountRO2,
+	getRefcountRO3,
+	getRefcountRO4,
+	getRefcountRO5,
+	getRefcountRO6,
+}
+
+// setRefcountFuncs is the setter of the refcount entry, which is indexed by the refcount order.
+//  block/qcow2-refcount.c: static Qcow2SetRefcountFunc *const set_refcount_funcs[]
+var setRefcountFuncs = [...]SetRefcountFunc{
+	setRefcountRO0,
+	setRefcountRO1,
+	setRefcountRO2,
+	setRefcountRO3,
+	setRefcountRO4,
+	setRefcountRO5,
+	setRefcountRO6,
+}
+
+// refcountInit loads the refcount table of the image.
+//  block/qcow2-refcount.c: int qcow2_refcount_init(BlockDriverState *bs)
+func refcountInit(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	if s.RefcountOrder < 0 || s.RefcountOrder >= len(getRefcountFuncs) {
+		return errors.Wrapf(ErrInvalidHeader, "Invalid refcount order %d", s.RefcountOrder)
+	}
+	s.GetRefcount = getRefcountFuncs[s.RefcountOrder]
+	s.SetRefcount = setRefcountFuncs[s.RefcountOrder]
+
+	// the segments of the refcount table are loaded on demand
+	s.RefcountTable = newRefcountTable(s.RefcountTableOffset, int(s.RefcountTableSize))
+	updateMaxRefcountTableIndex(s)
+
+	return nil
+}
+
+// updateMaxRefcountTableIndex sets the index of the last used entry of the refcount table. The entries of the
+// segments which are not loaded yet are taken as used.
+//  block/qcow2-refcount.c: static void update_max_refcount_table_index(BDRVQcow2State *s)
+func updateMaxRefcountTableIndex(s *BDRVState) {
+	// Set s->max_refcount_table_index to the index of the last used entry
+	s.MaxRefcountTableIndex = s.RefcountTable.lastUsed()
 }
 
-// ((uint16_t *)refcount_array)[index] = cpu_to_be16(value);
-func setRefcountRO4(refcountArray *[8][]byte, index uint8, value uint64) {
-	refcountArray[index] = BEUvarint16(uint16(value))
+// loadRefcountBlock loads the refcount block at refcountBlockOffset from the refcount block cache.
+// The block must be released by cachePut. The refcount blocks are shared by the requests, so their cache misses
+// are traced without the context of the request.
+//  block/qcow2-refcount.c: static int load_refcount_block(BlockDriverState *bs, int64_t refcount_block_offset, void **refcount_block)
+func loadRefcountBlock(bs *BlockDriverState, refcountBlockOffset int64) ([]byte, error) {
+	s := bs.Opaque
+
+	return cacheGet(context.Background(), bs, s.RefcountBlockCache, refcountBlockOffset)
 }
 
+// getRefcount return the refcount of the cluster of clusterIndex.
+// The cluster which is not covered by the refcount table has the refcount 0.
+//  block/qcow2-refcount.c: int qcow2_get_refcount(BlockDriverState *bs, int64_t cluster_index, uint64_t *refcount)
 func getRefcount(bs *BlockDriverState, clusterIndex uint64) (uint64, error) {
 	s := bs.Opaque
 
 	refcountTableIndex := clusterIndex >> uint(s.RefcountBlockBits)
-	if uint32(refcountTableIndex) >= s.RefcountTableSize {
+	if refcountTableIndex >= uint64(s.RefcountTableSize) {
 		return 0, nil
 	}
-	refcountBlockOffset := BEUint64(s.RefcountTable[refcountTableIndex]) & REFT_OFFSET_MASK
-	if refcountBlockOffset != 0 {
+	reftEntry, err := s.RefcountTable.get(bs, int(refcountTableIndex))
+	if err != nil {
+		return 0, err
+	}
+	refcountBlockOffset := reftEntry & REFT_OFFSET_MASK
+	if refcountBlockOffset == 0 {
 		return 0, nil
 	}
 
-	if offsetIntoCluster(s, int64(refcountBlockOffset)) == 0 {
-		// TODO(zchee): implements qcow2_signal_corruption
-		// qcow2_signal_corruption(bs, true, -1, -1, "Refblock offset %#" PRIx64
-		//                         " unaligned (reftable index: %#" PRIx64 ")",
-		//                         refcount_block_offset, refcount_table_index);
-		return 0, syscall.EIO
+	if offsetIntoCluster(s, int64(refcountBlockOffset)) != 0 {
+		err := signalCorruption(bs, true, int64(refcountBlockOffset), "Refblock offset %#x unaligned (reftable index: %#x)", refcountBlockOffset, refcountTableIndex)
+		return 0, err
 	}
 
-	// TODO(zchee): implements qcow2_cache_get
-	// ret = qcow2_cache_get(bs, s->refcount_block_cache, refcount_block_offset, &refcount_block);
-	// if (ret < 0) {
-	//     return ret;
-	// }
+	refcountBlock, err := loadRefcountBlock(bs, int64(refcountBlockOffset))
+	if err != nil {
+		return 0, err
+	}
+	defer cachePut(s.RefcountBlockCache, refcountBlock)
 
 	blockIndex := clusterIndex & uint64(s.RefcountBlockSize-1)
-	var refcountBlock int
-	refcount := s.GetRefcount(refcountBlock, blockIndex)
+	return s.GetRefcount(refcountBlock, blockIndex), nil
+}
+
+// inSameRefcountBlock reports whether the offset a and b are covered by the same refcount block.
+//  block/qcow2-refcount.c: static int in_same_refcount_block(BDRVQcow2State *s, uint64_t offset_a, uint64_t offset_b)
+func inSameRefcountBlock(s *BDRVState, offsetA, offsetB uint64) bool {
+	blockA := offsetA >> uint(s.ClusterBits+s.RefcountBlockBits)
+	blockB := offsetB >> uint(s.ClusterBits+s.RefcountBlockBits)
+
+	return blockA == blockB
+}
+
+// allocRefcountBlock loads the refcount block for the cluster of clusterIndex, and allocates it if needed.
+// Returns the refcount block, which must be released by cachePut.
+//
+// If the new metadata clusters are allocated, returns syscall.EAGAIN to signal the caller
+// that it needs to restart the search for free clusters.
+//  block/qcow2-refcount.c: static int alloc_refcount_block(BlockDriverState *bs, int64_t cluster_index, void **refcount_block)
+func allocRefcountBlock(bs *BlockDriverState, clusterIndex int64) ([]byte, error) {
+	s := bs.Opaque
+
+	// Find the refcount block for the given cluster
+	refcountTableIndex := uint64(clusterIndex) >> uint(s.RefcountBlockBits)
+
+	if refcountTableIndex < uint64(s.RefcountTableSize) {
+		reftEntry, err := s.RefcountTable.get(bs, int(refcountTableIndex))
+		if err != nil {
+			return nil, err
+		}
+		refcountBlockOffset := reftEntry & REFT_OFFSET_MASK
+
+		// If it's already there, we're done
+		if refcountBlockOffset != 0 {
+			if offsetIntoCluster(s, int64(refcountBlockOffset)) != 0 {
+				err := signalCorruption(bs, true, int64(refcountBlockOffset), "Refblock offset %#x unaligned (reftable index: %#x)", refcountBlockOffset, refcountTableIndex)
+				return nil, err
+			}
+
+			return loadRefcountBlock(bs, int64(refcountBlockOffset))
+		}
+	}
+
+	// If we came here, we need to allocate something. Something is at least
+	// a cluster for the new refcount block. It may also include a new refcount
+	// table if the old refcount table is too small.
+	//
+	// Note that allocating clusters here needs some special care:
+	//
+	// - We can't use the normal AllocClusters(), it would try to
+	//   increase the refcount and very likely we would end up with an endless
+	//   recursion. Instead we must place the refcount blocks in a way that
+	//   they can describe them themselves.
+	//
+	// - We need to consider that at this point we are inside updateRefcount
+	//   and potentially doing an initial refcount increase. This means that
+	//   some clusters have already been allocated by the caller, but their
+	//   refcount isn't accurate yet. If we allocate clusters for metadata, we
+	//   need to return EAGAIN to signal the caller that it needs to restart
+	//   the search for free clusters.
+
+	// Allocate the refcount block itself and mark it as used
+	newBlock, err := AllocClustersNoref(bs, uint64(s.ClusterSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// If we're allocating the block at offset 0 then something is wrong
+	if newBlock == 0 {
+		err := signalCorruption(bs, true, 0, "Preventing invalid allocation of refcount block at offset 0")
+		return nil, err
+	}
+
+	var refcountBlock []byte
+	if inSameRefcountBlock(s, uint64(newBlock), uint64(clusterIndex)<<uint(s.ClusterBits)) {
+		// Zero the new refcount block before updating it
+		refcountBlock, err = cacheGetEmpty(bs, s.RefcountBlockCache, newBlock)
+		if err != nil {
+			return nil, err
+		}
+		for i := range refcountBlock {
+			refcountBlock[i] = 0
+		}
+
+		// The block describes itself, need to update the cache
+		blockIndex := uint64(newBlock>>uint(s.ClusterBits)) & uint64(s.RefcountBlockSize-1)
+		s.SetRefcount(refcountBlock, blockIndex, 1)
+	} else {
+		// Described somewhere else. This can recurse at most twice before we
+		// arrive at a block that describes itself.
+		if err := updateRefcount(bs, newBlock, int64(s.ClusterSize), 1, false, DISCARD_NEVER); err != nil {
+			return nil, err
+		}
+
+		if err := cacheFlush(bs, s.RefcountBlockCache); err != nil {
+			return nil, err
+		}
+
+		// Initialize the new refcount block only after updating its refcount,
+		// updateRefcount uses the refcount cache itself
+		refcountBlock, err = cacheGetEmpty(bs, s.RefcountBlockCache, newBlock)
+		if err != nil {
+			return nil, err
+		}
+		for i := range refcountBlock {
+			refcountBlock[i] = 0
+		}
+	}
+
+	// Now the new refcount block needs to be written to disk
+	cacheEntryMarkDirty(s.RefcountBlockCache, refcountBlock)
+	err = cacheFlush(bs, s.RefcountBlockCache)
+	cachePut(s.RefcountBlockCache, refcountBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the refcount table is big enough, just hook the block up there
+	if refcountTableIndex < uint64(s.RefcountTableSize) {
+		offset := int64(s.RefcountTableOffset + refcountTableIndex*UINT64_SIZE)
+		if err := bdrvPwriteSync(bs.file, offset, BEUvarint64(uint64(newBlock))); err != nil {
+			return nil, err
+		}
+
+		if err := s.RefcountTable.set(bs, int(refcountTableIndex), uint64(newBlock)); err != nil {
+			return nil, err
+		}
+		if int(refcountTableIndex) > s.MaxRefcountTableIndex {
+			s.MaxRefcountTableIndex = int(refcountTableIndex)
+		}
+
+		// The new refcount block may be where the caller intended to put its
+		// data, so let it restart the search.
+		return nil, syscall.EAGAIN
+	}
+
+	// If we come here, we need to grow the refcount table. Again, a new
+	// refcount table needs some space and we can't simply allocate to avoid
+	// endless recursion.
+	//
+	// Therefore let's grab new refcount blocks at the end of the image, which
+	// will describe themselves and the new refcount table. This way we can
+	// reference them only in the new table and do the switch to the new
+	// refcount table at once without producing an inconsistent state in
+	// between.
+
+	// Calculate the number of refcount blocks needed so far; this will be the
+	// basis for calculating the index of the first cluster used for the
+	// self-describing refcount structures which we are about to create.
+	//
+	// Because we reached this point, there cannot be any refcount entries for
+	// cluster_index or higher indices yet. However, because new_block has been
+	// allocated to describe that cluster (and it will assume this role later
+	// on), we cannot use that index; also, new_block may actually have a higher
+	// cluster index than cluster_index, so it needs to be taken into account
+	// here (and 1 needs to be added to its value because that cluster is used).
+	last := uint64(clusterIndex) + 1
+	if n := uint64(newBlock>>uint(s.ClusterBits)) + 1; n > last {
+		last = n
+	}
+	blocksUsed := uint64(divRoundUp(int64(last), int64(s.RefcountBlockSize)))
+
+	// Create the new refcount table and blocks
+	metaOffset := (blocksUsed * uint64(s.RefcountBlockSize)) * uint64(s.ClusterSize)
+
+	if _, err := refcountArea(bs, metaOffset, 0, false, int(refcountTableIndex), uint64(newBlock)); err != nil {
+		return nil, err
+	}
+
+	// If we were trying to do the initial refcount update for some cluster
+	// allocation, we might have used the same clusters to store newly
+	// allocated metadata. Make the caller search some new space.
+	return nil, syscall.EAGAIN
+}
+
+// refcountArea creates the refcount structures which cover the area from startOffset, plus
+// additionalClusters clusters, and switches to the new refcount table.
+// Returns the end offset of the new refcount structures.
+//  block/qcow2-refcount.c: int64_t qcow2_refcount_area(BlockDriverState *bs, uint64_t start_offset, uint64_t additional_clusters, bool exact_size, int new_refblock_index, uint64_t new_refblock_offset)
+func refcountArea(bs *BlockDriverState, startOffset, additionalClusters uint64, exactSize bool, newRefblockIndex int, newRefblockOffset uint64) (int64, error) {
+	s := bs.Opaque
+	clusterSize := uint64(s.ClusterSize)
+
+	_, totalRefblockCount64 := refcountMetadataSize(int64(startOffset/clusterSize+additionalClusters), int64(clusterSize), s.RefcountOrder, !exactSize)
+	if totalRefblockCount64 > MAX_REFTABLE_SIZE {
+		return 0, errors.Wrap(ErrTooLarge, "Refcount table too large")
+	}
+	totalRefblockCount := int(totalRefblockCount64)
+
+	// Index in the refcount table of the first refcount block to cover the area
+	// of refcount structures we are about to create; we know that
+	// totalRefblockCount can cover startOffset, so this will definitely
+	// fit into an int.
+	areaReftableIndex := int((startOffset / clusterSize) / uint64(s.RefcountBlockSize))
+
+	var tableSize int
+	if exactSize {
+		tableSize = totalRefblockCount
+	} else {
+		tableSize = totalRefblockCount + (totalRefblockCount+1)/2
+	}
+	// The qcow2 file can only store the reftable size in number of clusters
+	tableSize = int(roundUp(int64(tableSize), int64(clusterSize/UINT64_SIZE)))
+	tableClusters := (tableSize * UINT64_SIZE) / int(clusterSize)
+
+	if tableSize > MAX_REFTABLE_SIZE {
+		return 0, errors.Wrap(ErrTooLarge, "Refcount table too large")
+	}
+
+	newTable := make([]uint64, tableSize)
+
+	// Fill the new refcount table, which loads the whole old table
+	oldTable, err := s.RefcountTable.entries(bs)
+	if err != nil {
+		return 0, err
+	}
+	if tableSize > s.MaxRefcountTableIndex {
+		// We're actually growing the reftable
+		copy(newTable, oldTable[:s.MaxRefcountTableIndex+1])
+	} else {
+		// Improbable case: We're shrinking the reftable. However, the caller
+		// has assured us that there is only empty space beyond startOffset,
+		// so we can simply drop all of the refblocks that won't fit into the
+		// new reftable.
+		copy(newTable, oldTable[:tableSize])
+	}
+
+	if newRefblockOffset != 0 {
+		newTable[newRefblockIndex] = newRefblockOffset
+	}
+
+	// Count how many new refblocks we have to create
+	var additionalRefblockCount uint64
+	for i := areaReftableIndex; i < totalRefblockCount; i++ {
+		if newTable[i] == 0 {
+			additionalRefblockCount++
+		}
+	}
+
+	tableOffset := startOffset + additionalRefblockCount*clusterSize
+	endOffset := tableOffset + uint64(tableClusters)*clusterSize
+
+	// Fill the refcount blocks, and create new ones, if necessary
+	blockOffset := startOffset
+	for i := areaReftableIndex; i < totalRefblockCount; i++ {
+		var (
+			refblockData []byte
+			err          error
+		)
+
+		// Reuse an existing refblock if possible, create a new one otherwise
+		if newTable[i] != 0 {
+			refblockData, err = loadRefcountBlock(bs, int64(newTable[i]))
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			refblockData, err = cacheGetEmpty(bs, s.RefcountBlockCache, int64(blockOffset))
+			if err != nil {
+				return 0, err
+			}
+			for j := range refblockData {
+				refblockData[j] = 0
+			}
+			cacheEntryMarkDirty(s.RefcountBlockCache, refblockData)
+
+			newTable[i] = blockOffset
+			blockOffset += clusterSize
+		}
+
+		// First host offset covered by this refblock
+		firstOffsetCovered := uint64(i) * uint64(s.RefcountBlockSize) * clusterSize
+		if firstOffsetCovered < endOffset {
+			// Set the refcount of all of the new refcount structures to 1
+			var j uint64
+			if firstOffsetCovered < startOffset {
+				j = (startOffset - firstOffsetCovered) / clusterSize
+			}
+
+			endIndex := (endOffset - firstOffsetCovered) / clusterSize
+			if endIndex > uint64(s.RefcountBlockSize) {
+				endIndex = uint64(s.RefcountBlockSize)
+			}
+
+			for ; j < endIndex; j++ {
+				// The caller guaranteed us this space would be empty
+				s.SetRefcount(refblockData, j, 1)
+			}
+
+			cacheEntryMarkDirty(s.RefcountBlockCache, refblockData)
+		}
+
+		cachePut(s.RefcountBlockCache, refblockData)
+	}
+
+	// Write refcount blocks to disk
+	if err := cacheFlush(bs, s.RefcountBlockCache); err != nil {
+		return 0, err
+	}
+
+	// Write refcount table to disk
+	if err := preWriteOverlapCheck(bs, 0, int64(tableOffset), int64(tableSize)*UINT64_SIZE); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, tableSize*UINT64_SIZE)
+	for i, e := range newTable {
+		copy(buf[i*UINT64_SIZE:], BEUvarint64(e))
+	}
+	if err := bdrvPwriteSync(bs.file, int64(tableOffset), buf); err != nil {
+		return 0, err
+	}
+
+	// Hook up the new refcount table in the qcow2 header
+	data := make([]byte, UINT64_SIZE+UINT32_SIZE)
+	copy(data, BEUvarint64(tableOffset))
+	copy(data[UINT64_SIZE:], BEUvarint32(uint32(tableClusters)))
+	if err := bdrvPwriteSync(bs.file, int64(unsafe.Offsetof(Header{}.RefcountTableOffset)), data); err != nil {
+		return 0, err
+	}
+
+	// And switch it in memory
+	oldTableOffset := s.RefcountTableOffset
+	oldTableSize := s.RefcountTableSize
+
+	s.RefcountTable = newRefcountTableFrom(tableOffset, newTable)
+	s.RefcountTableSize = uint32(tableSize)
+	s.RefcountTableOffset = tableOffset
+	updateMaxRefcountTableIndex(s)
+
+	// Free old table.
+	freeClusters(bs, int64(oldTableOffset), int64(oldTableSize)*UINT64_SIZE, DISCARD_OTHER)
 
-	// TODO(zchee): implements qcow2_cache_put
-	// qcow2_cache_put(bs, s->refcount_block_cache, &refcount_block);
+	return int64(endOffset), nil
+}
+
+// refcountMetadataSize return the size of the refcount metadata in bytes, and the number of
+// refcount blocks which are needed to cover the clusters, and the refcount metadata itself.
+//  block/qcow2-refcount.c: int64_t qcow2_refcount_metadata_size(int64_t clusters, size_t cluster_size, int refcount_order, bool generous_increase, uint64_t *refblock_count)
+func refcountMetadataSize(clusters, clusterSize int64, refcountOrder int, generousIncrease bool) (int64, uint64) {
+	// Every host cluster is reference-counted, including metadata (even
+	// refcount metadata is recursively included).
+	//
+	// An accurate formula for the size of refcount metadata size is difficult
+	// to derive.  An easier method of calculation is finding the fixed point
+	// where no further refcount blocks or table clusters are required to
+	// reference count every cluster.
+	blocksPerTableCluster := clusterSize / UINT64_SIZE
+	refcountsPerBlock := clusterSize * 8 / (1 << uint(refcountOrder))
+
+	var (
+		table  int64 // number of refcount table clusters
+		blocks int64 // number of refcount block clusters
+		last   int64
+		n      int64
+	)
+	for {
+		last = n
+		blocks = (clusters + table + blocks + refcountsPerBlock - 1) / refcountsPerBlock
+		table = (blocks + blocksPerTableCluster - 1) / blocksPerTableCluster
+		n = clusters + blocks + table
+
+		if n == last && generousIncrease {
+			clusters += (table + 1) / 2
+			n = 0 // force another loop
+			generousIncrease = false
+		}
+		if n == last {
+			break
+		}
+	}
 
-	return refcount, nil
+	return (blocks + table) * clusterSize, uint64(blocks)
 }
 
+// AllocClusters allocates the clusters of size bytes, and increases its refcount.
+// Returns the offset of the first allocated cluster.
+//  block/qcow2-refcount.c: int64_t qcow2_alloc_clusters(BlockDriverState *bs, uint64_t size)
 func AllocClusters(bs *BlockDriverState, size uint64) (int64, error) {
 	var (
 		offset int64
@@ -66,33 +576,59 @@ func AllocClusters(bs *BlockDriverState, size uint64) (int64, error) {
 
 	for {
 		offset, err = AllocClustersNoref(bs, size)
-		if err != nil || offset < 0 {
-			return offset, err
+		if err != nil {
+			return 0, err
 		}
 
 		err = updateRefcount(bs, offset, int64(size), 1, false, DISCARD_NEVER)
-		if err != syscall.EAGAIN {
+		if !errors.Is(err, syscall.EAGAIN) {
 			break
 		}
 	}
 
+	if err != nil {
+		return 0, err
+	}
+
 	return offset, nil
 }
 
+// allocClusterAt allocates the cluster at offset if it is free, and reports whether it is allocated.
+//  block/qcow2-refcount.c: int64_t qcow2_alloc_clusters_at(BlockDriverState *bs, uint64_t offset, int64_t nb_clusters)
+func allocClusterAt(bs *BlockDriverState, offset uint64) (bool, error) {
+	s := bs.Opaque
+
+	for {
+		refcount, err := getRefcount(bs, offset>>uint(s.ClusterBits))
+		if err != nil {
+			return false, err
+		}
+		if refcount != 0 {
+			return false, nil
+		}
+
+		err = updateRefcount(bs, int64(offset), int64(s.ClusterSize), 1, false, DISCARD_NEVER)
+		if !errors.Is(err, syscall.EAGAIN) {
+			return err == nil, err
+		}
+	}
+}
+
+// AllocClustersNoref finds the free contiguous clusters of size bytes, without increasing its refcount.
+//  block/qcow2-refcount.c: static int64_t alloc_clusters_noref(BlockDriverState *bs, uint64_t size)
 func AllocClustersNoref(bs *BlockDriverState, size uint64) (int64, error) {
 	s := bs.Opaque
 
 	// We can't allocate clusters if they may still be queued for discard
 	if s.CacheDiscards {
-		// TODO(zchee): implements
-		// void qcow2_process_discards(BlockDriverState *bs, int ret)
+		processDiscards(bs, nil)
 	}
 
 	nbClusters := sizeToClusters(s, size)
 retry:
 	for i := uint64(0); i < nbClusters; i++ {
-		s.FreeClusterIndex++
 		nextClusterIndex := s.FreeClusterIndex
+		s.FreeClusterIndex++
 		refcount, err := getRefcount(bs, nextClusterIndex)
 
 		if err != nil {
@@ -103,35 +639,1202 @@ retry:
 		}
 	}
 
+	// Make sure that all offsets in the "allocated" range are representable
+	// in an int64_t
 	if s.FreeClusterIndex > 0 && s.FreeClusterIndex-1 > (INT64_MAX>>uint(s.ClusterBits)) {
-		err := errors.New("File too large")
-		return 0, err
+		return 0, errors.Wrap(ErrTooLarge, "Image file too large")
 	}
 
 	return int64((s.FreeClusterIndex - nbClusters) << uint64(s.ClusterBits)), nil
 }
 
-var refcountBlock = [8][]byte{}
+// allocBytes allocates size bytes in the image file for the compressed cluster, and increases the refcount of
+// the clusters which contain them. The small allocations are packed into the same cluster by s.FreeByteOffset.
+// Returns the offset of the allocated bytes.
+//  block/qcow2-refcount.c: int64_t qcow2_alloc_bytes(BlockDriverState *bs, int size)
+func allocBytes(bs *BlockDriverState, size int) (int64, error) {
+	s := bs.Opaque
+
+	if size <= 0 || size > s.ClusterSize {
+		return 0, syscall.EINVAL
+	}
+
+	offset := int64(s.FreeByteOffset)
+	if offset != 0 {
+		refcount, err := getRefcount(bs, uint64(offset>>uint(s.ClusterBits)))
+		if err != nil {
+			return 0, err
+		}
+		if refcount == s.RefcountMax {
+			offset = 0
+		}
+	}
+
+	freeInCluster := int64(s.ClusterSize) - int64(offsetIntoCluster(s, offset))
+	var err error
+	for {
+		if offset == 0 || freeInCluster < int64(size) {
+			newCluster, err := AllocClustersNoref(bs, uint64(s.ClusterSize))
+			if err != nil {
+				return 0, err
+			}
+			if newCluster == 0 {
+				err := signalCorruption(bs, true, -1, "Preventing invalid allocation of compressed cluster at offset 0")
+				return 0, err
+			}
+
+			if offset == 0 || roundUp(offset, int64(s.ClusterSize)) != newCluster {
+				offset = newCluster
+				freeInCluster = int64(s.ClusterSize)
+			} else {
+				freeInCluster += int64(s.ClusterSize)
+			}
+		}
+
+		err = updateRefcount(bs, offset, int64(size), 1, false, DISCARD_NEVER)
+		if err != nil {
+			offset = 0
+		}
+		if !errors.Is(err, syscall.EAGAIN) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The cluster refcount was incremented; refcount blocks must be flushed
+	// before the caller's L2 table updates.
+	if err := cacheSetDependency(bs, s.L2TableCache, s.RefcountBlockCache); err != nil {
+		return 0, err
+	}
+
+	s.FreeByteOffset = uint64(offset) + uint64(size)
+	if offsetIntoCluster(s, int64(s.FreeByteOffset)) == 0 {
+		s.FreeByteOffset = 0
+	}
+
+	return offset, nil
+}
+
+// processDiscards discards the queued ranges of the image file.
+// If err is not nil, the queued ranges are dropped without discarding.
+//  block/qcow2-refcount.c: void qcow2_process_discards(BlockDriverState *bs, int ret)
+func processDiscards(bs *BlockDriverState, err error) {
+	s := bs.Opaque
+
+	for _, d := range s.Discards {
+		// Discard is optional, ignore the return value
+		if err == nil {
+			bdrvPdiscard(bs.file, int64(d.Offset), int64(d.Bytes))
+		}
+	}
+	s.Discards = nil
+}
+
+// updateRefcountDiscard queues the range of the image file to discard, and merges it with the adjacent ranges.
+//  block/qcow2-refcount.c: static void update_refcount_discard(BlockDriverState *bs, uint64_t offset, uint64_t length)
+func updateRefcountDiscard(bs *BlockDriverState, offset, length uint64) {
+	s := bs.Opaque
+
+	var d *DiscardRegion
+	for _, r := range s.Discards {
+		newStart := offset
+		if r.Offset < newStart {
+			newStart = r.Offset
+		}
+		newEnd := offset + length
+		if r.Offset+r.Bytes > newEnd {
+			newEnd = r.Offset + r.Bytes
+		}
+
+		if newEnd-newStart <= length+r.Bytes {
+			// There can't be any overlap, areas ending up here have no
+			// references any more and therefore shouldn't get freed another
+			// time.
+			r.Offset = newStart
+			r.Bytes = newEnd - newStart
+			d = r
+			break
+		}
+	}
+
+	if d == nil {
+		d = &DiscardRegion{
+			Bs:     bs,
+			Offset: offset,
+			Bytes:  length,
+		}
+		s.Discards = append(s.Discards, d)
+	}
+
+	// Merge discard requests if they are adjacent now
+	discards := s.Discards[:0]
+	for _, p := range s.Discards {
+		if p == d || p.Offset > d.Offset+d.Bytes || d.Offset > p.Offset+p.Bytes {
+			discards = append(discards, p)
+			continue
+		}
+
+		// Still no overlap possible
+		if p.Offset < d.Offset {
+			d.Offset = p.Offset
+		}
+		d.Bytes += p.Bytes
+	}
+	s.Discards = discards
+}
+
+// freeClusters decreases the refcount of the clusters from offset to offset+size.
+//  block/qcow2-refcount.c: void qcow2_free_clusters(BlockDriverState *bs, int64_t offset, int64_t size, enum qcow2_discard_type type)
+func freeClusters(bs *BlockDriverState, offset, size int64, typ DiscardType) error {
+	if err := updateRefcount(bs, offset, size, 1, true, typ); err != nil {
+		// TODO(zchee): remember the clusters to free them later and avoid leaking
+		bdrvLogf(bs, LogWarn, "qcow2_free_clusters failed: %v", err)
+		return errors.Wrap(err, "qcow2_free_clusters failed")
+	}
+	return nil
+}
 
-func updateRefcount(bs *BlockDriverState, offset, length int64, addend uint64, decrease bool, typ DiscardType) error {
+// updateRefcount increases or decreases the refcount of the clusters from offset to offset+length by addend.
+//  block/qcow2-refcount.c: static int QEMU_WARN_UNUSED_RESULT update_refcount(BlockDriverState *bs, int64_t offset, int64_t length, uint64_t addend, bool decrease, enum qcow2_discard_type type)
+func updateRefcount(bs *BlockDriverState, offset, length int64, addend uint64, decrease bool, typ DiscardType) (err error) {
 	s := bs.Opaque
+
+	if length < 0 {
+		return syscall.EINVAL
+	} else if length == 0 {
+		return nil
+	}
+
+	if decrease {
+		if err := cacheSetDependency(bs, s.RefcountBlockCache, s.L2TableCache); err != nil {
+			return err
+		}
+		// the L2 tables in the image file must not refer to the wiped clusters, such as the old clusters of
+		// the copy-on-write, which are freed before the updated L2 tables are written
+		if s.WipeFreed {
+			if err := cacheFlush(bs, s.L2TableCache); err != nil {
+				return err
+			}
+		}
+	}
+
+	var (
+		refcountBlock []byte
+		oldTableIndex = int64(-1)
+		clusterOffset int64
+	)
+
+	defer func() {
+		// Write last changed block to disk
+		if refcountBlock != nil {
+			cachePut(s.RefcountBlockCache, refcountBlock)
+			refcountBlock = nil
+		}
+
+		// Try do undo any updates if an error is returned (This may succeed in
+		// some cases like ENOSPC for allocating a new refcount block)
+		if err != nil {
+			updateRefcount(bs, offset, clusterOffset-offset, addend, !decrease, DISCARD_NEVER)
+		}
+
+		if !s.CacheDiscards {
+			processDiscards(bs, err)
+		}
+	}()
+
 	start := startOfCluster(int64(s.ClusterSize), offset)
 	last := startOfCluster(int64(s.ClusterSize), offset+length-1)
-	// log.Printf("start: %+v last: %+v\n", start, last)
 
-	for clusterOffset := start; clusterOffset <= last; clusterOffset += int64(s.ClusterSize) {
-		refcountBlockBits := s.ClusterBits - (s.RefcountOrder - 3)
-		refcountBlockSize := 1 << uint(refcountBlockBits)
+	for clusterOffset = start; clusterOffset <= last; clusterOffset += int64(s.ClusterSize) {
 		clusterIndex := clusterOffset >> uint(s.ClusterBits)
+		tableIndex := clusterIndex >> uint(s.RefcountBlockBits)
+
+		// Load the refcount block and allocate it if needed
+		if tableIndex != oldTableIndex {
+			if refcountBlock != nil {
+				cachePut(s.RefcountBlockCache, refcountBlock)
+				refcountBlock = nil
+			}
+			refcountBlock, err = allocRefcountBlock(bs, clusterIndex)
+			if err != nil {
+				return err
+			}
+		}
+		oldTableIndex = tableIndex
 
-		blockIndex := clusterIndex & int64(refcountBlockSize-1)
+		cacheEntryMarkDirty(s.RefcountBlockCache, refcountBlock)
 
-		refcount := getRefcountRO4(&refcountBlock, uint8(blockIndex))
+		// we can update the count and save it
+		blockIndex := uint64(clusterIndex) & uint64(s.RefcountBlockSize-1)
 
-		setRefcountRO4(&refcountBlock, uint8(blockIndex), refcount)
-	}
-	// TODO(zchee): hardcoded 131072
-	writeFile(bs, 131072, bytes.Join(refcountBlock[:], nil), int(offset+length))
+		refcount := s.GetRefcount(refcountBlock, blockIndex)
+		if decrease && refcount-addend > refcount ||
+			!decrease && (refcount+addend < refcount || refcount+addend > s.RefcountMax) {
+			return syscall.ERANGE
+		}
+		if decrease {
+			refcount -= addend
+		} else {
+			refcount += addend
+		}
+		// the cluster is not freed if it can not be wiped
+		if refcount == 0 && s.WipeFreed {
+			if err := wipeCluster(bs, clusterOffset); err != nil {
+				return err
+			}
+		}
+		if refcount == 0 && uint64(clusterIndex) < s.FreeClusterIndex {
+			s.FreeClusterIndex = uint64(clusterIndex)
+		}
+		s.SetRefcount(refcountBlock, blockIndex, refcount)
+
+		if refcount == 0 {
+			// the cached table of the freed cluster must not be written back
+			if table := cacheIsTableOffset(s.RefcountBlockCache, clusterOffset); table != nil {
+				cachePut(s.RefcountBlockCache, refcountBlock)
+				refcountBlock = nil
+				oldTableIndex = -1
+				cacheDiscard(s.RefcountBlockCache, table)
+			}
+			cacheDiscardOffset(s.L2TableCache, clusterOffset)
+
+			if s.DiscardPassthrough[typ] {
+				updateRefcountDiscard(bs, uint64(clusterOffset), uint64(s.ClusterSize))
+			}
+		}
+	}
+
+	return nil
+}
+
+// wipeCluster overwrites the cluster at offset of the image file with zeros, before it is freed by s.WipeFreed.
+// The zeros are written instead of discarded, since the discarded range may still hold the data on the storage.
+func wipeCluster(bs *BlockDriverState, offset int64) error {
+	s := bs.Opaque
+
+	for end := offset + int64(s.ClusterSize); offset < end; {
+		n := MIN(len(zeroBlock), int(end-offset))
+		if err := bdrvPwrite(bs.file, offset, zeroBlock[:n]); err != nil {
+			err = errors.Wrapf(err, "Could not wipe the freed cluster at %#x", offset)
+			return err
+		}
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// updateClusterRefcount increases or decreases the refcount of the cluster of clusterIndex by addend.
+//  block/qcow2-refcount.c: int qcow2_update_cluster_refcount(BlockDriverState *bs, int64_t cluster_index, uint64_t addend, bool decrease, enum qcow2_discard_type type)
+func updateClusterRefcount(bs *BlockDriverState, clusterIndex int64, addend uint64, decrease bool, typ DiscardType) error {
+	s := bs.Opaque
+
+	return updateRefcount(bs, clusterIndex<<uint(s.ClusterBits), 1, addend, decrease, typ)
+}
+
+// updateSnapshotRefcount increases or decreases by addend the refcounts of the L2 tables and the clusters which
+// are referred by the L1 table of l1Size entries at l1TableOffset, and updates the OFLAG_COPIED flags of the L1
+// and L2 entries by the new refcounts. addend is -1, 0 or 1, and 0 only updates the flags.
+//
+// If l1TableOffset is the offset of the active L1 table, the in-memory s.L1Table is used instead of reading it,
+// and the modified entries are also updated in it.
+//  block/qcow2-refcount.c: int qcow2_update_snapshot_refcount(BlockDriverState *bs, int64_t l1_table_offset, int l1_size, int addend)
+func updateSnapshotRefcount(bs *BlockDriverState, l1TableOffset uint64, l1Size int, addend int) (err error) {
+	s := bs.Opaque
+
+	if addend < -1 || addend > 1 {
+		return syscall.EINVAL
+	}
+	decrease := addend < 0
+	absAddend := uint64(addend)
+	if decrease {
+		absAddend = uint64(-addend)
+	}
+
+	s.CacheDiscards = true
+
+	var (
+		l1Table    []uint64
+		l1Modified bool
+	)
+	defer func() {
+		s.CacheDiscards = false
+		processDiscards(bs, err)
+
+		// Update L1 only if it isn't deleted anyway (addend = -1)
+		if err == nil && addend >= 0 && l1Modified {
+			buf := make([]byte, l1Size*UINT64_SIZE)
+			for i, e := range l1Table {
+				copy(buf[i*UINT64_SIZE:], BEUvarint64(e))
+			}
+			err = bdrvPwriteSync(bs.file, int64(l1TableOffset), buf)
+		}
+	}()
+
+	// WARNING: snapshotGoto relies on this function not using the
+	// l1TableOffset when it is the current s.L1TableOffset! Be careful
+	// when changing this!
+	if l1TableOffset != s.L1TableOffset {
+		buf := make([]byte, l1Size*UINT64_SIZE)
+		if err := bdrvPread(bs.file, int64(l1TableOffset), buf); err != nil {
+			return err
+		}
+		l1Table = make([]uint64, l1Size)
+		for i := range l1Table {
+			l1Table[i] = BEUint64(buf[i*UINT64_SIZE:])
+		}
+	} else {
+		if l1Size != s.L1Size {
+			return syscall.EINVAL
+		}
+		if l1Table, err = s.L1Table.entries(bs); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < l1Size; i++ {
+		l2Offset := l1Table[i]
+		if l2Offset == 0 {
+			continue
+		}
+		oldL2Offset := l2Offset
+		l2Offset &= L1E_OFFSET_MASK
+
+		if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+			err := signalCorruption(bs, true, -1, "L2 table offset %#x unaligned (L1 index: %#x)", l2Offset, i)
+			return err
+		}
+
+		l2Table, err := l2Load(context.Background(), bs, l2Offset)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < s.L2Size; j++ {
+			entry := getL2Entry(l2Table, j)
+			oldEntry := entry
+			entry &^= OFLAG_COPIED
+			offset := entry & L2E_OFFSET_MASK
+
+			var refcount uint64
+			switch typ := getClusterType(entry); {
+			case typ == CLUSTER_COMPRESSED:
+				if addend != 0 {
+					nbCsectors := int64((entry>>uint(s.Csize_shift))&uint64(s.Csize_mask)) + 1
+					if err := updateRefcount(bs, int64(entry&s.ClusterOffsetMask)&^511, nbCsectors*512, absAddend, decrease, DISCARD_SNAPSHOT); err != nil {
+						cachePut(s.L2TableCache, l2Table)
+						return err
+					}
+				}
+				// compressed clusters are never modified
+				refcount = 2
+
+			case typ == CLUSTER_NORMAL, typ == CLUSTER_ZERO && offset != 0:
+				if offsetIntoCluster(s, int64(offset)) != 0 {
+					cachePut(s.L2TableCache, l2Table)
+					err := signalCorruption(bs, true, -1, "Cluster allocation offset %#x unaligned (L2 offset: %#x, L2 index: %#x)", offset, l2Offset, j)
+					return err
+				}
+
+				clusterIndex := int64(offset >> uint(s.ClusterBits))
+				if addend != 0 {
+					if err := updateClusterRefcount(bs, clusterIndex, absAddend, decrease, DISCARD_SNAPSHOT); err != nil {
+						cachePut(s.L2TableCache, l2Table)
+						return err
+					}
+				}
+
+				refcount, err = getRefcount(bs, uint64(clusterIndex))
+				if err != nil {
+					cachePut(s.L2TableCache, l2Table)
+					return err
+				}
+
+			default:
+				refcount = 0
+			}
+
+			if refcount == 1 {
+				entry |= OFLAG_COPIED
+			}
+			if entry != oldEntry {
+				if addend > 0 {
+					if err := cacheSetDependency(bs, s.L2TableCache, s.RefcountBlockCache); err != nil {
+						cachePut(s.L2TableCache, l2Table)
+						return err
+					}
+				}
+				setL2Entry(l2Table, j, entry)
+				cacheEntryMarkDirty(s.L2TableCache, l2Table)
+			}
+		}
+
+		cachePut(s.L2TableCache, l2Table)
+
+		if addend != 0 {
+			if err := updateClusterRefcount(bs, int64(l2Offset>>uint(s.ClusterBits)), absAddend, decrease, DISCARD_SNAPSHOT); err != nil {
+				return err
+			}
+		}
+		refcount, err := getRefcount(bs, l2Offset>>uint(s.ClusterBits))
+		if err != nil {
+			return err
+		}
+		if refcount == 1 {
+			l2Offset |= OFLAG_COPIED
+		}
+		if l2Offset != oldL2Offset {
+			l1Table[i] = l2Offset
+			l1Modified = true
+			if l1TableOffset == s.L1TableOffset {
+				if err := s.L1Table.set(bs, i, l2Offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := writeCaches(bs); err != nil {
+		return err
+	}
+
+	return bdrvFlush(bs.file)
+}
+
+// freeAnyClusters decreases the refcount of the nbClusters clusters which the l2Entry points to.
+// The compressed cluster is freed by its compressed size.
+//  block/qcow2-refcount.c: void qcow2_free_any_clusters(BlockDriverState *bs, uint64_t l2_entry, int nb_clusters, enum qcow2_discard_type type)
+func freeAnyClusters(bs *BlockDriverState, l2Entry uint64, nbClusters int, typ DiscardType) error {
+	s := bs.Opaque
+
+	switch getClusterType(l2Entry) {
+	case CLUSTER_COMPRESSED:
+		nbCsectors := int64((l2Entry>>uint(s.Csize_shift))&uint64(s.Csize_mask)) + 1
+		return freeClusters(bs, int64(l2Entry&s.ClusterOffsetMask)&^511, nbCsectors*512, typ)
+
+	case CLUSTER_NORMAL, CLUSTER_ZERO:
+		offset := l2Entry & L2E_OFFSET_MASK
+		if offset == 0 {
+			return nil
+		}
+		if offsetIntoCluster(s, int64(offset)) != 0 {
+			err := signalCorruption(bs, false, int64(offset), "Cannot free unaligned cluster %#x", offset)
+			return err
+		}
+		return freeClusters(bs, int64(offset), int64(nbClusters)<<uint(s.ClusterBits), typ)
+
+	case CLUSTER_UNALLOCATED:
+		return nil
+	}
+
+	return syscall.EINVAL
+}
+
+// freeL2Entries decreases the refcounts of the clusters which the L2 entries point to, such as the old entries
+// of the discarded or the zeroed clusters of a request. The runs of the contiguous host clusters are freed by a
+// single refcount update, so that a refcount block is loaded and marked dirty once per run instead of once per
+// cluster, and the freed range is discarded at once. The compressed clusters are freed one by one.
+// It frees all of the entries, and returns the first error.
+func freeL2Entries(bs *BlockDriverState, entries []uint64, typ DiscardType) error {
+	s := bs.Opaque
+
+	var (
+		runStart, runEnd uint64
+		firstErr         error
+	)
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	flushRun := func() {
+		if runEnd > runStart {
+			record(freeClusters(bs, int64(runStart), int64(runEnd-runStart), typ))
+		}
+		runStart, runEnd = 0, 0
+	}
+
+	for _, e := range entries {
+		offset := e & L2E_OFFSET_MASK
+		switch ctype := getClusterType(e); {
+		case (ctype == CLUSTER_NORMAL || ctype == CLUSTER_ZERO) && offset != 0 && offsetIntoCluster(s, int64(offset)) == 0:
+			if offset != runEnd {
+				flushRun()
+				runStart = offset
+			}
+			runEnd = offset + uint64(s.ClusterSize)
+		default:
+			flushRun()
+			record(freeAnyClusters(bs, e, 1, typ))
+		}
+	}
+	flushRun()
+
+	return firstErr
+}
+
+// overlapCheckTemplate returns the bitmask of the metadata which is checked by the overlap check level of
+// the options of bs.
+//  block/qcow2.c: static int qcow2_update_options_prepare(BlockDriverState *bs, Qcow2ReopenState *r, QDict *options, int flags, Error **errp)
+func overlapCheckTemplate(bs *BlockDriverState) (int, error) {
+	mode := OverlapCheckCached
+	if bs.Options != nil && bs.Options.OverlapCheck != "" {
+		mode = bs.Options.OverlapCheck
+	}
+
+	switch mode {
+	case OverlapCheckNone:
+		return QCOW2_OL_NONE, nil
+	case OverlapCheckConstant:
+		return QCOW2_OL_CONSTANT, nil
+	case OverlapCheckCached:
+		return QCOW2_OL_CACHED, nil
+	case OverlapCheckAll:
+		return QCOW2_OL_ALL, nil
+	}
+
+	err := errors.Wrapf(ErrInvalidOption, "Unsupported value '%s' for qcow2 option 'overlap-check'. "+
+		"Allowed are any of the following: none, constant, cached, all", mode)
+	return 0, err
+}
+
+// checkMetadataOverlap checks whether the range of size bytes at offset of the image file overlaps with the
+// metadata which is checked by s.OverlapCheck, except the metadata of the ign bitmask.
+// It returns the bit of the overlapped metadata, or 0 if the range does not overlap.
+//
+// Unlike qemu, which holds the whole active L1 table and refcount table in the memory, the cached check sees
+// only the L2 tables and the refcount blocks which are referred by the loaded segments of the tables, so the
+// write over the metadata of the guest disk and the host file which are not accessed since the open is not
+// detected by it. The check of all the metadata loads the whole tables, and sees all of them.
+// The caller must hold s.lock.
+//  block/qcow2-refcount.c: int qcow2_check_metadata_overlap(BlockDriverState *bs, int ign, int64_t offset, int64_t size)
+func checkMetadataOverlap(bs *BlockDriverState, ign int, offset, size int64) (int, error) {
+	s := bs.Opaque
+	chk := s.OverlapCheck &^ ign
+
+	if size == 0 {
+		return 0, nil
+	}
+
+	if chk&QCOW2_OL_MAIN_HEADER != 0 {
+		if offset < int64(s.ClusterSize) {
+			return QCOW2_OL_MAIN_HEADER, nil
+		}
+	}
+
+	// align range to test to cluster boundaries
+	size = alignOffset(int64(offsetIntoCluster(s, offset))+size, s.ClusterSize)
+	offset = startOfCluster(int64(s.ClusterSize), offset)
+
+	overlapsWith := func(ofs, sz int64) bool {
+		return ofs < offset+size && offset < ofs+sz
+	}
+
+	if chk&QCOW2_OL_ACTIVE_L1 != 0 && s.L1Size > 0 {
+		if overlapsWith(int64(s.L1TableOffset), int64(s.L1Size)*UINT64_SIZE) {
+			return QCOW2_OL_ACTIVE_L1, nil
+		}
+	}
+
+	if chk&QCOW2_OL_REFCOUNT_TABLE != 0 && s.RefcountTableSize > 0 {
+		if overlapsWith(int64(s.RefcountTableOffset), int64(s.RefcountTableSize)*UINT64_SIZE) {
+			return QCOW2_OL_REFCOUNT_TABLE, nil
+		}
+	}
+
+	if chk&QCOW2_OL_SNAPSHOT_TABLE != 0 && s.SnapshotsSize > 0 {
+		if overlapsWith(int64(s.SnapshotsOffset), int64(s.SnapshotsSize)) {
+			return QCOW2_OL_SNAPSHOT_TABLE, nil
+		}
+	}
+
+	if chk&QCOW2_OL_INACTIVE_L1 != 0 {
+		for _, sn := range s.Snapshots {
+			if sn.L1Size > 0 && overlapsWith(int64(sn.L1TableOffset), int64(sn.L1Size)*UINT64_SIZE) {
+				return QCOW2_OL_INACTIVE_L1, nil
+			}
+		}
+	}
+
+	if chk&QCOW2_OL_ACTIVE_L2 != 0 {
+		// the cached check sees only the L2 tables of the loaded segments of the active L1 table, and the
+		// check of all the metadata loads the whole table
+		if chk&QCOW2_OL_INACTIVE_L2 != 0 {
+			if _, err := s.L1Table.entries(bs); err != nil {
+				return 0, err
+			}
+		}
+		overlapped := false
+		s.L1Table.loadedEntries(func(_ int, l1Entry uint64) bool {
+			l2Offset := l1Entry & L1E_OFFSET_MASK
+			overlapped = l2Offset != 0 && overlapsWith(int64(l2Offset), int64(s.ClusterSize))
+			return !overlapped
+		})
+		if overlapped {
+			return QCOW2_OL_ACTIVE_L2, nil
+		}
+	}
+
+	if chk&QCOW2_OL_REFCOUNT_BLOCK != 0 && s.RefcountTable != nil {
+		// same as the L2 tables, the cached check sees only the refcount blocks of the loaded segments of the
+		// refcount table
+		if chk&QCOW2_OL_INACTIVE_L2 != 0 {
+			if _, err := s.RefcountTable.entries(bs); err != nil {
+				return 0, err
+			}
+		}
+		overlapped := false
+		s.RefcountTable.loadedEntries(func(i int, reftEntry uint64) bool {
+			if i > s.MaxRefcountTableIndex {
+				return false
+			}
+			refblockOffset := reftEntry & REFT_OFFSET_MASK
+			overlapped = refblockOffset != 0 && overlapsWith(int64(refblockOffset), int64(s.ClusterSize))
+			return !overlapped
+		})
+		if overlapped {
+			return QCOW2_OL_REFCOUNT_BLOCK, nil
+		}
+	}
+
+	if chk&QCOW2_OL_INACTIVE_L2 != 0 {
+		for _, sn := range s.Snapshots {
+			l1 := make([]byte, int(sn.L1Size)*UINT64_SIZE)
+			if err := bdrvPread(bs.file, int64(sn.L1TableOffset), l1); err != nil {
+				return 0, err
+			}
+
+			for j := 0; j < len(l1); j += UINT64_SIZE {
+				if l2Offset := BEUint64(l1[j:]) & L1E_OFFSET_MASK; l2Offset != 0 && overlapsWith(int64(l2Offset), int64(s.ClusterSize)) {
+					return QCOW2_OL_INACTIVE_L2, nil
+				}
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// metadataOlNames the names of the metadata of the overlap check bits.
+//  block/qcow2-refcount.c: static const char *metadata_ol_names[]
+var metadataOlNames = [QCOW2_OL_MAX_BITNR]string{
+	QCOW2_OL_MAIN_HEADER_BITNR:    "qcow2_header",
+	QCOW2_OL_ACTIVE_L1_BITNR:      "active L1 table",
+	QCOW2_OL_ACTIVE_L2_BITNR:      "active L2 table",
+	QCOW2_OL_REFCOUNT_TABLE_BITNR: "refcount table",
+	QCOW2_OL_REFCOUNT_BLOCK_BITNR: "refcount block",
+	QCOW2_OL_SNAPSHOT_TABLE_BITNR: "snapshot table",
+	QCOW2_OL_INACTIVE_L1_BITNR:    "inactive L1 table",
+	QCOW2_OL_INACTIVE_L2_BITNR:    "inactive L2 table",
+}
+
+// preWriteOverlapCheck checks the write of size bytes at offset of the image file by checkMetadataOverlap,
+// and returns the CorruptionError if the write overlaps with the metadata.
+// The caller must hold s.lock.
+//  block/qcow2-refcount.c: int qcow2_pre_write_overlap_check(BlockDriverState *bs, int ign, int64_t offset, int64_t size)
+func preWriteOverlapCheck(bs *BlockDriverState, ign int, offset, size int64) error {
+	ret, err := checkMetadataOverlap(bs, ign, offset, size)
+	if err != nil {
+		return err
+	}
+	if ret > 0 {
+		metadataOlBitnr := ctz32(uint32(ret))
+		err := signalCorruption(bs, true, offset, "Preventing invalid write on metadata (overlaps with %s)", metadataOlNames[metadataOlBitnr])
+		return err
+	}
+
+	return nil
+}
+
+// incRefcounts increases the refcount of the clusters from offset to offset+size in refcountTable, which is
+// the refcount table of the check built in memory. refcountTable grows if the clusters exceed its size.
+// The region which exceeds the end of the image file by one cluster or more is counted as the corruption, so
+// the bogus offset of the hostile image does not grow refcountTable without bound.
+//  block/qcow2-refcount.c: int qcow2_inc_refcounts_imrt(BlockDriverState *bs, BdrvCheckResult *res, void **refcount_table, int64_t *refcount_table_size, int64_t offset, int64_t size)
+func incRefcounts(bs *BlockDriverState, res *BdrvCheckResult, refcountTable *[]uint64, offset, size int64) {
+	s := bs.Opaque
+
+	if size <= 0 {
+		return
+	}
+
+	start := startOfCluster(int64(s.ClusterSize), offset)
+	last := startOfCluster(int64(s.ClusterSize), offset+size-1)
+
+	if last>>uint(s.ClusterBits) >= int64(len(*refcountTable)) {
+		fileLength, err := bs.file.bs.File.Size()
+		if err != nil {
+			res.CheckErrors++
+			return
+		}
+		if offset+size-fileLength > int64(s.ClusterSize) {
+			bdrvLogf(bs, LogError, "ERROR: counting reference for region exceeding the end of the file by one cluster or more: offset %#x size %#x", offset, size)
+			res.Corruptions++
+			return
+		}
+	}
+	for clusterOffset := start; clusterOffset <= last; clusterOffset += int64(s.ClusterSize) {
+		k := clusterOffset >> uint(s.ClusterBits)
+		if k >= int64(len(*refcountTable)) {
+			*refcountTable = append(*refcountTable, make([]uint64, k+1-int64(len(*refcountTable)))...)
+		}
+
+		if (*refcountTable)[k] == s.RefcountMax {
+			bdrvLogf(bs, LogError, "ERROR: overflow cluster offset=%#x", clusterOffset)
+			bdrvLogf(bs, LogError, "Use qemu-img amend to increase the refcount entry width or qemu-img convert to create a clean copy if the image cannot be opened for writing")
+			res.Corruptions++
+			continue
+		}
+		(*refcountTable)[k]++
+	}
+}
+
+// checkRefcountsL2 increases the refcount of the clusters which the entries of the L2 table at l2Offset refer to.
+// If flags has CHECK_FRAG_INFO, the allocation and the fragmentation of the clusters are counted in res.Bfi,
+// and nextContiguousOffset is the host offset which follows the last allocated cluster.
+//  block/qcow2-refcount.c: static int check_refcounts_l2(BlockDriverState *bs, BdrvCheckResult *res, void **refcount_table, int64_t *refcount_table_size, int64_t l2_offset, int flags, BdrvCheckMode fix, bool active)
+func checkRefcountsL2(bs *BlockDriverState, res *BdrvCheckResult, refcountTable *[]uint64, l2Offset int64, flags int, nextContiguousOffset *uint64) error {
+	s := bs.Opaque
+
+	// Read L2 table from disk
+	l2Table := make([]byte, s.ClusterSize)
+	if err := bdrvPread(bs.file, l2Offset, l2Table); err != nil {
+		bdrvLogf(bs, LogError, "ERROR: I/O error in check_refcounts_l2")
+		res.CheckErrors++
+		return err
+	}
+
+	// Do the actual checks
+	for i := 0; i < s.L2Size; i++ {
+		l2Entry := getL2Entry(l2Table, i)
+
+		switch getClusterType(l2Entry) {
+		case CLUSTER_COMPRESSED:
+			// Compressed clusters don't have QCOW_OFLAG_COPIED
+			if l2Entry&OFLAG_COPIED != 0 {
+				bdrvLogf(bs, LogError, "ERROR: coffset=%#x: copied flag must never be set for compressed clusters", l2Entry&s.ClusterOffsetMask)
+				l2Entry &^= OFLAG_COPIED
+				res.Corruptions++
+			}
+
+			// Mark cluster as used
+			nbCsectors := int64((l2Entry>>uint(s.Csize_shift))&uint64(s.Csize_mask)) + 1
+			l2Entry &= s.ClusterOffsetMask
+			incRefcounts(bs, res, refcountTable, int64(l2Entry&^511), nbCsectors*512)
+
+			if flags&CHECK_FRAG_INFO != 0 {
+				res.Bfi.AllocatedClusters++
+				res.Bfi.CompressedClusters++
+
+				// Compressed clusters are fragmented by nature.  Since they
+				// take up sub-sector space but we only have sector granularity
+				// I/O we need to re-read the same sectors even for adjacent
+				// compressed clusters.
+				res.Bfi.FragmentedClusters++
+			}
+
+		case CLUSTER_ZERO, CLUSTER_NORMAL:
+			offset := l2Entry & L2E_OFFSET_MASK
+			if offset == 0 {
+				// the zero cluster without the preallocated host cluster
+				continue
+			}
+
+			if flags&CHECK_FRAG_INFO != 0 {
+				res.Bfi.AllocatedClusters++
+				if *nextContiguousOffset != 0 && offset != *nextContiguousOffset {
+					res.Bfi.FragmentedClusters++
+				}
+				*nextContiguousOffset = offset + uint64(s.ClusterSize)
+			}
+
+			// Correct offsets are cluster aligned
+			if offsetIntoCluster(s, int64(offset)) != 0 {
+				bdrvLogf(bs, LogError, "ERROR offset=%#x: Cluster is not properly aligned; L2 entry corrupted.", offset)
+				res.Corruptions++
+			}
+
+			// Mark cluster as used
+			incRefcounts(bs, res, refcountTable, int64(offset), int64(s.ClusterSize))
+
+		case CLUSTER_UNALLOCATED:
+			// nothing to do
+		}
+	}
+
+	return nil
+}
+
+// checkRefcountsL1 increases the refcount of the L1 table of l1Size entries at l1TableOffset, and of the clusters
+// which the L2 tables of the L1 table refer to. Returns the error of ctx if ctx is done.
+//  block/qcow2-refcount.c: static int check_refcounts_l1(BlockDriverState *bs, BdrvCheckResult *res, void **refcount_table, int64_t *refcount_table_size, int64_t l1_table_offset, int l1_size, int flags, BdrvCheckMode fix, bool active)
+func checkRefcountsL1(ctx context.Context, bs *BlockDriverState, res *BdrvCheckResult, refcountTable *[]uint64, l1TableOffset int64, l1Size int, flags int) error {
+	s := bs.Opaque
+
+	// Mark L1 table as used
+	incRefcounts(bs, res, refcountTable, l1TableOffset, int64(l1Size)*UINT64_SIZE)
+
+	// Read L1 table entries from disk
+	if l1Size == 0 {
+		return nil
+	}
+	l1Table := make([]byte, l1Size*UINT64_SIZE)
+	if err := bdrvPread(bs.file, l1TableOffset, l1Table); err != nil {
+		bdrvLogf(bs, LogError, "ERROR: I/O error in check_refcounts_l1")
+		res.CheckErrors++
+		return err
+	}
+
+	// Do the actual checks
+	var nextContiguousOffset uint64
+	for i := 0; i < l1Size; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l2Offset := BEUint64(l1Table[i*UINT64_SIZE:]) & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+
+		// Mark L2 table as used
+		incRefcounts(bs, res, refcountTable, int64(l2Offset), int64(s.ClusterSize))
+
+		// L2 tables are cluster aligned
+		if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+			bdrvLogf(bs, LogError, "ERROR l2_offset=%#x: Table is not cluster aligned; L1 entry corrupted", l2Offset)
+			res.Corruptions++
+		}
+
+		// Process and check L2 entries
+		if err := checkRefcountsL2(bs, res, refcountTable, int64(l2Offset), flags, &nextContiguousOffset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkOflagCopied checks the OFLAG_COPIED flag of the entries of the active L1 table and the L2 tables,
+// which must be set if and only if the refcount of the cluster is 1.
+// If fix has BDRV_FIX_ERRORS, the wrong flags are repaired.
+//  block/qcow2-refcount.c: static int check_oflag_copied(BlockDriverState *bs, BdrvCheckResult *res, BdrvCheckMode fix)
+func checkOflagCopied(bs *BlockDriverState, res *BdrvCheckResult, fix CheckMode) error {
+	s := bs.Opaque
+
+	prefix := "ERROR"
+	if fix&BDRV_FIX_ERRORS != 0 {
+		prefix = "Repairing"
+	}
+
+	l1Table, err := s.L1Table.entries(bs)
+	if err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	l2Table := make([]byte, s.ClusterSize)
+	for i, l1Entry := range l1Table {
+		l2Offset := l1Entry & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+
+		refcount, err := getRefcount(bs, l2Offset>>uint(s.ClusterBits))
+		if err != nil {
+			// don't print message nor increment check_errors
+			continue
+		}
+		if (refcount == 1) != (l1Entry&OFLAG_COPIED != 0) {
+			bdrvLogf(bs, LogError, "%s OFLAG_COPIED L2 cluster: l1_index=%d l1_entry=%#x refcount=%d", prefix, i, l1Entry, refcount)
+			res.Corruptions++
+			if fix&BDRV_FIX_ERRORS != 0 {
+				l1Entry ^= OFLAG_COPIED
+				if err := s.L1Table.set(bs, i, l1Entry); err != nil {
+					res.CheckErrors++
+					return err
+				}
+				if err := writeL1Entry(bs, i); err != nil {
+					res.CheckErrors++
+					return err
+				}
+				res.Corruptions--
+				res.CorruptionsFixed++
+			}
+		}
+
+		if err := bdrvPread(bs.file, int64(l2Offset), l2Table); err != nil {
+			bdrvLogf(bs, LogError, "ERROR: Could not read L2 table: %v", err)
+			res.CheckErrors++
+			return err
+		}
+
+		var l2Dirty int
+		for j := 0; j < s.L2Size; j++ {
+			l2Entry := getL2Entry(l2Table, j)
+			dataOffset := l2Entry & L2E_OFFSET_MASK
+			typ := getClusterType(l2Entry)
+
+			if typ != CLUSTER_NORMAL && (typ != CLUSTER_ZERO || dataOffset == 0) {
+				continue
+			}
+
+			refcount, err := getRefcount(bs, dataOffset>>uint(s.ClusterBits))
+			if err != nil {
+				// don't print message nor increment check_errors
+				continue
+			}
+			if (refcount == 1) != (l2Entry&OFLAG_COPIED != 0) {
+				bdrvLogf(bs, LogError, "%s OFLAG_COPIED data cluster: l2_entry=%#x refcount=%d", prefix, l2Entry, refcount)
+				res.Corruptions++
+				if fix&BDRV_FIX_ERRORS != 0 {
+					if refcount == 1 {
+						setL2Entry(l2Table, j, l2Entry|OFLAG_COPIED)
+					} else {
+						setL2Entry(l2Table, j, l2Entry&^OFLAG_COPIED)
+					}
+					l2Dirty++
+				}
+			}
+		}
+
+		if l2Dirty > 0 {
+			if err := preWriteOverlapCheck(bs, QCOW2_OL_ACTIVE_L2, int64(l2Offset), int64(s.ClusterSize)); err != nil {
+				bdrvLogf(bs, LogError, "ERROR: Could not write L2 table; metadata overlap check failed: %v", err)
+				res.CheckErrors++
+				return err
+			}
+			if err := bdrvPwrite(bs.file, int64(l2Offset), l2Table); err != nil {
+				bdrvLogf(bs, LogError, "ERROR: Could not write L2 table: %v", err)
+				res.CheckErrors++
+				return err
+			}
+			// the cached table is older than the repaired one
+			cacheDiscardOffset(s.L2TableCache, int64(l2Offset))
+
+			res.Corruptions -= l2Dirty
+			res.CorruptionsFixed += l2Dirty
+		}
+	}
+
+	return nil
+}
+
+// checkRefblocks checks the entries of the refcount table, and increases the refcount of the refcount blocks.
+// Returns true if the refcount structures need to be rebuilt.
+//  block/qcow2-refcount.c: static int check_refblocks(BlockDriverState *bs, BdrvCheckResult *res, BdrvCheckMode fix, bool *rebuild, void **refcount_table, int64_t *nb_clusters)
+func checkRefblocks(bs *BlockDriverState, res *BdrvCheckResult, refcountTable *[]uint64, nbClusters int64) (bool, error) {
+	s := bs.Opaque
+
+	reftable, err := s.RefcountTable.entries(bs)
+	if err != nil {
+		return false, err
+	}
+
+	var rebuild bool
+	for i, reftEntry := range reftable {
+		offset := reftEntry & REFT_OFFSET_MASK
+		cluster := offset >> uint(s.ClusterBits)
+
+		if reftEntry&REFT_RESERVED_MASK != 0 {
+			bdrvLogf(bs, LogError, "ERROR refcount table entry %d has reserved bits set", i)
+			res.Corruptions++
+			rebuild = true
+			continue
+		}
+
+		// Refcount blocks are cluster aligned
+		if offsetIntoCluster(s, int64(offset)) != 0 {
+			bdrvLogf(bs, LogError, "ERROR refcount block %d is not cluster aligned; refcount table entry corrupted", i)
+			res.Corruptions++
+			rebuild = true
+			continue
+		}
+
+		if cluster >= uint64(nbClusters) {
+			bdrvLogf(bs, LogError, "ERROR refcount block %d is outside image", i)
+			res.Corruptions++
+			rebuild = true
+			continue
+		}
+
+		if offset != 0 {
+			incRefcounts(bs, res, refcountTable, int64(offset), int64(s.ClusterSize))
+			if (*refcountTable)[cluster] != 1 {
+				bdrvLogf(bs, LogError, "ERROR refcount block %d refcount=%d", i, (*refcountTable)[cluster])
+				res.Corruptions++
+				rebuild = true
+			}
+		}
+	}
+
+	return rebuild, nil
+}
+
+// calculateRefcounts builds the refcount table of the image in memory, by counting the references from all of
+// the metadata of the image. Returns the refcount table, and true if the refcount structures need to be rebuilt.
+//  block/qcow2-refcount.c: static int calculate_refcounts(BlockDriverState *bs, BdrvCheckResult *res, BdrvCheckMode fix, bool *rebuild, void **refcount_table, int64_t *nb_clusters)
+func calculateRefcounts(ctx context.Context, bs *BlockDriverState, res *BdrvCheckResult, nbClusters int64) ([]uint64, bool, error) {
+	s := bs.Opaque
+
+	refcountTable := make([]uint64, nbClusters)
+
+	// header
+	incRefcounts(bs, res, &refcountTable, 0, int64(s.ClusterSize))
+
+	// current L1 table
+	if err := checkRefcountsL1(ctx, bs, res, &refcountTable, int64(s.L1TableOffset), s.L1Size, CHECK_FRAG_INFO); err != nil {
+		return nil, false, err
+	}
+
+	// snapshots
+	for i := range s.Snapshots {
+		sn := &s.Snapshots[i]
+		if offsetIntoCluster(s, int64(sn.L1TableOffset)) != 0 {
+			bdrvLogf(bs, LogError, "ERROR snapshot %s (%s) l1_offset=%#x: L1 table is not cluster aligned; snapshot table entry corrupted", sn.IDStr, sn.Name, sn.L1TableOffset)
+			res.Corruptions++
+			continue
+		}
+		if err := checkRefcountsL1(ctx, bs, res, &refcountTable, int64(sn.L1TableOffset), int(sn.L1Size), 0); err != nil {
+			return nil, false, err
+		}
+	}
+	incRefcounts(bs, res, &refcountTable, int64(s.SnapshotsOffset), int64(s.SnapshotsSize))
+
+	// refcount data
+	incRefcounts(bs, res, &refcountTable, int64(s.RefcountTableOffset), int64(s.RefcountTableSize)*UINT64_SIZE)
+
+	// bitmaps
+	if err := checkBitmapsRefcounts(bs, res, &refcountTable); err != nil {
+		return nil, false, err
+	}
+
+	rebuild, err := checkRefblocks(bs, res, &refcountTable, nbClusters)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return refcountTable, rebuild, nil
+}
+
+// compareRefcounts compares the refcounts of the image with refcountTable, which is built by calculateRefcounts.
+// The leaks and the corruptions are repaired by the fix mode. Returns the index of the last cluster which is in use.
+//  block/qcow2-refcount.c: static void compare_refcounts(BlockDriverState *bs, BdrvCheckResult *res, BdrvCheckMode fix, bool *rebuild, int64_t *highest_cluster, void *refcount_table, int64_t nb_clusters)
+func compareRefcounts(bs *BlockDriverState, res *BdrvCheckResult, fix CheckMode, refcountTable []uint64) int64 {
+	s := bs.Opaque
+
+	var highestCluster int64
+	for i := range refcountTable {
+		refcount1, err := getRefcount(bs, uint64(i))
+		if err != nil {
+			bdrvLogf(bs, LogError, "Can't get refcount for cluster %d: %v", i, err)
+			res.CheckErrors++
+			continue
+		}
+
+		refcount2 := refcountTable[i]
+		if refcount1 > 0 || refcount2 > 0 {
+			highestCluster = int64(i)
+		}
+		if refcount1 == refcount2 {
+			continue
+		}
+
+		// Check if we're allowed to fix the mismatch
+		var fixed *int
+		if refcount1 > refcount2 && fix&BDRV_FIX_LEAKS != 0 {
+			fixed = &res.LeaksFixed
+		} else if refcount1 < refcount2 && fix&BDRV_FIX_ERRORS != 0 {
+			fixed = &res.CorruptionsFixed
+		}
+
+		switch {
+		case fixed != nil:
+			bdrvLogf(bs, LogInfo, "Repairing cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+		case refcount1 < refcount2:
+			bdrvLogf(bs, LogError, "ERROR cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+		default:
+			bdrvLogf(bs, LogWarn, "Leaked cluster %d refcount=%d reference=%d", i, refcount1, refcount2)
+		}
+
+		if fixed != nil {
+			var err error
+			if refcount1 > refcount2 {
+				err = updateRefcount(bs, int64(i)<<uint(s.ClusterBits), 1, refcount1-refcount2, true, DISCARD_ALWAYS)
+			} else {
+				err = updateRefcount(bs, int64(i)<<uint(s.ClusterBits), 1, refcount2-refcount1, false, DISCARD_ALWAYS)
+			}
+			if err == nil {
+				(*fixed)++
+				continue
+			}
+		}
+
+		// And if we couldn't, print an error
+		if refcount1 < refcount2 {
+			res.Corruptions++
+		} else {
+			res.Leaks++
+		}
+	}
+
+	return highestCluster
+}
+
+// checkRefcounts checks the refcounts of all of the clusters of the image, and the OFLAG_COPIED flags of the
+// active tables. The inconsistencies are repaired by the fix mode.
+// The caller must hold s.lock, and the caches must be written to the image file.
+//  block/qcow2-refcount.c: int qcow2_check_refcounts(BlockDriverState *bs, BdrvCheckResult *res, BdrvCheckMode fix)
+func checkRefcounts(ctx context.Context, bs *BlockDriverState, res *BdrvCheckResult, fix CheckMode) error {
+	s := bs.Opaque
+
+	size, err := bs.file.bs.File.Size()
+	if err != nil {
+		res.CheckErrors++
+		return err
+	}
+
+	nbClusters := int64(sizeToClusters(s, uint64(size)))
+	if nbClusters > INT_MAX {
+		res.CheckErrors++
+		return errors.Wrap(ErrTooLarge, "Image file too large")
+	}
+
+	res.Bfi.TotalClusters = int64(sizeToClusters(s, uint64(bs.TotalSectors)*uint64(BDRV_SECTOR_SIZE)))
+
+	refcountTable, rebuild, err := calculateRefcounts(ctx, bs, res, nbClusters)
+	if err != nil {
+		return err
+	}
+
+	// In case we don't need to rebuild the refcount structure (but want to fix
+	// something), this function is immediately called again, in which case the
+	// result should be ignored
+	preCompareRes := *res
+	highestCluster := compareRefcounts(bs, res, 0, refcountTable)
+
+	if fix != 0 {
+		// TODO(zchee): rebuilds the refcount structures for BDRV_FIX_ERRORS
+		if rebuild {
+			bdrvLogf(bs, LogError, "ERROR need to rebuild refcount structures")
+			res.CheckErrors++
+			return syscall.EIO
+		}
+
+		if res.Leaks > 0 || res.Corruptions > 0 {
+			*res = preCompareRes
+			highestCluster = compareRefcounts(bs, res, fix, refcountTable)
+		}
+	}
+
+	// check OFLAG_COPIED
+	if err := checkOflagCopied(bs, res, fix); err != nil {
+		return err
+	}
+
+	res.ImageEndOffset = (highestCluster + 1) * int64(s.ClusterSize)
 
 	return nil
 }
@@ -0,0 +1,260 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWipeFreedNever frees the cluster with DISCARD_NEVER, such as the rollback of the failed allocation and
+// the old cluster of the copy-on-write, which must be wiped regardless of the discard type.
+func TestWipeFreedNever(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wipe.qcow2")
+	img, err := CreateImage(filename, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.SetWipeFreed(true); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := img.blk.bs()
+	s := bs.Opaque
+	secret := bytes.Repeat([]byte("secret"), s.ClusterSize/6)
+
+	s.lock.Lock()
+	offset, err := AllocClusters(bs, uint64(s.ClusterSize))
+	if err == nil {
+		err = bdrvPwrite(bs.file, offset, secret)
+	}
+	if err == nil {
+		err = freeClusters(bs, offset, int64(s.ClusterSize), DISCARD_NEVER)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, len(secret))
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("the freed cluster is not wiped")
+	}
+}
+
+// loadedSegments returns the number of the loaded segments of the refcount table of img.
+func loadedSegments(img *QCow2) int {
+	t := img.blk.bs().Opaque.RefcountTable
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, seg := range t.segs {
+		if seg != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// TestRefcountTableOnDemand opens the image without reading its refcount table, which is loaded by the segments
+// which are accessed, and by the check as a whole.
+func TestRefcountTableOnDemand(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reftable.qcow2")
+	img, err := CreateImage(filename, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	bs := img.blk.bs()
+	s := bs.Opaque
+	if len(s.RefcountTable.segs) < 2 {
+		t.Fatalf("refcount table has %d segments, want more than 1", len(s.RefcountTable.segs))
+	}
+	if n := loadedSegments(img); n != 0 {
+		t.Errorf("%d segments are loaded by the open, want 0", n)
+	}
+
+	s.lock.Lock()
+	refcount, err := getRefcount(bs, 0)
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refcount != 1 {
+		t.Errorf("refcount of the header is %d, want 1", refcount)
+	}
+	if n := loadedSegments(img); n != 1 {
+		t.Errorf("%d segments are loaded by the refcount of the header, want 1", n)
+	}
+
+	check, err := img.Check(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Corruptions != 0 || check.Leaks != 0 || check.CheckErrors != 0 {
+		t.Fatalf("check: %+v", check)
+	}
+	if n := loadedSegments(img); n != len(s.RefcountTable.segs) {
+		t.Errorf("%d segments are loaded by the check, want %d", n, len(s.RefcountTable.segs))
+	}
+}
+
+// TestRefcountTableGrow grows the refcount table of the image with the small clusters, which copies the
+// entries of the old table.
+func TestRefcountTableGrow(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "grow.qcow2")
+	img, err := CreateImage(filename, 8<<20, WithClusterSize(512), WithRefcountBits(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := img.blk.bs().Opaque.RefcountTableSize
+
+	data := bytes.Repeat([]byte("reftable"), 4<<20/8)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := img.blk.bs().Opaque.RefcountTableSize; n <= size {
+		t.Fatalf("refcount table has %d entries, want more than %d", n, size)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = OpenFile(filename, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("the data is not read back")
+	}
+	check, err := img.Check(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Corruptions != 0 || check.Leaks != 0 || check.CheckErrors != 0 {
+		t.Fatalf("check: %+v", check)
+	}
+}
+
+// TestOverlapCheckCached checks the overlap with the L2 tables and the refcount blocks of the unloaded segments,
+// which the cached check does not see until the segments are loaded, and the check of all the metadata sees.
+func TestOverlapCheckCached(t *testing.T) {
+	const guestOffset = 40 << 20
+
+	filename := filepath.Join(t.TempDir(), "overlap.qcow2")
+	img, err := CreateImage(filename, 64<<20, WithClusterSize(512), WithRefcountBits(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the host file exceeds the first segment of the refcount table, and the L2 table of guestOffset is
+	// allocated after the data in the second segment
+	if _, err := img.WriteAt(bytes.Repeat([]byte("overlap!"), 18<<20/8), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("overlap!"), guestOffset); err != nil {
+		t.Fatal(err)
+	}
+	bs := img.blk.bs()
+	s := bs.Opaque
+	l1Index := guestOffset >> uint(s.ClusterBits+s.L2Bits)
+	l1Entry, err := s.L1Table.get(bs, l1Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2Offset := int64(l1Entry & L1E_OFFSET_MASK)
+	reftIndex := int(l2Offset >> uint(s.ClusterBits+s.RefcountBlockBits))
+	reftEntry, err := s.RefcountTable.get(bs, reftIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refblockOffset := int64(reftEntry & REFT_OFFSET_MASK)
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l1Index/L1_SEGMENT_SIZE == 0 || reftIndex/REFT_SEGMENT_SIZE == 0 {
+		t.Fatalf("L1 index %d and refcount table index %d are in the first segments", l1Index, reftIndex)
+	}
+
+	img, err = OpenFileOpts(filename, DriverQCow2, os.O_RDWR, &OpenOpts{OverlapCheck: OverlapCheckCached})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	bs = img.blk.bs()
+	s = bs.Opaque
+
+	check := func(chk int, offset int64) int {
+		t.Helper()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		saved := s.OverlapCheck
+		s.OverlapCheck = chk
+		ret, err := checkMetadataOverlap(bs, 0, offset, int64(s.ClusterSize))
+		s.OverlapCheck = saved
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	// the first segments are loaded by the access to the head of the image
+	buf := make([]byte, 512)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	_, err = getRefcount(bs, 0)
+	s.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ret := check(QCOW2_OL_CACHED, l2Offset); ret != 0 {
+		t.Errorf("cached check of the L2 table of the unloaded segment returns %#x, want 0", ret)
+	}
+	if ret := check(QCOW2_OL_CACHED, refblockOffset); ret != 0 {
+		t.Errorf("cached check of the refcount block of the unloaded segment returns %#x, want 0", ret)
+	}
+	if ret := check(QCOW2_OL_ALL, l2Offset); ret != QCOW2_OL_ACTIVE_L2 {
+		t.Errorf("check of all the metadata of the L2 table returns %#x, want %#x", ret, QCOW2_OL_ACTIVE_L2)
+	}
+	if ret := check(QCOW2_OL_ALL, refblockOffset); ret != QCOW2_OL_REFCOUNT_BLOCK {
+		t.Errorf("check of all the metadata of the refcount block returns %#x, want %#x", ret, QCOW2_OL_REFCOUNT_BLOCK)
+	}
+	// the check of all the metadata loaded the whole tables
+	if ret := check(QCOW2_OL_CACHED, l2Offset); ret != QCOW2_OL_ACTIVE_L2 {
+		t.Errorf("cached check of the L2 table of the loaded segment returns %#x, want %#x", ret, QCOW2_OL_ACTIVE_L2)
+	}
+	if ret := check(QCOW2_OL_CACHED, refblockOffset); ret != QCOW2_OL_REFCOUNT_BLOCK {
+		t.Errorf("cached check of the refcount block of the loaded segment returns %#x, want %#x", ret, QCOW2_OL_REFCOUNT_BLOCK)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// REFT_SEGMENT_SIZE the number of the entries of the segment of the refcount table, which is loaded from the
+// image file at once. The segment of 4 KiB covers 1 TiB of the image file with the 64 KiB clusters and the 16 bit
+// refcounts.
+const REFT_SEGMENT_SIZE = 512
+
+// refcountTable is the refcount table of the image. The segments of REFT_SEGMENT_SIZE entries are loaded from the
+// image file on the first access, same as l1Table, so opening the image with the large refcount table does not
+// read the whole table, and only the segments which cover the clusters in use are held in the memory. The whole
+// table is loaded only by the growth of the table and by the operations which walk all of the refcount blocks,
+// such as the check.
+//
+// The entries are accessed with s.lock held, and mu serializes the loading of the segments by the concurrent
+// readers.
+type refcountTable struct {
+	// offset the offset of the table in the image file, which the segments are loaded from.
+	offset uint64
+	// size the number of the entries.
+	size int
+
+	mu sync.Mutex
+	// segs the segments of the table, which are nil until loaded.
+	segs [][]uint64
+}
+
+// newRefcountTable returns the refcount table of size entries at offset of the image file, which is not loaded yet.
+func newRefcountTable(offset uint64, size int) *refcountTable {
+	return &refcountTable{
+		offset: offset,
+		size:   size,
+		segs:   make([][]uint64, (size+REFT_SEGMENT_SIZE-1)/REFT_SEGMENT_SIZE),
+	}
+}
+
+// newRefcountTableFrom returns the refcount table of entries at offset of the image file, which is already loaded.
+func newRefcountTableFrom(offset uint64, entries []uint64) *refcountTable {
+	t := newRefcountTable(offset, len(entries))
+	for i := range t.segs {
+		end := MIN((i+1)*REFT_SEGMENT_SIZE, len(entries))
+		t.segs[i] = append([]uint64(nil), entries[i*REFT_SEGMENT_SIZE:end]...)
+	}
+	return t
+}
+
+// segment returns the segment seg of t, which is loaded from the image file of bs if needed.
+// The caller must hold t.mu.
+func (t *refcountTable) segment(bs *BlockDriverState, seg int) ([]uint64, error) {
+	if t.segs[seg] != nil {
+		return t.segs[seg], nil
+	}
+
+	start := seg * REFT_SEGMENT_SIZE
+	n := MIN(REFT_SEGMENT_SIZE, t.size-start)
+	buf := make([]byte, n*UINT64_SIZE)
+	if err := bdrvPread(bs.file, int64(t.offset)+int64(start)*UINT64_SIZE, buf); err != nil {
+		err = errors.Wrap(err, "Could not read refcount table")
+		return nil, err
+	}
+
+	entries := make([]uint64, n)
+	for i := range entries {
+		entries[i] = BEUint64(buf[i*UINT64_SIZE:])
+	}
+	t.segs[seg] = entries
+
+	return entries, nil
+}
+
+// get returns the entry i of t.
+func (t *refcountTable) get(bs *BlockDriverState, i int) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seg, err := t.segment(bs, i/REFT_SEGMENT_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	return seg[i%REFT_SEGMENT_SIZE], nil
+}
+
+// set sets the entry i of t to e in the memory. The entry is written to the image file by the caller.
+func (t *refcountTable) set(bs *BlockDriverState, i int, e uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seg, err := t.segment(bs, i/REFT_SEGMENT_SIZE)
+	if err != nil {
+		return err
+	}
+	seg[i%REFT_SEGMENT_SIZE] = e
+	return nil
+}
+
+// entries returns the copy of the whole table, which loads all of the segments of t.
+func (t *refcountTable) entries(bs *BlockDriverState) ([]uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]uint64, 0, t.size)
+	for i := range t.segs {
+		seg, err := t.segment(bs, i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, seg...)
+	}
+	return entries, nil
+}
+
+// loadedEntries calls fn with the index and the value of the entries of the loaded segments of t, until fn
+// returns false.
+func (t *refcountTable) loadedEntries(fn func(i int, e uint64) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, seg := range t.segs {
+		for j, e := range seg {
+			if !fn(i*REFT_SEGMENT_SIZE+j, e) {
+				return
+			}
+		}
+	}
+}
+
+// lastUsed returns the index of the last entry of t which may be used. The entries of the segments which are not
+// loaded yet are taken as used.
+func (t *refcountTable) lastUsed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.size - 1
+	for i > 0 {
+		seg := t.segs[i/REFT_SEGMENT_SIZE]
+		if seg == nil || seg[i%REFT_SEGMENT_SIZE]&REFT_OFFSET_MASK != 0 {
+			break
+		}
+		i--
+	}
+	return i
+}
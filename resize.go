@@ -0,0 +1,85 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Resize grows the virtual disk size of the image to size bytes.
+// The image can be resized while it is in use, such as exported over the NBD or FUSE.
+// The in-flight requests are completed before the L1 table and the header are updated, and the
+// functions registered by AddResizeNotifier are called with the new size after the image is resized.
+// Shrinking the image is not supported.
+//  qemu-img.c: static int img_resize(int argc, char **argv)
+func (q *QCow2) Resize(size int64) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+
+	if size < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "New image size must be positive")
+		return err
+	}
+	if size > INT64_MAX-int64(BDRV_SECTOR_SIZE) {
+		err := errors.Wrap(ErrTooLarge, "New image size is too big")
+		return err
+	}
+
+	total := roundUp(size, int64(BDRV_SECTOR_SIZE))
+	if err := q.blk.truncate(total); err != nil {
+		err = errors.Wrap(err, "Error resizing image")
+		return err
+	}
+
+	return nil
+}
+
+// resizeNotifier is the function registered by AddResizeNotifier, which is removed by its identity.
+//  include/qemu/notify.h: struct Notifier
+type resizeNotifier struct {
+	fn func(size int64)
+}
+
+// AddResizeNotifier registers fn to be called with the new virtual disk size after the image is resized.
+// The export servers use it to notify the connected clients of the new size.
+//
+// The returned function unregisters fn, and must be called when the export is closed, so the image does not
+// keep the closed export alive. It may be called more than once, and after the image is closed.
+//  block/block-backend.c: void blk_set_dev_ops(BlockBackend *blk, const BlockDevOps *ops, void *opaque)
+func (q *QCow2) AddResizeNotifier(fn func(size int64)) (remove func()) {
+	n := &resizeNotifier{fn: fn}
+
+	bs := q.blk.bs()
+	bdrvDrainedBegin(bs)
+	notifiers := make([]*resizeNotifier, len(q.blk.resizeNotifiers), len(q.blk.resizeNotifiers)+1)
+	copy(notifiers, q.blk.resizeNotifiers)
+	q.blk.resizeNotifiers = append(notifiers, n)
+	bdrvDrainedEnd(bs)
+
+	return func() {
+		q.removeResizeNotifier(n)
+	}
+}
+
+// removeResizeNotifier unregisters n, if it is registered.
+//  util/notify.c: void notifier_remove(Notifier *notifier)
+func (q *QCow2) removeResizeNotifier(n *resizeNotifier) {
+	if bs := q.blk.bs(); bs != nil {
+		bdrvDrainedBegin(bs)
+		defer bdrvDrainedEnd(bs)
+	}
+
+	notifiers := make([]*resizeNotifier, 0, len(q.blk.resizeNotifiers))
+	for _, m := range q.blk.resizeNotifiers {
+		if m != n {
+			notifiers = append(notifiers, m)
+		}
+	}
+	q.blk.resizeNotifiers = notifiers
+}
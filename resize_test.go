@@ -0,0 +1,44 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResizeNotifier(t *testing.T) {
+	img, err := CreateImage(filepath.Join(t.TempDir(), "resize.qcow2"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	var got1, got2 []int64
+	remove1 := img.AddResizeNotifier(func(size int64) { got1 = append(got1, size) })
+	remove2 := img.AddResizeNotifier(func(size int64) { got2 = append(got2, size) })
+
+	if err := img.Resize(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	remove1()
+	remove1()
+	if err := img.Resize(3 << 20); err != nil {
+		t.Fatal(err)
+	}
+	remove2()
+
+	if len(got1) != 1 || got1[0] != 2<<20 {
+		t.Errorf("removed notifier got %v, want [%d]", got1, 2<<20)
+	}
+	if len(got2) != 2 || got2[0] != 2<<20 || got2[1] != 3<<20 {
+		t.Errorf("notifier got %v, want [%d %d]", got2, 2<<20, 3<<20)
+	}
+	if n := len(img.blk.resizeNotifiers); n != 0 {
+		t.Errorf("%d notifiers are left registered", n)
+	}
+}
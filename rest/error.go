@@ -0,0 +1,27 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rest
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/internal/confine"
+)
+
+// The errors returned by the Handler in the error body. The HTTP status of the response is mapped from the
+// errno which each error wraps.
+var (
+	// ErrInvalidParameter the parameter of the request is missing or invalid.
+	ErrInvalidParameter error = qcow2.NewError(syscall.EINVAL, "invalid parameter")
+	// ErrInvalidBody the body of the request is not the valid JSON object of the request.
+	ErrInvalidBody error = qcow2.NewError(syscall.EINVAL, "invalid request body")
+	// ErrUnsupportedMediaType the Content-Type of the request body is not "application/json".
+	ErrUnsupportedMediaType error = qcow2.NewError(syscall.EINVAL, "unsupported media type")
+	// ErrFileExists the file to create already exists, and the request does not overwrite it.
+	ErrFileExists error = qcow2.NewError(syscall.EEXIST, "file already exists")
+	// ErrOutsideRoot the filename of the request is outside of Options.Root.
+	ErrOutsideRoot error = confine.ErrOutsideRoot
+)
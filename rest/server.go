@@ -0,0 +1,540 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rest serves the image operations over the HTTP REST API with the JSON bodies, so the VM management
+// agents which can not link Go can create, resize, snapshot and inspect the images.
+//
+// The Handler is the http.Handler which can be embedded in the HTTP server of the agent:
+//
+//  POST   /v1/images                  creates the image, same as blockdev-create of the qcow2 driver
+//  GET    /v1/images/info             returns the information of the image, same as 'qemu-img info --output=json'
+//  POST   /v1/images/resize           resizes the image, same as block_resize
+//  GET    /v1/images/snapshots        lists the internal snapshots of the image
+//  POST   /v1/images/snapshots        creates the internal snapshot, same as blockdev-snapshot-internal-sync
+//  POST   /v1/images/snapshots/apply  reverts the image to the internal snapshot
+//  DELETE /v1/images/snapshots        deletes the internal snapshot, same as blockdev-snapshot-delete-internal-sync
+//
+// The image of the GET and DELETE requests is given by the "filename" query parameter, and of the POST requests
+// by the "filename" member of the JSON body, whose Content-Type must be "application/json". The names of the
+// members are the same as QAPI. The errors are
+// returned as the JSON body {"error": {"class": "GenericError", "desc": "..."}}, same as QMP, with the HTTP status
+// mapped from the errno of the error.
+//
+// The filenames are the paths on the host of the server, which are confined to Options.Root if it is set, and
+// the Handler has no authentication of its own, so serve it on the unix socket or the loopback address, or
+// behind the authenticating handler.
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/internal/confine"
+)
+
+// maxBodySize the maximum size of the request body.
+const maxBodySize = 1 << 20
+
+// CreateRequest the body of POST /v1/images.
+//  qapi/block-core.json: { 'struct': 'BlockdevCreateOptionsQcow2' }
+type CreateRequest struct {
+	// Filename the filename of the new image.
+	Filename string `json:"filename"`
+	// Size the virtual size in bytes. The size of the backing file is used if zero.
+	Size int64 `json:"size"`
+	// Version the compatibility level, "v2" (compat=0.10) or "v3" (compat=1.1). The default is "v3".
+	Version string `json:"version,omitempty"`
+	// BackingFile the backing file of the image.
+	BackingFile string `json:"backing-file,omitempty"`
+	// BackingFmt the format of the backing file, probed if empty.
+	BackingFmt string `json:"backing-fmt,omitempty"`
+	// ClusterSize the cluster size in bytes, selected by the virtual size if zero.
+	ClusterSize int `json:"cluster-size,omitempty"`
+	// Preallocation the preallocation mode, "off", "metadata", "falloc" or "full".
+	Preallocation qcow2.PreallocMode `json:"preallocation,omitempty"`
+	// LazyRefcounts postpones the refcount updates.
+	LazyRefcounts bool `json:"lazy-refcounts,omitempty"`
+	// RefcountBits the width of the refcount in bits. The default is 16.
+	RefcountBits int `json:"refcount-bits,omitempty"`
+	// Overwrite replaces the existing file of Filename. The request fails with 409 if the file exists and
+	// Overwrite is false.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// ResizeRequest the body of POST /v1/images/resize.
+//  qapi/block-core.json: { 'command': 'block_resize' }
+type ResizeRequest struct {
+	Filename string `json:"filename"`
+	// Size the new virtual size in bytes.
+	Size int64 `json:"size"`
+}
+
+// SnapshotRequest the body of POST /v1/images/snapshots and POST /v1/images/snapshots/apply.
+//  qapi/block-core.json: { 'struct': 'BlockdevSnapshotInternal' }
+type SnapshotRequest struct {
+	Filename string `json:"filename"`
+	// Name the name of the new snapshot, or the ID or name of the snapshot to apply.
+	Name string `json:"name"`
+}
+
+// Error the error body of the response.
+//  qapi/qmp-dispatch.c: QDict *qmp_error_response(Error *err)
+type Error struct {
+	// Class the error class, which is always "GenericError", same as qemu.
+	Class string `json:"class"`
+	// Desc the human readable description of the error.
+	Desc string `json:"desc"`
+}
+
+// Options represents the options of the Handler.
+type Options struct {
+	// Root confines the filenames of the requests, and the backing files of the images, to the directory.
+	// The relative filenames are relative to Root, and the symbolic links are resolved before the check.
+	// The requests of the filenames outside of Root fail with 403. If empty, any file of the host is allowed.
+	Root string
+}
+
+// Handler serves the REST API of the image operations.
+type Handler struct {
+	mux  *http.ServeMux
+	root string
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns the new Handler. If opts is nil, the default options are used.
+func NewHandler(opts *Options) *Handler {
+	h := &Handler{mux: http.NewServeMux()}
+	if opts != nil {
+		h.root = opts.Root
+	}
+	h.mux.Handle("/v1/images", methods{
+		http.MethodPost: h.create,
+	})
+	h.mux.Handle("/v1/images/info", methods{
+		http.MethodGet: h.info,
+	})
+	h.mux.Handle("/v1/images/resize", methods{
+		http.MethodPost: h.resize,
+	})
+	h.mux.Handle("/v1/images/snapshots", methods{
+		http.MethodGet:    h.listSnapshots,
+		http.MethodPost:   h.createSnapshot,
+		http.MethodDelete: h.deleteSnapshot,
+	})
+	h.mux.Handle("/v1/images/snapshots/apply", methods{
+		http.MethodPost: h.applySnapshot,
+	})
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// methods dispatches the request of the endpoint by its method.
+type methods map[string]http.HandlerFunc
+
+// ServeHTTP implements http.Handler. The request of the unsupported method is rejected with 405.
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fn, ok := m[r.Method]; ok {
+		fn(w, r)
+		return
+	}
+
+	allow := make([]string, 0, len(m))
+	for method := range m {
+		allow = append(allow, method)
+	}
+	sort.Strings(allow)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, errorBody(errors.Errorf("Method %s is not allowed", r.Method)))
+}
+
+// create creates the new qcow2 image, and returns its information.
+//  block/qcow2.c: static int qcow2_co_create(BlockdevCreateOptions *create_options, Error **errp)
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) {
+	var req CreateRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Filename == "" {
+		writeError(w, errors.Wrap(ErrInvalidParameter, "Parameter 'filename' is missing"))
+		return
+	}
+	filename, err := confine.Path(h.root, req.Filename)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := confine.Backing(h.root, filename, req.BackingFile); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	opts := &qcow2.Opts{
+		Filename:      filename,
+		Exclusive:     !req.Overwrite,
+		Fmt:           qcow2.DriverQCow2,
+		Size:          req.Size,
+		BackingFile:   req.BackingFile,
+		BackingFormat: req.BackingFmt,
+		ClusterSize:   req.ClusterSize,
+		Preallocation: req.Preallocation,
+		LazyRefcounts: req.LazyRefcounts,
+		RefcountBits:  req.RefcountBits,
+	}
+	switch req.Version {
+	case "", "v3":
+		// the default compat=1.1
+	case "v2":
+		opts.Compat = "0.10"
+	default:
+		writeError(w, errors.Wrapf(ErrInvalidParameter, "Invalid parameter 'version' value '%s'", req.Version))
+		return
+	}
+	if opts.Size == 0 && opts.BackingFile == "" {
+		writeError(w, errors.Wrap(ErrInvalidParameter, "Image creation needs a size parameter"))
+		return
+	}
+
+	img, err := qcow2.CreateContext(r.Context(), opts)
+	if errors.Is(err, os.ErrExist) {
+		writeError(w, errors.Wrapf(ErrFileExists, "Could not create '%s'", req.Filename))
+		return
+	}
+	if err != nil {
+		writeError(w, errors.Wrapf(err, "%s", req.Filename))
+		return
+	}
+	defer img.Close()
+
+	info, err := img.Info()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// info returns the information of the image of the "filename" query parameter, or of its backing chain if
+// the "backing-chain" query parameter is true. The "format" and "force-share" query parameters are the format
+// of the image and whether to open it without the lock.
+//  qemu-img.c: static int img_info(int argc, char **argv)
+func (h *Handler) info(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chain, err := queryBool(query.Get("backing-chain"))
+	if err != nil {
+		writeError(w, errors.Wrap(err, "Invalid parameter 'backing-chain'"))
+		return
+	}
+	force, err := queryBool(query.Get("force-share"))
+	if err != nil {
+		writeError(w, errors.Wrap(err, "Invalid parameter 'force-share'"))
+		return
+	}
+
+	img, err := h.openImage(query.Get("filename"), query.Get("format"), os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: !chain,
+		Force:     force,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	images := []*qcow2.QCow2{img}
+	if chain {
+		backings, err := img.BackingChain()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for _, backing := range backings {
+			defer backing.Close()
+		}
+		images = append(images, backings...)
+	}
+
+	infos := make([]*qcow2.ImageInfo, len(images))
+	for i, image := range images {
+		info, err := image.Info()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		infos[i] = info
+	}
+
+	// the backing chain is the array of the information, same as qemu-img info --backing-chain
+	var v interface{} = infos[0]
+	if chain {
+		v = infos
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// resize resizes the image, and returns its information.
+//  blockdev.c: void qmp_block_resize(bool has_device, const char *device, bool has_node_name, const char *node_name, int64_t size, Error **errp)
+func (h *Handler) resize(w http.ResponseWriter, r *http.Request) {
+	var req ResizeRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	img, err := h.openImage(req.Filename, "", os.O_RDWR, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	if err := img.Resize(req.Size); err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := img.Info()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// listSnapshots returns the internal snapshots of the image of the "filename" query parameter.
+//  block/qapi.c: int bdrv_query_snapshot_info_list(BlockDriverState *bs, SnapshotInfoList **p_list, Error **errp)
+func (h *Handler) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	img, err := h.openImage(r.URL.Query().Get("filename"), "", os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	snapshots, err := img.Snapshots()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if snapshots == nil {
+		snapshots = []qcow2.SnapshotInfo{}
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// createSnapshot creates the internal snapshot of the image, and returns it.
+//  blockdev.c: void qmp_blockdev_snapshot_internal_sync(const char *device, const char *name, Error **errp)
+func (h *Handler) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, errors.Wrap(ErrInvalidParameter, "Parameter 'name' is missing"))
+		return
+	}
+
+	img, err := h.openImage(req.Filename, "", os.O_RDWR, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	sn, err := img.CreateSnapshot(req.Name)
+	if err != nil {
+		writeError(w, errors.Wrapf(err, "Could not create snapshot '%s'", req.Name))
+		return
+	}
+	writeJSON(w, http.StatusCreated, sn)
+}
+
+// applySnapshot reverts the image to the internal snapshot.
+//  qemu-img.c: static int img_snapshot(int argc, char **argv)
+func (h *Handler) applySnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, errors.Wrap(ErrInvalidParameter, "Parameter 'name' is missing"))
+		return
+	}
+
+	img, err := h.openImage(req.Filename, "", os.O_RDWR, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	if err := img.ApplySnapshot(req.Name); err != nil {
+		writeError(w, errors.Wrapf(err, "Could not apply snapshot '%s'", req.Name))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSnapshot deletes the internal snapshot of the "name" query parameter, which is the ID or name of the
+// snapshot, from the image of the "filename" query parameter.
+//  blockdev.c: SnapshotInfo *qmp_blockdev_snapshot_delete_internal_sync(const char *device, bool has_id, const char *id, bool has_name, const char *name, Error **errp)
+func (h *Handler) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		writeError(w, errors.Wrap(ErrInvalidParameter, "Parameter 'name' is missing"))
+		return
+	}
+
+	img, err := h.openImage(query.Get("filename"), "", os.O_RDWR, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer img.Close()
+
+	if err := img.DeleteSnapshot(name); err != nil {
+		writeError(w, errors.Wrapf(err, "Could not delete snapshot '%s'", name))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openImage opens the image of filename, which is confined to the root directory with its backing files.
+// The backing file outside of the root directory is rejected before it is opened, and the backing files which
+// are shared with the images opened before are checked after the open.
+func (h *Handler) openImage(filename, format string, flag int, opts *qcow2.OpenOpts) (*qcow2.QCow2, error) {
+	if filename == "" {
+		return nil, errors.Wrap(ErrInvalidParameter, "Parameter 'filename' is missing")
+	}
+	path, err := confine.Path(h.root, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	o := qcow2.OpenOpts{}
+	if opts != nil {
+		o = *opts
+	}
+	o.CheckBacking = confine.BackingCheck(h.root)
+	img, err := qcow2.OpenFileOpts(path, qcow2.DriverFmt(format), flag, &o)
+	if err != nil {
+		return nil, err
+	}
+	if err := confine.Chain(h.root, img); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// decodeBody decodes the JSON body of r to v. The body must be "application/json", so the request can not be
+// sent by the cross-origin form of the browser without the preflight. The unknown members are rejected, same
+// as QMP.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return errors.Wrapf(ErrUnsupportedMediaType, "Content-Type '%s' is not supported, use 'application/json'", r.Header.Get("Content-Type"))
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.Wrap(ErrInvalidBody, "Request body is empty")
+		}
+		return errors.Wrapf(ErrInvalidBody, "Invalid request body: %v", err)
+	}
+	if dec.More() {
+		return errors.Wrap(ErrInvalidBody, "Invalid request body: trailing data")
+	}
+	return nil
+}
+
+// queryBool parses the boolean query parameter, which is false if it is empty.
+func queryBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.Wrap(ErrInvalidParameter, err.Error())
+	}
+	return v, nil
+}
+
+// writeJSON writes v as the JSON body of the response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as the QMP error body of the response, with the HTTP status mapped from the errno of err.
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusCode(err), errorBody(err))
+}
+
+// errorBody returns the QMP error body of err.
+func errorBody(err error) interface{} {
+	return struct {
+		Error Error `json:"error"`
+	}{
+		Error: Error{
+			Class: "GenericError",
+			Desc:  err.Error(),
+		},
+	}
+}
+
+// statusCode returns the HTTP status code of err.
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, qcow2.ErrCorrupt), errors.Is(err, qcow2.ErrLocked), errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.EEXIST):
+		return http.StatusConflict
+	case errors.Is(err, syscall.ENOENT):
+		return http.StatusNotFound
+	case errors.Is(err, syscall.EINVAL), errors.Is(err, syscall.ERANGE), errors.Is(err, syscall.EFBIG):
+		return http.StatusBadRequest
+	case errors.Is(err, syscall.ENOTSUP):
+		return http.StatusNotImplemented
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EROFS):
+		return http.StatusForbidden
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, io.ErrShortWrite):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+	_ "github.com/zchee/go-qcow2/curl"
+)
+
+func TestCreate(t *testing.T) {
+	root := t.TempDir()
+	h := NewHandler(&Options{Root: root})
+
+	post := func(contentType, body string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/v1/images", strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: `{"filename": "a.qcow2", "size": 1048576}`, want: http.StatusUnsupportedMediaType},
+		{name: "no content type", body: `{"filename": "a.qcow2", "size": 1048576}`, want: http.StatusUnsupportedMediaType},
+		{name: "create", contentType: "application/json", body: `{"filename": "a.qcow2", "size": 1048576}`, want: http.StatusCreated},
+		{name: "exists", contentType: "application/json; charset=utf-8", body: `{"filename": "a.qcow2", "size": 1048576}`, want: http.StatusConflict},
+		{name: "overwrite", contentType: "application/json", body: `{"filename": "a.qcow2", "size": 2097152, "overwrite": true}`, want: http.StatusCreated},
+		{name: "outside", contentType: "application/json", body: `{"filename": "../a.qcow2", "size": 1048576}`, want: http.StatusForbidden},
+		{name: "backing outside", contentType: "application/json", body: `{"filename": "b.qcow2", "backing-file": "/etc/passwd", "backing-fmt": "raw"}`, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := post(tt.contentType, tt.body); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "b.qcow2")); !os.IsNotExist(err) {
+		t.Errorf("the image of the backing file outside of the root directory is created: %v", err)
+	}
+}
+
+// TestBackingOutsideRoot opens the image whose backing file is on the remote server, which is rejected before
+// the backing file is opened, and resizes it, which does not open the backing file.
+func TestBackingOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	base := filepath.Join(t.TempDir(), "base.qcow2")
+	img, err := qcow2.CreateImage(base, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeFile(w, r, base)
+	}))
+	defer srv.Close()
+
+	img, err = qcow2.CreateImage(filepath.Join(root, "a.qcow2"), 1<<20, qcow2.WithBackingFile(srv.URL+"/base.qcow2", qcow2.DriverQCow2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&requests, 0)
+
+	h := NewHandler(&Options{Root: root})
+	do := func(method, target, body string) int {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if got := do(http.MethodGet, "/v1/images/info?filename=a.qcow2&backing-chain=true", ""); got != http.StatusForbidden {
+		t.Errorf("info: got status %d, want %d", got, http.StatusForbidden)
+	}
+	if got := do(http.MethodPost, "/v1/images/resize", `{"filename": "a.qcow2", "size": 2097152}`); got != http.StatusOK {
+		t.Errorf("resize: got status %d, want %d", got, http.StatusOK)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("the remote backing file is requested %d times", n)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/internal/confine"
+)
+
+// The errors returned by the Server in the status of the failed call. The status code is mapped from the
+// errno which each error wraps.
+var (
+	// ErrInvalidArgument the field of the request is missing or invalid.
+	ErrInvalidArgument error = qcow2.NewError(syscall.EINVAL, "invalid argument")
+	// ErrExportExists the export of the ID already exists.
+	ErrExportExists error = qcow2.NewError(syscall.EEXIST, "export already exists")
+	// ErrExportNotFound no export has the ID.
+	ErrExportNotFound error = qcow2.NewError(syscall.ENOENT, "export not found")
+	// ErrFileExists the file to create already exists, and the request does not overwrite it.
+	ErrFileExists error = qcow2.NewError(syscall.EEXIST, "file already exists")
+	// ErrOutsideRoot the filename of the request is outside of Options.Root.
+	ErrOutsideRoot error = confine.ErrOutsideRoot
+)
@@ -0,0 +1,1850 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: qcow2.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Repair the repair mode of the check.
+type CheckRequest_Repair int32
+
+const (
+	// NONE only checks the image.
+	CheckRequest_NONE CheckRequest_Repair = 0
+	// LEAKS repairs the leaked clusters.
+	CheckRequest_LEAKS CheckRequest_Repair = 1
+	// ALL repairs the leaked clusters and the corruptions.
+	CheckRequest_ALL CheckRequest_Repair = 2
+)
+
+// Enum value maps for CheckRequest_Repair.
+var (
+	CheckRequest_Repair_name = map[int32]string{
+		0: "NONE",
+		1: "LEAKS",
+		2: "ALL",
+	}
+	CheckRequest_Repair_value = map[string]int32{
+		"NONE":  0,
+		"LEAKS": 1,
+		"ALL":   2,
+	}
+)
+
+func (x CheckRequest_Repair) Enum() *CheckRequest_Repair {
+	p := new(CheckRequest_Repair)
+	*p = x
+	return p
+}
+
+func (x CheckRequest_Repair) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CheckRequest_Repair) Descriptor() protoreflect.EnumDescriptor {
+	return file_qcow2_proto_enumTypes[0].Descriptor()
+}
+
+func (CheckRequest_Repair) Type() protoreflect.EnumType {
+	return &file_qcow2_proto_enumTypes[0]
+}
+
+func (x CheckRequest_Repair) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CheckRequest_Repair.Descriptor instead.
+func (CheckRequest_Repair) EnumDescriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{5, 0}
+}
+
+type SnapshotRequest_Action int32
+
+const (
+	// LIST lists the snapshots.
+	SnapshotRequest_LIST SnapshotRequest_Action = 0
+	// CREATE creates the snapshot of the name.
+	SnapshotRequest_CREATE SnapshotRequest_Action = 1
+	// APPLY reverts the image to the snapshot of the ID or name.
+	SnapshotRequest_APPLY SnapshotRequest_Action = 2
+	// DELETE deletes the snapshot of the ID or name.
+	SnapshotRequest_DELETE SnapshotRequest_Action = 3
+)
+
+// Enum value maps for SnapshotRequest_Action.
+var (
+	SnapshotRequest_Action_name = map[int32]string{
+		0: "LIST",
+		1: "CREATE",
+		2: "APPLY",
+		3: "DELETE",
+	}
+	SnapshotRequest_Action_value = map[string]int32{
+		"LIST":   0,
+		"CREATE": 1,
+		"APPLY":  2,
+		"DELETE": 3,
+	}
+)
+
+func (x SnapshotRequest_Action) Enum() *SnapshotRequest_Action {
+	p := new(SnapshotRequest_Action)
+	*p = x
+	return p
+}
+
+func (x SnapshotRequest_Action) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (SnapshotRequest_Action) Descriptor() protoreflect.EnumDescriptor {
+	return file_qcow2_proto_enumTypes[1].Descriptor()
+}
+
+func (SnapshotRequest_Action) Type() protoreflect.EnumType {
+	return &file_qcow2_proto_enumTypes[1]
+}
+
+func (x SnapshotRequest_Action) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use SnapshotRequest_Action.Descriptor instead.
+func (SnapshotRequest_Action) EnumDescriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{10, 0}
+}
+
+type Export_Type int32
+
+const (
+	// NBD exports the image over the NBD protocol.
+	Export_NBD Export_Type = 0
+	// FUSE mounts the guest disk of the image on the regular file.
+	Export_FUSE Export_Type = 1
+)
+
+// Enum value maps for Export_Type.
+var (
+	Export_Type_name = map[int32]string{
+		0: "NBD",
+		1: "FUSE",
+	}
+	Export_Type_value = map[string]int32{
+		"NBD":  0,
+		"FUSE": 1,
+	}
+)
+
+func (x Export_Type) Enum() *Export_Type {
+	p := new(Export_Type)
+	*p = x
+	return p
+}
+
+func (x Export_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Export_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_qcow2_proto_enumTypes[2].Descriptor()
+}
+
+func (Export_Type) Type() protoreflect.EnumType {
+	return &file_qcow2_proto_enumTypes[2]
+}
+
+func (x Export_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Export_Type.Descriptor instead.
+func (Export_Type) EnumDescriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{12, 0}
+}
+
+// ImageOptions the creation options of the qcow2 image.
+type ImageOptions struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// backing_file the backing file of the image.
+	BackingFile string `protobuf:"bytes,1,opt,name=backing_file,json=backingFile,proto3" json:"backing_file,omitempty"`
+	// backing_format the format of the backing file, probed if empty.
+	BackingFormat string `protobuf:"bytes,2,opt,name=backing_format,json=backingFormat,proto3" json:"backing_format,omitempty"`
+	// cluster_size the cluster size in bytes, selected by the virtual size if zero.
+	ClusterSize int64 `protobuf:"varint,3,opt,name=cluster_size,json=clusterSize,proto3" json:"cluster_size,omitempty"`
+	// compat the compatibility level, "0.10" or "1.1". The default is "1.1".
+	Compat string `protobuf:"bytes,4,opt,name=compat,proto3" json:"compat,omitempty"`
+	// lazy_refcounts postpones the refcount updates.
+	LazyRefcounts bool `protobuf:"varint,5,opt,name=lazy_refcounts,json=lazyRefcounts,proto3" json:"lazy_refcounts,omitempty"`
+	// refcount_bits the width of the refcount in bits. The default is 16.
+	RefcountBits int32 `protobuf:"varint,6,opt,name=refcount_bits,json=refcountBits,proto3" json:"refcount_bits,omitempty"`
+	// preallocation the preallocation mode, "off", "metadata", "falloc" or "full". The default is "off".
+	Preallocation string `protobuf:"bytes,7,opt,name=preallocation,proto3" json:"preallocation,omitempty"`
+	// nocow turns off the copy-on-write of the image file on btrfs.
+	Nocow         bool `protobuf:"varint,8,opt,name=nocow,proto3" json:"nocow,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ImageOptions) Reset() {
+	*x = ImageOptions{}
+	mi := &file_qcow2_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageOptions) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageOptions) ProtoMessage() {}
+
+func (x *ImageOptions) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageOptions.ProtoReflect.Descriptor instead.
+func (*ImageOptions) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ImageOptions) GetBackingFile() string {
+	if x != nil {
+		return x.BackingFile
+	}
+	return ""
+}
+
+func (x *ImageOptions) GetBackingFormat() string {
+	if x != nil {
+		return x.BackingFormat
+	}
+	return ""
+}
+
+func (x *ImageOptions) GetClusterSize() int64 {
+	if x != nil {
+		return x.ClusterSize
+	}
+	return 0
+}
+
+func (x *ImageOptions) GetCompat() string {
+	if x != nil {
+		return x.Compat
+	}
+	return ""
+}
+
+func (x *ImageOptions) GetLazyRefcounts() bool {
+	if x != nil {
+		return x.LazyRefcounts
+	}
+	return false
+}
+
+func (x *ImageOptions) GetRefcountBits() int32 {
+	if x != nil {
+		return x.RefcountBits
+	}
+	return 0
+}
+
+func (x *ImageOptions) GetPreallocation() string {
+	if x != nil {
+		return x.Preallocation
+	}
+	return ""
+}
+
+func (x *ImageOptions) GetNocow() bool {
+	if x != nil {
+		return x.Nocow
+	}
+	return false
+}
+
+type CreateRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// filename the filename of the new image.
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	// format the format of the new image. Only "qcow2" is supported, which is the default.
+	Format string `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	// size the virtual size in bytes. The size of the backing file is used if zero.
+	Size    int64         `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	Options *ImageOptions `protobuf:"bytes,4,opt,name=options,proto3" json:"options,omitempty"`
+	// overwrite replaces the existing file of filename. The call fails with ALREADY_EXISTS if the file exists
+	// and overwrite is false.
+	Overwrite     bool `protobuf:"varint,5,opt,name=overwrite,proto3" json:"overwrite,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateRequest) Reset() {
+	*x = CreateRequest{}
+	mi := &file_qcow2_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateRequest) ProtoMessage() {}
+
+func (x *CreateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateRequest.ProtoReflect.Descriptor instead.
+func (*CreateRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CreateRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *CreateRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *CreateRequest) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *CreateRequest) GetOptions() *ImageOptions {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+func (x *CreateRequest) GetOverwrite() bool {
+	if x != nil {
+		return x.Overwrite
+	}
+	return false
+}
+
+// ImageInfo the information of the image.
+type ImageInfo struct {
+	state                 protoimpl.MessageState `protogen:"open.v1"`
+	Filename              string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Format                string                 `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	DirtyFlag             bool                   `protobuf:"varint,3,opt,name=dirty_flag,json=dirtyFlag,proto3" json:"dirty_flag,omitempty"`
+	ActualSize            int64                  `protobuf:"varint,4,opt,name=actual_size,json=actualSize,proto3" json:"actual_size,omitempty"`
+	VirtualSize           int64                  `protobuf:"varint,5,opt,name=virtual_size,json=virtualSize,proto3" json:"virtual_size,omitempty"`
+	ClusterSize           int64                  `protobuf:"varint,6,opt,name=cluster_size,json=clusterSize,proto3" json:"cluster_size,omitempty"`
+	Encrypted             bool                   `protobuf:"varint,7,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
+	BackingFilename       string                 `protobuf:"bytes,8,opt,name=backing_filename,json=backingFilename,proto3" json:"backing_filename,omitempty"`
+	FullBackingFilename   string                 `protobuf:"bytes,9,opt,name=full_backing_filename,json=fullBackingFilename,proto3" json:"full_backing_filename,omitempty"`
+	BackingFilenameFormat string                 `protobuf:"bytes,10,opt,name=backing_filename_format,json=backingFilenameFormat,proto3" json:"backing_filename_format,omitempty"`
+	// compat the compatibility level of the qcow2 image.
+	Compat          string          `protobuf:"bytes,11,opt,name=compat,proto3" json:"compat,omitempty"`
+	CompressionType string          `protobuf:"bytes,12,opt,name=compression_type,json=compressionType,proto3" json:"compression_type,omitempty"`
+	LazyRefcounts   bool            `protobuf:"varint,13,opt,name=lazy_refcounts,json=lazyRefcounts,proto3" json:"lazy_refcounts,omitempty"`
+	RefcountBits    int32           `protobuf:"varint,14,opt,name=refcount_bits,json=refcountBits,proto3" json:"refcount_bits,omitempty"`
+	Corrupt         bool            `protobuf:"varint,15,opt,name=corrupt,proto3" json:"corrupt,omitempty"`
+	ExtendedL2      bool            `protobuf:"varint,16,opt,name=extended_l2,json=extendedL2,proto3" json:"extended_l2,omitempty"`
+	Snapshots       []*SnapshotInfo `protobuf:"bytes,17,rep,name=snapshots,proto3" json:"snapshots,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ImageInfo) Reset() {
+	*x = ImageInfo{}
+	mi := &file_qcow2_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageInfo) ProtoMessage() {}
+
+func (x *ImageInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageInfo.ProtoReflect.Descriptor instead.
+func (*ImageInfo) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ImageInfo) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetDirtyFlag() bool {
+	if x != nil {
+		return x.DirtyFlag
+	}
+	return false
+}
+
+func (x *ImageInfo) GetActualSize() int64 {
+	if x != nil {
+		return x.ActualSize
+	}
+	return 0
+}
+
+func (x *ImageInfo) GetVirtualSize() int64 {
+	if x != nil {
+		return x.VirtualSize
+	}
+	return 0
+}
+
+func (x *ImageInfo) GetClusterSize() int64 {
+	if x != nil {
+		return x.ClusterSize
+	}
+	return 0
+}
+
+func (x *ImageInfo) GetEncrypted() bool {
+	if x != nil {
+		return x.Encrypted
+	}
+	return false
+}
+
+func (x *ImageInfo) GetBackingFilename() string {
+	if x != nil {
+		return x.BackingFilename
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetFullBackingFilename() string {
+	if x != nil {
+		return x.FullBackingFilename
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetBackingFilenameFormat() string {
+	if x != nil {
+		return x.BackingFilenameFormat
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetCompat() string {
+	if x != nil {
+		return x.Compat
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetCompressionType() string {
+	if x != nil {
+		return x.CompressionType
+	}
+	return ""
+}
+
+func (x *ImageInfo) GetLazyRefcounts() bool {
+	if x != nil {
+		return x.LazyRefcounts
+	}
+	return false
+}
+
+func (x *ImageInfo) GetRefcountBits() int32 {
+	if x != nil {
+		return x.RefcountBits
+	}
+	return 0
+}
+
+func (x *ImageInfo) GetCorrupt() bool {
+	if x != nil {
+		return x.Corrupt
+	}
+	return false
+}
+
+func (x *ImageInfo) GetExtendedL2() bool {
+	if x != nil {
+		return x.ExtendedL2
+	}
+	return false
+}
+
+func (x *ImageInfo) GetSnapshots() []*SnapshotInfo {
+	if x != nil {
+		return x.Snapshots
+	}
+	return nil
+}
+
+type InfoRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Filename string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	// format the format of the image, probed if empty.
+	Format string `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	// backing_chain returns the information of the backing chain.
+	BackingChain bool `protobuf:"varint,3,opt,name=backing_chain,json=backingChain,proto3" json:"backing_chain,omitempty"`
+	// force_share opens the image without the lock, even if it is in use.
+	ForceShare    bool `protobuf:"varint,4,opt,name=force_share,json=forceShare,proto3" json:"force_share,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InfoRequest) Reset() {
+	*x = InfoRequest{}
+	mi := &file_qcow2_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InfoRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InfoRequest) ProtoMessage() {}
+
+func (x *InfoRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InfoRequest.ProtoReflect.Descriptor instead.
+func (*InfoRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *InfoRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *InfoRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *InfoRequest) GetBackingChain() bool {
+	if x != nil {
+		return x.BackingChain
+	}
+	return false
+}
+
+func (x *InfoRequest) GetForceShare() bool {
+	if x != nil {
+		return x.ForceShare
+	}
+	return false
+}
+
+type InfoResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// images the information of the image, followed by its backing chain.
+	Images        []*ImageInfo `protobuf:"bytes,1,rep,name=images,proto3" json:"images,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InfoResponse) Reset() {
+	*x = InfoResponse{}
+	mi := &file_qcow2_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InfoResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InfoResponse) ProtoMessage() {}
+
+func (x *InfoResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InfoResponse.ProtoReflect.Descriptor instead.
+func (*InfoResponse) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *InfoResponse) GetImages() []*ImageInfo {
+	if x != nil {
+		return x.Images
+	}
+	return nil
+}
+
+type CheckRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Filename string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Format   string                 `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	Repair   CheckRequest_Repair    `protobuf:"varint,3,opt,name=repair,proto3,enum=goqcow2.v1.CheckRequest_Repair" json:"repair,omitempty"`
+	// force_share opens the image without the lock. It is not allowed with the repair.
+	ForceShare    bool `protobuf:"varint,4,opt,name=force_share,json=forceShare,proto3" json:"force_share,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CheckRequest) Reset() {
+	*x = CheckRequest{}
+	mi := &file_qcow2_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CheckRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckRequest) ProtoMessage() {}
+
+func (x *CheckRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckRequest.ProtoReflect.Descriptor instead.
+func (*CheckRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CheckRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetRepair() CheckRequest_Repair {
+	if x != nil {
+		return x.Repair
+	}
+	return CheckRequest_NONE
+}
+
+func (x *CheckRequest) GetForceShare() bool {
+	if x != nil {
+		return x.ForceShare
+	}
+	return false
+}
+
+// CheckResponse the result of the check, same as 'qemu-img check --output=json'.
+type CheckResponse struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Filename           string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Format             string                 `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	CheckErrors        int64                  `protobuf:"varint,3,opt,name=check_errors,json=checkErrors,proto3" json:"check_errors,omitempty"`
+	ImageEndOffset     int64                  `protobuf:"varint,4,opt,name=image_end_offset,json=imageEndOffset,proto3" json:"image_end_offset,omitempty"`
+	Corruptions        int64                  `protobuf:"varint,5,opt,name=corruptions,proto3" json:"corruptions,omitempty"`
+	Leaks              int64                  `protobuf:"varint,6,opt,name=leaks,proto3" json:"leaks,omitempty"`
+	CorruptionsFixed   int64                  `protobuf:"varint,7,opt,name=corruptions_fixed,json=corruptionsFixed,proto3" json:"corruptions_fixed,omitempty"`
+	LeaksFixed         int64                  `protobuf:"varint,8,opt,name=leaks_fixed,json=leaksFixed,proto3" json:"leaks_fixed,omitempty"`
+	TotalClusters      int64                  `protobuf:"varint,9,opt,name=total_clusters,json=totalClusters,proto3" json:"total_clusters,omitempty"`
+	AllocatedClusters  int64                  `protobuf:"varint,10,opt,name=allocated_clusters,json=allocatedClusters,proto3" json:"allocated_clusters,omitempty"`
+	FragmentedClusters int64                  `protobuf:"varint,11,opt,name=fragmented_clusters,json=fragmentedClusters,proto3" json:"fragmented_clusters,omitempty"`
+	CompressedClusters int64                  `protobuf:"varint,12,opt,name=compressed_clusters,json=compressedClusters,proto3" json:"compressed_clusters,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *CheckResponse) Reset() {
+	*x = CheckResponse{}
+	mi := &file_qcow2_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CheckResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckResponse) ProtoMessage() {}
+
+func (x *CheckResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckResponse.ProtoReflect.Descriptor instead.
+func (*CheckResponse) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CheckResponse) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *CheckResponse) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *CheckResponse) GetCheckErrors() int64 {
+	if x != nil {
+		return x.CheckErrors
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetImageEndOffset() int64 {
+	if x != nil {
+		return x.ImageEndOffset
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetCorruptions() int64 {
+	if x != nil {
+		return x.Corruptions
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetLeaks() int64 {
+	if x != nil {
+		return x.Leaks
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetCorruptionsFixed() int64 {
+	if x != nil {
+		return x.CorruptionsFixed
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetLeaksFixed() int64 {
+	if x != nil {
+		return x.LeaksFixed
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetTotalClusters() int64 {
+	if x != nil {
+		return x.TotalClusters
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetAllocatedClusters() int64 {
+	if x != nil {
+		return x.AllocatedClusters
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetFragmentedClusters() int64 {
+	if x != nil {
+		return x.FragmentedClusters
+	}
+	return 0
+}
+
+func (x *CheckResponse) GetCompressedClusters() int64 {
+	if x != nil {
+		return x.CompressedClusters
+	}
+	return 0
+}
+
+type ConvertRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Source       string                 `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	SourceFormat string                 `protobuf:"bytes,2,opt,name=source_format,json=sourceFormat,proto3" json:"source_format,omitempty"`
+	// source_force_share opens the source image without the lock, even if it is in use.
+	SourceForceShare bool   `protobuf:"varint,3,opt,name=source_force_share,json=sourceForceShare,proto3" json:"source_force_share,omitempty"`
+	Target           string `protobuf:"bytes,4,opt,name=target,proto3" json:"target,omitempty"`
+	// target_format the format of the target image, "qcow2" or "raw". The default is "raw".
+	TargetFormat string        `protobuf:"bytes,5,opt,name=target_format,json=targetFormat,proto3" json:"target_format,omitempty"`
+	Options      *ImageOptions `protobuf:"bytes,6,opt,name=options,proto3" json:"options,omitempty"`
+	// compress compresses the data clusters of the qcow2 target.
+	Compress bool `protobuf:"varint,7,opt,name=compress,proto3" json:"compress,omitempty"`
+	// dedup deduplicates the data clusters of the qcow2 target which have the same contents.
+	Dedup bool `protobuf:"varint,8,opt,name=dedup,proto3" json:"dedup,omitempty"`
+	// rate_limit the bandwidth limit in bytes per second. Zero means unlimited.
+	RateLimit int64 `protobuf:"varint,9,opt,name=rate_limit,json=rateLimit,proto3" json:"rate_limit,omitempty"`
+	// overwrite replaces the existing file of target. The call fails with ALREADY_EXISTS if the file exists
+	// and overwrite is false.
+	Overwrite     bool `protobuf:"varint,10,opt,name=overwrite,proto3" json:"overwrite,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertRequest) Reset() {
+	*x = ConvertRequest{}
+	mi := &file_qcow2_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertRequest) ProtoMessage() {}
+
+func (x *ConvertRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertRequest.ProtoReflect.Descriptor instead.
+func (*ConvertRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ConvertRequest) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetSourceFormat() string {
+	if x != nil {
+		return x.SourceFormat
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetSourceForceShare() bool {
+	if x != nil {
+		return x.SourceForceShare
+	}
+	return false
+}
+
+func (x *ConvertRequest) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetTargetFormat() string {
+	if x != nil {
+		return x.TargetFormat
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetOptions() *ImageOptions {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+func (x *ConvertRequest) GetCompress() bool {
+	if x != nil {
+		return x.Compress
+	}
+	return false
+}
+
+func (x *ConvertRequest) GetDedup() bool {
+	if x != nil {
+		return x.Dedup
+	}
+	return false
+}
+
+func (x *ConvertRequest) GetRateLimit() int64 {
+	if x != nil {
+		return x.RateLimit
+	}
+	return 0
+}
+
+func (x *ConvertRequest) GetOverwrite() bool {
+	if x != nil {
+		return x.Overwrite
+	}
+	return false
+}
+
+// ConvertProgress the progress of the conversion. The last message has done == total.
+type ConvertProgress struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// done the number of bytes which have been copied.
+	Done int64 `protobuf:"varint,1,opt,name=done,proto3" json:"done,omitempty"`
+	// total the number of bytes to be copied.
+	Total         int64 `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertProgress) Reset() {
+	*x = ConvertProgress{}
+	mi := &file_qcow2_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertProgress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertProgress) ProtoMessage() {}
+
+func (x *ConvertProgress) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertProgress.ProtoReflect.Descriptor instead.
+func (*ConvertProgress) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ConvertProgress) GetDone() int64 {
+	if x != nil {
+		return x.Done
+	}
+	return 0
+}
+
+func (x *ConvertProgress) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+// SnapshotInfo the internal snapshot of the image.
+type SnapshotInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	VmStateSize   int64                  `protobuf:"varint,3,opt,name=vm_state_size,json=vmStateSize,proto3" json:"vm_state_size,omitempty"`
+	DateSec       int64                  `protobuf:"varint,4,opt,name=date_sec,json=dateSec,proto3" json:"date_sec,omitempty"`
+	DateNsec      int64                  `protobuf:"varint,5,opt,name=date_nsec,json=dateNsec,proto3" json:"date_nsec,omitempty"`
+	VmClockSec    int64                  `protobuf:"varint,6,opt,name=vm_clock_sec,json=vmClockSec,proto3" json:"vm_clock_sec,omitempty"`
+	VmClockNsec   int64                  `protobuf:"varint,7,opt,name=vm_clock_nsec,json=vmClockNsec,proto3" json:"vm_clock_nsec,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotInfo) Reset() {
+	*x = SnapshotInfo{}
+	mi := &file_qcow2_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotInfo) ProtoMessage() {}
+
+func (x *SnapshotInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotInfo.ProtoReflect.Descriptor instead.
+func (*SnapshotInfo) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SnapshotInfo) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *SnapshotInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SnapshotInfo) GetVmStateSize() int64 {
+	if x != nil {
+		return x.VmStateSize
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetDateSec() int64 {
+	if x != nil {
+		return x.DateSec
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetDateNsec() int64 {
+	if x != nil {
+		return x.DateNsec
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetVmClockSec() int64 {
+	if x != nil {
+		return x.VmClockSec
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetVmClockNsec() int64 {
+	if x != nil {
+		return x.VmClockNsec
+	}
+	return 0
+}
+
+type SnapshotRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Filename string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Format   string                 `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	Action   SnapshotRequest_Action `protobuf:"varint,3,opt,name=action,proto3,enum=goqcow2.v1.SnapshotRequest_Action" json:"action,omitempty"`
+	// name the name of the snapshot, or the ID or name of APPLY and DELETE.
+	Name          string `protobuf:"bytes,4,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_qcow2_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SnapshotRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *SnapshotRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *SnapshotRequest) GetAction() SnapshotRequest_Action {
+	if x != nil {
+		return x.Action
+	}
+	return SnapshotRequest_LIST
+}
+
+func (x *SnapshotRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type SnapshotResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// snapshots the snapshots of LIST, or the created snapshot of CREATE.
+	Snapshots     []*SnapshotInfo `protobuf:"bytes,1,rep,name=snapshots,proto3" json:"snapshots,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotResponse) Reset() {
+	*x = SnapshotResponse{}
+	mi := &file_qcow2_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotResponse) ProtoMessage() {}
+
+func (x *SnapshotResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotResponse.ProtoReflect.Descriptor instead.
+func (*SnapshotResponse) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *SnapshotResponse) GetSnapshots() []*SnapshotInfo {
+	if x != nil {
+		return x.Snapshots
+	}
+	return nil
+}
+
+// Export the image exported by the server.
+type Export struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// id the unique ID of the export.
+	Id       string      `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Type     Export_Type `protobuf:"varint,2,opt,name=type,proto3,enum=goqcow2.v1.Export_Type" json:"type,omitempty"`
+	Filename string      `protobuf:"bytes,3,opt,name=filename,proto3" json:"filename,omitempty"`
+	ReadOnly bool        `protobuf:"varint,4,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	// address the address of the NBD server, "unix:<path>" or "<host>:<port>", or the mountpoint of FUSE.
+	Address       string `protobuf:"bytes,5,opt,name=address,proto3" json:"address,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Export) Reset() {
+	*x = Export{}
+	mi := &file_qcow2_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Export) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Export) ProtoMessage() {}
+
+func (x *Export) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Export.ProtoReflect.Descriptor instead.
+func (*Export) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Export) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Export) GetType() Export_Type {
+	if x != nil {
+		return x.Type
+	}
+	return Export_NBD
+}
+
+func (x *Export) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *Export) GetReadOnly() bool {
+	if x != nil {
+		return x.ReadOnly
+	}
+	return false
+}
+
+func (x *Export) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type AddExportRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// id the unique ID of the export.
+	Id       string      `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Type     Export_Type `protobuf:"varint,2,opt,name=type,proto3,enum=goqcow2.v1.Export_Type" json:"type,omitempty"`
+	Filename string      `protobuf:"bytes,3,opt,name=filename,proto3" json:"filename,omitempty"`
+	Format   string      `protobuf:"bytes,4,opt,name=format,proto3" json:"format,omitempty"`
+	ReadOnly bool        `protobuf:"varint,5,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	// address the address which the NBD server listens on, "unix:<path>" or "<host>:<port>", or the
+	// mountpoint of FUSE, which must be the regular file.
+	Address string `protobuf:"bytes,6,opt,name=address,proto3" json:"address,omitempty"`
+	// name the NBD export name.
+	Name string `protobuf:"bytes,7,opt,name=name,proto3" json:"name,omitempty"`
+	// description the NBD export description.
+	Description string `protobuf:"bytes,8,opt,name=description,proto3" json:"description,omitempty"`
+	// allow_other allows the other users to access the FUSE export.
+	AllowOther    bool `protobuf:"varint,9,opt,name=allow_other,json=allowOther,proto3" json:"allow_other,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddExportRequest) Reset() {
+	*x = AddExportRequest{}
+	mi := &file_qcow2_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddExportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddExportRequest) ProtoMessage() {}
+
+func (x *AddExportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddExportRequest.ProtoReflect.Descriptor instead.
+func (*AddExportRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *AddExportRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetType() Export_Type {
+	if x != nil {
+		return x.Type
+	}
+	return Export_NBD
+}
+
+func (x *AddExportRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetReadOnly() bool {
+	if x != nil {
+		return x.ReadOnly
+	}
+	return false
+}
+
+func (x *AddExportRequest) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *AddExportRequest) GetAllowOther() bool {
+	if x != nil {
+		return x.AllowOther
+	}
+	return false
+}
+
+type DeleteExportRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteExportRequest) Reset() {
+	*x = DeleteExportRequest{}
+	mi := &file_qcow2_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteExportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteExportRequest) ProtoMessage() {}
+
+func (x *DeleteExportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteExportRequest.ProtoReflect.Descriptor instead.
+func (*DeleteExportRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *DeleteExportRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type DeleteExportResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteExportResponse) Reset() {
+	*x = DeleteExportResponse{}
+	mi := &file_qcow2_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteExportResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteExportResponse) ProtoMessage() {}
+
+func (x *DeleteExportResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteExportResponse.ProtoReflect.Descriptor instead.
+func (*DeleteExportResponse) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{15}
+}
+
+type ListExportsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListExportsRequest) Reset() {
+	*x = ListExportsRequest{}
+	mi := &file_qcow2_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListExportsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListExportsRequest) ProtoMessage() {}
+
+func (x *ListExportsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListExportsRequest.ProtoReflect.Descriptor instead.
+func (*ListExportsRequest) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{16}
+}
+
+type ListExportsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Exports       []*Export              `protobuf:"bytes,1,rep,name=exports,proto3" json:"exports,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListExportsResponse) Reset() {
+	*x = ListExportsResponse{}
+	mi := &file_qcow2_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListExportsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListExportsResponse) ProtoMessage() {}
+
+func (x *ListExportsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_qcow2_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListExportsResponse.ProtoReflect.Descriptor instead.
+func (*ListExportsResponse) Descriptor() ([]byte, []int) {
+	return file_qcow2_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *ListExportsResponse) GetExports() []*Export {
+	if x != nil {
+		return x.Exports
+	}
+	return nil
+}
+
+var File_qcow2_proto protoreflect.FileDescriptor
+
+const file_qcow2_proto_rawDesc = "" +
+	"\n" +
+	"\vqcow2.proto\x12\n" +
+	"goqcow2.v1\"\x9b\x02\n" +
+	"\fImageOptions\x12!\n" +
+	"\fbacking_file\x18\x01 \x01(\tR\vbackingFile\x12%\n" +
+	"\x0ebacking_format\x18\x02 \x01(\tR\rbackingFormat\x12!\n" +
+	"\fcluster_size\x18\x03 \x01(\x03R\vclusterSize\x12\x16\n" +
+	"\x06compat\x18\x04 \x01(\tR\x06compat\x12%\n" +
+	"\x0elazy_refcounts\x18\x05 \x01(\bR\rlazyRefcounts\x12#\n" +
+	"\rrefcount_bits\x18\x06 \x01(\x05R\frefcountBits\x12$\n" +
+	"\rpreallocation\x18\a \x01(\tR\rpreallocation\x12\x14\n" +
+	"\x05nocow\x18\b \x01(\bR\x05nocow\"\xa9\x01\n" +
+	"\rCreateRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x122\n" +
+	"\aoptions\x18\x04 \x01(\v2\x18.goqcow2.v1.ImageOptionsR\aoptions\x12\x1c\n" +
+	"\toverwrite\x18\x05 \x01(\bR\toverwrite\"\xfc\x04\n" +
+	"\tImageInfo\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12\x1d\n" +
+	"\n" +
+	"dirty_flag\x18\x03 \x01(\bR\tdirtyFlag\x12\x1f\n" +
+	"\vactual_size\x18\x04 \x01(\x03R\n" +
+	"actualSize\x12!\n" +
+	"\fvirtual_size\x18\x05 \x01(\x03R\vvirtualSize\x12!\n" +
+	"\fcluster_size\x18\x06 \x01(\x03R\vclusterSize\x12\x1c\n" +
+	"\tencrypted\x18\a \x01(\bR\tencrypted\x12)\n" +
+	"\x10backing_filename\x18\b \x01(\tR\x0fbackingFilename\x122\n" +
+	"\x15full_backing_filename\x18\t \x01(\tR\x13fullBackingFilename\x126\n" +
+	"\x17backing_filename_format\x18\n" +
+	" \x01(\tR\x15backingFilenameFormat\x12\x16\n" +
+	"\x06compat\x18\v \x01(\tR\x06compat\x12)\n" +
+	"\x10compression_type\x18\f \x01(\tR\x0fcompressionType\x12%\n" +
+	"\x0elazy_refcounts\x18\r \x01(\bR\rlazyRefcounts\x12#\n" +
+	"\rrefcount_bits\x18\x0e \x01(\x05R\frefcountBits\x12\x18\n" +
+	"\acorrupt\x18\x0f \x01(\bR\acorrupt\x12\x1f\n" +
+	"\vextended_l2\x18\x10 \x01(\bR\n" +
+	"extendedL2\x126\n" +
+	"\tsnapshots\x18\x11 \x03(\v2\x18.goqcow2.v1.SnapshotInfoR\tsnapshots\"\x87\x01\n" +
+	"\vInfoRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12#\n" +
+	"\rbacking_chain\x18\x03 \x01(\bR\fbackingChain\x12\x1f\n" +
+	"\vforce_share\x18\x04 \x01(\bR\n" +
+	"forceShare\"=\n" +
+	"\fInfoResponse\x12-\n" +
+	"\x06images\x18\x01 \x03(\v2\x15.goqcow2.v1.ImageInfoR\x06images\"\xc4\x01\n" +
+	"\fCheckRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x127\n" +
+	"\x06repair\x18\x03 \x01(\x0e2\x1f.goqcow2.v1.CheckRequest.RepairR\x06repair\x12\x1f\n" +
+	"\vforce_share\x18\x04 \x01(\bR\n" +
+	"forceShare\"&\n" +
+	"\x06Repair\x12\b\n" +
+	"\x04NONE\x10\x00\x12\t\n" +
+	"\x05LEAKS\x10\x01\x12\a\n" +
+	"\x03ALL\x10\x02\"\xce\x03\n" +
+	"\rCheckResponse\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12!\n" +
+	"\fcheck_errors\x18\x03 \x01(\x03R\vcheckErrors\x12(\n" +
+	"\x10image_end_offset\x18\x04 \x01(\x03R\x0eimageEndOffset\x12 \n" +
+	"\vcorruptions\x18\x05 \x01(\x03R\vcorruptions\x12\x14\n" +
+	"\x05leaks\x18\x06 \x01(\x03R\x05leaks\x12+\n" +
+	"\x11corruptions_fixed\x18\a \x01(\x03R\x10corruptionsFixed\x12\x1f\n" +
+	"\vleaks_fixed\x18\b \x01(\x03R\n" +
+	"leaksFixed\x12%\n" +
+	"\x0etotal_clusters\x18\t \x01(\x03R\rtotalClusters\x12-\n" +
+	"\x12allocated_clusters\x18\n" +
+	" \x01(\x03R\x11allocatedClusters\x12/\n" +
+	"\x13fragmented_clusters\x18\v \x01(\x03R\x12fragmentedClusters\x12/\n" +
+	"\x13compressed_clusters\x18\f \x01(\x03R\x12compressedClusters\"\xdb\x02\n" +
+	"\x0eConvertRequest\x12\x16\n" +
+	"\x06source\x18\x01 \x01(\tR\x06source\x12#\n" +
+	"\rsource_format\x18\x02 \x01(\tR\fsourceFormat\x12,\n" +
+	"\x12source_force_share\x18\x03 \x01(\bR\x10sourceForceShare\x12\x16\n" +
+	"\x06target\x18\x04 \x01(\tR\x06target\x12#\n" +
+	"\rtarget_format\x18\x05 \x01(\tR\ftargetFormat\x122\n" +
+	"\aoptions\x18\x06 \x01(\v2\x18.goqcow2.v1.ImageOptionsR\aoptions\x12\x1a\n" +
+	"\bcompress\x18\a \x01(\bR\bcompress\x12\x14\n" +
+	"\x05dedup\x18\b \x01(\bR\x05dedup\x12\x1d\n" +
+	"\n" +
+	"rate_limit\x18\t \x01(\x03R\trateLimit\x12\x1c\n" +
+	"\toverwrite\x18\n" +
+	" \x01(\bR\toverwrite\";\n" +
+	"\x0fConvertProgress\x12\x12\n" +
+	"\x04done\x18\x01 \x01(\x03R\x04done\x12\x14\n" +
+	"\x05total\x18\x02 \x01(\x03R\x05total\"\xd4\x01\n" +
+	"\fSnapshotInfo\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\"\n" +
+	"\rvm_state_size\x18\x03 \x01(\x03R\vvmStateSize\x12\x19\n" +
+	"\bdate_sec\x18\x04 \x01(\x03R\adateSec\x12\x1b\n" +
+	"\tdate_nsec\x18\x05 \x01(\x03R\bdateNsec\x12 \n" +
+	"\fvm_clock_sec\x18\x06 \x01(\x03R\n" +
+	"vmClockSec\x12\"\n" +
+	"\rvm_clock_nsec\x18\a \x01(\x03R\vvmClockNsec\"\xcc\x01\n" +
+	"\x0fSnapshotRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12:\n" +
+	"\x06action\x18\x03 \x01(\x0e2\".goqcow2.v1.SnapshotRequest.ActionR\x06action\x12\x12\n" +
+	"\x04name\x18\x04 \x01(\tR\x04name\"5\n" +
+	"\x06Action\x12\b\n" +
+	"\x04LIST\x10\x00\x12\n" +
+	"\n" +
+	"\x06CREATE\x10\x01\x12\t\n" +
+	"\x05APPLY\x10\x02\x12\n" +
+	"\n" +
+	"\x06DELETE\x10\x03\"J\n" +
+	"\x10SnapshotResponse\x126\n" +
+	"\tsnapshots\x18\x01 \x03(\v2\x18.goqcow2.v1.SnapshotInfoR\tsnapshots\"\xb3\x01\n" +
+	"\x06Export\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12+\n" +
+	"\x04type\x18\x02 \x01(\x0e2\x17.goqcow2.v1.Export.TypeR\x04type\x12\x1a\n" +
+	"\bfilename\x18\x03 \x01(\tR\bfilename\x12\x1b\n" +
+	"\tread_only\x18\x04 \x01(\bR\breadOnly\x12\x18\n" +
+	"\aaddress\x18\x05 \x01(\tR\aaddress\"\x19\n" +
+	"\x04Type\x12\a\n" +
+	"\x03NBD\x10\x00\x12\b\n" +
+	"\x04FUSE\x10\x01\"\x91\x02\n" +
+	"\x10AddExportRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12+\n" +
+	"\x04type\x18\x02 \x01(\x0e2\x17.goqcow2.v1.Export.TypeR\x04type\x12\x1a\n" +
+	"\bfilename\x18\x03 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06format\x18\x04 \x01(\tR\x06format\x12\x1b\n" +
+	"\tread_only\x18\x05 \x01(\bR\breadOnly\x12\x18\n" +
+	"\aaddress\x18\x06 \x01(\tR\aaddress\x12\x12\n" +
+	"\x04name\x18\a \x01(\tR\x04name\x12 \n" +
+	"\vdescription\x18\b \x01(\tR\vdescription\x12\x1f\n" +
+	"\vallow_other\x18\t \x01(\bR\n" +
+	"allowOther\"%\n" +
+	"\x13DeleteExportRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x16\n" +
+	"\x14DeleteExportResponse\"\x14\n" +
+	"\x12ListExportsRequest\"C\n" +
+	"\x13ListExportsResponse\x12,\n" +
+	"\aexports\x18\x01 \x03(\v2\x12.goqcow2.v1.ExportR\aexports2\xb2\x04\n" +
+	"\fImageService\x12:\n" +
+	"\x06Create\x12\x19.goqcow2.v1.CreateRequest\x1a\x15.goqcow2.v1.ImageInfo\x129\n" +
+	"\x04Info\x12\x17.goqcow2.v1.InfoRequest\x1a\x18.goqcow2.v1.InfoResponse\x12<\n" +
+	"\x05Check\x12\x18.goqcow2.v1.CheckRequest\x1a\x19.goqcow2.v1.CheckResponse\x12D\n" +
+	"\aConvert\x12\x1a.goqcow2.v1.ConvertRequest\x1a\x1b.goqcow2.v1.ConvertProgress0\x01\x12E\n" +
+	"\bSnapshot\x12\x1b.goqcow2.v1.SnapshotRequest\x1a\x1c.goqcow2.v1.SnapshotResponse\x12=\n" +
+	"\tAddExport\x12\x1c.goqcow2.v1.AddExportRequest\x1a\x12.goqcow2.v1.Export\x12Q\n" +
+	"\fDeleteExport\x12\x1f.goqcow2.v1.DeleteExportRequest\x1a .goqcow2.v1.DeleteExportResponse\x12N\n" +
+	"\vListExports\x12\x1e.goqcow2.v1.ListExportsRequest\x1a\x1f.goqcow2.v1.ListExportsResponseB\x1fZ\x1dgithub.com/zchee/go-qcow2/rpcb\x06proto3"
+
+var (
+	file_qcow2_proto_rawDescOnce sync.Once
+	file_qcow2_proto_rawDescData []byte
+)
+
+func file_qcow2_proto_rawDescGZIP() []byte {
+	file_qcow2_proto_rawDescOnce.Do(func() {
+		file_qcow2_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_qcow2_proto_rawDesc), len(file_qcow2_proto_rawDesc)))
+	})
+	return file_qcow2_proto_rawDescData
+}
+
+var file_qcow2_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_qcow2_proto_msgTypes = make([]protoimpl.MessageInfo, 18)
+var file_qcow2_proto_goTypes = []any{
+	(CheckRequest_Repair)(0),     // 0: goqcow2.v1.CheckRequest.Repair
+	(SnapshotRequest_Action)(0),  // 1: goqcow2.v1.SnapshotRequest.Action
+	(Export_Type)(0),             // 2: goqcow2.v1.Export.Type
+	(*ImageOptions)(nil),         // 3: goqcow2.v1.ImageOptions
+	(*CreateRequest)(nil),        // 4: goqcow2.v1.CreateRequest
+	(*ImageInfo)(nil),            // 5: goqcow2.v1.ImageInfo
+	(*InfoRequest)(nil),          // 6: goqcow2.v1.InfoRequest
+	(*InfoResponse)(nil),         // 7: goqcow2.v1.InfoResponse
+	(*CheckRequest)(nil),         // 8: goqcow2.v1.CheckRequest
+	(*CheckResponse)(nil),        // 9: goqcow2.v1.CheckResponse
+	(*ConvertRequest)(nil),       // 10: goqcow2.v1.ConvertRequest
+	(*ConvertProgress)(nil),      // 11: goqcow2.v1.ConvertProgress
+	(*SnapshotInfo)(nil),         // 12: goqcow2.v1.SnapshotInfo
+	(*SnapshotRequest)(nil),      // 13: goqcow2.v1.SnapshotRequest
+	(*SnapshotResponse)(nil),     // 14: goqcow2.v1.SnapshotResponse
+	(*Export)(nil),               // 15: goqcow2.v1.Export
+	(*AddExportRequest)(nil),     // 16: goqcow2.v1.AddExportRequest
+	(*DeleteExportRequest)(nil),  // 17: goqcow2.v1.DeleteExportRequest
+	(*DeleteExportResponse)(nil), // 18: goqcow2.v1.DeleteExportResponse
+	(*ListExportsRequest)(nil),   // 19: goqcow2.v1.ListExportsRequest
+	(*ListExportsResponse)(nil),  // 20: goqcow2.v1.ListExportsResponse
+}
+var file_qcow2_proto_depIdxs = []int32{
+	3,  // 0: goqcow2.v1.CreateRequest.options:type_name -> goqcow2.v1.ImageOptions
+	12, // 1: goqcow2.v1.ImageInfo.snapshots:type_name -> goqcow2.v1.SnapshotInfo
+	5,  // 2: goqcow2.v1.InfoResponse.images:type_name -> goqcow2.v1.ImageInfo
+	0,  // 3: goqcow2.v1.CheckRequest.repair:type_name -> goqcow2.v1.CheckRequest.Repair
+	3,  // 4: goqcow2.v1.ConvertRequest.options:type_name -> goqcow2.v1.ImageOptions
+	1,  // 5: goqcow2.v1.SnapshotRequest.action:type_name -> goqcow2.v1.SnapshotRequest.Action
+	12, // 6: goqcow2.v1.SnapshotResponse.snapshots:type_name -> goqcow2.v1.SnapshotInfo
+	2,  // 7: goqcow2.v1.Export.type:type_name -> goqcow2.v1.Export.Type
+	2,  // 8: goqcow2.v1.AddExportRequest.type:type_name -> goqcow2.v1.Export.Type
+	15, // 9: goqcow2.v1.ListExportsResponse.exports:type_name -> goqcow2.v1.Export
+	4,  // 10: goqcow2.v1.ImageService.Create:input_type -> goqcow2.v1.CreateRequest
+	6,  // 11: goqcow2.v1.ImageService.Info:input_type -> goqcow2.v1.InfoRequest
+	8,  // 12: goqcow2.v1.ImageService.Check:input_type -> goqcow2.v1.CheckRequest
+	10, // 13: goqcow2.v1.ImageService.Convert:input_type -> goqcow2.v1.ConvertRequest
+	13, // 14: goqcow2.v1.ImageService.Snapshot:input_type -> goqcow2.v1.SnapshotRequest
+	16, // 15: goqcow2.v1.ImageService.AddExport:input_type -> goqcow2.v1.AddExportRequest
+	17, // 16: goqcow2.v1.ImageService.DeleteExport:input_type -> goqcow2.v1.DeleteExportRequest
+	19, // 17: goqcow2.v1.ImageService.ListExports:input_type -> goqcow2.v1.ListExportsRequest
+	5,  // 18: goqcow2.v1.ImageService.Create:output_type -> goqcow2.v1.ImageInfo
+	7,  // 19: goqcow2.v1.ImageService.Info:output_type -> goqcow2.v1.InfoResponse
+	9,  // 20: goqcow2.v1.ImageService.Check:output_type -> goqcow2.v1.CheckResponse
+	11, // 21: goqcow2.v1.ImageService.Convert:output_type -> goqcow2.v1.ConvertProgress
+	14, // 22: goqcow2.v1.ImageService.Snapshot:output_type -> goqcow2.v1.SnapshotResponse
+	15, // 23: goqcow2.v1.ImageService.AddExport:output_type -> goqcow2.v1.Export
+	18, // 24: goqcow2.v1.ImageService.DeleteExport:output_type -> goqcow2.v1.DeleteExportResponse
+	20, // 25: goqcow2.v1.ImageService.ListExports:output_type -> goqcow2.v1.ListExportsResponse
+	18, // [18:26] is the sub-list for method output_type
+	10, // [10:18] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_qcow2_proto_init() }
+func file_qcow2_proto_init() {
+	if File_qcow2_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_qcow2_proto_rawDesc), len(file_qcow2_proto_rawDesc)),
+			NumEnums:      3,
+			NumMessages:   18,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_qcow2_proto_goTypes,
+		DependencyIndexes: file_qcow2_proto_depIdxs,
+		EnumInfos:         file_qcow2_proto_enumTypes,
+		MessageInfos:      file_qcow2_proto_msgTypes,
+	}.Build()
+	File_qcow2_proto = out.File
+	file_qcow2_proto_goTypes = nil
+	file_qcow2_proto_depIdxs = nil
+}
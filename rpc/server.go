@@ -0,0 +1,658 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rpc serves the image management operations over gRPC, same as the block commands of the QMP
+// (QEMU Machine Protocol) of qemu-storage-daemon, so the orchestration daemons written in the other languages
+// can drive the library remotely.
+//
+// The ImageService of qcow2.proto creates, inspects, checks, converts and snapshots the images, and exports
+// them over NBD or FUSE. The conversion streams its progress. The filenames are the paths on the host of the
+// server, which are confined to Options.Root if it is set, and the server has no authentication of its own,
+// so serve it on the unix socket, or with the transport credentials of grpc.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative qcow2.proto
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+	"github.com/zchee/go-qcow2/fuse"
+	"github.com/zchee/go-qcow2/internal/confine"
+	"github.com/zchee/go-qcow2/nbd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options represents the options of the Server.
+type Options struct {
+	// Root confines the filenames of the requests, the backing files of the images, the FUSE mountpoints and
+	// the unix sockets of the NBD exports to the directory. The relative filenames are relative to Root, and
+	// the symbolic links are resolved before the check. The calls of the filenames outside of Root fail with
+	// PERMISSION_DENIED. If empty, any file of the host is allowed.
+	Root string
+}
+
+// Server implements the ImageServiceServer.
+type Server struct {
+	UnimplementedImageServiceServer
+
+	root string
+
+	// mu guards exports.
+	mu      sync.Mutex
+	exports map[string]*export
+}
+
+// export represents the running export of the image.
+type export struct {
+	info *Export
+	img  *qcow2.QCow2
+	// close stops the export.
+	close func() error
+	// done is closed when the export stops serving.
+	done chan struct{}
+}
+
+var _ ImageServiceServer = (*Server)(nil)
+
+// NewServer returns the new Server. If opts is nil, the default options are used.
+func NewServer(opts *Options) *Server {
+	srv := &Server{
+		exports: make(map[string]*export),
+	}
+	if opts != nil {
+		srv.root = opts.Root
+	}
+	return srv
+}
+
+// Register registers the Server to the grpc server s.
+func (srv *Server) Register(s *grpc.Server) {
+	RegisterImageServiceServer(s, srv)
+}
+
+// Close stops all of the exports.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	exports := srv.exports
+	srv.exports = make(map[string]*export)
+	srv.mu.Unlock()
+
+	var err error
+	for _, e := range exports {
+		if cerr := e.stop(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Create creates the new image.
+//  qemu-img.c: static int img_create(int argc, char **argv)
+func (srv *Server) Create(ctx context.Context, req *CreateRequest) (*ImageInfo, error) {
+	if req.Format != "" && req.Format != string(qcow2.DriverQCow2) {
+		return nil, grpcError(errors.Wrapf(ErrInvalidArgument, "Format driver '%s' does not support image creation", req.Format))
+	}
+
+	filename, err := srv.createPath(req.Filename, req.Overwrite)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	opts := &qcow2.Opts{
+		Filename: filename,
+		Fmt:      qcow2.DriverQCow2,
+		Size:     req.Size,
+	}
+	if err := setImageOptions(opts, req.Options); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := confine.Backing(srv.root, filename, opts.BackingFile); err != nil {
+		return nil, grpcError(err)
+	}
+	if opts.Size == 0 && opts.BackingFile == "" {
+		return nil, grpcError(errors.Wrap(ErrInvalidArgument, "Image creation needs a size parameter"))
+	}
+
+	img, err := qcow2.CreateContext(ctx, opts)
+	if err != nil {
+		return nil, grpcError(errors.Wrapf(err, "%s", req.Filename))
+	}
+	defer img.Close()
+
+	info, err := imageInfo(img)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return info, nil
+}
+
+// Info returns the information of the image, and its backing chain.
+//  qemu-img.c: static int img_info(int argc, char **argv)
+func (srv *Server) Info(ctx context.Context, req *InfoRequest) (*InfoResponse, error) {
+	img, err := srv.openImage(req.Filename, req.Format, os.O_RDONLY, &qcow2.OpenOpts{
+		NoBacking: !req.BackingChain,
+		Force:     req.ForceShare,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer img.Close()
+
+	images := []*qcow2.QCow2{img}
+	if req.BackingChain {
+		backings, err := img.BackingChain()
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		for _, backing := range backings {
+			defer backing.Close()
+		}
+		images = append(images, backings...)
+	}
+
+	resp := new(InfoResponse)
+	for _, image := range images {
+		info, err := imageInfo(image)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		resp.Images = append(resp.Images, info)
+	}
+	return resp, nil
+}
+
+// Check checks the consistency of the image, and repairs it by the repair mode.
+//  qemu-img.c: static int img_check(int argc, char **argv)
+func (srv *Server) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	var fix qcow2.CheckMode
+	switch req.Repair {
+	case CheckRequest_NONE:
+		// nothing to do
+	case CheckRequest_LEAKS:
+		fix = qcow2.BDRV_FIX_LEAKS
+	case CheckRequest_ALL:
+		fix = qcow2.BDRV_FIX_LEAKS | qcow2.BDRV_FIX_ERRORS
+	default:
+		return nil, grpcError(errors.Wrapf(ErrInvalidArgument, "Unknown repair mode %d", req.Repair))
+	}
+
+	flags := os.O_RDONLY
+	if fix != 0 {
+		flags = os.O_RDWR
+		if req.ForceShare {
+			return nil, grpcError(errors.Wrap(ErrInvalidArgument, "force_share is not supported with repair"))
+		}
+	}
+	img, err := srv.openImage(req.Filename, req.Format, flags, &qcow2.OpenOpts{
+		Force:  req.ForceShare,
+		Repair: true,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer img.Close()
+
+	check, err := img.Check(fix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &CheckResponse{
+		Filename:           check.Filename,
+		Format:             string(check.Format),
+		CheckErrors:        int64(check.CheckErrors),
+		ImageEndOffset:     check.ImageEndOffset,
+		Corruptions:        int64(check.Corruptions),
+		Leaks:              int64(check.Leaks),
+		CorruptionsFixed:   int64(check.CorruptionsFixed),
+		LeaksFixed:         int64(check.LeaksFixed),
+		TotalClusters:      check.TotalClusters,
+		AllocatedClusters:  check.AllocatedClusters,
+		FragmentedClusters: check.FragmentedClusters,
+		CompressedClusters: check.CompressedClusters,
+	}, nil
+}
+
+// Convert converts the source image to the target image, and streams the progress of the conversion.
+// The conversion is cancelled if the client cancels the call.
+//  qemu-img.c: static int img_convert(int argc, char **argv)
+func (srv *Server) Convert(req *ConvertRequest, stream ImageService_ConvertServer) error {
+	format := req.TargetFormat
+	if format == "" {
+		format = string(qcow2.DriverRaw)
+	}
+	target, err := srv.createPath(req.Target, req.Overwrite)
+	if err != nil {
+		return grpcError(err)
+	}
+	opts := &qcow2.Opts{
+		Filename: target,
+		Fmt:      qcow2.DriverFmt(format),
+	}
+	if req.Options != nil && format != string(qcow2.DriverQCow2) {
+		return grpcError(errors.Wrapf(ErrInvalidArgument, "Format driver '%s' does not support the options", format))
+	}
+	if err := setImageOptions(opts, req.Options); err != nil {
+		return grpcError(err)
+	}
+	if err := confine.Backing(srv.root, target, opts.BackingFile); err != nil {
+		return grpcError(err)
+	}
+	if req.RateLimit < 0 {
+		return grpcError(errors.Wrapf(ErrInvalidArgument, "Invalid rate limit specified: %d", req.RateLimit))
+	}
+
+	src, err := srv.openImage(req.Source, req.SourceFormat, os.O_RDONLY, &qcow2.OpenOpts{
+		Force: req.SourceForceShare,
+	})
+	if err != nil {
+		return grpcError(errors.Wrapf(err, "Could not open '%s'", req.Source))
+	}
+	defer src.Close()
+
+	// the progress is sent whenever it advances by 1 percent, same as qemu-img convert -p
+	var sendErr error
+	var last int64 = -1
+	copts := &qcow2.ConvertOpts{
+		Compress:  req.Compress,
+		Dedup:     req.Dedup,
+		RateLimit: qcow2.RateLimit{Speed: req.RateLimit},
+		Progress: func(done, total int64) {
+			if sendErr != nil || (last >= 0 && total > 0 && (done-last)*100 < total && done < total) {
+				return
+			}
+			last = done
+			sendErr = stream.Send(&ConvertProgress{Done: done, Total: total})
+		},
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	if err := qcow2.ConvertContext(ctx, src, opts, copts); err != nil {
+		return grpcError(err)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return nil
+}
+
+// Snapshot lists, creates, applies or deletes the internal snapshots of the image.
+//  qemu-img.c: static int img_snapshot(int argc, char **argv)
+func (srv *Server) Snapshot(ctx context.Context, req *SnapshotRequest) (*SnapshotResponse, error) {
+	flags := os.O_RDWR
+	if req.Action == SnapshotRequest_LIST {
+		flags = os.O_RDONLY
+	} else if req.Name == "" {
+		return nil, grpcError(errors.Wrap(ErrInvalidArgument, "Snapshot name is required"))
+	}
+
+	img, err := srv.openImage(req.Filename, req.Format, flags, &qcow2.OpenOpts{
+		NoBacking: true,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer img.Close()
+
+	resp := new(SnapshotResponse)
+	switch req.Action {
+	case SnapshotRequest_LIST:
+		snapshots, err := img.Snapshots()
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		for i := range snapshots {
+			resp.Snapshots = append(resp.Snapshots, snapshotInfo(&snapshots[i]))
+		}
+	case SnapshotRequest_CREATE:
+		sn, err := img.CreateSnapshot(req.Name)
+		if err != nil {
+			return nil, grpcError(errors.Wrapf(err, "Could not create snapshot '%s'", req.Name))
+		}
+		resp.Snapshots = append(resp.Snapshots, snapshotInfo(sn))
+	case SnapshotRequest_APPLY:
+		if err := img.ApplySnapshot(req.Name); err != nil {
+			return nil, grpcError(errors.Wrapf(err, "Could not apply snapshot '%s'", req.Name))
+		}
+	case SnapshotRequest_DELETE:
+		if err := img.DeleteSnapshot(req.Name); err != nil {
+			return nil, grpcError(errors.Wrapf(err, "Could not delete snapshot '%s'", req.Name))
+		}
+	default:
+		return nil, grpcError(errors.Wrapf(ErrInvalidArgument, "Unknown snapshot action %d", req.Action))
+	}
+
+	return resp, nil
+}
+
+// AddExport opens the image, and exports it over NBD or FUSE until DeleteExport or Close.
+//  blockdev-nbd.c: void qmp_block_export_add(BlockExportOptions *export, Error **errp)
+func (srv *Server) AddExport(ctx context.Context, req *AddExportRequest) (*Export, error) {
+	if req.Id == "" {
+		return nil, grpcError(errors.Wrap(ErrInvalidArgument, "Export ID is required"))
+	}
+	if req.Address == "" {
+		return nil, grpcError(errors.Wrap(ErrInvalidArgument, "Export address is required"))
+	}
+
+	srv.mu.Lock()
+	_, exists := srv.exports[req.Id]
+	srv.mu.Unlock()
+	if exists {
+		return nil, grpcError(errors.Wrapf(ErrExportExists, "Export '%s' already exists", req.Id))
+	}
+
+	// the FUSE mountpoint and the unix socket are the files of the host, same as the image
+	address := req.Address
+	if req.Type == Export_FUSE {
+		path, err := confine.Path(srv.root, address)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		address = path
+	} else if strings.HasPrefix(address, "unix:") {
+		path, err := confine.Path(srv.root, strings.TrimPrefix(address, "unix:"))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		address = "unix:" + path
+	}
+
+	flags := os.O_RDWR
+	if req.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	img, err := srv.openImage(req.Filename, req.Format, flags, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	e := &export{
+		info: &Export{
+			Id:       req.Id,
+			Type:     req.Type,
+			Filename: req.Filename,
+			ReadOnly: req.ReadOnly || img.ReadOnly(),
+			Address:  address,
+		},
+		img:  img,
+		done: make(chan struct{}),
+	}
+	switch req.Type {
+	case Export_NBD:
+		err = e.serveNBD(req, address)
+	case Export_FUSE:
+		err = e.serveFUSE(req, address)
+	default:
+		err = errors.Wrapf(ErrInvalidArgument, "Unknown export type %d", req.Type)
+	}
+	if err != nil {
+		img.Close()
+		return nil, grpcError(err)
+	}
+
+	srv.mu.Lock()
+	if _, exists := srv.exports[req.Id]; exists {
+		srv.mu.Unlock()
+		e.stop()
+		return nil, grpcError(errors.Wrapf(ErrExportExists, "Export '%s' already exists", req.Id))
+	}
+	srv.exports[req.Id] = e
+	srv.mu.Unlock()
+
+	return e.info, nil
+}
+
+// DeleteExport stops the export, and closes its image.
+//  block/export/export.c: void qmp_block_export_del(const char *id, bool has_mode, BlockExportRemoveMode mode, Error **errp)
+func (srv *Server) DeleteExport(ctx context.Context, req *DeleteExportRequest) (*DeleteExportResponse, error) {
+	srv.mu.Lock()
+	e, ok := srv.exports[req.Id]
+	delete(srv.exports, req.Id)
+	srv.mu.Unlock()
+	if !ok {
+		return nil, grpcError(errors.Wrapf(ErrExportNotFound, "Export '%s' is not found", req.Id))
+	}
+
+	if err := e.stop(); err != nil {
+		return nil, grpcError(err)
+	}
+	return new(DeleteExportResponse), nil
+}
+
+// ListExports returns the exports of the server.
+//  block/export/export.c: BlockExportInfoList *qmp_query_block_exports(Error **errp)
+func (srv *Server) ListExports(ctx context.Context, req *ListExportsRequest) (*ListExportsResponse, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	resp := new(ListExportsResponse)
+	for _, e := range srv.exports {
+		resp.Exports = append(resp.Exports, e.info)
+	}
+	return resp, nil
+}
+
+// serveNBD serves the image of req over NBD on address.
+func (e *export) serveNBD(req *AddExportRequest, address string) error {
+	ns := nbd.NewServer()
+	if err := ns.AddExport(&nbd.Export{
+		Name:        req.Name,
+		Description: req.Description,
+		Image:       e.img,
+		ReadOnly:    req.ReadOnly,
+	}); err != nil {
+		return err
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return errors.Wrapf(err, "Could not listen on '%s'", req.Address)
+	}
+	if network == "tcp" {
+		// the port may be assigned by the listener
+		e.info.Address = l.Addr().String()
+	}
+
+	go func() {
+		defer close(e.done)
+		ns.Serve(l)
+	}()
+	e.close = ns.Close
+
+	return nil
+}
+
+// serveFUSE mounts the guest disk of the image of req on the mountpoint.
+func (e *export) serveFUSE(req *AddExportRequest, mountpoint string) error {
+	exp, err := fuse.Mount(mountpoint, e.img, &fuse.Options{
+		ReadOnly:   req.ReadOnly,
+		AllowOther: req.AllowOther,
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer close(e.done)
+		exp.Serve()
+	}()
+	e.close = exp.Close
+
+	return nil
+}
+
+// stop stops the export, waits until it stops serving, and closes its image.
+func (e *export) stop() error {
+	err := e.close()
+	<-e.done
+	if cerr := e.img.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openImage opens the image of filename, which is confined to the root directory with its backing files.
+// If opts is nil, the default options are used.
+func (srv *Server) openImage(filename, format string, flag int, opts *qcow2.OpenOpts) (*qcow2.QCow2, error) {
+	path, err := confine.Path(srv.root, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var img *qcow2.QCow2
+	if opts == nil {
+		img, err = qcow2.OpenFileFormat(path, qcow2.DriverFmt(format), flag)
+	} else {
+		img, err = qcow2.OpenFileOpts(path, qcow2.DriverFmt(format), flag, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := confine.Chain(srv.root, img); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// createPath returns the path of the new file of filename, which is confined to the root directory. The
+// existing file is replaced only if overwrite is true.
+func (srv *Server) createPath(filename string, overwrite bool) (string, error) {
+	path, err := confine.Path(srv.root, filename)
+	if err != nil {
+		return "", err
+	}
+	if !overwrite {
+		if _, err := os.Lstat(path); err == nil {
+			return "", errors.Wrapf(ErrFileExists, "Could not create '%s'", filename)
+		}
+	}
+	return path, nil
+}
+
+// setImageOptions sets the creation options o to opts.
+func setImageOptions(opts *qcow2.Opts, o *ImageOptions) error {
+	if o == nil {
+		return nil
+	}
+
+	opts.BackingFile = o.BackingFile
+	opts.BackingFormat = o.BackingFormat
+	opts.ClusterSize = int(o.ClusterSize)
+	opts.Compat = o.Compat
+	opts.LazyRefcounts = o.LazyRefcounts
+	opts.RefcountBits = int(o.RefcountBits)
+	opts.NoCow = o.Nocow
+
+	if o.Preallocation != "" {
+		mode, err := qcow2.ParsePreallocMode(o.Preallocation)
+		if err != nil {
+			return err
+		}
+		opts.Preallocation = mode
+	}
+
+	return nil
+}
+
+// imageInfo returns the ImageInfo of img.
+//  block/qapi.c: void bdrv_query_image_info(BlockDriverState *bs, ImageInfo **p_info, Error **errp)
+func imageInfo(img *qcow2.QCow2) (*ImageInfo, error) {
+	info, err := img.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ImageInfo{
+		Filename:              info.Filename,
+		Format:                string(info.Format),
+		DirtyFlag:             info.DirtyFlag,
+		ActualSize:            info.ActualSize,
+		VirtualSize:           info.VirtualSize,
+		ClusterSize:           int64(info.ClusterSize),
+		Encrypted:             info.Encrypted,
+		BackingFilename:       info.BackingFilename,
+		FullBackingFilename:   info.FullBackingFilename,
+		BackingFilenameFormat: info.BackingFilenameFormat,
+	}
+	if spec := info.FormatSpecific; spec != nil && spec.Data != nil {
+		resp.Compat = spec.Data.Compat
+		resp.CompressionType = spec.Data.CompressionType
+		resp.LazyRefcounts = spec.Data.LazyRefcounts != nil && *spec.Data.LazyRefcounts
+		resp.RefcountBits = int32(spec.Data.RefcountBits)
+		resp.Corrupt = spec.Data.Corrupt != nil && *spec.Data.Corrupt
+		resp.ExtendedL2 = spec.Data.ExtendedL2
+	}
+
+	if info.Format == qcow2.DriverQCow2 {
+		snapshots, err := img.Snapshots()
+		if err != nil {
+			return nil, err
+		}
+		for i := range snapshots {
+			resp.Snapshots = append(resp.Snapshots, snapshotInfo(&snapshots[i]))
+		}
+	}
+
+	return resp, nil
+}
+
+// snapshotInfo returns the SnapshotInfo of sn.
+func snapshotInfo(sn *qcow2.SnapshotInfo) *SnapshotInfo {
+	return &SnapshotInfo{
+		Id:          sn.ID,
+		Name:        sn.Name,
+		VmStateSize: sn.VMStateSize,
+		DateSec:     sn.DateSec,
+		DateNsec:    sn.DateNsec,
+		VmClockSec:  sn.VMClockSec,
+		VmClockNsec: sn.VMClockNsec,
+	}
+}
+
+// grpcError returns the grpc status error of err, whose code is mapped from the errno of err.
+func grpcError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, qcow2.ErrCorrupt), errors.Is(err, qcow2.ErrLocked):
+		code = codes.FailedPrecondition
+	case errors.Is(err, syscall.ENOENT):
+		code = codes.NotFound
+	case errors.Is(err, syscall.EEXIST):
+		code = codes.AlreadyExists
+	case errors.Is(err, syscall.EINVAL), errors.Is(err, syscall.ERANGE), errors.Is(err, syscall.EFBIG):
+		code = codes.InvalidArgument
+	case errors.Is(err, syscall.ENOTSUP):
+		code = codes.Unimplemented
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EROFS):
+		code = codes.PermissionDenied
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EBUSY):
+		code = codes.Unavailable
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, io.ErrShortWrite):
+		code = codes.ResourceExhausted
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
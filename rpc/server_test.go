@@ -0,0 +1,206 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/zchee/go-qcow2/nbd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestClient serves the Server confined to a new root directory on the in-process listener, and returns
+// its client and the root directory.
+func newTestClient(t *testing.T) (ImageServiceClient, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(root, "grpc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(&Options{Root: root})
+	s := grpc.NewServer()
+	srv.Register(s)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Stop()
+		srv.Close()
+	})
+
+	conn, err := grpc.NewClient("unix://"+l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return NewImageServiceClient(conn), root
+}
+
+// createImage creates the image of filename in the root of c.
+func createImage(t *testing.T, c ImageServiceClient, filename string, size int64) {
+	t.Helper()
+
+	if _, err := c.Create(context.Background(), &CreateRequest{Filename: filename, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportNBD(t *testing.T) {
+	ctx := context.Background()
+	c, root := newTestClient(t)
+	createImage(t, c, "disk.qcow2", 4<<20)
+
+	exp, err := c.AddExport(ctx, &AddExportRequest{
+		Id:       "disk",
+		Type:     Export_NBD,
+		Filename: "disk.qcow2",
+		Address:  "unix:nbd.sock",
+		Name:     "disk",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "unix:" + filepath.Join(root, "nbd.sock"); exp.Address != want {
+		t.Errorf("export address = %q, want %q", exp.Address, want)
+	}
+
+	nc, err := nbd.Dial("unix", filepath.Join(root, "nbd.sock"), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	data := bytes.Repeat([]byte("rpc!"), 16<<10)
+	if _, err := nc.WriteAt(data, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := nc.ReadAt(buf, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("the data written over the export is not read back")
+	}
+	if _, err := nc.ReadAt(buf, 4<<20-1024); err == nil {
+		t.Error("the read beyond the end of the export succeeded")
+	}
+
+	list, err := c.ListExports(ctx, &ListExportsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Exports) != 1 || list.Exports[0].Id != "disk" {
+		t.Errorf("exports = %v, want disk", list.Exports)
+	}
+
+	if _, err := c.DeleteExport(ctx, &DeleteExportRequest{Id: "disk"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image is closed by the deletion, so it can be opened as read-write again
+	if _, err := c.Check(ctx, &CheckRequest{Filename: "disk.qcow2", Repair: CheckRequest_ALL}); err != nil {
+		t.Errorf("the image is still open by the deleted export: %v", err)
+	}
+}
+
+func TestExportNBDReadOnly(t *testing.T) {
+	ctx := context.Background()
+	c, root := newTestClient(t)
+	createImage(t, c, "disk.qcow2", 4<<20)
+
+	exp, err := c.AddExport(ctx, &AddExportRequest{
+		Id:       "ro",
+		Type:     Export_NBD,
+		Filename: "disk.qcow2",
+		ReadOnly: true,
+		Address:  "unix:nbd.sock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exp.ReadOnly {
+		t.Error("the export is not read-only")
+	}
+
+	nc, err := nbd.Dial("unix", filepath.Join(root, "nbd.sock"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	if !nc.ReadOnly() {
+		t.Error("the client sees the writable export")
+	}
+	if _, err := nc.WriteAt(make([]byte, 512), 0); err == nil {
+		t.Error("the write to the read-only export succeeded")
+	}
+	if _, err := nc.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestClient(t)
+	createImage(t, c, "disk.qcow2", 4<<20)
+
+	if _, err := c.AddExport(ctx, &AddExportRequest{Id: "dup", Filename: "disk.qcow2", Address: "unix:dup.sock", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  *AddExportRequest
+		want codes.Code
+	}{
+		{name: "no id", req: &AddExportRequest{Filename: "disk.qcow2", Address: "unix:nbd.sock"}, want: codes.InvalidArgument},
+		{name: "no address", req: &AddExportRequest{Id: "disk", Filename: "disk.qcow2"}, want: codes.InvalidArgument},
+		{name: "duplicate id", req: &AddExportRequest{Id: "dup", Filename: "disk.qcow2", Address: "unix:nbd.sock"}, want: codes.AlreadyExists},
+		{name: "unknown type", req: &AddExportRequest{Id: "disk", Type: 99, Filename: "disk.qcow2", Address: "unix:nbd.sock", ReadOnly: true}, want: codes.InvalidArgument},
+		{name: "missing image", req: &AddExportRequest{Id: "disk", Filename: "missing.qcow2", Address: "unix:nbd.sock"}, want: codes.NotFound},
+		{name: "image outside root", req: &AddExportRequest{Id: "disk", Filename: "/etc/passwd", Address: "unix:nbd.sock"}, want: codes.PermissionDenied},
+		{name: "socket outside root", req: &AddExportRequest{Id: "disk", Filename: "disk.qcow2", Address: "unix:/tmp/nbd.sock"}, want: codes.PermissionDenied},
+		{name: "address in use", req: &AddExportRequest{Id: "disk", Filename: "disk.qcow2", Address: "unix:dup.sock", ReadOnly: true}, want: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.AddExport(ctx, tt.req)
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("AddExport() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := c.DeleteExport(ctx, &DeleteExportRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteExport() of the missing export = %v, want %v", err, codes.NotFound)
+	}
+
+	// the failed exports do not keep the image open
+	list, err := c.ListExports(ctx, &ListExportsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Exports) != 1 {
+		t.Errorf("exports = %v, want only dup", list.Exports)
+	}
+	if _, err := c.DeleteExport(ctx, &DeleteExportRequest{Id: "dup"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Check(ctx, &CheckRequest{Filename: "disk.qcow2", Repair: CheckRequest_ALL}); err != nil {
+		t.Errorf("the image is still open by the failed exports: %v", err)
+	}
+}
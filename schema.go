@@ -0,0 +1,240 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version of the JSON schemas of the goqcow2 command JSON outputs.
+//
+// The schemas of the same version only change additively. The new optional properties may be added,
+// but the existing properties are never removed, renamed, nor changed the type or meaning.
+// The consumers should ignore the unknown properties, and all of the schemas allow additional properties.
+// The incompatible changes increment the SchemaVersion, and the $id of the schemas.
+const SchemaVersion = 1
+
+// schemaIDPrefix is the prefix of the $id of the schemas.
+const schemaIDPrefix = "https://github.com/zchee/go-qcow2/schema/v1/"
+
+// schemas map of the output name to the JSON schema.
+var schemas = map[string]string{
+	"info":      infoSchema,
+	"check":     checkSchema,
+	"map":       mapSchema,
+	"measure":   measureSchema,
+	"histogram": histogramSchema,
+	"usage":     usageSchema,
+}
+
+// SchemaNames returns the sorted names of the JSON outputs which have the schema.
+func SchemaNames() []string {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Schema returns the JSON schema of the name output.
+func Schema(name string) ([]byte, error) {
+	schema, ok := schemas[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidArgument, "Unknown schema '%s'", name)
+	}
+
+	return []byte(schema), nil
+}
+
+// infoSchema is the JSON schema of the ImageInfo, or of the array of the ImageInfo of the backing chain.
+const infoSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `info.json",
+  "title": "goqcow2 info",
+  "description": "Information about the disk image, or the array of the information about the images of the backing chain with -backing-chain. Same as the 'qemu-img info --output=json' output.",
+  "oneOf": [
+    {"$ref": "#/definitions/image-info"},
+    {"type": "array", "items": {"$ref": "#/definitions/image-info"}}
+  ],
+  "definitions": {
+    "image-info": {
+      "type": "object",
+      "required": ["filename", "format", "dirty-flag", "actual-size", "virtual-size"],
+      "properties": {
+        "filename": {"type": "string"},
+        "format": {"type": "string"},
+        "dirty-flag": {"type": "boolean"},
+        "actual-size": {"type": "integer", "minimum": 0},
+        "virtual-size": {"type": "integer", "minimum": 0},
+        "cluster-size": {"type": "integer", "minimum": 512},
+        "encrypted": {"type": "boolean"},
+        "backing-filename": {"type": "string"},
+        "full-backing-filename": {"type": "string"},
+        "backing-filename-format": {"type": "string"},
+        "format-specific": {
+          "type": "object",
+          "required": ["type", "data"],
+          "properties": {
+            "type": {"type": "string"},
+            "data": {
+              "type": "object",
+              "required": ["compat", "refcount-bits"],
+              "properties": {
+                "compat": {"type": "string", "enum": ["0.10", "1.1"]},
+                "compression-type": {"type": "string"},
+                "lazy-refcounts": {"type": "boolean"},
+                "refcount-bits": {"type": "integer", "minimum": 1, "maximum": 64},
+                "corrupt": {"type": "boolean"},
+                "extended-l2": {"type": "boolean"}
+              },
+              "additionalProperties": true
+            }
+          },
+          "additionalProperties": true
+        }
+      },
+      "additionalProperties": true
+    }
+  }
+}
+`
+
+// checkSchema is the JSON schema of the image check result.
+const checkSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `check.json",
+  "title": "goqcow2 check",
+  "description": "Result of the consistency check of the image. Same as the 'qemu-img check --output=json' output.",
+  "type": "object",
+  "required": ["filename", "format", "check-errors"],
+  "properties": {
+    "filename": {"type": "string"},
+    "format": {"type": "string"},
+    "check-errors": {"type": "integer", "minimum": 0},
+    "image-end-offset": {"type": "integer", "minimum": 0},
+    "corruptions": {"type": "integer", "minimum": 0},
+    "leaks": {"type": "integer", "minimum": 0},
+    "corruptions-fixed": {"type": "integer", "minimum": 0},
+    "leaks-fixed": {"type": "integer", "minimum": 0},
+    "total-clusters": {"type": "integer", "minimum": 0},
+    "allocated-clusters": {"type": "integer", "minimum": 0},
+    "fragmented-clusters": {"type": "integer", "minimum": 0},
+    "compressed-clusters": {"type": "integer", "minimum": 0}
+  },
+  "additionalProperties": true
+}
+`
+
+// mapSchema is the JSON schema of the allocation map.
+const mapSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `map.json",
+  "title": "goqcow2 map",
+  "description": "Allocation map of the guest address range of the image. Same as the 'qemu-img map --output=json' output.",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["start", "length", "depth", "present", "zero", "data"],
+    "properties": {
+      "start": {"type": "integer", "minimum": 0},
+      "length": {"type": "integer", "minimum": 0},
+      "depth": {"type": "integer", "minimum": 0},
+      "present": {"type": "boolean"},
+      "zero": {"type": "boolean"},
+      "data": {"type": "boolean"},
+      "compressed": {"type": "boolean"},
+      "offset": {"type": "integer", "minimum": 0}
+    },
+    "additionalProperties": true
+  }
+}
+`
+
+// measureSchema is the JSON schema of the MeasureInfo.
+const measureSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `measure.json",
+  "title": "goqcow2 measure",
+  "description": "File size required for the new disk image. Same as the 'qemu-img measure --output=json' output.",
+  "type": "object",
+  "required": ["required", "fully-allocated"],
+  "properties": {
+    "required": {"type": "integer", "minimum": 0},
+    "fully-allocated": {"type": "integer", "minimum": 0}
+  },
+  "additionalProperties": true
+}
+`
+
+// histogramSchema is the JSON schema of the ClusterHistogram.
+const histogramSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `histogram.json",
+  "title": "goqcow2 histogram",
+  "description": "Number of the guest clusters of the image by cluster type, and the fragmentation of the allocated clusters.",
+  "type": "object",
+  "required": [
+    "cluster-size", "total-clusters", "unallocated-clusters", "zero-clusters", "compressed-clusters",
+    "normal-clusters", "backing-clusters", "fragmented-clusters", "runs"
+  ],
+  "properties": {
+    "cluster-size": {"type": "integer", "minimum": 512},
+    "total-clusters": {"type": "integer", "minimum": 0},
+    "unallocated-clusters": {"type": "integer", "minimum": 0},
+    "zero-clusters": {"type": "integer", "minimum": 0},
+    "compressed-clusters": {"type": "integer", "minimum": 0},
+    "normal-clusters": {"type": "integer", "minimum": 0},
+    "backing-clusters": {"type": "integer", "minimum": 0},
+    "fragmented-clusters": {"type": "integer", "minimum": 0},
+    "runs": {
+      "description": "runs[i] is the number of runs of 2^i to 2^(i+1)-1 contiguous clusters.",
+      "type": "array",
+      "items": {"type": "integer", "minimum": 0}
+    }
+  },
+  "additionalProperties": true
+}
+`
+
+// usageSchema is the JSON schema of the Usage.
+const usageSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "` + schemaIDPrefix + `usage.json",
+  "title": "goqcow2 usage",
+  "description": "Space of the image file by the structure which uses it.",
+  "type": "object",
+  "required": [
+    "cluster-size", "virtual-size", "file-length", "allocated-size", "allocated-clusters", "data-clusters",
+    "compressed-clusters", "free-clusters", "leaked-clusters", "header-bytes", "l1-bytes", "l2-bytes",
+    "refcount-bytes", "snapshot-bytes", "bitmap-bytes", "compressed-guest-bytes", "compressed-bytes"
+  ],
+  "properties": {
+    "cluster-size": {"type": "integer", "minimum": 512},
+    "virtual-size": {"type": "integer", "minimum": 0},
+    "file-length": {"type": "integer", "minimum": 0},
+    "allocated-size": {"type": "integer", "minimum": 0},
+    "allocated-clusters": {"type": "integer", "minimum": 0},
+    "data-clusters": {"type": "integer", "minimum": 0},
+    "compressed-clusters": {"type": "integer", "minimum": 0},
+    "free-clusters": {"type": "integer", "minimum": 0},
+    "leaked-clusters": {"type": "integer", "minimum": 0},
+    "header-bytes": {"type": "integer", "minimum": 0},
+    "l1-bytes": {"type": "integer", "minimum": 0},
+    "l2-bytes": {"type": "integer", "minimum": 0},
+    "refcount-bytes": {"type": "integer", "minimum": 0},
+    "snapshot-bytes": {"type": "integer", "minimum": 0},
+    "bitmap-bytes": {"type": "integer", "minimum": 0},
+    "compressed-guest-bytes": {"type": "integer", "minimum": 0},
+    "compressed-bytes": {"type": "integer", "minimum": 0}
+  },
+  "additionalProperties": true
+}
+`
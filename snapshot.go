@@ -0,0 +1,864 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"runtime/trace"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// readSnapshots reads the snapshot table of the image, and sets the size of the snapshot table.
+//  block/qcow2-snapshot.c: int qcow2_read_snapshots(BlockDriverState *bs)
+func readSnapshots(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	if s.NbSnapshots == 0 {
+		s.Snapshots = nil
+		s.SnapshotsSize = 0
+		return nil
+	}
+
+	fileSize, err := bs.file.bs.File.Size()
+	if err != nil {
+		return err
+	}
+
+	offset := int64(s.SnapshotsOffset)
+	snapshots := make([]Snapshot, s.NbSnapshots)
+
+	for i := range snapshots {
+		// Read statically sized part of the snapshot header
+		offset = alignOffset(offset, 8)
+		buf := make([]byte, snapshotHeaderSize)
+		if err := bdrvPread(bs.file, offset, buf); err != nil {
+			return err
+		}
+		offset += snapshotHeaderSize
+
+		var h SnapshotHeader
+		if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &h); err != nil {
+			return err
+		}
+
+		if h.ExtraDataSize > MAX_SNAPSHOT_EXTRA_DATA {
+			err := errors.Wrapf(ErrInvalidHeader, "Too much extra metadata in snapshot table entry %d", i)
+			return err
+		}
+		if h.L1Size > MAX_L1_SIZE/UINT64_SIZE {
+			err := errors.Wrapf(ErrTooLarge, "Snapshot L1 table too large in snapshot table entry %d", i)
+			return err
+		}
+		if err := validateTableOffset(s, h.L1TableOffset, uint64(h.L1Size), UINT64_SIZE); err != nil {
+			err = errors.Wrapf(err, "Snapshot L1 table offset invalid in snapshot table entry %d", i)
+			return err
+		}
+		if err := validateTableInFile(fileSize, h.L1TableOffset, uint64(h.L1Size), UINT64_SIZE); err != nil {
+			err = errors.Wrapf(err, "Snapshot L1 table exceeds the end of the image file in snapshot table entry %d", i)
+			return err
+		}
+
+		sn := &snapshots[i]
+		sn.L1TableOffset = h.L1TableOffset
+		sn.L1Size = h.L1Size
+		sn.VMStateSize = uint64(h.VMStateSize)
+		sn.DateSec = h.DateSec
+		sn.DateNsec = h.DateNsec
+		sn.VMClockNsec = h.VMClockNsec
+
+		// Read extra data
+		extra := make([]byte, 16)
+		if h.ExtraDataSize < uint32(len(extra)) {
+			extra = extra[:h.ExtraDataSize]
+		}
+		if err := bdrvPread(bs.file, offset, extra); err != nil {
+			return err
+		}
+		offset += int64(h.ExtraDataSize)
+
+		if len(extra) >= 8 {
+			sn.VMStateSize = BEUint64(extra[0:8])
+		}
+		if len(extra) >= 16 {
+			sn.DiskSize = BEUint64(extra[8:16])
+		} else {
+			sn.DiskSize = uint64(bs.TotalSectors) * uint64(BDRV_SECTOR_SIZE)
+		}
+
+		// Read snapshot ID
+		id := make([]byte, h.IDStrSize)
+		if err := bdrvPread(bs.file, offset, id); err != nil {
+			return err
+		}
+		offset += int64(h.IDStrSize)
+		sn.IDStr = string(id)
+
+		// Read snapshot name
+		name := make([]byte, h.NameSize)
+		if err := bdrvPread(bs.file, offset, name); err != nil {
+			return err
+		}
+		offset += int64(h.NameSize)
+		sn.Name = string(name)
+
+		if offset-int64(s.SnapshotsOffset) > MAX_SNAPSHOTS_SIZE {
+			err := errors.Wrap(ErrTooLarge, "Snapshot table too large")
+			return err
+		}
+		if offset > fileSize {
+			err := errors.Wrap(ErrInvalidHeader, "Snapshot table exceeds the end of the image file")
+			return err
+		}
+	}
+
+	s.Snapshots = snapshots
+	s.SnapshotsSize = int(offset - int64(s.SnapshotsOffset))
+
+	return nil
+}
+
+// Snapshots returns the internal snapshots of the image.
+//  block/snapshot.c: int bdrv_snapshot_list(BlockDriverState *bs, QEMUSnapshotInfo **psn_info)
+func (q *QCow2) Snapshots() ([]SnapshotInfo, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return nil, ENOMEDIUM
+	}
+	if bs.Drv.bdrvSnapshotList == nil {
+		return nil, syscall.ENOTSUP
+	}
+
+	return bs.Drv.bdrvSnapshotList(bs)
+}
+
+// FindSnapshot returns the internal snapshot which has idOrName as its id, or as its name if no snapshot has such
+// id, same as the lookup of 'qemu-img snapshot -a' and '-d'. The id takes precedence over the name, so the snapshot
+// whose name is the id of the other snapshot is only found by its own id. It fails with ErrSnapshotNotFound if no
+// snapshot matches, and with ErrSnapshotAmbiguous if several snapshots have the name.
+//  block/snapshot.c: int bdrv_snapshot_find(BlockDriverState *bs, QEMUSnapshotInfo *sn_info, const char *name)
+func (q *QCow2) FindSnapshot(idOrName string) (*SnapshotInfo, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return nil, ENOMEDIUM
+	}
+
+	return findSnapshot(bs, idOrName)
+}
+
+// findSnapshot returns the snapshot of bs which has idOrName as its id, or as its unique name.
+//  block/snapshot.c: int bdrv_snapshot_find(BlockDriverState *bs, QEMUSnapshotInfo *sn_info, const char *name)
+func findSnapshot(bs *BlockDriverState, idOrName string) (*SnapshotInfo, error) {
+	if bs.Drv.bdrvSnapshotList == nil {
+		return nil, syscall.ENOTSUP
+	}
+	snapshots, err := bs.Drv.bdrvSnapshotList(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	if idOrName != "" {
+		for i := range snapshots {
+			if snapshots[i].ID == idOrName {
+				return &snapshots[i], nil
+			}
+		}
+	}
+
+	var found *SnapshotInfo
+	for i := range snapshots {
+		if idOrName == "" || snapshots[i].Name != idOrName {
+			continue
+		}
+		if found != nil {
+			err := errors.Wrapf(ErrSnapshotAmbiguous, "Several snapshots are named '%s', use the snapshot ID", idOrName)
+			return nil, err
+		}
+		found = &snapshots[i]
+	}
+	if found == nil {
+		err := errors.Wrapf(ErrSnapshotNotFound, "Can't find the snapshot '%s'", idOrName)
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// CreateSnapshot creates the internal snapshot of the current disk state, which is named name, and returns
+// the information of it. The id of the snapshot is generated, and the snapshot has no VM state.
+//  block/snapshot.c: int bdrv_snapshot_create(BlockDriverState *bs, QEMUSnapshotInfo *sn_info)
+func (q *QCow2) CreateSnapshot(name string) (*SnapshotInfo, error) {
+	return q.CreateSnapshotContext(context.Background(), name)
+}
+
+// CreateSnapshotContext is like CreateSnapshot, but returns the error of ctx if ctx is done before the snapshot
+// is started. The snapshot which has been started is completed, so the image is not left with the partial
+// snapshot.
+func (q *QCow2) CreateSnapshotContext(ctx context.Context, name string) (*SnapshotInfo, error) {
+	defer trace.StartRegion(ctx, "qcow2.CreateSnapshot").End()
+
+	bs, err := q.snapshotBs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+	defer bdrvDecInFlight(bs)
+
+	if bs.Drv.bdrvSnapshotCreate == nil {
+		return nil, syscall.ENOTSUP
+	}
+
+	now, err := q.blk.snapshotDate()
+	if err != nil {
+		return nil, err
+	}
+	info := &SnapshotInfo{
+		Name:     name,
+		DateSec:  now.Unix(),
+		DateNsec: int64(now.Nanosecond()),
+	}
+	if err := bs.Drv.bdrvSnapshotCreate(bs, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// DeleteSnapshot deletes the internal snapshot which is found by idOrName, same as FindSnapshot.
+//  block/snapshot.c: int bdrv_snapshot_delete_by_id_or_name(BlockDriverState *bs, const char *id_or_name, Error **errp)
+func (q *QCow2) DeleteSnapshot(idOrName string) error {
+	return q.DeleteSnapshotContext(context.Background(), idOrName)
+}
+
+// DeleteSnapshotContext is like DeleteSnapshot, but returns the error of ctx if ctx is done before the snapshot
+// is deleted. The deletion which has been started is completed.
+func (q *QCow2) DeleteSnapshotContext(ctx context.Context, idOrName string) error {
+	defer trace.StartRegion(ctx, "qcow2.DeleteSnapshot").End()
+
+	bs, err := q.snapshotBs(ctx)
+	if err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+	defer bdrvDecInFlight(bs)
+
+	if bs.Drv.bdrvSnapshotDelete == nil {
+		return syscall.ENOTSUP
+	}
+	sn, err := findSnapshot(bs, idOrName)
+	if err != nil {
+		return err
+	}
+
+	return bs.Drv.bdrvSnapshotDelete(bs, sn.ID, "")
+}
+
+// ApplySnapshot reverts the disk state of the image to the internal snapshot which is found by idOrName,
+// same as FindSnapshot.
+//  block/snapshot.c: int bdrv_snapshot_goto(BlockDriverState *bs, const char *snapshot_id)
+func (q *QCow2) ApplySnapshot(idOrName string) error {
+	return q.ApplySnapshotContext(context.Background(), idOrName)
+}
+
+// ApplySnapshotContext is like ApplySnapshot, but returns the error of ctx if ctx is done before the snapshot
+// is applied. The revert which has been started is completed, so the image is not left half reverted.
+func (q *QCow2) ApplySnapshotContext(ctx context.Context, idOrName string) error {
+	defer trace.StartRegion(ctx, "qcow2.ApplySnapshot").End()
+
+	bs, err := q.snapshotBs(ctx)
+	if err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+	defer bdrvDecInFlight(bs)
+
+	if bs.Drv.bdrvSnapshotGoto == nil {
+		return syscall.ENOTSUP
+	}
+	sn, err := findSnapshot(bs, idOrName)
+	if err != nil {
+		return err
+	}
+
+	q.invalidateReadahead()
+	return bs.Drv.bdrvSnapshotGoto(bs, sn.ID)
+}
+
+// SnapshotQuota limits the internal snapshots which are created in the image, so that the snapshot table does not
+// grow until the image is unusable, such as by the automation which creates the snapshots periodically. Creating
+// the snapshot which exceeds the quota fails with SnapshotQuotaError. The existing snapshots are kept even if
+// they exceed the quota. The zero value of the field means no limit.
+type SnapshotQuota struct {
+	// MaxSnapshots the maximum number of the snapshots of the image.
+	MaxSnapshots int
+	// MaxTableSize the maximum size of the snapshot table in bytes, which grows with the length of the names
+	// of the snapshots.
+	MaxTableSize int64
+}
+
+// SetSnapshotQuota sets the snapshot quota of the image, same as OpenOpts.SnapshotQuota.
+// The quota is not recorded in the image file.
+func (q *QCow2) SetSnapshotQuota(quota SnapshotQuota) error {
+	if quota.MaxSnapshots < 0 || quota.MaxTableSize < 0 {
+		err := errors.Wrap(ErrInvalidArgument, "Snapshot quota must not be negative")
+		return err
+	}
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		return syscall.ENOTSUP
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.Opaque.SnapshotQuota = quota
+	bdrvDrainedEnd(bs)
+
+	return nil
+}
+
+// snapshotBs locks q, and returns the writable BlockDriverState of q with the request in flight.
+// Returns the error of ctx if ctx is done after q is locked.
+// The caller must unlock q and decrease the in flight requests of bs, if err is nil.
+func (q *QCow2) snapshotBs(ctx context.Context) (*BlockDriverState, error) {
+	q.mu.Lock()
+
+	if err := ctx.Err(); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		q.mu.Unlock()
+		return nil, ENOMEDIUM
+	}
+	if bs.ReadOnly {
+		q.mu.Unlock()
+		return nil, ErrReadOnly
+	}
+	q.drainReadahead()
+	bdrvIncInFlight(bs)
+
+	return bs, nil
+}
+
+// snapshotDate returns the creation time of the new snapshot. The deterministic image records the time of
+// SOURCE_DATE_EPOCH, or the zero time if it is not set, so the snapshot does not depend on the time of the build.
+func (blk *BlockBackend) snapshotDate() (time.Time, error) {
+	if !blk.deterministic {
+		return time.Now(), nil
+	}
+
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || sec < 0 {
+		err := errors.Wrapf(ErrInvalidArgument, "Invalid SOURCE_DATE_EPOCH '%s'", epoch)
+		return time.Time{}, err
+	}
+
+	return time.Unix(sec, 0), nil
+}
+
+// snapshotTableSize returns the size of the snapshot table of snapshots, which is written by writeSnapshots.
+func snapshotTableSize(snapshots []Snapshot) int64 {
+	var size int64
+	for _, sn := range snapshots {
+		size = alignOffset(size, 8) + snapshotEntrySize(sn.IDStr, sn.Name)
+	}
+	return size
+}
+
+// snapshotEntrySize returns the size of the snapshot table entry of the snapshot of id and name, without the
+// padding.
+func snapshotEntrySize(id, name string) int64 {
+	return snapshotHeaderSize + snapshotExtraDataSize + int64(len(id)) + int64(len(name))
+}
+
+// writeSnapshots writes s.Snapshots to the newly allocated snapshot table, and updates the header to point to it.
+// The old snapshot table is freed.
+//  block/qcow2-snapshot.c: static int qcow2_write_snapshots(BlockDriverState *bs)
+func writeSnapshots(bs *BlockDriverState) error {
+	s := bs.Opaque
+
+	// compute the size of the snapshots
+	snapshotsSize := snapshotTableSize(s.Snapshots)
+	if snapshotsSize > MAX_SNAPSHOTS_SIZE {
+		err := errors.Wrap(ErrTooLarge, "Snapshot table too large")
+		return err
+	}
+
+	// Allocate space for the new snapshot list
+	var snapshotsOffset int64
+	if snapshotsSize > 0 {
+		var err error
+		snapshotsOffset, err = AllocClusters(bs, uint64(snapshotsSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	fail := func(err error) error {
+		if snapshotsOffset > 0 {
+			freeClusters(bs, snapshotsOffset, snapshotsSize, DISCARD_ALWAYS)
+		}
+		return err
+	}
+
+	if snapshotsSize > 0 {
+		if err := writeCaches(bs); err != nil {
+			return fail(err)
+		}
+
+		// The snapshot list position has not yet been updated, so these clusters
+		// must indeed be completely free
+		if err := preWriteOverlapCheck(bs, 0, snapshotsOffset, snapshotsSize); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Write all snapshots to the new list
+	var buf bytes.Buffer
+	for _, sn := range s.Snapshots {
+		if pad := alignOffset(int64(buf.Len()), 8) - int64(buf.Len()); pad > 0 {
+			buf.Write(make([]byte, pad))
+		}
+
+		h := SnapshotHeader{
+			L1TableOffset: sn.L1TableOffset,
+			L1Size:        sn.L1Size,
+			IDStrSize:     uint16(len(sn.IDStr)),
+			NameSize:      uint16(len(sn.Name)),
+			DateSec:       sn.DateSec,
+			DateNsec:      sn.DateNsec,
+			VMClockNsec:   sn.VMClockNsec,
+			ExtraDataSize: snapshotExtraDataSize,
+		}
+		// If it doesn't fit in 32 bit, older implementations should treat it
+		// as a disk-only snapshot rather than truncate the VM state
+		if sn.VMStateSize <= 0xffffffff {
+			h.VMStateSize = uint32(sn.VMStateSize)
+		}
+		extra := SnapshotExtraData{
+			VMStateSizeLarge: sn.VMStateSize,
+			DiskSize:         sn.DiskSize,
+		}
+
+		binary.Write(&buf, binary.BigEndian, &h)
+		binary.Write(&buf, binary.BigEndian, &extra)
+		buf.WriteString(sn.IDStr)
+		buf.WriteString(sn.Name)
+	}
+	if snapshotsSize > 0 {
+		if err := bdrvPwrite(bs.file, snapshotsOffset, buf.Bytes()); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Update the header to point to the new snapshot table. This requires the
+	// new table and its refcounts to be stable on disk.
+	if err := bdrvFlush(bs.file); err != nil {
+		return fail(err)
+	}
+
+	headerData := make([]byte, UINT32_SIZE+UINT64_SIZE)
+	binary.BigEndian.PutUint32(headerData[0:], uint32(len(s.Snapshots)))
+	binary.BigEndian.PutUint64(headerData[UINT32_SIZE:], uint64(snapshotsOffset))
+	if err := bdrvPwriteSync(bs.file, int64(unsafe.Offsetof(Header{}.NbSnapshots)), headerData); err != nil {
+		return fail(err)
+	}
+
+	// free the old snapshot table
+	if s.SnapshotsSize > 0 {
+		freeClusters(bs, int64(s.SnapshotsOffset), int64(s.SnapshotsSize), DISCARD_SNAPSHOT)
+	}
+	s.SnapshotsOffset = uint64(snapshotsOffset)
+	s.SnapshotsSize = int(snapshotsSize)
+	s.NbSnapshots = uintptr(len(s.Snapshots))
+
+	return nil
+}
+
+// findSnapshotByID returns the index of the snapshot which has the id, or -1 if it is not found.
+//  block/qcow2-snapshot.c: static int find_snapshot_by_id_and_name(BlockDriverState *bs, const char *id, const char *name)
+func findSnapshotByIDAndName(s *BDRVState, id, name string) int {
+	for i, sn := range s.Snapshots {
+		switch {
+		case id != "" && name != "":
+			if sn.IDStr == id && sn.Name == name {
+				return i
+			}
+		case id != "":
+			if sn.IDStr == id {
+				return i
+			}
+		case name != "":
+			if sn.Name == name {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// findSnapshotByIDOrName returns the index of the snapshot which has the name as its id, or as its name.
+// The id is searched first. Returns -1 if it is not found.
+//  block/qcow2-snapshot.c: static int find_snapshot_by_id_or_name(BlockDriverState *bs, const char *id_or_name)
+func findSnapshotByIDOrName(s *BDRVState, idOrName string) int {
+	if i := findSnapshotByIDAndName(s, idOrName, ""); i >= 0 {
+		return i
+	}
+
+	return findSnapshotByIDAndName(s, "", idOrName)
+}
+
+// findNewSnapshotID returns the new snapshot id, which is the next of the largest numeric id.
+//  block/qcow2-snapshot.c: static void find_new_snapshot_id(BlockDriverState *bs, char *id_str, int id_str_size)
+func findNewSnapshotID(s *BDRVState) string {
+	var idMax uint64
+	for _, sn := range s.Snapshots {
+		// same as strtoul, the leading digits are the id
+		var id uint64
+		for _, c := range sn.IDStr {
+			if c < '0' || c > '9' {
+				break
+			}
+			id = id*10 + uint64(c-'0')
+		}
+		if id > idMax {
+			idMax = id
+		}
+	}
+
+	return strconv.FormatUint(idMax+1, 10)
+}
+
+// snapshotCreate creates the internal snapshot of the active L1 table, which is described by info.
+// The id of info is set to the newly generated id.
+//  block/qcow2-snapshot.c: int qcow2_snapshot_create(BlockDriverState *bs, QEMUSnapshotInfo *sn_info)
+func snapshotCreate(bs *BlockDriverState, info *SnapshotInfo) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+	if len(s.Snapshots) >= MAX_SNAPSHOTS {
+		err := errors.Wrapf(ErrTooLarge, "Too many snapshots, at most %d snapshots are supported", MAX_SNAPSHOTS)
+		return err
+	}
+	if len(info.Name) > math.MaxUint16 {
+		err := errors.Wrap(ErrInvalidArgument, "Snapshot name is too long")
+		return err
+	}
+
+	// Generate an ID
+	info.ID = findNewSnapshotID(s)
+
+	// the limits are checked before the refcounts are increased, which are leaked if the snapshot table can not
+	// be written
+	tableSize := snapshotTableSize(s.Snapshots) + snapshotEntrySize(info.ID, info.Name)
+	if tableSize > MAX_SNAPSHOTS_SIZE {
+		err := errors.Wrap(ErrTooLarge, "Snapshot table too large")
+		return err
+	}
+	if q := s.SnapshotQuota; (q.MaxSnapshots > 0 && len(s.Snapshots) >= q.MaxSnapshots) ||
+		(q.MaxTableSize > 0 && tableSize > q.MaxTableSize) {
+		return errors.WithStack(&SnapshotQuotaError{
+			Quota:     q,
+			Snapshots: len(s.Snapshots),
+			TableSize: tableSize,
+		})
+	}
+
+	// Populate sn with passed data
+	sn := Snapshot{
+		IDStr:       info.ID,
+		Name:        info.Name,
+		DiskSize:    uint64(bs.TotalSectors) * uint64(BDRV_SECTOR_SIZE),
+		VMStateSize: uint64(info.VMStateSize),
+		DateSec:     uint32(info.DateSec),
+		DateNsec:    uint32(info.DateNsec),
+		VMClockNsec: uint64(info.VMClockSec)*1000000000 + uint64(info.VMClockNsec),
+	}
+
+	// Allocate the L1 table of the snapshot and copy the current one there.
+	l1TableOffset, err := AllocClusters(bs, uint64(s.L1Size*UINT64_SIZE))
+	if err != nil {
+		return err
+	}
+	sn.L1TableOffset = uint64(l1TableOffset)
+	sn.L1Size = uint32(s.L1Size)
+
+	fail := func(err error) error {
+		freeClusters(bs, l1TableOffset, int64(s.L1Size*UINT64_SIZE), DISCARD_ALWAYS)
+		return err
+	}
+
+	entries, err := s.L1Table.entries(bs)
+	if err != nil {
+		return fail(err)
+	}
+	l1Table := make([]byte, s.L1Size*UINT64_SIZE)
+	for i, e := range entries {
+		copy(l1Table[i*UINT64_SIZE:], BEUvarint64(e))
+	}
+	if len(l1Table) > 0 {
+		if err := preWriteOverlapCheck(bs, 0, l1TableOffset, int64(len(l1Table))); err != nil {
+			return fail(err)
+		}
+		if err := bdrvPwrite(bs.file, l1TableOffset, l1Table); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Increase the refcounts of all clusters and make sure everything is
+	// stable on disk before updating the snapshot table to contain a pointer
+	// to the new L1 table.
+	if err := updateSnapshotRefcount(bs, s.L1TableOffset, s.L1Size, 1); err != nil {
+		return fail(err)
+	}
+
+	// Append the new snapshot to the snapshot list
+	oldSnapshots := s.Snapshots
+	s.Snapshots = append(oldSnapshots[:len(oldSnapshots):len(oldSnapshots)], sn)
+	if err := writeSnapshots(bs); err != nil {
+		// the refcounts of the clusters are leaked, since they are shared with the active L1 table
+		s.Snapshots = oldSnapshots
+		return err
+	}
+
+	return nil
+}
+
+// snapshotGoto reverts the active L1 table to the snapshot which has snapshotID as its id or name.
+//  block/qcow2-snapshot.c: int qcow2_snapshot_goto(BlockDriverState *bs, const char *snapshot_id)
+func snapshotGoto(bs *BlockDriverState, snapshotID string) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	// Search the snapshot
+	snapshotIndex := findSnapshotByIDOrName(s, snapshotID)
+	if snapshotIndex < 0 {
+		err := errors.Wrapf(ErrSnapshotNotFound, "Can't find the snapshot '%s'", snapshotID)
+		return err
+	}
+	sn := s.Snapshots[snapshotIndex]
+
+	if err := validateSnapshotL1Table(bs, &sn); err != nil {
+		return err
+	}
+
+	if sn.DiskSize != uint64(bs.TotalSectors)*uint64(BDRV_SECTOR_SIZE) {
+		err := errors.Wrap(ErrUnsupported, "Can't resize an image which has snapshots")
+		return err
+	}
+
+	// Make sure that the current L1 table is big enough to contain the whole
+	// L1 table of the snapshot. If the snapshot L1 table is smaller, the
+	// current one must be padded with zeros.
+	if err := growL1Table(bs, uint64(sn.L1Size), true); err != nil {
+		return err
+	}
+
+	curL1Bytes := s.L1Size * UINT64_SIZE
+	snL1Bytes := int(sn.L1Size) * UINT64_SIZE
+
+	// Copy the snapshot L1 table to the current L1 table.
+	//
+	// Before overwriting the old current L1 table on disk, make sure to
+	// increase all refcounts for the clusters referenced by the new one.
+	// Decrease the refcount referenced by the old one only when the L1
+	// table is overwritten.
+	snL1Table := make([]byte, curL1Bytes)
+	if err := bdrvPread(bs.file, int64(sn.L1TableOffset), snL1Table[:snL1Bytes]); err != nil {
+		return err
+	}
+
+	if err := updateSnapshotRefcount(bs, sn.L1TableOffset, int(sn.L1Size), 1); err != nil {
+		return err
+	}
+
+	// The L1 table of the snapshot may keep OFLAG_COPIED of the time it was taken, but its L2 tables are shared
+	// with the snapshot now. The flags are cleared before the current L1 table is overwritten, so that the crash
+	// before they are updated below does not leave the shared L2 tables to be written in place.
+	for i := 0; i < snL1Bytes; i += UINT64_SIZE {
+		binary.BigEndian.PutUint64(snL1Table[i:], BEUint64(snL1Table[i:])&^OFLAG_COPIED)
+	}
+
+	// The segments of the current L1 table which are not loaded yet are loaded before it is overwritten, since
+	// its entries are used to decrease the refcounts below.
+	if _, err := s.L1Table.entries(bs); err != nil {
+		return err
+	}
+
+	if err := preWriteOverlapCheck(bs, QCOW2_OL_ACTIVE_L1, int64(s.L1TableOffset), int64(curL1Bytes)); err != nil {
+		return err
+	}
+	if err := bdrvPwriteSync(bs.file, int64(s.L1TableOffset), snL1Table); err != nil {
+		return err
+	}
+
+	// Decrease refcount of clusters of current L1 table.
+	//
+	// At this point, the in-memory s.L1Table points to the old L1 table,
+	// whereas on disk we already have the new one.
+	//
+	// updateSnapshotRefcount special cases the current L1 table to use
+	// the in-memory data instead of really using the offset to load a new one,
+	// which is why this works.
+	err := updateSnapshotRefcount(bs, s.L1TableOffset, s.L1Size, -1)
+
+	// Now update the in-memory L1 table to be in sync with the on-disk one. We
+	// need to do this even if updating refcounts failed.
+	entries := make([]uint64, s.L1Size)
+	for i := range entries {
+		entries[i] = BEUint64(snL1Table[i*UINT64_SIZE:])
+	}
+	s.L1Table = newL1TableFrom(s.L1TableOffset, entries)
+	if err != nil {
+		return err
+	}
+
+	// Update QCOW_OFLAG_COPIED in the active L1 table (it may have changed
+	// when we decreased the refcount of the old snapshot.
+	return updateSnapshotRefcount(bs, s.L1TableOffset, s.L1Size, 0)
+}
+
+// snapshotDelete deletes the snapshot which has snapshotID as its id and name as its name.
+// Either of them can be empty to search the snapshot by the other.
+//  block/qcow2-snapshot.c: int qcow2_snapshot_delete(BlockDriverState *bs, const char *snapshot_id, const char *name, Error **errp)
+func snapshotDelete(bs *BlockDriverState, snapshotID, name string) error {
+	s := bs.Opaque
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := checkFenced(bs); err != nil {
+		return err
+	}
+
+	// Search the snapshot
+	snapshotIndex := findSnapshotByIDAndName(s, snapshotID, name)
+	if snapshotIndex < 0 {
+		err := errors.Wrap(ErrSnapshotNotFound, "Can't find the snapshot")
+		return err
+	}
+	sn := s.Snapshots[snapshotIndex]
+
+	if err := validateSnapshotL1Table(bs, &sn); err != nil {
+		return err
+	}
+
+	// Remove it from the snapshot list
+	oldSnapshots := s.Snapshots
+	snapshots := make([]Snapshot, 0, len(oldSnapshots)-1)
+	snapshots = append(snapshots, oldSnapshots[:snapshotIndex]...)
+	s.Snapshots = append(snapshots, oldSnapshots[snapshotIndex+1:]...)
+	if err := writeSnapshots(bs); err != nil {
+		s.Snapshots = oldSnapshots
+		err = errors.Wrap(err, "Failed to remove snapshot from snapshot list")
+		return err
+	}
+
+	// The snapshot is now unused, clean up. If we fail after this point, we
+	// won't recover but just leak clusters.
+
+	// Now decrease the refcounts of clusters referenced by the snapshot and
+	// free the L1 table.
+	if err := updateSnapshotRefcount(bs, sn.L1TableOffset, int(sn.L1Size), -1); err != nil {
+		err = errors.Wrap(err, "Failed to free the cluster and L1 table")
+		return err
+	}
+	freeClusters(bs, int64(sn.L1TableOffset), int64(sn.L1Size)*UINT64_SIZE, DISCARD_SNAPSHOT)
+
+	// must update the copied flag on the current cluster offsets
+	if err := updateSnapshotRefcount(bs, s.L1TableOffset, s.L1Size, 0); err != nil {
+		err = errors.Wrap(err, "Failed to update snapshot status in disk")
+		return err
+	}
+
+	return nil
+}
+
+// snapshotList returns the information of the snapshots of the image.
+//  block/qcow2-snapshot.c: int qcow2_snapshot_list(BlockDriverState *bs, QEMUSnapshotInfo **psn_tab)
+func snapshotList(bs *BlockDriverState) ([]SnapshotInfo, error) {
+	s := bs.Opaque
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	infos := make([]SnapshotInfo, len(s.Snapshots))
+	for i, sn := range s.Snapshots {
+		infos[i] = SnapshotInfo{
+			ID:          sn.IDStr,
+			Name:        sn.Name,
+			VMStateSize: int64(sn.VMStateSize),
+			DateSec:     int64(sn.DateSec),
+			DateNsec:    int64(sn.DateNsec),
+			VMClockSec:  int64(sn.VMClockNsec / 1000000000),
+			VMClockNsec: int64(sn.VMClockNsec % 1000000000),
+		}
+	}
+
+	return infos, nil
+}
+
+// validateSnapshotL1Table checks the L1 table of sn lies within the image file.
+//  block/qcow2.c: int qcow2_validate_table(BlockDriverState *bs, uint64_t offset, uint64_t entries, size_t entry_len, int64_t max_size_bytes, const char *table_name, Error **errp)
+func validateSnapshotL1Table(bs *BlockDriverState, sn *Snapshot) error {
+	s := bs.Opaque
+
+	if uint64(sn.L1Size) > MAX_L1_SIZE/UINT64_SIZE {
+		err := errors.Wrap(ErrTooLarge, "Snapshot L1 table too large")
+		return err
+	}
+	if err := validateTableOffset(s, sn.L1TableOffset, uint64(sn.L1Size), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "Snapshot L1 table offset invalid")
+		return err
+	}
+
+	fileSize, err := bs.file.bs.File.Size()
+	if err != nil {
+		return err
+	}
+	if err := validateTableInFile(fileSize, sn.L1TableOffset, uint64(sn.L1Size), UINT64_SIZE); err != nil {
+		err = errors.Wrap(err, "Snapshot L1 table exceeds the end of the image file")
+		return err
+	}
+
+	return nil
+}
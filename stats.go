@@ -0,0 +1,254 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import "sync"
+
+// StatsEvent represents the kind of the accounted I/O event of the image.
+//  include/block/accounting.h: enum BlockAcctType
+type StatsEvent int
+
+const (
+	// StatsRead the guest read.
+	StatsRead StatsEvent = iota
+	// StatsWrite the guest write, including the compressed write.
+	StatsWrite
+	// StatsWriteZeroes the write of zeros to the guest data.
+	StatsWriteZeroes
+	// StatsDiscard the discard of the guest data.
+	StatsDiscard
+	// StatsFlush the flush of the image.
+	StatsFlush
+	// StatsCow the copy of the unmodified guest data to the newly allocated cluster on the allocating write.
+	StatsCow
+	// StatsL2CacheHit the L2 table is found in the L2 table cache.
+	StatsL2CacheHit
+	// StatsL2CacheMiss the L2 table is read from the image file into the L2 table cache.
+	StatsL2CacheMiss
+	// StatsRefcountCacheHit the refcount block is found in the refcount block cache.
+	StatsRefcountCacheHit
+	// StatsRefcountCacheMiss the refcount block is read from the image file into the refcount block cache.
+	StatsRefcountCacheMiss
+	// StatsReadahead the prefetch of the guest data by the readahead.
+	StatsReadahead
+	// StatsReadaheadHit the guest read is served from the data prefetched by the readahead.
+	// It is also counted as StatsRead.
+	StatsReadaheadHit
+)
+
+// String returns the name of the event.
+func (ev StatsEvent) String() string {
+	switch ev {
+	case StatsRead:
+		return "read"
+	case StatsWrite:
+		return "write"
+	case StatsWriteZeroes:
+		return "write-zeroes"
+	case StatsDiscard:
+		return "discard"
+	case StatsFlush:
+		return "flush"
+	case StatsCow:
+		return "cow"
+	case StatsL2CacheHit:
+		return "l2-cache-hit"
+	case StatsL2CacheMiss:
+		return "l2-cache-miss"
+	case StatsRefcountCacheHit:
+		return "refcount-cache-hit"
+	case StatsRefcountCacheMiss:
+		return "refcount-cache-miss"
+	case StatsReadahead:
+		return "readahead"
+	case StatsReadaheadHit:
+		return "readahead-hit"
+	}
+	return "unknown"
+}
+
+// StatsObserver is notified of each accounted I/O event of the image, so that the counters can be exported
+// to the metrics system such as Prometheus.
+// ObserveIO is called with the number of the bytes of the request, which is zero for the flushes and the
+// cache lookups, and the error of the failed request. It may be called concurrently, and must not block
+// nor call the methods of the image.
+type StatsObserver interface {
+	ObserveIO(ev StatsEvent, bytes int64, err error)
+}
+
+// IOStats represents the I/O counters of the image since it is opened.
+// It is marshaled to the json object, and can be published by expvar.Func as is.
+//  qapi/block-core.json: { 'struct': 'BlockDeviceStats' }
+type IOStats struct {
+	Reads        int64 `json:"rd_operations"`
+	BytesRead    int64 `json:"rd_bytes"`
+	FailedReads  int64 `json:"failed_rd_operations"`
+	Writes       int64 `json:"wr_operations"`
+	BytesWritten int64 `json:"wr_bytes"`
+	FailedWrites int64 `json:"failed_wr_operations"`
+
+	// WriteZeroes the number of the writes of zeros, and BytesZeroed the bytes of them.
+	// They are not counted in Writes and BytesWritten.
+	WriteZeroes int64 `json:"zero_operations"`
+	BytesZeroed int64 `json:"zero_bytes"`
+	// Discards the number of the discards, and BytesDiscarded the bytes of them.
+	Discards       int64 `json:"unmap_operations"`
+	BytesDiscarded int64 `json:"unmap_bytes"`
+	// FailedOthers the number of the failed writes of zeros and discards.
+	FailedOthers int64 `json:"failed_unmap_operations"`
+
+	Flushes       int64 `json:"flush_operations"`
+	FailedFlushes int64 `json:"failed_flush_operations"`
+
+	// CowOps the number of the copies on write, and CowBytes the bytes copied by them.
+	CowOps   int64 `json:"cow_operations"`
+	CowBytes int64 `json:"cow_bytes"`
+
+	L2CacheHits         int64 `json:"l2_cache_hits"`
+	L2CacheMisses       int64 `json:"l2_cache_misses"`
+	RefcountCacheHits   int64 `json:"refcount_cache_hits"`
+	RefcountCacheMisses int64 `json:"refcount_cache_misses"`
+
+	// ReadaheadOps the number of the prefetches by the readahead, and ReadaheadBytes the bytes of them.
+	// They are not counted in Reads and BytesRead.
+	ReadaheadOps   int64 `json:"readahead_operations"`
+	ReadaheadBytes int64 `json:"readahead_bytes"`
+	// ReadaheadHits the number of the reads served from the prefetched data.
+	ReadaheadHits int64 `json:"readahead_hits"`
+}
+
+// BlockAcctStats accounts the I/O events of the block driver state.
+//  include/block/accounting.h: struct BlockAcctStats
+type BlockAcctStats struct {
+	mu       sync.Mutex
+	stats    IOStats
+	observer StatsObserver
+}
+
+// blockAcctDone accounts the request of ev of bytes on bs, which is failed if err is not nil.
+//  block/accounting.c: void block_acct_done(BlockAcctStats *stats, BlockAcctCookie *cookie)
+func blockAcctDone(bs *BlockDriverState, ev StatsEvent, bytes int64, err error) {
+	acct := &bs.acct
+
+	acct.mu.Lock()
+	st := &acct.stats
+	switch ev {
+	case StatsRead:
+		if err != nil {
+			st.FailedReads++
+			break
+		}
+		st.Reads++
+		st.BytesRead += bytes
+	case StatsWrite:
+		if err != nil {
+			st.FailedWrites++
+			break
+		}
+		st.Writes++
+		st.BytesWritten += bytes
+	case StatsWriteZeroes:
+		if err != nil {
+			st.FailedOthers++
+			break
+		}
+		st.WriteZeroes++
+		st.BytesZeroed += bytes
+	case StatsDiscard:
+		if err != nil {
+			st.FailedOthers++
+			break
+		}
+		st.Discards++
+		st.BytesDiscarded += bytes
+	case StatsFlush:
+		if err != nil {
+			st.FailedFlushes++
+			break
+		}
+		st.Flushes++
+	case StatsCow:
+		if err != nil {
+			break
+		}
+		st.CowOps++
+		st.CowBytes += bytes
+	case StatsL2CacheHit:
+		st.L2CacheHits++
+	case StatsL2CacheMiss:
+		st.L2CacheMisses++
+	case StatsRefcountCacheHit:
+		st.RefcountCacheHits++
+	case StatsRefcountCacheMiss:
+		st.RefcountCacheMisses++
+	case StatsReadahead:
+		if err != nil {
+			break
+		}
+		st.ReadaheadOps++
+		st.ReadaheadBytes += bytes
+	case StatsReadaheadHit:
+		st.ReadaheadHits++
+	}
+	observer := acct.observer
+	acct.mu.Unlock()
+
+	if observer != nil {
+		observer.ObserveIO(ev, bytes, err)
+	}
+}
+
+// blockAcctCache accounts the lookup of the table in c, which is the L2 table cache or the refcount block
+// cache of bs.
+func blockAcctCache(bs *BlockDriverState, c *Cache, hit bool) {
+	s := bs.Opaque
+	switch {
+	case c == s.L2TableCache && hit:
+		blockAcctDone(bs, StatsL2CacheHit, 0, nil)
+	case c == s.L2TableCache:
+		blockAcctDone(bs, StatsL2CacheMiss, 0, nil)
+	case c == s.RefcountBlockCache && hit:
+		blockAcctDone(bs, StatsRefcountCacheHit, 0, nil)
+	case c == s.RefcountBlockCache:
+		blockAcctDone(bs, StatsRefcountCacheMiss, 0, nil)
+	}
+}
+
+// Stats returns the I/O counters of the image since it is opened.
+// The requests to the backing file chain are counted only as the requests to the image.
+// The closed image returns the zero counters.
+//  block/qapi.c: static BlockStats *bdrv_query_bds_stats(BlockDriverState *bs, bool blk_level)
+func (q *QCow2) Stats() IOStats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return IOStats{}
+	}
+
+	bs.acct.mu.Lock()
+	defer bs.acct.mu.Unlock()
+
+	return bs.acct.stats
+}
+
+// SetStatsObserver sets the observer which is notified of each accounted I/O event of the image.
+// The nil observer removes the observer.
+func (q *QCow2) SetStatsObserver(observer StatsObserver) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return
+	}
+
+	bs.acct.mu.Lock()
+	bs.acct.observer = observer
+	bs.acct.mu.Unlock()
+}
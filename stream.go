@@ -0,0 +1,136 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"io"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+)
+
+// StreamConverter converts the raw image read from the non-seekable stream, such as the image decompressed
+// to the standard input, to the qcow2 image, same as 'qemu-img convert -f raw -O qcow2' from the pipe.
+// The stream is read by the bounded window, so the memory usage does not depend on the image size.
+type StreamConverter struct {
+	r     io.Reader
+	opts  Opts
+	limit RateLimit
+}
+
+// NewStreamConverter returns the StreamConverter which reads the raw image from r, and creates the
+// qcow2 image by opts. If opts.Size is zero and opts.BackingFile is empty, the virtual disk size is
+// the length of the stream.
+func NewStreamConverter(r io.Reader, opts *Opts) *StreamConverter {
+	return &StreamConverter{
+		r:    r,
+		opts: *opts,
+	}
+}
+
+// SetRateLimit limits the number of bytes of the stream which are converted per second.
+// It must be called before Convert.
+func (c *StreamConverter) SetRateLimit(limit RateLimit) {
+	c.limit = limit
+}
+
+// Convert creates the image, and writes the stream to it until io.EOF. It returns the number of bytes
+// read from the stream.
+//
+// The clusters which are all zeros in the stream are not allocated, unless the image has the backing file.
+// If the virtual disk size is not given by opts, the image grows as the stream is written, and the virtual
+// disk size is the length of the stream rounded up to the sector size. Otherwise, the rest of the image after the end of the stream
+// reads as zeros or the backing file, and the stream longer than the image fails with EFBIG.
+//  qemu-img.c: static int img_convert(int argc, char **argv)
+func (c *StreamConverter) Convert() (int64, error) {
+	return c.ConvertContext(context.Background())
+}
+
+// ConvertContext is like Convert, but stops reading the stream when ctx is done, and returns the error of ctx.
+// The image which is partially written on the cancellation is removed. ctx is checked between the windows,
+// so the read of the stream which is blocked is not interrupted.
+func (c *StreamConverter) ConvertContext(ctx context.Context) (int64, error) {
+	defer trace.StartRegion(ctx, "qcow2.StreamConverter.Convert").End()
+
+	img, err := CreateContext(ctx, &c.opts)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.convert(ctx, img)
+	if cerr := img.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil && err == ctx.Err() {
+		removeImageFile(c.opts.Filename)
+	}
+
+	return n, err
+}
+
+func (c *StreamConverter) convert(ctx context.Context, img *QCow2) (int64, error) {
+	bs := img.blk.bs()
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+	hasBacking := bs.Backing != nil
+
+	// the size of the image created on the backing file without opts.Size is the size of the backing file
+	growable := c.opts.Size == 0 && !hasBacking
+	size, err := getlength(bs)
+	if err != nil {
+		return 0, err
+	}
+	img.blk.allowBeyondEOF = growable
+
+	window := int64(IO_BUF_SIZE)
+	if window < clusterSize {
+		window = clusterSize
+	}
+	buf := make([]byte, window)
+	limit := newRateLimit(c.limit)
+
+	var pos int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return pos, err
+		}
+
+		n, err := io.ReadFull(c.r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return pos, errors.Wrapf(err, "error while reading the stream at offset %d", pos)
+		}
+		if !growable && pos+int64(n) > size {
+			err := errors.Wrapf(ErrTooLarge, "stream is larger than the image size %d", size)
+			return pos, err
+		}
+
+		if err := convertWrite(ctx, img, buf[:n], pos, clusterSize, hasBacking); err != nil {
+			return pos, err
+		}
+		pos += int64(n)
+
+		if n < len(buf) {
+			break
+		}
+		if err := limit.wait(ctx, int64(n)); err != nil {
+			return pos, err
+		}
+	}
+
+	if growable {
+		img.blk.allowBeyondEOF = false
+		if err := img.blk.truncate(roundUp(pos, int64(BDRV_SECTOR_SIZE))); err != nil {
+			return pos, errors.Wrap(err, "Could not resize image")
+		}
+	}
+
+	return pos, nil
+}
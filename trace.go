@@ -0,0 +1,113 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import "context"
+
+// TraceOp represents the internal operation of the image which is traced by the Tracer.
+//  block/trace-events: qcow2_*
+type TraceOp int
+
+const (
+	// TraceAllocClusters the allocation of the new clusters for the allocating write.
+	TraceAllocClusters TraceOp = iota
+	// TraceCow the copy of the unmodified guest data to the newly allocated cluster.
+	TraceCow
+	// TraceL2CacheMiss the read of the L2 table into the L2 table cache, including the write back of the
+	// evicted table.
+	TraceL2CacheMiss
+	// TraceRefcountCacheMiss the read of the refcount block into the refcount block cache, including the write
+	// back of the evicted block.
+	TraceRefcountCacheMiss
+	// TraceFlush the flush of the image.
+	TraceFlush
+)
+
+// String returns the span name of the operation.
+func (op TraceOp) String() string {
+	switch op {
+	case TraceAllocClusters:
+		return "qcow2.alloc_clusters"
+	case TraceCow:
+		return "qcow2.cow"
+	case TraceL2CacheMiss:
+		return "qcow2.l2_cache_miss"
+	case TraceRefcountCacheMiss:
+		return "qcow2.refcount_cache_miss"
+	case TraceFlush:
+		return "qcow2.flush"
+	}
+	return "qcow2.unknown"
+}
+
+// Span represents the traced operation, which is ended by End with the error of the operation.
+type Span interface {
+	End(err error)
+}
+
+// Tracer creates the spans of the internal operations of the image, so that the latency of the guest
+// requests can be attributed to them. It is implemented by the caller, usually on top of the OpenTelemetry
+// tracer.
+//
+// StartSpan is called at the start of op on the range of bytes at offset, which is the guest offset for
+// TraceAllocClusters and TraceCow, the host offset of the table for the cache misses, and zero for TraceFlush.
+// The ctx is the context of the request which runs op, such as the ctx of ReadAtContext and WriteAtContext, or
+// context.Background for the requests without the context and for the refcount block cache misses, which are
+// shared by the requests. StartSpan returns the ctx derived from ctx, which carries the span to the operations
+// run by op, such as the L2 table cache misses of the reads of the backing file by TraceCow.
+// It may be called concurrently, and must not call the methods of the image.
+type Tracer interface {
+	StartSpan(ctx context.Context, op TraceOp, offset, bytes int64) (context.Context, Span)
+}
+
+// noopSpan the span which is returned when no tracer is set.
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+// traceStart starts the span of op of bs in ctx, or returns ctx and the no-op span if the tracer of bs is not
+// set.
+func traceStart(ctx context.Context, bs *BlockDriverState, op TraceOp, offset, bytes int64) (context.Context, Span) {
+	if bs.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return bs.tracer.StartSpan(ctx, op, offset, bytes)
+}
+
+// traceCacheMiss starts the span of the miss of c, which is the L2 table cache or the refcount block cache of
+// bs, for the table at offset. The table which is not read from the image file is not traced.
+func traceCacheMiss(ctx context.Context, bs *BlockDriverState, c *Cache, offset int64, readFromDisk bool) Span {
+	if !readFromDisk {
+		return noopSpan{}
+	}
+
+	s := bs.Opaque
+	var span Span = noopSpan{}
+	switch c {
+	case s.L2TableCache:
+		_, span = traceStart(ctx, bs, TraceL2CacheMiss, offset, int64(c.tableSize))
+	case s.RefcountBlockCache:
+		_, span = traceStart(ctx, bs, TraceRefcountCacheMiss, offset, int64(c.tableSize))
+	}
+	return span
+}
+
+// SetTracer sets the tracer of the internal operations of the image.
+// The in-flight requests are completed before the tracer is replaced. The nil tracer removes the tracer.
+func (q *QCow2) SetTracer(tracer Tracer) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.tracer = tracer
+	bdrvDrainedEnd(bs)
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type (
+	requestKey struct{}
+	spanKey    struct{}
+)
+
+// testSpan the span recorded by testTracer, with the request of its ctx and its parent span.
+type testSpan struct {
+	op      TraceOp
+	request interface{}
+	parent  *testSpan
+}
+
+func (*testSpan) End(error) {}
+
+// testTracer records the started spans, and carries them in the derived ctx.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) StartSpan(ctx context.Context, op TraceOp, offset, bytes int64) (context.Context, Span) {
+	span := &testSpan{op: op, request: ctx.Value(requestKey{})}
+	span.parent, _ = ctx.Value(spanKey{}).(*testSpan)
+
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// find returns the first span of op, or nil.
+func (tr *testTracer) find(op TraceOp) *testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	for _, span := range tr.spans {
+		if span.op == op {
+			return span
+		}
+	}
+	return nil
+}
+
+// TestTraceContext writes to the overlay in the ctx of the request, and checks the spans are started in it. The
+// L2 table cache miss of the backing file, which is read by the copy on write, must be the child of the COW span.
+func TestTraceContext(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+
+	img, err := CreateImage(base, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("base"), 64<<10/4)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = CreateImage(filepath.Join(dir, "overlay.qcow2"), 4<<20, WithBackingFile(base, DriverQCow2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	tr := &testTracer{}
+	img.SetTracer(tr)
+	img.blk.bs().Backing.bs.tracer = tr
+
+	ctx := context.WithValue(context.Background(), requestKey{}, "write")
+	if _, err := img.WriteAtContext(ctx, []byte("overlay!"), 512); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []TraceOp{TraceAllocClusters, TraceCow} {
+		span := tr.find(op)
+		if span == nil {
+			t.Fatalf("%v is not traced", op)
+		}
+		if span.request != "write" {
+			t.Errorf("%v is traced in the request %v, want write", op, span.request)
+		}
+	}
+
+	miss := tr.find(TraceL2CacheMiss)
+	if miss == nil {
+		t.Fatal("the L2 table cache miss of the backing file is not traced")
+	}
+	if miss.request != "write" {
+		t.Errorf("the L2 table cache miss is traced in the request %v, want write", miss.request)
+	}
+	if miss.parent == nil || miss.parent.op != TraceCow {
+		t.Errorf("the parent of the L2 table cache miss is %v, want the COW span", miss.parent)
+	}
+
+	ctx = context.WithValue(context.Background(), requestKey{}, "flush")
+	if err := img.FlushContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if span := tr.find(TraceFlush); span == nil || span.request != "flush" {
+		t.Errorf("the flush is traced in %v, want the flush request", span)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := img.ReadAtContext(canceled, make([]byte, 512), 0); err != context.Canceled {
+		t.Errorf("ReadAtContext with the canceled ctx returns %v, want %v", err, context.Canceled)
+	}
+}
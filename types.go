@@ -7,19 +7,28 @@
 package qcow2
 
 import (
+	"context"
 	"math"
-	"os"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 // ---------------------------------------------------------------------------
 // go-qcow2
 
+// writeStatus represents how the range of the source image is written to the target image by Convert.
+//  qemu-img.c: enum ImgConvertBlockStatus
 type writeStatus int
 
 const (
+	// BLK_DATA the range is copied to the target image.
 	BLK_DATA writeStatus = iota
+	// BLK_ZERO the range reads as zeros.
 	BLK_ZERO
+	// BLK_BACKING_FILE the range is read from the backing file of the target image.
 	BLK_BACKING_FILE
 )
 
@@ -27,23 +36,16 @@ const (
 type QCow2 struct {
 	blk *BlockBackend
 
-	// ImgConvertState
-	src              *BlockBackend
-	srcSectors       int64         // int64_t
-	srcCur, srcNum   int           // int
-	srcCurOffset     int64         // int64_t
-	totalSectors     int64         // int64_t
-	allocatedSectors int64         // int64_t
-	status           writeStatus   // ImgConvertBlockStatus
-	sectorNextStatus int64         // int64_t
-	target           *BlockBackend // BlockBackend
-	hasZeroInit      bool          // bool
-	compressed       bool          // bool
-	targetHasBacking bool          // bool
-	minSparse        int           // int
-	clusterSectors   int           // size_t
-	bufSectors       int           // size_t
-
+	// mu guards offset and the opened image. ReadAt and WriteAt hold it for reading, so they run concurrently,
+	// and the other requests of the standard io interfaces are serialized by holding it for writing.
+	mu sync.RWMutex
+	// offset the current offset of Read, Write and Seek.
+	offset int64
+	// ra the readahead of the sequential reads, or nil if it is disabled.
+	ra *readahead
+	// expvarName the name of the image published by PublishExpvar, or empty if it is not published.
+	// It is guarded by expvarMu.
+	expvarName string
 }
 
 const (
@@ -84,17 +86,26 @@ type FeatureNameTable struct {
 }
 
 // BitmapExtension represents a optional header extension.
+//  block/qcow2.h: typedef struct Qcow2BitmapHeaderExt
 type BitmapExtension struct {
-	// NbBitmaps the number of bitmaps contained in the image. Must be greater than ro equal to 1. [1:4]
-	NbBitmaps int
+	// NbBitmaps the number of bitmaps contained in the image. Must be greater than ro equal to 1. [0:4]
+	NbBitmaps uint32
 	// Reserved reserved, must be zero. [4:8]
-	Reserved int
+	Reserved uint32
 	// BitmapDirectorySize size of the bitmap directory in bytes. It is the cumulative size of all (nb_bitmaps) bitmap headers. [8:16]
-	BitmapDirectorySize int
+	BitmapDirectorySize uint64
 	// BitmapDirectoryOffset offste into the image file at which the bitmap directory starts. [16:24]
-	BitmapDirectoryOffset int
+	BitmapDirectoryOffset uint64
 }
 
+// MAX_BITMAPS the maximum number of the bitmaps in the image.
+//  block/qcow2.h: #define QCOW2_MAX_BITMAPS 65535
+const MAX_BITMAPS = 65535
+
+// MAX_BITMAP_DIRECTORY_SIZE the maximum size of the bitmap directory in bytes.
+//  block/qcow2.h: #define QCOW2_MAX_BITMAP_DIRECTORY_SIZE (1024 * QCOW2_MAX_BITMAPS)
+const MAX_BITMAP_DIRECTORY_SIZE = 1024 * MAX_BITMAPS
+
 const BDRV_SECTOR_BITS = 9
 
 var (
@@ -102,7 +113,10 @@ var (
 	BDRV_SECTOR_MASK = ^(BDRV_SECTOR_SIZE - 1) // ~(BDRV_SECTOR_SIZE - 1)
 )
 
-var BDRV_REQUEST_MAX_SECTORS = MIN(SIZE_MAX>>BDRV_SECTOR_BITS, INT_MAX>>BDRV_SECTOR_BITS)
+// BDRV_REQUEST_MAX_SECTORS is always INT_MAX >> BDRV_SECTOR_BITS, because SIZE_MAX is not less than INT_MAX.
+// SIZE_MAX >> BDRV_SECTOR_BITS overflows int on 32-bit platforms.
+//  #define BDRV_REQUEST_MAX_SECTORS MIN(SIZE_MAX >> BDRV_SECTOR_BITS, INT_MAX >> BDRV_SECTOR_BITS)
+var BDRV_REQUEST_MAX_SECTORS = INT_MAX >> BDRV_SECTOR_BITS
 
 // ---------------------------------------------------------------------------
 // block/qcow2.c
@@ -127,7 +141,6 @@ const (
 	HeaderExtensionFeatureNameTable HeaderExtensionType = 0x6803f857
 
 	// HeaderExtensionBitmapsExtension Bitmaps extension.
-	// TODO(zchee): qemu does not implements?
 	HeaderExtensionBitmapsExtension HeaderExtensionType = 0x23852875
 
 	// Safely ignored other unknown header extension
@@ -175,6 +188,10 @@ const MAX_L1_SIZE = 0x2000000
  * space for snapshot names and IDs */
 const MAX_SNAPSHOTS_SIZE = 1024 * MAX_SNAPSHOTS
 
+// MAX_SNAPSHOT_EXTRA_DATA the maximum size of the extra data of a snapshot table entry.
+//  block/qcow2.h: #define QCOW_MAX_SNAPSHOT_EXTRA_DATA 1024
+const MAX_SNAPSHOT_EXTRA_DATA = 1024
+
 const (
 	// indicate that the refcount of the referenced cluster is exactly one.
 	OFLAG_COPIED = 1 << 63
@@ -229,20 +246,51 @@ type Header struct {
 	HeaderLength          uint32      // [100:103] for version >= 3: Length of the header structure in bytes
 }
 
-// SnapshotHeader represents a header of snapshot.
+// SnapshotHeader represents a header of snapshot, which is the fixed part of the snapshot table entry.
+//  block/qcow2.h: typedef struct QEMU_PACKED QCowSnapshotHeader
 type SnapshotHeader struct {
+	L1TableOffset uint64 //   [0:7] Offset into the image file at which the L1 table of the snapshot starts
+	L1Size        uint32 //  [8:11] Number of entries in the L1 table of the snapshot
+	IDStrSize     uint16 // [12:13] Length of the unique ID string describing the snapshot
+	NameSize      uint16 // [14:15] Length of the name of the snapshot
+	DateSec       uint32 // [16:19] Time at which the snapshot was taken in seconds since the Epoch
+	DateNsec      uint32 // [20:23] Subsecond part of the time at which the snapshot was taken in nanoseconds
+	VMClockNsec   uint64 // [24:31] Time that the guest was running until the snapshot was taken in nanoseconds
+	VMStateSize   uint32 // [32:35] Size of the VM state in bytes. 0 if no VM state is saved
+	ExtraDataSize uint32 // [36:39] Size of extra data in the table entry
 }
 
 // SnapshotExtraData represents a extra data of snapshot.
+//  block/qcow2.h: typedef struct QEMU_PACKED QCowSnapshotExtraData
 type SnapshotExtraData struct {
+	VMStateSizeLarge uint64 // [0:7] Size of the VM state in bytes, which replaces VMStateSize
+	DiskSize         uint64 // [8:15] Virtual disk size of the snapshot in bytes
 }
 
 // Snapshot represents a snapshot.
+//  block/qcow2.h: typedef struct QCowSnapshot
 type Snapshot struct {
+	L1TableOffset uint64 // uint64_t
+	L1Size        uint32 // uint32_t
+	IDStr         string // char *
+	Name          string // char *
+	DiskSize      uint64 // uint64_t
+	VMStateSize   uint64 // uint64_t
+	DateSec       uint32 // uint32_t
+	DateNsec      uint32 // uint32_t
+	VMClockNsec   uint64 // uint64_t
 }
 
-// Cache represents a cache.
-type Cache struct {
+// SnapshotInfo represents the information of an internal snapshot, which is independent of the image format.
+//  include/block/snapshot.h: typedef struct QEMUSnapshotInfo
+type SnapshotInfo struct {
+	ID          string `json:"id"`            // char id_str[128]; unique snapshot id
+	Name        string `json:"name"`          // char name[256]; user chosen name
+	VMStateSize int64  `json:"vm-state-size"` // uint64_t vm_state_size; VM state info size
+	DateSec     int64  `json:"date-sec"`      // uint32_t date_sec; UTC date of the snapshot
+	DateNsec    int64  `json:"date-nsec"`     // uint32_t date_nsec
+	VMClockSec  int64  `json:"vm-clock-sec"`  // uint64_t vm_clock_nsec; VM clock relative to boot
+	VMClockNsec int64  `json:"vm-clock-nsec"`
 }
 
 // UnknownHeaderExtension represents a unknown of header extension.
@@ -250,7 +298,7 @@ type UnknownHeaderExtension struct {
 	Magic uint32
 	Len   uint32
 	// Next QLIST_ENTRY(Qcow2UnknownHeaderExtension)
-	Data []int8
+	Data []byte
 }
 
 // FeatureType represents a type of feature.
@@ -291,6 +339,16 @@ const (
 	COMPAT_FEAT_MASK = COMPAT_LAZY_REFCOUNTS
 )
 
+const (
+	// AUTOCLEAR_BITMAPS_BITNR represents a autoclear bitmaps bit number.
+	AUTOCLEAR_BITMAPS_BITNR = 0
+	// AUTOCLEAR_BITMAPS the bitmaps extension is consistent with the image.
+	AUTOCLEAR_BITMAPS = 1 << AUTOCLEAR_BITMAPS_BITNR
+
+	// AUTOCLEAR_MASK mask of autoclear feature.
+	AUTOCLEAR_MASK = AUTOCLEAR_BITMAPS
+)
+
 // DiscardType represents a type of discard.
 type DiscardType int
 
@@ -316,74 +374,124 @@ type Feature struct {
 	byt  []byte
 }
 
+// featureSize is the size of feature name table entry.
+//  sizeof(Qcow2Feature)
+const featureSize = 48
+
+// snapshotHeaderSize is the size of the fixed part of snapshot table entry.
+//  sizeof(QCowSnapshotHeader)
+const snapshotHeaderSize = 40
+
+// snapshotExtraDataSize is the size of the extra data of snapshot table entry, which is written by this package.
+//  sizeof(QCowSnapshotExtraData)
+const snapshotExtraDataSize = 16
+
+// The bit numbers of the metadata which is checked by the overlap check.
+//  block/qcow2.h: typedef enum QCow2MetadataOverlap
+const (
+	QCOW2_OL_MAIN_HEADER_BITNR = iota
+	QCOW2_OL_ACTIVE_L1_BITNR
+	QCOW2_OL_ACTIVE_L2_BITNR
+	QCOW2_OL_REFCOUNT_TABLE_BITNR
+	QCOW2_OL_REFCOUNT_BLOCK_BITNR
+	QCOW2_OL_SNAPSHOT_TABLE_BITNR
+	QCOW2_OL_INACTIVE_L1_BITNR
+	QCOW2_OL_INACTIVE_L2_BITNR
+
+	QCOW2_OL_MAX_BITNR
+)
+
+// The bitmask of the metadata which is checked by the overlap check, and the templates of the check levels.
+//  block/qcow2.h: typedef enum QCow2MetadataOverlap
+const (
+	QCOW2_OL_NONE           = 0
+	QCOW2_OL_MAIN_HEADER    = 1 << QCOW2_OL_MAIN_HEADER_BITNR
+	QCOW2_OL_ACTIVE_L1      = 1 << QCOW2_OL_ACTIVE_L1_BITNR
+	QCOW2_OL_ACTIVE_L2      = 1 << QCOW2_OL_ACTIVE_L2_BITNR
+	QCOW2_OL_REFCOUNT_TABLE = 1 << QCOW2_OL_REFCOUNT_TABLE_BITNR
+	QCOW2_OL_REFCOUNT_BLOCK = 1 << QCOW2_OL_REFCOUNT_BLOCK_BITNR
+	QCOW2_OL_SNAPSHOT_TABLE = 1 << QCOW2_OL_SNAPSHOT_TABLE_BITNR
+	QCOW2_OL_INACTIVE_L1    = 1 << QCOW2_OL_INACTIVE_L1_BITNR
+	// QCOW2_OL_INACTIVE_L2 is not in QCOW2_OL_CACHED, because the L1 tables of the snapshots are read from
+	// the image file by every check.
+	QCOW2_OL_INACTIVE_L2 = 1 << QCOW2_OL_INACTIVE_L2_BITNR
+
+	// QCOW2_OL_CONSTANT the metadata which is checked in constant time.
+	QCOW2_OL_CONSTANT = QCOW2_OL_MAIN_HEADER | QCOW2_OL_ACTIVE_L1 | QCOW2_OL_REFCOUNT_TABLE | QCOW2_OL_SNAPSHOT_TABLE
+	// QCOW2_OL_CACHED the metadata which is checked without the I/O.
+	QCOW2_OL_CACHED = QCOW2_OL_CONSTANT | QCOW2_OL_ACTIVE_L2 | QCOW2_OL_REFCOUNT_BLOCK | QCOW2_OL_INACTIVE_L1
+	// QCOW2_OL_ALL all of the metadata.
+	QCOW2_OL_ALL = QCOW2_OL_CACHED | QCOW2_OL_INACTIVE_L2
+)
+
 type DiscardRegion struct {
 	Bs     *BlockDriverState
 	Offset uint64 // uint64_t
-	byt    uint64 // uint64_t
+	Bytes  uint64 // uint64_t
 	// next QTAILQ_ENTRY(Qcow2DiscardRegion)
 }
 
-// GetRefcountFunc typedef uint64_t Qcow2GetRefcountFunc(const void *refcount_array, uint64_t index);
-func GetRefcountFunc(refcountArray map[uint64]uintptr, index uint64) uint64 {
-	// ro0 := (refcountArray[index/8] >> (index % 8)) & 0x1
-	// ro1 := (refcountArray)[index/4] >> (2 * (index % 4))
-	// ro2 := (refcountArray)[index/2] >> (4 * (index % 2))
-	// ro3 := (refcountArray)[index]
-	// ro4 := BEUvarint16(uint16(refcountArray[index]))
-	// ro5 := BEUvarint32(uint32(refcountArray[index]))
-	// ro6 := BEUvarint64(uint64(refcountArray[index]))
-
-	// TODO(zchee): WIP
-	return 0
-}
+// GetRefcountFunc returns the refcount entry at index of the refcount block refcountArray.
+// The width of the entry depends on the refcount order of the image.
+//  block/qcow2.h: typedef uint64_t Qcow2GetRefcountFunc(const void *refcount_array, uint64_t index);
+type GetRefcountFunc func(refcountArray []byte, index uint64) uint64
 
-// SetRefcountFunc typedef void Qcow2SetRefcountFunc(void *refcount_array, uint64_t index, uint64_t value);
-func SetRefcountFunc(refcountArray map[uint64]uintptr, index uint64) {
-	// TODO(zchee): WIP
-	return
-}
+// SetRefcountFunc sets the refcount entry at index of the refcount block refcountArray to value.
+// The width of the entry depends on the refcount order of the image.
+//  block/qcow2.h: typedef void Qcow2SetRefcountFunc(void *refcount_array, uint64_t index, uint64_t value);
+type SetRefcountFunc func(refcountArray []byte, index uint64, value uint64)
 
 type BDRVState struct {
-	ClusterBits       int    // int
-	ClusterSize       int    // int
-	ClusterSectors    int    // int
-	L2Bits            int    // int
-	L2Size            int    // int
-	L1Size            int    // int
-	L1VmStateIndex    int    // int
-	RefcountBlockBits int    // int
-	RefcountBlockSize int    // int
-	Csize_shift       int    // int
-	Csize_mask        int    // int
-	ClusterOffsetMask uint64 // uint64_t
-	L1TableOffset     uint64 // uint64_t
-	L1Table           uint64 // uint64_t
-
-	L2TableCache       *Cache // *Qcow2Cache
-	RefcountBlockCache *Cache // *Qcow2Cache
-	// cache_clean_timer    *QEMUTimer
-	CacheCleanInterval uintptr // unsigned
-
-	ClusterCache       uint8  // uint8_t
-	ClusterData        uint8  // uint8_t
+	ClusterBits       int      // int
+	ClusterSize       int      // int
+	ClusterSectors    int      // int
+	L2Bits            int      // int
+	L2Size            int      // int
+	L1Size            int      // int
+	L1VmStateIndex    int      // int
+	RefcountBlockBits int      // int
+	RefcountBlockSize int      // int
+	Csize_shift       int      // int
+	Csize_mask        int      // int
+	ClusterOffsetMask uint64   // uint64_t
+	L1TableOffset     uint64   // uint64_t
+	L1Table           *l1Table // uint64_t *
+
+	L2TableCache       *Cache           // *Qcow2Cache
+	RefcountBlockCache *Cache           // *Qcow2Cache
+	cacheCleanTimer    *cacheCleanTimer // QEMUTimer *
+	CacheCleanInterval time.Duration    // unsigned
+
+	ClusterCache       []byte // uint8_t *
+	ClusterData        []byte // uint8_t *
 	ClusterCacheOffset uint64 // uint64_t
+	// clusterCacheLock serializes the decompression to ClusterCache by the concurrent reads.
+	clusterCacheLock sync.Mutex
 	// cluster_allocs QLIST_HEAD(QCowClusterAlloc, QCowL2Meta)
 
-	// RefcountTable       map[uint64]int64 // uint64_t
-	RefcountTable       [8][]byte // uint64_t
-	RefcountTableOffset uint64    // uint64_t
-	RefcountTableSize   uint32    // uint32_t
-	FreeClusterIndex    uint64    // uint64_t
-	FreeByteOffset      uint64    // uint64_t
-
-	// lock CoMutex // CoMutex
+	// RefcountTable the refcount table, whose i-th entry is the offset of the refcount block of the i-th
+	// RefcountBlockSize clusters, or 0 if it is not allocated. It is bounded by MAX_REFTABLE_SIZE at open, and
+	// its segments are loaded on demand, same as the refcount blocks by RefcountBlockCache, so the memory does
+	// not grow with the size of the image file.
+	RefcountTable       *refcountTable // uint64_t *
+	RefcountTableOffset uint64         // uint64_t
+	RefcountTableSize   uint32         // uint32_t
+	// MaxRefcountTableIndex the last used entry of RefcountTable. The entries of the segments which are not
+	// loaded yet are taken as used.
+	MaxRefcountTableIndex int    // uint32_t: Last used entry in refcount_table
+	FreeClusterIndex      uint64 // uint64_t
+	FreeByteOffset        uint64 // uint64_t
+
+	// lock guards the metadata. It is held for reading by the reads of the guest data, and for writing
+	// by the requests which update the metadata, so the copy on write of the allocating writes is serialized.
+	lock sync.RWMutex // CoMutex
 
 	// cipher              *QCryptoCipher // current cipher, nil if no key yet
-	CryptMethodHeader uint32  // uint32_t
-	SnapshotsOffset   uint64  // uint64_t
-	SnapshotsSize     int     // int
-	NbSnapshots       uintptr // unsigend int
-	// snapshots           *QCowSnapshot
+	CryptMethodHeader uint32     // uint32_t
+	SnapshotsOffset   uint64     // uint64_t
+	SnapshotsSize     int        // int
+	NbSnapshots       uintptr    // unsigend int
+	Snapshots         []Snapshot // QCowSnapshot *
 
 	Flags            int     // int
 	Version          Version // int
@@ -392,23 +500,37 @@ type BDRVState struct {
 	RefcountBits     int     // int
 	RefcountMax      uint64  // uint64_t
 
-	GetRefcount func(refcountArray interface{}, index uint64) uint64        // *Qcow2GetRefcountFunc
-	SetRefcount func(refcountArray interface{}, index uint64, value uint64) // *Qcow2SetRefcountFunc
+	GetRefcount GetRefcountFunc // Qcow2GetRefcountFunc *
+	SetRefcount SetRefcountFunc // Qcow2SetRefcountFunc *
 
-	DiscardPassthrough bool // bool discard_passthrough[QCOW2_DISCARD_MAX]
+	DiscardPassthrough [DISCARD_MAX]bool // bool discard_passthrough[QCOW2_DISCARD_MAX]
+	// WipeFreed overwrites the clusters with zeros when their refcounts drop to zero.
+	WipeFreed bool
+	// SnapshotQuota limits the snapshots which are created in the image.
+	SnapshotQuota SnapshotQuota
+	// Compression the options of the compressed writes.
+	Compression Compression
 
 	OverlapCheck       int  // int: bitmask of Qcow2MetadataOverlap values
 	SignaledCorruption bool // bool
+	// fenced the fatal corruption is signaled, and the writes to the image fail.
+	fenced bool
+	// corruptLock serializes the signals of the corruption, which are signaled by the concurrent reads.
+	corruptLock sync.Mutex
 
 	IncompatibleFeatures uint64 // uint64_t
 	CompatibleFeatures   uint64 // uint64_t
 	AutoclearFeatures    uint64 // uint64_t
 
-	UnknownheaderFieldsSize int    // size_t
-	UnknownHeaderFields     []byte // void*
-	// unknown_header_ext QLIST_HEAD(, Qcow2UnknownHeaderExtension)
-	// discards QTAILQ_HEAD (, Qcow2DiscardRegion)
-	CacheDiscards bool // bool
+	NbBitmaps             uint32 // uint32_t
+	BitmapDirectorySize   uint64 // uint64_t
+	BitmapDirectoryOffset uint64 // uint64_t
+
+	UnknownheaderFieldsSize int                       // size_t
+	UnknownHeaderFields     []byte                    // void*
+	UnknownHeaderExt        []*UnknownHeaderExtension // QLIST_HEAD(, Qcow2UnknownHeaderExtension)
+	Discards                []*DiscardRegion          // QTAILQ_HEAD (, Qcow2DiscardRegion)
+	CacheDiscards           bool                      // bool
 
 	// Backing file path and format as stored in the image (this is not the
 	// effective path/format, which may be the result of a runtime option
@@ -417,6 +539,31 @@ type BDRVState struct {
 	ImageBackingFormat []byte // char *
 }
 
+// COWRegion represents a part of the newly allocated cluster which is copied from the old cluster.
+//  block/qcow2.h: typedef struct Qcow2COWRegion
+type COWRegion struct {
+	// Offset offset of the region relative to the start of the first allocated cluster.
+	Offset uint64 // uint64_t
+	// NbBytes number of bytes to copy.
+	NbBytes int // int
+}
+
+// L2Meta represents the newly allocated clusters which are linked to the L2 table after the guest data is written.
+//  block/qcow2.h: typedef struct QCowL2Meta
+type L2Meta struct {
+	// Offset guest offset of the first newly allocated cluster.
+	Offset uint64 // uint64_t
+	// AllocOffset host offset of the first newly allocated cluster.
+	AllocOffset uint64 // uint64_t
+	// NbClusters number of newly allocated clusters.
+	NbClusters int // int
+
+	// CowStart the region from the start of the first allocated cluster to the start of the guest write.
+	CowStart COWRegion // Qcow2COWRegion
+	// CowEnd the region from the end of the guest write to the end of the last allocated cluster.
+	CowEnd COWRegion // Qcow2COWRegion
+}
+
 type CLUSTER uint64
 
 const (
@@ -427,10 +574,11 @@ const (
 )
 
 const (
-	L1E_OFFSET_MASK                 = uint64(72057594037927424)   // 0x00fffffffffffe00ULL
-	L2E_OFFSET_MASK                 = uint64(72057594037927424)   // 0x00fffffffffffe00ULL
-	L2E_COMPRESSED_OFFSET_SIZE_MASK = uint64(4611686018427387903) // 0x3fffffffffffffffULL
-	REFT_OFFSET_MASK                = uint64(1844674407370955110) // 0xfffffffffffffe00ULL
+	L1E_OFFSET_MASK                 = uint64(72057594037927424)    // 0x00fffffffffffe00ULL
+	L2E_OFFSET_MASK                 = uint64(72057594037927424)    // 0x00fffffffffffe00ULL
+	L2E_COMPRESSED_OFFSET_SIZE_MASK = uint64(4611686018427387903)  // 0x3fffffffffffffffULL
+	REFT_OFFSET_MASK                = uint64(18446744073709551104) // 0xfffffffffffffe00ULL
+	REFT_RESERVED_MASK              = uint64(511)                  // 0x1ffULL
 )
 
 // ---------------------------------------------------------------------------
@@ -467,10 +615,73 @@ const (
 	BDRV_BLOCK_OFFSET_VALID = 0x04
 	BDRV_BLOCK_RAW          = 0x08
 	BDRV_BLOCK_ALLOCATED    = 0x10
+	BDRV_BLOCK_EOF          = 0x20
+	BDRV_BLOCK_COMPRESSED   = 0x80
 )
 
 var BDRV_BLOCK_OFFSET_MASK = BDRV_SECTOR_MASK
 
+// BdrvRequestFlags represents a flags of the block layer request.
+type BdrvRequestFlags uint
+
+const (
+	// BDRV_REQ_COPY_ON_READ copy the read backing sectors into the image.
+	BDRV_REQ_COPY_ON_READ BdrvRequestFlags = 0x1
+	// BDRV_REQ_ZERO_WRITE the request writes zeros without the buffer.
+	BDRV_REQ_ZERO_WRITE BdrvRequestFlags = 0x2
+	// BDRV_REQ_MAY_UNMAP the zero write request may unmap the zeroed clusters.
+	//
+	// The BDRV_REQ_MAY_UNMAP flag is used to indicate that the block driver
+	// is allowed to optimize a write zeroes request by unmapping (discarding)
+	// blocks if it is guaranteed that the result will read back as
+	// zeroes. The flag is only passed to the driver if the block device is
+	// opened with BDRV_O_UNMAP.
+	BDRV_REQ_MAY_UNMAP BdrvRequestFlags = 0x4
+	// BDRV_REQ_NO_SERIALISING the request is not serialised with the overlapping requests.
+	BDRV_REQ_NO_SERIALISING BdrvRequestFlags = 0x8
+	// BDRV_REQ_FUA the request is written through to the stable storage.
+	BDRV_REQ_FUA BdrvRequestFlags = 0x10
+	// BDRV_REQ_WRITE_COMPRESSED the request writes the compressed clusters.
+	BDRV_REQ_WRITE_COMPRESSED BdrvRequestFlags = 0x20
+)
+
+// BlockFragInfo represents the allocation and the fragmentation of the guest clusters of the image.
+//  include/block/block.h: typedef struct BlockFragInfo
+type BlockFragInfo struct {
+	AllocatedClusters  int64 // uint64_t
+	TotalClusters      int64 // uint64_t
+	FragmentedClusters int64 // uint64_t
+	CompressedClusters int64 // uint64_t
+}
+
+// BdrvCheckResult represents the result of the consistency check of the image.
+//  include/block/block.h: typedef struct BdrvCheckResult
+type BdrvCheckResult struct {
+	Corruptions      int           // int
+	Leaks            int           // int
+	CheckErrors      int           // int
+	CorruptionsFixed int           // int
+	LeaksFixed       int           // int
+	ImageEndOffset   int64         // int64_t
+	Bfi              BlockFragInfo // BlockFragInfo
+}
+
+// CheckMode represents the inconsistencies which are repaired by the consistency check of the image.
+//  include/block/block.h: typedef enum BdrvCheckMode
+type CheckMode int
+
+const (
+	// BDRV_FIX_LEAKS repairs the leaked clusters, whose refcount is larger than the number of the references.
+	BDRV_FIX_LEAKS CheckMode = 1
+	// BDRV_FIX_ERRORS repairs the corruptions, such as the refcount which is smaller than the number of the
+	// references, and the wrong OFLAG_COPIED flag.
+	BDRV_FIX_ERRORS CheckMode = 2
+)
+
+// CHECK_FRAG_INFO collects the fragmentation information of the clusters while the L2 tables are checked.
+//  block/qcow2-refcount.c: enum { CHECK_FRAG_INFO = 0x2 }
+const CHECK_FRAG_INFO = 0x2
+
 // ---------------------------------------------------------------------------
 // include/block/block_int.h
 
@@ -489,7 +700,8 @@ type BlockDriver struct {
 	 */
 	// bool (*bdrv_recurse_is_first_non_filter)(BlockDriverState *bs, BlockDriverState *candidate)
 
-	// (*bdrv_probe)(const uint8_t *buf, int buf_size, const char *filename) int // TODO
+	// int (*bdrv_probe)(const uint8_t *buf, int buf_size, const char *filename);
+	bdrvProbe func(buf []byte, filename string) int
 	// (*bdrv_probe_device)(const char *filename) int // TODO
 
 	/* Any driver implementing this callback is expected to be able to handle
@@ -512,11 +724,11 @@ type BlockDriver struct {
 	// void (*bdrv_reopen_abort)(BDRVReopenState *reopen_state);
 	// void (*bdrv_join_options)(QDict *options, QDict *old_options);
 
-	// int (*bdrv_open)(BlockDriverState *bs, QDict *options, int flags,
-	//                  Error **errp);
+	bdrvOpen func(bs *BlockDriverState, options *QDict, flags int) error
 	// int (*bdrv_file_open)(BlockDriverState *bs, QDict *options, int flags,
 	//                       Error **errp);
 	// void (*bdrv_close)(BlockDriverState *bs);
+	bdrvClose func(bs *BlockDriverState)
 	// int (*bdrv_create)(const char *filename, QemuOpts *opts, Error **errp);
 	// int (*bdrv_set_key)(BlockDriverState *bs, const char *key);
 	// int (*bdrv_make_empty)(BlockDriverState *bs);
@@ -531,9 +743,13 @@ type BlockDriver struct {
 
 	// int coroutine_fn (*bdrv_co_readv)(BlockDriverState *bs, int64_t sector_num, int nb_sectors, QEMUIOVector *qiov);
 	// int coroutine_fn (*bdrv_co_preadv)(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags);
+	// The request callbacks take the ctx of the request, in which the internal operations are traced.
+	bdrvCoPreadv func(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error
 	// int coroutine_fn (*bdrv_co_writev)(BlockDriverState *bs, int64_t sector_num, int nb_sectors, QEMUIOVector *qiov);
 	// int coroutine_fn (*bdrv_co_writev_flags)(BlockDriverState *bs, int64_t sector_num, int nb_sectors, QEMUIOVector *qiov, int flags);
 	// int coroutine_fn (*bdrv_co_pwritev)(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov, int flags);
+	// The flags are the flags of the request which are in SupportedWriteFlags of bs.
+	bdrvCoPwritev func(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte, flags BdrvRequestFlags) error
 
 	// Efficiently zero a region of the disk image.  Typically an image format
 	// would use a compact metadata representation to implement this.  This
@@ -541,12 +757,26 @@ type BlockDriver struct {
 	// will be called instead.
 	//
 	// int coroutine_fn (*bdrv_co_pwrite_zeroes)(BlockDriverState *bs, int64_t offset, int count, BdrvRequestFlags flags);
+	bdrvCoPwriteZeroes func(ctx context.Context, bs *BlockDriverState, offset, count int64, flags BdrvRequestFlags) error
 	// int coroutine_fn (*bdrv_co_pdiscard)(BlockDriverState *bs, int64_t offset, int count);
+	bdrvCoPdiscard func(ctx context.Context, bs *BlockDriverState, offset, count int64) error
 	// int64_t coroutine_fn (*bdrv_co_get_block_status)(BlockDriverState *bs, int64_t sector_num, int nb_sectors, int *pnum, BlockDriverState **file);
+	bdrvCoGetBlockStatus func(bs *BlockDriverState, offset, bytes int64) (status int, n int64, mapOffset int64, err error)
+
+	// Copy the guest data of bs to the guest data of dst in the image files, without reading the data into the
+	// memory. The source driver maps the range to its image file, and calls bdrvCoCopyRangeTo of dst.
+	// Return ENOTSUP if the range can not be copied, then the caller reads and writes the data instead.
+	//
+	// int coroutine_fn (*bdrv_co_copy_range_from)(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags);
+	bdrvCoCopyRangeFrom func(ctx context.Context, bs *BlockDriverState, offset int64, dst *BlockDriverState, dstOff, bytes int64) error
+	// int coroutine_fn (*bdrv_co_copy_range_to)(BlockDriverState *bs, BdrvChild *src, uint64_t src_offset, BdrvChild *dst, uint64_t dst_offset, uint64_t bytes, BdrvRequestFlags read_flags, BdrvRequestFlags write_flags);
+	bdrvCoCopyRangeTo func(ctx context.Context, src *BdrvChild, srcOff int64, bs *BlockDriverState, offset, bytes int64) error
 
 	// Invalidate any cached meta-data.
 	// void (*bdrv_invalidate_cache)(BlockDriverState *bs, Error **errp);
+	// Writes the cached meta-data to the image file, and leaves the image consistent before it is closed.
 	// int (*bdrv_inactivate)(BlockDriverState *bs);
+	bdrvInactivate func(bs *BlockDriverState) error
 
 	// Flushes all data for all layers by calling bdrv_co_flush for underlying
 	// layers, if needed. This function is needed for deterministic
@@ -561,28 +791,36 @@ type BlockDriver struct {
 	// writeback cache of the host OS, but it will survive a crash of the qemu
 	// process.
 	// int coroutine_fn (*bdrv_co_flush_to_os)(BlockDriverState *bs);
+	bdrvCoFlushToOS func(bs *BlockDriverState) error
 
 	protocol_name string
-	// bdrvTruncate  func(bs *BlockDriverState, offset int64) error // NOTE: implemented use interface
+	bdrvTruncate  func(bs *BlockDriverState, offset int64) error
 
 	bdrvGetlength     func(bs *BlockDriverState) (int64, error)
 	hasVariableLength bool
 	// int64_t (*bdrv_get_allocated_file_size)(BlockDriverState *bs);
 
-	// int (*bdrv_write_compressed)(BlockDriverState *bs, int64_t sector_num, const uint8_t *buf, int nb_sectors);
+	// int coroutine_fn (*bdrv_co_pwritev_compressed)(BlockDriverState *bs, uint64_t offset, uint64_t bytes, QEMUIOVector *qiov);
+	bdrvCoPwritevCompressed func(ctx context.Context, bs *BlockDriverState, offset int64, buf []byte) error
 
 	// int (*bdrv_snapshot_create)(BlockDriverState *bs, QEMUSnapshotInfo *sn_info);
+	bdrvSnapshotCreate func(bs *BlockDriverState, info *SnapshotInfo) error
 	// int (*bdrv_snapshot_goto)(BlockDriverState *bs, const char *snapshot_id);
+	bdrvSnapshotGoto func(bs *BlockDriverState, snapshotID string) error
 	// int (*bdrv_snapshot_delete)(BlockDriverState *bs, const char *snapshot_id, const char *name, Error **errp);
+	bdrvSnapshotDelete func(bs *BlockDriverState, snapshotID, name string) error
 	// int (*bdrv_snapshot_list)(BlockDriverState *bs, QEMUSnapshotInfo **psn_info);
+	bdrvSnapshotList func(bs *BlockDriverState) ([]SnapshotInfo, error)
 	// int (*bdrv_snapshot_load_tmp)(BlockDriverState *bs, const char *snapshot_id, const char *name, Error **errp);
 	// int (*bdrv_get_info)(BlockDriverState *bs, BlockDriverInfo *bdi);
+	bdrvGetInfo func(bs *BlockDriverState) *BlockDriverInfo
 	// ImageInfoSpecific *(*bdrv_get_specific_info)(BlockDriverState *bs);
 
 	// int coroutine_fn (*bdrv_save_vmstate)(BlockDriverState *bs, QEMUIOVector *qiov, int64_t pos);
 	// int coroutine_fn (*bdrv_load_vmstate)(BlockDriverState *bs, QEMUIOVector *qiov, int64_t pos);
 
 	// int (*bdrv_change_backing_file)(BlockDriverState *bs, const char *backing_file, const char *backing_fmt);
+	bdrvChangeBackingFile func(bs *BlockDriverState, backingFile, backingFmt string) error
 
 	// removable device specific
 	// bool (*bdrv_is_inserted)(BlockDriverState *bs);
@@ -601,6 +839,7 @@ type BlockDriver struct {
 	// The check results are stored in result.
 	//
 	// int (*bdrv_check)(BlockDriverState* bs, BdrvCheckResult *result, BdrvCheckMode fix);
+	bdrvCheck func(ctx context.Context, bs *BlockDriverState, res *BdrvCheckResult, fix CheckMode) error
 
 	// int (*bdrv_amend_options)(BlockDriverState *bs, QemuOpts *opts, BlockDriverAmendStatusCB *status_cb, void *cb_opaque);
 
@@ -613,12 +852,14 @@ type BlockDriver struct {
 	// bool (*bdrv_debug_is_suspended)(BlockDriverState *bs, const char *tag);
 
 	// void (*bdrv_refresh_limits)(BlockDriverState *bs, Error **errp);
+	bdrvRefreshLimits func(bs *BlockDriverState)
 
 	//
 	// Returns 1 if newly created images are guaranteed to contain only
 	// zeros, 0 otherwise.
 	//
 	// int (*bdrv_has_zero_init)(BlockDriverState *bs);
+	bdrvHasZeroInit func(bs *BlockDriverState) bool
 
 	// Remove fd handlers, timers, and other event loop callbacks so the event
 	// loop is no longer in use.  Called with no in-flight requests and in
@@ -688,12 +929,19 @@ func nbSectors(bs *BlockDriverState) (int64, error) {
 	}
 
 	if drv.hasVariableLength {
-		err := refreshTotalSectors(bs, bs.TotalSectors)
+		bs.mu.Lock()
+		hint := bs.TotalSectors
+		bs.mu.Unlock()
+
+		err := refreshTotalSectors(bs, hint)
 		if err != nil {
 			return 0, err
 		}
 	}
 
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
 	return bs.TotalSectors, nil
 }
 
@@ -705,8 +953,8 @@ func getlength(bs *BlockDriverState) (int64, error) {
 		return 0, err
 	}
 
-	if length > int64(INT64_MAX/BDRV_SECTOR_SIZE) {
-		return 0, syscall.EFBIG
+	if length > INT64_MAX/int64(BDRV_SECTOR_SIZE) {
+		return 0, errors.Wrap(ErrTooLarge, "Image too large")
 	}
 	return length * int64(BDRV_SECTOR_SIZE), nil
 }
@@ -724,6 +972,8 @@ const (
 	DriverRaw DriverFmt = "raw"
 	// DriverQCow2 qcow2 driver format.
 	DriverQCow2 DriverFmt = "qcow2"
+	// DriverQCow qcow (version 1) driver format.
+	DriverQCow DriverFmt = "qcow"
 )
 
 type BlockLimits struct {
@@ -802,6 +1052,8 @@ type BlockDriverState struct {
 
 	Drv    *BlockDriver // BlockDriver *: NULL means no media
 	Opaque *BDRVState   // void *
+	// qcowOpaque the state of the qcow (version 1) driver.
+	qcowOpaque *qcowState // void *
 
 	// AioContext *AioContext // event loop used for fd handlers, timers, etc // TODO
 
@@ -819,7 +1071,7 @@ type BlockDriverState struct {
 	ExactFilename string // char: exact_filename[PATH_MAX]
 
 	Backing *BdrvChild
-	File    *os.File
+	File    Backend
 	file    *BdrvChild
 
 	// BeforeWriteNotifiers Callback before write request is processed
@@ -848,9 +1100,16 @@ type BlockDriverState struct {
 	// MonitorList element of the list of monitor-owned BDS
 	// MonitorList QTAILQ_ENTRY(BlockDriverState) // TODO
 	// DirtyBitmaps QLIST_HEAD(, BdrvDirtyBitmap) // TODO
+	// Refcnt the number of the references to the node, guarded by bdrvRefMu.
 	Refcnt int // int
 
-	// TrackedRequests QLIST_HEAD(, BdrvTrackedRequest) // TODO
+	// TrackedRequests the in-flight requests, guarded by mu.
+	TrackedRequests []*BdrvTrackedRequest // QLIST_HEAD(, BdrvTrackedRequest)
+
+	// acct the I/O counters of the requests to the node.
+	acct BlockAcctStats // BlockAcctStats stats
+	// tracer the tracer of the internal operations of the node, replaced only in the quiesced section.
+	tracer Tracer
 
 	// operation blockers
 	// OpBlockers [BLOCK_OP_TYPE_MAX]QLIST_HEAD(, BdrvOpBlocker) // operation blockers TODO
@@ -861,13 +1120,18 @@ type BlockDriverState struct {
 	// The node that this node inherited default options from (and a reopen on
 	// which can affect this node by changing these defaults). This is always a
 	// parent node of this node.
-	// InheritsFrom *BlockDriverState // BlockDriverState *: TODO
+	// inheritsFrom the overlay of the node while the backing chain is opened, which is used to
+	// detect the loop of the backing chain.
+	inheritsFrom *BlockDriverState // BlockDriverState *
 	// Children QLIST_HEAD(, BdrvChild) // TODO
 	// Parents QLIST_HEAD(, BdrvChild) // TODO
 
-	// Options         *QDict                      // TODO
+	// Options the options of opening the image, or nil if the default options are used.
+	Options *OpenOpts // QDict *
+	// logger the Logger of the node, which holds loggerHolder. If it is not set, the Logger of the package is used.
+	logger atomic.Value
 	// ExplicitOptions *QDict                      // TODO
-	// DetectZeroes    BlockdevDetectZeroesOptions // TODO
+	DetectZeroes DetectZeroes // BlockdevDetectZeroesOptions
 
 	// The error object in use for blocking operations on backing_hd
 	BackingBlocker error
@@ -881,6 +1145,31 @@ type BlockDriverState struct {
 	IOPlugDisabled uintptr // unsigned: TODO
 
 	QuiesceCounter int // int
+
+	// mu guards TotalSectors, WriteGen and the tracked requests, which are updated by the requests.
+	mu sync.Mutex
+
+	// quiesce is held for reading by the in-flight requests, and for writing
+	// by the quiesced section such as the resize of the image.
+	quiesce sync.RWMutex
+}
+
+// BdrvTrackedRequest represents the in-flight request of the BlockDriverState.
+// The serialising request waits for the overlapping in-flight requests, and the other requests wait for it,
+// so the overlapping writes and the copy on write of them are serialized while the disjoint requests run in parallel.
+//  include/block/block_int.h: typedef struct BdrvTrackedRequest
+type BdrvTrackedRequest struct {
+	bs      *BlockDriverState
+	Offset  int64 // int64_t
+	Bytes   int64 // unsigned int
+	IsWrite bool  // enum BdrvTrackedRequestType type
+
+	Serialising   bool  // bool
+	OverlapOffset int64 // int64_t
+	OverlapBytes  int64 // unsigned int
+
+	// waitQueue is closed when the request is completed.
+	waitQueue chan struct{} // CoQueue
 }
 
 type BdrvChild struct {
@@ -925,6 +1214,20 @@ const (
 	PREALLOC_MODE__MAX
 )
 
+// DetectZeroes represents a mode of the detection of the zero writes.
+type DetectZeroes int
+
+const (
+	// DETECT_ZEROES_OFF disables the zero detection.
+	DETECT_ZEROES_OFF DetectZeroes = iota
+	// DETECT_ZEROES_ON writes the zero buffers as the zero clusters.
+	DETECT_ZEROES_ON
+	// DETECT_ZEROES_UNMAP writes the zero buffers as the zero clusters, and frees the host clusters.
+	DETECT_ZEROES_UNMAP
+	// DETECT_ZEROES__MAX maximum detect zeroes mode.
+	DETECT_ZEROES__MAX
+)
+
 // ---------------------------------------------------------------------------
 // include/qemu/option.h
 
@@ -1020,11 +1323,12 @@ func MAX(a, b int) int {
 // Right side comments carried from the C header.
 
 const (
-	INT8_MAX  = math.MaxInt8  // 127
-	INT16_MAX = math.MaxInt16 // 32767
-	INT32_MAX = math.MaxInt32 // 2147483647
-	INT64_MAX = math.MaxInt64 // 9223372036854775807LL
-	INT_MAX   = math.MaxInt32 // INT_MAX == INT32_MAX on darwin,amd64
+	INT8_MAX  = math.MaxInt8   // 127
+	INT16_MAX = math.MaxInt16  // 32767
+	INT32_MAX = math.MaxInt32  // 2147483647
+	INT64_MAX = math.MaxInt64  // 9223372036854775807LL
+	INT_MAX   = math.MaxInt32  // INT_MAX == INT32_MAX on darwin,amd64
+	UINT_MAX  = math.MaxUint32 // UINT_MAX == UINT32_MAX on darwin,amd64
 )
 
 const (
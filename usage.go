@@ -0,0 +1,316 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// Usage represents where the space of the image file goes. The clusters of the image file are classified by the
+// first structure which refers to them, so the clusters which are shared by the active layer and the internal
+// snapshots are counted once, and the byte counts of the metadata are rounded up to the clusters.
+type Usage struct {
+	ClusterSize int   `json:"cluster-size"`
+	VirtualSize int64 `json:"virtual-size"`
+
+	// FileLength the length of the image file, and AllocatedSize the space which is allocated to the image file
+	// on the host, which is smaller than FileLength if the image file is sparse.
+	FileLength    int64 `json:"file-length"`
+	AllocatedSize int64 `json:"allocated-size"`
+
+	// AllocatedClusters the number of the clusters of the image file whose refcount is not zero.
+	AllocatedClusters int64 `json:"allocated-clusters"`
+	// DataClusters the number of the clusters of the image file which hold the uncompressed guest data of the
+	// active layer and the internal snapshots, including the VM state and the preallocated zero clusters.
+	DataClusters int64 `json:"data-clusters"`
+	// CompressedClusters the number of the clusters of the image file which hold the compressed guest data.
+	CompressedClusters int64 `json:"compressed-clusters"`
+	// FreeClusters the number of the clusters of the image file which are not in use, and LeakedClusters the
+	// number of them which have the refcount but are not referred by any structure of the image.
+	FreeClusters   int64 `json:"free-clusters"`
+	LeakedClusters int64 `json:"leaked-clusters"`
+
+	// HeaderBytes the size of the header and the header extensions.
+	HeaderBytes int64 `json:"header-bytes"`
+	// L1Bytes the size of the active L1 table, and L2Bytes the size of the L2 tables of the active layer and
+	// the internal snapshots.
+	L1Bytes int64 `json:"l1-bytes"`
+	L2Bytes int64 `json:"l2-bytes"`
+	// RefcountBytes the size of the refcount table and the refcount blocks.
+	RefcountBytes int64 `json:"refcount-bytes"`
+	// SnapshotBytes the size of the snapshot table and the L1 tables of the internal snapshots.
+	SnapshotBytes int64 `json:"snapshot-bytes"`
+	// BitmapBytes the size of the bitmap directory, the bitmap tables and the bitmap data of the persistent
+	// dirty bitmaps.
+	BitmapBytes int64 `json:"bitmap-bytes"`
+
+	// CompressedGuestBytes the size of the guest data which is stored compressed, and CompressedBytes the size
+	// of the compressed data which the L2 entries record, which is rounded up to the sectors, and may exceed the
+	// compressed data by a sector per cluster.
+	CompressedGuestBytes int64 `json:"compressed-guest-bytes"`
+	CompressedBytes      int64 `json:"compressed-bytes"`
+}
+
+// MetadataBytes returns the total size of the metadata of the image file.
+func (u *Usage) MetadataBytes() int64 {
+	return u.HeaderBytes + u.L1Bytes + u.L2Bytes + u.RefcountBytes + u.SnapshotBytes + u.BitmapBytes
+}
+
+// CompressedSavings returns the size of the image file which is saved by the compressed clusters.
+func (u *Usage) CompressedSavings() int64 {
+	return u.CompressedGuestBytes - u.CompressedClusters*int64(u.ClusterSize)
+}
+
+// the kinds of the clusters of the image file, in the order of the priority of the classification.
+const (
+	usageFree uint8 = iota
+	usageHeader
+	usageRefcount
+	usageL1
+	usageSnapshot
+	usageBitmap
+	usageL2
+	usageData
+	usageCompressed
+)
+
+// Usage walks the metadata of the image, and returns how much of the image file is used by the guest data, the
+// compressed data, each kind of the metadata, and the free and the leaked clusters.
+func (q *QCow2) Usage() (*Usage, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	bs := q.blk.bs()
+	if bs == nil || bs.Drv == nil {
+		return nil, ENOMEDIUM
+	}
+	if bs.Drv != bdrvQCow2 {
+		err := errors.Wrap(ErrUnsupported, "This image format does not support the usage")
+		return nil, err
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	s := bs.Opaque
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return usage(bs)
+}
+
+// usageState the classification of the clusters of the image file.
+type usageState struct {
+	bs   *BlockDriverState
+	kind []uint8
+	u    *Usage
+	// compressed the host offsets of the compressed clusters which are counted.
+	compressed map[uint64]struct{}
+}
+
+// mark classifies the clusters of the range of size bytes at offset as kind, unless they are classified already.
+// The clusters beyond the end of the image file are ignored, such as the bogus offsets of the corrupted image.
+func (st *usageState) mark(offset, size int64, kind uint8) {
+	s := st.bs.Opaque
+
+	if size <= 0 || offset < 0 {
+		return
+	}
+	first := offset >> uint(s.ClusterBits)
+	if first >= int64(len(st.kind)) {
+		return
+	}
+	last := (offset + size - 1) >> uint(s.ClusterBits)
+	for i := first; i <= last && i < int64(len(st.kind)); i++ {
+		if st.kind[i] == usageFree {
+			st.kind[i] = kind
+		}
+	}
+}
+
+// walkL1 classifies the L2 tables and the guest data which the entries of l1Table refer to.
+func (st *usageState) walkL1(l1Table []uint64) error {
+	bs := st.bs
+	s := bs.Opaque
+
+	for i, l1Entry := range l1Table {
+		l2Offset := l1Entry & L1E_OFFSET_MASK
+		if l2Offset == 0 {
+			continue
+		}
+		if offsetIntoCluster(s, int64(l2Offset)) != 0 {
+			err := signalCorruption(bs, true, -1, "L2 table offset %#x unaligned (L1 index: %#x)", l2Offset, i)
+			return err
+		}
+
+		// the L2 table which is shared with the other L1 table is walked once
+		idx := int64(l2Offset >> uint(s.ClusterBits))
+		if idx < int64(len(st.kind)) && st.kind[idx] == usageL2 {
+			continue
+		}
+		st.mark(int64(l2Offset), int64(s.ClusterSize), usageL2)
+
+		l2Table, err := l2Load(context.Background(), bs, l2Offset)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < s.L2Size; j++ {
+			st.classify(getL2Entry(l2Table, j))
+		}
+		cachePut(s.L2TableCache, l2Table)
+	}
+
+	return nil
+}
+
+// classify classifies the host cluster which l2Entry refers to.
+func (st *usageState) classify(l2Entry uint64) {
+	s := st.bs.Opaque
+
+	switch getClusterType(l2Entry) {
+	case CLUSTER_COMPRESSED:
+		coffset := l2Entry & s.ClusterOffsetMask
+		if _, ok := st.compressed[coffset]; ok {
+			return
+		}
+		st.compressed[coffset] = struct{}{}
+
+		nbCsectors := int64((l2Entry>>uint(s.Csize_shift))&uint64(s.Csize_mask)) + 1
+		st.u.CompressedGuestBytes += int64(s.ClusterSize)
+		st.u.CompressedBytes += nbCsectors * 512
+		st.mark(int64(coffset&^511), nbCsectors*512, usageCompressed)
+
+	case CLUSTER_NORMAL, CLUSTER_ZERO:
+		if offset := l2Entry & L2E_OFFSET_MASK; offset != 0 {
+			st.mark(int64(offset), int64(s.ClusterSize), usageData)
+		}
+	}
+}
+
+// usage returns the usage of the image file of bs. The caller must hold s.lock.
+func usage(bs *BlockDriverState) (*Usage, error) {
+	s := bs.Opaque
+	clusterSize := int64(s.ClusterSize)
+
+	fileLength, err := bs.File.Size()
+	if err != nil {
+		return nil, err
+	}
+	allocated, err := allocatedSize(bs.File)
+	if err != nil {
+		return nil, err
+	}
+
+	nbClusters := divRoundUp(fileLength, clusterSize)
+	st := &usageState{
+		bs:   bs,
+		kind: make([]uint8, nbClusters),
+		u: &Usage{
+			ClusterSize:   s.ClusterSize,
+			VirtualSize:   bs.TotalSectors * int64(BDRV_SECTOR_SIZE),
+			FileLength:    fileLength,
+			AllocatedSize: allocated,
+		},
+		compressed: make(map[uint64]struct{}),
+	}
+
+	// the metadata which is referred by the header
+	st.mark(0, clusterSize, usageHeader)
+	st.mark(int64(s.RefcountTableOffset), int64(s.RefcountTableSize)*UINT64_SIZE, usageRefcount)
+	reftable, err := s.RefcountTable.entries(bs)
+	if err != nil {
+		return nil, err
+	}
+	for _, reftEntry := range reftable {
+		if offset := reftEntry & REFT_OFFSET_MASK; offset != 0 {
+			st.mark(int64(offset), clusterSize, usageRefcount)
+		}
+	}
+	st.mark(int64(s.L1TableOffset), int64(s.L1Size)*UINT64_SIZE, usageL1)
+	st.mark(int64(s.SnapshotsOffset), int64(s.SnapshotsSize), usageSnapshot)
+	for i := range s.Snapshots {
+		sn := &s.Snapshots[i]
+		st.mark(int64(sn.L1TableOffset), int64(sn.L1Size)*UINT64_SIZE, usageSnapshot)
+	}
+
+	// the bitmaps are counted by the refcounts which the check of the bitmaps increases
+	if s.NbBitmaps > 0 {
+		bitmaps := make([]uint64, nbClusters)
+		if err := checkBitmapsRefcounts(bs, &BdrvCheckResult{}, &bitmaps); err != nil {
+			return nil, err
+		}
+		for i, n := range bitmaps {
+			if n != 0 {
+				st.mark(int64(i)<<uint(s.ClusterBits), clusterSize, usageBitmap)
+			}
+		}
+	}
+
+	// the L2 tables and the guest data of the active layer and the internal snapshots
+	l1Table, err := s.L1Table.entries(bs)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.walkL1(l1Table); err != nil {
+		return nil, err
+	}
+	for i := range s.Snapshots {
+		sn := &s.Snapshots[i]
+		if sn.L1Size == 0 {
+			continue
+		}
+		buf := make([]byte, int(sn.L1Size)*UINT64_SIZE)
+		if err := bdrvPread(bs.file, int64(sn.L1TableOffset), buf); err != nil {
+			return nil, errors.Wrapf(err, "Could not read the L1 table of the snapshot '%s'", sn.Name)
+		}
+		snL1Table := make([]uint64, sn.L1Size)
+		for j := range snL1Table {
+			snL1Table[j] = BEUint64(buf[j*UINT64_SIZE:])
+		}
+		if err := st.walkL1(snL1Table); err != nil {
+			return nil, err
+		}
+	}
+
+	u := st.u
+	for i, kind := range st.kind {
+		refcount, err := getRefcount(bs, uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if refcount != 0 {
+			u.AllocatedClusters++
+		}
+
+		switch kind {
+		case usageFree:
+			if refcount == 0 {
+				u.FreeClusters++
+			} else {
+				u.LeakedClusters++
+			}
+		case usageHeader:
+			u.HeaderBytes += clusterSize
+		case usageRefcount:
+			u.RefcountBytes += clusterSize
+		case usageL1:
+			u.L1Bytes += clusterSize
+		case usageSnapshot:
+			u.SnapshotBytes += clusterSize
+		case usageBitmap:
+			u.BitmapBytes += clusterSize
+		case usageL2:
+			u.L2Bytes += clusterSize
+		case usageData:
+			u.DataClusters++
+		case usageCompressed:
+			u.CompressedClusters++
+		}
+	}
+
+	return u, nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vhostuser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+const (
+	// VIRTIO_BLK_SECTOR_BITS the shift of the sector of the virtio-blk requests, which is always 512 bytes.
+	VIRTIO_BLK_SECTOR_BITS = 9
+	// VIRTIO_BLK_SECTOR_SIZE the size of the sector of the virtio-blk requests.
+	VIRTIO_BLK_SECTOR_SIZE = 1 << VIRTIO_BLK_SECTOR_BITS
+
+	// VHOST_USER_BLK_MAX_DISCARD_SECTORS the maximum number of the sectors of the discard segment.
+	//  block/export/vhost-user-blk-server.c: #define VHOST_USER_BLK_MAX_DISCARD_SECTORS 32768
+	VHOST_USER_BLK_MAX_DISCARD_SECTORS = 32768
+	// VHOST_USER_BLK_MAX_WRITE_ZEROES_SECTORS the maximum number of the sectors of the write zeroes segment.
+	//  block/export/vhost-user-blk-server.c: #define VHOST_USER_BLK_MAX_WRITE_ZEROES_SECTORS 32768
+	VHOST_USER_BLK_MAX_WRITE_ZEROES_SECTORS = 32768
+)
+
+// features returns the virtio features offered to the front-end.
+//  block/export/vhost-user-blk-server.c: static uint64_t vu_blk_get_features(VuDev *dev)
+func (srv *Server) features() uint64 {
+	features := uint64(1)<<VIRTIO_F_VERSION_1 |
+		1<<VHOST_USER_F_PROTOCOL_FEATURES |
+		1<<VIRTIO_RING_F_INDIRECT_DESC |
+		1<<VIRTIO_BLK_F_SEG_MAX |
+		1<<VIRTIO_BLK_F_BLK_SIZE |
+		1<<VIRTIO_BLK_F_FLUSH |
+		1<<VIRTIO_BLK_F_DISCARD |
+		1<<VIRTIO_BLK_F_WRITE_ZEROES
+	if srv.opts.NumQueues > 1 {
+		features |= 1 << VIRTIO_BLK_F_MQ
+	}
+	if srv.opts.ReadOnly {
+		features |= 1 << VIRTIO_BLK_F_RO
+	}
+	return features
+}
+
+// protocolFeatures the protocol features offered to the front-end.
+//  block/export/vhost-user-blk-server.c: static uint64_t vu_blk_get_protocol_features(VuDev *dev)
+const protocolFeatures = 1<<VHOST_USER_PROTOCOL_F_MQ |
+	1<<VHOST_USER_PROTOCOL_F_REPLY_ACK |
+	1<<VHOST_USER_PROTOCOL_F_CONFIG
+
+// config returns the device config space of virtio-blk.
+//  block/export/vhost-user-blk-server.c: static void vu_blk_initialize_config(BlockDriverState *bs, struct virtio_blk_config *config, uint32_t blk_size, uint16_t num_queues)
+func (srv *Server) config() ([]byte, error) {
+	size, err := srv.img.VirtualSize()
+	if err != nil {
+		return nil, err
+	}
+	// the discard of the partial clusters is ignored by the image
+	alignment := uint32(srv.opts.LogicalBlockSize)
+	if info, err := srv.img.Info(); err == nil && info.ClusterSize > srv.opts.LogicalBlockSize {
+		alignment = uint32(info.ClusterSize)
+	}
+
+	config := blkConfig{
+		Capacity:               uint64(size) >> VIRTIO_BLK_SECTOR_BITS,
+		SegMax:                 VIRTQUEUE_MAX_SIZE - 2,
+		BlkSize:                uint32(srv.opts.LogicalBlockSize),
+		MinIOSize:              1,
+		OptIOSize:              1,
+		NumQueues:              uint16(srv.opts.NumQueues),
+		MaxDiscardSectors:      VHOST_USER_BLK_MAX_DISCARD_SECTORS,
+		MaxDiscardSeg:          1,
+		DiscardSectorAlignment: alignment >> VIRTIO_BLK_SECTOR_BITS,
+		MaxWriteZeroesSectors:  VHOST_USER_BLK_MAX_WRITE_ZEROES_SECTORS,
+		MaxWriteZeroesSeg:      1,
+		WriteZeroesMayUnmap:    1,
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &config)
+	return buf.Bytes(), nil
+}
+
+// processRequest processes the virtio-blk request of elem, and returns the number of bytes written to the in
+// buffers, including the status byte.
+//  block/export/virtio-blk-handler.c: int coroutine_fn virtio_blk_process_req(VirtioBlkHandler *handler, struct iovec *in_iov, struct iovec *out_iov, unsigned int in_num, unsigned int out_num)
+func (srv *Server) processRequest(elem *element) uint32 {
+	out := newIOVec(elem.out)
+	in := newIOVec(elem.in)
+
+	var hdr blkOuthdr
+	if err := binary.Read(out, binary.LittleEndian, &hdr); err != nil || in.len() < 1 {
+		// the request without the status can not be completed
+		return 0
+	}
+	tail := in.tail(1)
+
+	n, st := srv.handle(&hdr, out, in)
+	tail[0] = st
+	return uint32(n) + 1
+}
+
+// handle handles the request of hdr, whose data is out and in, and returns the number of bytes written to in and
+// the status.
+func (srv *Server) handle(hdr *blkOuthdr, out, in *iovec) (int64, byte) {
+	size, err := srv.img.VirtualSize()
+	if err != nil {
+		return 0, VIRTIO_BLK_S_IOERR
+	}
+	inRange := func(sector, n uint64) bool {
+		return sector <= uint64(size)>>VIRTIO_BLK_SECTOR_BITS &&
+			n <= uint64(size)-sector<<VIRTIO_BLK_SECTOR_BITS &&
+			sector<<VIRTIO_BLK_SECTOR_BITS%uint64(srv.opts.LogicalBlockSize) == 0 &&
+			n%uint64(srv.opts.LogicalBlockSize) == 0
+	}
+
+	typ := hdr.Type &^ VIRTIO_BLK_T_BARRIER
+	switch typ {
+	case VIRTIO_BLK_T_IN:
+		if !inRange(hdr.Sector, uint64(in.len())) {
+			return 0, VIRTIO_BLK_S_IOERR
+		}
+		off := int64(hdr.Sector << VIRTIO_BLK_SECTOR_BITS)
+		var n int64
+		for _, b := range in.bufs {
+			if _, err := srv.img.ReadAt(b, off+n); err != nil && err != io.EOF {
+				return n, status(err)
+			}
+			n += int64(len(b))
+		}
+		return n, VIRTIO_BLK_S_OK
+
+	case VIRTIO_BLK_T_OUT:
+		if srv.opts.ReadOnly {
+			return 0, VIRTIO_BLK_S_IOERR
+		}
+		if !inRange(hdr.Sector, uint64(out.len())) {
+			return 0, VIRTIO_BLK_S_IOERR
+		}
+		off := int64(hdr.Sector << VIRTIO_BLK_SECTOR_BITS)
+		for _, b := range out.bufs {
+			if _, err := srv.img.WriteAt(b, off); err != nil {
+				return 0, status(err)
+			}
+			off += int64(len(b))
+		}
+		return 0, VIRTIO_BLK_S_OK
+
+	case VIRTIO_BLK_T_FLUSH:
+		if err := srv.img.Flush(); err != nil {
+			return 0, status(err)
+		}
+		return 0, VIRTIO_BLK_S_OK
+
+	case VIRTIO_BLK_T_GET_ID:
+		id := make([]byte, VIRTIO_BLK_ID_BYTES)
+		copy(id, srv.opts.Serial)
+		return int64(in.copyTo(id)), VIRTIO_BLK_S_OK
+
+	case VIRTIO_BLK_T_DISCARD, VIRTIO_BLK_T_WRITE_ZEROES:
+		if srv.opts.ReadOnly {
+			return 0, VIRTIO_BLK_S_IOERR
+		}
+		// only the single segment is supported, same as max_discard_seg and max_write_zeroes_seg
+		var seg blkDiscardWriteZeroes
+		if out.len() != binary.Size(seg) {
+			return 0, VIRTIO_BLK_S_UNSUPP
+		}
+		binary.Read(out, binary.LittleEndian, &seg)
+
+		n := uint64(seg.NumSectors) << VIRTIO_BLK_SECTOR_BITS
+		if !inRange(seg.Sector, n) {
+			return 0, VIRTIO_BLK_S_IOERR
+		}
+		off := int64(seg.Sector << VIRTIO_BLK_SECTOR_BITS)
+
+		if typ == VIRTIO_BLK_T_DISCARD {
+			// the discard has no flags
+			if seg.Flags != 0 || seg.NumSectors > VHOST_USER_BLK_MAX_DISCARD_SECTORS {
+				return 0, VIRTIO_BLK_S_UNSUPP
+			}
+			if err := srv.img.Discard(off, int64(n)); err != nil {
+				return 0, status(err)
+			}
+			return 0, VIRTIO_BLK_S_OK
+		}
+
+		if seg.Flags&^VIRTIO_BLK_WRITE_ZEROES_FLAG_UNMAP != 0 || seg.NumSectors > VHOST_USER_BLK_MAX_WRITE_ZEROES_SECTORS {
+			return 0, VIRTIO_BLK_S_UNSUPP
+		}
+		var flags qcow2.BdrvRequestFlags
+		if seg.Flags&VIRTIO_BLK_WRITE_ZEROES_FLAG_UNMAP != 0 {
+			flags |= qcow2.BDRV_REQ_MAY_UNMAP
+		}
+		if err := srv.img.WriteZeroesFlags(off, int64(n), flags); err != nil {
+			return 0, status(err)
+		}
+		return 0, VIRTIO_BLK_S_OK
+
+	default:
+		return 0, VIRTIO_BLK_S_UNSUPP
+	}
+}
+
+// status returns the virtio-blk status of err.
+func status(err error) byte {
+	if errors.Is(err, syscall.ENOTSUP) {
+		return VIRTIO_BLK_S_UNSUPP
+	}
+	return VIRTIO_BLK_S_IOERR
+}
+
+// iovec represents the buffers of the descriptor chain, which is read from the head.
+//  include/qemu/iov.h
+type iovec struct {
+	bufs [][]byte
+}
+
+// newIOVec returns the iovec of bufs.
+func newIOVec(bufs [][]byte) *iovec {
+	return &iovec{bufs: bufs}
+}
+
+// len returns the number of bytes of the remaining buffers.
+func (v *iovec) len() int {
+	var n int
+	for _, b := range v.bufs {
+		n += len(b)
+	}
+	return n
+}
+
+// Read implements io.Reader, and discards the read bytes from the buffers.
+//  util/iov.c: size_t iov_discard_front(struct iovec **iov, unsigned int *iov_cnt, size_t bytes)
+func (v *iovec) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) && len(v.bufs) > 0 {
+		m := copy(p[n:], v.bufs[0])
+		n += m
+		v.bufs[0] = v.bufs[0][m:]
+		if len(v.bufs[0]) == 0 {
+			v.bufs = v.bufs[1:]
+		}
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// tail discards the last n bytes from the buffers, and returns them, which must be in the last buffer.
+//  util/iov.c: size_t iov_discard_back(struct iovec *iov, unsigned int *iov_cnt, size_t bytes)
+func (v *iovec) tail(n int) []byte {
+	for len(v.bufs) > 0 && len(v.bufs[len(v.bufs)-1]) == 0 {
+		v.bufs = v.bufs[:len(v.bufs)-1]
+	}
+	last := v.bufs[len(v.bufs)-1]
+	if len(last) < n {
+		n = len(last)
+	}
+	v.bufs[len(v.bufs)-1] = last[:len(last)-n]
+	return last[len(last)-n:]
+}
+
+// copyTo copies p to the buffers, and returns the number of bytes copied.
+//  util/iov.c: size_t iov_from_buf_full(const struct iovec *iov, unsigned int iov_cnt, size_t offset, const void *buf, size_t bytes)
+func (v *iovec) copyTo(p []byte) int {
+	var n int
+	for _, b := range v.bufs {
+		if n == len(p) {
+			break
+		}
+		n += copy(b, p[n:])
+	}
+	return n
+}
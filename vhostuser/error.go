@@ -0,0 +1,26 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vhostuser
+
+import (
+	"syscall"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// The errors returned by the Server and reported to its ErrorLog. The returned errors wrap them with the
+// message, so use errors.Is to test them. Each error also wraps the errno of the failure.
+var (
+	// ErrInvalidOption the option of the server is invalid.
+	ErrInvalidOption error = qcow2.NewError(syscall.EINVAL, "invalid vhost-user option")
+	// ErrInvalidMessage the message of the front-end is invalid.
+	ErrInvalidMessage error = qcow2.NewError(syscall.EINVAL, "invalid vhost-user message")
+	// ErrUnsupported the request of the front-end or the platform is not supported.
+	ErrUnsupported error = qcow2.NewError(syscall.ENOTSUP, "not supported by the vhost-user back-end")
+	// ErrNotMapped the guest address or the front-end address is not in the memory table of the front-end.
+	ErrNotMapped error = qcow2.NewError(syscall.EFAULT, "address is not mapped")
+	// ErrInvalidRing the guest put the invalid descriptor chain or index in the virtqueue.
+	ErrInvalidRing error = qcow2.NewError(syscall.EIO, "invalid virtqueue")
+)
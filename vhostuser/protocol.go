@@ -0,0 +1,218 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vhostuser
+
+// The requests of the vhost-user protocol.
+//  subprojects/libvhost-user/libvhost-user.h: typedef enum VhostUserRequest
+const (
+	VHOST_USER_NONE                  = 0
+	VHOST_USER_GET_FEATURES          = 1
+	VHOST_USER_SET_FEATURES          = 2
+	VHOST_USER_SET_OWNER             = 3
+	VHOST_USER_RESET_OWNER           = 4
+	VHOST_USER_SET_MEM_TABLE         = 5
+	VHOST_USER_SET_LOG_BASE          = 6
+	VHOST_USER_SET_LOG_FD            = 7
+	VHOST_USER_SET_VRING_NUM         = 8
+	VHOST_USER_SET_VRING_ADDR        = 9
+	VHOST_USER_SET_VRING_BASE        = 10
+	VHOST_USER_GET_VRING_BASE        = 11
+	VHOST_USER_SET_VRING_KICK        = 12
+	VHOST_USER_SET_VRING_CALL        = 13
+	VHOST_USER_SET_VRING_ERR         = 14
+	VHOST_USER_GET_PROTOCOL_FEATURES = 15
+	VHOST_USER_SET_PROTOCOL_FEATURES = 16
+	VHOST_USER_GET_QUEUE_NUM         = 17
+	VHOST_USER_SET_VRING_ENABLE      = 18
+	VHOST_USER_GET_CONFIG            = 24
+	VHOST_USER_SET_CONFIG            = 25
+)
+
+// The flags of the message header.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VhostUserMsg
+const (
+	VHOST_USER_VERSION_MASK = 0x3
+	VHOST_USER_REPLY_MASK   = 0x1 << 2
+	VHOST_USER_NEED_REPLY   = 0x1 << 3
+	VHOST_USER_VERSION      = 0x1
+)
+
+// The payload of SET_VRING_KICK, SET_VRING_CALL and SET_VRING_ERR.
+const (
+	VHOST_USER_VRING_IDX_MASK  = 0xff
+	VHOST_USER_VRING_NOFD_MASK = 0x1 << 8
+)
+
+const (
+	// VHOST_MEMORY_BASELINE_NREGIONS the maximum number of the memory regions of SET_MEM_TABLE.
+	VHOST_MEMORY_BASELINE_NREGIONS = 8
+	// VHOST_USER_MAX_CONFIG_SIZE the maximum size of the device config space of GET_CONFIG.
+	VHOST_USER_MAX_CONFIG_SIZE = 256
+	// VHOST_USER_HDR_SIZE the size of the message header.
+	VHOST_USER_HDR_SIZE = 12
+	// VHOST_USER_MAX_PAYLOAD the maximum size of the payload which the front-end sends.
+	VHOST_USER_MAX_PAYLOAD = 4096
+)
+
+// The protocol features.
+//  subprojects/libvhost-user/libvhost-user.h: enum VhostUserProtocolFeature
+const (
+	VHOST_USER_PROTOCOL_F_MQ        = 0
+	VHOST_USER_PROTOCOL_F_REPLY_ACK = 3
+	VHOST_USER_PROTOCOL_F_CONFIG    = 9
+)
+
+// The virtio device features.
+//  include/standard-headers/linux/virtio_config.h, virtio_ring.h and virtio_blk.h
+const (
+	VIRTIO_BLK_F_SIZE_MAX     = 1
+	VIRTIO_BLK_F_SEG_MAX      = 2
+	VIRTIO_BLK_F_RO           = 5
+	VIRTIO_BLK_F_BLK_SIZE     = 6
+	VIRTIO_BLK_F_FLUSH        = 9
+	VIRTIO_BLK_F_TOPOLOGY     = 10
+	VIRTIO_BLK_F_CONFIG_WCE   = 11
+	VIRTIO_BLK_F_MQ           = 12
+	VIRTIO_BLK_F_DISCARD      = 13
+	VIRTIO_BLK_F_WRITE_ZEROES = 14
+
+	VIRTIO_RING_F_INDIRECT_DESC    = 28
+	VHOST_USER_F_PROTOCOL_FEATURES = 30
+	VIRTIO_F_VERSION_1             = 32
+)
+
+// The types of the virtio-blk requests.
+//  include/standard-headers/linux/virtio_blk.h
+const (
+	VIRTIO_BLK_T_IN           = 0
+	VIRTIO_BLK_T_OUT          = 1
+	VIRTIO_BLK_T_FLUSH        = 4
+	VIRTIO_BLK_T_GET_ID       = 8
+	VIRTIO_BLK_T_DISCARD      = 11
+	VIRTIO_BLK_T_WRITE_ZEROES = 13
+
+	// VIRTIO_BLK_T_BARRIER the legacy barrier flag of the request type, which is ignored.
+	VIRTIO_BLK_T_BARRIER = 0x80000000
+
+	// VIRTIO_BLK_WRITE_ZEROES_FLAG_UNMAP the flag of the write zeroes segment which may unmap the range.
+	VIRTIO_BLK_WRITE_ZEROES_FLAG_UNMAP = 0x1
+
+	// VIRTIO_BLK_ID_BYTES the length of the serial of GET_ID.
+	VIRTIO_BLK_ID_BYTES = 20
+)
+
+// The status of the virtio-blk requests.
+const (
+	VIRTIO_BLK_S_OK     = 0
+	VIRTIO_BLK_S_IOERR  = 1
+	VIRTIO_BLK_S_UNSUPP = 2
+)
+
+// The flags of the virtqueue descriptors and rings.
+//  include/standard-headers/linux/virtio_ring.h
+const (
+	VRING_DESC_F_NEXT          = 1
+	VRING_DESC_F_WRITE         = 2
+	VRING_DESC_F_INDIRECT      = 4
+	VRING_AVAIL_F_NO_INTERRUPT = 1
+)
+
+// VIRTQUEUE_MAX_SIZE the maximum number of the descriptors of the virtqueue.
+//  subprojects/libvhost-user/libvhost-user.h: #define VIRTQUEUE_MAX_SIZE 1024
+const VIRTQUEUE_MAX_SIZE = 1024
+
+// msgHeader represents the header of the vhost-user message.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VhostUserMsg
+type msgHeader struct {
+	Request uint32
+	Flags   uint32
+	Size    uint32
+}
+
+// vringState represents the payload of SET_VRING_NUM, SET_VRING_BASE, GET_VRING_BASE and SET_VRING_ENABLE.
+//  include/standard-headers/linux/vhost_types.h: struct vhost_vring_state
+type vringState struct {
+	Index uint32
+	Num   uint32
+}
+
+// vringAddr represents the payload of SET_VRING_ADDR.
+//  include/standard-headers/linux/vhost_types.h: struct vhost_vring_addr
+type vringAddr struct {
+	Index         uint32
+	Flags         uint32
+	DescUserAddr  uint64
+	UsedUserAddr  uint64
+	AvailUserAddr uint64
+	LogGuestAddr  uint64
+}
+
+// memoryRegion represents the memory region of SET_MEM_TABLE.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VhostUserMemoryRegion
+type memoryRegion struct {
+	GuestPhysAddr uint64
+	MemorySize    uint64
+	UserspaceAddr uint64
+	MmapOffset    uint64
+}
+
+// memory represents the payload of SET_MEM_TABLE.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VhostUserMemory
+type memory struct {
+	Nregions uint32
+	Padding  uint32
+	Regions  [VHOST_MEMORY_BASELINE_NREGIONS]memoryRegion
+}
+
+// configHeader represents the header of the payload of GET_CONFIG and SET_CONFIG, which is followed by the
+// device config space.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VhostUserConfig
+type configHeader struct {
+	Offset uint32
+	Size   uint32
+	Flags  uint32
+}
+
+// blkConfig represents the device config space of virtio-blk.
+//  include/standard-headers/linux/virtio_blk.h: struct virtio_blk_config
+type blkConfig struct {
+	Capacity               uint64
+	SizeMax                uint32
+	SegMax                 uint32
+	Cylinders              uint16
+	Heads                  uint8
+	Sectors                uint8
+	BlkSize                uint32
+	PhysicalBlockExp       uint8
+	AlignmentOffset        uint8
+	MinIOSize              uint16
+	OptIOSize              uint32
+	WCE                    uint8
+	Unused                 uint8
+	NumQueues              uint16
+	MaxDiscardSectors      uint32
+	MaxDiscardSeg          uint32
+	DiscardSectorAlignment uint32
+	MaxWriteZeroesSectors  uint32
+	MaxWriteZeroesSeg      uint32
+	WriteZeroesMayUnmap    uint8
+	Unused1                [3]uint8
+}
+
+// blkOuthdr represents the header of the virtio-blk request.
+//  include/standard-headers/linux/virtio_blk.h: struct virtio_blk_outhdr
+type blkOuthdr struct {
+	Type   uint32
+	Ioprio uint32
+	Sector uint64
+}
+
+// blkDiscardWriteZeroes represents the segment of the discard and write zeroes requests.
+//  include/standard-headers/linux/virtio_blk.h: struct virtio_blk_discard_write_zeroes
+type blkDiscardWriteZeroes struct {
+	Sector     uint64
+	NumSectors uint32
+	Flags      uint32
+}
@@ -0,0 +1,662 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vhostuser exports the qcow2 image as the vhost-user-blk device, same as the vhost-user-blk export of
+// qemu-storage-daemon.
+//
+// The front-end, such as QEMU with the vhost-user-blk-pci device or cloud-hypervisor, connects to the unix
+// socket, and shares the guest memory and the virtqueues with the Server, so the requests of the guest are
+// processed directly from the shared memory without the block layer of the front-end. The guest memory must
+// be shared by the front-end, such as by the memory-backend-memfd with share=on.
+//
+// The split virtqueues with the indirect descriptors are supported. The packed virtqueues, the inflight
+// tracking and the migration of the dirty log are not supported. The host must be little-endian, same as the
+// byte order of virtio 1.0.
+package vhostuser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zchee/go-qcow2"
+)
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("vhostuser: Server closed")
+
+// Options options of the vhost-user-blk export. The zero value is the writable export of a single virtqueue.
+//  qapi/block-export.json: { 'struct': 'BlockExportOptionsVhostUserBlk' }
+type Options struct {
+	// ReadOnly exports the image as read-only. The read-only image is always exported as read-only.
+	ReadOnly bool
+	// NumQueues the number of the virtqueues. The default is 1.
+	NumQueues int
+	// LogicalBlockSize the logical block size of the device in bytes, which is a power of 2 from 512 to 32768.
+	// The default is 512.
+	LogicalBlockSize int
+	// Serial the serial of the device, which is truncated to 20 bytes.
+	Serial string
+}
+
+// Server serves the image to the front-end of the vhost-user-blk device. The front-ends are served one at a
+// time, and the next front-end can connect after the previous one disconnects.
+type Server struct {
+	img  *qcow2.QCow2
+	opts Options
+
+	mu       sync.Mutex
+	listener net.Listener
+	conn     net.Conn
+	closed   bool
+}
+
+// NewServer returns the new Server of img.
+//  block/export/vhost-user-blk-server.c: static int vu_blk_exp_create(BlockExport *exp, BlockExportOptions *opts, Error **errp)
+func NewServer(img *qcow2.QCow2, opts *Options) (*Server, error) {
+	srv := &Server{img: img}
+	if opts != nil {
+		srv.opts = *opts
+	}
+	if img.ReadOnly() {
+		srv.opts.ReadOnly = true
+	}
+
+	if srv.opts.NumQueues == 0 {
+		srv.opts.NumQueues = 1
+	}
+	if srv.opts.NumQueues < 0 || srv.opts.NumQueues > VHOST_USER_VRING_IDX_MASK {
+		return nil, errors.Wrapf(ErrInvalidOption, "Invalid number of queues %d", srv.opts.NumQueues)
+	}
+	if srv.opts.LogicalBlockSize == 0 {
+		srv.opts.LogicalBlockSize = 512
+	}
+	if bs := srv.opts.LogicalBlockSize; bs < 512 || bs > 32768 || bs&(bs-1) != 0 {
+		return nil, errors.Wrapf(ErrInvalidOption, "Logical block size %d is not a power of 2 from 512 to 32768", bs)
+	}
+
+	return srv, nil
+}
+
+// Serve accepts the front-ends on l, and serves them one at a time until Close is called.
+// It returns ErrServerClosed after Close is called.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listener = l
+	srv.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		uc, ok := conn.(*net.UnixConn)
+		if !ok {
+			conn.Close()
+			return errors.Wrap(ErrInvalidOption, "vhostuser: The listener must be the unix socket")
+		}
+
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		srv.conn = conn
+		srv.mu.Unlock()
+
+		s := newSession(srv, uc)
+		s.serve()
+
+		srv.mu.Lock()
+		srv.conn = nil
+		srv.mu.Unlock()
+	}
+}
+
+// Close closes the listener and the connection of the front-end, and Serve returns.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	if srv.conn != nil {
+		srv.conn.Close()
+	}
+	return err
+}
+
+// session represents the connection of the front-end.
+//  subprojects/libvhost-user/libvhost-user.h: struct VuDev
+type session struct {
+	srv  *Server
+	conn *net.UnixConn
+
+	mem              devMemory
+	vqs              []*virtqueue
+	features         uint64
+	protocolFeatures uint64
+}
+
+// newSession returns the session of the connection conn.
+//  subprojects/libvhost-user/libvhost-user.c: bool vu_init(VuDev *dev, uint16_t max_queues, int socket, vu_panic_cb panic, vu_read_msg_cb read_msg, vu_set_watch_cb set_watch, vu_remove_watch_cb remove_watch, const VuDevIface *iface)
+func newSession(srv *Server, conn *net.UnixConn) *session {
+	s := &session{
+		srv:  srv,
+		conn: conn,
+		vqs:  make([]*virtqueue, srv.opts.NumQueues),
+	}
+	for i := range s.vqs {
+		s.vqs[i] = &virtqueue{index: i}
+	}
+	return s
+}
+
+// serve handles the messages of the front-end until it disconnects, or sends the invalid message.
+//  subprojects/libvhost-user/libvhost-user.c: bool vu_dispatch(VuDev *dev)
+func (s *session) serve() {
+	defer s.close()
+
+	for {
+		hdr, payload, fds, err := s.readMsg()
+		if err != nil {
+			return
+		}
+
+		reply, err := s.processMsg(hdr, payload, fds)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case reply != nil:
+			err = s.writeMsg(hdr.Request, reply)
+		case hdr.Flags&VHOST_USER_NEED_REPLY != 0 && s.hasProtocolFeature(VHOST_USER_PROTOCOL_F_REPLY_ACK):
+			// the success of the request which has no reply
+			err = s.writeMsg(hdr.Request, uint64(0))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close stops all of the virtqueues, unmaps the guest memory and closes the connection.
+//  subprojects/libvhost-user/libvhost-user.c: void vu_deinit(VuDev *dev)
+func (s *session) close() {
+	for _, vq := range s.vqs {
+		s.stopQueue(vq)
+		if vq.call != nil {
+			vq.call.Close()
+			vq.call = nil
+		}
+	}
+	s.mem.unmap()
+	s.conn.Close()
+}
+
+// readMsg reads the message of the front-end, and the file descriptors sent with it.
+//  subprojects/libvhost-user/libvhost-user.c: bool vu_message_read_default(VuDev *dev, int conn_fd, VhostUserMsg *vmsg)
+func (s *session) readMsg() (*msgHeader, []byte, []int, error) {
+	buf := make([]byte, VHOST_USER_HDR_SIZE)
+	oob := make([]byte, fdsSpace(VHOST_MEMORY_BASELINE_NREGIONS))
+	n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n == 0 {
+		return nil, nil, nil, io.EOF
+	}
+	fds, err := parseFds(oob[:oobn])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n < len(buf) {
+		if _, err := io.ReadFull(s.conn, buf[n:]); err != nil {
+			closeFds(fds)
+			return nil, nil, nil, err
+		}
+	}
+
+	hdr := &msgHeader{
+		Request: binary.LittleEndian.Uint32(buf),
+		Flags:   binary.LittleEndian.Uint32(buf[4:]),
+		Size:    binary.LittleEndian.Uint32(buf[8:]),
+	}
+	if hdr.Size > VHOST_USER_MAX_PAYLOAD {
+		closeFds(fds)
+		return nil, nil, nil, errors.Wrapf(ErrInvalidMessage, "Request %d is too large: %d", hdr.Request, hdr.Size)
+	}
+	payload := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		closeFds(fds)
+		return nil, nil, nil, err
+	}
+
+	return hdr, payload, fds, nil
+}
+
+// writeMsg writes the reply v of the request.
+func (s *session) writeMsg(request uint32, v interface{}) error {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, v)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &msgHeader{
+		Request: request,
+		Flags:   VHOST_USER_VERSION | VHOST_USER_REPLY_MASK,
+		Size:    uint32(body.Len()),
+	})
+	buf.Write(body.Bytes())
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// hasFeature reports whether the virtio feature bit is negotiated.
+func (s *session) hasFeature(bit uint) bool {
+	return s.features&(1<<bit) != 0
+}
+
+// hasProtocolFeature reports whether the protocol feature bit is negotiated.
+func (s *session) hasProtocolFeature(bit uint) bool {
+	return s.protocolFeatures&(1<<bit) != 0
+}
+
+// processMsg processes the message, and returns its reply, or nil if the request has no reply. The file
+// descriptors are owned by processMsg.
+//  subprojects/libvhost-user/libvhost-user.c: static bool vu_process_message(VuDev *dev, VhostUserMsg *vmsg)
+func (s *session) processMsg(hdr *msgHeader, payload []byte, fds []int) (interface{}, error) {
+	switch hdr.Request {
+	case VHOST_USER_SET_MEM_TABLE, VHOST_USER_SET_VRING_KICK, VHOST_USER_SET_VRING_CALL, VHOST_USER_SET_VRING_ERR:
+	default:
+		closeFds(fds)
+		fds = nil
+	}
+
+	if hdr.Flags&VHOST_USER_VERSION_MASK != VHOST_USER_VERSION {
+		closeFds(fds)
+		return nil, errors.Wrapf(ErrInvalidMessage, "Invalid version of the request %d", hdr.Request)
+	}
+
+	switch hdr.Request {
+	case VHOST_USER_GET_FEATURES:
+		return s.srv.features(), nil
+
+	case VHOST_USER_SET_FEATURES:
+		var features uint64
+		if err := decode(payload, &features); err != nil {
+			return nil, err
+		}
+		if features&^s.srv.features() != 0 {
+			return nil, errors.Wrapf(ErrInvalidMessage, "Unsupported features 0x%x", features&^s.srv.features())
+		}
+		s.features = features
+		if !s.hasFeature(VHOST_USER_F_PROTOCOL_FEATURES) {
+			// the rings are enabled without SET_VRING_ENABLE
+			for _, vq := range s.vqs {
+				vq.enabled = true
+				s.startQueue(vq)
+			}
+		}
+		return nil, nil
+
+	case VHOST_USER_GET_PROTOCOL_FEATURES:
+		return uint64(protocolFeatures), nil
+
+	case VHOST_USER_SET_PROTOCOL_FEATURES:
+		var features uint64
+		if err := decode(payload, &features); err != nil {
+			return nil, err
+		}
+		s.protocolFeatures = features & protocolFeatures
+		return nil, nil
+
+	case VHOST_USER_SET_OWNER:
+		return nil, nil
+
+	case VHOST_USER_RESET_OWNER:
+		for _, vq := range s.vqs {
+			s.stopQueue(vq)
+		}
+		s.features = 0
+		return nil, nil
+
+	case VHOST_USER_GET_QUEUE_NUM:
+		return uint64(len(s.vqs)), nil
+
+	case VHOST_USER_SET_MEM_TABLE:
+		return nil, s.setMemTable(payload, fds)
+
+	case VHOST_USER_SET_VRING_NUM:
+		var state vringState
+		vq, err := s.decodeVring(payload, &state, &state.Index)
+		if err != nil {
+			return nil, err
+		}
+		if state.Num == 0 || state.Num > VIRTQUEUE_MAX_SIZE || state.Num&(state.Num-1) != 0 {
+			return nil, errors.Wrapf(ErrInvalidMessage, "Invalid size %d of vq %d", state.Num, state.Index)
+		}
+		// the kick handler indexes the rings by the size, which must not change under it
+		if vq.started {
+			return nil, errors.Wrapf(ErrInvalidMessage, "Size of the started vq %d can not be changed", state.Index)
+		}
+		vq.num = uint16(state.Num)
+		if vq.addr != nil {
+			// the rings are mapped by the previous size
+			if err := vq.mapRings(&s.mem); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	case VHOST_USER_SET_VRING_ADDR:
+		var addr vringAddr
+		vq, err := s.decodeVring(payload, &addr, &addr.Index)
+		if err != nil {
+			return nil, err
+		}
+		if vq.num == 0 {
+			return nil, errors.Wrapf(ErrInvalidMessage, "Size of vq %d is not set", addr.Index)
+		}
+		if err := vq.setAddr(&s.mem, &addr); err != nil {
+			return nil, err
+		}
+		s.startQueue(vq)
+		return nil, nil
+
+	case VHOST_USER_SET_VRING_BASE:
+		var state vringState
+		vq, err := s.decodeVring(payload, &state, &state.Index)
+		if err != nil {
+			return nil, err
+		}
+		vq.lastAvailIdx = uint16(state.Num)
+		return nil, nil
+
+	case VHOST_USER_GET_VRING_BASE:
+		var state vringState
+		vq, err := s.decodeVring(payload, &state, &state.Index)
+		if err != nil {
+			return nil, err
+		}
+		s.stopQueue(vq)
+		if vq.call != nil {
+			vq.call.Close()
+			vq.call = nil
+		}
+		vq.addr = nil
+		vq.desc, vq.avail, vq.used = nil, nil, nil
+		state.Num = uint32(vq.lastAvailIdx)
+		return &state, nil
+
+	case VHOST_USER_SET_VRING_KICK, VHOST_USER_SET_VRING_CALL, VHOST_USER_SET_VRING_ERR:
+		return nil, s.setVringFd(hdr.Request, payload, fds)
+
+	case VHOST_USER_SET_VRING_ENABLE:
+		var state vringState
+		vq, err := s.decodeVring(payload, &state, &state.Index)
+		if err != nil {
+			return nil, err
+		}
+		vq.enabled = state.Num != 0
+		if vq.enabled {
+			s.startQueue(vq)
+		}
+		return nil, nil
+
+	case VHOST_USER_GET_CONFIG:
+		var cfg configHeader
+		if err := decode(payload, &cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Size > VHOST_USER_MAX_CONFIG_SIZE {
+			return nil, errors.Wrapf(ErrInvalidMessage, "Invalid config size %d", cfg.Size)
+		}
+		config, err := s.srv.config()
+		if err != nil {
+			return nil, err
+		}
+		reply := make([]byte, binary.Size(cfg)+int(cfg.Size))
+		binary.LittleEndian.PutUint32(reply, cfg.Offset)
+		binary.LittleEndian.PutUint32(reply[4:], cfg.Size)
+		binary.LittleEndian.PutUint32(reply[8:], cfg.Flags)
+		if cfg.Offset < uint32(len(config)) {
+			copy(reply[binary.Size(cfg):], config[cfg.Offset:])
+		}
+		return reply, nil
+
+	case VHOST_USER_SET_CONFIG:
+		// the writable config field is only wce, which is not supported
+		return nil, nil
+
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "Unsupported request %d", hdr.Request)
+	}
+}
+
+// decodeVring decodes the payload of the vring request to v, whose index is *index, and returns the
+// virtqueue of the index.
+func (s *session) decodeVring(payload []byte, v interface{}, index *uint32) (*virtqueue, error) {
+	if err := decode(payload, v); err != nil {
+		return nil, err
+	}
+	if int(*index) >= len(s.vqs) {
+		return nil, errors.Wrapf(ErrInvalidMessage, "Invalid queue index %d", *index)
+	}
+	return s.vqs[*index], nil
+}
+
+// setMemTable maps the guest memory regions of the payload, whose file descriptors are fds, and replaces the
+// previous mapping. The front-end replaces the memory table on the memory hotplug without stopping the
+// virtqueues, so the rings are translated again in the new mapping, and the virtqueues are restarted.
+//  subprojects/libvhost-user/libvhost-user.c: static bool vu_set_mem_table_exec(VuDev *dev, VhostUserMsg *vmsg)
+func (s *session) setMemTable(payload []byte, fds []int) error {
+	defer closeFds(fds)
+
+	// the front-end sends only the regions in use
+	var mem memory
+	buf := make([]byte, binary.Size(mem))
+	n := copy(buf, payload)
+	if err := decode(buf, &mem); err != nil {
+		return err
+	}
+	if mem.Nregions > VHOST_MEMORY_BASELINE_NREGIONS || int(mem.Nregions) != len(fds) ||
+		n < 8+binary.Size(memoryRegion{})*int(mem.Nregions) {
+		return errors.Wrapf(ErrInvalidMessage, "Invalid memory table of %d regions and %d fds", mem.Nregions, len(fds))
+	}
+
+	// the rings refer to the previous mapping
+	for _, vq := range s.vqs {
+		s.pauseQueue(vq)
+		vq.desc, vq.avail, vq.used = nil, nil, nil
+	}
+	s.mem.unmap()
+
+	for i := 0; i < int(mem.Nregions); i++ {
+		r := mem.Regions[i]
+		m, err := mmap(fds[i], int(r.MemorySize+r.MmapOffset))
+		if err != nil {
+			s.mem.unmap()
+			return errors.Wrapf(err, "Could not map the memory region %d", i)
+		}
+		s.mem.regions = append(s.mem.regions, devRegion{
+			gpa:  r.GuestPhysAddr,
+			size: r.MemorySize,
+			qva:  r.UserspaceAddr,
+			mmap: m,
+			data: m[r.MmapOffset:],
+		})
+	}
+
+	for _, vq := range s.vqs {
+		if vq.addr == nil {
+			continue
+		}
+		if err := vq.mapRings(&s.mem); err != nil {
+			return errors.Wrapf(err, "Could not remap vq %d", vq.index)
+		}
+		s.startQueue(vq)
+	}
+
+	return nil
+}
+
+// setVringFd sets the kick, call or err notifier of the virtqueue of the payload.
+//  subprojects/libvhost-user/libvhost-user.c: static bool vu_set_vring_kick_exec(VuDev *dev, VhostUserMsg *vmsg)
+func (s *session) setVringFd(request uint32, payload []byte, fds []int) error {
+	var u64 uint64
+	if err := decode(payload, &u64); err != nil {
+		closeFds(fds)
+		return err
+	}
+	index := int(u64 & VHOST_USER_VRING_IDX_MASK)
+	nofd := u64&VHOST_USER_VRING_NOFD_MASK != 0
+	if index >= len(s.vqs) || (nofd && len(fds) != 0) || (!nofd && len(fds) != 1) {
+		closeFds(fds)
+		return errors.Wrapf(ErrInvalidMessage, "Invalid vring fd request 0x%x with %d fds", u64, len(fds))
+	}
+
+	vq := s.vqs[index]
+	var f *os.File
+	if !nofd {
+		var err error
+		if f, err = newEventFile(fds[0]); err != nil {
+			return err
+		}
+	}
+
+	switch request {
+	case VHOST_USER_SET_VRING_KICK:
+		s.stopQueue(vq)
+		if f == nil {
+			return errors.Wrapf(ErrUnsupported, "Polling of vq %d is not supported", index)
+		}
+		vq.kick = f
+		if !s.hasFeature(VHOST_USER_F_PROTOCOL_FEATURES) {
+			vq.enabled = true
+		}
+		s.startQueue(vq)
+	case VHOST_USER_SET_VRING_CALL:
+		vq.mu.Lock()
+		if vq.call != nil {
+			vq.call.Close()
+		}
+		vq.call = f
+		vq.mu.Unlock()
+	case VHOST_USER_SET_VRING_ERR:
+		// the errors are not reported by the notifier
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	return nil
+}
+
+// startQueue starts handling the kicks of the virtqueue, if it is enabled, and has the rings and the kick
+// notifier.
+//  subprojects/libvhost-user/libvhost-user.c: static bool vu_check_queue_msg_file(VuDev *dev, VhostUserMsg *vmsg)
+func (s *session) startQueue(vq *virtqueue) {
+	if vq.started || !vq.enabled || !vq.ready() || vq.kick == nil || len(s.mem.regions) == 0 {
+		return
+	}
+
+	vq.started = true
+	vq.stopped = make(chan struct{})
+	vq.handlers.Add(1)
+	go func() {
+		defer vq.handlers.Done()
+		s.handleKicks(vq)
+	}()
+}
+
+// stopQueue stops handling the kicks of the virtqueue, and waits until the requests in flight complete.
+// The kick notifier is closed.
+func (s *session) stopQueue(vq *virtqueue) {
+	s.pauseQueue(vq)
+	if vq.kick != nil {
+		vq.kick.Close()
+		vq.kick = nil
+	}
+}
+
+// pauseQueue stops handling the kicks of the virtqueue, and waits until the requests in flight complete.
+// The kick notifier is kept, so the virtqueue can be started again by startQueue.
+func (s *session) pauseQueue(vq *virtqueue) {
+	if !vq.started {
+		return
+	}
+	close(vq.stopped)
+	// interrupt the read of the kick notifier
+	vq.kick.SetReadDeadline(time.Now())
+	vq.handlers.Wait()
+	vq.kick.SetReadDeadline(time.Time{})
+	vq.started = false
+}
+
+// handleKicks processes the available requests of the virtqueue on each kick of the front-end, until the
+// virtqueue is stopped.
+//  block/export/vhost-user-blk-server.c: static void vu_blk_process_vq(VuDev *vu_dev, int idx)
+func (s *session) handleKicks(vq *virtqueue) {
+	kick := vq.kick
+	buf := make([]byte, 8)
+	for {
+		// the requests which are available before the virtqueue is started are also processed
+		for {
+			select {
+			case <-vq.stopped:
+				return
+			default:
+			}
+
+			elem, err := vq.pop(&s.mem)
+			if err != nil {
+				// the broken ring is not processed until the front-end resets it
+				<-vq.stopped
+				return
+			}
+			if elem == nil {
+				break
+			}
+
+			vq.handlers.Add(1)
+			go func() {
+				defer vq.handlers.Done()
+				vq.push(elem, s.srv.processRequest(elem))
+			}()
+		}
+
+		if _, err := kick.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// decode decodes the little-endian payload to v.
+func decode(payload []byte, v interface{}) error {
+	if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, v); err != nil {
+		return errors.Wrap(ErrInvalidMessage, "Invalid payload size")
+	}
+	return nil
+}
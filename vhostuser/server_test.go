@@ -0,0 +1,325 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package vhostuser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/zchee/go-qcow2"
+)
+
+// newTestSession returns the session of the new image, which is not connected to the front-end.
+func newTestSession(t *testing.T) *session {
+	t.Helper()
+
+	img, err := qcow2.CreateImage(filepath.Join(t.TempDir(), "export.qcow2"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSession(srv, nil)
+	t.Cleanup(func() {
+		for _, vq := range s.vqs {
+			s.stopQueue(vq)
+		}
+		s.mem.unmap()
+		img.Close()
+	})
+	return s
+}
+
+// send processes the request of the payload v, which is nil or encoded in little-endian, with fds.
+func send(s *session, request uint32, v interface{}, fds ...int) (interface{}, error) {
+	var payload bytes.Buffer
+	if v != nil {
+		binary.Write(&payload, binary.LittleEndian, v)
+	}
+	hdr := &msgHeader{Request: request, Flags: VHOST_USER_VERSION, Size: uint32(payload.Len())}
+	return s.processMsg(hdr, payload.Bytes(), fds)
+}
+
+// memFd returns the duplicated file descriptor of the new shared memory file of size bytes, which is owned by
+// the session it is sent to.
+func memFd(t *testing.T, size int64) int {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "mem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// memTable returns the payload of SET_MEM_TABLE of regions.
+func memTable(regions ...memoryRegion) *memory {
+	mem := &memory{Nregions: uint32(len(regions))}
+	copy(mem.Regions[:], regions)
+	return mem
+}
+
+func TestProcessMsg(t *testing.T) {
+	s := newTestSession(t)
+
+	reply, err := send(s, VHOST_USER_GET_FEATURES, nil)
+	if err != nil || reply != s.srv.features() {
+		t.Errorf("GET_FEATURES: %v, %v", reply, err)
+	}
+	if reply, err := send(s, VHOST_USER_GET_QUEUE_NUM, nil); err != nil || reply != uint64(1) {
+		t.Errorf("GET_QUEUE_NUM: %v, %v", reply, err)
+	}
+
+	tests := []struct {
+		name    string
+		request uint32
+		v       interface{}
+		want    error
+	}{
+		{name: "unsupported features", request: VHOST_USER_SET_FEATURES, v: uint64(1 << 63), want: ErrInvalidMessage},
+		{name: "short payload", request: VHOST_USER_SET_VRING_NUM, v: uint32(0), want: ErrInvalidMessage},
+		{name: "invalid queue index", request: VHOST_USER_SET_VRING_NUM, v: &vringState{Index: 1, Num: 8}, want: ErrInvalidMessage},
+		{name: "invalid size", request: VHOST_USER_SET_VRING_NUM, v: &vringState{Num: 3}, want: ErrInvalidMessage},
+		{name: "too large size", request: VHOST_USER_SET_VRING_NUM, v: &vringState{Num: 2 * VIRTQUEUE_MAX_SIZE}, want: ErrInvalidMessage},
+		{name: "address before size", request: VHOST_USER_SET_VRING_ADDR, v: &vringAddr{}, want: ErrInvalidMessage},
+		{name: "too large config", request: VHOST_USER_GET_CONFIG, v: &configHeader{Size: VHOST_USER_MAX_CONFIG_SIZE + 1}, want: ErrInvalidMessage},
+		{name: "kick without fd", request: VHOST_USER_SET_VRING_KICK, v: uint64(0), want: ErrInvalidMessage},
+		{name: "unsupported request", request: VHOST_USER_SET_LOG_BASE, v: uint64(0), want: ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := send(s, tt.request, tt.v); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	hdr := &msgHeader{Request: VHOST_USER_GET_FEATURES, Flags: VHOST_USER_VERSION + 1}
+	if _, err := s.processMsg(hdr, nil, nil); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("invalid version: got %v, want ErrInvalidMessage", err)
+	}
+
+	reply, err = send(s, VHOST_USER_GET_CONFIG, &configHeader{Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := reply.([]byte)
+	if capacity := binary.LittleEndian.Uint64(config[binary.Size(configHeader{}):]); capacity != 1<<20/512 {
+		t.Errorf("capacity %d, want %d", capacity, 1<<20/512)
+	}
+}
+
+// the layout of the rings in the memory region of the tests.
+const (
+	testQva       = 0x7f0000000000
+	testMemSize   = 64 << 10
+	testDescOff   = 0
+	testAvailOff  = 0x4000
+	testUsedOff   = 0x8000
+	testQueueSize = 8
+)
+
+var testRingAddr = &vringAddr{
+	DescUserAddr:  testQva + testDescOff,
+	AvailUserAddr: testQva + testAvailOff,
+	UsedUserAddr:  testQva + testUsedOff,
+}
+
+// TestSetMemTableRemap replaces the memory table while the virtqueue is started, same as the memory hotplug
+// of the front-end, and the rings are translated in the new mapping.
+func TestSetMemTableRemap(t *testing.T) {
+	s := newTestSession(t)
+
+	region := memoryRegion{MemorySize: testMemSize, UserspaceAddr: testQva}
+	if _, err := send(s, VHOST_USER_SET_MEM_TABLE, memTable(region), memFd(t, testMemSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(s, VHOST_USER_SET_VRING_NUM, &vringState{Num: testQueueSize}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(s, VHOST_USER_SET_VRING_ADDR, testRingAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	kick, err := syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rings are enabled by the kick without VHOST_USER_F_PROTOCOL_FEATURES
+	if _, err := send(s, VHOST_USER_SET_VRING_KICK, uint64(0), kick); err != nil {
+		t.Fatal(err)
+	}
+	vq := s.vqs[0]
+	if !vq.started {
+		t.Fatal("the virtqueue is not started")
+	}
+
+	if _, err := send(s, VHOST_USER_SET_VRING_NUM, &vringState{Num: 2 * testQueueSize}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("resize of the started virtqueue: got %v, want ErrInvalidMessage", err)
+	}
+	if vq.num != testQueueSize {
+		t.Errorf("size of the started virtqueue is changed to %d", vq.num)
+	}
+
+	// the hotplugged region is added after the region of the rings
+	hotplug := memoryRegion{GuestPhysAddr: 1 << 30, MemorySize: testMemSize, UserspaceAddr: testQva + 1<<30}
+	if _, err := send(s, VHOST_USER_SET_MEM_TABLE, memTable(region, hotplug), memFd(t, testMemSize), memFd(t, testMemSize)); err != nil {
+		t.Fatal(err)
+	}
+	if !vq.started || !vq.ready() {
+		t.Fatal("the virtqueue is not restarted after the memory table is replaced")
+	}
+	if &vq.avail[0] != &s.mem.regions[0].data[testAvailOff] {
+		t.Error("the available ring is not translated in the new mapping")
+	}
+	w.Write(make([]byte, 8))
+
+	// the rings are not mapped by the new memory table
+	if _, err := send(s, VHOST_USER_SET_MEM_TABLE, memTable(hotplug), memFd(t, testMemSize)); !errors.Is(err, ErrNotMapped) {
+		t.Errorf("memory table without the rings: got %v, want ErrNotMapped", err)
+	}
+	if vq.started || vq.ready() {
+		t.Error("the virtqueue of the unmapped rings is started")
+	}
+}
+
+// TestSetVringNum resizes the virtqueue which is not started, whose rings are translated by the new size.
+func TestSetVringNum(t *testing.T) {
+	s := newTestSession(t)
+
+	region := memoryRegion{MemorySize: testMemSize, UserspaceAddr: testQva}
+	if _, err := send(s, VHOST_USER_SET_MEM_TABLE, memTable(region), memFd(t, testMemSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(s, VHOST_USER_SET_VRING_NUM, &vringState{Num: testQueueSize}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(s, VHOST_USER_SET_VRING_ADDR, testRingAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(s, VHOST_USER_SET_VRING_NUM, &vringState{Num: VIRTQUEUE_MAX_SIZE}); err != nil {
+		t.Fatal(err)
+	}
+	vq := s.vqs[0]
+	if len(vq.avail) != 6+2*VIRTQUEUE_MAX_SIZE || len(vq.used) != 6+8*VIRTQUEUE_MAX_SIZE {
+		t.Errorf("rings of %d and %d bytes, want the size %d", len(vq.avail), len(vq.used), VIRTQUEUE_MAX_SIZE)
+	}
+
+	// the used ring of the larger size is beyond the end of the region
+	addr := *testRingAddr
+	addr.UsedUserAddr = testQva + testMemSize - 8*testQueueSize
+	if _, err := send(s, VHOST_USER_SET_VRING_ADDR, &addr); !errors.Is(err, ErrNotMapped) {
+		t.Errorf("used ring beyond the region: got %v, want ErrNotMapped", err)
+	}
+	if vq.ready() {
+		t.Error("the virtqueue of the invalid rings is ready")
+	}
+}
+
+// testRing returns the virtqueue of num descriptors, whose rings are in the memory which is not shared.
+func testRing(t *testing.T, num uint16) (*virtqueue, *devMemory, []byte) {
+	t.Helper()
+
+	buf := make([]byte, testMemSize)
+	mem := &devMemory{regions: []devRegion{{size: testMemSize, qva: testQva, data: buf}}}
+	vq := &virtqueue{num: num}
+	if err := vq.setAddr(mem, testRingAddr); err != nil {
+		t.Fatal(err)
+	}
+	return vq, mem, buf
+}
+
+// putDesc puts the i-th descriptor of the descriptor table of the test memory buf.
+func putDesc(buf []byte, i uint16, d vringDesc) {
+	b := buf[testDescOff+16*int(i):]
+	binary.LittleEndian.PutUint64(b, d.addr)
+	binary.LittleEndian.PutUint32(b[8:], d.len)
+	binary.LittleEndian.PutUint16(b[12:], d.flags)
+	binary.LittleEndian.PutUint16(b[14:], d.next)
+}
+
+// putAvail makes the head available at the ring index idx-1 of the test memory buf, whose available index is idx.
+func putAvail(buf []byte, num, idx, head uint16) {
+	binary.LittleEndian.PutUint16(buf[testAvailOff+4+2*int((idx-1)%num):], head)
+	binary.LittleEndian.PutUint16(buf[testAvailOff+2:], idx)
+}
+
+func TestPopMalformedRing(t *testing.T) {
+	const num = 4
+	const dataOff = 0xc000
+
+	tests := []struct {
+		name  string
+		last  uint16
+		avail uint16
+		head  uint16
+		descs []vringDesc
+		want  error
+	}{
+		{name: "valid", avail: 1, descs: []vringDesc{{addr: dataOff, len: 512}}},
+		{name: "wrapped index", last: 0xffff, avail: 0, descs: []vringDesc{{addr: dataOff, len: 512}}},
+		{name: "too many available", avail: num + 1, want: ErrInvalidRing},
+		{name: "head beyond the ring", avail: 1, head: num, want: ErrInvalidRing},
+		{name: "looped chain", avail: 1, descs: []vringDesc{{addr: dataOff, len: 512, flags: VRING_DESC_F_NEXT}}, want: ErrInvalidRing},
+		{name: "next beyond the table", avail: 1, descs: []vringDesc{{addr: dataOff, len: 512, flags: VRING_DESC_F_NEXT, next: num}}, want: ErrInvalidRing},
+		{name: "buffer beyond the memory", avail: 1, descs: []vringDesc{{addr: testMemSize - 8, len: 512}}, want: ErrNotMapped},
+		{name: "out after in", avail: 1, descs: []vringDesc{{addr: dataOff, len: 512, flags: VRING_DESC_F_WRITE | VRING_DESC_F_NEXT, next: 1}, {addr: dataOff, len: 512}}, want: ErrInvalidRing},
+		{name: "nested indirect", avail: 1, descs: []vringDesc{{addr: dataOff, len: 16, flags: VRING_DESC_F_INDIRECT}}, want: ErrInvalidRing},
+		{name: "misaligned indirect", avail: 1, descs: []vringDesc{{addr: dataOff, len: 15, flags: VRING_DESC_F_INDIRECT}}, want: ErrInvalidRing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vq, mem, buf := testRing(t, num)
+			vq.lastAvailIdx = tt.last
+			for i, d := range tt.descs {
+				putDesc(buf, uint16(i), d)
+			}
+			// the indirect table at dataOff, whose descriptor is indirect again
+			putDesc(buf[dataOff:], 0, vringDesc{addr: dataOff, len: 16, flags: VRING_DESC_F_INDIRECT})
+			putAvail(buf, num, tt.avail, tt.head)
+
+			elem, err := vq.pop(mem)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elem == nil || len(elem.out) != 1 || len(elem.out[0]) != 512 {
+				t.Fatalf("element %+v", elem)
+			}
+			if elem, err := vq.pop(mem); elem != nil || err != nil {
+				t.Errorf("second pop: %+v, %v", elem, err)
+			}
+		})
+	}
+}
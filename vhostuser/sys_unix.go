@@ -0,0 +1,67 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package vhostuser
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mmap maps the size bytes of the shared memory fd.
+func mmap(fd, size int) ([]byte, error) {
+	b, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap")
+	}
+	return b, nil
+}
+
+// munmap unmaps b, which is mapped by mmap.
+func munmap(b []byte) {
+	syscall.Munmap(b)
+}
+
+// fdsSpace returns the size of the control message of n file descriptors.
+func fdsSpace(n int) int {
+	return syscall.CmsgSpace(n * 4)
+}
+
+// parseFds returns the file descriptors of the control messages oob.
+func parseFds(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse the control message")
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// closeFds closes the file descriptors received from the front-end.
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// newEventFile returns the File of the eventfd fd, whose reads are interrupted by Close.
+func newEventFile(fd int) (*os.File, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "Could not set the eventfd to non-blocking")
+	}
+	return os.NewFile(uintptr(fd), "eventfd"), nil
+}
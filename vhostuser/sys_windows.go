@@ -0,0 +1,28 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vhostuser
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmap returns ENOTSUP, since the vhost-user-blk export is not supported on Windows.
+func mmap(fd, size int) ([]byte, error) {
+	return nil, errors.Wrap(ErrUnsupported, "vhostuser: vhost-user-blk export is not supported on Windows")
+}
+
+func munmap(b []byte) {}
+
+func fdsSpace(n int) int { return 0 }
+
+func parseFds(oob []byte) ([]int, error) { return nil, nil }
+
+func closeFds(fds []int) {}
+
+func newEventFile(fd int) (*os.File, error) {
+	return nil, errors.Wrap(ErrUnsupported, "vhostuser: vhost-user-blk export is not supported on Windows")
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vhostuser
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// devRegion represents the guest memory region shared by the front-end.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VuDevRegion
+type devRegion struct {
+	gpa  uint64 // uint64_t gpa
+	size uint64 // uint64_t size
+	qva  uint64 // uint64_t qva
+	// mmap the whole mapping of the region, which starts at the mmap offset before data.
+	mmap []byte
+	// data the guest memory of the region.
+	data []byte
+}
+
+// devMemory represents the guest memory shared by the front-end.
+type devMemory struct {
+	regions []devRegion
+}
+
+// gpaToVa returns the n bytes of the guest memory at the guest physical address gpa.
+//  subprojects/libvhost-user/libvhost-user.c: void *vu_gpa_to_va(VuDev *dev, uint64_t *plen, uint64_t guest_addr)
+func (m *devMemory) gpaToVa(gpa, n uint64) ([]byte, error) {
+	for i := range m.regions {
+		r := &m.regions[i]
+		if gpa >= r.gpa && gpa-r.gpa < r.size && n <= r.size-(gpa-r.gpa) {
+			off := gpa - r.gpa
+			return r.data[off : off+n : off+n], nil
+		}
+	}
+	return nil, errors.Wrapf(ErrNotMapped, "Guest address 0x%x+0x%x is not mapped", gpa, n)
+}
+
+// qvaToVa returns the n bytes of the guest memory at the virtual address qva of the front-end.
+//  subprojects/libvhost-user/libvhost-user.c: static void *qva_to_va(VuDev *dev, uint64_t qemu_addr)
+func (m *devMemory) qvaToVa(qva, n uint64) ([]byte, error) {
+	for i := range m.regions {
+		r := &m.regions[i]
+		if qva >= r.qva && qva-r.qva < r.size && n <= r.size-(qva-r.qva) {
+			off := qva - r.qva
+			return r.data[off : off+n : off+n], nil
+		}
+	}
+	return nil, errors.Wrapf(ErrNotMapped, "Front-end address 0x%x+0x%x is not mapped", qva, n)
+}
+
+// unmap unmaps all of the regions.
+func (m *devMemory) unmap() {
+	for _, r := range m.regions {
+		munmap(r.mmap)
+	}
+	m.regions = nil
+}
+
+// virtqueue represents the split virtqueue.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VuVirtq
+type virtqueue struct {
+	index int
+	num   uint16
+
+	// addr the addresses of the rings of SET_VRING_ADDR, which are translated again when the memory table is
+	// replaced, or nil if the rings are not set.
+	addr *vringAddr
+	// desc, avail and used the rings in the guest memory.
+	desc  []byte
+	avail []byte
+	used  []byte
+
+	// lastAvailIdx the index of the next available descriptor chain to be processed.
+	lastAvailIdx uint16
+	// usedIdx the index of the next used element.
+	usedIdx uint16
+
+	kick *os.File
+	call *os.File
+
+	// enabled whether the virtqueue is enabled by SET_VRING_ENABLE.
+	enabled bool
+	// started whether the kicks of the virtqueue are handled.
+	started bool
+	// stopped is closed to stop handling the kicks.
+	stopped chan struct{}
+	// handlers counts the kick handler and the requests in flight.
+	handlers sync.WaitGroup
+
+	// mu guards the used ring and the call notifier.
+	mu sync.Mutex
+}
+
+// vringDesc represents the descriptor of the virtqueue.
+//  include/standard-headers/linux/virtio_ring.h: struct vring_desc
+type vringDesc struct {
+	addr  uint64
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+// element represents the descriptor chain of the request, split into the device readable out buffers and the
+// device writable in buffers.
+//  subprojects/libvhost-user/libvhost-user.h: typedef struct VuVirtqElement
+type element struct {
+	index uint16
+	out   [][]byte
+	in    [][]byte
+}
+
+// setAddr sets the rings of the virtqueue to the addresses of addr, which are the virtual addresses of the
+// front-end.
+//  subprojects/libvhost-user/libvhost-user.c: static bool vu_set_vring_addr_exec(VuDev *dev, VhostUserMsg *vmsg)
+func (vq *virtqueue) setAddr(mem *devMemory, addr *vringAddr) error {
+	if addr.DescUserAddr%16 != 0 || addr.AvailUserAddr%2 != 0 || addr.UsedUserAddr%4 != 0 {
+		return errors.Wrapf(ErrInvalidMessage, "Invalid alignment of the rings of vq %d", vq.index)
+	}
+
+	a := *addr
+	vq.addr = &a
+	if err := vq.mapRings(mem); err != nil {
+		return err
+	}
+	// the front-end may have the requests in flight, which are resumed from the used index
+	vq.usedIdx = loadUint16(vq.used, 2)
+	return nil
+}
+
+// mapRings translates the addresses of the rings of SET_VRING_ADDR in mem, by the size of the virtqueue.
+// The rings are cleared if any of them is not mapped.
+//  subprojects/libvhost-user/libvhost-user.c: static bool map_ring(VuDev *dev, VuVirtq *vq)
+func (vq *virtqueue) mapRings(mem *devMemory) error {
+	vq.desc, vq.avail, vq.used = nil, nil, nil
+	addr := vq.addr
+
+	num := uint64(vq.num)
+	desc, err := mem.qvaToVa(addr.DescUserAddr, 16*num)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid descriptor table of vq %d", vq.index)
+	}
+	avail, err := mem.qvaToVa(addr.AvailUserAddr, 6+2*num)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid available ring of vq %d", vq.index)
+	}
+	used, err := mem.qvaToVa(addr.UsedUserAddr, 6+8*num)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid used ring of vq %d", vq.index)
+	}
+
+	vq.desc, vq.avail, vq.used = desc, avail, used
+	return nil
+}
+
+// ready reports whether the rings of the virtqueue are set.
+func (vq *virtqueue) ready() bool {
+	return vq.desc != nil && vq.avail != nil && vq.used != nil
+}
+
+// pop returns the next available descriptor chain, or nil if no descriptor chain is available.
+//  subprojects/libvhost-user/libvhost-user.c: void *vu_queue_pop(VuDev *dev, VuVirtq *vq, size_t sz)
+func (vq *virtqueue) pop(mem *devMemory) (*element, error) {
+	availIdx := loadUint16(vq.avail, 2)
+	if availIdx == vq.lastAvailIdx {
+		return nil, nil
+	}
+	if uint16(availIdx-vq.lastAvailIdx) > vq.num {
+		return nil, errors.Wrapf(ErrInvalidRing, "Guest moved used index from %d to %d", vq.lastAvailIdx, availIdx)
+	}
+
+	head := binary.LittleEndian.Uint16(vq.avail[4+2*(vq.lastAvailIdx%vq.num):])
+	vq.lastAvailIdx++
+	if head >= vq.num {
+		return nil, errors.Wrapf(ErrInvalidRing, "Guest says index %d is available", head)
+	}
+
+	elem := &element{index: head}
+	if err := vq.readChain(mem, elem, vq.desc, head, false); err != nil {
+		return nil, err
+	}
+	return elem, nil
+}
+
+// readChain reads the descriptor chain of the table desc from i to elem.
+//  subprojects/libvhost-user/libvhost-user.c: static void *vu_queue_map_desc(VuDev *dev, VuVirtq *vq, unsigned int idx, size_t sz)
+func (vq *virtqueue) readChain(mem *devMemory, elem *element, desc []byte, i uint16, indirect bool) error {
+	max := len(desc) / 16
+	for n := 0; ; n++ {
+		if n >= max || int(i) >= max {
+			return errors.Wrap(ErrInvalidRing, "Looped or invalid descriptor chain")
+		}
+
+		d := readDesc(desc, i)
+		if d.flags&VRING_DESC_F_INDIRECT != 0 {
+			if indirect || d.len%16 != 0 || d.len == 0 {
+				return errors.Wrap(ErrInvalidRing, "Invalid indirect descriptor table")
+			}
+			table, err := mem.gpaToVa(d.addr, uint64(d.len))
+			if err != nil {
+				return err
+			}
+			// the indirect descriptor must be the only descriptor of the chain
+			return vq.readChain(mem, elem, table, 0, true)
+		}
+
+		buf, err := mem.gpaToVa(d.addr, uint64(d.len))
+		if err != nil {
+			return err
+		}
+		if d.flags&VRING_DESC_F_WRITE != 0 {
+			elem.in = append(elem.in, buf)
+		} else {
+			if len(elem.in) > 0 {
+				return errors.Wrap(ErrInvalidRing, "Incorrect order for descriptors")
+			}
+			elem.out = append(elem.out, buf)
+		}
+
+		if d.flags&VRING_DESC_F_NEXT == 0 {
+			return nil
+		}
+		i = d.next
+	}
+}
+
+// push returns the processed descriptor chain of elem to the front-end, whose len bytes are written, and
+// notifies the front-end unless it suppresses the notification.
+//  subprojects/libvhost-user/libvhost-user.c: void vu_queue_push(VuDev *dev, VuVirtq *vq, const VuVirtqElement *elem, unsigned int len)
+func (vq *virtqueue) push(elem *element, len uint32) {
+	vq.mu.Lock()
+	defer vq.mu.Unlock()
+
+	e := vq.used[4+8*uint32(vq.usedIdx%vq.num):]
+	binary.LittleEndian.PutUint32(e, uint32(elem.index))
+	binary.LittleEndian.PutUint32(e[4:], len)
+	vq.usedIdx++
+
+	// the used element must be visible before the used index, and the used index before the flags of the
+	// available ring are read
+	storeUint16Pair(vq.used, 0, vq.usedIdx)
+	if loadUint16(vq.avail, 0)&VRING_AVAIL_F_NO_INTERRUPT != 0 || vq.call == nil {
+		return
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], 1)
+	vq.call.Write(buf[:])
+}
+
+// readDesc reads the i-th descriptor of the table desc.
+func readDesc(desc []byte, i uint16) vringDesc {
+	b := desc[16*int(i):]
+	return vringDesc{
+		addr:  binary.LittleEndian.Uint64(b),
+		len:   binary.LittleEndian.Uint32(b[8:]),
+		flags: binary.LittleEndian.Uint16(b[12:]),
+		next:  binary.LittleEndian.Uint16(b[14:]),
+	}
+}
+
+// loadUint16 atomically loads the little-endian uint16 at b[off:], which the front-end writes concurrently.
+// The uint16 is loaded by the aligned uint32 which contains it, which is in the same ring.
+func loadUint16(b []byte, off int) uint16 {
+	shift := (uintptr(unsafe.Pointer(&b[off])) & 3) * 8
+	v := atomic.LoadUint32((*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(&b[off])) &^ 3)))
+	return uint16(v >> shift)
+}
+
+// storeUint16Pair atomically stores the pair of the little-endian uint16 at b[off:], which is the zero flags
+// and the index v of the used ring, so the index is published after the used elements.
+func storeUint16Pair(b []byte, off int, v uint16) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b[off])), uint32(v)<<16)
+}
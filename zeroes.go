@@ -0,0 +1,98 @@
+// Copyright 2016 The go-qcow2 Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// QCow2 image format specifications is under the QEMU license.
+
+package qcow2
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// WriteZeroes writes zeros to the guest data from off to off+length.
+// For the compat=1.1 image, the whole clusters in the range are marked as the zero clusters by the
+// OFLAG_ZERO flag, without writing the zeros to the image file. The allocated clusters keep its host offset.
+// For the compat=0.10 image, and the partial clusters which can not be the zero clusters, the clusters
+// are allocated and written zeros.
+//  block/block-backend.c: int blk_pwrite_zeroes(BlockBackend *blk, int64_t offset, int count, BdrvRequestFlags flags)
+func (q *QCow2) WriteZeroes(off, length int64) error {
+	return q.WriteZeroesFlags(off, length, 0)
+}
+
+// WriteZeroesFlags is like WriteZeroes, but writes zeros with flags. BDRV_REQ_FUA writes the zeros through to
+// the disk, same as WriteAtFlags, and BDRV_REQ_MAY_UNMAP allows the zeroed clusters to be freed.
+//  block/block-backend.c: int blk_pwrite_zeroes(BlockBackend *blk, int64_t offset, int count, BdrvRequestFlags flags)
+func (q *QCow2) WriteZeroesFlags(off, length int64, flags BdrvRequestFlags) error {
+	if flags&^(BDRV_REQ_FUA|BDRV_REQ_MAY_UNMAP) != 0 {
+		err := errors.Wrapf(ErrInvalidArgument, "Unsupported write zeroes flags %#x", flags&^(BDRV_REQ_FUA|BDRV_REQ_MAY_UNMAP))
+		return err
+	}
+
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	bdrvIncInFlight(bs)
+	defer bdrvDecInFlight(bs)
+
+	if err := q.blk.pwriteZeroes(context.Background(), off, length, flags); err != nil {
+		err = errors.Wrapf(err, "Could not write zeros at offset %d", off)
+		return err
+	}
+
+	return nil
+}
+
+// SetDetectZeroes sets the detection of the zero writes, same as the detect-zeroes option of qemu.
+// If mode is not DETECT_ZEROES_OFF, the written buffers which are all zeros are written as the zero clusters
+// instead of writing the zeros to the image file, which prevents the image from growing by the guest zero writes.
+// DETECT_ZEROES_UNMAP also frees the host clusters of the zeroed clusters, which are discarded in the image file
+// if the passthrough of DISCARD_REQUEST is enabled by SetDiscardPassthrough.
+//  block.c: static int bdrv_open_common(BlockDriverState *bs, BlockBackend *file, QDict *options, Error **errp)
+func (q *QCow2) SetDetectZeroes(mode DetectZeroes) error {
+	bs := q.blk.bs()
+	if bs == nil {
+		return ENOMEDIUM
+	}
+	if mode < 0 || mode >= DETECT_ZEROES__MAX {
+		err := errors.Wrapf(ErrInvalidArgument, "Invalid detect-zeroes mode %d", mode)
+		return err
+	}
+
+	bdrvDrainedBegin(bs)
+	bs.DetectZeroes = mode
+	bdrvDrainedEnd(bs)
+
+	return nil
+}
+
+// detectZeroesLookup the names of DetectZeroes.
+//  qapi-types.c: const char *const BlockdevDetectZeroesOptions_lookup[]
+var detectZeroesLookup = [DETECT_ZEROES__MAX]string{
+	DETECT_ZEROES_OFF:   "off",
+	DETECT_ZEROES_ON:    "on",
+	DETECT_ZEROES_UNMAP: "unmap",
+}
+
+// String implements fmt.Stringer.
+func (d DetectZeroes) String() string {
+	if d < 0 || d >= DETECT_ZEROES__MAX {
+		return fmt.Sprintf("DetectZeroes(%d)", int(d))
+	}
+	return detectZeroesLookup[d]
+}
+
+// ParseDetectZeroes parses the detect-zeroes option value "off", "on" or "unmap".
+func ParseDetectZeroes(s string) (DetectZeroes, error) {
+	for i, name := range detectZeroesLookup {
+		if s == name {
+			return DetectZeroes(i), nil
+		}
+	}
+
+	return DETECT_ZEROES_OFF, errors.Wrapf(ErrInvalidOption, "Invalid detect-zeroes value '%s'", s)
+}